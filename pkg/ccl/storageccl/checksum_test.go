@@ -0,0 +1,102 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package storageccl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestIncrementalChecksumReplicas verifies that the replicas of a range
+// compute the same incremental checksum for the same window.
+func TestIncrementalChecksumReplicas(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3, base.TestClusterArgs{
+		ReplicationMode: base.ReplicationManual,
+	})
+	defer tc.Stopper().Stop(ctx)
+	kvDB := tc.Server(0).KVClient().(*client.DB)
+
+	desc, err := tc.LookupRange(keys.UserTableDataMin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.AddReplicas(desc.StartKey.AsRawKey(), tc.Target(1), tc.Target(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := tc.Server(0).Clock().Now()
+	for i := 0; i < 10; i++ {
+		key := append(keys.MakeTablePrefix(100), fmt.Sprintf("key%d", i)...)
+		if err := kvDB.Put(ctx, key, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	endTime := tc.Server(0).Clock().Now()
+
+	// checksums returns the checksums of the replicas for the window.
+	checksums := func(startTime, endTime hlc.Timestamp) ([][]byte, error) {
+		var res [][]byte
+		for i := 0; i < tc.NumServers(); i++ {
+			store, err := tc.Servers[i].Stores().GetStore(tc.Servers[i].GetFirstStoreID())
+			if err != nil {
+				return nil, err
+			}
+			repl := store.LookupReplica(desc.StartKey, nil)
+			if repl == nil {
+				return nil, errors.Errorf("no replica of r%d on store %d", desc.RangeID, store.StoreID())
+			}
+			checksum, err := repl.IncrementalChecksum(ctx, startTime, endTime)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, checksum)
+		}
+		return res, nil
+	}
+
+	// The followers may not have applied the writes yet.
+	var sums [][]byte
+	testutils.SucceedsSoon(t, func() error {
+		var err error
+		if sums, err = checksums(startTime, endTime); err != nil {
+			return err
+		}
+		for i := 1; i < len(sums); i++ {
+			if !bytes.Equal(sums[i], sums[0]) {
+				return errors.Errorf("replica %d has checksum %x, replica 0 has %x", i, sums[i], sums[0])
+			}
+		}
+		return nil
+	})
+
+	// The window before the writes has a different checksum.
+	before, err := checksums(hlc.Timestamp{}, startTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before[0], sums[0]) {
+		t.Errorf("expected the checksums of different windows to differ, got %x", sums[0])
+	}
+}
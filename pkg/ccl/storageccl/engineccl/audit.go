@@ -0,0 +1,241 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"math/rand"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+// AuditFraction is the fraction of the iterations of MVCCIncrementalIterators
+// using time-bound iterators which are audited, to continuously check in
+// production that skipping sstables by their timestamps doesn't change what
+// an iteration emits. An audited iteration takes a snapshot of the engine when
+// it starts, and once it completes, reruns the iteration on the snapshot
+// without a time-bound iterator in the background and compares the digests of
+// the key/values emitted by the two. A mismatch is logged with the span and
+// time range of the iteration, for reproducing it offline, and counted in
+// IteratorMetrics.AuditMismatches. The setting is read when an iteration
+// starts.
+//
+// The snapshot is of the engine rather than of the reader iterated over, so
+// an audit is only meaningful if the reader sees the same data in the time
+// range as the engine, as for an ExportRequest, whose span is latched and
+// whose end time is its timestamp. Only the iterations of iterators given an
+// MVCCIncrementalIteratorOptions.AuditStopper and AuditSem are audited, as the
+// reruns run as tasks of the stopper.
+var AuditFraction = func() *settings.FloatSetting {
+	name := "kv.incremental_iterator.audit_fraction"
+	s := settings.RegisterNonNegativeFloatSetting(name, "fraction of incremental iterations using "+
+		"time-bound iterators which are audited against an iteration without them", 0)
+	settings.Hide(name)
+	return s
+}()
+
+// auditTestingKnobs are the hooks of the audits of an iterator's iterations.
+type auditTestingKnobs struct {
+	// divergeAudit, if set, is called with each key/value emitted by the
+	// rerun of an audited iteration, and returns the key/value to digest in
+	// its place, so that tests can simulate a divergence.
+	divergeAudit func(engine.MVCCKeyValue) engine.MVCCKeyValue
+	// afterAudit, if set, is called once an audit has completed, with whether
+	// it found a mismatch.
+	afterAudit func(mismatch bool)
+}
+
+// iterationAudit is the audit of an iteration of an MVCCIncrementalIterator.
+// It digests the key/values emitted by the iteration as they are emitted, and
+// once the iteration completes, reruns it on the snapshot taken when it
+// started.
+type iterationAudit struct {
+	snapshot engine.Reader
+	span     roachpb.Span
+	window   hlc.TimestampWindow
+	// opts, skipAbortedIntents and skipped are those of the audited
+	// iteration.
+	opts               MVCCIncrementalIteratorOptions
+	skipAbortedIntents bool
+	skipped            []roachpb.Span
+	metrics            *IteratorMetrics
+	knobs              auditTestingKnobs
+	// stopper runs the rerun, limited by sem.
+	stopper *stop.Stopper
+	sem     chan struct{}
+
+	h     hash.Hash
+	buf   [binary.MaxVarintLen64]byte
+	count int64
+}
+
+// maybeStartAudit samples the iteration starting at the iterator's position
+// for an audit, if it uses a time-bound iterator; see AuditFraction. Only the
+// iterations of an engine, or of a reader of the engine supplied in
+// MVCCIncrementalIteratorOptions.Engine, can be audited.
+func (i *MVCCIncrementalIterator) maybeStartAudit() {
+	if !i.timeBound || i.opts.AuditStopper == nil || i.opts.AuditSem == nil {
+		return
+	}
+	if fraction := AuditFraction.Get(); fraction <= 0 || rand.Float64() >= fraction {
+		return
+	}
+	eng := i.eng
+	if eng == nil {
+		var ok bool
+		if eng, ok = i.reader.(engine.Engine); !ok {
+			return
+		}
+	}
+	i.audit = &iterationAudit{
+		snapshot:           eng.NewSnapshot(),
+		span:               i.iterCtx.Span,
+		window:             i.window,
+		opts:               i.opts,
+		skipAbortedIntents: i.skipAbortedIntents,
+		skipped:            i.skipped,
+		metrics:            i.metrics,
+		knobs:              i.auditKnobs,
+		stopper:            i.opts.AuditStopper,
+		sem:                i.opts.AuditSem,
+		h:                  sha256.New(),
+	}
+}
+
+// finishAudit ends the audit of the current iteration, if any. The audit of an
+// iteration which completed is run as an async task of the audit's stopper,
+// while that of one which failed or was abandoned, or for which the
+// semaphore has no capacity, is dropped.
+func (i *MVCCIncrementalIterator) finishAudit() {
+	a := i.audit
+	if a == nil {
+		return
+	}
+	i.audit = nil
+	if i.valid || i.err != nil {
+		a.snapshot.Close()
+		return
+	}
+	ctx := context.Background()
+	if err := a.stopper.RunLimitedAsyncTask(ctx, a.sem, false /* wait */, a.run); err != nil {
+		log.VEventf(ctx, 2, "audit of incremental iteration over %s in %s dropped: %s", a.span, a.window, err)
+		a.snapshot.Close()
+	}
+}
+
+// add digests a key/value emitted by the audited iteration.
+func (a *iterationAudit) add(key engine.MVCCKey, value []byte) {
+	hashKV(a.h, &a.buf, engine.MVCCKeyValue{Key: key, Value: value})
+	a.count++
+}
+
+// run reruns the audited iteration on the snapshot, compares the results, and
+// closes the snapshot. An audit which the quiescence of its stopper stops is
+// neither logged nor counted.
+func (a *iterationAudit) run(ctx context.Context) {
+	defer a.snapshot.Close()
+	expected := a.h.Sum(nil)
+	digest, count, err := a.rerun()
+	if err == errAuditQuiesced {
+		return
+	}
+	mismatch := err == nil && (count != a.count || !bytes.Equal(digest, expected))
+	if err != nil {
+		log.Warningf(ctx, "audit of incremental iteration over %s in %s failed: %s", a.span, a.window, err)
+	} else if mismatch {
+		log.Errorf(ctx, "audit of incremental iteration over %s in %s failed: the time-bound "+
+			"iteration emitted %d key/values with digest %x, and an iteration without it %d with "+
+			"digest %x", a.span, a.window, a.count, expected, count, digest)
+	}
+	if a.metrics != nil {
+		a.metrics.Audits.Inc(1)
+		if mismatch {
+			a.metrics.AuditMismatches.Inc(1)
+		}
+	}
+	if a.knobs.afterAudit != nil {
+		a.knobs.afterAudit(mismatch)
+	}
+}
+
+// errAuditQuiesced is returned by iterationAudit.rerun if the stopper
+// quiesces while it runs.
+var errAuditQuiesced = errors.New("audit stopped by quiescence")
+
+// rerun iterates over the span of the snapshot in the time range with the
+// options of the audited iteration, but without a time-bound iterator, and
+// returns the digest and number of the key/values emitted. It stops with
+// errAuditQuiesced once the stopper quiesces, so that the snapshot is closed
+// before the engine is.
+func (a *iterationAudit) rerun() ([]byte, int64, error) {
+	opts := a.opts
+	opts.TimeBound = false
+	opts.AuditStopper = nil
+	opts.AuditSem = nil
+	opts.SkipAbortedIntents = a.skipAbortedIntents
+	opts.SecondaryReader = nil
+	opts.Engine = nil
+	opts.Metrics = nil
+	opts.RecheckDescriptor = nil
+	iter := NewMVCCIncrementalIterator(a.snapshot, opts)
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		return nil, 0, err
+	}
+	if iter.timeBound {
+		// TimeBoundIteratorsEnabled makes every iterator time-bound, which is
+		// what's being audited.
+		iter.iter.Close()
+		iter.iter, iter.timeBound = a.snapshot.NewIterator(false), false
+	}
+	iter.SkipSpans(a.skipped)
+
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	var count int64
+	quiesce := a.stopper.ShouldQuiesce()
+	for iter.Reset(a.span.Key, a.span.EndKey); ; iter.Next() {
+		select {
+		case <-quiesce:
+			return nil, 0, errAuditQuiesced
+		default:
+		}
+		ok, err := iter.ValidWithErr()
+		if err != nil {
+			switch err.(type) {
+			case *ValueTooLargeError, *ChecksumMismatchError:
+				// The audited iteration completed, so its caller skipped the
+				// value by calling Next.
+				continue
+			}
+			return nil, 0, err
+		}
+		if !ok {
+			break
+		}
+		kv := engine.MVCCKeyValue{Key: iter.UnsafeKey(), Value: iter.UnsafeValue()}
+		if a.knobs.divergeAudit != nil {
+			kv = a.knobs.divergeAudit(kv)
+		}
+		hashKV(h, &buf, kv)
+		count++
+	}
+	return h.Sum(nil), count, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+// TestMVCCIncrementalIteratorAudit verifies that with every iteration audited,
+// an iteration using a time-bound iterator is rerun in the background once it
+// completes, and that a divergence of the rerun, injected by a testing knob,
+// is counted and logged with the span and time range of the iteration.
+func TestMVCCIncrementalIteratorAudit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	sc := log.ScopeWithoutShowLogs(t)
+	defer sc.Close(t)
+	defer settings.TestingSetFloat(&AuditFraction, 1)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	if err := GenerateExportTestData(ctx, e, 1, 100, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	span := roachpb.Span{Key: roachpb.KeyMin, EndKey: roachpb.KeyMax}
+	startTime, endTime := hlc.Timestamp{WallTime: 3}, hlc.Timestamp{WallTime: 8}
+	// The semaphore has capacity for all of the audits, which may still hold
+	// it briefly once they've completed.
+	sem := make(chan struct{}, 4)
+
+	for _, diverge := range []bool{false, true} {
+		t.Run(fmt.Sprintf("diverge=%t", diverge), func(t *testing.T) {
+			metrics := NewIteratorMetrics()
+			iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+				StartTime:    startTime,
+				EndTime:      endTime,
+				TimeBound:    true,
+				Metrics:      metrics,
+				AuditStopper: stopper,
+				AuditSem:     sem,
+			})
+			done := make(chan bool, 1)
+			iter.auditKnobs.afterAudit = func(mismatch bool) { done <- mismatch }
+			if diverge {
+				iter.auditKnobs.divergeAudit = func(kv engine.MVCCKeyValue) engine.MVCCKeyValue {
+					kv.Key.Timestamp = kv.Key.Timestamp.Next()
+					return kv
+				}
+			}
+			var emitted int
+			for iter.Reset(span.Key, span.EndKey); ; iter.Next() {
+				if ok, err := iter.ValidWithErr(); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					break
+				}
+				emitted++
+			}
+			if emitted == 0 {
+				t.Fatal("expected the iteration to emit key/values")
+			}
+			if iter.audit == nil {
+				t.Fatal("expected the iteration to be audited")
+			}
+			// The audit runs once the iteration is superseded or the iterator
+			// closed.
+			iter.Close()
+			if mismatch := <-done; mismatch != diverge {
+				t.Fatalf("expected mismatch=%t, got %t", diverge, mismatch)
+			}
+			var expectedMismatches int64
+			if diverge {
+				expectedMismatches = 1
+			}
+			if a := metrics.Audits.Count(); a != 1 {
+				t.Errorf("expected 1 audit, got %d", a)
+			}
+			if a := metrics.AuditMismatches.Count(); a != expectedMismatches {
+				t.Errorf("expected %d audit mismatches, got %d", expectedMismatches, a)
+			}
+		})
+	}
+
+	log.Flush()
+	entries, err := log.FetchEntriesFromFiles(0, math.MaxInt64, 100,
+		regexp.MustCompile(`audit of incremental iteration`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the mismatch to be logged once, got %d entries", len(entries))
+	}
+	window := hlc.TimestampWindow{Start: startTime, End: endTime}
+	for _, s := range []string{span.String(), window.String()} {
+		if !strings.Contains(entries[0].Message, s) {
+			t.Errorf("expected the log entry to contain %q, got %q", s, entries[0].Message)
+		}
+	}
+
+	t.Run("unaudited", func(t *testing.T) {
+		// An iteration which doesn't use a time-bound iterator, or whose
+		// iterator has no stopper to run the audit, is not audited.
+		for _, opts := range []MVCCIncrementalIteratorOptions{
+			{StartTime: startTime, EndTime: endTime, AuditStopper: stopper, AuditSem: sem},
+			{StartTime: startTime, EndTime: endTime, TimeBound: true},
+		} {
+			iter := NewMVCCIncrementalIterator(e, opts)
+			iter.Reset(span.Key, span.EndKey)
+			if iter.audit != nil {
+				t.Fatalf("expected an iteration with options %+v not to be audited", opts)
+			}
+			iter.Close()
+		}
+	})
+
+	// iterate runs an audited iteration to completion, and returns its audit.
+	iterate := func(t *testing.T, stopper *stop.Stopper, sem chan struct{}, metrics *IteratorMetrics,
+		knobs auditTestingKnobs) *iterationAudit {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime:    startTime,
+			EndTime:      endTime,
+			TimeBound:    true,
+			Metrics:      metrics,
+			AuditStopper: stopper,
+			AuditSem:     sem,
+		})
+		iter.auditKnobs = knobs
+		for iter.Reset(span.Key, span.EndKey); iter.Valid(); iter.Next() {
+		}
+		a := iter.audit
+		if a == nil {
+			t.Fatal("expected the iteration to be audited")
+		}
+		iter.Close()
+		return a
+	}
+
+	t.Run("throttled", func(t *testing.T) {
+		// An audit without capacity to run is dropped, and its snapshot closed.
+		metrics := NewIteratorMetrics()
+		a := iterate(t, stopper, make(chan struct{}), metrics, auditTestingKnobs{
+			afterAudit: func(bool) { t.Error("expected the audit to be dropped") },
+		})
+		if !a.snapshot.Closed() {
+			t.Error("expected the snapshot of the dropped audit to be closed")
+		}
+		if a := metrics.Audits.Count(); a != 0 {
+			t.Errorf("expected no audits, got %d", a)
+		}
+	})
+
+	t.Run("quiesce", func(t *testing.T) {
+		// An audit stops once its stopper quiesces, closing its snapshot
+		// before the stopper stops.
+		stopper := stop.NewStopper()
+		metrics := NewIteratorMetrics()
+		var once sync.Once
+		a := iterate(t, stopper, sem, metrics, auditTestingKnobs{
+			divergeAudit: func(kv engine.MVCCKeyValue) engine.MVCCKeyValue {
+				once.Do(func() {
+					go stopper.Stop(ctx)
+					<-stopper.ShouldQuiesce()
+				})
+				return kv
+			},
+			afterAudit: func(bool) { t.Error("expected the audit to be stopped") },
+		})
+		<-stopper.IsStopped()
+		if !a.snapshot.Closed() {
+			t.Error("expected the snapshot of the stopped audit to be closed")
+		}
+		if a := metrics.Audits.Count(); a != 0 {
+			t.Errorf("expected no audits, got %d", a)
+		}
+	})
+}
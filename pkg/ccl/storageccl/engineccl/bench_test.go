@@ -9,26 +9,54 @@
 package engineccl
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
 
+// defaultTestDataSeed is the seed of the data written by loadTestData.
+const defaultTestDataSeed = 1449168817
+
+// testDataOptions configures the data written by loadTestDataWithOptions.
+type testDataOptions struct {
+	// seed seeds the generation of the data. The same seed and options always
+	// generate the same data.
+	seed int64
+	// deletionRatio is the fraction of writes which delete their key instead
+	// of writing a value.
+	deletionRatio float64
+	// rewriteFraction is the number of keys of earlier batches rewritten by
+	// each batch, as a fraction of the batch size. A rewrite is timestamped
+	// between the previous version of its key and the end of the time span of
+	// its batch, so the timestamps of the SSTs of the batches overlap.
+	rewriteFraction float64
+	// intents is the number of unresolved intents written on distinct keys, at
+	// timestamps after those of all of the batches.
+	intents int
+}
+
 // loadTestData writes numKeys keys in numBatches separate batches. Keys are
-// written in order. Every key in a given batch has the same MVCC timestamp;
-// batch timestamps start at 0 and increase in intervals of batchTimeSpan.
+// written in order. The timestamps of the keys in a given batch are in
+// [batch*batchTimeSpan, (batch+1)*batchTimeSpan).
 //
 // Importantly, writing keys in order convinces RocksDB to output one SST per
 // batch, where each SST contains keys of only one timestamp. E.g., writing A,B
@@ -38,81 +66,175 @@ import (
 // immediate compaction).
 //
 // The creation of the database is time consuming, so the caller can choose
-// whether to use a temporary or permanent location.
+// whether to use a temporary or permanent location. An existing database in
+// dir is reused.
 func loadTestData(
 	dir string, numKeys, numBatches, batchTimeSpan, valueBytes int,
 ) (engine.Engine, error) {
-	ctx := context.Background()
+	return loadCachedTestData(dir, numKeys, numBatches, batchTimeSpan, valueBytes,
+		testDataOptions{seed: defaultTestDataSeed})
+}
 
-	exists := true
+// loadCachedTestData opens the database in dir, first writing it with the
+// options if it doesn't exist. The database is written to a temporary
+// directory which is renamed to dir once complete, so that an interrupted run
+// doesn't leave a partial database to be reused.
+func loadCachedTestData(
+	dir string, numKeys, numBatches, batchTimeSpan, valueBytes int, opts testDataOptions,
+) (engine.Engine, error) {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		exists = false
+		tmpDir := dir + ".tmp"
+		if err := os.RemoveAll(tmpDir); err != nil {
+			return nil, err
+		}
+		eng, _, err := loadTestDataWithOptions(tmpDir, numKeys, numBatches, batchTimeSpan, valueBytes, opts)
+		if err != nil {
+			return nil, err
+		}
+		eng.Close()
+		if err := os.Rename(tmpDir, dir); err != nil {
+			return nil, err
+		}
 	}
 
-	eng, err := engine.NewRocksDB(
+	eng, err := openTestData(dir)
+	if err != nil {
+		return nil, err
+	}
+	testutils.ReadAllFiles(filepath.Join(dir, "*"))
+	return eng, nil
+}
+
+// loadTestDataWithOptions writes data like loadTestData to a new database in
+// dir, with the deletions, rewrites and intents configured by opts. It returns
+// the latest committed version of every key, which is what an incremental
+// iteration over [0, numBatches*batchTimeSpan) emits.
+func loadTestDataWithOptions(
+	dir string, numKeys, numBatches, batchTimeSpan, valueBytes int, opts testDataOptions,
+) (engine.Engine, []engine.MVCCKeyValue, error) {
+	eng, err := openTestData(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Infof(context.Background(), "creating test data: %s", dir)
+	kvs, err := writeTestData(eng, numKeys, numBatches, batchTimeSpan, valueBytes, opts)
+	if err != nil {
+		eng.Close()
+		return nil, nil, err
+	}
+	return eng, kvs, nil
+}
+
+func openTestData(dir string) (engine.Engine, error) {
+	return engine.NewRocksDB(
 		roachpb.Attributes{},
 		dir,
 		engine.RocksDBCache{},
 		0,
 		engine.DefaultMaxOpenFiles,
 	)
-	if err != nil {
-		return nil, err
-	}
-
-	if exists {
-		testutils.ReadAllFiles(filepath.Join(dir, "*"))
-		return eng, nil
-	}
+}
 
-	log.Infof(context.Background(), "creating test data: %s", dir)
+func writeTestData(
+	eng engine.Engine, numKeys, numBatches, batchTimeSpan, valueBytes int, opts testDataOptions,
+) ([]engine.MVCCKeyValue, error) {
+	ctx := context.Background()
 
 	// Generate the same data every time.
-	rng := rand.New(rand.NewSource(1449168817))
+	rng := rand.New(rand.NewSource(opts.seed))
 
 	keys := make([]roachpb.Key, numKeys)
 	for i := 0; i < numKeys; i++ {
 		keys[i] = roachpb.Key(encoding.EncodeUvarintAscending([]byte("key-"), uint64(i)))
 	}
+	// latest is the latest committed version of each key.
+	latest := make([]engine.MVCCKeyValue, numKeys)
 
-	sstTimestamps := make([]int64, numBatches)
-	for i := 0; i < len(sstTimestamps); i++ {
-		sstTimestamps[i] = int64(i * batchTimeSpan)
+	write := func(batch engine.Batch, i int, timestamp hlc.Timestamp) error {
+		key := keys[i]
+		if opts.deletionRatio > 0 && rng.Float64() < opts.deletionRatio {
+			latest[i] = engine.MVCCKeyValue{Key: engine.MVCCKey{Key: key, Timestamp: timestamp}}
+			return engine.MVCCDelete(ctx, batch, nil, key, timestamp, nil)
+		}
+		value := roachpb.MakeValueFromBytes(randutil.RandBytes(rng, valueBytes))
+		value.InitChecksum(key)
+		latest[i] = engine.MVCCKeyValue{
+			Key:   engine.MVCCKey{Key: key, Timestamp: timestamp},
+			Value: value.RawBytes,
+		}
+		return engine.MVCCPut(ctx, batch, nil, key, timestamp, value, nil)
+	}
+	commit := func(batch engine.Batch) error {
+		defer batch.Close()
+		if err := batch.Commit(false /* !sync */); err != nil {
+			return err
+		}
+		return eng.Flush()
 	}
 
-	var batch engine.Batch
-	var minWallTime int64
-	for i, key := range keys {
-		if scaled := len(keys) / numBatches; (i % scaled) == 0 {
-			if i > 0 {
-				log.Infof(ctx, "committing (%d/~%d)", i/scaled, numBatches)
-				if err := batch.Commit(false /* !sync */); err != nil {
-					return nil, err
-				}
+	scaled := numKeys / numBatches
+	for b := 0; b < numBatches; b++ {
+		minWallTime := int64(b * batchTimeSpan)
+		maxWallTime := minWallTime + int64(batchTimeSpan)
+		batch := eng.NewBatch()
+		end := (b + 1) * scaled
+		if b == numBatches-1 {
+			end = numKeys
+		}
+		for i := b * scaled; i < end; i++ {
+			wallTime := minWallTime + rng.Int63n(int64(batchTimeSpan))
+			if wallTime == 0 {
+				// A zero timestamp would write an inline value.
+				wallTime = 1
+			}
+			if err := write(batch, i, hlc.Timestamp{WallTime: wallTime}); err != nil {
 				batch.Close()
-				if err := eng.Flush(); err != nil {
-					return nil, err
-				}
+				return nil, err
 			}
-			batch = eng.NewBatch()
-			minWallTime = sstTimestamps[i/scaled]
 		}
-		timestamp := hlc.Timestamp{WallTime: minWallTime + rand.Int63n(int64(batchTimeSpan))}
-		value := roachpb.MakeValueFromBytes(randutil.RandBytes(rng, valueBytes))
-		value.InitChecksum(key)
-		if err := engine.MVCCPut(ctx, batch, nil, key, timestamp, value, nil); err != nil {
+		for j := 0; b > 0 && j < int(opts.rewriteFraction*float64(scaled)); j++ {
+			i := rng.Intn(b * scaled)
+			minRewriteWallTime := latest[i].Key.Timestamp.WallTime + 1
+			if minRewriteWallTime >= maxWallTime {
+				continue
+			}
+			wallTime := minRewriteWallTime + rng.Int63n(maxWallTime-minRewriteWallTime)
+			if err := write(batch, i, hlc.Timestamp{WallTime: wallTime}); err != nil {
+				batch.Close()
+				return nil, err
+			}
+		}
+		log.Infof(ctx, "committing (%d/%d)", b+1, numBatches)
+		if err := commit(batch); err != nil {
 			return nil, err
 		}
 	}
-	if err := batch.Commit(false /* !sync */); err != nil {
-		return nil, err
-	}
-	batch.Close()
-	if err := eng.Flush(); err != nil {
-		return nil, err
+
+	if opts.intents > 0 {
+		batch := eng.NewBatch()
+		endWallTime := int64(numBatches * batchTimeSpan)
+		for j, i := range rng.Perm(numKeys)[:opts.intents] {
+			txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+				Key:       keys[i],
+				ID:        uuid.NewPopulatedUUID(rng),
+				Epoch:     1,
+				Timestamp: hlc.Timestamp{WallTime: endWallTime + 1 + int64(j)},
+			}}
+			value := roachpb.MakeValueFromBytes(randutil.RandBytes(rng, valueBytes))
+			value.InitChecksum(keys[i])
+			if err := engine.MVCCPut(
+				ctx, batch, nil, keys[i], txn.Timestamp, value, &txn,
+			); err != nil {
+				batch.Close()
+				return nil, err
+			}
+		}
+		if err := commit(batch); err != nil {
+			return nil, err
+		}
 	}
 
-	return eng, nil
+	return latest, nil
 }
 
 // runIterate benchmarks iteration over the entire keyspace within time bounds
@@ -178,3 +300,270 @@ func BenchmarkTimeBoundIterate(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkMVCCIncrementalIteratorNormal benchmarks incremental iterations
+// without time-bound iterators; see runMVCCIncrementalIteratorBenchmarks.
+func BenchmarkMVCCIncrementalIteratorNormal(b *testing.B) {
+	runMVCCIncrementalIteratorBenchmarks(b, false /* timeBound */)
+}
+
+// BenchmarkMVCCIncrementalIteratorTimeBound benchmarks incremental iterations
+// with time-bound iterators; see runMVCCIncrementalIteratorBenchmarks.
+func BenchmarkMVCCIncrementalIteratorTimeBound(b *testing.B) {
+	runMVCCIncrementalIteratorBenchmarks(b, true /* timeBound */)
+}
+
+// runMVCCIncrementalIteratorBenchmarks benchmarks incremental iterations over
+// the most recent 1%, 10% and 100% of the time span of data with values of 64
+// and 512 bytes and about 1 and 4 versions per key. Each iteration is run with
+// the copying and the unsafe accessors, with only keys, and over all versions
+// with both Next and NextKey, which skips the older versions of each key.
+//
+// The data of each size class is written once and kept in the temp directory
+// across runs, as writing it takes much longer than the benchmarks.
+func runMVCCIncrementalIteratorBenchmarks(b *testing.B, timeBound bool) {
+	const numKeys = 100000
+	const numBatches = 100
+	const batchTimeSpan = 10
+
+	defer settings.TestingSetBool(&TimeBoundIteratorsEnabled, timeBound)()
+
+	for _, valueBytes := range []int{64, 512} {
+		for _, versions := range []int{1, 4} {
+			b.Run(fmt.Sprintf("ValueBytes%d/Versions%d", valueBytes, versions), func(b *testing.B) {
+				dir := filepath.Join(os.TempDir(), fmt.Sprintf("mvcc_incremental_data_%d_%d_%d_%d_%d",
+					numKeys, numBatches, batchTimeSpan, valueBytes, versions))
+				eng, err := loadCachedTestData(dir, numKeys, numBatches, batchTimeSpan, valueBytes,
+					testDataOptions{seed: defaultTestDataSeed, rewriteFraction: float64(versions - 1)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer eng.Close()
+
+				endTime := hlc.Timestamp{WallTime: numBatches * batchTimeSpan}
+				for _, window := range []int{1, 10, 100} {
+					startTime := hlc.Timestamp{WallTime: endTime.WallTime * int64(100-window) / 100}
+					b.Run(fmt.Sprintf("Window%d", window), func(b *testing.B) {
+						allVersions := MVCCIncrementalIteratorOptions{AllVersions: true}
+						// The metrics accumulate over every iteration of the benchmark, as
+						// a store's do, for comparison with UnsafeKey which records none.
+						withMetrics := MVCCIncrementalIteratorOptions{Metrics: NewIteratorMetrics()}
+						for _, tc := range []struct {
+							name   string
+							opts   MVCCIncrementalIteratorOptions
+							unsafe bool
+							next   func(*MVCCIncrementalIterator)
+						}{
+							{"Key", MVCCIncrementalIteratorOptions{}, false, (*MVCCIncrementalIterator).Next},
+							{"UnsafeKey", MVCCIncrementalIteratorOptions{}, true, (*MVCCIncrementalIterator).Next},
+							{"UnsafeKey/Metrics", withMetrics, true, (*MVCCIncrementalIterator).Next},
+							{"KeysOnly", MVCCIncrementalIteratorOptions{KeysOnly: true}, true, (*MVCCIncrementalIterator).Next},
+							{"AllVersions/Next", allVersions, true, (*MVCCIncrementalIterator).Next},
+							{"AllVersions/NextKey", allVersions, true, (*MVCCIncrementalIterator).NextKey},
+						} {
+							b.Run(tc.name, func(b *testing.B) {
+								runMVCCIncrementalIteration(b, eng, startTime, endTime, tc.opts, tc.unsafe, tc.next)
+							})
+						}
+					})
+				}
+			})
+		}
+	}
+}
+
+// runMVCCIncrementalIteration benchmarks an incremental iteration with the
+// options over the whole keyspace, advancing it with next and reading the key/values with the
+// unsafe accessors if unsafe is set. The bytes of the emitted key/values are reported per iteration, and
+// the rate of emitted keys is logged.
+func runMVCCIncrementalIteration(
+	b *testing.B,
+	eng engine.Engine,
+	startTime, endTime hlc.Timestamp,
+	opts MVCCIncrementalIteratorOptions,
+	unsafe bool,
+	next func(*MVCCIncrementalIterator),
+) {
+	opts.StartTime, opts.EndTime = startTime, endTime
+	iter := NewMVCCIncrementalIterator(eng, opts)
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		b.Fatal(err)
+	}
+
+	var numKeys, numBytes int64
+	b.ResetTimer()
+	start := timeutil.Now()
+	for i := 0; i < b.N; i++ {
+		numKeys, numBytes = 0, 0
+		for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); next(iter) {
+			var key engine.MVCCKey
+			var value []byte
+			if unsafe {
+				key, value = iter.UnsafeKey(), iter.UnsafeValue()
+			} else {
+				key, value = iter.Key(), iter.Value()
+			}
+			numKeys++
+			numBytes += int64(key.EncodedSize() + len(value))
+		}
+		if _, err := iter.Finish(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	elapsed := timeutil.Since(start)
+	b.StopTimer()
+
+	b.SetBytes(numBytes)
+	b.Logf("%d keys per iteration, %.0f keys/sec", numKeys,
+		float64(numKeys)*float64(b.N)/elapsed.Seconds())
+}
+
+// BenchmarkIncrementalIteratePrefixes benchmarks an incremental iteration over
+// 100 of 2000 key prefixes, covering 5% of the keyspace, comparing seeking
+// between the prefixes with filtering all the keys of the keyspace.
+func BenchmarkIncrementalIteratePrefixes(b *testing.B) {
+	const numPrefixes = 2000
+	const keysPerPrefix = 50
+	const prefixStride = 20
+
+	ctx := context.Background()
+	eng := engine.NewInMem(roachpb.Attributes{}, 1<<30)
+	defer eng.Close()
+
+	prefix := func(i int) roachpb.Key {
+		return roachpb.Key(fmt.Sprintf("tenant-%04d/", i))
+	}
+	for i := 0; i < numPrefixes; i++ {
+		for j := 0; j < keysPerPrefix; j++ {
+			key := append(prefix(i), fmt.Sprintf("%03d", j)...)
+			value := roachpb.MakeValueFromString(string(key))
+			if err := engine.MVCCPut(ctx, eng, nil, key, hlc.Timestamp{WallTime: 1}, value, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	var prefixes []roachpb.Key
+	for i := 0; i < numPrefixes; i += prefixStride {
+		prefixes = append(prefixes, prefix(i))
+	}
+	hasPrefix := func(key roachpb.Key) bool {
+		for _, p := range prefixes {
+			if bytes.HasPrefix(key, p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	startTime, endTime := hlc.Timestamp{}, hlc.Timestamp{WallTime: 2}
+	expected := len(prefixes) * keysPerPrefix
+	run := func(b *testing.B, iter *MVCCIncrementalIterator, filter bool) {
+		defer iter.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			n := 0
+			for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); iter.Next() {
+				if !filter || hasPrefix(iter.UnsafeKey().Key) {
+					n++
+				}
+			}
+			if _, err := iter.Finish(); err != nil {
+				b.Fatal(err)
+			}
+			if n != expected {
+				b.Fatalf("expected %d keys, got %d", expected, n)
+			}
+		}
+	}
+	b.Run("Filter", func(b *testing.B) {
+		iter := NewMVCCIncrementalIterator(eng, MVCCIncrementalIteratorOptions{
+			StartTime: startTime,
+			EndTime:   endTime,
+		})
+		run(b, iter, true /* filter */)
+	})
+	b.Run("Prefixes", func(b *testing.B) {
+		iter := NewMVCCIncrementalIterator(eng, MVCCIncrementalIteratorOptions{
+			StartTime: startTime,
+			EndTime:   endTime,
+			Prefixes:  prefixes,
+		})
+		if err := iter.Error(); err != nil {
+			b.Fatal(err)
+		}
+		run(b, iter, false /* filter */)
+	})
+}
+
+// BenchmarkExportBatching benchmarks carrying the key/values emitted by an
+// incremental iteration to a sink in chunks, comparing copying each key/value
+// into allocations of its own with copying them into KVBatches. The sink
+// digests each chunk, as an export does. The number of garbage collections and
+// their total pause are logged along with the allocation rate.
+func BenchmarkExportBatching(b *testing.B) {
+	const numKeys = 100000
+	const chunkSize = 1000
+
+	ctx := context.Background()
+	eng := engine.NewInMem(roachpb.Attributes{}, 1<<30)
+	defer eng.Close()
+	if err := GenerateExportTestData(ctx, eng, 1, numKeys, 3, 10); err != nil {
+		b.Fatal(err)
+	}
+
+	run := func(b *testing.B, export func(iter *MVCCIncrementalIterator, sink func([]engine.MVCCKeyValue))) {
+		iter := NewMVCCIncrementalIterator(eng, MVCCIncrementalIteratorOptions{
+			EndTime: hlc.Timestamp{WallTime: 11},
+		})
+		defer iter.Close()
+		sink := func(kvs []engine.MVCCKeyValue) {
+			_ = DigestKVs(kvs)
+		}
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			iter.Reset(roachpb.KeyMin, roachpb.KeyMax)
+			export(iter, sink)
+			if _, err := iter.Finish(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		runtime.ReadMemStats(&after)
+		b.Logf("%d iterations: %d GCs, %s total pause", b.N, after.NumGC-before.NumGC,
+			time.Duration(after.PauseTotalNs-before.PauseTotalNs))
+	}
+
+	b.Run("Copy", func(b *testing.B) {
+		run(b, func(iter *MVCCIncrementalIterator, sink func([]engine.MVCCKeyValue)) {
+			var kvs []engine.MVCCKeyValue
+			for ; iter.Valid(); iter.Next() {
+				kvs = append(kvs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+				if len(kvs) == chunkSize {
+					sink(kvs)
+					kvs = nil
+				}
+			}
+			sink(kvs)
+		})
+	})
+	b.Run("KVBatch", func(b *testing.B) {
+		run(b, func(iter *MVCCIncrementalIterator, sink func([]engine.MVCCKeyValue)) {
+			batch := NewKVBatch()
+			for ; iter.Valid(); iter.Next() {
+				batch.Add(iter.UnsafeKey(), iter.UnsafeValue())
+				if batch.Len() == chunkSize {
+					sink(batch.KVs())
+					batch.Release()
+					batch = NewKVBatch()
+				}
+			}
+			sink(batch.KVs())
+			batch.Release()
+		})
+	})
+}
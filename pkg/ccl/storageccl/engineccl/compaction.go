@@ -0,0 +1,92 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+const (
+	// compactionSparseWeight weighs the sparseness of the keys of a restored
+	// window against its tombstones when scoring it for compaction.
+	compactionSparseWeight = 0.5
+	// compactionSmallValueBytes is the average value size below which the
+	// per-key overhead of restored data makes compacting it more beneficial.
+	compactionSmallValueBytes = 64
+)
+
+// CompactionRecommendation is a span of restored data recommended for
+// compaction by RecommendCompactions.
+type CompactionRecommendation struct {
+	Span roachpb.Span
+	// Windows is the number of exported windows restored into the span.
+	Windows int
+	// Stats is the sum of the stats of those windows.
+	Stats MVCCIncrementalIteratorProgress
+	// Score estimates the benefit of compacting the span. Spans with higher
+	// scores should be compacted first.
+	Score float64
+}
+
+// RecommendCompactions returns the spans restored from the supplied manifests
+// which would benefit from a compaction, in the order in which they should be
+// compacted. The windows exported for the same span are scored together, as
+// they are compacted together once restored. Spans which would not benefit
+// from a compaction are omitted.
+//
+// A compaction drops the tombstones of a window, so the fraction of
+// tombstones is the main signal. The data of a window whose changed keys are
+// sparse among the keys of its span overlaps much more data than it contains,
+// and the data of a window of small values is dominated by per-key overhead;
+// both also benefit from a compaction. The score weighs these by the size of
+// the restored data.
+func RecommendCompactions(manifests []ExportManifest) []CompactionRecommendation {
+	type spanKey struct {
+		key, endKey string
+	}
+	bySpan := make(map[spanKey]*CompactionRecommendation)
+	var recs []*CompactionRecommendation
+	for _, m := range manifests {
+		k := spanKey{key: string(m.Span.Key), endKey: string(m.Span.EndKey)}
+		rec, ok := bySpan[k]
+		if !ok {
+			rec = &CompactionRecommendation{Span: m.Span}
+			bySpan[k] = rec
+			recs = append(recs, rec)
+		}
+		rec.Windows++
+		rec.Stats.add(m.Stats)
+	}
+
+	var result []CompactionRecommendation
+	for _, rec := range recs {
+		if rec.Score = compactionScore(rec.Stats); rec.Score > 0 {
+			result = append(result, *rec)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Span.Key.Compare(result[j].Span.Key) < 0
+	})
+	return result
+}
+
+// compactionScore estimates the benefit of compacting restored data with the
+// supplied stats. See RecommendCompactions.
+func compactionScore(s MVCCIncrementalIteratorProgress) float64 {
+	benefit := s.TombstoneFraction() + compactionSparseWeight*(1-s.KeyDensity())
+	if avg := s.AverageValueBytes(); avg < compactionSmallValueBytes {
+		benefit *= 2 - avg/compactionSmallValueBytes
+	}
+	return float64(s.EmittedKeyBytes+s.EmittedValueBytes) * benefit
+}
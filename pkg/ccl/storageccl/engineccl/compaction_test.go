@@ -0,0 +1,74 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestRecommendCompactions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(key, endKey string) roachpb.Span {
+		return roachpb.Span{Key: roachpb.Key(key), EndKey: roachpb.Key(endKey)}
+	}
+	manifest := func(s roachpb.Span, keys, deletions, keyBytes, valueBytes, skipped int64) ExportManifest {
+		return ExportManifest{Span: s, Stats: MVCCIncrementalIteratorProgress{
+			EmittedKeys:       keys,
+			EmittedDeletions:  deletions,
+			EmittedKeyBytes:   keyBytes,
+			EmittedValueBytes: valueBytes,
+			SkippedVersions:   skipped,
+		}}
+	}
+
+	manifests := []ExportManifest{
+		// Half of the keys of the first window of [a,b) are deletions, and the
+		// second window of [a,b) dilutes them.
+		manifest(span("a", "b"), 100, 50, 1000, 10000, 0),
+		manifest(span("a", "b"), 100, 0, 1000, 20000, 0),
+		// Dense windows without deletions gain nothing from a compaction.
+		manifest(span("b", "c"), 100, 0, 1000, 20000, 0),
+		// Sparse windows of large and of small values.
+		manifest(span("c", "d"), 100, 0, 1000, 20000, 300),
+		manifest(span("e", "f"), 400, 0, 4000, 16000, 1200),
+		// Empty windows are omitted.
+		manifest(span("d", "e"), 0, 0, 0, 0, 0),
+	}
+	recs := RecommendCompactions(manifests)
+
+	var spans []roachpb.Span
+	for _, rec := range recs {
+		spans = append(spans, rec.Span)
+	}
+	expected := []roachpb.Span{span("e", "f"), span("a", "b"), span("c", "d")}
+	if !reflect.DeepEqual(spans, expected) {
+		t.Fatalf("expected spans %s to be recommended, got %s", expected, spans)
+	}
+	if rec := recs[1]; rec.Windows != 2 || rec.Stats.EmittedKeys != 200 || rec.Stats.EmittedDeletions != 50 {
+		t.Fatalf("expected the two windows of %s to be combined, got %+v", rec.Span, rec)
+	}
+	if f := recs[1].Stats.TombstoneFraction(); f != 0.25 {
+		t.Fatalf("expected a tombstone fraction of 0.25, got %f", f)
+	}
+	if d := recs[2].Stats.KeyDensity(); d != 0.25 {
+		t.Fatalf("expected a key density of 0.25, got %f", d)
+	}
+	if a := recs[0].Stats.AverageValueBytes(); a != 40 {
+		t.Fatalf("expected an average value size of 40, got %f", a)
+	}
+
+	if recs := RecommendCompactions(nil); len(recs) != 0 {
+		t.Fatalf("expected no recommendations without manifests, got %+v", recs)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// CountKeysInTimeRange returns the number of versions which an incremental
+// iteration over [startKey, endKey) and [startTime, endTime) emits, and the
+// total size of their keys and values, such as to size an incremental backup
+// before running it. The versions are counted by a keys-only iteration with a
+// time-bound iterator, so no values are copied and the sstables outside the
+// time range are skipped. The iteration fails on intents as usual.
+//
+// If approximate is set, the sstables whose versions are all emitted by the
+// iteration (see MVCCIncrementalIterator.CoveredSSTables) are counted from
+// their properties instead of being iterated over, and only the rest of the
+// key range is iterated over. The sizes of the keys of those sstables include
+// their encoded timestamps, so the size is overestimated by up to 13 bytes per
+// version.
+func CountKeysInTimeRange(
+	reader engine.Reader,
+	startKey, endKey roachpb.Key,
+	startTime, endTime hlc.Timestamp,
+	approximate bool,
+) (keys, bytes int64, _ error) {
+	iter := NewMVCCIncrementalIterator(reader, MVCCIncrementalIteratorOptions{
+		StartTime: startTime,
+		EndTime:   endTime,
+		KeysOnly:  true,
+		TimeBound: true,
+	})
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		return 0, 0, err
+	}
+	if approximate {
+		covered, err := iter.coveredSSTables(startKey, endKey)
+		if err != nil {
+			return 0, 0, err
+		}
+		spans := make([]roachpb.Span, len(covered))
+		for j, sst := range covered {
+			keys += sst.NumEntries
+			bytes += sst.RawKeyBytes + sst.RawValueBytes
+			// The end key of an sstable is inclusive.
+			spans[j] = roachpb.Span{Key: sst.Start.Key, EndKey: sst.End.Key.Next()}
+		}
+		iter.SkipSpans(spans)
+	}
+	for iter.Reset(startKey, endKey); ; iter.Next() {
+		if ok, err := iter.ValidWithErr(); err != nil {
+			return 0, 0, err
+		} else if !ok {
+			break
+		}
+		// A keys-only iteration doesn't count the sizes of the values, which
+		// are read all the same.
+		bytes += int64(len(iter.iter.UnsafeValue()))
+	}
+	stats, err := iter.Finish()
+	if err != nil {
+		return 0, 0, err
+	}
+	return keys + stats.EmittedKeys, bytes + stats.EmittedKeyBytes, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestCountKeysInTimeRange verifies that the approximate count of the keys
+// changed in a time range agrees with the exact count, and reads fewer blocks
+// when sstables are entirely in the time range.
+func TestCountKeysInTimeRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	const numKeys = 1000
+	const numBatches = 10
+	const batchTimeSpan = 10
+	const valueSize = 100
+
+	eng, err := loadTestData(filepath.Join(dir, "mvcc_data"),
+		numKeys, numBatches, batchTimeSpan, valueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+
+	blocks := func() int64 {
+		stats, err := eng.GetStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.BlockCacheHits + stats.BlockCacheMisses
+	}
+	count := func(startTime, endTime int64, approximate bool) (keys, bytes, blocksRead int64) {
+		before := blocks()
+		keys, bytes, err := CountKeysInTimeRange(eng, roachpb.KeyMin, roachpb.KeyMax,
+			hlc.Timestamp{WallTime: startTime}, hlc.Timestamp{WallTime: endTime}, approximate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys, bytes, blocks() - before
+	}
+
+	for _, tc := range []struct {
+		name               string
+		startTime, endTime int64
+		// expectedKeys is the exact count, if known, and otherwise -1.
+		expectedKeys int64
+	}{
+		{"all", 0, numBatches * batchTimeSpan, numKeys},
+		// The sstable of the fifth batch is only partially in the time range.
+		{"recent", 45, numBatches * batchTimeSpan, -1},
+		{"none", numBatches * batchTimeSpan, 2 * numBatches * batchTimeSpan, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, bytes, exactBlocks := count(tc.startTime, tc.endTime, false /* approximate */)
+			if tc.expectedKeys >= 0 && keys != tc.expectedKeys {
+				t.Fatalf("expected %d keys, got %d", tc.expectedKeys, keys)
+			}
+			approxKeys, approxBytes, approxBlocks := count(tc.startTime, tc.endTime, true /* approximate */)
+			if approxKeys != keys {
+				t.Errorf("expected the approximate count of %d keys to be exact, got %d", keys, approxKeys)
+			}
+			// The approximation only overestimates the sizes of the keys, by
+			// their timestamps.
+			if approxBytes < bytes || approxBytes > bytes+13*keys {
+				t.Errorf("expected approximately %d bytes, got %d", bytes, approxBytes)
+			}
+			if keys > 0 && approxBlocks >= exactBlocks {
+				t.Errorf("expected the approximate count to read fewer than %d blocks, read %d",
+					exactBlocks, approxBlocks)
+			}
+		})
+	}
+}
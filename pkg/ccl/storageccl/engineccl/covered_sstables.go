@@ -0,0 +1,138 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// sstableEngine is implemented by the engines, such as *engine.RocksDB and
+// engine.InMem, whose live sstables can be inspected.
+type sstableEngine interface {
+	SSTableInfosWithTimestamps(start, end roachpb.Key) engine.SSTableInfos
+	MemTableOverlaps(from, to roachpb.Key) (bool, error)
+}
+
+// CoveredSSTables returns the live sstables, in key order, whose contents are
+// exactly what an iteration over [startKey, endKey) emits between their first
+// and last keys, and so could be copied wholesale rather than iterated over;
+// see SkipSpans. Such an sstable is within the key range, its timestamps are
+// within the time range, it contains no intents and, unless the iterator
+// emits all versions, no older versions of its keys, and neither another
+// sstable nor an unflushed write overlaps its keys.
+//
+// The sstables are those of MVCCIncrementalIteratorOptions.Engine, or else of
+// the reader, and none are returned unless it is a RocksDB engine, or if the
+// iterator is restricted to prefixes, limits the size of values or emits only
+// keys. The reader must not hold writes of its own in the key range.
+//
+// The live sstables are those of the engine when CoveredSSTables is called,
+// which a flush or compaction may change before the reader is iterated over.
+// A caller which copies the sstables must call it again once they are copied,
+// and iterate over the spans of the copies whose sstables it no longer
+// returns.
+func (i *MVCCIncrementalIterator) CoveredSSTables(
+	startKey, endKey roachpb.Key,
+) ([]engine.SSTableInfo, error) {
+	iterCtx := IterationContext{
+		Span:      roachpb.Span{Key: startKey, EndKey: endKey},
+		StartTime: i.window.Start,
+		EndTime:   i.window.End,
+	}
+	if i.window.Start != (hlc.Timestamp{}) && i.window.Start.Less(i.gcThreshold) {
+		return nil, &GCThresholdError{IterationContext: iterCtx, GCThreshold: i.gcThreshold}
+	}
+	if i.maxSafeTimestamp != (hlc.Timestamp{}) && i.maxSafeTimestamp.Less(i.window.End) {
+		return nil, &UnsafeEndTimeError{IterationContext: iterCtx, MaxSafeTimestamp: i.maxSafeTimestamp}
+	}
+	if len(i.prefixes) > 0 || i.maxValueBytes > 0 || i.keysOnly {
+		return nil, nil
+	}
+	return i.coveredSSTables(startKey, endKey)
+}
+
+// coveredSSTables is CoveredSSTables without the restrictions on the options
+// of the iterator, for callers which count the versions of the sstables
+// rather than copy them, such as CountKeysInTimeRange. The iterator must not
+// be restricted to prefixes.
+func (i *MVCCIncrementalIterator) coveredSSTables(
+	startKey, endKey roachpb.Key,
+) ([]engine.SSTableInfo, error) {
+	var r engine.Reader = i.reader
+	if i.eng != nil {
+		r = i.eng
+	}
+	eng, ok := r.(sstableEngine)
+	if !ok {
+		return nil, nil
+	}
+
+	ssts := eng.SSTableInfosWithTimestamps(startKey, endKey)
+	var covered []engine.SSTableInfo
+	for j, sst := range ssts {
+		if !i.coversSSTable(sst, startKey, endKey) || overlapsOtherSSTable(ssts, j) {
+			continue
+		}
+		overlaps, err := eng.MemTableOverlaps(sst.Start.Key, sst.End.Key.Next())
+		if err != nil {
+			return nil, err
+		}
+		if !overlaps {
+			covered = append(covered, sst)
+		}
+	}
+	sort.Slice(covered, func(a, b int) bool {
+		return covered[a].Start.Key.Compare(covered[b].Start.Key) < 0
+	})
+	return covered, nil
+}
+
+// coversSSTable returns whether the properties and bounds of sst place all of
+// its versions in an iteration over [startKey, endKey).
+func (i *MVCCIncrementalIterator) coversSSTable(
+	sst engine.SSTableInfo, startKey, endKey roachpb.Key,
+) bool {
+	// The end key of an sstable is inclusive.
+	if sst.Start.Key.Compare(startKey) < 0 || sst.End.Key.Compare(endKey) >= 0 {
+		return false
+	}
+	if sst.TsMin == nil || sst.TsMax == nil ||
+		!i.window.Contains(*sst.TsMin) || !i.window.Contains(*sst.TsMax) {
+		return false
+	}
+	if sst.UnversionedKeys == nil || *sst.UnversionedKeys != 0 {
+		return false
+	}
+	return i.allVersions || (sst.ShadowedVersions != nil && *sst.ShadowedVersions == 0)
+}
+
+// overlapsOtherSSTable returns whether the keys of ssts[j] overlap those of
+// another of the sstables.
+func overlapsOtherSSTable(ssts engine.SSTableInfos, j int) bool {
+	for k, other := range ssts {
+		if k != j && other.End.Key.Compare(ssts[j].Start.Key) >= 0 &&
+			other.Start.Key.Compare(ssts[j].End.Key) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SkipSpans causes the following iterations to seek past the keys in the
+// spans, which must be sorted and non-overlapping, such as those of the
+// CoveredSSTables whose contents the caller copies instead. Nothing in the
+// spans is emitted, including intents.
+func (i *MVCCIncrementalIterator) SkipSpans(spans []roachpb.Span) {
+	i.skipped = spans
+	i.skippedIdx = 0
+}
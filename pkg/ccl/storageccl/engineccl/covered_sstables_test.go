@@ -0,0 +1,184 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+func TestMVCCIncrementalIteratorCoveredSSTables(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	put := func(e engine.Engine, key string, wallTime int64) error {
+		return engine.MVCCPut(ctx, e, nil, roachpb.Key(key), hlc.Timestamp{WallTime: wallTime},
+			roachpb.MakeValueFromString(key), nil)
+	}
+	putIntent := func(e engine.Engine, key string, wallTime int64) error {
+		txnID := uuid.MakeV4()
+		txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+			Key:       roachpb.Key(key),
+			ID:        &txnID,
+			Epoch:     1,
+			Timestamp: hlc.Timestamp{WallTime: wallTime},
+		}}
+		return engine.MVCCPut(ctx, e, nil, txn.Key, txn.Timestamp,
+			roachpb.MakeValueFromString(key), &txn)
+	}
+	// writeSSTable writes b1@2 and b2@3, and then whatever else writes, to
+	// a single sstable.
+	writeSSTable := func(e engine.Engine, write func(engine.Engine) error) error {
+		if err := put(e, "b1", 2); err != nil {
+			return err
+		}
+		if err := put(e, "b2", 3); err != nil {
+			return err
+		}
+		if write != nil {
+			if err := write(e); err != nil {
+				return err
+			}
+		}
+		return e.Flush()
+	}
+
+	for _, tc := range []struct {
+		name               string
+		before, after      func(engine.Engine) error
+		startKey, endKey   string
+		startTime, endTime int64
+		allVersions        bool
+		expected           bool
+	}{
+		{name: "full", startKey: "a", endKey: "c", startTime: 1, endTime: 5, expected: true},
+		{name: "keys", startKey: "b2", endKey: "c", startTime: 1, endTime: 5},
+		{name: "end key", startKey: "a", endKey: "b2", startTime: 1, endTime: 5},
+		{name: "start time", startKey: "a", endKey: "c", startTime: 3, endTime: 5},
+		{name: "end time", startKey: "a", endKey: "c", startTime: 1, endTime: 3},
+		{
+			name:     "older version",
+			before:   func(e engine.Engine) error { return put(e, "b1", 1) },
+			startKey: "a", endKey: "c", startTime: 1, endTime: 5,
+		},
+		{
+			name:     "older version with all versions",
+			before:   func(e engine.Engine) error { return put(e, "b1", 1) },
+			startKey: "a", endKey: "c", startTime: 1, endTime: 5,
+			allVersions: true, expected: true,
+		},
+		{
+			name:     "intent",
+			before:   func(e engine.Engine) error { return putIntent(e, "b3", 4) },
+			startKey: "a", endKey: "c", startTime: 1, endTime: 5,
+		},
+		{
+			name:     "unflushed intent",
+			after:    func(e engine.Engine) error { return putIntent(e, "b15", 4) },
+			startKey: "a", endKey: "c", startTime: 1, endTime: 5,
+		},
+		{
+			name:     "unflushed write after the sstable",
+			after:    func(e engine.Engine) error { return put(e, "b3", 4) },
+			startKey: "a", endKey: "c", startTime: 1, endTime: 5, expected: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+			defer e.Close()
+
+			if err := writeSSTable(e, tc.before); err != nil {
+				t.Fatal(err)
+			}
+			if tc.after != nil {
+				if err := tc.after(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+				StartTime:   hlc.Timestamp{WallTime: tc.startTime},
+				EndTime:     hlc.Timestamp{WallTime: tc.endTime},
+				AllVersions: tc.allVersions,
+			})
+			defer iter.Close()
+			if err := iter.Error(); err != nil {
+				t.Fatal(err)
+			}
+			covered, err := iter.CoveredSSTables(roachpb.Key(tc.startKey), roachpb.Key(tc.endKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.expected {
+				if len(covered) != 0 {
+					t.Fatalf("expected no covered sstables, got %s", engine.SSTableInfos(covered))
+				}
+				return
+			}
+			if len(covered) != 1 || !covered[0].Start.Key.Equal(roachpb.Key("b1")) {
+				t.Fatalf("expected the sstable starting at b1, got %s", engine.SSTableInfos(covered))
+			}
+		})
+	}
+}
+
+func TestMVCCIncrementalIteratorSkipSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	var expected []engine.MVCCKeyValue
+	for _, key := range []string{"a", "b1", "b2", "c", "d"} {
+		value := roachpb.MakeValueFromString(key)
+		ts := hlc.Timestamp{WallTime: 1}
+		if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(key), ts, value, nil); err != nil {
+			t.Fatal(err)
+		}
+		if key != "b1" && key != "b2" && key != "d" {
+			expected = append(expected, engine.MVCCKeyValue{
+				Key: engine.MVCCKey{Key: roachpb.Key(key), Timestamp: ts}, Value: value.RawBytes,
+			})
+		}
+	}
+
+	iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+		EndTime: hlc.Timestamp{WallTime: 2},
+	})
+	defer iter.Close()
+	iter.SkipSpans([]roachpb.Span{
+		{Key: roachpb.Key("b"), EndKey: roachpb.Key("c")},
+		{Key: roachpb.Key("d"), EndKey: keys.MaxKey},
+	})
+	// Each iteration skips the spans.
+	for n := 0; n < 2; n++ {
+		var kvs []engine.MVCCKeyValue
+		for iter.Reset(keys.MinKey, keys.MaxKey); iter.Valid(); iter.Next() {
+			kvs = append(kvs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+		}
+		stats, err := iter.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertKVsEqual(t, kvs, expected)
+		if stats.SkippedSpans != 2 {
+			t.Fatalf("expected 2 skipped spans, got %d", stats.SkippedSpans)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// DescriptorChange is a change, made in the time range of an incremental
+// export, to a row of one of the system config tables which describe the
+// schema: system.namespace, system.descriptor and system.zones.
+type DescriptorChange struct {
+	// TableID is the ID of the system table containing the row.
+	TableID uint32
+	// DescID is the ID of the descriptor which the row pertains to.
+	DescID uint32
+	Key    engine.MVCCKey
+	// Value is the value of the row at Key.Timestamp. It is empty if the row
+	// was deleted, as when a descriptor is dropped.
+	Value []byte
+}
+
+// Deleted returns whether the change deleted the row.
+func (c DescriptorChange) Deleted() bool {
+	return len(c.Value) == 0
+}
+
+// ExportDescriptorHistory returns the changes to the rows of the schema
+// tables in the system config span between startTime and endTime, as seen by
+// an MVCCIncrementalIterator: the most recent version of each changed row,
+// including deletions. The changes are ordered by timestamp and then by key,
+// so that changes made at the same timestamp (by the same transaction, say)
+// are all retained. If filter is non-nil, only changes to the descriptors for
+// which it returns true are returned.
+func ExportDescriptorHistory(
+	ctx context.Context,
+	e engine.Reader,
+	startTime, endTime hlc.Timestamp,
+	filter func(descID uint32) bool,
+) ([]DescriptorChange, error) {
+	var changes []DescriptorChange
+	if err := IterateMVCCIncremental(ctx, e, keys.SystemConfigSpan, startTime, endTime,
+		MVCCIncrementalIteratorOptions{RetainKeyValues: true},
+		func(kv engine.MVCCKeyValue) error {
+			tableID, descID, ok, err := decodeDescriptorChange(ctx, e, kv.Key, kv.Value)
+			if err != nil {
+				return errors.Wrap(err, "decoding descriptor change")
+			}
+			if !ok || (filter != nil && !filter(descID)) {
+				return nil
+			}
+			changes = append(changes, DescriptorChange{
+				TableID: tableID,
+				DescID:  descID,
+				Key:     kv.Key,
+				Value:   kv.Value,
+			})
+			return nil
+		},
+	); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Key.Timestamp.Less(changes[j].Key.Timestamp)
+	})
+	return changes, nil
+}
+
+// decodeDescriptorChange returns the table and descriptor IDs of a changed
+// row of the system config span. ok is false if the row is not in one of the
+// schema tables. The rows of system.descriptor and system.zones are keyed by
+// descriptor ID, while the rows of system.namespace hold it as their value;
+// the ID of a deleted namespace row is read from the version it replaced.
+func decodeDescriptorChange(
+	ctx context.Context, e engine.Reader, key engine.MVCCKey, value []byte,
+) (tableID, descID uint32, ok bool, err error) {
+	rest, id, err := keys.DecodeTablePrefix(key.Key)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	tableID = uint32(id)
+	switch tableID {
+	case keys.DescriptorTableID, keys.ZonesTableID:
+		// Skip the index ID.
+		if rest, _, err = encoding.DecodeUvarintAscending(rest); err != nil {
+			return 0, 0, false, err
+		}
+		if _, id, err = encoding.DecodeUvarintAscending(rest); err != nil {
+			return 0, 0, false, err
+		}
+		return tableID, uint32(id), true, nil
+	case keys.NamespaceTableID:
+		v := roachpb.Value{RawBytes: value}
+		if len(value) == 0 {
+			prev, _, err := engine.MVCCGet(ctx, e, key.Key, key.Timestamp.Prev(), true /* consistent */, nil)
+			if err != nil {
+				return 0, 0, false, err
+			}
+			if prev == nil {
+				// No version of the row preceded its deletion.
+				return 0, 0, false, nil
+			}
+			v = *prev
+		}
+		nsID, err := v.GetInt()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		return tableID, uint32(nsID), true, nil
+	default:
+		return 0, 0, false, nil
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// descKey returns a key shaped like the row of the descriptor with the
+// supplied ID in system.descriptor or system.zones.
+func descKey(tableID, descID uint32) roachpb.Key {
+	k := keys.MakeTablePrefix(tableID)
+	k = encoding.EncodeUvarintAscending(k, 1)
+	k = encoding.EncodeUvarintAscending(k, uint64(descID))
+	return keys.MakeFamilyKey(k, 2)
+}
+
+// namespaceKey returns a key shaped like the row of system.namespace for the
+// supplied name.
+func namespaceKey(parentID uint32, name string) roachpb.Key {
+	k := keys.MakeTablePrefix(keys.NamespaceTableID)
+	k = encoding.EncodeUvarintAscending(k, 1)
+	k = encoding.EncodeUvarintAscending(k, uint64(parentID))
+	k = encoding.EncodeBytesAscending(k, []byte(name))
+	return keys.MakeFamilyKey(k, 3)
+}
+
+func TestExportDescriptorHistory(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	put := func(key roachpb.Key, wall int64, value roachpb.Value) {
+		if err := engine.MVCCPut(ctx, e, nil, key, hlc.Timestamp{WallTime: wall}, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putDesc := func(tableID, descID uint32, wall int64) {
+		put(descKey(tableID, descID), wall,
+			roachpb.MakeValueFromString(fmt.Sprintf("desc-%d-%d-%d", tableID, descID, wall)))
+	}
+	putName := func(name string, descID uint32, wall int64) {
+		var v roachpb.Value
+		v.SetInt(int64(descID))
+		put(namespaceKey(50, name), wall, v)
+	}
+	del := func(key roachpb.Key, wall int64) {
+		if err := engine.MVCCDelete(ctx, e, nil, key, hlc.Timestamp{WallTime: wall}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Before the window: tables 51 and 52 are created, and 51 gets a zone.
+	putName("t", 51, 1)
+	putDesc(keys.DescriptorTableID, 51, 1)
+	putName("u", 52, 1)
+	putDesc(keys.DescriptorTableID, 52, 1)
+	putDesc(keys.ZonesTableID, 51, 1)
+	// In the window: table 51 is altered at the same timestamp as table 53 is
+	// created, the zone of 51 is changed, and table 52 is dropped.
+	putName("v", 53, 3)
+	putDesc(keys.DescriptorTableID, 51, 3)
+	putDesc(keys.DescriptorTableID, 53, 3)
+	putDesc(keys.ZonesTableID, 51, 4)
+	putDesc(keys.DescriptorTableID, 52, 4)
+	del(namespaceKey(50, "u"), 5)
+	del(descKey(keys.DescriptorTableID, 52), 5)
+	// Rows of other system tables, and of user tables, are not schema changes.
+	putDesc(keys.UsersTableID, 51, 3)
+	putDesc(60, 51, 3)
+	// After the window.
+	putDesc(keys.DescriptorTableID, 51, 20)
+
+	type change struct {
+		tableID, descID uint32
+		wall            int64
+		deleted         bool
+	}
+	startTime, endTime := hlc.Timestamp{WallTime: 2}, hlc.Timestamp{WallTime: 10}
+	testCases := []struct {
+		filter   func(uint32) bool
+		expected []change
+	}{
+		{nil, []change{
+			{keys.NamespaceTableID, 53, 3, false},
+			{keys.DescriptorTableID, 51, 3, false},
+			{keys.DescriptorTableID, 53, 3, false},
+			{keys.ZonesTableID, 51, 4, false},
+			{keys.NamespaceTableID, 52, 5, true},
+			{keys.DescriptorTableID, 52, 5, true},
+		}},
+		{func(id uint32) bool { return id == 51 }, []change{
+			{keys.DescriptorTableID, 51, 3, false},
+			{keys.ZonesTableID, 51, 4, false},
+		}},
+		{func(id uint32) bool { return id == 52 }, []change{
+			{keys.NamespaceTableID, 52, 5, true},
+			{keys.DescriptorTableID, 52, 5, true},
+		}},
+		{func(id uint32) bool { return false }, nil},
+	}
+	for i, c := range testCases {
+		changes, err := ExportDescriptorHistory(ctx, e, startTime, endTime, c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual []change
+		for _, d := range changes {
+			actual = append(actual, change{d.TableID, d.DescID, d.Key.Timestamp.WallTime, d.Deleted()})
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%d: expected changes %+v, got %+v", i, c.expected, actual)
+		}
+	}
+
+	// The changes are included in the manifest of an export.
+	sink := &FakeExportSink{}
+	h := &ExportTestHarness{
+		Engine:            e,
+		Sink:              sink,
+		ChunkSize:         10,
+		ExportDescriptors: true,
+		DescriptorFilter:  func(id uint32) bool { return id == 53 },
+	}
+	span := roachpb.Span{Key: keys.MakeTablePrefix(60), EndKey: keys.MakeTablePrefix(61)}
+	if err := h.Export(span, startTime, endTime); err != nil {
+		t.Fatal(err)
+	}
+	manifests := sink.Manifests()
+	if len(manifests) != 1 {
+		t.Fatalf("expected 1 manifest, got %d", len(manifests))
+	}
+	descs := manifests[0].Descriptors
+	if len(descs) != 2 || descs[0].DescID != 53 || descs[1].DescID != 53 {
+		t.Fatalf("expected the two changes of descriptor 53 in the manifest, got %+v", descs)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// diffRangeMaxBytes is the size, in key and value bytes, beyond which the diff
+// returned by DiffRangeAtTimestamps is truncated.
+const diffRangeMaxBytes = 16 << 20 // 16 MiB
+
+// DiffEntry describes how a key changed between two timestamps. See
+// DiffRangeAtTimestamps.
+type DiffEntry struct {
+	Key roachpb.Key
+	// Before and After are the values of the key visible at the earlier and
+	// the later timestamp, with the timestamps at which they were written.
+	// They are nil where the key didn't exist or was deleted.
+	Before, After *roachpb.Value
+	// Versions are the versions of the key written after the earlier
+	// timestamp and at or before the later one, newest first, so the first is
+	// the version visible at the later timestamp. Deletions have nil values.
+	Versions []engine.MVCCKeyValue
+}
+
+// size returns the number of key and value bytes in the entry.
+func (d DiffEntry) size() int64 {
+	size := int64(len(d.Key))
+	if d.Before != nil {
+		size += int64(len(d.Before.RawBytes))
+	}
+	for _, v := range d.Versions {
+		size += int64(len(v.Key.Key) + len(v.Value))
+	}
+	return size
+}
+
+// DiffRangeAtTimestamps returns, for each key in [startKey, endKey) which was
+// written after t1 and at or before t2, its values visible at t1 and t2 and
+// the versions written in between, in key order. It is intended for debugging
+// replica divergence after the fact: the diffs of the engines of two replicas
+// of a range show where their histories differ.
+//
+// The versions are found with an MVCCIncrementalIterator over every version in
+// the time range, and the value at t1 of each changed key by a point lookup.
+// An intent in the time range results in an *IntentConflictError. If the diff
+// exceeds diffRangeMaxBytes it is truncated, and the returned resume key is
+// the key at which the remainder of the diff begins.
+func DiffRangeAtTimestamps(
+	ctx context.Context, e engine.Reader, startKey, endKey roachpb.Key, t1, t2 hlc.Timestamp,
+) ([]DiffEntry, roachpb.Key, error) {
+	return diffRange(ctx, e, startKey, endKey, t1, t2, diffRangeMaxBytes)
+}
+
+// diffRange implements DiffRangeAtTimestamps, truncating the diff once it
+// exceeds maxBytes. At least one entry is returned before the diff is
+// truncated.
+func diffRange(
+	ctx context.Context,
+	e engine.Reader,
+	startKey, endKey roachpb.Key,
+	t1, t2 hlc.Timestamp,
+	maxBytes int64,
+) ([]DiffEntry, roachpb.Key, error) {
+	if !t1.Less(t2) {
+		return nil, nil, errors.Errorf("invalid time range: %s is not before %s", t1, t2)
+	}
+	// The iterator's time range excludes its end, while the diff includes t2
+	// but excludes t1.
+	iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+		StartTime:   t1.Next(),
+		EndTime:     t2.Next(),
+		AllVersions: true,
+	})
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		return nil, nil, err
+	}
+
+	var entries []DiffEntry
+	var size int64
+	// add looks up the value of the entry's key at t1 and appends the entry to
+	// the diff. It returns false, without appending the entry, if the diff is
+	// full.
+	add := func(entry DiffEntry) (bool, error) {
+		before, _, err := engine.MVCCGet(ctx, e, entry.Key, t1, true /* consistent */, nil /* txn */)
+		if err != nil {
+			return false, err
+		}
+		entry.Before = before
+		entrySize := entry.size()
+		if len(entries) > 0 && size+entrySize > maxBytes {
+			return false, nil
+		}
+		entries = append(entries, entry)
+		size += entrySize
+		return true, nil
+	}
+
+	var entry DiffEntry
+	for iter.Reset(startKey, endKey); ; iter.Next() {
+		if ok, err := iter.ValidWithErr(); err != nil {
+			return nil, nil, err
+		} else if !ok {
+			break
+		}
+		if len(entry.Versions) > 0 && !iter.UnsafeKey().Key.Equal(entry.Key) {
+			if ok, err := add(entry); err != nil {
+				return nil, nil, err
+			} else if !ok {
+				return entries, entry.Key, nil
+			}
+			entry = DiffEntry{}
+		}
+		version := engine.MVCCKeyValue{Key: iter.Key()}
+		if value := iter.UnsafeValue(); len(value) > 0 {
+			version.Value = iter.Value()
+		}
+		if len(entry.Versions) == 0 {
+			entry.Key = version.Key.Key
+			if len(version.Value) > 0 {
+				entry.After = &roachpb.Value{RawBytes: version.Value, Timestamp: version.Key.Timestamp}
+			}
+		}
+		entry.Versions = append(entry.Versions, version)
+	}
+	if _, err := iter.Finish(); err != nil {
+		return nil, nil, err
+	}
+	if len(entry.Versions) > 0 {
+		if ok, err := add(entry); err != nil {
+			return nil, nil, err
+		} else if !ok {
+			return entries, entry.Key, nil
+		}
+	}
+	return entries, nil, nil
+}
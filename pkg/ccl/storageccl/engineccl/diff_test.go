@@ -0,0 +1,122 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestDiffRangeAtTimestamps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	value := roachpb.MakeValueFromString
+	put := func(key string, wallTime int64, s string) {
+		if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(key), ts(wallTime), value(s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	del := func(key string, wallTime int64) {
+		if err := engine.MVCCDelete(ctx, e, nil, roachpb.Key(key), ts(wallTime), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The diff is taken between t1 = 2 and t2 = 10.
+	put("a", 1, "a1") // unchanged in the window
+	put("b", 5, "b5") // created in the window
+	put("c", 1, "c1") // updated twice in the window
+	put("c", 4, "c4")
+	put("c", 6, "c6")
+	put("d", 1, "d1") // deleted in the window
+	del("d", 7)
+	put("e", 2, "e2") // written at t1, and after t2
+	put("e", 12, "e12")
+
+	versionKey := func(key string, wallTime int64) engine.MVCCKey {
+		return engine.MVCCKey{Key: roachpb.Key(key), Timestamp: ts(wallTime)}
+	}
+	// The values visible at t1 and t2 carry their timestamps, as returned by
+	// MVCCGet.
+	valuePtr := func(s string, wallTime int64) *roachpb.Value {
+		v := value(s)
+		v.Timestamp = ts(wallTime)
+		return &v
+	}
+	expected := []DiffEntry{
+		{
+			Key:   roachpb.Key("b"),
+			After: valuePtr("b5", 5),
+			Versions: []engine.MVCCKeyValue{
+				{Key: versionKey("b", 5), Value: value("b5").RawBytes},
+			},
+		},
+		{
+			Key:    roachpb.Key("c"),
+			Before: valuePtr("c1", 1),
+			After:  valuePtr("c6", 6),
+			Versions: []engine.MVCCKeyValue{
+				{Key: versionKey("c", 6), Value: value("c6").RawBytes},
+				{Key: versionKey("c", 4), Value: value("c4").RawBytes},
+			},
+		},
+		{
+			Key:    roachpb.Key("d"),
+			Before: valuePtr("d1", 1),
+			Versions: []engine.MVCCKeyValue{
+				{Key: versionKey("d", 7)},
+			},
+		},
+	}
+
+	start, end := roachpb.Key("a"), roachpb.Key("z")
+	diff, resumeKey, err := DiffRangeAtTimestamps(ctx, e, start, end, ts(2), ts(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumeKey != nil {
+		t.Fatalf("expected no resume key, got %s", resumeKey)
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("expected diff %+v, got %+v", expected, diff)
+	}
+
+	// A diff which is truncated can be resumed, one entry at a time.
+	var resumed []DiffEntry
+	for key := start; key != nil; {
+		var entries []DiffEntry
+		entries, key, err = diffRange(ctx, e, key, end, ts(2), ts(10), 1 /* maxBytes */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 entry before resume key %s, got %d", key, len(entries))
+		}
+		resumed = append(resumed, entries...)
+	}
+	if !reflect.DeepEqual(resumed, expected) {
+		t.Fatalf("expected resumed diff %+v, got %+v", expected, resumed)
+	}
+
+	if _, _, err := DiffRangeAtTimestamps(ctx, e, start, end, ts(10), ts(2)); err == nil {
+		t.Fatal("expected an error for an inverted time range")
+	}
+}
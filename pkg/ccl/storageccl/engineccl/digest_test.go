@@ -0,0 +1,100 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestIncrementalDigest(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	put := func(e engine.Engine, key string, ts int64, value string) {
+		if err := engine.MVCCPut(
+			ctx, e, nil, roachpb.Key(key), hlc.Timestamp{WallTime: ts}, roachpb.MakeValueFromString(value), nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type version struct {
+		key   string
+		ts    int64
+		value string
+	}
+	versions := []version{
+		{"a", 1, "a1"}, {"a", 2, "a2"}, {"b", 3, "b3"}, {"c", 2, "c2"}, {"c", 3, "c3"}, {"d", 4, "d4"},
+	}
+	span := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")}
+	startTime, endTime := hlc.Timestamp{WallTime: 2}, hlc.Timestamp{WallTime: 4}
+	digest := func(e engine.Reader) []byte {
+		d, err := IncrementalDigest(ctx, e, span, startTime, endTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	e1 := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e1.Close()
+	for _, v := range versions {
+		put(e1, v.key, v.ts, v.value)
+	}
+	expected := digest(e1)
+
+	testCases := []struct {
+		name   string
+		mutate func(engine.Engine)
+		equal  bool
+	}{
+		{"identical", func(engine.Engine) {}, true},
+		// Versions outside of the window don't contribute to the digest.
+		{"before", func(e engine.Engine) { put(e, "e", 1, "e1") }, true},
+		{"after", func(e engine.Engine) { put(e, "b", 5, "b5") }, true},
+		{"added", func(e engine.Engine) { put(e, "f", 3, "f3") }, false},
+		{"changed", func(e engine.Engine) { put(e, "b", 3, "changed") }, false},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			// The second engine is written in a different order, with its
+			// versions spread over sstables.
+			e2 := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+			defer e2.Close()
+			for i := len(versions) - 1; i >= 0; i-- {
+				v := versions[i]
+				put(e2, v.key, v.ts, v.value)
+				if err := e2.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.mutate(e2)
+			if equal := bytes.Equal(digest(e2), expected); equal != c.equal {
+				t.Fatalf("expected equal digests %t, got %t", c.equal, equal)
+			}
+		})
+	}
+
+	// A window without versions has a digest of its own.
+	emptyTime := hlc.Timestamp{WallTime: 10}
+	empty, err := IncrementalDigest(ctx, e1, span, emptyTime, emptyTime.Next())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(empty, expected) {
+		t.Errorf("expected the digest of an empty window to differ, got %x", empty)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// ingestFileCounter names the files WriteAndIngestSst stages for ingestion,
+// so that concurrent ingestions into an engine don't collide.
+var ingestFileCounter int64
+
+// WriteAndIngestSst ingests an sstable, such as one written by an export, into
+// the engine. The sstable is staged in a file of the engine's auxiliary
+// directory, which is moved into the engine. Its keys are visible to new
+// iterators once WriteAndIngestSst returns, and shadow any versions of the
+// same keys already in the engine. The sstable must have been written by
+// engine.RocksDBSstFileWriter, which records the timestamp properties that
+// let time-bound iterators skip it.
+func WriteAndIngestSst(ctx context.Context, e engine.Engine, sstBytes []byte) error {
+	if len(sstBytes) == 0 {
+		return errors.New("cannot ingest an empty sstable")
+	}
+	path := filepath.Join(e.GetAuxiliaryDir(),
+		fmt.Sprintf("ingest-%d.sst", atomic.AddInt64(&ingestFileCounter, 1)))
+	if err := e.WriteFile(path, sstBytes); err != nil {
+		return errors.Wrapf(err, "writing sstable to %s", path)
+	}
+	// The sstable's keys may overlap existing data, including data in the
+	// memtable, which they must shadow.
+	if err := e.IngestExternalFile(path, engine.IngestExternalFileOptions{
+		MoveFile:           true,
+		AllowGlobalSeqNo:   true,
+		AllowBlockingFlush: true,
+	}); err != nil {
+		// A file which failed to be ingested remains where it was staged.
+		if delErr := e.DeleteFile(path); delErr != nil {
+			log.Warningf(ctx, "could not remove sstable %s: %s", path, delErr)
+		}
+		return errors.Wrapf(err, "ingesting sstable %s", path)
+	}
+	log.VEventf(ctx, 2, "ingested sstable of %d bytes", len(sstBytes))
+	return nil
+}
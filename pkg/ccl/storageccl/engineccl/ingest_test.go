@@ -0,0 +1,286 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// exportWindow writes the most recent version of each key written in the
+// window [startTime, endTime) of the engine to an sstable, and returns its
+// contents.
+func exportWindow(
+	t *testing.T, e engine.Reader, dir string, startTime, endTime hlc.Timestamp,
+) []byte {
+	path := filepath.Join(dir, endTime.String()+".sst")
+	sst := engine.MakeRocksDBSstFileWriter()
+	if err := sst.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+		StartTime: startTime,
+		EndTime:   endTime,
+	})
+	defer iter.Close()
+	for iter.Reset(keys.MinKey, keys.MaxKey); iter.Valid(); iter.Next() {
+		kv := engine.MVCCKeyValue{Key: iter.UnsafeKey(), Value: iter.UnsafeValue()}
+		if err := sst.Add(kv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := iter.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// scanAll returns every version of every key the iterator emits.
+func scanAll(t *testing.T, iter engine.Iterator) []engine.MVCCKeyValue {
+	defer iter.Close()
+	var kvs []engine.MVCCKeyValue
+	for iter.Seek(engine.MakeMVCCMetadataKey(keys.MinKey)); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			break
+		}
+		kvs = append(kvs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+	}
+	return kvs
+}
+
+// TestWriteAndIngestSst verifies that the windows of an incremental export
+// round-trip through ingestion, and that the ingested sstables can be skipped
+// by time-bound iterators.
+func TestWriteAndIngestSst(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&TimeBoundIteratorsEnabled, true)()
+
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	kv := func(key string, wallTime int64) engine.MVCCKeyValue {
+		return engine.MVCCKeyValue{
+			Key:   engine.MVCCKey{Key: roachpb.Key(key), Timestamp: hlc.Timestamp{WallTime: wallTime}},
+			Value: roachpb.MakeValueFromString(key).RawBytes,
+		}
+	}
+	put := func(e engine.Engine, kvs ...engine.MVCCKeyValue) {
+		for _, kv := range kvs {
+			if err := e.Put(kv.Key, kv.Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	src := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer src.Close()
+	put(src, kv("a", 1), kv("b", 2), kv("c", 1), kv("b", 4), kv("d", 5))
+	// The first window holds a@1, b@2 and c@1, and the second b@4 and d@5.
+	first := exportWindow(t, src, dir, hlc.Timestamp{}, hlc.Timestamp{WallTime: 3})
+	second := exportWindow(t, src, dir, hlc.Timestamp{WallTime: 3}, hlc.Timestamp{WallTime: 6})
+
+	dst, err := engine.NewRocksDB(
+		roachpb.Attributes{},
+		filepath.Join(dir, "dst"),
+		engine.RocksDBCache{},
+		0,
+		engine.DefaultMaxOpenFiles,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := WriteAndIngestSst(ctx, dst, first); err != nil {
+		t.Fatal(err)
+	}
+	// The second window overlaps data in the memtable, which must be flushed
+	// before it is ingested.
+	put(dst, kv("c", 3))
+	if err := WriteAndIngestSst(ctx, dst, second); err != nil {
+		t.Fatal(err)
+	}
+
+	assertKVsEqual(t, scanAll(t, dst.NewIterator(false)), []engine.MVCCKeyValue{
+		kv("a", 1), kv("b", 4), kv("b", 2), kv("c", 3), kv("c", 1), kv("d", 5),
+	})
+	// The sstable of the first window is skipped entirely.
+	assertKVsEqual(t, scanAll(t, dst.NewTimeBoundIterator(
+		hlc.Timestamp{WallTime: 3}, hlc.Timestamp{WallTime: 5},
+	)), []engine.MVCCKeyValue{
+		kv("b", 4), kv("c", 3), kv("d", 5),
+	})
+	assertEqualKVs(
+		dst, keys.MinKey, keys.MaxKey, hlc.Timestamp{WallTime: 3}, hlc.Timestamp{WallTime: 6},
+		[]engine.MVCCKeyValue{kv("b", 4), kv("c", 3), kv("d", 5)},
+	)(t)
+
+	// The staged files were moved into the engine.
+	if files, err := ioutil.ReadDir(dst.GetAuxiliaryDir()); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("expected the auxiliary directory to be empty, found %d files", len(files))
+	}
+
+	if err := WriteAndIngestSst(ctx, dst, nil); !testutils.IsError(err, "empty sstable") {
+		t.Fatalf("expected an error ingesting an empty sstable, got %v", err)
+	}
+}
+
+// keyRewriterFunc adapts a function to the KeyRewriter interface.
+type keyRewriterFunc func(key []byte) ([]byte, bool, error)
+
+func (f keyRewriterFunc) RewriteKey(key []byte) ([]byte, bool, error) {
+	return f(key)
+}
+
+// TestIterateMVCCIncrementalKeyRewriter verifies that the keys emitted by an
+// incremental iteration can be rewritten to the prefix of another table as
+// they are exported, and the result ingested under the new prefix in order,
+// and that a rewrite which breaks the order of the keys fails the iteration.
+func TestIterateMVCCIncrementalKeyRewriter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	tableKey := func(tableID uint32, pk string) roachpb.Key {
+		key := keys.MakeTablePrefix(tableID)
+		key = encoding.EncodeUvarintAscending(key, 1 /* index */)
+		return encoding.EncodeStringAscending(key, pk)
+	}
+	kv := func(tableID uint32, pk string, wallTime int64) engine.MVCCKeyValue {
+		return engine.MVCCKeyValue{
+			Key: engine.MVCCKey{
+				Key:       tableKey(tableID, pk),
+				Timestamp: hlc.Timestamp{WallTime: wallTime},
+			},
+			Value: roachpb.MakeValueFromString(pk).RawBytes,
+		}
+	}
+	src := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer src.Close()
+	for _, v := range []engine.MVCCKeyValue{
+		kv(50, "x", 1), kv(51, "a", 1), kv(51, "a", 3), kv(51, "b", 2), kv(51, "c", 1), kv(52, "z", 1),
+	} {
+		if err := src.Put(v.Key, v.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPrefix, newPrefix := keys.MakeTablePrefix(51), keys.MakeTablePrefix(99)
+	rewriter := keyRewriterFunc(func(key []byte) ([]byte, bool, error) {
+		if !bytes.HasPrefix(key, oldPrefix) {
+			return nil, false, nil
+		}
+		return append(append([]byte(nil), newPrefix...), key[len(oldPrefix):]...), true, nil
+	})
+	span := roachpb.Span{Key: keys.MinKey, EndKey: keys.MaxKey}
+	endTime := hlc.Timestamp{WallTime: 5}
+	// Only the keys of table 51 are exported, under the prefix of table 99,
+	// with their timestamps and values.
+	expected := []engine.MVCCKeyValue{kv(99, "a", 3), kv(99, "a", 1), kv(99, "b", 2), kv(99, "c", 1)}
+
+	// The rewritten keys may be retained by the callback.
+	var retained []engine.MVCCKeyValue
+	if err := IterateMVCCIncremental(ctx, src, span, hlc.Timestamp{}, endTime,
+		MVCCIncrementalIteratorOptions{KeyRewriter: rewriter, RetainKeyValues: true},
+		func(kv engine.MVCCKeyValue) error {
+			retained = append(retained, kv)
+			return nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	assertKVsEqual(t, retained, expected)
+
+	// The rewritten keys are written to an sstable which is ingested.
+	path := filepath.Join(dir, "rewritten.sst")
+	sst := engine.MakeRocksDBSstFileWriter()
+	if err := sst.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := IterateMVCCIncremental(ctx, src, span, hlc.Timestamp{}, endTime,
+		MVCCIncrementalIteratorOptions{KeyRewriter: rewriter}, sst.Add,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := engine.NewRocksDB(
+		roachpb.Attributes{},
+		filepath.Join(dir, "dst"),
+		engine.RocksDBCache{},
+		0,
+		engine.DefaultMaxOpenFiles,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := WriteAndIngestSst(ctx, dst, data); err != nil {
+		t.Fatal(err)
+	}
+	assertKVsEqual(t, scanAll(t, dst.NewIterator(false)), expected)
+
+	// A rewrite which moves a key before the key emitted before it fails.
+	collapse := keyRewriterFunc(func(key []byte) ([]byte, bool, error) {
+		if !bytes.HasPrefix(key, oldPrefix) {
+			return nil, false, nil
+		}
+		return tableKey(99, "a"), true, nil
+	})
+	err = IterateMVCCIncremental(ctx, src, span, hlc.Timestamp{}, endTime,
+		MVCCIncrementalIteratorOptions{KeyRewriter: collapse},
+		func(engine.MVCCKeyValue) error { return nil },
+	)
+	if orderErr, ok := err.(*KeyRewriteOrderError); !ok {
+		t.Fatalf("expected a *KeyRewriteOrderError, got %v", err)
+	} else if e := kv(51, "b", 2).Key; !orderErr.Key.Equal(e) {
+		t.Fatalf("expected the rewrite of %s to fail, got %s", e, orderErr.Key)
+	}
+
+	// The errors of the rewriter stop the iteration.
+	failing := keyRewriterFunc(func([]byte) ([]byte, bool, error) {
+		return nil, false, errors.New("injected error")
+	})
+	if err := IterateMVCCIncremental(ctx, src, span, hlc.Timestamp{}, endTime,
+		MVCCIncrementalIteratorOptions{KeyRewriter: failing},
+		func(engine.MVCCKeyValue) error { return nil },
+	); !testutils.IsError(err, "injected error") {
+		t.Fatalf("expected the injected error, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+)
+
+// KeyRewriter rewrites the keys emitted by an iteration, such as to move the
+// exported data of a table under the prefix of the table it is restored into,
+// rather than copying every key again once exported. storageccl.KeyRewriter
+// implements it.
+type KeyRewriter interface {
+	// RewriteKey returns the key to emit in place of the supplied one, or
+	// false if the key is to be dropped. The supplied key may be modified,
+	// and reused by the returned key.
+	RewriteKey(key []byte) (newKey []byte, ok bool, err error)
+}
+
+// KeyRewriteOrderError is returned by an iteration whose KeyRewriter rewrote
+// a key to sort at or before the key emitted before it. Sstables, and so
+// exports and ingestion, require their keys to be in order.
+type KeyRewriteOrderError struct {
+	IterationContext
+	// Key is the key which was rewritten to RewrittenKey.
+	Key, RewrittenKey engine.MVCCKey
+	// PrevKey is the rewritten key emitted before it.
+	PrevKey engine.MVCCKey
+}
+
+func (e *KeyRewriteOrderError) Error() string {
+	return fmt.Sprintf("key %s was rewritten to %s, which does not sort after %s (%s)",
+		e.Key, e.RewrittenKey, e.PrevKey, e.IterationContext)
+}
+
+// keyRewriteState applies a KeyRewriter to the keys of an iteration in turn,
+// and verifies that the rewritten keys remain in order. Timestamps are
+// preserved.
+type keyRewriteState struct {
+	rewriter KeyRewriter
+	// buf is the copy of the key passed to the rewriter, which may modify it;
+	// it is reused unless the rewritten keys are retained.
+	buf []byte
+	// prev is a copy of the last rewritten key, if hasPrev is set.
+	prev    engine.MVCCKey
+	hasPrev bool
+}
+
+// rewrite returns the rewritten key, or false if the key is to be dropped. If
+// retain is set, the returned key doesn't share memory with the supplied key
+// or any other returned key; otherwise it is only valid until the next call.
+func (s *keyRewriteState) rewrite(
+	iterCtx IterationContext, key engine.MVCCKey, retain bool,
+) (engine.MVCCKey, bool, error) {
+	if retain {
+		s.buf = nil
+	}
+	s.buf = append(s.buf[:0], key.Key...)
+	newKey, ok, err := s.rewriter.RewriteKey(s.buf)
+	if err != nil {
+		return engine.MVCCKey{}, false, errors.Wrapf(err, "rewriting key %s", key)
+	}
+	if !ok {
+		return engine.MVCCKey{}, false, nil
+	}
+	rewritten := engine.MVCCKey{Key: newKey, Timestamp: key.Timestamp}
+	if s.hasPrev && !s.prev.Less(rewritten) {
+		return engine.MVCCKey{}, false, &KeyRewriteOrderError{
+			IterationContext: iterCtx,
+			Key:              key,
+			RewrittenKey:     rewritten,
+			PrevKey:          s.prev,
+		}
+	}
+	s.prev.Key = append(s.prev.Key[:0], newKey...)
+	s.prev.Timestamp = key.Timestamp
+	s.hasPrev = true
+	return rewritten, true, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// kvBatchBlockSize is the size of the blocks of a KVBatch's arena. A key/value
+// larger than a block is given a block of its own.
+const kvBatchBlockSize = 64 << 10 // 64 KiB
+
+// kvBatchPoison is written over the arena of a released KVBatch in race
+// builds.
+const kvBatchPoison = 0xdb
+
+var kvBatchPool = sync.Pool{
+	New: func() interface{} {
+		return &KVBatch{}
+	},
+}
+
+// KVBatch is a batch of key/values, such as those emitted by an
+// MVCCIncrementalIterator, which are copied into an arena of large blocks
+// rather than each into allocations of their own. It is intended to carry
+// key/values from an iterator to a sink: the key/values returned by a batch
+// are only valid until it is released, so a sink which retains them must copy
+// them. To catch sinks which don't, the arena of a released batch is poisoned
+// in race builds.
+type KVBatch struct {
+	// blocks is the arena. Key/values are appended to the last block, and a
+	// new block is allocated once it is full.
+	blocks  [][]byte
+	entries []kvBatchEntry
+	// size is the total size of the keys and values.
+	size int64
+	// released is set by Release, and cleared when the batch is reused.
+	released bool
+}
+
+// kvBatchEntry locates a key/value in the arena of a KVBatch. The key is
+// followed by the value.
+type kvBatchEntry struct {
+	block            int32
+	offset           int32
+	keyLen, valueLen int32
+	timestamp        hlc.Timestamp
+}
+
+// NewKVBatch returns an empty KVBatch, which should be released once it is no
+// longer needed.
+func NewKVBatch() *KVBatch {
+	b := kvBatchPool.Get().(*KVBatch)
+	b.released = false
+	return b
+}
+
+// Add copies a key/value into the batch.
+func (b *KVBatch) Add(key engine.MVCCKey, value []byte) {
+	n := len(key.Key) + len(value)
+	if len(b.blocks) == 0 || cap(b.blocks[len(b.blocks)-1])-len(b.blocks[len(b.blocks)-1]) < n {
+		size := kvBatchBlockSize
+		if n > size {
+			size = n
+		}
+		b.blocks = append(b.blocks, make([]byte, 0, size))
+	}
+	i := len(b.blocks) - 1
+	e := kvBatchEntry{
+		block:     int32(i),
+		offset:    int32(len(b.blocks[i])),
+		keyLen:    int32(len(key.Key)),
+		valueLen:  int32(len(value)),
+		timestamp: key.Timestamp,
+	}
+	b.blocks[i] = append(append(b.blocks[i], key.Key...), value...)
+	b.entries = append(b.entries, e)
+	b.size += int64(n)
+}
+
+// Len returns the number of key/values in the batch.
+func (b *KVBatch) Len() int {
+	return len(b.entries)
+}
+
+// Size returns the total size of the keys and values in the batch.
+func (b *KVBatch) Size() int64 {
+	return b.size
+}
+
+// KV returns the i'th key/value added to the batch. Its memory is owned by the
+// batch, and is invalidated by Release. Empty keys and values are returned as
+// nil.
+func (b *KVBatch) KV(i int) engine.MVCCKeyValue {
+	e := b.entries[i]
+	block := b.blocks[e.block]
+	keyEnd := int(e.offset + e.keyLen)
+	valueEnd := keyEnd + int(e.valueLen)
+	kv := engine.MVCCKeyValue{Key: engine.MVCCKey{Timestamp: e.timestamp}}
+	// The slices are capped so that appending to one can't overwrite the
+	// key/value following it.
+	if e.keyLen > 0 {
+		kv.Key.Key = block[e.offset:keyEnd:keyEnd]
+	}
+	if e.valueLen > 0 {
+		kv.Value = block[keyEnd:valueEnd:valueEnd]
+	}
+	return kv
+}
+
+// KVs returns the key/values in the batch, in the order in which they were
+// added. Their memory is owned by the batch, as for KV.
+func (b *KVBatch) KVs() []engine.MVCCKeyValue {
+	kvs := make([]engine.MVCCKeyValue, len(b.entries))
+	for i := range kvs {
+		kvs[i] = b.KV(i)
+	}
+	return kvs
+}
+
+// Release empties the batch and returns it to a pool for reuse, invalidating
+// the key/values returned by it. The batch must not be used afterwards, and
+// must be released only once: a batch pooled twice would be handed out to two
+// users at once, each overwriting the key/values of the other. A second
+// Release before the batch is reused is therefore ignored, or panics in race
+// builds to catch the misuse.
+func (b *KVBatch) Release() {
+	if b.released {
+		if raceEnabled {
+			panic("KVBatch released twice")
+		}
+		return
+	}
+	b.released = true
+	if raceEnabled {
+		for _, block := range b.blocks {
+			for i := range block {
+				block[i] = kvBatchPoison
+			}
+		}
+	}
+	// Only the first block is kept, so that a batch which once held a large
+	// chunk doesn't pin its memory while pooled.
+	if len(b.blocks) > 0 && cap(b.blocks[0]) == kvBatchBlockSize {
+		b.blocks = b.blocks[:1]
+		b.blocks[0] = b.blocks[0][:0]
+	} else {
+		b.blocks = nil
+	}
+	b.entries = b.entries[:0]
+	b.size = 0
+	kvBatchPool.Put(b)
+}
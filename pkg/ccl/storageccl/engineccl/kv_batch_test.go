@@ -0,0 +1,95 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestKVBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var expected []engine.MVCCKeyValue
+	for i := 0; i < 1000; i++ {
+		kv := engine.MVCCKeyValue{
+			Key: engine.MVCCKey{
+				Key:       roachpb.Key(fmt.Sprintf("key-%04d", i)),
+				Timestamp: hlc.Timestamp{WallTime: int64(i), Logical: int32(i % 3)},
+			},
+			Value: bytes.Repeat([]byte{byte(i)}, i%200),
+		}
+		switch {
+		case len(kv.Value) == 0:
+			// A deletion, whose empty value the batch returns as nil.
+			kv.Value = nil
+		case i == 500:
+			// A value larger than a block.
+			kv.Value = bytes.Repeat([]byte{'v'}, 2*kvBatchBlockSize)
+		}
+		expected = append(expected, kv)
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		// The second pass reuses a released batch.
+		batch := NewKVBatch()
+		for _, kv := range expected {
+			batch.Add(kv.Key, kv.Value)
+		}
+		if batch.Len() != len(expected) {
+			t.Fatalf("expected %d key/values, got %d", len(expected), batch.Len())
+		}
+		kvs := batch.KVs()
+		if !reflect.DeepEqual(kvs, expected) {
+			t.Fatalf("%d: batch does not return the key/values added to it", pass)
+		}
+		// Appending to a key/value doesn't overwrite the next.
+		_ = append(kvs[1].Value, 'x')
+		if !bytes.Equal(batch.KV(2).Key.Key, expected[2].Key.Key) {
+			t.Fatalf("%d: expected key %s, got %s", pass, expected[2].Key.Key, batch.KV(2).Key.Key)
+		}
+
+		batch.Release()
+		// A sink which retains the key/values past Release sees them
+		// poisoned in race builds.
+		if raceEnabled {
+			if v := kvs[1].Value; !bytes.Equal(v, bytes.Repeat([]byte{kvBatchPoison}, len(v))) {
+				t.Fatalf("%d: expected the released value to be poisoned, got %q", pass, v)
+			}
+		}
+	}
+}
+
+// TestKVBatchReleaseTwice verifies that releasing a batch twice doesn't pool
+// it twice, which would hand it out to two users at once.
+func TestKVBatchReleaseTwice(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	batch := NewKVBatch()
+	batch.Add(engine.MVCCKey{Key: roachpb.Key("a")}, []byte("a"))
+	batch.Release()
+	if raceEnabled {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected the second release to panic in race builds")
+			}
+		}()
+	}
+	batch.Release()
+	if b1, b2 := NewKVBatch(), NewKVBatch(); b1 == b2 {
+		t.Fatal("a batch released twice was handed out twice")
+	}
+}
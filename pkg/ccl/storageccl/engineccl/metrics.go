@@ -0,0 +1,155 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import "github.com/cockroachdb/cockroach/pkg/util/metric"
+
+var (
+	metaIncrementalIterations = metric.Metadata{
+		Name: "engineccl.incremental.iterations",
+		Help: "Number of iterations by MVCCIncrementalIterators"}
+	metaIncrementalTimeBoundIterations = metric.Metadata{
+		Name: "engineccl.incremental.timebound_iterations",
+		Help: "Number of iterations by MVCCIncrementalIterators which used time-bound iterators"}
+	metaIncrementalFailedIterations = metric.Metadata{
+		Name: "engineccl.incremental.failed_iterations",
+		Help: "Number of iterations by MVCCIncrementalIterators which ended with an error"}
+	metaIncrementalEmittedKeys = metric.Metadata{
+		Name: "engineccl.incremental.emitted_keys",
+		Help: "Number of keys emitted by MVCCIncrementalIterators"}
+	metaIncrementalEmittedDeletions = metric.Metadata{
+		Name: "engineccl.incremental.emitted_deletions",
+		Help: "Number of deletions emitted by MVCCIncrementalIterators"}
+	metaIncrementalEmittedBytes = metric.Metadata{
+		Name: "engineccl.incremental.emitted_bytes",
+		Help: "Number of key and value bytes emitted by MVCCIncrementalIterators"}
+	metaIncrementalSkippedVersions = metric.Metadata{
+		Name: "engineccl.incremental.skipped_versions",
+		Help: "Number of versions outside the time range stepped over by MVCCIncrementalIterators"}
+	metaIncrementalAbortedIntents = metric.Metadata{
+		Name: "engineccl.incremental.aborted_intents",
+		Help: "Number of aborted intents skipped by MVCCIncrementalIterators"}
+	metaIncrementalIntentConflicts = metric.Metadata{
+		Name: "engineccl.incremental.intent_conflicts",
+		Help: "Number of intents in the time range encountered by MVCCIncrementalIterators"}
+	metaIncrementalVersionCapSeeks = metric.Metadata{
+		Name: "engineccl.incremental.version_cap_seeks",
+		Help: "Number of seeks past the newer versions of keys by MVCCIncrementalIterators with a version cap"}
+	metaIncrementalPrefixSkips = metric.Metadata{
+		Name: "engineccl.incremental.prefix_skips",
+		Help: "Number of seeks past keys outside the prefixes of MVCCIncrementalIterators"}
+	metaIncrementalSkippedSpans = metric.Metadata{
+		Name: "engineccl.incremental.skipped_spans",
+		Help: "Number of seeks past spans skipped by MVCCIncrementalIterators, such as exported sstables"}
+	metaIncrementalSSTSkippedBytes = metric.Metadata{
+		Name: "engineccl.incremental.sst_skipped_bytes",
+		Help: "Size of the sstables outside the time ranges of time-bound MVCCIncrementalIterators, which they skipped"}
+	metaIncrementalCorruptValues = metric.Metadata{
+		Name: "engineccl.incremental.corrupt_values",
+		Help: "Number of corrupt values skipped by MVCCIncrementalIterators"}
+	metaIncrementalAudits = metric.Metadata{
+		Name: "engineccl.incremental.audits",
+		Help: "Number of time-bound incremental iterations audited against iterations without time-bound iterators"}
+	metaIncrementalAuditMismatches = metric.Metadata{
+		Name: "engineccl.incremental.audit_mismatches",
+		Help: "Number of audited time-bound incremental iterations whose results differed from those without time-bound iterators"}
+	metaIncrementalUnknownResumeOptions = metric.Metadata{
+		Name: "engineccl.incremental.unknown_resume_options",
+		Help: "Number of resume tokens with unknown optional options, which were ignored"}
+)
+
+// IteratorMetrics are the metrics of the MVCCIncrementalIterators of a store.
+// They aggregate the MVCCIncrementalIteratorProgress of each iteration, and
+// are updated once an iteration ends rather than per key: when it is
+// superseded by the next iteration or the iterator is closed, so that an
+// iteration which failed or was abandoned part way is counted too. The
+// metrics of a store are supplied to its iterators through
+// MVCCIncrementalIteratorOptions.Metrics; iterators without metrics do no
+// accounting.
+type IteratorMetrics struct {
+	Iterations          *metric.Counter
+	TimeBoundIterations *metric.Counter
+	FailedIterations    *metric.Counter
+	EmittedKeys         *metric.Counter
+	EmittedDeletions    *metric.Counter
+	EmittedBytes        *metric.Counter
+	SkippedVersions     *metric.Counter
+	AbortedIntents      *metric.Counter
+	IntentConflicts     *metric.Counter
+	VersionCapSeeks     *metric.Counter
+	PrefixSkips         *metric.Counter
+	SkippedSpans        *metric.Counter
+	SSTSkippedBytes     *metric.Counter
+	CorruptValues       *metric.Counter
+
+	// Audits and AuditMismatches are updated by the audits of iterations,
+	// which complete in the background after the iterations; see
+	// AuditFraction.
+	Audits          *metric.Counter
+	AuditMismatches *metric.Counter
+
+	// UnknownResumeOptions is updated by UnmarshalResumeToken rather than by
+	// iterations.
+	UnknownResumeOptions *metric.Counter
+}
+
+// MetricStruct implements the metric.Struct interface.
+func (*IteratorMetrics) MetricStruct() {}
+
+var _ metric.Struct = (*IteratorMetrics)(nil)
+
+// NewIteratorMetrics returns a new instance of IteratorMetrics.
+func NewIteratorMetrics() *IteratorMetrics {
+	return &IteratorMetrics{
+		Iterations:          metric.NewCounter(metaIncrementalIterations),
+		TimeBoundIterations: metric.NewCounter(metaIncrementalTimeBoundIterations),
+		FailedIterations:    metric.NewCounter(metaIncrementalFailedIterations),
+		EmittedKeys:         metric.NewCounter(metaIncrementalEmittedKeys),
+		EmittedDeletions:    metric.NewCounter(metaIncrementalEmittedDeletions),
+		EmittedBytes:        metric.NewCounter(metaIncrementalEmittedBytes),
+		SkippedVersions:     metric.NewCounter(metaIncrementalSkippedVersions),
+		AbortedIntents:      metric.NewCounter(metaIncrementalAbortedIntents),
+		IntentConflicts:     metric.NewCounter(metaIncrementalIntentConflicts),
+		VersionCapSeeks:     metric.NewCounter(metaIncrementalVersionCapSeeks),
+		PrefixSkips:         metric.NewCounter(metaIncrementalPrefixSkips),
+		SkippedSpans:        metric.NewCounter(metaIncrementalSkippedSpans),
+		SSTSkippedBytes:     metric.NewCounter(metaIncrementalSSTSkippedBytes),
+		CorruptValues:       metric.NewCounter(metaIncrementalCorruptValues),
+
+		Audits:          metric.NewCounter(metaIncrementalAudits),
+		AuditMismatches: metric.NewCounter(metaIncrementalAuditMismatches),
+
+		UnknownResumeOptions: metric.NewCounter(metaIncrementalUnknownResumeOptions),
+	}
+}
+
+// record adds the counters of an iteration which has ended to the metrics.
+// failed is set if the iteration ended with an error.
+func (m *IteratorMetrics) record(
+	p MVCCIncrementalIteratorProgress, timeBound bool, conflicts int, failed bool,
+) {
+	m.Iterations.Inc(1)
+	if timeBound {
+		m.TimeBoundIterations.Inc(1)
+	}
+	if failed {
+		m.FailedIterations.Inc(1)
+	}
+	m.EmittedKeys.Inc(p.EmittedKeys)
+	m.EmittedDeletions.Inc(p.EmittedDeletions)
+	m.EmittedBytes.Inc(p.EmittedKeyBytes + p.EmittedValueBytes)
+	m.SkippedVersions.Inc(p.SkippedVersions)
+	m.AbortedIntents.Inc(p.AbortedIntents)
+	m.IntentConflicts.Inc(int64(conflicts))
+	m.VersionCapSeeks.Inc(p.VersionCapSeeks)
+	m.PrefixSkips.Inc(p.PrefixSkips)
+	m.SkippedSpans.Inc(p.SkippedSpans)
+	m.SSTSkippedBytes.Inc(p.SkippedSSTableBytes)
+	m.CorruptValues.Inc(p.CorruptValues)
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// TestIteratorMetrics verifies that the progress of the iterations of
+// MVCCIncrementalIterators is recorded in their metrics once each iteration
+// is over, as seen through a metric registry.
+func TestIteratorMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	for _, kv := range []struct {
+		key  string
+		wall int64
+	}{{"a", 1}, {"a", 3}, {"b", 3}, {"c", 1}, {"d", 3}} {
+		value := roachpb.MakeValueFromString(kv.key)
+		if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(kv.key), hlc.Timestamp{WallTime: kv.wall}, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	txnID := uuid.MakeV4()
+	txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+		Key:       roachpb.Key("e"),
+		ID:        &txnID,
+		Epoch:     1,
+		Timestamp: hlc.Timestamp{WallTime: 3},
+	}}
+	if err := engine.MVCCPut(
+		ctx, e, nil, txn.Key, txn.Timestamp, roachpb.MakeValueFromString("intent"), &txn,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewIteratorMetrics()
+	registry := metric.NewRegistry()
+	registry.AddMetricStruct(metrics)
+	snapshot := func() map[string]int64 {
+		m := make(map[string]int64)
+		registry.Each(func(name string, val interface{}) {
+			m[name] = val.(*metric.Counter).Count()
+		})
+		return m
+	}
+	// expectSnapshot checks the metrics against the expected values, which
+	// are zero unless specified.
+	expectSnapshot := func(nonZero map[string]int64) {
+		expected := make(map[string]int64)
+		registry.Each(func(name string, _ interface{}) {
+			expected[name] = nonZero[name]
+		})
+		if a := snapshot(); !reflect.DeepEqual(a, expected) {
+			t.Fatalf("expected metrics %v, got %v", expected, a)
+		}
+	}
+	// Each of the keys emitted has a one byte key and value.
+	kvBytes := int64(1 + len(roachpb.MakeValueFromString("a").RawBytes))
+	iterate := func(prefixes []roachpb.Key) *MVCCIncrementalIterator {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime: hlc.Timestamp{WallTime: 2},
+			EndTime:   hlc.Timestamp{WallTime: 4},
+			Prefixes:  prefixes,
+			Metrics:   metrics,
+		})
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); iter.Next() {
+		}
+		return iter
+	}
+
+	// The iteration emits a, b and d, skips c and stops at the intent on e. It
+	// is only recorded once the iterator is closed, and counted as failed.
+	iter := iterate(nil)
+	if _, err := iter.Finish(); err == nil {
+		t.Fatal("expected an intent conflict")
+	}
+	expectSnapshot(nil)
+	iter.Close()
+	expectSnapshot(map[string]int64{
+		"engineccl.incremental.iterations":        1,
+		"engineccl.incremental.failed_iterations": 1,
+		"engineccl.incremental.emitted_keys":      3,
+		"engineccl.incremental.emitted_bytes":     3 * kvBytes,
+		"engineccl.incremental.skipped_versions":  1,
+		"engineccl.incremental.intent_conflicts":  1,
+	})
+
+	// Restricted to a and c, the iteration emits a, seeks past b and skips c.
+	// It is recorded once it is superseded by the next iteration.
+	iter = iterate([]roachpb.Key{roachpb.Key("a"), roachpb.Key("c")})
+	iter.Reset(roachpb.KeyMin, roachpb.Key("a"))
+	expected := map[string]int64{
+		"engineccl.incremental.iterations":        2,
+		"engineccl.incremental.failed_iterations": 1,
+		"engineccl.incremental.emitted_keys":      4,
+		"engineccl.incremental.emitted_bytes":     4 * kvBytes,
+		"engineccl.incremental.skipped_versions":  2,
+		"engineccl.incremental.intent_conflicts":  1,
+		"engineccl.incremental.prefix_skips":      1,
+	}
+	expectSnapshot(expected)
+	iter.Close()
+	expected["engineccl.incremental.iterations"]++
+	expectSnapshot(expected)
+
+	// The iterators of another engine accumulate into the same metrics. The
+	// deletion of f has no value bytes.
+	other := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer other.Close()
+	if err := engine.MVCCDelete(
+		ctx, other, nil, roachpb.Key("f"), hlc.Timestamp{WallTime: 3}, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	iter = NewMVCCIncrementalIterator(other, MVCCIncrementalIteratorOptions{
+		StartTime: hlc.Timestamp{WallTime: 2},
+		EndTime:   hlc.Timestamp{WallTime: 4},
+		Metrics:   metrics,
+	})
+	for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); ; iter.Next() {
+		if ok, err := iter.ValidWithErr(); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			break
+		}
+	}
+	iter.Close()
+	expected["engineccl.incremental.iterations"]++
+	expected["engineccl.incremental.emitted_keys"]++
+	expected["engineccl.incremental.emitted_deletions"]++
+	expected["engineccl.incremental.emitted_bytes"]++
+	expectSnapshot(expected)
+
+	// A time-bound iteration counts the size of the sstables below its time
+	// range, which it skips, but not that of the sstables in it.
+	flushed := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer flushed.Close()
+	for _, ts := range []hlc.Timestamp{{WallTime: 1}, {WallTime: 3}} {
+		if err := engine.MVCCPut(
+			ctx, flushed, nil, roachpb.Key("g"), ts, roachpb.MakeValueFromString("g"), nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+		if err := flushed.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ssts := flushed.GetSSTables()
+	if len(ssts) != 2 {
+		t.Fatalf("expected 2 sstables, got %d: %s", len(ssts), ssts)
+	}
+	var skippedBytes int64
+	for _, sst := range ssts {
+		if sst.TsMax != nil && sst.TsMax.WallTime == 1 {
+			skippedBytes = sst.Size
+		}
+	}
+	if skippedBytes == 0 {
+		t.Fatalf("expected an sstable of the version at 1, got %s", ssts)
+	}
+	iter = NewMVCCIncrementalIterator(flushed, MVCCIncrementalIteratorOptions{
+		StartTime: hlc.Timestamp{WallTime: 2},
+		EndTime:   hlc.Timestamp{WallTime: 4},
+		TimeBound: true,
+		Metrics:   metrics,
+	})
+	for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); iter.Next() {
+	}
+	iter.Close()
+	expected["engineccl.incremental.iterations"]++
+	expected["engineccl.incremental.timebound_iterations"]++
+	expected["engineccl.incremental.emitted_keys"]++
+	expected["engineccl.incremental.emitted_bytes"] += kvBytes
+	expected["engineccl.incremental.sst_skipped_bytes"] = skippedBytes
+	expectSnapshot(expected)
+}
@@ -9,45 +9,554 @@
 package engineccl
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/iterutil"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 )
 
 // MVCCIncrementalIterator iterates over the diff of the key range
 // [startKey,endKey) and time range [startTime,endTime). If a key was added or
 // modified between startTime and endTime, the iterator will position at the
 // most recent version (before endTime) of that key. If the key was most
-// recently deleted, this is signalled with an empty value.
+// recently deleted, this is signalled with an empty value. The time range is
+// an hlc.TimestampWindow, which decides both the versions emitted and the
+// intents which conflict with the iteration.
 //
 // Expected usage:
-//    iter := NewMVCCIncrementalIterator(e)
+//    iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+//        StartTime: startTime,
+//        EndTime:   endTime,
+//    })
 //    defer iter.Close()
-//    for iter.Reset(startKey, endKey, ...); iter.Valid(); iter.Next() {
+//    if err := iter.Error(); err != nil {
+//      ...
+//    }
+//    for iter.Reset(startKey, endKey); ; iter.Next() {
+//        if ok, err := iter.ValidWithErr(); err != nil {
+//            ...
+//        } else if !ok {
+//            break
+//        }
 //        [code using iter.Key() and iter.Value()]
 //    }
-//    if err := iter.Error(); err != nil {
+//    stats, err := iter.Finish()
+//    if err != nil {
 //      ...
 //    }
+//
+// Iteration must not allocate per key: positioning the iterator with Next and
+// reading the current key with UnsafeKey and UnsafeValue is allocation free
+// (see TestMVCCIncrementalIteratorAllocations). Key and Value legitimately
+// allocate, as they copy the current key and value. So does an intent in the
+// time range, whose metadata is decoded and which is recorded in an
+// IntentConflictError, and with SetSkipAbortedIntents the key of each such
+// intent is copied to re-read its provisional value. Anything added to the
+// loop in Next, such as wrapping an error or copying a key, must keep to this.
+//
+// The iterator returns whatever the reader returns. For the iteration to be
+// the changes in the time range as of the end time, such as for an
+// incremental backup, the reader must be a consistent view of the data, such
+// as an engine snapshot, taken once no further writes at or below the end
+// time are possible. Otherwise a write at or below the end time which arrives
+// during a slow iteration is seen at some keys and not at others. An
+// ExportRequest is evaluated at its end time, so the timestamp cache pushes
+// any later write to its keys above it. Other callers must know the timestamp
+// below which writes have stopped, and supply it as
+// MVCCIncrementalIteratorOptions.MaxSafeTimestamp.
 type MVCCIncrementalIterator struct {
 	// TODO(dan): Move all this logic into c++ and make this a thin wrapper.
 
-	iter engine.Iterator
+	reader engine.Reader
+	iter   engine.Iterator
+
+	endKey  engine.MVCCKey
+	window  hlc.TimestampWindow
+	err     error
+	valid   bool
+	nextkey bool
+	next    bool
+	started bool
+	// errUnconsulted is set when Valid reports the end of an iteration which
+	// failed, and cleared once its error is consulted with Error,
+	// ValidWithErr or Finish. In race builds, Reset and Close panic if it is
+	// set, so that callers which mistake a failed iteration for a complete one
+	// are found.
+	errUnconsulted bool
+	// optionsErr is the error of the invalid options the iterator was created
+	// with, if any, in which case iter is nil and every iteration fails with
+	// it.
+	optionsErr error
+
+	// iterCtx is the context of the current iteration, which is embedded in
+	// its errors.
+	iterCtx IterationContext
+
+	// skipAbortedIntents is set by SetSkipAbortedIntents.
+	skipAbortedIntents bool
+	// allVersions is set by MVCCIncrementalIteratorOptions.AllVersions.
+	allVersions bool
+	// txn is set by MVCCIncrementalIteratorOptions.Txn.
+	txn *roachpb.Transaction
+	// keysOnly is set by MVCCIncrementalIteratorOptions.KeysOnly. deletion is
+	// set if the current version is a deletion.
+	keysOnly bool
+	deletion bool
+	// gcThreshold is set by MVCCIncrementalIteratorOptions.GCThreshold.
+	gcThreshold hlc.Timestamp
+	// maxSafeTimestamp is set by MVCCIncrementalIteratorOptions.MaxSafeTimestamp.
+	maxSafeTimestamp hlc.Timestamp
+	// maxValueBytes and truncateLargeValues are set by the options of the
+	// same names. truncated is set if the current value was truncated, in
+	// which case truncatedValue holds what is emitted in its place.
+	// skipValue is set if the iteration stopped at a value which was too
+	// large or failed verification, and is skipped by the next call to Next.
+	maxValueBytes       int64
+	truncateLargeValues bool
+	truncated           bool
+	truncatedValue      [truncatedValueSize]byte
+	skipValue           bool
+	// verifyChecksums and skipCorruptValues are set by the options of the
+	// same names.
+	verifyChecksums   bool
+	skipCorruptValues bool
+	// consistencyChecks and failFast are set by the options of the same
+	// names. violations are those found by the current iteration, and
+	// checkIter, which isn't time-bound, reads the versions of intents.
+	consistencyChecks bool
+	failFast          bool
+	violations        []MVCCViolation
+	checkIter         engine.Iterator
+	// timeBound is set if iter is a time-bound iterator.
+	timeBound bool
+	// maxVersionsPerKey is set by MVCCIncrementalIteratorOptions of the same
+	// name. newerVersions is the number of versions of newerKey above the
+	// time range which have been stepped over.
+	maxVersionsPerKey int
+	newerKey          roachpb.Key
+	newerVersions     int
+	// secondary is set to MVCCIncrementalIteratorOptions.SecondaryReader if
+	// consistency checks are enabled, in which case a checkSampleRate fraction
+	// of the emitted versions are checked against it using secondaryIter.
+	secondary       engine.Reader
+	secondaryIter   engine.Iterator
+	checkSampleRate float64
+	// opts are the options the iterator was created with, from which the
+	// iterations it audits are rerun. audit is the audit of the current
+	// iteration, if it was sampled; see AuditFraction. auditKnobs are only
+	// used in tests.
+	opts       MVCCIncrementalIteratorOptions
+	audit      *iterationAudit
+	auditKnobs auditTestingKnobs
+	// metrics, if set, are updated with the progress of each iteration once it
+	// is superseded by the next, or the iterator is closed. recorded is set
+	// once the current iteration has been recorded.
+	metrics  *IteratorMetrics
+	recorded bool
+	// prefixes, if non-empty, are the sorted, non-overlapping key prefixes to
+	// which the iteration is restricted, and prefixEnds their PrefixEnds.
+	// prefixIdx is the index of the first prefix not entirely before the
+	// iterator's position.
+	prefixes   []roachpb.Key
+	prefixEnds []roachpb.Key
+	prefixIdx  int
+	// eng is set by MVCCIncrementalIteratorOptions.Engine.
+	eng engine.Engine
+	// skipped are the sorted, non-overlapping spans set by SkipSpans, and
+	// skippedIdx the index of the first span not entirely before the
+	// iterator's position.
+	skipped    []roachpb.Span
+	skippedIdx int
+	// beforeIntentRecheck, if set, is called after the metadata of an intent
+	// has been read and before it is re-checked by skipAbortedIntents. It is
+	// only used in tests, to deterministically interleave a resolution.
+	beforeIntentRecheck func(key roachpb.Key)
+	// descGeneration and closedDescGeneration are the generations of the
+	// descriptor of the range iterated over when the iterator was opened and
+	// closed; see MVCCIncrementalIteratorOptions.RecheckDescriptor.
+	descGeneration       int64
+	closedDescGeneration int64
+	recheckDescriptor    func() int64
+	closed               bool
 
-	endKey    engine.MVCCKey
-	startTime hlc.Timestamp
-	endTime   hlc.Timestamp
-	err       error
-	valid     bool
-	nextkey   bool
+	progress     MVCCIncrementalIteratorProgress
+	maxTimestamp hlc.Timestamp
+	// conflict is set once an intent in the time range is found. The iterator
+	// then stops emitting keys, but scans the remainder of the key range for
+	// further intents.
+	conflict *IntentConflictError
 
 	// For allocation avoidance.
 	meta enginepb.MVCCMetadata
 }
 
+// MVCCIncrementalIteratorProgress contains counters which are updated as an
+// MVCCIncrementalIterator advances. They are monotonic within an iteration and
+// are safe to read at any point.
+type MVCCIncrementalIteratorProgress struct {
+	// EmittedKeys is the number of keys the iterator has positioned at.
+	EmittedKeys int64
+	// EmittedDeletions is the number of emitted keys which are deletions.
+	EmittedDeletions int64
+	// EmittedKeyBytes and EmittedValueBytes are the sizes of the keys and
+	// values emitted, excluding timestamps.
+	EmittedKeyBytes   int64
+	EmittedValueBytes int64
+	// SkippedVersions is the number of versions outside the time range which
+	// were stepped over.
+	SkippedVersions int64
+	// AbortedIntents is the number of intents which were found to have been
+	// aborted and removed while being iterated over. See SetSkipAbortedIntents.
+	AbortedIntents int64
+	// SkippedProvisional is the number of intents below the start time which
+	// were stepped over. Their provisional values are below the time range,
+	// as are the older versions of their keys, so they don't conflict with
+	// the iteration.
+	SkippedProvisional int64
+	// VersionCapSeeks is the number of keys at which the iterator seeked past
+	// the versions above the time range, having stepped over
+	// MVCCIncrementalIteratorOptions.MaxVersionsPerKey of them.
+	VersionCapSeeks int64
+	// PrefixSkips is the number of times the iterator seeked past keys outside
+	// of its prefixes (see MVCCIncrementalIteratorOptions.Prefixes). The keys
+	// which were seeked past are not visited, so are not counted themselves.
+	PrefixSkips int64
+	// SkippedSpans is the number of times the iterator seeked past the keys
+	// of a span passed to SkipSpans.
+	SkippedSpans int64
+	// SkippedSSTableBytes is the size of the sstables overlapping the span
+	// whose timestamps are all outside the time range, and which a time-bound
+	// iterator therefore skips. It is only measured for the time-bound
+	// iterators with metrics (see MVCCIncrementalIteratorOptions.Metrics)
+	// whose sstables can be inspected, like those of CoveredSSTables.
+	SkippedSSTableBytes int64
+	// CorruptValues is the number of versions which failed checksum
+	// verification and were skipped; see
+	// MVCCIncrementalIteratorOptions.SkipCorruptValues.
+	CorruptValues int64
+	// ConsistencyChecks is the number of emitted versions which were checked
+	// against MVCCIncrementalIteratorOptions.SecondaryReader, and
+	// ConsistencyCheckFailures the number of those which differed.
+	ConsistencyChecks        int64
+	ConsistencyCheckFailures int64
+}
+
+// add adds the counters of o to p.
+func (p *MVCCIncrementalIteratorProgress) add(o MVCCIncrementalIteratorProgress) {
+	p.EmittedKeys += o.EmittedKeys
+	p.EmittedDeletions += o.EmittedDeletions
+	p.EmittedKeyBytes += o.EmittedKeyBytes
+	p.EmittedValueBytes += o.EmittedValueBytes
+	p.SkippedVersions += o.SkippedVersions
+	p.AbortedIntents += o.AbortedIntents
+	p.SkippedProvisional += o.SkippedProvisional
+	p.VersionCapSeeks += o.VersionCapSeeks
+	p.PrefixSkips += o.PrefixSkips
+	p.SkippedSpans += o.SkippedSpans
+	p.SkippedSSTableBytes += o.SkippedSSTableBytes
+	p.CorruptValues += o.CorruptValues
+	p.ConsistencyChecks += o.ConsistencyChecks
+	p.ConsistencyCheckFailures += o.ConsistencyCheckFailures
+}
+
+// TombstoneFraction returns the fraction of the emitted keys which are
+// deletions.
+func (p MVCCIncrementalIteratorProgress) TombstoneFraction() float64 {
+	if p.EmittedKeys == 0 {
+		return 0
+	}
+	return float64(p.EmittedDeletions) / float64(p.EmittedKeys)
+}
+
+// AverageValueBytes returns the average size of the values of the emitted
+// keys which aren't deletions.
+func (p MVCCIncrementalIteratorProgress) AverageValueBytes() float64 {
+	if n := p.EmittedKeys - p.EmittedDeletions; n > 0 {
+		return float64(p.EmittedValueBytes) / float64(n)
+	}
+	return 0
+}
+
+// KeyDensity returns the fraction of the versions in the key range which
+// were emitted, as opposed to skipped for being outside the time range. A low
+// density indicates that the keys changed in the time range are sparse among
+// the keys of the range.
+func (p MVCCIncrementalIteratorProgress) KeyDensity() float64 {
+	if n := p.EmittedKeys + p.SkippedVersions; n > 0 {
+		return float64(p.EmittedKeys) / float64(n)
+	}
+	return 0
+}
+
+// MVCCIncrementalIteratorStats contains the results of a completed iteration.
+// Unlike MVCCIncrementalIteratorProgress, these are only meaningful once the
+// iteration has finished.
+type MVCCIncrementalIteratorStats struct {
+	MVCCIncrementalIteratorProgress
+	// MaxTimestamp is the largest timestamp of any emitted key.
+	MaxTimestamp hlc.Timestamp
+}
+
+// IncompleteIterationError is returned by MVCCIncrementalIterator.Finish if
+// the iteration has not run to completion.
+type IncompleteIterationError struct {
+	// Key is the key the iterator is positioned at, if any.
+	Key roachpb.Key
+}
+
+func (e *IncompleteIterationError) Error() string {
+	if e.Key == nil {
+		return "incremental iteration has not been started"
+	}
+	return fmt.Sprintf("incremental iteration is incomplete; positioned at %s", e.Key)
+}
+
+// IterationContext identifies the iteration in which an error occurred: the
+// span passed to the Reset which began it and the iterator's time range. It is
+// embedded in the errors returned by MVCCIncrementalIterator, so that the
+// failures of an operation iterating over many spans can be told apart.
+type IterationContext struct {
+	Span               roachpb.Span
+	StartTime, EndTime hlc.Timestamp
+}
+
+func (c IterationContext) String() string {
+	return fmt.Sprintf("iteration of %s over [%s, %s)", c.Span, c.StartTime, c.EndTime)
+}
+
+// IntentConflictError is returned by MVCCIncrementalIterator if the key range
+// contains intents in the time range. The iterator emits every key before the
+// first intent, so once the intents are resolved the iteration can resume at
+// ResumeKey instead of being repeated in full.
+type IntentConflictError struct {
+	IterationContext
+	// Intents are the conflicting intents, in key order.
+	Intents []roachpb.Intent
+	// ConflictSpan is the minimal span containing all of the intents.
+	ConflictSpan roachpb.Span
+	// ResumeKey is the key at which iteration should resume once the intents
+	// are resolved. All keys before it were emitted.
+	ResumeKey roachpb.Key
+}
+
+func (e *IntentConflictError) Error() string {
+	return fmt.Sprintf("%s in %s; resume at %s (%s)", e.Cause(), e.ConflictSpan, e.ResumeKey,
+		e.IterationContext)
+}
+
+// Cause returns the intents as a *roachpb.WriteIntentError, the error which
+// causes the KV layer to resolve them.
+func (e *IntentConflictError) Cause() error {
+	return &roachpb.WriteIntentError{Intents: e.Intents}
+}
+
+// GCThresholdError is returned by an MVCCIncrementalIterator whose start time
+// is before MVCCIncrementalIteratorOptions.GCThreshold. Versions in the time
+// range may have been garbage collected, so iterating over it would silently
+// return incomplete changes.
+type GCThresholdError struct {
+	IterationContext
+	GCThreshold hlc.Timestamp
+}
+
+func (e *GCThresholdError) Error() string {
+	return fmt.Sprintf("start timestamp %s is before the GC threshold %s (%s)",
+		e.StartTime, e.GCThreshold, e.IterationContext)
+}
+
+// UnsafeEndTimeError is returned by an MVCCIncrementalIterator whose end time
+// is after MVCCIncrementalIteratorOptions.MaxSafeTimestamp. Writes at or below
+// the end time may still arrive after the reader was taken, so iterating over
+// the time range could return changes which are later contradicted.
+type UnsafeEndTimeError struct {
+	IterationContext
+	MaxSafeTimestamp hlc.Timestamp
+}
+
+func (e *UnsafeEndTimeError) Error() string {
+	return fmt.Sprintf("end timestamp %s is after the maximum safe timestamp %s (%s)",
+		e.EndTime, e.MaxSafeTimestamp, e.IterationContext)
+}
+
+// ValueTooLargeError is returned by an MVCCIncrementalIterator when the value
+// of a version to be emitted is larger than
+// MVCCIncrementalIteratorOptions.MaxValueBytes. The iterator remains
+// positioned at the version, which the caller may skip by calling Next to
+// continue the iteration.
+type ValueTooLargeError struct {
+	IterationContext
+	Key  engine.MVCCKey
+	Size int64
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("value of %s is too large: %d bytes (%s)", e.Key, e.Size, e.IterationContext)
+}
+
+// ChecksumMismatchError is returned by an MVCCIncrementalIterator with
+// VerifyChecksums when the value of a version to be emitted doesn't match its
+// checksum. The iterator remains positioned at the version, which the caller
+// may skip by calling Next to continue the iteration.
+type ChecksumMismatchError struct {
+	IterationContext
+	Key engine.MVCCKey
+	Err error
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch in value of %s: %s (%s)", e.Key, e.Err, e.IterationContext)
+}
+
+// Cause returns the verification error.
+func (e *ChecksumMismatchError) Cause() error {
+	return e.Err
+}
+
+// CorruptMVCCMetadataError is returned by an MVCCIncrementalIterator when the
+// metadata of a key can't be decoded.
+type CorruptMVCCMetadataError struct {
+	IterationContext
+	Key engine.MVCCKey
+	Err error
+}
+
+func (e *CorruptMVCCMetadataError) Error() string {
+	return fmt.Sprintf("corrupt MVCC metadata at %s: %s (%s)", e.Key, e.Err, e.IterationContext)
+}
+
+// Cause returns the decoding error.
+func (e *CorruptMVCCMetadataError) Cause() error {
+	return e.Err
+}
+
+// MVCCViolationType is the kind of an MVCCViolation.
+type MVCCViolationType int
+
+const (
+	// CorruptMetadataViolation is metadata which can't be decoded.
+	CorruptMetadataViolation MVCCViolationType = iota + 1
+	// IntentWithoutVersionViolation is an intent without a version at its
+	// timestamp to hold its provisional value.
+	IntentWithoutVersionViolation
+	// VersionAboveIntentViolation is a version newer than the intent on its
+	// key. An intent is always the newest write to its key.
+	VersionAboveIntentViolation
+)
+
+func (t MVCCViolationType) String() string {
+	switch t {
+	case CorruptMetadataViolation:
+		return "corrupt metadata"
+	case IntentWithoutVersionViolation:
+		return "intent without version"
+	case VersionAboveIntentViolation:
+		return "version above intent"
+	default:
+		return fmt.Sprintf("MVCCViolationType(%d)", int(t))
+	}
+}
+
+// MVCCViolation is an impossible state of the MVCC data found by an
+// MVCCIncrementalIterator with ConsistencyChecks.
+type MVCCViolation struct {
+	Type MVCCViolationType
+	// Key is the metadata key, or the version, at which the violation was
+	// found.
+	Key engine.MVCCKey
+	// Detail describes the violation.
+	Detail string
+}
+
+func (v MVCCViolation) String() string {
+	return fmt.Sprintf("%s at %s: %s", v.Type, v.Key, v.Detail)
+}
+
+// ConsistencyViolationError is returned by an MVCCIncrementalIterator with
+// ConsistencyChecks and FailFast at the first violation it finds.
+type ConsistencyViolationError struct {
+	IterationContext
+	Violation MVCCViolation
+}
+
+func (e *ConsistencyViolationError) Error() string {
+	return fmt.Sprintf("MVCC consistency violation: %s (%s)", e.Violation, e.IterationContext)
+}
+
+// InlineValueError is returned by an MVCCIncrementalIterator at an inline
+// value. Inline values are only used in non-user data, which isn't needed for
+// backup, so one showing up means something is wrong.
+type InlineValueError struct {
+	IterationContext
+	Key roachpb.Key
+}
+
+func (e *InlineValueError) Error() string {
+	return fmt.Sprintf("inline values are unsupported by MVCCIncrementalIterator: %s (%s)",
+		e.Key, e.IterationContext)
+}
+
+// EngineError is returned by an MVCCIncrementalIterator when reading from the
+// engine fails.
+type EngineError struct {
+	IterationContext
+	Err error
+}
+
+func (e *EngineError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Err, e.IterationContext)
+}
+
+// Cause returns the engine's error.
+func (e *EngineError) Cause() error {
+	return e.Err
+}
+
+// truncatedValueSize is the size of a truncated value: a CRC-32 (IEEE)
+// checksum of the value followed by its size, both big-endian.
+const truncatedValueSize = 12
+
+// DecodeTruncatedValue returns the checksum and size of a value which was
+// truncated by an MVCCIncrementalIterator with TruncateLargeValues.
+func DecodeTruncatedValue(b []byte) (checksum uint32, size int64, err error) {
+	if len(b) != truncatedValueSize {
+		return 0, 0, errors.Errorf("truncated value has %d bytes; expected %d", len(b), truncatedValueSize)
+	}
+	return binary.BigEndian.Uint32(b[:4]), int64(binary.BigEndian.Uint64(b[4:])), nil
+}
+
+// ConsistencyCheckEnabled enables the checks of incremental iterations against
+// MVCCIncrementalIteratorOptions.SecondaryReader. The setting is read when an
+// iterator is created.
+var ConsistencyCheckEnabled = func() *settings.BoolSetting {
+	name := "enterprise.kv.incremental_iterator.consistency_check.enabled"
+	s := settings.RegisterBoolSetting(name, "check a sample of the keys emitted by incremental "+
+		"iterations against a secondary reader, where one is supplied", false)
+	settings.Hide(name)
+	return s
+}()
+
+// ConsistencyCheckSampleRate is the fraction of the versions emitted by an
+// incremental iteration which are checked against its secondary reader.
+var ConsistencyCheckSampleRate = func() *settings.FloatSetting {
+	name := "enterprise.kv.incremental_iterator.consistency_check.sample_rate"
+	s := settings.RegisterFloatSetting(name, "fraction of the keys emitted by incremental "+
+		"iterations checked against their secondary reader", 0.01)
+	settings.Hide(name)
+	return s
+}()
+
 // TimeBoundIteratorsEnabled controls whether to use experimental iterators that
 // can more efficiently perform incremental backups by skipping over old SSTs.
 var TimeBoundIteratorsEnabled = func() *settings.BoolSetting {
@@ -57,49 +566,460 @@ var TimeBoundIteratorsEnabled = func() *settings.BoolSetting {
 	return s
 }()
 
-func newEngineIter(e engine.Reader, startTime, endTime hlc.Timestamp) engine.Iterator {
-	if TimeBoundIteratorsEnabled.Get() {
-		return e.NewTimeBoundIterator(startTime, endTime)
+// newEngineIter returns the iterator underlying an MVCCIncrementalIterator,
+// and whether it is a time-bound iterator.
+func newEngineIter(
+	e engine.Reader, window hlc.TimestampWindow, timeBound bool,
+) (engine.Iterator, bool) {
+	if timeBound || TimeBoundIteratorsEnabled.Get() {
+		return e.NewTimeBoundIterator(window.Start, window.End), true
 	}
-	return e.NewIterator(false)
+	return e.NewIterator(false), false
 }
 
-// NewMVCCIncrementalIterator creates an MVCCIncrementalIterator with the
-// specified engine and time range.
+// logUnskippableSSTables logs the sstables overlapping [startKey, endKey)
+// which lack the timestamp properties, and so are never skipped by a
+// time-bound iterator. Only the sstables of a RocksDB engine are inspected.
+func logUnskippableSSTables(r engine.Reader, startKey, endKey roachpb.Key) {
+	rocksdb, ok := r.(*engine.RocksDB)
+	if !ok {
+		return
+	}
+	for _, t := range rocksdb.SSTableInfosWithTimestamps(startKey, endKey) {
+		if t.TsMin == nil || t.TsMax == nil {
+			log.Infof(context.TODO(), "sstable at level %d [%s, %s] lacks timestamp properties "+
+				"and cannot be skipped by time-bound iterators", t.Level, t.Start, t.End)
+		}
+	}
+}
+
+// skippedSSTableBytes returns the size of the live sstables overlapping
+// [startKey, endKey) whose timestamps are all outside the time range, which a
+// time-bound iterator skips. The sstables are found like those of
+// coveredSSTables.
+func (i *MVCCIncrementalIterator) skippedSSTableBytes(startKey, endKey roachpb.Key) int64 {
+	var r engine.Reader = i.reader
+	if i.eng != nil {
+		r = i.eng
+	}
+	eng, ok := r.(sstableEngine)
+	if !ok {
+		return 0
+	}
+	var size int64
+	for _, t := range eng.SSTableInfosWithTimestamps(startKey, endKey) {
+		if t.TsMin != nil && t.TsMax != nil && !i.window.Overlaps(*t.TsMin, *t.TsMax) {
+			size += t.Size
+		}
+	}
+	return size
+}
+
+// NewMVCCIncrementalIterator creates an MVCCIncrementalIterator over the
+// specified reader with the specified options. The options are validated
+// before the reader is touched: if they are invalid, the iterator never reads
+// from it, Error returns the validation error, and every iteration fails with
+// it.
 func NewMVCCIncrementalIterator(
-	e engine.Reader, startTime, endTime hlc.Timestamp,
+	e engine.Reader, opts MVCCIncrementalIteratorOptions,
 ) *MVCCIncrementalIterator {
-	return &MVCCIncrementalIterator{
-		iter:      newEngineIter(e, startTime, endTime),
-		startTime: startTime,
-		endTime:   endTime,
+	i := &MVCCIncrementalIterator{
+		reader: e,
+		window: opts.window(),
+		opts:   opts,
+	}
+	prefixEnds, err := opts.validate()
+	if err != nil {
+		i.optionsErr = err
+		i.err = err
+		return i
+	}
+	i.iter, i.timeBound = newEngineIter(e, i.window, opts.TimeBound)
+	i.prefixes = opts.Prefixes
+	i.prefixEnds = prefixEnds
+	i.skipAbortedIntents = opts.SkipAbortedIntents
+	i.allVersions = opts.AllVersions
+	i.keysOnly = opts.KeysOnly
+	i.maxVersionsPerKey = opts.MaxVersionsPerKey
+	i.txn = opts.Txn
+	i.verifyChecksums = opts.VerifyChecksums
+	i.skipCorruptValues = opts.SkipCorruptValues
+	i.consistencyChecks = opts.ConsistencyChecks
+	i.failFast = opts.FailFast
+	i.maxValueBytes = opts.MaxValueBytes
+	i.truncateLargeValues = opts.TruncateLargeValues
+	i.gcThreshold = opts.GCThreshold
+	i.maxSafeTimestamp = opts.MaxSafeTimestamp
+	i.metrics = opts.Metrics
+	i.eng = opts.Engine
+	i.descGeneration = opts.DescriptorGeneration
+	i.closedDescGeneration = opts.DescriptorGeneration
+	i.recheckDescriptor = opts.RecheckDescriptor
+	if opts.SecondaryReader != nil && ConsistencyCheckEnabled.Get() {
+		i.secondary = opts.SecondaryReader
+		i.checkSampleRate = ConsistencyCheckSampleRate.Get()
 	}
+	return i
+}
+
+// MVCCIncrementalIteratorOptions configures an MVCCIncrementalIterator
+// created by NewMVCCIncrementalIterator.
+type MVCCIncrementalIteratorOptions struct {
+	// StartTime and EndTime are the time range of the iteration. EndTime
+	// must not precede StartTime.
+	StartTime, EndTime hlc.Timestamp
+	// Prefixes, if non-empty, restricts the iteration to the keys having one
+	// of the prefixes, such as the prefixes of the tenants or tables of
+	// interest in a store-wide span. Rather than scanning the keys between
+	// prefixes, the iterator seeks from the end of one prefix to the start of
+	// the next. The prefixes must be non-empty, sorted and non-overlapping: no
+	// prefix may be a prefix of another.
+	Prefixes []roachpb.Key
+	// SkipAbortedIntents is as set by SetSkipAbortedIntents.
+	SkipAbortedIntents bool
+	// AllVersions causes the iterator to position at every version of a key
+	// in the time range, newest first, rather than only at the most recent.
+	// Each version is counted as an emitted key.
+	AllVersions bool
+	// MaxValueBytes, if positive, is the size of the largest value the
+	// iterator emits, which bounds the memory used by a caller copying the
+	// values. The iteration stops at a version with a larger value with a
+	// *ValueTooLargeError, unless TruncateLargeValues is set.
+	MaxValueBytes int64
+	// TruncateLargeValues causes a value larger than MaxValueBytes to be
+	// emitted as its checksum and size instead; see DecodeTruncatedValue. It
+	// requires MaxValueBytes, and is incompatible with KeysOnly.
+	TruncateLargeValues bool
+	// KeysOnly causes the iterator to emit only keys, for callers which need
+	// the set of keys changed in the time range but not their values. Value
+	// and UnsafeValue return nil, and IsDelete tells whether a version is a
+	// deletion. The values are never copied out of the engine, which has no
+	// key-only iteration, and are not counted in EmittedValueBytes nor limited
+	// by MaxValueBytes.
+	KeysOnly bool
+	// TimeBound causes the iterator to use a time-bound iterator, which skips
+	// the sstables outside the time range, regardless of
+	// TimeBoundIteratorsEnabled.
+	TimeBound bool
+	// MaxVersionsPerKey, if positive, is the number of versions of a key above
+	// the time range which the iterator steps over one by one. Past it, the
+	// iterator seeks to the newest version below the end time instead, so
+	// that a key with many versions newer than the time range, such as a hot
+	// row which has yet to be garbage collected, doesn't cost a step per
+	// version. A seek is slower than a step, so the cap shouldn't be set much
+	// below the typical number of versions of a key. The versions below the
+	// time range are always seeked past.
+	MaxVersionsPerKey int
+	// Txn, if set, is the transaction in which the iteration runs, whose own
+	// intents are seen like MVCCScan sees them: the provisional value of an
+	// intent written by the transaction at its current epoch is iterated over
+	// like a committed version, and emitted if it is in the time range, while
+	// one written by an earlier epoch is skipped. An intent written by a later
+	// epoch, or by another transaction, conflicts as usual.
+	Txn *roachpb.Transaction
+	// VerifyChecksums causes the iterator to verify the checksum of each value
+	// to be emitted against its key, to detect corruption of the data at rest
+	// before it is copied elsewhere. Values without a checksum and deletions
+	// are not verified. The iteration stops at a value which fails with a
+	// *ChecksumMismatchError, unless SkipCorruptValues is set.
+	VerifyChecksums bool
+	// SkipCorruptValues causes a value which fails verification to be logged,
+	// counted in CorruptValues and skipped, rather than to stop the iteration.
+	// The older versions of its key are skipped too, unless AllVersions is
+	// set. It requires VerifyChecksums.
+	SkipCorruptValues bool
+	// SecondaryReader, if set while ConsistencyCheckEnabled is, is a second
+	// view of the data, such as a snapshot taken moments after the reader
+	// iterated over, against which a sample of the emitted versions are
+	// checked. This is meant for investigating suspected snapshot isolation
+	// bugs: the secondary reader must return the same version for the time
+	// range, and differences are logged and counted in
+	// ConsistencyCheckFailures.
+	SecondaryReader engine.Reader
+	// ConsistencyChecks causes the iterator to check the invariants of the
+	// MVCC data it steps over, such as for an offline check of a store: the
+	// metadata of each key must decode, and an intent must have a version at
+	// its timestamp and no newer one. Unlike the checks against
+	// SecondaryReader, these are cheap and apply to every key. Violations are
+	// reported by Violations rather than stopping the iteration, and a key
+	// with corrupt metadata is skipped, since its newest version may be a
+	// provisional value.
+	ConsistencyChecks bool
+	// FailFast causes the iteration to stop at the first violation with a
+	// *ConsistencyViolationError. It requires ConsistencyChecks.
+	FailFast bool
+	// GCThreshold, if set, is the GC threshold of the data iterated over,
+	// typically that of the range, below which versions may have been garbage
+	// collected. Iterating from a non-zero start time before it fails with a
+	// *GCThresholdError rather than returning incomplete changes. A zero
+	// start time, which asks for all of the data rather than the changes
+	// since a time, is allowed.
+	GCThreshold hlc.Timestamp
+	// MaxSafeTimestamp, if set, is the timestamp at or below which no more
+	// writes can arrive in the data the reader reads, which must be a snapshot
+	// taken once that was the case. Iterating to an end time after it fails
+	// with an *UnsafeEndTimeError rather than returning changes which a late
+	// write may contradict. See the MVCCIncrementalIterator type comment.
+	MaxSafeTimestamp hlc.Timestamp
+	// RetainKeyValues is only used by IterateMVCCIncremental. If set, the
+	// key/values passed to the callback are copies, which it may retain.
+	// Otherwise they point into the iterator's buffers and are only valid
+	// until the callback returns, which avoids an allocation per key.
+	RetainKeyValues bool
+	// KeyRewriter is only used by IterateMVCCIncremental. If set, each key is
+	// rewritten by it before it is passed to the callback, and dropped if it
+	// returns false. The iteration fails with a *KeyRewriteOrderError if the
+	// rewritten keys are out of order.
+	KeyRewriter KeyRewriter
+	// StreamBatchBytes and StreamBufferedBatches are only used by
+	// StreamIncremental. A batch is sent once the size of its keys and values
+	// reaches StreamBatchBytes, 1 MiB if unset, and up to
+	// StreamBufferedBatches batches, 4 if unset, are sent ahead of the
+	// consumers, bounding the memory held by a stream.
+	StreamBatchBytes      int64
+	StreamBufferedBatches int
+	// Engine, if set, is the engine the reader reads from, such as the engine
+	// of a batch or snapshot, whose sstables are inspected by
+	// CoveredSSTables. Otherwise the reader itself is inspected.
+	Engine engine.Engine
+	// Metrics, if non-nil, are updated with the progress of each iteration,
+	// typically those of the store whose engine is iterated over.
+	Metrics *IteratorMetrics
+	// DescriptorGeneration is the generation of the descriptor of the range
+	// iterated over at the time the iterator is opened.
+	DescriptorGeneration int64
+	// RecheckDescriptor, if set, is called when the iterator is closed to
+	// return the generation of the range's descriptor at that time. A split
+	// or rebalance of the range during a long iteration doesn't invalidate
+	// the snapshot iterated over, but changes which span the range covers,
+	// which callers such as exports need to record. See DescriptorGenerations.
+	RecheckDescriptor func() int64
+	// AuditStopper and AuditSem let the iterations be audited; see
+	// AuditFraction. Iterations are only audited if both are set. The audits
+	// run as async tasks of the stopper, at most as many at once as the
+	// capacity of the semaphore, which is shared by the iterators of a store;
+	// an audit without capacity to run is dropped, and one which is running
+	// stops once the stopper quiesces.
+	AuditStopper *stop.Stopper
+	AuditSem     chan struct{}
+}
+
+// window returns the time range of the iteration.
+func (opts MVCCIncrementalIteratorOptions) window() hlc.TimestampWindow {
+	return hlc.TimestampWindow{Start: opts.StartTime, End: opts.EndTime}
+}
+
+// validate checks that the options are consistent, and returns the
+// PrefixEnds of the prefixes.
+func (opts MVCCIncrementalIteratorOptions) validate() ([]roachpb.Key, error) {
+	if err := opts.window().Validate(); err != nil {
+		return nil, err
+	}
+	if opts.MaxVersionsPerKey < 0 {
+		return nil, errors.Errorf("negative maximum versions per key %d", opts.MaxVersionsPerKey)
+	}
+	if opts.MaxValueBytes < 0 {
+		return nil, errors.Errorf("negative maximum value size %d", opts.MaxValueBytes)
+	}
+	if opts.TruncateLargeValues {
+		if opts.MaxValueBytes == 0 {
+			return nil, errors.New("truncating large values requires a maximum value size")
+		}
+		if opts.KeysOnly {
+			return nil, errors.New("a keys-only iteration emits no values to truncate")
+		}
+	}
+	if opts.SkipCorruptValues && !opts.VerifyChecksums {
+		return nil, errors.New("skipping corrupt values requires verifying checksums")
+	}
+	if opts.FailFast && !opts.ConsistencyChecks {
+		return nil, errors.New("failing fast requires consistency checks")
+	}
+	return validatePrefixes(opts.Prefixes)
+}
+
+// NewMVCCIncrementalIteratorWithOptions creates an MVCCIncrementalIterator
+// with the specified engine, time range and options. An error is returned if
+// the options are invalid.
+//
+// Deprecated: use NewMVCCIncrementalIterator, which takes the time range in
+// the options. This will be removed in the next release.
+func NewMVCCIncrementalIteratorWithOptions(
+	e engine.Reader, startTime, endTime hlc.Timestamp, opts MVCCIncrementalIteratorOptions,
+) (*MVCCIncrementalIterator, error) {
+	opts.StartTime, opts.EndTime = startTime, endTime
+	i := NewMVCCIncrementalIterator(e, opts)
+	if err := i.Error(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// NewMVCCIncrementalIteratorWithPrefixes creates an MVCCIncrementalIterator
+// which only iterates over the keys having one of the supplied prefixes. See
+// MVCCIncrementalIteratorOptions.Prefixes.
+//
+// Deprecated: use NewMVCCIncrementalIterator, which takes the time range and
+// prefixes in the options. This will be removed in the next release.
+func NewMVCCIncrementalIteratorWithPrefixes(
+	e engine.Reader, startTime, endTime hlc.Timestamp, prefixes []roachpb.Key,
+) (*MVCCIncrementalIterator, error) {
+	return NewMVCCIncrementalIteratorWithOptions(e, startTime, endTime,
+		MVCCIncrementalIteratorOptions{Prefixes: prefixes})
+}
+
+// validatePrefixes checks that the prefixes are non-empty, sorted and
+// non-overlapping, and returns their PrefixEnds.
+func validatePrefixes(prefixes []roachpb.Key) ([]roachpb.Key, error) {
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	prefixEnds := make([]roachpb.Key, len(prefixes))
+	for j, prefix := range prefixes {
+		if len(prefix) == 0 {
+			return nil, errors.Errorf("prefix %d is empty", j)
+		}
+		if j > 0 && prefix.Compare(prefixEnds[j-1]) < 0 {
+			return nil, errors.Errorf("prefix %s is not sorted after, or overlaps, prefix %s",
+				prefix, prefixes[j-1])
+		}
+		prefixEnds[j] = prefix.PrefixEnd()
+	}
+	return prefixEnds, nil
+}
+
+// SetSkipAbortedIntents controls the handling of an intent in the time range
+// which is resolved as ABORTED while the iterator is positioned at it. The
+// underlying iterator may still see such an intent's metadata even though its
+// provisional value has since been removed. When enabled, an intent in the
+// time range is re-checked against the reader before it is reported, and is
+// skipped (and counted in AbortedIntents) if its provisional value is gone: an
+// aborted intent contributes nothing to the time range. Otherwise, as when
+// disabled, the intent is reported in an IntentConflictError.
+func (i *MVCCIncrementalIterator) SetSkipAbortedIntents(skip bool) {
+	i.skipAbortedIntents = skip
 }
 
 // Reset begins a new iteration with the specified key range.
 func (i *MVCCIncrementalIterator) Reset(startKey, endKey roachpb.Key) {
+	i.checkErrConsulted()
+	i.recordMetrics()
+	i.finishAudit()
+	i.recorded = false
+	if i.optionsErr != nil {
+		i.err = i.optionsErr
+		i.valid = false
+		i.started = true
+		return
+	}
+	if i.timeBound && log.V(2) {
+		logUnskippableSSTables(i.reader, startKey, endKey)
+	}
 	i.iter.Seek(engine.MakeMVCCMetadataKey(startKey))
 	i.endKey = engine.MakeMVCCMetadataKey(endKey)
+	i.iterCtx = IterationContext{
+		Span:      roachpb.Span{Key: startKey, EndKey: endKey},
+		StartTime: i.window.Start,
+		EndTime:   i.window.End,
+	}
 	i.err = nil
 	i.valid = true
 	i.nextkey = false
+	i.next = false
+	i.truncated = false
+	i.skipValue = false
+	i.started = true
+	i.progress = MVCCIncrementalIteratorProgress{}
+	i.maxTimestamp = hlc.Timestamp{}
+	i.conflict = nil
+	i.violations = nil
+	i.prefixIdx = 0
+	i.skippedIdx = 0
+	if i.timeBound && i.metrics != nil {
+		i.progress.SkippedSSTableBytes = i.skippedSSTableBytes(startKey, endKey)
+	}
+	i.maybeStartAudit()
+	if i.window.Start != (hlc.Timestamp{}) && i.window.Start.Less(i.gcThreshold) {
+		i.err = &GCThresholdError{IterationContext: i.iterCtx, GCThreshold: i.gcThreshold}
+		i.valid = false
+		return
+	}
+	if i.maxSafeTimestamp != (hlc.Timestamp{}) && i.maxSafeTimestamp.Less(i.window.End) {
+		i.err = &UnsafeEndTimeError{IterationContext: i.iterCtx, MaxSafeTimestamp: i.maxSafeTimestamp}
+		i.valid = false
+		return
+	}
 	i.Next()
 }
 
-// Close frees up resources held by the iterator.
+// Close frees up resources held by the iterator, and re-checks the generation
+// of the range's descriptor if MVCCIncrementalIteratorOptions.RecheckDescriptor
+// is set. Closing the iterator again has no effect.
 func (i *MVCCIncrementalIterator) Close() {
-	i.iter.Close()
+	if i.closed {
+		return
+	}
+	i.closed = true
+	i.recordMetrics()
+	i.finishAudit()
+	if i.iter != nil {
+		i.iter.Close()
+	}
+	if i.secondaryIter != nil {
+		i.secondaryIter.Close()
+	}
+	if i.checkIter != nil {
+		i.checkIter.Close()
+	}
+	if i.recheckDescriptor != nil {
+		i.closedDescGeneration = i.recheckDescriptor()
+	}
+	i.checkErrConsulted()
+}
+
+// DescriptorGenerations returns the generations of the descriptor of the range
+// iterated over when the iterator was opened and when it was closed, as
+// supplied by MVCCIncrementalIteratorOptions. Until the iterator is closed, or
+// if the descriptor is not re-checked, both are the generation at open.
+func (i *MVCCIncrementalIterator) DescriptorGenerations() (opened, closed int64) {
+	return i.descGeneration, i.closedDescGeneration
+}
+
+// recordMetrics adds the progress of the current iteration, if any, to the
+// iterator's metrics, unless it has been recorded already.
+func (i *MVCCIncrementalIterator) recordMetrics() {
+	if i.metrics == nil || !i.started || i.recorded {
+		return
+	}
+	i.recorded = true
+	var conflicts int
+	if i.conflict != nil {
+		conflicts = len(i.conflict.Intents)
+	}
+	i.metrics.record(i.progress, i.timeBound, conflicts, i.err != nil)
 }
 
 // Next advances the iterator to the next key/value in the iteration.
 func (i *MVCCIncrementalIterator) Next() {
+	if i.skipValue {
+		// The iteration stopped at a value which was too large or corrupt, and
+		// the caller chose to skip it.
+		i.skipValue = false
+		i.err = nil
+		i.errUnconsulted = false
+		i.valid = true
+	}
+	i.truncated = false
 	for {
 		if !i.valid {
 			return
 		}
 		if ok, err := i.iter.Valid(); !ok {
-			i.err = err
+			if err != nil {
+				i.err = &EngineError{IterationContext: i.iterCtx, Err: err}
+			}
 			i.valid = false
+			i.finishConflict()
 			return
 		}
 
@@ -108,28 +1028,56 @@ func (i *MVCCIncrementalIterator) Next() {
 			i.iter.NextKey()
 			continue
 		}
+		if i.next {
+			i.next = false
+			i.iter.Next()
+			continue
+		}
 
 		unsafeMetaKey := i.iter.UnsafeKey()
 		if !unsafeMetaKey.Less(i.endKey) {
 			i.valid = false
+			i.finishConflict()
 			return
 		}
+		if len(i.prefixes) > 0 && !i.withinPrefix(unsafeMetaKey.Key) {
+			if i.prefixIdx == len(i.prefixes) {
+				// The remaining keys are after the last prefix.
+				i.valid = false
+				i.finishConflict()
+				return
+			}
+			i.progress.PrefixSkips++
+			i.iter.Seek(engine.MakeMVCCMetadataKey(i.prefixes[i.prefixIdx]))
+			continue
+		}
+		if len(i.skipped) > 0 && i.withinSkipped(unsafeMetaKey.Key) {
+			i.progress.SkippedSpans++
+			i.iter.Seek(engine.MakeMVCCMetadataKey(i.skipped[i.skippedIdx].EndKey))
+			continue
+		}
 		if unsafeMetaKey.IsValue() {
 			i.meta.Reset()
 			i.meta.Timestamp = unsafeMetaKey.Timestamp
 		} else {
-			if i.err = i.iter.ValueProto(&i.meta); i.err != nil {
+			if err := i.iter.ValueProto(&i.meta); err != nil {
+				if i.consistencyChecks {
+					if !i.addViolation(MVCCViolation{
+						Type: CorruptMetadataViolation, Key: i.iter.Key(), Detail: err.Error(),
+					}) {
+						return
+					}
+					i.iter.NextKey()
+					continue
+				}
+				i.err = &CorruptMVCCMetadataError{IterationContext: i.iterCtx, Key: i.iter.Key(), Err: err}
 				i.valid = false
 				return
 			}
 		}
 		if i.meta.IsInline() {
-			// Inline values are only used in non-user data. They're not needed
-			// for backup, so they're not handled by this method. If one shows
-			// up, throw an error so it's obvious something is wrong.
 			i.valid = false
-			i.err = errors.Errorf("inline values are unsupported by MVCCIncrementalIterator: %s",
-				unsafeMetaKey.Key)
+			i.err = &InlineValueError{IterationContext: i.iterCtx, Key: i.iter.Key().Key}
 			return
 		}
 		if unsafeMetaKey.Key == nil {
@@ -138,54 +1086,503 @@ func (i *MVCCIncrementalIterator) Next() {
 		}
 
 		if i.meta.Txn != nil {
-			if !i.endTime.Less(i.meta.Timestamp) {
-				i.err = &roachpb.WriteIntentError{
-					Intents: []roachpb.Intent{{
-						Span:   roachpb.Span{Key: i.iter.Key().Key},
-						Status: roachpb.PENDING,
-						Txn:    *i.meta.Txn,
-					}},
-				}
-				i.valid = false
+			if i.consistencyChecks && !i.checkIntent(i.iter.Key().Key, i.meta.Timestamp) {
 				return
 			}
+			if i.txn != nil && roachpb.TxnIDEqual(i.meta.Txn.ID, i.txn.ID) &&
+				i.txn.Epoch >= i.meta.Txn.Epoch {
+				if i.txn.Epoch > i.meta.Txn.Epoch {
+					// The intent was written by an earlier epoch of the
+					// transaction, which has since restarted, so its provisional
+					// value is not seen.
+					i.skipProvisionalValue(i.iter.Key().Key, i.meta.Timestamp)
+				} else {
+					// The provisional value of the transaction's own intent is
+					// iterated over like a committed version.
+					i.iter.Next()
+				}
+				continue
+			}
+			if i.meta.Timestamp.Less(i.window.Start) {
+				// The intent's provisional value is written at the timestamp
+				// of its metadata, and every other version of the key is
+				// older, so none of them are in the time range.
+				i.progress.SkippedProvisional++
+				i.iter.NextKey()
+				continue
+			}
+			if i.window.Contains(i.meta.Timestamp) {
+				if i.skipAbortedIntents {
+					key := i.iter.Key().Key
+					aborted, err := i.intentAborted(key, i.meta.Timestamp)
+					if err != nil {
+						i.err = &EngineError{IterationContext: i.iterCtx, Err: err}
+						i.valid = false
+						return
+					}
+					if aborted {
+						i.progress.AbortedIntents++
+						i.skipProvisionalValue(key, i.meta.Timestamp)
+						continue
+					}
+				}
+				i.addConflict(roachpb.Intent{
+					Span:   roachpb.Span{Key: i.iter.Key().Key},
+					Status: roachpb.PENDING,
+					Txn:    *i.meta.Txn,
+				})
+				i.iter.NextKey()
+				continue
+			}
 			i.iter.Next()
 			continue
 		}
 
-		if !i.meta.Timestamp.Less(i.endTime) {
+		if !i.window.Contains(i.meta.Timestamp) {
+			i.progress.SkippedVersions++
+			if i.meta.Timestamp.Less(i.window.Start) {
+				// Every older version of the key is before the time range too.
+				i.iter.NextKey()
+				continue
+			}
+			if i.maxVersionsPerKey > 0 && i.skipNewerVersions(unsafeMetaKey.Key) {
+				continue
+			}
 			i.iter.Next()
 			continue
 		}
-		if i.meta.Timestamp.Less(i.startTime) {
+
+		if i.conflict != nil {
+			// Keys after a conflict are not emitted.
 			i.iter.NextKey()
 			continue
 		}
 
-		i.nextkey = true
+		valueBytes := len(i.iter.UnsafeValue())
+		i.deletion = valueBytes == 0
+		if i.verifyChecksums && !i.deletion {
+			if err := (roachpb.Value{RawBytes: i.iter.UnsafeValue()}).Verify(unsafeMetaKey.Key); err != nil {
+				if i.skipCorruptValues {
+					i.progress.CorruptValues++
+					log.Warningf(context.TODO(), "skipping corrupt value of %s: %s", unsafeMetaKey, err)
+					// An older version isn't the latest in the time range, so
+					// it's only emitted in place of the corrupt one with
+					// AllVersions.
+					if i.allVersions {
+						i.iter.Next()
+					} else {
+						i.iter.NextKey()
+					}
+					continue
+				}
+				i.err = &ChecksumMismatchError{IterationContext: i.iterCtx, Key: i.iter.Key(), Err: err}
+				i.valid = false
+				i.skipValue = true
+				i.advance()
+				return
+			}
+		}
+		if i.keysOnly {
+			valueBytes = 0
+		} else if i.maxValueBytes > 0 && int64(valueBytes) > i.maxValueBytes {
+			if !i.truncateLargeValues {
+				i.err = &ValueTooLargeError{
+					IterationContext: i.iterCtx, Key: i.iter.Key(), Size: int64(valueBytes),
+				}
+				i.valid = false
+				i.skipValue = true
+				i.advance()
+				return
+			}
+			i.truncateValue()
+			valueBytes = len(i.truncatedValue)
+		}
+
+		if i.secondary != nil && rand.Float64() < i.checkSampleRate {
+			i.checkConsistency()
+		}
+
+		i.progress.EmittedKeys++
+		i.progress.EmittedKeyBytes += int64(len(unsafeMetaKey.Key))
+		if i.deletion {
+			i.progress.EmittedDeletions++
+		}
+		i.progress.EmittedValueBytes += int64(valueBytes)
+		i.maxTimestamp.Forward(i.meta.Timestamp)
+		i.advance()
+		if i.audit != nil {
+			i.audit.add(i.UnsafeKey(), i.UnsafeValue())
+		}
 		break
 	}
 }
 
-// Valid returns true if the iterator is currently valid. An iterator that
-// hasn't had Reset called on it or has gone past the end of the key range is
-// invalid.
+// NextKey advances the iterator to the first key/value in the iteration of the
+// next key, skipping the remaining versions of the current key which an
+// iteration of all versions emits. Otherwise it is the same as Next.
+func (i *MVCCIncrementalIterator) NextKey() {
+	if i.next {
+		i.next = false
+		i.nextkey = true
+	}
+	i.Next()
+}
+
+// skipNewerVersions counts a version of the key above the time range which is
+// being stepped over. Once maxVersionsPerKey of the key's versions have been,
+// it seeks to the newest version of the key below the end time, and returns
+// true. Versions are ordered newest first, so none of those seeked past are
+// in the time range.
+func (i *MVCCIncrementalIterator) skipNewerVersions(key roachpb.Key) bool {
+	if !key.Equal(i.newerKey) {
+		i.newerKey = append(i.newerKey[:0], key...)
+		i.newerVersions = 0
+	}
+	i.newerVersions++
+	if i.newerVersions < i.maxVersionsPerKey {
+		return false
+	}
+	i.newerVersions = 0
+	i.progress.VersionCapSeeks++
+	i.iter.Seek(engine.MVCCKey{Key: i.newerKey, Timestamp: i.window.End.Prev()})
+	return true
+}
+
+// checkConsistency checks that the secondary reader returns the version the
+// iterator is positioned at for the time range: the same version of the key
+// with AllVersions, and otherwise the same latest version in the time range.
+// A difference is logged and counted.
+func (i *MVCCIncrementalIterator) checkConsistency() {
+	i.progress.ConsistencyChecks++
+	key := i.iter.UnsafeKey()
+	seekKey := engine.MVCCKey{Key: key.Key, Timestamp: key.Timestamp}
+	if !i.allVersions {
+		// The latest version before the end of the time range.
+		seekKey.Timestamp = i.window.End.Prev()
+	}
+	if i.secondaryIter == nil {
+		i.secondaryIter = i.secondary.NewIterator(false)
+	}
+	i.secondaryIter.Seek(seekKey)
+
+	secondary := "no version in the time range"
+	ok, err := i.secondaryIter.Valid()
+	if err != nil {
+		secondary = fmt.Sprintf("error: %s", err)
+	} else if ok {
+		if unsafeKey := i.secondaryIter.UnsafeKey(); unsafeKey.Key.Equal(key.Key) &&
+			unsafeKey.IsValue() && i.window.Contains(unsafeKey.Timestamp) {
+			if unsafeKey.Timestamp == key.Timestamp &&
+				bytes.Equal(i.secondaryIter.UnsafeValue(), i.iter.UnsafeValue()) {
+				return
+			}
+			secondary = fmt.Sprintf("version at %s of %d bytes",
+				unsafeKey.Timestamp, len(i.secondaryIter.UnsafeValue()))
+		}
+	}
+	i.progress.ConsistencyCheckFailures++
+	log.Warningf(context.TODO(), "incremental iteration of time range %s is inconsistent "+
+		"with the secondary reader at %s: emitted version at %s of %d bytes, secondary has %s",
+		i.window, key.Key, key.Timestamp, len(i.iter.UnsafeValue()), secondary)
+}
+
+// checkIntent checks that the intent at key has a version at its timestamp,
+// and no newer version, recording violations otherwise. It returns false if
+// the iteration is to stop, because of FailFast or an engine error.
+func (i *MVCCIncrementalIterator) checkIntent(key roachpb.Key, ts hlc.Timestamp) bool {
+	if i.checkIter == nil {
+		i.checkIter = i.reader.NewIterator(false)
+	}
+	var found bool
+	for i.checkIter.Seek(engine.MVCCKey{Key: key, Timestamp: hlc.MaxTimestamp}); ; i.checkIter.Next() {
+		if ok, err := i.checkIter.Valid(); err != nil {
+			i.err = &EngineError{IterationContext: i.iterCtx, Err: err}
+			i.valid = false
+			return false
+		} else if !ok {
+			break
+		}
+		unsafeKey := i.checkIter.UnsafeKey()
+		if !unsafeKey.Key.Equal(key) || unsafeKey.Timestamp.Less(ts) {
+			break
+		}
+		if unsafeKey.Timestamp == ts {
+			found = true
+			continue
+		}
+		if !i.addViolation(MVCCViolation{
+			Type:   VersionAboveIntentViolation,
+			Key:    i.checkIter.Key(),
+			Detail: fmt.Sprintf("newer than the intent at %s", ts),
+		}) {
+			return false
+		}
+	}
+	if !found {
+		return i.addViolation(MVCCViolation{
+			Type:   IntentWithoutVersionViolation,
+			Key:    engine.MakeMVCCMetadataKey(key),
+			Detail: fmt.Sprintf("no version at the intent's timestamp %s", ts),
+		})
+	}
+	return true
+}
+
+// addViolation records a violation found by the consistency checks. With
+// FailFast, it stops the iteration and returns false.
+func (i *MVCCIncrementalIterator) addViolation(v MVCCViolation) bool {
+	i.violations = append(i.violations, v)
+	if i.failFast {
+		i.err = &ConsistencyViolationError{IterationContext: i.iterCtx, Violation: v}
+		i.valid = false
+		return false
+	}
+	return true
+}
+
+// advance arranges for the next call to Next to move past the version the
+// iterator is positioned at: to the next version of the key with AllVersions,
+// and to the next key otherwise.
+func (i *MVCCIncrementalIterator) advance() {
+	if i.allVersions {
+		i.next = true
+	} else {
+		i.nextkey = true
+	}
+}
+
+// truncateValue replaces the current value, which is too large, with its
+// checksum and size.
+func (i *MVCCIncrementalIterator) truncateValue() {
+	value := i.iter.UnsafeValue()
+	binary.BigEndian.PutUint32(i.truncatedValue[:4], crc32.ChecksumIEEE(value))
+	binary.BigEndian.PutUint64(i.truncatedValue[4:], uint64(len(value)))
+	i.truncated = true
+}
+
+// withinPrefix returns whether key has one of the iterator's prefixes. If it
+// doesn't, prefixIdx is left at the next prefix after key, or at
+// len(i.prefixes) if there is none. As the iterator only moves forward, the
+// prefixes before key are never considered again.
+func (i *MVCCIncrementalIterator) withinPrefix(key roachpb.Key) bool {
+	for i.prefixIdx < len(i.prefixes) && bytes.Compare(key, i.prefixEnds[i.prefixIdx]) >= 0 {
+		i.prefixIdx++
+	}
+	return i.prefixIdx < len(i.prefixes) && bytes.Compare(key, i.prefixes[i.prefixIdx]) >= 0
+}
+
+// withinSkipped returns whether key is in one of the spans passed to
+// SkipSpans, which is then skipped[skippedIdx]. Like the prefixes, the spans
+// before key are never considered again.
+func (i *MVCCIncrementalIterator) withinSkipped(key roachpb.Key) bool {
+	for i.skippedIdx < len(i.skipped) &&
+		bytes.Compare(key, i.skipped[i.skippedIdx].EndKey) >= 0 {
+		i.skippedIdx++
+	}
+	return i.skippedIdx < len(i.skipped) &&
+		bytes.Compare(key, i.skipped[i.skippedIdx].Key) >= 0
+}
+
+// addConflict records a conflicting intent.
+func (i *MVCCIncrementalIterator) addConflict(intent roachpb.Intent) {
+	if i.conflict == nil {
+		i.conflict = &IntentConflictError{IterationContext: i.iterCtx, ResumeKey: intent.Key}
+	}
+	i.conflict.Intents = append(i.conflict.Intents, intent)
+}
+
+// finishConflict sets the iterator's error to the conflict, if any, once the
+// key range has been scanned. An error from the underlying iterator takes
+// precedence.
+func (i *MVCCIncrementalIterator) finishConflict() {
+	if i.conflict == nil || i.err != nil {
+		return
+	}
+	intents := i.conflict.Intents
+	i.conflict.ConflictSpan = roachpb.Span{
+		Key:    intents[0].Key,
+		EndKey: intents[len(intents)-1].Key.Next(),
+	}
+	i.err = i.conflict
+}
+
+// intentAborted re-reads the provisional value of the intent at key, whose
+// metadata the iterator has seen, directly from the reader. The intent was
+// aborted if the value is gone.
+func (i *MVCCIncrementalIterator) intentAborted(key roachpb.Key, ts hlc.Timestamp) (bool, error) {
+	if i.beforeIntentRecheck != nil {
+		i.beforeIntentRecheck(key)
+	}
+	value, err := i.reader.Get(engine.MVCCKey{Key: key, Timestamp: ts})
+	if err != nil {
+		return false, err
+	}
+	return value == nil, nil
+}
+
+// skipProvisionalValue advances the iterator past the metadata of the intent
+// at key and, if the iterator still sees it, the intent's provisional value.
+// Older versions of the key are iterated over as usual.
+func (i *MVCCIncrementalIterator) skipProvisionalValue(key roachpb.Key, ts hlc.Timestamp) {
+	i.iter.Next()
+	if ok, _ := i.iter.Valid(); ok {
+		if unsafeKey := i.iter.UnsafeKey(); unsafeKey.Key.Equal(key) && unsafeKey.Timestamp == ts {
+			i.iter.Next()
+		}
+	}
+}
+
+// ValidWithErr returns true if the iterator is currently valid. An iterator
+// that hasn't had Reset called on it or has gone past the end of the key range
+// is invalid. If the iterator is invalid because the iteration failed, the
+// error is returned, as by Error.
+func (i *MVCCIncrementalIterator) ValidWithErr() (bool, error) {
+	if i.valid {
+		return true, nil
+	}
+	return false, i.Error()
+}
+
+// Valid is like ValidWithErr, but leaves it to the caller to check Error (or
+// Finish) once it returns false, which an iteration that failed, such as on an
+// intent, is otherwise mistaken for a complete one.
+//
+// Deprecated: use ValidWithErr.
 func (i *MVCCIncrementalIterator) Valid() bool {
+	if !i.valid && i.err != nil {
+		i.errUnconsulted = true
+	}
 	return i.valid
 }
 
-// Error returns the error, if any, which the iterator encountered.
+// checkErrConsulted panics in race builds if Valid reported the end of an
+// iteration which failed and the error was never consulted.
+func (i *MVCCIncrementalIterator) checkErrConsulted() {
+	if raceEnabled && i.errUnconsulted {
+		panic(fmt.Sprintf("MVCCIncrementalIterator: the error of a failed iteration was never "+
+			"consulted after Valid returned false: %v", i.err))
+	}
+	i.errUnconsulted = false
+}
+
+// Error returns the error, if any, which the iterator encountered. Errors
+// encountered by the iteration are of the types defined in this package, such
+// as *IntentConflictError or *EngineError, which embed its IterationContext.
 func (i *MVCCIncrementalIterator) Error() error {
+	i.errUnconsulted = false
 	return i.err
 }
 
+// Violations returns the violations found by the consistency checks of the
+// current iteration so far, in the order they were found. See
+// MVCCIncrementalIteratorOptions.ConsistencyChecks.
+func (i *MVCCIncrementalIterator) Violations() []MVCCViolation {
+	return i.violations
+}
+
+// Progress returns the counters for the current iteration. It may be called
+// at any point, including mid-iteration.
+func (i *MVCCIncrementalIterator) Progress() MVCCIncrementalIteratorProgress {
+	return i.progress
+}
+
+// Finish returns the results of the current iteration. It must be called
+// after the iteration has completed (i.e. Valid returns false) and before
+// Close. If the iteration ended with an error, that error is returned. If the
+// iteration is still in progress, or was never started, an
+// *IncompleteIterationError is returned.
+func (i *MVCCIncrementalIterator) Finish() (MVCCIncrementalIteratorStats, error) {
+	i.errUnconsulted = false
+	if i.err != nil {
+		return MVCCIncrementalIteratorStats{}, i.err
+	}
+	if !i.started {
+		return MVCCIncrementalIteratorStats{}, &IncompleteIterationError{}
+	}
+	if i.valid {
+		return MVCCIncrementalIteratorStats{}, &IncompleteIterationError{Key: i.iter.Key().Key}
+	}
+	return MVCCIncrementalIteratorStats{
+		MVCCIncrementalIteratorProgress: i.progress,
+		MaxTimestamp:                    i.maxTimestamp,
+	}, nil
+}
+
+// IterateMVCCIncremental iterates over the span of the reader between the
+// supplied times like an MVCCIncrementalIterator with the supplied options,
+// calling fn with each emitted key/value. See opts.RetainKeyValues for
+// whether fn may retain them. If fn returns iterutil.Done, the iteration
+// stops early and nil is returned; any other error stops the iteration and is
+// returned annotated with the key at which it occurred. The context is
+// checked for cancellation before each call. See opts.KeyRewriter for the
+// rewriting of the keys passed to fn.
+func IterateMVCCIncremental(
+	ctx context.Context,
+	reader engine.Reader,
+	span roachpb.Span,
+	startTime, endTime hlc.Timestamp,
+	opts MVCCIncrementalIteratorOptions,
+	fn func(engine.MVCCKeyValue) error,
+) error {
+	opts.StartTime, opts.EndTime = startTime, endTime
+	iter := NewMVCCIncrementalIterator(reader, opts)
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	var rewrite *keyRewriteState
+	if opts.KeyRewriter != nil {
+		rewrite = &keyRewriteState{rewriter: opts.KeyRewriter}
+	}
+	for iter.Reset(span.Key, span.EndKey); ; iter.Next() {
+		if ok, err := iter.ValidWithErr(); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var kv engine.MVCCKeyValue
+		if opts.RetainKeyValues {
+			kv = engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()}
+		} else {
+			kv = engine.MVCCKeyValue{Key: iter.UnsafeKey(), Value: iter.UnsafeValue()}
+		}
+		if rewrite != nil {
+			key, ok, err := rewrite.rewrite(iter.iterCtx, kv.Key, opts.RetainKeyValues)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			kv.Key = key
+		}
+		if err := fn(kv); err != nil {
+			if err == iterutil.Done {
+				return nil
+			}
+			return errors.Wrapf(err, "at key %s", iter.UnsafeKey())
+		}
+	}
+	_, err := iter.Finish()
+	return err
+}
+
 // Key returns the current key.
 func (i *MVCCIncrementalIterator) Key() engine.MVCCKey {
 	return i.iter.Key()
 }
 
-// Value returns the current value as a byte slice.
+// Value returns the current value as a byte slice, or nil with KeysOnly.
 func (i *MVCCIncrementalIterator) Value() []byte {
+	if i.keysOnly {
+		return nil
+	}
+	if i.truncated {
+		return append([]byte(nil), i.truncatedValue[:]...)
+	}
 	return i.iter.Value()
 }
 
@@ -198,5 +1595,24 @@ func (i *MVCCIncrementalIterator) UnsafeKey() engine.MVCCKey {
 // UnsafeValue returns the same value as Value, but the memory is invalidated on
 // the next call to {Next,Reset,Close}.
 func (i *MVCCIncrementalIterator) UnsafeValue() []byte {
+	if i.keysOnly {
+		return nil
+	}
+	if i.truncated {
+		return i.truncatedValue[:]
+	}
 	return i.iter.UnsafeValue()
 }
+
+// IsDelete returns whether the current version is a deletion. Unlike checking
+// for an empty value, this works with KeysOnly.
+func (i *MVCCIncrementalIterator) IsDelete() bool {
+	return i.deletion
+}
+
+// ValueTruncated returns whether the current value is larger than
+// MVCCIncrementalIteratorOptions.MaxValueBytes, and was truncated to its
+// checksum and size.
+func (i *MVCCIncrementalIterator) ValueTruncated() bool {
+	return i.truncated
+}
@@ -0,0 +1,299 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// The time-bound iterator modes of a fragmented iteration.
+const (
+	tbiOff = iota
+	tbiOn
+	// tbiRandom picks the mode of each fragment at random, so that resume
+	// tokens created in one mode are consumed in the other.
+	tbiRandom
+)
+
+// fragmentedIterationConfig is a combination of a dataset and iterator
+// features exercised by TestMVCCIncrementalIteratorFragmented.
+type fragmentedIterationConfig struct {
+	// numKeys keys are written with up to maxVersions versions each at
+	// timestamps in [1, 20], and numIntents of them have intents above those.
+	numKeys, maxVersions, numIntents int
+	// The time range is [startTime, endTime), in wall time.
+	startTime, endTime int64
+	// numPrefixes, if positive, restricts the iteration to that many of the
+	// keys, as prefixes.
+	numPrefixes        int
+	skipAbortedIntents bool
+	allVersions        bool
+	// maxBudget is the largest number of versions emitted by a fragment
+	// before it is interrupted, as the budget of each fragment is random.
+	maxBudget int
+	// crashes causes some fragments to be interrupted and their output
+	// discarded, as if the iteration was restarted from its last token.
+	crashes bool
+	tbi     int
+}
+
+func (c fragmentedIterationConfig) String() string {
+	return fmt.Sprintf("keys=%d versions=%d intents=%d time=[%d,%d) prefixes=%d "+
+		"skipAborted=%t allVersions=%t budget=%d crashes=%t tbi=%d",
+		c.numKeys, c.maxVersions, c.numIntents, c.startTime, c.endTime, c.numPrefixes,
+		c.skipAbortedIntents, c.allVersions, c.maxBudget, c.crashes, c.tbi)
+}
+
+// randFragmentedIterationConfig returns a random configuration.
+func randFragmentedIterationConfig(rng *rand.Rand) fragmentedIterationConfig {
+	c := fragmentedIterationConfig{
+		numKeys:            1 + rng.Intn(50),
+		maxVersions:        1 + rng.Intn(5),
+		skipAbortedIntents: rng.Intn(2) == 0,
+		allVersions:        rng.Intn(2) == 0,
+		maxBudget:          1 + rng.Intn(10),
+		crashes:            rng.Intn(2) == 0,
+		tbi:                rng.Intn(3),
+	}
+	c.numIntents = rng.Intn(c.numKeys/10 + 2)
+	if rng.Intn(3) == 0 {
+		c.numPrefixes = 1 + rng.Intn(c.numKeys)
+	}
+	c.startTime = rng.Int63n(15)
+	c.endTime = c.startTime + 1 + rng.Int63n(30-c.startTime)
+	return c
+}
+
+// shrink returns simpler variants of the configuration, with which a failure
+// is retried to find a minimal failing configuration.
+func (c fragmentedIterationConfig) shrink() []fragmentedIterationConfig {
+	var variants []fragmentedIterationConfig
+	add := func(f func(*fragmentedIterationConfig)) {
+		v := c
+		f(&v)
+		if v != c {
+			variants = append(variants, v)
+		}
+	}
+	add(func(v *fragmentedIterationConfig) { v.numKeys /= 2 })
+	add(func(v *fragmentedIterationConfig) { v.numKeys-- })
+	add(func(v *fragmentedIterationConfig) { v.maxVersions-- })
+	add(func(v *fragmentedIterationConfig) { v.numIntents-- })
+	add(func(v *fragmentedIterationConfig) { v.numPrefixes = 0 })
+	add(func(v *fragmentedIterationConfig) { v.numPrefixes-- })
+	add(func(v *fragmentedIterationConfig) { v.skipAbortedIntents = false })
+	add(func(v *fragmentedIterationConfig) { v.allVersions = false })
+	add(func(v *fragmentedIterationConfig) { v.crashes = false })
+	add(func(v *fragmentedIterationConfig) { v.tbi = tbiOff })
+	add(func(v *fragmentedIterationConfig) { v.maxBudget++ })
+	// Drop the variants which are no longer valid.
+	valid := variants[:0]
+	for _, v := range variants {
+		if v.numKeys >= 1 && v.maxVersions >= 1 && v.numIntents >= 0 &&
+			v.numIntents <= v.numKeys && v.numPrefixes >= 0 && v.numPrefixes <= v.numKeys {
+			valid = append(valid, v)
+		}
+	}
+	return valid
+}
+
+// fragmentedIterationResult is the output of an iteration: the emitted
+// versions and the conflict which ended it, if any.
+type fragmentedIterationResult struct {
+	kvs      []engine.MVCCKeyValue
+	conflict *IntentConflictError
+}
+
+// runFragmentedIteration generates the dataset of the configuration from the
+// seed, and checks that an iteration of it split into fragments, each resumed
+// from the marshaled resume token of the last, emits the same versions and
+// conflicts as a single uninterrupted iteration.
+func runFragmentedIteration(seed int64, c fragmentedIterationConfig) error {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(seed))
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+	defer settings.TestingSetBool(&TimeBoundIteratorsEnabled, false)()
+
+	if err := GenerateExportTestData(ctx, e, seed, c.numKeys, c.maxVersions, 20); err != nil {
+		return err
+	}
+	for _, i := range rng.Perm(c.numKeys)[:c.numIntents] {
+		key := ExportTestDataKey(i)
+		txnID := uuid.MakeV4()
+		txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+			Key:       key,
+			ID:        &txnID,
+			Epoch:     1,
+			Timestamp: hlc.Timestamp{WallTime: 21 + rng.Int63n(5)},
+		}}
+		if err := engine.MVCCPut(
+			ctx, e, nil, key, txn.Timestamp, roachpb.MakeValueFromString("intent"), &txn,
+		); err != nil {
+			return err
+		}
+	}
+
+	opts := MVCCIncrementalIteratorOptions{
+		SkipAbortedIntents: c.skipAbortedIntents,
+		AllVersions:        c.allVersions,
+	}
+	if c.numPrefixes > 0 {
+		indexes := rng.Perm(c.numKeys)[:c.numPrefixes]
+		sort.Ints(indexes)
+		for _, i := range indexes {
+			opts.Prefixes = append(opts.Prefixes, ExportTestDataKey(i))
+		}
+	}
+	token := ResumeToken{
+		Span:      roachpb.Span{Key: ExportTestDataKey(0), EndKey: ExportTestDataKey(c.numKeys)},
+		StartTime: hlc.Timestamp{WallTime: c.startTime},
+		EndTime:   hlc.Timestamp{WallTime: c.endTime},
+		Options:   opts,
+	}
+
+	// iterate runs a fragment of the iteration described by the token. Once
+	// budget versions have been emitted, the fragment is interrupted at the
+	// next key, and the key at which to resume is returned.
+	iterate := func(token ResumeToken, budget int) (fragmentedIterationResult, roachpb.Key, error) {
+		opts := token.Options
+		opts.StartTime, opts.EndTime = token.StartTime, token.EndTime
+		iter := NewMVCCIncrementalIterator(e, opts)
+		defer iter.Close()
+		if err := iter.Error(); err != nil {
+			return fragmentedIterationResult{}, nil, err
+		}
+		var res fragmentedIterationResult
+		for iter.Reset(token.Span.Key, token.Span.EndKey); iter.Valid(); iter.Next() {
+			key := iter.UnsafeKey()
+			// Resume tokens resume at a key, so all versions of a key are
+			// emitted by the same fragment.
+			if n := len(res.kvs); budget > 0 && n >= budget && !key.Key.Equal(res.kvs[n-1].Key.Key) {
+				return res, iter.Key().Key, nil
+			}
+			res.kvs = append(res.kvs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+		}
+		if _, err := iter.Finish(); err != nil {
+			conflict, ok := err.(*IntentConflictError)
+			if !ok {
+				return fragmentedIterationResult{}, nil, err
+			}
+			// Each fragment iterates over a different span, so the contexts
+			// of the conflicts differ.
+			withoutCtx := *conflict
+			withoutCtx.IterationContext = IterationContext{}
+			res.conflict = &withoutCtx
+		}
+		return res, nil, nil
+	}
+
+	expected, _, err := iterate(token, 0 /* budget */)
+	if err != nil {
+		return err
+	}
+
+	var actual fragmentedIterationResult
+	for fragments := 0; ; fragments++ {
+		if fragments > 10000 {
+			return errors.New("fragmented iteration did not terminate")
+		}
+		decoded, err := UnmarshalResumeToken(token.Marshal(), nil /* metrics */)
+		if err != nil {
+			return err
+		}
+		switch c.tbi {
+		case tbiOff, tbiOn:
+			settings.TestingSetBool(&TimeBoundIteratorsEnabled, c.tbi == tbiOn)
+		case tbiRandom:
+			settings.TestingSetBool(&TimeBoundIteratorsEnabled, rng.Intn(2) == 0)
+		}
+		res, resumeKey, err := iterate(decoded, 1+rng.Intn(c.maxBudget))
+		if err != nil {
+			return err
+		}
+		if c.crashes && rng.Intn(4) == 0 {
+			// The fragment's output is lost; it is retried from the same token.
+			continue
+		}
+		actual.kvs = append(actual.kvs, res.kvs...)
+		if resumeKey == nil {
+			actual.conflict = res.conflict
+			break
+		}
+		token.Span.Key = resumeKey
+	}
+
+	if !reflect.DeepEqual(expected.kvs, actual.kvs) {
+		return errors.Errorf("expected versions\n%v\ngot\n%v", expected.kvs, actual.kvs)
+	}
+	if !reflect.DeepEqual(expected.conflict, actual.conflict) {
+		return errors.Errorf("expected conflict %v, got %v", expected.conflict, actual.conflict)
+	}
+	return nil
+}
+
+// TestMVCCIncrementalIteratorFragmented is a property-based test of the
+// interactions of the incremental iterator's features: random datasets are
+// iterated with random combinations of features in fragments of random sizes,
+// which are resumed from resume tokens, possibly in a different time-bound
+// iterator mode, and compared to an uninterrupted iteration. A failing
+// configuration is shrunk to a minimal one.
+//
+// Each run uses a new seed, so that repeated runs, as under the nightly
+// stress builds, explore new configurations. The seed is logged, and can be
+// reused with COCKROACH_RANDOM_SEED to reproduce a failure.
+func TestMVCCIncrementalIteratorFragmented(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	seed := envutil.EnvOrDefaultInt64("COCKROACH_RANDOM_SEED", randutil.NewPseudoSeed())
+	t.Logf("random seed: %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	trials := 50
+	if testing.Short() {
+		trials = 10
+	}
+	for i := 0; i < trials; i++ {
+		trialSeed := rng.Int63()
+		c := randFragmentedIterationConfig(rng)
+		err := runFragmentedIteration(trialSeed, c)
+		if err == nil {
+			continue
+		}
+		// Shrink the configuration for as long as a simpler one fails.
+		for shrunk := true; shrunk; {
+			shrunk = false
+			for _, v := range c.shrink() {
+				if vErr := runFragmentedIteration(trialSeed, v); vErr != nil {
+					c, err = v, vErr
+					shrunk = true
+					break
+				}
+			}
+		}
+		t.Fatalf("random seed %d, trial %d (seed %d): %s: %s", seed, i, trialSeed, c, err)
+	}
+}
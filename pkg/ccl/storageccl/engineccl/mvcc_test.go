@@ -11,10 +11,13 @@ package engineccl
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"math"
 	"path/filepath"
+	"reflect"
 	"testing"
 
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/keys"
@@ -23,22 +26,101 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/iterutil"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
 
-func iterateExpectErr(
-	e engine.Engine, startKey, endKey roachpb.Key, startTime, endTime hlc.Timestamp, errString string,
+// iterateCallback collects the key/values emitted by IterateMVCCIncremental,
+// copying them itself unless retain is set.
+func iterateCallback(
+	e engine.Reader, startKey, endKey roachpb.Key, startTime, endTime hlc.Timestamp, retain bool,
+) ([]engine.MVCCKeyValue, error) {
+	var kvs []engine.MVCCKeyValue
+	span := roachpb.Span{Key: startKey, EndKey: endKey}
+	opts := MVCCIncrementalIteratorOptions{RetainKeyValues: retain}
+	err := IterateMVCCIncremental(context.Background(), e, span, startTime, endTime, opts,
+		func(kv engine.MVCCKeyValue) error {
+			if !retain {
+				kv.Key.Key = append(roachpb.Key(nil), kv.Key.Key...)
+				kv.Value = append([]byte(nil), kv.Value...)
+			}
+			kvs = append(kvs, kv)
+			return nil
+		})
+	return kvs, err
+}
+
+// iterateExpectConflict checks that an iteration fails with an
+// *IntentConflictError for the intents on the expected keys, which identifies
+// the iteration.
+func iterateExpectConflict(
+	e engine.Engine,
+	startKey, endKey roachpb.Key,
+	startTime, endTime hlc.Timestamp,
+	expectedIntents []roachpb.Key,
 ) func(*testing.T) {
 	return func(t *testing.T) {
-		iter := NewMVCCIncrementalIterator(e, startTime, endTime)
+		expectedCtx := IterationContext{
+			Span:      roachpb.Span{Key: startKey, EndKey: endKey},
+			StartTime: startTime,
+			EndTime:   endTime,
+		}
+		check := func(desc string, err error) {
+			conflict, ok := err.(*IntentConflictError)
+			if !ok {
+				t.Fatalf("%s: expected an *IntentConflictError, got %v", desc, err)
+			}
+			if !reflect.DeepEqual(conflict.IterationContext, expectedCtx) {
+				t.Errorf("%s: expected the context %s, got %s", desc, expectedCtx, conflict.IterationContext)
+			}
+			var intents []roachpb.Key
+			for _, intent := range conflict.Intents {
+				intents = append(intents, intent.Key)
+			}
+			if !reflect.DeepEqual(intents, expectedIntents) {
+				t.Errorf("%s: expected intents on %s, got %s", desc, expectedIntents, intents)
+			}
+			if !conflict.ResumeKey.Equal(expectedIntents[0]) {
+				t.Errorf("%s: expected to resume at %s, got %s", desc, expectedIntents[0], conflict.ResumeKey)
+			}
+		}
+
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime: startTime,
+			EndTime:   endTime,
+		})
 		defer iter.Close()
-		for iter.Reset(startKey, endKey); iter.Valid(); iter.Next() {
-			// pass
+		for iter.Reset(startKey, endKey); ; iter.Next() {
+			ok, err := iter.ValidWithErr()
+			if !ok {
+				check("ValidWithErr", err)
+				break
+			}
+		}
+		check("Error", iter.Error())
+		_, err := iter.Finish()
+		check("Finish", err)
+		for _, retain := range []bool{false, true} {
+			_, err := iterateCallback(e, startKey, endKey, startTime, endTime, retain)
+			check(fmt.Sprintf("callback iteration (retain=%t)", retain), err)
+		}
+	}
+}
+
+// assertKVsEqual checks that the key/values are those expected.
+func assertKVsEqual(t *testing.T, kvs, expected []engine.MVCCKeyValue) {
+	if len(kvs) != len(expected) {
+		t.Fatalf("got %d kvs but expected %d: %v", len(kvs), len(expected), kvs)
+	}
+	for i := range kvs {
+		if !kvs[i].Key.Equal(expected[i].Key) {
+			t.Fatalf("%d key: got %v but expected %v", i, kvs[i].Key, expected[i].Key)
 		}
-		if err := iter.Error(); !testutils.IsError(err, errString) {
-			t.Fatalf("expected error %q but got %v", errString, err)
+		if !bytes.Equal(kvs[i].Value, expected[i].Value) {
+			t.Fatalf("%d value: got %x but expected %x", i, kvs[i].Value, expected[i].Value)
 		}
 	}
 }
@@ -50,23 +132,49 @@ func assertEqualKVs(
 	expected []engine.MVCCKeyValue,
 ) func(*testing.T) {
 	return func(t *testing.T) {
-		iter := NewMVCCIncrementalIterator(e, startTime, endTime)
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime: startTime,
+			EndTime:   endTime,
+		})
 		defer iter.Close()
 		var kvs []engine.MVCCKeyValue
-		for iter.Reset(startKey, endKey); iter.Valid(); iter.Next() {
+		var maxTimestamp hlc.Timestamp
+		for iter.Reset(startKey, endKey); ; iter.Next() {
+			if ok, err := iter.ValidWithErr(); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				break
+			}
 			kvs = append(kvs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+			maxTimestamp.Forward(iter.UnsafeKey().Timestamp)
+			if p := iter.Progress(); p.EmittedKeys != int64(len(kvs)) {
+				t.Fatalf("expected %d emitted keys mid-iteration, got %d", len(kvs), p.EmittedKeys)
+			}
 		}
-
-		if len(kvs) != len(expected) {
-			t.Fatalf("got %d kvs but expected %d: %v", len(kvs), len(expected), kvs)
+		stats, err := iter.Finish()
+		if err != nil {
+			t.Fatal(err)
 		}
-		for i := range kvs {
-			if !kvs[i].Key.Equal(expected[i].Key) {
-				t.Fatalf("%d key: got %v but expected %v", i, kvs[i].Key, expected[i].Key)
-			}
-			if !bytes.Equal(kvs[i].Value, expected[i].Value) {
-				t.Fatalf("%d value: got %x but expected %x", i, kvs[i].Value, expected[i].Value)
+		if stats.EmittedKeys != int64(len(kvs)) {
+			t.Fatalf("expected %d emitted keys, got %d", len(kvs), stats.EmittedKeys)
+		}
+		if e := exportProgress(kvs, 0); stats.EmittedDeletions != e.EmittedDeletions ||
+			stats.EmittedKeyBytes != e.EmittedKeyBytes || stats.EmittedValueBytes != e.EmittedValueBytes {
+			t.Fatalf("expected emitted deletions and bytes %+v, got %+v", e, stats)
+		}
+		if stats.MaxTimestamp != maxTimestamp {
+			t.Fatalf("expected max timestamp %s, got %s", maxTimestamp, stats.MaxTimestamp)
+		}
+
+		assertKVsEqual(t, kvs, expected)
+
+		// The callback API emits the same key/values as the pull API.
+		for _, retain := range []bool{false, true} {
+			callbackKVs, err := iterateCallback(e, startKey, endKey, startTime, endTime, retain)
+			if err != nil {
+				t.Fatal(err)
 			}
+			assertKVsEqual(t, callbackKVs, kvs)
 		}
 	}
 }
@@ -179,11 +287,60 @@ func runMVCCIterateIncremental(t *testing.T) {
 	}
 	mustFlush()
 	t.Run("intents1",
-		iterateExpectErr(e, testKey1, testKey1.PrefixEnd(), ts0, tsMax, "conflicting intents"))
+		iterateExpectConflict(e, testKey1, testKey1.PrefixEnd(), ts0, tsMax, []roachpb.Key{testKey1}))
 	t.Run("intents2",
-		iterateExpectErr(e, testKey2, testKey2.PrefixEnd(), ts0, tsMax, "conflicting intents"))
+		iterateExpectConflict(e, testKey2, testKey2.PrefixEnd(), ts0, tsMax, []roachpb.Key{testKey2}))
+	// The intents at the end of the time range can only commit after it, so
+	// they don't conflict; see hlc.TimestampWindow.
 	t.Run("intents3", assertEqualKVs(e, keyMin, keyMax, ts0, ts4, nil))
 
+	// An iteration in txn1 sees its own intent, but still conflicts with txn2's.
+	iterateInTxn := func(
+		t *testing.T, txn *roachpb.Transaction, startKey, endKey roachpb.Key,
+	) ([]engine.MVCCKeyValue, error) {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime: ts0,
+			EndTime:   tsMax,
+			Txn:       txn,
+		})
+		defer iter.Close()
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		var kvs []engine.MVCCKeyValue
+		for iter.Reset(startKey, endKey); iter.Valid(); iter.Next() {
+			kvs = append(kvs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+		}
+		_, err := iter.Finish()
+		return kvs, err
+	}
+	t.Run("own intent", func(t *testing.T) {
+		ownKVs, err := iterateInTxn(t, &txn1, keyMin, testKey2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertKVsEqual(t, ownKVs, kvs(kv1_4_4))
+
+		ownKVs, err = iterateInTxn(t, &txn1, keyMin, keyMax)
+		conflict, ok := err.(*IntentConflictError)
+		if !ok {
+			t.Fatalf("expected an *IntentConflictError, got %v", err)
+		}
+		if len(conflict.Intents) != 1 || !conflict.Intents[0].Key.Equal(testKey2) {
+			t.Fatalf("expected a conflict with the intent on %s, got %v", testKey2, conflict.Intents)
+		}
+		assertKVsEqual(t, ownKVs, kvs(kv1_4_4))
+	})
+	t.Run("own intent of an earlier epoch", func(t *testing.T) {
+		restarted := txn1
+		restarted.Epoch++
+		ownKVs, err := iterateInTxn(t, &restarted, keyMin, testKey2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertKVsEqual(t, ownKVs, kvs(kv1_3Deleted))
+	})
+
 	intent1 := roachpb.Intent{Span: roachpb.Span{Key: testKey1}, Txn: txn1.TxnMeta, Status: roachpb.COMMITTED}
 	if err := engine.MVCCResolveWriteIntent(ctx, e, nil, intent1); err != nil {
 		t.Fatal(err)
@@ -197,75 +354,1748 @@ func runMVCCIterateIncremental(t *testing.T) {
 	t.Run("intents4", assertEqualKVs(e, keyMin, keyMax, ts0, tsMax, kvs(kv1_4_4, kv2_2_2)))
 }
 
-func TestMVCCIterateIncremental(t *testing.T) {
+// TestMVCCIncrementalIteratorIntentBelowStartTime verifies that an intent
+// below the start time doesn't conflict with the iteration, and is counted as
+// a skipped provisional write, while one in the time range still conflicts.
+func TestMVCCIncrementalIteratorIntentBelowStartTime(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
-	t.Run("NormalIterators", func(t *testing.T) {
-		settings.TestingSetBool(&TimeBoundIteratorsEnabled, false)
-		runMVCCIterateIncremental(t)
-	})
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
 
-	t.Run("TimeBoundIterators", func(t *testing.T) {
-		settings.TestingSetBool(&TimeBoundIteratorsEnabled, true)
-		runMVCCIterateIncremental(t)
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	keyA, keyB := roachpb.Key("a"), roachpb.Key("b")
+	txnID := uuid.MakeV4()
+	txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+		Key:       keyA,
+		ID:        &txnID,
+		Epoch:     1,
+		Timestamp: ts(1),
+	}}
+	if err := engine.MVCCPut(
+		ctx, e, nil, keyA, txn.Timestamp, roachpb.MakeValueFromString("provisional"), &txn,
+	); err != nil {
+		t.Fatal(err)
+	}
+	valueB := roachpb.MakeValueFromString("b")
+	if err := engine.MVCCPut(ctx, e, nil, keyB, ts(3), valueB, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The intent is below the time range, and neither it nor its provisional
+	// value are emitted.
+	t.Run("below", func(t *testing.T) {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime: ts(2),
+			EndTime:   ts(4),
+		})
+		defer iter.Close()
+		var keys []roachpb.Key
+		for iter.Reset(keyA, keyB.PrefixEnd()); iter.Valid(); iter.Next() {
+			keys = append(keys, iter.Key().Key)
+		}
+		stats, err := iter.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []roachpb.Key{keyB}; !reflect.DeepEqual(keys, expected) {
+			t.Errorf("expected keys %s, got %s", expected, keys)
+		}
+		if stats.SkippedProvisional != 1 {
+			t.Errorf("expected 1 skipped provisional write, got %d", stats.SkippedProvisional)
+		}
 	})
+	// The start time is inclusive, so an intent at it conflicts, as does one
+	// after it.
+	t.Run("at", iterateExpectConflict(e, keyA, keyB.PrefixEnd(), ts(1), ts(4), []roachpb.Key{keyA}))
+	t.Run("above", iterateExpectConflict(e, keyA, keyB.PrefixEnd(), ts(0), ts(4), []roachpb.Key{keyA}))
 }
 
-func TestMVCCIterateTimeBound(t *testing.T) {
+// TestMVCCIncrementalIteratorWindowBoundaries verifies that a version is
+// emitted, and an intent conflicts, exactly when the time range contains its
+// timestamp, for time ranges whose ends are within a logical tick of either,
+// with and without time-bound iterators. The version and the intent are in
+// sstables of their own, so that time-bound iterators filter them.
+func TestMVCCIncrementalIteratorWindowBoundaries(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
 	dir, cleanupFn := testutils.TempDir(t)
 	defer cleanupFn()
+	ctx := context.Background()
+	e, err := engine.NewRocksDB(
+		roachpb.Attributes{},
+		dir,
+		engine.RocksDBCache{},
+		0,
+		engine.DefaultMaxOpenFiles,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
 
-	const numKeys = 100
-	const numBatches = 10
-	const batchTimeSpan = 10
-	const valueSize = 8
+	keyA, keyB := roachpb.Key("a"), roachpb.Key("b")
+	versionTS := hlc.Timestamp{WallTime: 5, Logical: 1}
+	intentTS := hlc.Timestamp{WallTime: 7, Logical: 1}
+	if err := engine.MVCCPut(
+		ctx, e, nil, keyA, versionTS, roachpb.MakeValueFromString("a"), nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	txnID := uuid.MakeV4()
+	txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+		Key:       keyB,
+		ID:        &txnID,
+		Epoch:     1,
+		Timestamp: intentTS,
+	}}
+	if err := engine.MVCCPut(
+		ctx, e, nil, keyB, intentTS, roachpb.MakeValueFromString("b"), &txn,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
 
-	eng, err := loadTestData(filepath.Join(dir, "mvcc_data"),
-		numKeys, numBatches, batchTimeSpan, valueSize)
+	var bounds []hlc.Timestamp
+	for _, ts := range []hlc.Timestamp{versionTS, intentTS} {
+		bounds = append(bounds, ts.Prev(), ts, ts.Next())
+	}
+	for i, start := range bounds {
+		for _, end := range bounds[i:] {
+			window := hlc.TimestampWindow{Start: start, End: end}
+			for _, timeBound := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/tbi=%t", window, timeBound), func(t *testing.T) {
+					iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+						StartTime: start,
+						EndTime:   end,
+						TimeBound: timeBound,
+					})
+					defer iter.Close()
+					var emitted []roachpb.Key
+					var err error
+					for iter.Reset(keyA, keyB.PrefixEnd()); ; iter.Next() {
+						var ok bool
+						if ok, err = iter.ValidWithErr(); !ok {
+							break
+						}
+						emitted = append(emitted, iter.Key().Key)
+					}
+					if _, conflict := err.(*IntentConflictError); err != nil && !conflict {
+						t.Fatal(err)
+					}
+					if a, e := len(emitted) == 1, window.Contains(versionTS); a != e {
+						t.Errorf("expected version emitted=%t, got keys %s", e, emitted)
+					}
+					if a, e := err != nil, window.Contains(intentTS); a != e {
+						t.Errorf("expected intent conflict=%t, got %v", e, err)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestMVCCIncrementalIteratorFinish(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	for i, key := range []roachpb.Key{roachpb.Key("a"), roachpb.Key("b")} {
+		ts := hlc.Timestamp{WallTime: int64(i + 1)}
+		v := roachpb.Value{RawBytes: []byte("val")}
+		if err := engine.MVCCPut(ctx, e, nil, key, ts, v, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+		EndTime: hlc.Timestamp{WallTime: math.MaxInt64},
+	})
+	defer iter.Close()
+
+	if _, err := iter.Finish(); err == nil {
+		t.Fatal("expected error finishing an iteration which was never started")
+	} else if _, ok := err.(*IncompleteIterationError); !ok {
+		t.Fatalf("expected *IncompleteIterationError, got %T: %v", err, err)
+	}
+
+	iter.Reset(roachpb.KeyMin, roachpb.KeyMax)
+	if !iter.Valid() {
+		t.Fatalf("expected valid iterator: %v", iter.Error())
+	}
+	if _, err := iter.Finish(); !testutils.IsError(err, "iteration is incomplete") {
+		t.Fatalf("expected incomplete iteration error, got %v", err)
+	}
+	for ; iter.Valid(); iter.Next() {
+	}
+	stats, err := iter.Finish()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer eng.Close()
+	if stats.EmittedKeys != 2 {
+		t.Errorf("expected 2 emitted keys, got %d", stats.EmittedKeys)
+	}
+	if expected := (hlc.Timestamp{WallTime: 2}); stats.MaxTimestamp != expected {
+		t.Errorf("expected max timestamp %s, got %s", expected, stats.MaxTimestamp)
+	}
+}
 
-	for _, testCase := range []struct {
-		start hlc.Timestamp
-		end   hlc.Timestamp
-	}{
-		// entire time range
-		{hlc.Timestamp{WallTime: 0, Logical: 0}, hlc.Timestamp{WallTime: 100, Logical: 0}},
-		// one SST
-		{hlc.Timestamp{WallTime: 10, Logical: 0}, hlc.Timestamp{WallTime: 19, Logical: 0}},
-		// one SST, plus the min of the following SST
-		{hlc.Timestamp{WallTime: 10, Logical: 0}, hlc.Timestamp{WallTime: 20, Logical: 0}},
-		// one SST, plus the max of the preceding SST
-		{hlc.Timestamp{WallTime: 9, Logical: 0}, hlc.Timestamp{WallTime: 19, Logical: 0}},
-		// one SST, plus the min of the following and the max of the preceding SST
-		{hlc.Timestamp{WallTime: 9, Logical: 0}, hlc.Timestamp{WallTime: 21, Logical: 0}},
-		// one SST, not min or max
-		{hlc.Timestamp{WallTime: 18, Logical: 0}, hlc.Timestamp{WallTime: 18, Logical: 1}},
-		// one SST's max
-		{hlc.Timestamp{WallTime: 19, Logical: 0}, hlc.Timestamp{WallTime: 19, Logical: 1}},
-		// one SST's min
-		{hlc.Timestamp{WallTime: 20, Logical: 0}, hlc.Timestamp{WallTime: 20, Logical: 1}},
-		// random endpoints
-		{hlc.Timestamp{WallTime: 32, Logical: 0}, hlc.Timestamp{WallTime: 78, Logical: 0}},
+// TestMVCCIncrementalIteratorValidWithErr verifies that ValidWithErr returns
+// the error of a failed iteration, and that in race builds, an iteration whose
+// failure was only reported by the deprecated Valid panics when the iterator
+// is reset or closed without the error having been consulted.
+func TestMVCCIncrementalIteratorValidWithErr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	keyA, keyB := roachpb.Key("a"), roachpb.Key("b")
+	if err := engine.MVCCPut(
+		ctx, e, nil, keyA, hlc.Timestamp{WallTime: 1}, roachpb.MakeValueFromString("a"), nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	txnID := uuid.MakeV4()
+	txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+		Key:       keyB,
+		ID:        &txnID,
+		Epoch:     1,
+		Timestamp: hlc.Timestamp{WallTime: 2},
+	}}
+	if err := engine.MVCCPut(
+		ctx, e, nil, keyB, txn.Timestamp, roachpb.MakeValueFromString("provisional"), &txn,
+	); err != nil {
+		t.Fatal(err)
+	}
+	newIter := func() *MVCCIncrementalIterator {
+		return NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			EndTime: hlc.Timestamp{WallTime: 3},
+		})
+	}
+	expectConflict := func(err error) {
+		if _, ok := err.(*IntentConflictError); !ok {
+			t.Fatalf("expected an *IntentConflictError, got %v", err)
+		}
+	}
+	expectPanic := func(desc string, fn func()) {
+		defer func() {
+			if r := recover(); (r != nil) != raceEnabled {
+				t.Fatalf("%s: expected a panic only in race builds, got %v", desc, r)
+			}
+		}()
+		fn()
+	}
+
+	// The key before the intent is valid, and the intent fails the iteration.
+	iter := newIter()
+	iter.Reset(keyA, keyB.PrefixEnd())
+	if ok, err := iter.ValidWithErr(); !ok || err != nil {
+		t.Fatalf("expected a valid iterator, got %t, %v", ok, err)
+	}
+	iter.Next()
+	ok, err := iter.ValidWithErr()
+	if ok {
+		t.Fatal("expected an invalid iterator")
+	}
+	expectConflict(err)
+	// The error was consulted, so neither Reset nor Close panic.
+	iter.Reset(keyA, keyB)
+	for ; iter.Valid(); iter.Next() {
+	}
+	iter.Close()
+
+	// An error consulted with Error or Finish after Valid doesn't panic either.
+	for _, consult := range []func(*MVCCIncrementalIterator) error{
+		(*MVCCIncrementalIterator).Error,
+		func(iter *MVCCIncrementalIterator) error {
+			_, err := iter.Finish()
+			return err
+		},
 	} {
-		t.Run(fmt.Sprintf("%s-%s", testCase.start, testCase.end), func(t *testing.T) {
-			defer leaktest.AfterTest(t)()
+		iter := newIter()
+		for iter.Reset(keyA, keyB.PrefixEnd()); iter.Valid(); iter.Next() {
+		}
+		expectConflict(consult(iter))
+		iter.Close()
+	}
 
-			settings.TestingSetBool(&TimeBoundIteratorsEnabled, false)
-			iter := NewMVCCIncrementalIterator(eng, testCase.start, testCase.end)
-			defer iter.Close()
+	// An error which is never consulted panics on Reset or Close.
+	iter = newIter()
+	for iter.Reset(keyA, keyB.PrefixEnd()); iter.Valid(); iter.Next() {
+	}
+	expectPanic("Reset", func() { iter.Reset(keyA, keyB.PrefixEnd()) })
+	for ; iter.Valid(); iter.Next() {
+	}
+	expectPanic("Close", iter.Close)
+}
 
-			var expectedKVs []engine.MVCCKeyValue
-			for iter.Reset(keys.MinKey, keys.MaxKey); iter.Valid(); iter.Next() {
-				expectedKVs = append(expectedKVs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+// TestMVCCIncrementalIteratorAbortedIntentRace verifies that an intent which
+// is aborted between the iterator reading its metadata and re-checking its
+// provisional value is skipped when SetSkipAbortedIntents is enabled.
+func TestMVCCIncrementalIteratorAbortedIntentRace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	keyA, keyB := roachpb.Key("a"), roachpb.Key("b")
+	tsCommitted, tsIntent := hlc.Timestamp{WallTime: 5}, hlc.Timestamp{WallTime: 10}
+	startTime, endTime := hlc.Timestamp{}, hlc.Timestamp{WallTime: 20}
+
+	setup := func(t *testing.T) (engine.Engine, roachpb.Intent) {
+		e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+		for _, key := range []roachpb.Key{keyA, keyB} {
+			if err := engine.MVCCPut(
+				ctx, e, nil, key, tsCommitted, roachpb.MakeValueFromString("committed"), nil,
+			); err != nil {
+				t.Fatal(err)
+			}
+		}
+		txnID := uuid.MakeV4()
+		txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+			Key:       keyA,
+			ID:        &txnID,
+			Epoch:     1,
+			Timestamp: tsIntent,
+		}}
+		if err := engine.MVCCPut(
+			ctx, e, nil, keyA, tsIntent, roachpb.MakeValueFromString("provisional"), &txn,
+		); err != nil {
+			t.Fatal(err)
+		}
+		return e, roachpb.Intent{Span: roachpb.Span{Key: keyA}, Txn: txn.TxnMeta, Status: roachpb.ABORTED}
+	}
+
+	iterate := func(
+		e engine.Engine, skip bool, hook func(roachpb.Key),
+	) ([]engine.MVCCKey, MVCCIncrementalIteratorStats, error) {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime: startTime,
+			EndTime:   endTime,
+		})
+		defer iter.Close()
+		iter.SetSkipAbortedIntents(skip)
+		iter.beforeIntentRecheck = hook
+		var found []engine.MVCCKey
+		for iter.Reset(keyA, keyB.Next()); iter.Valid(); iter.Next() {
+			found = append(found, iter.Key())
+		}
+		stats, err := iter.Finish()
+		return found, stats, err
+	}
+
+	t.Run("aborted", func(t *testing.T) {
+		e, intent := setup(t)
+		defer e.Close()
+		resolved := false
+		found, stats, err := iterate(e, true, func(key roachpb.Key) {
+			if !key.Equal(keyA) {
+				t.Errorf("unexpected recheck of %s", key)
+			}
+			if err := engine.MVCCResolveWriteIntent(ctx, e, nil, intent); err != nil {
+				t.Fatal(err)
+			}
+			resolved = true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resolved {
+			t.Fatal("expected the intent to be re-checked")
+		}
+		expected := []engine.MVCCKey{
+			{Key: keyA, Timestamp: tsCommitted},
+			{Key: keyB, Timestamp: tsCommitted},
+		}
+		if len(found) != len(expected) {
+			t.Fatalf("expected %v, got %v", expected, found)
+		}
+		for i := range found {
+			if !found[i].Equal(expected[i]) {
+				t.Fatalf("expected %v, got %v", expected, found)
 			}
+		}
+		if stats.AbortedIntents != 1 {
+			t.Errorf("expected 1 aborted intent, got %d", stats.AbortedIntents)
+		}
+	})
 
-			settings.TestingSetBool(&TimeBoundIteratorsEnabled, true)
-			assertEqualKVs(eng, keys.MinKey, keys.MaxKey, testCase.start, testCase.end, expectedKVs)
+	t.Run("pending", func(t *testing.T) {
+		e, _ := setup(t)
+		defer e.Close()
+		_, _, err := iterate(e, true, nil)
+		if _, ok := errors.Cause(err).(*roachpb.WriteIntentError); !ok {
+			t.Fatalf("expected WriteIntentError, got %v", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		e, _ := setup(t)
+		defer e.Close()
+		_, _, err := iterate(e, false, func(roachpb.Key) {
+			t.Error("unexpected recheck with SetSkipAbortedIntents disabled")
 		})
+		if _, ok := errors.Cause(err).(*roachpb.WriteIntentError); !ok {
+			t.Fatalf("expected WriteIntentError, got %v", err)
+		}
+	})
+}
+
+// TestMVCCIncrementalIteratorIntentConflictSpan verifies that intents
+// clustered at the end of a large span are all reported, along with the
+// minimal span containing them, and that every key before the first of them
+// is emitted.
+func TestMVCCIncrementalIteratorIntentConflictSpan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	const numKeys = 1000
+	if err := GenerateExportTestData(ctx, e, 1497033600, numKeys, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	intentKeys := []roachpb.Key{ExportTestDataKey(990), ExportTestDataKey(995), ExportTestDataKey(999)}
+	for _, key := range intentKeys {
+		txnID := uuid.MakeV4()
+		txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+			Key:       key,
+			ID:        &txnID,
+			Epoch:     1,
+			Timestamp: hlc.Timestamp{WallTime: 15},
+		}}
+		if err := engine.MVCCPut(
+			ctx, e, nil, key, txn.Timestamp, roachpb.MakeValueFromString("intent"), &txn,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+		EndTime: hlc.Timestamp{WallTime: 20},
+	})
+	defer iter.Close()
+	var last roachpb.Key
+	for iter.Reset(ExportTestDataKey(0), ExportTestDataKey(numKeys)); iter.Valid(); iter.Next() {
+		last = iter.Key().Key
+	}
+	_, err := iter.Finish()
+	conflict, ok := err.(*IntentConflictError)
+	if !ok {
+		t.Fatalf("expected IntentConflictError, got %v", err)
+	}
+	expectedCtx := IterationContext{
+		Span:    roachpb.Span{Key: ExportTestDataKey(0), EndKey: ExportTestDataKey(numKeys)},
+		EndTime: hlc.Timestamp{WallTime: 20},
+	}
+	if !reflect.DeepEqual(conflict.IterationContext, expectedCtx) {
+		t.Fatalf("expected the context %s, got %s", expectedCtx, conflict.IterationContext)
+	}
+	if !last.Equal(ExportTestDataKey(989)) {
+		t.Fatalf("expected the last emitted key to be %s, got %s", ExportTestDataKey(989), last)
+	}
+	var found []roachpb.Key
+	for _, intent := range conflict.Intents {
+		found = append(found, intent.Key)
+	}
+	if !reflect.DeepEqual(found, intentKeys) {
+		t.Fatalf("expected intents on %s, got %s", intentKeys, found)
+	}
+	expectedSpan := roachpb.Span{Key: intentKeys[0], EndKey: intentKeys[2].Next()}
+	if !conflict.ConflictSpan.Equal(expectedSpan) {
+		t.Fatalf("expected conflict span %s, got %s", expectedSpan, conflict.ConflictSpan)
+	}
+	if !conflict.ResumeKey.Equal(intentKeys[0]) {
+		t.Fatalf("expected resume key %s, got %s", intentKeys[0], conflict.ResumeKey)
+	}
+	if _, ok := errors.Cause(err).(*roachpb.WriteIntentError); !ok {
+		t.Fatalf("expected the cause to be a WriteIntentError, got %v", errors.Cause(err))
+	}
+}
+
+// TestMVCCIncrementalIteratorAllocations guards against per-key allocations
+// in the default mode of the incremental iterator: once the iterator is warm,
+// the allocations of an iteration must not depend on the number of keys it
+// visits.
+func TestMVCCIncrementalIteratorAllocations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 10<<20)
+	defer e.Close()
+
+	// Some versions of each key are before, in, and after the time range, so
+	// that the iteration both emits keys and skips versions.
+	const numKeys = 2000
+	if err := GenerateExportTestData(ctx, e, 1497033600, numKeys, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	startKey := ExportTestDataKey(0)
+	halfKey, endKey := ExportTestDataKey(numKeys/2), ExportTestDataKey(numKeys)
+
+	for _, timeBound := range []bool{false, true} {
+		t.Run(fmt.Sprintf("timeBound=%t", timeBound), func(t *testing.T) {
+			defer settings.TestingSetBool(&TimeBoundIteratorsEnabled, timeBound)()
+
+			iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+				StartTime: hlc.Timestamp{WallTime: 3},
+				EndTime:   hlc.Timestamp{WallTime: 8},
+			})
+			defer iter.Close()
+			allocs := func(endKey roachpb.Key) (float64, int64) {
+				var emitted int64
+				// AllocsPerRun warms the iterator up with an extra run.
+				a := testing.AllocsPerRun(10, func() {
+					for iter.Reset(startKey, endKey); iter.Valid(); iter.Next() {
+						_ = iter.UnsafeKey()
+						_ = iter.UnsafeValue()
+					}
+					stats, err := iter.Finish()
+					if err != nil {
+						t.Fatal(err)
+					}
+					emitted = stats.EmittedKeys
+				})
+				return a, emitted
+			}
+
+			halfAllocs, halfEmitted := allocs(halfKey)
+			fullAllocs, fullEmitted := allocs(endKey)
+			if halfEmitted == 0 || fullEmitted <= halfEmitted {
+				t.Fatalf("expected keys to be emitted, got %d of the first half and %d in total",
+					halfEmitted, fullEmitted)
+			}
+			if fullAllocs != halfAllocs {
+				t.Fatalf("expected the allocations of an iteration not to depend on its number of "+
+					"keys, got %.0f allocations for %d keys and %.0f for %d keys",
+					halfAllocs, halfEmitted, fullAllocs, fullEmitted)
+			}
+		})
+	}
+}
+
+// TestMVCCIncrementalIteratorPrefixes verifies that an iterator restricted to
+// a set of key prefixes emits exactly the keys having one of them, seeking
+// past the others, and that invalid prefixes are rejected.
+func TestMVCCIncrementalIteratorPrefixes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	for _, k := range []string{"a/1", "a/2", "b/1", "b/2", "c/1", "cc/1", "d/1", "e/1"} {
+		for wall := int64(1); wall <= 3; wall++ {
+			value := roachpb.MakeValueFromString(fmt.Sprintf("%s-%d", k, wall))
+			if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(k), hlc.Timestamp{WallTime: wall}, value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	startTime, endTime := hlc.Timestamp{WallTime: 1}, hlc.Timestamp{WallTime: 3}
+	testCases := []struct {
+		startKey, endKey string
+		prefixes         []string
+		expected         []string
+		skips            int64
+	}{
+		// b/1 and cc/1 are seeked past, and the iteration stops at e/1.
+		{"a", "z", []string{"a/", "c/", "d"}, []string{"a/1", "a/2", "c/1", "d/1"}, 2},
+		// Prefixes before the start key are ignored.
+		{"b", "z", []string{"a/", "c/"}, []string{"c/1"}, 1},
+		// The end key bounds the iteration within a prefix.
+		{"a", "a/2", []string{"a/", "c/"}, []string{"a/1"}, 0},
+		{"a", "z", []string{"f/"}, nil, 1},
+	}
+	for i, c := range testCases {
+		var prefixes []roachpb.Key
+		for _, p := range c.prefixes {
+			prefixes = append(prefixes, roachpb.Key(p))
+		}
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime: startTime,
+			EndTime:   endTime,
+			Prefixes:  prefixes,
+		})
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		var actual []string
+		for iter.Reset(roachpb.Key(c.startKey), roachpb.Key(c.endKey)); iter.Valid(); iter.Next() {
+			if ts := iter.UnsafeKey().Timestamp; ts != (hlc.Timestamp{WallTime: 2}) {
+				t.Errorf("%d: expected the version at 2 to be emitted, got %s", i, ts)
+			}
+			actual = append(actual, string(iter.UnsafeKey().Key))
+		}
+		stats, err := iter.Finish()
+		iter.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%d: expected keys %s, got %s", i, c.expected, actual)
+		}
+		if stats.PrefixSkips != c.skips {
+			t.Errorf("%d: expected %d prefix skips, got %d", i, c.skips, stats.PrefixSkips)
+		}
+	}
+
+	for _, c := range []struct {
+		prefixes []string
+		err      string
+	}{
+		{[]string{"a", ""}, "prefix 1 is empty"},
+		{[]string{"b", "a"}, "not sorted after, or overlaps"},
+		{[]string{"a", "ab"}, "not sorted after, or overlaps"},
+		{[]string{"a", "a"}, "not sorted after, or overlaps"},
+	} {
+		var prefixes []roachpb.Key
+		for _, p := range c.prefixes {
+			prefixes = append(prefixes, roachpb.Key(p))
+		}
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime: startTime,
+			EndTime:   endTime,
+			Prefixes:  prefixes,
+		})
+		if err := iter.Error(); !testutils.IsError(err, c.err) {
+			t.Errorf("%s: expected error %q, got %v", c.prefixes, c.err, err)
+		}
+		iter.Close()
+	}
+}
+
+// TestMVCCIncrementalIteratorOptionsValidation verifies that invalid options
+// are reported by Error and by every iteration, without the reader being
+// touched.
+func TestMVCCIncrementalIteratorOptionsValidation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	testCases := []struct {
+		opts MVCCIncrementalIteratorOptions
+		err  string
+	}{
+		{MVCCIncrementalIteratorOptions{}, ""},
+		{MVCCIncrementalIteratorOptions{StartTime: ts(2), EndTime: ts(2)}, ""},
+		{MVCCIncrementalIteratorOptions{StartTime: ts(2), EndTime: ts(1)}, "precedes start time"},
+		{MVCCIncrementalIteratorOptions{EndTime: ts(1), MaxValueBytes: -1}, "negative maximum"},
+		{MVCCIncrementalIteratorOptions{EndTime: ts(1), MaxVersionsPerKey: -1}, "negative maximum"},
+		{MVCCIncrementalIteratorOptions{EndTime: ts(1), MaxValueBytes: 10, KeysOnly: true}, ""},
+		{
+			MVCCIncrementalIteratorOptions{EndTime: ts(1), TruncateLargeValues: true},
+			"requires a maximum value size",
+		},
+		{
+			MVCCIncrementalIteratorOptions{
+				EndTime: ts(1), MaxValueBytes: 10, TruncateLargeValues: true, KeysOnly: true,
+			},
+			"keys-only iteration emits no values to truncate",
+		},
+		{
+			MVCCIncrementalIteratorOptions{EndTime: ts(1), SkipCorruptValues: true},
+			"requires verifying checksums",
+		},
+		{
+			MVCCIncrementalIteratorOptions{
+				EndTime: ts(1), VerifyChecksums: true, SkipCorruptValues: true,
+			},
+			"",
+		},
+		{MVCCIncrementalIteratorOptions{EndTime: ts(1), FailFast: true}, "requires consistency checks"},
+		{MVCCIncrementalIteratorOptions{EndTime: ts(1), ConsistencyChecks: true, FailFast: true}, ""},
+		{
+			MVCCIncrementalIteratorOptions{EndTime: ts(1), Prefixes: []roachpb.Key{roachpb.Key("")}},
+			"prefix 0 is empty",
+		},
+	}
+	for i, c := range testCases {
+		e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+		// An iterator with invalid options has no reader to touch.
+		var reader engine.Reader = e
+		if c.err != "" {
+			reader = nil
+		}
+		iter := NewMVCCIncrementalIterator(reader, c.opts)
+		if err := iter.Error(); !testutils.IsError(err, c.err) {
+			t.Errorf("%d: expected error %q, got %v", i, c.err, err)
+		}
+		iter.Reset(roachpb.KeyMin, roachpb.KeyMax)
+		if iter.Valid() && c.err != "" {
+			t.Errorf("%d: expected the iteration to be invalid", i)
+		}
+		for ; iter.Valid(); iter.Next() {
+		}
+		if _, err := iter.Finish(); !testutils.IsError(err, c.err) {
+			t.Errorf("%d: expected the iteration to fail with %q, got %v", i, c.err, err)
+		}
+		iter.Close()
+		e.Close()
+	}
+}
+
+func TestMVCCIncrementalIteratorNextKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	for _, k := range []string{"a", "b", "c"} {
+		for wall := int64(1); wall <= 3; wall++ {
+			value := roachpb.MakeValueFromString(fmt.Sprintf("%s-%d", k, wall))
+			if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(k), hlc.Timestamp{WallTime: wall}, value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, allVersions := range []bool{false, true} {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime:   hlc.Timestamp{WallTime: 1},
+			EndTime:     hlc.Timestamp{WallTime: 4},
+			AllVersions: allVersions,
+		})
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		var actual []string
+		// Step to the older versions of b, then skip them.
+		for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); {
+			key := iter.UnsafeKey()
+			actual = append(actual, fmt.Sprintf("%s@%d", key.Key, key.Timestamp.WallTime))
+			if string(key.Key) == "b" && key.Timestamp.WallTime == 3 {
+				iter.Next()
+			} else {
+				iter.NextKey()
+			}
+		}
+		_, err := iter.Finish()
+		iter.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"a@3", "b@3", "c@3"}
+		if allVersions {
+			expected = []string{"a@3", "b@3", "b@2", "c@3"}
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("allVersions=%t: expected %s, got %s", allVersions, expected, actual)
+		}
+	}
+}
+
+// TestMVCCIncrementalIteratorMaxVersionsPerKey verifies that an iteration with
+// MaxVersionsPerKey emits the same versions as one without, while seeking past
+// the versions above the time range of keys with more of them than the cap.
+func TestMVCCIncrementalIteratorMaxVersionsPerKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 10<<20)
+	defer e.Close()
+
+	put := func(key string, wallTime int64) {
+		value := roachpb.MakeValueFromString(fmt.Sprintf("%s-%d", key, wallTime))
+		if err := engine.MVCCPut(
+			ctx, e, nil, roachpb.Key(key), hlc.Timestamp{WallTime: wallTime}, value, nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a has 10k versions, b one, and c one below and 200 above the time ranges
+	// below.
+	for wall := int64(1); wall <= 10000; wall++ {
+		put("a", wall)
+	}
+	put("b", 15)
+	put("c", 1)
+	for wall := int64(200); wall < 400; wall++ {
+		put("c", wall)
+	}
+
+	iterate := func(
+		startTime, endTime int64, allVersions bool, maxVersions int,
+	) ([]string, MVCCIncrementalIteratorStats) {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			StartTime:         hlc.Timestamp{WallTime: startTime},
+			EndTime:           hlc.Timestamp{WallTime: endTime},
+			AllVersions:       allVersions,
+			MaxVersionsPerKey: maxVersions,
+		})
+		defer iter.Close()
+		var actual []string
+		for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); iter.Next() {
+			key := iter.UnsafeKey()
+			actual = append(actual, fmt.Sprintf("%s@%d", key.Key, key.Timestamp.WallTime))
+		}
+		stats, err := iter.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return actual, stats
+	}
+
+	const maxVersions = 100
+	testCases := []struct {
+		startTime, endTime int64
+		expected           []string
+		expectedSeeks      int64
+	}{
+		// c has no version in the time range, so the seek lands below it.
+		{10, 20, []string{"a@19", "b@15"}, 2},
+		{150, 250, []string{"a@249", "c@249"}, 2},
+		// Only versions below the time range, which are always seeked past.
+		{20000, 30000, nil, 0},
+	}
+	for _, tc := range testCases {
+		for _, allVersions := range []bool{false, true} {
+			name := fmt.Sprintf("[%d,%d)/allVersions=%t", tc.startTime, tc.endTime, allVersions)
+			expected, expectedStats := iterate(tc.startTime, tc.endTime, allVersions, 0)
+			if !allVersions && !reflect.DeepEqual(expected, tc.expected) {
+				t.Fatalf("%s: expected %s, got %s", name, tc.expected, expected)
+			}
+			if expectedStats.VersionCapSeeks != 0 {
+				t.Fatalf("%s: expected no seeks without a cap, got %d", name, expectedStats.VersionCapSeeks)
+			}
+
+			actual, stats := iterate(tc.startTime, tc.endTime, allVersions, maxVersions)
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s: expected %s, got %s", name, expected, actual)
+			}
+			if stats.VersionCapSeeks != tc.expectedSeeks {
+				t.Errorf("%s: expected %d seeks, got %d", name, tc.expectedSeeks, stats.VersionCapSeeks)
+			}
+			if tc.expectedSeeks > 0 && stats.SkippedVersions >= expectedStats.SkippedVersions/10 {
+				t.Errorf("%s: expected far fewer than %d versions to be stepped over, got %d",
+					name, expectedStats.SkippedVersions, stats.SkippedVersions)
+			}
+		}
+	}
+}
+
+func TestMVCCIncrementalIteratorKeysOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	const numKeys = 100
+	if err := GenerateExportTestData(ctx, e, 1, numKeys, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numKeys; i += 7 {
+		if err := engine.MVCCDelete(ctx, e, nil, ExportTestDataKey(i), hlc.Timestamp{WallTime: 11}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type version struct {
+		key      engine.MVCCKey
+		isDelete bool
+	}
+	iterate := func(opts MVCCIncrementalIteratorOptions) ([]version, MVCCIncrementalIteratorStats) {
+		opts.StartTime, opts.EndTime = hlc.Timestamp{WallTime: 5}, hlc.Timestamp{WallTime: 12}
+		iter := NewMVCCIncrementalIterator(e, opts)
+		defer iter.Close()
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		var versions []version
+		for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); iter.Next() {
+			if opts.KeysOnly {
+				if v := iter.Value(); v != nil {
+					t.Fatalf("%s: expected no value, got %x", iter.UnsafeKey(), v)
+				}
+			} else if iter.IsDelete() != (len(iter.UnsafeValue()) == 0) {
+				t.Fatalf("%s: IsDelete is %t for a value of %d bytes",
+					iter.UnsafeKey(), iter.IsDelete(), len(iter.UnsafeValue()))
+			}
+			versions = append(versions, version{key: iter.Key(), isDelete: iter.IsDelete()})
+		}
+		stats, err := iter.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return versions, stats
+	}
+
+	for _, allVersions := range []bool{false, true} {
+		full, fullStats := iterate(MVCCIncrementalIteratorOptions{AllVersions: allVersions})
+		keysOnly, keysOnlyStats := iterate(MVCCIncrementalIteratorOptions{
+			AllVersions: allVersions, KeysOnly: true,
+		})
+		if len(full) == 0 || fullStats.EmittedDeletions == 0 {
+			t.Fatalf("allVersions=%t: expected versions and deletions, got %d versions and %d deletions",
+				allVersions, len(full), fullStats.EmittedDeletions)
+		}
+		if !reflect.DeepEqual(keysOnly, full) {
+			t.Errorf("allVersions=%t: expected %v, got %v", allVersions, full, keysOnly)
+		}
+		if keysOnlyStats.EmittedValueBytes != 0 {
+			t.Errorf("allVersions=%t: expected no value bytes, got %d",
+				allVersions, keysOnlyStats.EmittedValueBytes)
+		}
+		if keysOnlyStats.EmittedKeys != fullStats.EmittedKeys ||
+			keysOnlyStats.EmittedDeletions != fullStats.EmittedDeletions {
+			t.Errorf("allVersions=%t: expected %d keys and %d deletions, got %d and %d", allVersions,
+				fullStats.EmittedKeys, fullStats.EmittedDeletions,
+				keysOnlyStats.EmittedKeys, keysOnlyStats.EmittedDeletions)
+		}
+	}
+}
+
+func TestMVCCIncrementalIteratorMaxValueBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<30)
+	defer e.Close()
+
+	ts := hlc.Timestamp{WallTime: 1}
+	large := roachpb.MakeValueFromBytes(bytes.Repeat([]byte("x"), 4<<20))
+	for _, k := range []string{"a", "b", "c"} {
+		value := roachpb.MakeValueFromString(k)
+		if k == "b" {
+			value = large
+		}
+		if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(k), ts, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	largeRaw, err := e.Get(engine.MVCCKey{Key: roachpb.Key("b"), Timestamp: ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("error", func(t *testing.T) {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			EndTime:       ts,
+			MaxValueBytes: 1 << 20,
+		})
+		defer iter.Close()
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		var tooLarge []string
+		iter.Reset(roachpb.Key("a"), roachpb.Key("z"))
+		for {
+			for ; iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.UnsafeKey().Key))
+			}
+			vErr, ok := iter.Error().(*ValueTooLargeError)
+			if !ok {
+				break
+			}
+			if vErr.Size != int64(len(largeRaw)) {
+				t.Errorf("expected a size of %d, got %d", len(largeRaw), vErr.Size)
+			}
+			tooLarge = append(tooLarge, string(vErr.Key.Key))
+			// Skip the value and continue.
+			iter.Next()
+		}
+		if _, err := iter.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"a", "c"}; !reflect.DeepEqual(keys, expected) {
+			t.Errorf("expected keys %s, got %s", expected, keys)
+		}
+		if expected := []string{"b"}; !reflect.DeepEqual(tooLarge, expected) {
+			t.Errorf("expected too large values at %s, got %s", expected, tooLarge)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+			EndTime:             ts,
+			MaxValueBytes:       1 << 20,
+			TruncateLargeValues: true,
+		})
+		defer iter.Close()
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for iter.Reset(roachpb.Key("a"), roachpb.Key("z")); iter.Valid(); iter.Next() {
+			key := string(iter.UnsafeKey().Key)
+			keys = append(keys, key)
+			if truncated := iter.ValueTruncated(); truncated != (key == "b") {
+				t.Errorf("%s: expected truncated=%t", key, !truncated)
+			}
+			if !iter.ValueTruncated() {
+				continue
+			}
+			checksum, size, err := DecodeTruncatedValue(iter.Value())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := crc32.ChecksumIEEE(largeRaw); checksum != expected {
+				t.Errorf("expected checksum %d, got %d", expected, checksum)
+			}
+			if size != int64(len(largeRaw)) {
+				t.Errorf("expected a size of %d, got %d", len(largeRaw), size)
+			}
+		}
+		if _, err := iter.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, expected) {
+			t.Errorf("expected keys %s, got %s", expected, keys)
+		}
+		if progress := iter.Progress(); progress.EmittedValueBytes >= 1<<20 {
+			t.Errorf("expected the truncated value to be counted, got %d value bytes",
+				progress.EmittedValueBytes)
+		}
+	})
+}
+
+func TestMVCCIncrementalIteratorVerifyChecksums(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	ts := hlc.Timestamp{WallTime: 2}
+	put := func(k string, ts hlc.Timestamp) {
+		value := roachpb.MakeValueFromString(k)
+		value.InitChecksum(roachpb.Key(k))
+		if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(k), ts, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b has an older version in the time range, which must not be emitted in
+	// place of its corrupt latest version.
+	put("b", hlc.Timestamp{WallTime: 1})
+	for _, k := range []string{"a", "b", "c"} {
+		put(k, ts)
+	}
+	// d has no checksum, and e is deleted, so neither is verified.
+	if err := engine.MVCCPut(ctx, e, nil, roachpb.Key("d"), ts, roachpb.MakeValueFromString("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.MVCCDelete(ctx, e, nil, roachpb.Key("e"), ts, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the value of b in place.
+	corruptKey := engine.MVCCKey{Key: roachpb.Key("b"), Timestamp: ts}
+	raw, err := e.Get(corruptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0xff
+	if err := e.Put(corruptKey, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	iterate := func(opts MVCCIncrementalIteratorOptions) ([]string, MVCCIncrementalIteratorProgress, error) {
+		opts.EndTime = ts.Next()
+		iter := NewMVCCIncrementalIterator(e, opts)
+		defer iter.Close()
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for iter.Reset(roachpb.Key("a"), roachpb.Key("z")); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.UnsafeKey().Key))
+		}
+		_, err := iter.Finish()
+		return keys, iter.Progress(), err
+	}
+
+	// Without verification, the corrupt value is emitted.
+	keys, _, err := iterate(MVCCIncrementalIteratorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %s, got %s", expected, keys)
+	}
+
+	keys, _, err = iterate(MVCCIncrementalIteratorOptions{VerifyChecksums: true})
+	if cErr, ok := err.(*ChecksumMismatchError); !ok {
+		t.Fatalf("expected a *ChecksumMismatchError, got %v", err)
+	} else if !cErr.Key.Equal(corruptKey) {
+		t.Errorf("expected a mismatch at %s, got %s", corruptKey, cErr.Key)
+	}
+	if expected := []string{"a"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %s, got %s", expected, keys)
+	}
+
+	keys, progress, err := iterate(MVCCIncrementalIteratorOptions{
+		VerifyChecksums: true, SkipCorruptValues: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "c", "d", "e"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %s, got %s", expected, keys)
+	}
+	if progress.CorruptValues != 1 {
+		t.Errorf("expected 1 corrupt value, got %d", progress.CorruptValues)
+	}
+
+	// With AllVersions, the older version of b is emitted.
+	keys, progress, err = iterate(MVCCIncrementalIteratorOptions{
+		VerifyChecksums: true, SkipCorruptValues: true, AllVersions: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %s, got %s", expected, keys)
+	}
+	if progress.CorruptValues != 1 {
+		t.Errorf("expected 1 corrupt value, got %d", progress.CorruptValues)
+	}
+}
+
+// TestMVCCIncrementalIteratorViolations verifies that the consistency checks
+// report each kind of violation in MVCC data written directly to the engine,
+// and that the iteration only stops at one with FailFast.
+func TestMVCCIncrementalIteratorViolations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	put := func(key string, ts hlc.Timestamp, value []byte) {
+		if err := e.Put(engine.MVCCKey{Key: roachpb.Key(key), Timestamp: ts}, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putIntent := func(key string, ts hlc.Timestamp) {
+		txnID := uuid.MakeV4()
+		meta := enginepb.MVCCMetadata{
+			Txn:       &enginepb.TxnMeta{ID: &txnID, Key: roachpb.Key(key), Timestamp: ts},
+			Timestamp: ts,
+		}
+		metaKey := engine.MakeMVCCMetadataKey(roachpb.Key(key))
+		if _, _, err := engine.PutProto(e, metaKey, &meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := func(s string) []byte { return roachpb.MakeValueFromString(s).RawBytes }
+
+	put("a", ts(1), value("a1"))
+	// The metadata of b doesn't decode.
+	put("b", hlc.Timestamp{}, []byte{0xff, 0xff, 0xff})
+	put("b", ts(1), value("b1"))
+	// The intent on c has no provisional value.
+	putIntent("c", ts(20))
+	put("c", ts(2), value("c2"))
+	// The intent on d has a provisional value, but also a newer version.
+	putIntent("d", ts(20))
+	put("d", ts(25), value("d25"))
+	put("d", ts(20), value("d20"))
+	put("d", ts(1), value("d1"))
+	put("f", ts(1), value("f1"))
+
+	iterate := func(
+		opts MVCCIncrementalIteratorOptions, startKey roachpb.Key,
+	) ([]string, []MVCCViolation, error) {
+		opts.EndTime = ts(10)
+		iter := NewMVCCIncrementalIterator(e, opts)
+		defer iter.Close()
+		var keys []string
+		for iter.Reset(startKey, roachpb.Key("z")); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.UnsafeKey().Key))
+		}
+		_, err := iter.Finish()
+		return keys, iter.Violations(), err
+	}
+
+	keys, violations, err := iterate(
+		MVCCIncrementalIteratorOptions{ConsistencyChecks: true}, roachpb.Key("a"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "c", "d", "f"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %s, got %s", expected, keys)
+	}
+	expected := []struct {
+		typ MVCCViolationType
+		key engine.MVCCKey
+	}{
+		{CorruptMetadataViolation, engine.MakeMVCCMetadataKey(roachpb.Key("b"))},
+		{IntentWithoutVersionViolation, engine.MakeMVCCMetadataKey(roachpb.Key("c"))},
+		{VersionAboveIntentViolation, engine.MVCCKey{Key: roachpb.Key("d"), Timestamp: ts(25)}},
+	}
+	if len(violations) != len(expected) {
+		t.Fatalf("expected %d violations, got %v", len(expected), violations)
+	}
+	for j, v := range violations {
+		if v.Type != expected[j].typ || !v.Key.Equal(expected[j].key) {
+			t.Errorf("%d: expected %s at %s, got %s", j, expected[j].typ, expected[j].key, v)
+		}
+	}
+
+	// Without the checks, the corrupt metadata fails the iteration, and the
+	// intents go unnoticed.
+	if _, violations, err := iterate(MVCCIncrementalIteratorOptions{}, roachpb.Key("a")); err == nil {
+		t.Fatal("expected the corrupt metadata to fail the iteration")
+	} else if _, ok := err.(*CorruptMVCCMetadataError); !ok {
+		t.Fatalf("expected a *CorruptMVCCMetadataError, got %v", err)
+	} else if len(violations) != 0 {
+		t.Fatalf("expected no violations, got %v", violations)
+	}
+	keys, violations, err = iterate(MVCCIncrementalIteratorOptions{}, roachpb.Key("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"c", "d", "f"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %s, got %s", expected, keys)
+	}
+	if len(violations) != 0 {
+		t.Fatalf("expected no violations, got %v", violations)
+	}
+
+	// With FailFast, the iteration stops at the first violation.
+	keys, violations, err = iterate(
+		MVCCIncrementalIteratorOptions{ConsistencyChecks: true, FailFast: true}, roachpb.Key("c"),
+	)
+	if vErr, ok := err.(*ConsistencyViolationError); !ok {
+		t.Fatalf("expected a *ConsistencyViolationError, got %v", err)
+	} else if vErr.Violation.Type != IntentWithoutVersionViolation {
+		t.Fatalf("expected an intent without version, got %s", vErr.Violation)
+	}
+	if len(keys) != 0 || len(violations) != 1 {
+		t.Fatalf("expected no keys and 1 violation, got %s and %v", keys, violations)
+	}
+}
+
+func TestMVCCIterateIncremental(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingCheckScopedOverrides(t)()
+
+	t.Run("NormalIterators", func(t *testing.T) {
+		defer settings.TestingSetBoolScoped(&TimeBoundIteratorsEnabled, false)()
+		runMVCCIterateIncremental(t)
+	})
+
+	t.Run("TimeBoundIterators", func(t *testing.T) {
+		defer settings.TestingSetBoolScoped(&TimeBoundIteratorsEnabled, true)()
+		runMVCCIterateIncremental(t)
+	})
+}
+
+func TestMVCCIterateTimeBound(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingCheckScopedOverrides(t)()
+
+	dir, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	const numKeys = 100
+	const numBatches = 10
+	const batchTimeSpan = 10
+	const valueSize = 8
+
+	eng, err := loadTestData(filepath.Join(dir, "mvcc_data"),
+		numKeys, numBatches, batchTimeSpan, valueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+
+	t.Run("ordered", func(t *testing.T) {
+		assertTimeBoundKVs(t, eng)
+	})
+
+	// Rewrites of keys of earlier batches give the SSTs overlapping
+	// timestamps.
+	t.Run("overlapping", func(t *testing.T) {
+		opts := testDataOptions{seed: 1, deletionRatio: 0.2, rewriteFraction: 0.5, intents: 3}
+		eng, expected, err := loadTestDataWithOptions(filepath.Join(dir, "mvcc_data_overlapping"),
+			numKeys, numBatches, batchTimeSpan, valueSize, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer eng.Close()
+
+		// The same seed generates the same data.
+		engAgain, expectedAgain, err := loadTestDataWithOptions(
+			filepath.Join(dir, "mvcc_data_overlapping_again"),
+			numKeys, numBatches, batchTimeSpan, valueSize, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		engAgain.Close()
+		assertKVsEqual(t, expectedAgain, expected)
+
+		var deletions, rewrites int
+		for i, kv := range expected {
+			if len(kv.Value) == 0 {
+				deletions++
+			}
+			if kv.Key.Timestamp.WallTime >= int64((i/(numKeys/numBatches)+1)*batchTimeSpan) {
+				rewrites++
+			}
+		}
+		if deletions == 0 || rewrites == 0 {
+			t.Fatalf("expected deletions and rewrites, got %d deletions and %d rewrites",
+				deletions, rewrites)
+		}
+
+		// The intents, whose metadata keys are the only unversioned keys, are
+		// after the end of the full window.
+		var intents []roachpb.Key
+		it := eng.NewIterator(false)
+		for it.Seek(engine.MVCCKey{}); ; it.Next() {
+			if ok, err := it.Valid(); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				break
+			}
+			if !it.UnsafeKey().IsValue() {
+				intents = append(intents, it.Key().Key)
+			}
+		}
+		it.Close()
+		if len(intents) != opts.intents {
+			t.Fatalf("expected %d intents, got %d", opts.intents, len(intents))
+		}
+		endTime := hlc.Timestamp{WallTime: numBatches * batchTimeSpan}
+		for _, tbi := range []bool{false, true} {
+			func() {
+				defer settings.TestingSetBoolScoped(&TimeBoundIteratorsEnabled, tbi)()
+				t.Run(fmt.Sprintf("full/tbi=%t", tbi),
+					assertEqualKVs(eng, keys.MinKey, keys.MaxKey, hlc.Timestamp{}, endTime, expected))
+				t.Run(fmt.Sprintf("intents/tbi=%t", tbi), iterateExpectConflict(eng, keys.MinKey, keys.MaxKey,
+					hlc.Timestamp{}, endTime.Add(batchTimeSpan, 0), intents))
+			}()
+		}
+
+		assertTimeBoundKVs(t, eng)
+	})
+}
+
+// assertTimeBoundKVs checks that iterations over windows of the data written
+// by loadTestData emit the same key/values with and without time-bound
+// iterators.
+func assertTimeBoundKVs(t *testing.T, eng engine.Engine) {
+	for _, testCase := range []struct {
+		start hlc.Timestamp
+		end   hlc.Timestamp
+	}{
+		// entire time range
+		{hlc.Timestamp{WallTime: 0, Logical: 0}, hlc.Timestamp{WallTime: 100, Logical: 0}},
+		// one SST
+		{hlc.Timestamp{WallTime: 10, Logical: 0}, hlc.Timestamp{WallTime: 19, Logical: 0}},
+		// one SST, plus the min of the following SST
+		{hlc.Timestamp{WallTime: 10, Logical: 0}, hlc.Timestamp{WallTime: 20, Logical: 0}},
+		// one SST, plus the max of the preceding SST
+		{hlc.Timestamp{WallTime: 9, Logical: 0}, hlc.Timestamp{WallTime: 19, Logical: 0}},
+		// one SST, plus the min of the following and the max of the preceding SST
+		{hlc.Timestamp{WallTime: 9, Logical: 0}, hlc.Timestamp{WallTime: 21, Logical: 0}},
+		// one SST, not min or max
+		{hlc.Timestamp{WallTime: 18, Logical: 0}, hlc.Timestamp{WallTime: 18, Logical: 1}},
+		// one SST's max
+		{hlc.Timestamp{WallTime: 19, Logical: 0}, hlc.Timestamp{WallTime: 19, Logical: 1}},
+		// one SST's min
+		{hlc.Timestamp{WallTime: 20, Logical: 0}, hlc.Timestamp{WallTime: 20, Logical: 1}},
+		// random endpoints
+		{hlc.Timestamp{WallTime: 32, Logical: 0}, hlc.Timestamp{WallTime: 78, Logical: 0}},
+	} {
+		t.Run(fmt.Sprintf("%s-%s", testCase.start, testCase.end), func(t *testing.T) {
+			defer leaktest.AfterTest(t)()
+
+			restore := settings.TestingSetBoolScoped(&TimeBoundIteratorsEnabled, false)
+			iter := NewMVCCIncrementalIterator(eng, MVCCIncrementalIteratorOptions{
+				StartTime: testCase.start,
+				EndTime:   testCase.end,
+			})
+			defer iter.Close()
+
+			var expectedKVs []engine.MVCCKeyValue
+			for iter.Reset(keys.MinKey, keys.MaxKey); ; iter.Next() {
+				if ok, err := iter.ValidWithErr(); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					break
+				}
+				expectedKVs = append(expectedKVs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+			}
+			restore()
+
+			defer settings.TestingSetBoolScoped(&TimeBoundIteratorsEnabled, true)()
+			assertEqualKVs(eng, keys.MinKey, keys.MaxKey, testCase.start, testCase.end, expectedKVs)(t)
+		})
+	}
+}
+
+// TestSSTableTimestamps checks that each sstable created by loadTestData
+// reports the timestamps of its batch, which time-bound iterators rely on to
+// skip it.
+func TestSSTableTimestamps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	const numKeys = 100
+	const numBatches = 10
+	const batchTimeSpan = 10
+	const valueSize = 8
+
+	eng, err := loadTestData(filepath.Join(dir, "mvcc_data"),
+		numKeys, numBatches, batchTimeSpan, valueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+
+	rocksdb, ok := eng.(*engine.RocksDB)
+	if !ok {
+		t.Fatalf("expected a RocksDB engine, got %T", eng)
+	}
+	ssts := rocksdb.SSTableInfosWithTimestamps(keys.MinKey, keys.MaxKey)
+	if len(ssts) != numBatches {
+		t.Fatalf("expected %d sstables, got %d: %s", numBatches, len(ssts), ssts)
+	}
+	seen := make(map[int64]bool)
+	for _, sst := range ssts {
+		if sst.TsMin == nil || sst.TsMax == nil {
+			t.Fatalf("sstable [%s, %s] lacks timestamps", sst.Start, sst.End)
+		}
+		// The timestamps of a batch are in [batch*batchTimeSpan,
+		// (batch+1)*batchTimeSpan).
+		batch := sst.TsMin.WallTime / batchTimeSpan
+		if sst.TsMax.WallTime/batchTimeSpan != batch || sst.TsMax.Less(*sst.TsMin) {
+			t.Errorf("sstable [%s, %s] has timestamps [%s, %s], which span more than one batch",
+				sst.Start, sst.End, sst.TsMin, sst.TsMax)
+		}
+		if seen[batch] {
+			t.Errorf("more than one sstable has the timestamps of batch %d", batch)
+		}
+		seen[batch] = true
+	}
+
+	// Only the sstable of the first batch overlaps its keys.
+	endKey := roachpb.Key(encoding.EncodeUvarintAscending([]byte("key-"), numKeys/numBatches))
+	if ssts := rocksdb.SSTableInfosWithTimestamps(keys.MinKey, endKey); len(ssts) != 1 ||
+		ssts[0].TsMin.WallTime >= batchTimeSpan {
+		t.Errorf("expected the sstable of the first batch, got %s", ssts)
+	}
+}
+
+// TestMVCCIncrementalIteratorConsistencyCheck verifies that the versions
+// emitted by an incremental iteration are checked against the secondary
+// reader, by writing a version to the engine after the snapshot iterated over
+// was taken.
+func TestMVCCIncrementalIteratorConsistencyCheck(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	ts1, ts2 := hlc.Timestamp{WallTime: 1}, hlc.Timestamp{WallTime: 2}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(k), ts1, roachpb.MakeValueFromString(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := e.NewSnapshot()
+	defer snap.Close()
+	// The snapshot doesn't see the new version of b, but the engine does.
+	if err := engine.MVCCPut(ctx, e, nil, roachpb.Key("b"), ts2, roachpb.MakeValueFromString("b2"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer settings.TestingSetFloat(&ConsistencyCheckSampleRate, 1)()
+	testCases := []struct {
+		enabled          bool
+		checks, failures int64
+	}{
+		{false, 0, 0},
+		{true, 3, 1},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("enabled=%t", c.enabled), func(t *testing.T) {
+			defer settings.TestingSetBool(&ConsistencyCheckEnabled, c.enabled)()
+			iter := NewMVCCIncrementalIterator(snap, MVCCIncrementalIteratorOptions{
+				EndTime:         ts2.Next(),
+				SecondaryReader: e,
+			})
+			defer iter.Close()
+			if err := iter.Error(); err != nil {
+				t.Fatal(err)
+			}
+			iter.Reset(roachpb.Key("a"), roachpb.Key("z"))
+			for ; iter.Valid(); iter.Next() {
+			}
+			stats, err := iter.Finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.ConsistencyChecks != c.checks || stats.ConsistencyCheckFailures != c.failures {
+				t.Errorf("expected %d checks with %d failures, got %d with %d",
+					c.checks, c.failures, stats.ConsistencyChecks, stats.ConsistencyCheckFailures)
+			}
+		})
+	}
+}
+
+// TestIterateMVCCIncrementalStop verifies that an iteration through the
+// callback API stops early without error on iterutil.Done, stops with an
+// error annotated with the current key on any other error, and stops once its
+// context is canceled.
+func TestIterateMVCCIncrementalStop(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	ts := hlc.Timestamp{WallTime: 1}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(k), ts, roachpb.MakeValueFromString(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	span := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")}
+
+	// iterate returns the keys passed to the callback, which returns err at
+	// stopKey.
+	iterate := func(ctx context.Context, stopKey string, err error) ([]string, error) {
+		var seen []string
+		iterErr := IterateMVCCIncremental(ctx, e, span, hlc.Timestamp{}, ts.Next(),
+			MVCCIncrementalIteratorOptions{},
+			func(kv engine.MVCCKeyValue) error {
+				seen = append(seen, string(kv.Key.Key))
+				if string(kv.Key.Key) == stopKey {
+					return err
+				}
+				return nil
+			})
+		return seen, iterErr
+	}
+
+	t.Run("done", func(t *testing.T) {
+		seen, err := iterate(ctx, "b", iterutil.Done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"a", "b"}; !reflect.DeepEqual(seen, expected) {
+			t.Errorf("expected keys %s, got %s", expected, seen)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		boom := errors.New("boom")
+		seen, err := iterate(ctx, "b", boom)
+		if errors.Cause(err) != boom || !testutils.IsError(err, `at key "b"`) {
+			t.Fatalf("expected boom annotated with the key, got %v", err)
+		}
+		if expected := []string{"a", "b"}; !reflect.DeepEqual(seen, expected) {
+			t.Errorf("expected keys %s, got %s", expected, seen)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		var seen []string
+		err := IterateMVCCIncremental(ctx, e, span, hlc.Timestamp{}, ts.Next(),
+			MVCCIncrementalIteratorOptions{},
+			func(kv engine.MVCCKeyValue) error {
+				seen = append(seen, string(kv.Key.Key))
+				cancel()
+				return nil
+			})
+		if err != context.Canceled {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+		if expected := []string{"a"}; !reflect.DeepEqual(seen, expected) {
+			t.Errorf("expected keys %s, got %s", expected, seen)
+		}
+	})
+}
+
+func TestMVCCIncrementalIteratorGCThreshold(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+	if err := engine.MVCCPut(
+		ctx, e, nil, roachpb.Key("a"), hlc.Timestamp{WallTime: 30}, roachpb.MakeValueFromString("a"), nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	gcThreshold := hlc.Timestamp{WallTime: 20}
+	testCases := []struct {
+		startTime, gcThreshold hlc.Timestamp
+		expectErr              bool
+	}{
+		{hlc.Timestamp{WallTime: 10}, hlc.Timestamp{}, false},
+		{hlc.Timestamp{WallTime: 10}, gcThreshold, true},
+		{gcThreshold.Prev(), gcThreshold, true},
+		{gcThreshold, gcThreshold, false},
+		{hlc.Timestamp{WallTime: 25}, gcThreshold, false},
+		// A full iteration isn't affected by garbage collection.
+		{hlc.Timestamp{}, gcThreshold, false},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("%s-%s", c.startTime, c.gcThreshold), func(t *testing.T) {
+			iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+				StartTime:   c.startTime,
+				EndTime:     hlc.Timestamp{WallTime: 40},
+				GCThreshold: c.gcThreshold,
+			})
+			defer iter.Close()
+			if err := iter.Error(); err != nil {
+				t.Fatal(err)
+			}
+			var count int
+			for iter.Reset(roachpb.Key("a"), roachpb.Key("z")); iter.Valid(); iter.Next() {
+				count++
+			}
+			_, err := iter.Finish()
+			if !c.expectErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 1 {
+					t.Fatalf("expected 1 key, got %d", count)
+				}
+				return
+			}
+			gcErr, ok := err.(*GCThresholdError)
+			if !ok {
+				t.Fatalf("expected a *GCThresholdError, got %v", err)
+			}
+			expectedCtx := IterationContext{
+				Span:      roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")},
+				StartTime: c.startTime,
+				EndTime:   hlc.Timestamp{WallTime: 40},
+			}
+			if !reflect.DeepEqual(gcErr.IterationContext, expectedCtx) || gcErr.GCThreshold != c.gcThreshold {
+				t.Fatalf("unexpected error %+v", gcErr)
+			}
+			if expected := fmt.Sprintf("start timestamp %s is before the GC threshold %s (%s)",
+				c.startTime, c.gcThreshold, expectedCtx); err.Error() != expected {
+				t.Fatalf("expected %q, got %q", expected, err)
+			}
+			if count != 0 {
+				t.Fatalf("expected no keys, got %d", count)
+			}
+		})
+	}
+}
+
+// TestMVCCIncrementalIteratorSnapshot verifies that an iteration over a
+// snapshot consistently excludes the writes in its time range which arrive
+// while it runs, both at the keys it has passed and at those ahead of it, and
+// that an end time after MaxSafeTimestamp is rejected.
+func TestMVCCIncrementalIteratorSnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+	version := func(key string, wall int64) engine.MVCCKey {
+		return engine.MVCCKey{Key: roachpb.Key(key), Timestamp: hlc.Timestamp{WallTime: wall}}
+	}
+	put := func(key string, wall int64) {
+		v := version(key, wall)
+		if err := engine.MVCCPut(
+			ctx, e, nil, v.Key, v.Timestamp, roachpb.MakeValueFromString(key), nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// iterate returns the versions emitted by an iteration over the reader,
+	// calling fn at each of them.
+	iterate := func(
+		r engine.Reader, opts MVCCIncrementalIteratorOptions, fn func(roachpb.Key),
+	) []engine.MVCCKey {
+		iter := NewMVCCIncrementalIterator(r, opts)
+		defer iter.Close()
+		var emitted []engine.MVCCKey
+		for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); iter.Next() {
+			emitted = append(emitted, iter.Key())
+			if fn != nil {
+				fn(iter.UnsafeKey().Key)
+			}
+		}
+		if _, err := iter.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		return emitted
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		put(key, 2)
+	}
+	snap := e.NewSnapshot()
+	defer snap.Close()
+	endTime := hlc.Timestamp{WallTime: 5}
+	opts := MVCCIncrementalIteratorOptions{
+		StartTime:        hlc.Timestamp{WallTime: 1},
+		EndTime:          endTime,
+		MaxSafeTimestamp: endTime,
+	}
+
+	// Once the iteration is past b, writes below the end time arrive at a,
+	// which it has passed, and at d and e, which are ahead of it.
+	expected := []engine.MVCCKey{version("a", 2), version("b", 2), version("c", 2), version("d", 2)}
+	if emitted := iterate(snap, opts, func(key roachpb.Key) {
+		if key.Equal(roachpb.Key("b")) {
+			put("a", 4)
+			put("d", 4)
+			put("e", 3)
+		}
+	}); !reflect.DeepEqual(emitted, expected) {
+		t.Fatalf("expected %v, got %v", expected, emitted)
+	}
+	// They remain excluded from iterations over the snapshot, while an
+	// iteration over the engine sees all of them.
+	if emitted := iterate(snap, opts, nil); !reflect.DeepEqual(emitted, expected) {
+		t.Fatalf("expected %v, got %v", expected, emitted)
+	}
+	if emitted, expected := iterate(e, opts, nil), []engine.MVCCKey{
+		version("a", 4), version("b", 2), version("c", 2), version("d", 4), version("e", 3),
+	}; !reflect.DeepEqual(emitted, expected) {
+		t.Fatalf("expected %v, got %v", expected, emitted)
+	}
+
+	// An end time after the maximum safe timestamp is rejected.
+	opts.MaxSafeTimestamp = endTime.Prev()
+	iter := NewMVCCIncrementalIterator(snap, opts)
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	for iter.Reset(roachpb.KeyMin, roachpb.KeyMax); iter.Valid(); iter.Next() {
+		t.Fatalf("unexpected key %s", iter.UnsafeKey())
+	}
+	_, err := iter.Finish()
+	unsafeErr, ok := err.(*UnsafeEndTimeError)
+	if !ok {
+		t.Fatalf("expected an *UnsafeEndTimeError, got %v", err)
+	}
+	if unsafeErr.EndTime != endTime || unsafeErr.MaxSafeTimestamp != opts.MaxSafeTimestamp {
+		t.Fatalf("unexpected error %+v", unsafeErr)
+	}
+	if _, err := iter.CoveredSSTables(roachpb.KeyMin, roachpb.KeyMax); !testutils.IsError(
+		err, "is after the maximum safe timestamp",
+	) {
+		t.Fatalf("expected covered sstables to be rejected, got %v", err)
 	}
 }
@@ -0,0 +1,292 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// timeBoundQuery is an incremental iteration which is run with and without
+// time-bound iterators by TestMVCCIterateTimeBoundRandomized.
+type timeBoundQuery struct {
+	span               roachpb.Span
+	startTime, endTime hlc.Timestamp
+	allVersions        bool
+}
+
+func (q timeBoundQuery) String() string {
+	return fmt.Sprintf("span=%s time=[%s,%s) allVersions=%t",
+		q.span, q.startTime, q.endTime, q.allVersions)
+}
+
+// timeBoundResult is the output of a query: the emitted versions and the
+// error which ended the iteration, if any.
+type timeBoundResult struct {
+	kvs []engine.MVCCKeyValue
+	err string
+}
+
+// runTimeBoundQuery runs the query, with time-bound iterators if tbi is set.
+func runTimeBoundQuery(e engine.Reader, q timeBoundQuery, tbi bool) (timeBoundResult, error) {
+	defer settings.TestingSetBoolScoped(&TimeBoundIteratorsEnabled, tbi)()
+	iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+		StartTime:   q.startTime,
+		EndTime:     q.endTime,
+		AllVersions: q.allVersions,
+	})
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		return timeBoundResult{}, err
+	}
+	var res timeBoundResult
+	for iter.Reset(q.span.Key, q.span.EndKey); iter.Valid(); iter.Next() {
+		res.kvs = append(res.kvs, engine.MVCCKeyValue{Key: iter.Key(), Value: iter.Value()})
+	}
+	if _, err := iter.Finish(); err != nil {
+		res.err = err.Error()
+	}
+	return res, nil
+}
+
+// timeBoundDivergence describes the first difference between the results of
+// a query with and without time-bound iterators, and returns the key at which
+// it occurs, which is nil if only the errors differ. The description is empty
+// if the results are the same.
+func timeBoundDivergence(normal, tbi timeBoundResult) (roachpb.Key, string) {
+	for i := 0; i < len(normal.kvs) || i < len(tbi.kvs); i++ {
+		switch {
+		case i >= len(normal.kvs):
+			return tbi.kvs[i].Key.Key, fmt.Sprintf("only the time-bound iterator emitted %s", tbi.kvs[i].Key)
+		case i >= len(tbi.kvs):
+			return normal.kvs[i].Key.Key, fmt.Sprintf("only the normal iterator emitted %s", normal.kvs[i].Key)
+		case !normal.kvs[i].Key.Equal(tbi.kvs[i].Key) || !bytes.Equal(normal.kvs[i].Value, tbi.kvs[i].Value):
+			key := normal.kvs[i].Key.Key
+			if tbi.kvs[i].Key.Key.Compare(key) < 0 {
+				key = tbi.kvs[i].Key.Key
+			}
+			return key, fmt.Sprintf("the normal iterator emitted %s (%x), the time-bound iterator %s (%x)",
+				normal.kvs[i].Key, normal.kvs[i].Value, tbi.kvs[i].Key, tbi.kvs[i].Value)
+		}
+	}
+	if normal.err != tbi.err {
+		return nil, fmt.Sprintf("the normal iterator failed with %q, the time-bound iterator with %q",
+			normal.err, tbi.err)
+	}
+	return nil, ""
+}
+
+// writeTimeBoundTestData writes numOps random puts, deletions, intents and
+// intent resolutions to the engine, flushing it numFlushes times along the
+// way. Intents are resolved after some of the flushes following them, and
+// sometimes at a pushed timestamp, so that the sstables' timestamp ranges
+// overlap and the metadata and values of intents are in different sstables.
+// It returns the largest timestamp written.
+func writeTimeBoundTestData(
+	ctx context.Context, e engine.Engine, rng *rand.Rand, numKeys, numOps, numFlushes int,
+) (hlc.Timestamp, error) {
+	var now hlc.Timestamp
+	intents := make(map[int]*roachpb.Transaction)
+	for op := 0; op < numOps; op++ {
+		// Each write is at a new timestamp, so that it is never older than
+		// the latest version of its key.
+		now = now.Add(1+rng.Int63n(2), 0)
+		i := rng.Intn(numKeys)
+		key := ExportTestDataKey(i)
+		value := roachpb.MakeValueFromBytes(randutil.RandBytes(rng, 8))
+		txn, pending := intents[i]
+		var err error
+		switch n := rng.Intn(10); {
+		case pending && n < 3:
+			intent := roachpb.Intent{Span: roachpb.Span{Key: key}, Status: roachpb.ABORTED}
+			if n > 0 {
+				// Commit the intent, at a pushed timestamp in one case.
+				intent.Status = roachpb.COMMITTED
+				if n == 2 {
+					txn.Timestamp = now
+				}
+			}
+			intent.Txn = txn.TxnMeta
+			err = engine.MVCCResolveWriteIntent(ctx, e, nil, intent)
+			delete(intents, i)
+		case pending:
+			// Writes to a key with an intent would conflict with it.
+		case n < 1:
+			txnID := uuid.MakeV4()
+			txn = &roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+				Key:       key,
+				ID:        &txnID,
+				Epoch:     1,
+				Timestamp: now,
+			}}
+			err = engine.MVCCPut(ctx, e, nil, key, now, value, txn)
+			intents[i] = txn
+		case n < 3:
+			err = engine.MVCCDelete(ctx, e, nil, key, now, nil)
+		default:
+			err = engine.MVCCPut(ctx, e, nil, key, now, value, nil)
+		}
+		if err != nil {
+			return hlc.Timestamp{}, err
+		}
+		if (op+1)%(numOps/numFlushes) == 0 {
+			if err := e.Flush(); err != nil {
+				return hlc.Timestamp{}, err
+			}
+		}
+	}
+	return now, nil
+}
+
+// TestMVCCIterateTimeBoundRandomized is a metamorphic test of time-bound
+// iterators: random queries of random data, including deletions, intents and
+// sstables with overlapping timestamps, must emit the same versions and fail
+// with the same conflicts with time-bound iterators as without. A divergence
+// is reported with a query minimized to the first divergent key.
+//
+// Each run uses a new seed, which is logged, and can be reused with
+// COCKROACH_RANDOM_SEED to reproduce a failure.
+func TestMVCCIterateTimeBoundRandomized(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingCheckScopedOverrides(t)()
+
+	seed := envutil.EnvOrDefaultInt64("COCKROACH_RANDOM_SEED", randutil.NewPseudoSeed())
+	t.Logf("random seed: %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	numKeys, numOps, numFlushes, numQueries := 200, 5000, 50, 300
+	if testing.Short() {
+		numKeys, numOps, numFlushes, numQueries = 50, 1000, 10, 50
+	}
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+	maxTime, err := writeTimeBoundTestData(ctx, e, rng, numKeys, numOps, numFlushes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diverges := func(q timeBoundQuery) (roachpb.Key, string) {
+		normal, err := runTimeBoundQuery(e, q, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tbi, err := runTimeBoundQuery(e, q, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return timeBoundDivergence(normal, tbi)
+	}
+
+	for n := 0; n < numQueries; n++ {
+		start := rng.Intn(numKeys)
+		startTime := hlc.Timestamp{WallTime: rng.Int63n(maxTime.WallTime + 1)}
+		q := timeBoundQuery{
+			span: roachpb.Span{
+				Key:    ExportTestDataKey(start),
+				EndKey: ExportTestDataKey(start + 1 + rng.Intn(numKeys-start)),
+			},
+			startTime:   startTime,
+			endTime:     startTime.Add(1+rng.Int63n(maxTime.WallTime-startTime.WallTime+5), 0),
+			allVersions: rng.Intn(2) == 0,
+		}
+		key, divergence := diverges(q)
+		if divergence == "" {
+			continue
+		}
+		// Narrow the query to the divergent key, if it still diverges there.
+		if key != nil {
+			narrowed := q
+			narrowed.span = roachpb.Span{Key: key, EndKey: key.Next()}
+			if _, d := diverges(narrowed); d != "" {
+				q, divergence = narrowed, d
+			}
+		}
+		t.Fatalf("random seed %d, query %d: %s: %s", seed, n, q, divergence)
+	}
+}
+
+// TestMVCCIterateTimeBoundIntentMetadata checks that an sstable holding the
+// metadata of an intent isn't skipped by a time-bound iterator whose time
+// range includes the intent, even if the sstable's versions are all outside
+// of it: the metadata has no timestamp in its key, so it is only accounted for
+// by the sstable's timestamp properties if they are derived from its value.
+// Were the sstable skipped, the provisional value of the intent, which is in
+// another sstable, would be emitted as if it were committed.
+func TestMVCCIterateTimeBoundIntentMetadata(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingCheckScopedOverrides(t)()
+
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	intentTS := hlc.Timestamp{WallTime: 5}
+	put := func(key string, ts hlc.Timestamp) {
+		value := roachpb.MakeValueFromString(key).RawBytes
+		if err := e.Put(engine.MVCCKey{Key: roachpb.Key(key), Timestamp: ts}, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush := func() {
+		if err := e.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The provisional value of the intent on b is in one sstable, and its
+	// metadata in another along with an older version of a.
+	put("b", intentTS)
+	flush()
+	put("a", hlc.Timestamp{WallTime: 1})
+	txnID := uuid.MakeV4()
+	meta := enginepb.MVCCMetadata{
+		Txn:       &enginepb.TxnMeta{ID: &txnID, Key: roachpb.Key("b"), Timestamp: intentTS},
+		Timestamp: intentTS,
+	}
+	if _, _, err := engine.PutProto(e, engine.MakeMVCCMetadataKey(roachpb.Key("b")), &meta); err != nil {
+		t.Fatal(err)
+	}
+	flush()
+
+	q := timeBoundQuery{
+		span:      roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("c")},
+		startTime: hlc.Timestamp{WallTime: 3},
+		endTime:   hlc.Timestamp{WallTime: 6},
+	}
+	normal, err := runTimeBoundQuery(e, q, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(normal.err, "conflicting intents") {
+		t.Fatalf("expected the normal iterator to conflict with the intent, got %q", normal.err)
+	}
+	tbi, err := runTimeBoundQuery(e, q, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, divergence := timeBoundDivergence(normal, tbi); divergence != "" {
+		t.Fatal(divergence)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// resumeOptions are the flags in a marshaled ResumeToken describing the
+// options of the iteration it resumes. A token has two sets of flags:
+// required flags change which keys the iteration emits, so a node which
+// doesn't understand one of them must not resume the iteration, while
+// optional flags only affect how the keys are found, and are ignored by a
+// node which doesn't understand them. Optional flags never carry data in the
+// token, so that they can be skipped.
+type resumeOptions uint64
+
+const (
+	// resumeSkipAbortedIntents is the required flag for
+	// MVCCIncrementalIteratorOptions.SkipAbortedIntents.
+	resumeSkipAbortedIntents resumeOptions = 1 << iota
+	// resumePrefixes is the required flag for
+	// MVCCIncrementalIteratorOptions.Prefixes, which follow the resume span in
+	// the token.
+	resumePrefixes
+	// resumeAllVersions is the required flag for
+	// MVCCIncrementalIteratorOptions.AllVersions.
+	resumeAllVersions
+	// resumeMaxValueBytes is the required flag for
+	// MVCCIncrementalIteratorOptions.MaxValueBytes, which follows the prefixes
+	// in the token.
+	resumeMaxValueBytes
+	// resumeTruncateLargeValues is the required flag for
+	// MVCCIncrementalIteratorOptions.TruncateLargeValues.
+	resumeTruncateLargeValues
+	// resumeKeysOnly is the required flag for
+	// MVCCIncrementalIteratorOptions.KeysOnly.
+	resumeKeysOnly
+	// resumeVerifyChecksums and resumeSkipCorruptValues are the required
+	// flags for MVCCIncrementalIteratorOptions.VerifyChecksums and
+	// SkipCorruptValues.
+	resumeVerifyChecksums
+	resumeSkipCorruptValues
+
+	// knownRequiredResumeOptions and knownOptionalResumeOptions are the flags
+	// understood by this version.
+	knownRequiredResumeOptions resumeOptions = resumeSkipAbortedIntents | resumePrefixes |
+		resumeAllVersions | resumeMaxValueBytes | resumeTruncateLargeValues | resumeKeysOnly |
+		resumeVerifyChecksums | resumeSkipCorruptValues
+	knownOptionalResumeOptions resumeOptions = 0
+)
+
+// UnsupportedResumeOptionsError is returned by UnmarshalResumeToken if the
+// token has required options which this version doesn't understand, as when
+// it was created by a newer version. Ignoring them could silently change the
+// keys emitted by the resumed iteration.
+type UnsupportedResumeOptionsError struct {
+	// Options are the unknown required option flags.
+	Options uint64
+}
+
+func (e *UnsupportedResumeOptionsError) Error() string {
+	return fmt.Sprintf("unsupported resume options %#x", e.Options)
+}
+
+// ResumeToken records how to resume an incremental iteration which was
+// interrupted, such as by an IntentConflictError, possibly on another node.
+type ResumeToken struct {
+	// Span is the remainder of the iteration; Span.Key is the key at which it
+	// resumes.
+	Span roachpb.Span
+	// StartTime and EndTime are the time range of the iteration.
+	StartTime, EndTime hlc.Timestamp
+	// Options are the options of the iteration. Options.Metrics,
+	// Options.SecondaryReader, Options.RetainKeyValues, Options.GCThreshold,
+	// Options.MaxSafeTimestamp, Options.Txn, Options.TimeBound,
+	// Options.MaxVersionsPerKey and the descriptor generation options are not
+	// part of the token, and Options.StartTime and Options.EndTime are ignored
+	// in favor of StartTime and EndTime.
+	Options MVCCIncrementalIteratorOptions
+}
+
+// Marshal encodes the token.
+func (t ResumeToken) Marshal() []byte {
+	var required resumeOptions
+	if t.Options.SkipAbortedIntents {
+		required |= resumeSkipAbortedIntents
+	}
+	if len(t.Options.Prefixes) > 0 {
+		required |= resumePrefixes
+	}
+	if t.Options.AllVersions {
+		required |= resumeAllVersions
+	}
+	if t.Options.MaxValueBytes > 0 {
+		required |= resumeMaxValueBytes
+	}
+	if t.Options.TruncateLargeValues {
+		required |= resumeTruncateLargeValues
+	}
+	if t.Options.KeysOnly {
+		required |= resumeKeysOnly
+	}
+	if t.Options.VerifyChecksums {
+		required |= resumeVerifyChecksums
+	}
+	if t.Options.SkipCorruptValues {
+		required |= resumeSkipCorruptValues
+	}
+	var buf []byte
+	var scratch [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		buf = append(buf, scratch[:binary.PutUvarint(scratch[:], v)]...)
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	putUvarint(uint64(required))
+	putUvarint(0 /* optional */)
+	for _, ts := range []hlc.Timestamp{t.StartTime, t.EndTime} {
+		putUvarint(uint64(ts.WallTime))
+		putUvarint(uint64(ts.Logical))
+	}
+	putBytes(t.Span.Key)
+	putBytes(t.Span.EndKey)
+	if required&resumePrefixes != 0 {
+		putUvarint(uint64(len(t.Options.Prefixes)))
+		for _, p := range t.Options.Prefixes {
+			putBytes(p)
+		}
+	}
+	if required&resumeMaxValueBytes != 0 {
+		putUvarint(uint64(t.Options.MaxValueBytes))
+	}
+	return buf
+}
+
+// UnmarshalResumeToken decodes a token encoded by ResumeToken.Marshal. A
+// *UnsupportedResumeOptionsError is returned if the token has required
+// options which this version doesn't understand. Unknown optional options are
+// ignored, and counted by metrics.UnknownResumeOptions if metrics is non-nil.
+func UnmarshalResumeToken(data []byte, metrics *IteratorMetrics) (ResumeToken, error) {
+	var t ResumeToken
+	var err error
+	getUvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = errors.New("malformed resume token")
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+	getBytes := func() []byte {
+		l := getUvarint()
+		if err != nil {
+			return nil
+		}
+		if uint64(len(data)) < l {
+			err = errors.New("malformed resume token")
+			return nil
+		}
+		if l == 0 {
+			return nil
+		}
+		b := append([]byte(nil), data[:l]...)
+		data = data[l:]
+		return b
+	}
+
+	required := resumeOptions(getUvarint())
+	optional := resumeOptions(getUvarint())
+	if err != nil {
+		return ResumeToken{}, err
+	}
+	if unknown := required &^ knownRequiredResumeOptions; unknown != 0 {
+		return ResumeToken{}, &UnsupportedResumeOptionsError{Options: uint64(unknown)}
+	}
+	if optional&^knownOptionalResumeOptions != 0 && metrics != nil {
+		metrics.UnknownResumeOptions.Inc(1)
+	}
+
+	for _, ts := range []*hlc.Timestamp{&t.StartTime, &t.EndTime} {
+		ts.WallTime = int64(getUvarint())
+		ts.Logical = int32(getUvarint())
+	}
+	t.Span.Key = getBytes()
+	t.Span.EndKey = getBytes()
+	t.Options.SkipAbortedIntents = required&resumeSkipAbortedIntents != 0
+	t.Options.AllVersions = required&resumeAllVersions != 0
+	t.Options.TruncateLargeValues = required&resumeTruncateLargeValues != 0
+	t.Options.KeysOnly = required&resumeKeysOnly != 0
+	t.Options.VerifyChecksums = required&resumeVerifyChecksums != 0
+	t.Options.SkipCorruptValues = required&resumeSkipCorruptValues != 0
+	if required&resumePrefixes != 0 {
+		n := getUvarint()
+		for i := uint64(0); i < n && err == nil; i++ {
+			t.Options.Prefixes = append(t.Options.Prefixes, getBytes())
+		}
+	}
+	if required&resumeMaxValueBytes != 0 {
+		t.Options.MaxValueBytes = int64(getUvarint())
+	}
+	if err != nil {
+		return ResumeToken{}, err
+	}
+	if len(data) > 0 {
+		return ResumeToken{}, errors.Errorf("resume token has %d trailing bytes", len(data))
+	}
+	return t, nil
+}
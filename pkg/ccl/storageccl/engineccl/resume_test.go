@@ -0,0 +1,114 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("z")}
+	for i, token := range []ResumeToken{
+		{},
+		{Span: span, StartTime: hlc.Timestamp{WallTime: 1}, EndTime: hlc.Timestamp{WallTime: 2, Logical: 3}},
+		{Span: span, Options: MVCCIncrementalIteratorOptions{SkipAbortedIntents: true}},
+		{Span: span, Options: MVCCIncrementalIteratorOptions{AllVersions: true}},
+		{Span: span, Options: MVCCIncrementalIteratorOptions{MaxValueBytes: 1 << 20}},
+		{Span: span, Options: MVCCIncrementalIteratorOptions{KeysOnly: true}},
+		{Span: span, Options: MVCCIncrementalIteratorOptions{
+			VerifyChecksums: true, SkipCorruptValues: true,
+		}},
+		{Span: span, Options: MVCCIncrementalIteratorOptions{
+			MaxValueBytes: 1 << 20, TruncateLargeValues: true,
+		}},
+		{Span: span, Options: MVCCIncrementalIteratorOptions{
+			Prefixes: []roachpb.Key{roachpb.Key("c"), roachpb.Key("d")},
+		}},
+	} {
+		decoded, err := UnmarshalResumeToken(token.Marshal(), nil)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if !reflect.DeepEqual(decoded, token) {
+			t.Errorf("%d: expected %+v, got %+v", i, token, decoded)
+		}
+	}
+
+	data := ResumeToken{Span: span}.Marshal()
+	if _, err := UnmarshalResumeToken(data[:len(data)-1], nil); !testutils.IsError(err, "malformed resume token") {
+		t.Errorf("expected a malformed token error, got %v", err)
+	}
+	if _, err := UnmarshalResumeToken(append(data, 0), nil); !testutils.IsError(err, "1 trailing bytes") {
+		t.Errorf("expected a trailing bytes error, got %v", err)
+	}
+}
+
+// TestResumeTokenFutureOptions simulates resuming, on this version, an
+// iteration whose token was created by a newer version which sets option
+// flags unknown to this one.
+func TestResumeTokenFutureOptions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	token := ResumeToken{
+		Span:      roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("z")},
+		StartTime: hlc.Timestamp{WallTime: 1},
+		EndTime:   hlc.Timestamp{WallTime: 2},
+		Options:   MVCCIncrementalIteratorOptions{SkipAbortedIntents: true},
+	}
+	// withFlags re-encodes the token with extra flags set, as a newer version
+	// would. Future flags are taken from the top of the flag space.
+	withFlags := func(required, optional uint64) []byte {
+		data := token.Marshal()
+		r, n := binary.Uvarint(data)
+		data = data[n:]
+		o, n := binary.Uvarint(data)
+		data = data[n:]
+		var buf [2 * binary.MaxVarintLen64]byte
+		n = binary.PutUvarint(buf[:], r|required)
+		n += binary.PutUvarint(buf[n:], o|optional)
+		return append(buf[:n:n], data...)
+	}
+	const futureFlag = 1 << 62
+
+	// An unknown optional flag is ignored, and counted.
+	metrics := NewIteratorMetrics()
+	decoded, err := UnmarshalResumeToken(withFlags(0, futureFlag), metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, token) {
+		t.Errorf("expected %+v, got %+v", token, decoded)
+	}
+	if c := metrics.UnknownResumeOptions.Count(); c != 1 {
+		t.Errorf("expected 1 token with unknown options, got %d", c)
+	}
+
+	// An unknown required flag fails the token, whether or not it also has
+	// unknown optional flags.
+	for _, optional := range []uint64{0, futureFlag} {
+		_, err := UnmarshalResumeToken(withFlags(futureFlag|futureFlag>>1, optional), metrics)
+		if e, ok := err.(*UnsupportedResumeOptionsError); !ok {
+			t.Fatalf("expected an *UnsupportedResumeOptionsError, got %v", err)
+		} else if e.Options != futureFlag|futureFlag>>1 {
+			t.Errorf("expected unsupported options %#x, got %#x", uint64(futureFlag|futureFlag>>1), e.Options)
+		}
+	}
+	if c := metrics.UnknownResumeOptions.Count(); c != 1 {
+		t.Errorf("expected 1 token with unknown options, got %d", c)
+	}
+}
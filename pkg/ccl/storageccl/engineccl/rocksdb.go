@@ -14,6 +14,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/pkg/errors"
 )
 
@@ -88,6 +89,43 @@ func VerifyBatchRepr(
 	return cStatsToGoStats(stats, nowNanos)
 }
 
+// VerifyMergeBatchRepr asserts that a BatchRepr consists only of merges of
+// inline values whose keys are between the specified start and end keys, and
+// that the checksums of the values validate.
+func VerifyMergeBatchRepr(repr []byte, start, end engine.MVCCKey) error {
+	r, err := engine.NewRocksDBBatchReader(repr)
+	if err != nil {
+		return errors.Wrapf(err, "verifying merges")
+	}
+	for r.Next() {
+		if r.BatchType() != engine.BatchTypeMerge {
+			return errors.Errorf("unexpected entry type in merge batch: %d", r.BatchType())
+		}
+		mvccKey, err := engine.DecodeKey(r.UnsafeKey())
+		if err != nil {
+			return errors.Wrapf(err, "verifying merges")
+		}
+		if mvccKey.IsValue() {
+			return errors.Errorf("merge of versioned key %s", mvccKey)
+		}
+		if mvccKey.Less(start) || !mvccKey.Less(end) {
+			return errors.Errorf("key not in request range: %s", mvccKey)
+		}
+		var meta enginepb.MVCCMetadata
+		if err := protoutil.Unmarshal(r.UnsafeValue(), &meta); err != nil {
+			return errors.Wrapf(err, "verifying merges")
+		}
+		if !meta.IsInline() {
+			return errors.Errorf("merge of non-inline value at %s", mvccKey)
+		}
+		v := roachpb.Value{RawBytes: meta.RawBytes}
+		if err := v.Verify(mvccKey.Key); err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(r.Error(), "verifying merges")
+}
+
 // TODO(dan): The following are all duplicated from storage/engine/rocksdb.go,
 // but if you export the ones there and reuse them here, it doesn't work.
 //
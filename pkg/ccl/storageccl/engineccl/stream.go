@@ -0,0 +1,102 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/iterutil"
+)
+
+const (
+	defaultStreamBatchBytes      = 1 << 20 // 1 MiB
+	defaultStreamBufferedBatches = 4
+)
+
+// StreamIncremental runs an incremental iteration over the span of the reader
+// in the window, like IterateMVCCIncremental with the supplied options, in a
+// goroutine of its own, and sends the emitted key/values in KVBatches on the
+// returned batch channel. This lets a single iteration feed several
+// consumers, such as the workers of a backup which encode and compress
+// sstables: any number of goroutines may receive from the channels. See
+// opts.StreamBatchBytes and opts.StreamBufferedBatches for the size of the
+// batches and how many are sent ahead of the consumers.
+//
+// The consumer of a batch owns it, and must release it once done with it,
+// after which the key/values returned by the batch are invalid; see
+// KVBatch.Release. A consumer which needs them for longer must copy them.
+//
+// Once the iteration ends, the error channel delivers exactly one value, nil
+// if the iteration completed or the error which stopped it, and the batch
+// channel is closed. A consumer which abandons the stream must cancel the
+// context, which stops the iteration and closes the iterator promptly; the
+// error channel then delivers the context's error unless the iteration had
+// already ended. The batches left in the channel are not returned to the pool.
+func StreamIncremental(
+	ctx context.Context,
+	reader engine.Reader,
+	span roachpb.Span,
+	window hlc.TimestampWindow,
+	opts MVCCIncrementalIteratorOptions,
+) (<-chan *KVBatch, <-chan error) {
+	batchBytes := opts.StreamBatchBytes
+	if batchBytes <= 0 {
+		batchBytes = defaultStreamBatchBytes
+	}
+	buffered := opts.StreamBufferedBatches
+	if buffered <= 0 {
+		buffered = defaultStreamBufferedBatches
+	}
+	// The key/values are copied into the batches, so there's no need for the
+	// iteration to copy them too.
+	opts.RetainKeyValues = false
+
+	batches := make(chan *KVBatch, buffered)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(batches)
+		var batch *KVBatch
+		var sendErr error
+		send := func() bool {
+			select {
+			case batches <- batch:
+				batch = nil
+				return true
+			case <-ctx.Done():
+				sendErr = ctx.Err()
+				return false
+			}
+		}
+		err := IterateMVCCIncremental(ctx, reader, span, window.Start, window.End, opts,
+			func(kv engine.MVCCKeyValue) error {
+				if batch == nil {
+					batch = NewKVBatch()
+				}
+				batch.Add(kv.Key, kv.Value)
+				if batch.Size() >= batchBytes && !send() {
+					return iterutil.Done
+				}
+				return nil
+			})
+		if err == nil && sendErr == nil && batch != nil {
+			send()
+		}
+		if err == nil {
+			err = sendErr
+		}
+		if batch != nil {
+			batch.Release()
+		}
+		errCh <- err
+	}()
+	return batches, errCh
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// expectOneError receives the value delivered by the error channel of a
+// stream, and checks that it is the only one.
+func expectOneError(t *testing.T, errCh <-chan error) error {
+	err := <-errCh
+	select {
+	case err2 := <-errCh:
+		t.Fatalf("expected a single error, got %v and %v", err, err2)
+	default:
+	}
+	return err
+}
+
+// TestStreamIncremental verifies that the key/values streamed to concurrent
+// consumers are those emitted by the iteration, and that the reuse of the
+// batches released by some consumers doesn't disturb the batches held by
+// others. Run it with -race to check the hand-off of the batches.
+func TestStreamIncremental(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<30)
+	defer e.Close()
+	if err := GenerateExportTestData(ctx, e, 1, 2000, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	span := roachpb.Span{Key: roachpb.KeyMin, EndKey: roachpb.KeyMax}
+	window := hlc.TimestampWindow{Start: hlc.Timestamp{WallTime: 3}, End: hlc.Timestamp{WallTime: 8}}
+	expected, err := iterateCallback(e, span.Key, span.EndKey, window.Start, window.End, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches, errCh := StreamIncremental(ctx, e, span, window, MVCCIncrementalIteratorOptions{
+		StreamBatchBytes:      1 << 10,
+		StreamBufferedBatches: 2,
+	})
+	const consumers = 4
+	var wg sync.WaitGroup
+	results := make([][]engine.MVCCKeyValue, consumers)
+	for c := 0; c < consumers; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			// The first consumer holds on to its batches until the stream
+			// ends, while their memory would be reused by the batches the
+			// others release.
+			var held []*KVBatch
+			var heldKVs [][]engine.MVCCKeyValue
+			for batch := range batches {
+				kvs := copyKVs(batch.KVs())
+				results[c] = append(results[c], kvs...)
+				if c == 0 {
+					held = append(held, batch)
+					heldKVs = append(heldKVs, kvs)
+					continue
+				}
+				batch.Release()
+			}
+			for i, batch := range held {
+				if !reflect.DeepEqual(batch.KVs(), heldKVs[i]) {
+					t.Errorf("held batch %d was modified after it was received", i)
+				}
+				batch.Release()
+			}
+		}(c)
+	}
+	wg.Wait()
+	if err := expectOneError(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	var kvs []engine.MVCCKeyValue
+	for _, r := range results {
+		kvs = append(kvs, r...)
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key.Less(kvs[j].Key) })
+	if len(kvs) != len(expected) {
+		t.Fatalf("expected %d key/values, got %d", len(expected), len(kvs))
+	}
+	if !reflect.DeepEqual(kvs, expected) {
+		t.Fatal("streamed key/values differ from those of the iteration")
+	}
+}
+
+// TestStreamIncrementalAbandon verifies that a stream stops once its
+// consumer abandons it by canceling the context, delivering the context's
+// error and closing the batch channel, and that an iteration which fails
+// delivers its error once.
+func TestStreamIncrementalAbandon(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<30)
+	defer e.Close()
+	if err := GenerateExportTestData(ctx, e, 1, 2000, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	span := roachpb.Span{Key: roachpb.KeyMin, EndKey: roachpb.KeyMax}
+	window := hlc.TimestampWindow{End: hlc.Timestamp{WallTime: 11}}
+	opts := MVCCIncrementalIteratorOptions{
+		StreamBatchBytes:      1 << 10,
+		StreamBufferedBatches: 1,
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		batches, errCh := StreamIncremental(ctx, e, span, window, opts)
+		(<-batches).Release()
+		cancel()
+		if err := expectOneError(t, errCh); err != context.Canceled {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+		// The channel holds at most the buffered batches, and is closed.
+		n := 0
+		for batch := range batches {
+			batch.Release()
+			n++
+		}
+		if n > opts.StreamBufferedBatches {
+			t.Errorf("expected at most %d batches after cancellation, got %d", opts.StreamBufferedBatches, n)
+		}
+	})
+
+	t.Run("intent", func(t *testing.T) {
+		key := ExportTestDataKey(1000)
+		txnID := uuid.MakeV4()
+		ts := hlc.Timestamp{WallTime: 10, Logical: 1}
+		txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{Key: key, ID: &txnID, Timestamp: ts}}
+		if err := engine.MVCCPut(
+			ctx, e, nil, key, ts, roachpb.MakeValueFromString("intent"), &txn,
+		); err != nil {
+			t.Fatal(err)
+		}
+		batches, errCh := StreamIncremental(ctx, e, span, window, opts)
+		for batch := range batches {
+			batch.Release()
+		}
+		if _, ok := expectOneError(t, errCh).(*IntentConflictError); !ok {
+			t.Fatal("expected an *IntentConflictError")
+		}
+	})
+}
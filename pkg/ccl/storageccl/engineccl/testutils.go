@@ -0,0 +1,413 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// This file contains a harness for testing incremental exports end to end:
+// a generated dataset is iterated with an MVCCIncrementalIterator, cut into
+// chunks, and written along with a manifest to an in-memory sink, which can
+// then be verified. It is exported so that tests in other packages can reuse
+// it.
+
+// ErrSimulatedCrash is returned by ExportTestHarness.Export when it stops
+// early because of ExportTestHarness.CrashAfterChunks.
+var ErrSimulatedCrash = errors.New("simulated crash during export")
+
+// ExportChunk is a contiguous piece of an export. Chunks of the same export
+// are adjacent: each chunk's span begins where the previous chunk's ended.
+type ExportChunk struct {
+	Span   roachpb.Span
+	KVs    []engine.MVCCKeyValue
+	Digest []byte
+	// Stats describes the data of the chunk, and the versions in its span
+	// which were skipped for being outside the time range of the export.
+	Stats MVCCIncrementalIteratorProgress
+	// DescriptorGeneration is the generation of the range's descriptor when
+	// the iterator which exported the chunk was opened.
+	DescriptorGeneration int64
+}
+
+// ExportManifest describes a completed export.
+type ExportManifest struct {
+	Span      roachpb.Span
+	StartTime hlc.Timestamp
+	EndTime   hlc.Timestamp
+	Chunks    []roachpb.Span
+	// Digest covers every key/value in every chunk, in order.
+	Digest []byte
+	// Descriptors are the schema changes made between StartTime and EndTime,
+	// if requested by ExportTestHarness.ExportDescriptors.
+	Descriptors []DescriptorChange
+	// Stats is the sum of the stats of the chunks. Its derived metrics guide
+	// the compaction of the data once restored; see RecommendCompactions.
+	Stats MVCCIncrementalIteratorProgress
+	// StartDescriptorGeneration and EndDescriptorGeneration are the
+	// generations of the range's descriptor when the export began and when it
+	// completed. DescriptorChanged is set if they differ, in which case the
+	// range's span at completion differs from its span at the start, though
+	// the exported data is still consistent. See RecheckExportDescriptor.
+	StartDescriptorGeneration int64
+	EndDescriptorGeneration   int64
+	DescriptorChanged         bool
+}
+
+// FakeExportSink is an in-memory destination for exports which records every
+// chunk and manifest written to it.
+type FakeExportSink struct {
+	mu        syncutil.Mutex
+	chunks    []ExportChunk
+	manifests []ExportManifest
+}
+
+// PutChunk records a chunk. The key/values of the chunk are copied, as they
+// are only valid for the duration of the call (see KVBatch).
+func (s *FakeExportSink) PutChunk(c ExportChunk) {
+	c.KVs = copyKVs(c.KVs)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks = append(s.chunks, c)
+}
+
+// copyKVs copies the supplied key/values into a single allocation.
+func copyKVs(kvs []engine.MVCCKeyValue) []engine.MVCCKeyValue {
+	var size int
+	for _, kv := range kvs {
+		size += len(kv.Key.Key) + len(kv.Value)
+	}
+	buf := make([]byte, 0, size)
+	copyBytes := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		buf = append(buf, b...)
+		return buf[len(buf)-len(b) : len(buf) : len(buf)]
+	}
+	res := make([]engine.MVCCKeyValue, len(kvs))
+	for i, kv := range kvs {
+		res[i].Key = engine.MVCCKey{Key: copyBytes(kv.Key.Key), Timestamp: kv.Key.Timestamp}
+		res[i].Value = copyBytes(kv.Value)
+	}
+	return res
+}
+
+// PutManifest records a manifest.
+func (s *FakeExportSink) PutManifest(m ExportManifest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifests = append(s.manifests, m)
+}
+
+// Chunks returns the chunks written to the sink, in order.
+func (s *FakeExportSink) Chunks() []ExportChunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ExportChunk(nil), s.chunks...)
+}
+
+// Manifests returns the manifests written to the sink, in order.
+func (s *FakeExportSink) Manifests() []ExportManifest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ExportManifest(nil), s.manifests...)
+}
+
+// ExportTestHarness exports the data in an engine to a FakeExportSink.
+type ExportTestHarness struct {
+	Engine engine.Reader
+	Sink   *FakeExportSink
+	// ChunkSize is the number of keys in each chunk.
+	ChunkSize int
+	// CrashAfterChunks, if positive, causes the next call to Export to return
+	// ErrSimulatedCrash once it has written that many chunks. It is reset by
+	// the simulated crash.
+	CrashAfterChunks int
+	// ExportDescriptors causes the manifest to include the schema changes made
+	// in the time range of the export. See ExportDescriptorHistory.
+	ExportDescriptors bool
+	// DescriptorFilter, if set, restricts the exported schema changes to the
+	// descriptors for which it returns true.
+	DescriptorFilter func(descID uint32) bool
+	// DescriptorGeneration, if set, returns the current generation of the
+	// descriptor of the range being exported, which is recorded in the
+	// manifest. See RecheckExportDescriptor.
+	DescriptorGeneration func() int64
+}
+
+// Export exports the span between the supplied times. If chunks have already
+// been written to the sink (by an export which crashed or hit an error),
+// the export resumes after the last of them, simulating a restart. A manifest
+// is written once the whole span has been exported.
+//
+// If the export runs into intents, the data emitted before the first of them
+// is written as a chunk before the *IntentConflictError is returned, so that
+// once the intents are resolved only the conflicted tail is exported again.
+func (h *ExportTestHarness) Export(span roachpb.Span, startTime, endTime hlc.Timestamp) error {
+	if h.ChunkSize <= 0 {
+		return errors.Errorf("invalid chunk size %d", h.ChunkSize)
+	}
+	resumeKey := span.Key
+	if chunks := h.Sink.Chunks(); len(chunks) > 0 {
+		resumeKey = chunks[len(chunks)-1].Span.EndKey
+	}
+
+	var opts MVCCIncrementalIteratorOptions
+	if h.DescriptorGeneration != nil {
+		opts.DescriptorGeneration = h.DescriptorGeneration()
+		opts.RecheckDescriptor = h.DescriptorGeneration
+	}
+	opts.StartTime, opts.EndTime = startTime, endTime
+	iter := NewMVCCIncrementalIterator(h.Engine, opts)
+	// The iterator is closed before the manifest is written, to re-check the
+	// range's descriptor; closing it again is a no-op.
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	written := 0
+	// skipped is the number of versions skipped before the current chunk. The
+	// versions skipped to reach the first key of a chunk are attributed to the
+	// chunk before it.
+	var skipped int64
+	// The key/values of the current chunk are accumulated in a batch, which is
+	// released once the chunk has been written to the sink.
+	batch := NewKVBatch()
+	defer func() { batch.Release() }()
+	generation, _ := iter.DescriptorGenerations()
+	chunk := ExportChunk{Span: roachpb.Span{Key: resumeKey}, DescriptorGeneration: generation}
+	flush := func(endKey roachpb.Key) {
+		chunk.Span.EndKey = endKey
+		chunk.KVs = batch.KVs()
+		chunk.Digest = DigestKVs(chunk.KVs)
+		progress := iter.Progress()
+		chunk.Stats = exportProgress(chunk.KVs, progress.SkippedVersions-skipped)
+		skipped = progress.SkippedVersions
+		h.Sink.PutChunk(chunk)
+		batch.Release()
+		batch = NewKVBatch()
+		chunk = ExportChunk{Span: roachpb.Span{Key: endKey}, DescriptorGeneration: generation}
+		written++
+	}
+	for iter.Reset(resumeKey, span.EndKey); ; iter.Next() {
+		// The error of a failed iteration is handled with Finish, below.
+		if ok, _ := iter.ValidWithErr(); !ok {
+			break
+		}
+		// A full chunk ends where the next key begins, so that the final chunk
+		// can always extend to the end of the span.
+		if batch.Len() == h.ChunkSize {
+			flush(iter.Key().Key)
+			if h.CrashAfterChunks > 0 && written == h.CrashAfterChunks {
+				h.CrashAfterChunks = 0
+				return ErrSimulatedCrash
+			}
+		}
+		batch.Add(iter.UnsafeKey(), iter.UnsafeValue())
+	}
+	if _, err := iter.Finish(); err != nil {
+		if conflict, ok := err.(*IntentConflictError); ok && chunk.Span.Key.Compare(conflict.ResumeKey) < 0 {
+			flush(conflict.ResumeKey)
+		}
+		return err
+	}
+	if batch.Len() > 0 || !chunk.Span.Key.Equal(span.EndKey) {
+		flush(span.EndKey)
+	}
+
+	manifest := ExportManifest{Span: span, StartTime: startTime, EndTime: endTime}
+	chunks := h.Sink.Chunks()
+	var kvs []engine.MVCCKeyValue
+	for _, c := range chunks {
+		manifest.Chunks = append(manifest.Chunks, c.Span)
+		manifest.Stats.add(c.Stats)
+		kvs = append(kvs, c.KVs...)
+	}
+	manifest.Digest = DigestKVs(kvs)
+	RecheckExportDescriptor(iter, chunks, &manifest)
+	if h.ExportDescriptors {
+		descs, err := ExportDescriptorHistory(
+			context.Background(), h.Engine, startTime, endTime, h.DescriptorFilter,
+		)
+		if err != nil {
+			return err
+		}
+		manifest.Descriptors = descs
+	}
+	h.Sink.PutManifest(manifest)
+	return nil
+}
+
+// RecheckExportDescriptor closes the iterator which completed an export, which
+// re-checks the generation of the range's descriptor, and records in the
+// manifest the generations at the start and the end of the export. The export
+// began when the iterator which exported its first chunk was opened, which
+// precedes the iterator which completed it if the export was restarted.
+func RecheckExportDescriptor(
+	iter *MVCCIncrementalIterator, chunks []ExportChunk, manifest *ExportManifest,
+) {
+	iter.Close()
+	opened, closed := iter.DescriptorGenerations()
+	manifest.StartDescriptorGeneration = opened
+	if len(chunks) > 0 {
+		manifest.StartDescriptorGeneration = chunks[0].DescriptorGeneration
+	}
+	manifest.EndDescriptorGeneration = closed
+	manifest.DescriptorChanged = manifest.StartDescriptorGeneration != closed
+}
+
+// DigestKVs returns a digest of the supplied key/values, including their
+// timestamps.
+func DigestKVs(kvs []engine.MVCCKeyValue) []byte {
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	for _, kv := range kvs {
+		hashKV(h, &buf, kv)
+	}
+	return h.Sum(nil)
+}
+
+// exportProgress returns the stats of the supplied exported key/values, of
+// which skippedVersions versions were skipped.
+func exportProgress(kvs []engine.MVCCKeyValue, skippedVersions int64) MVCCIncrementalIteratorProgress {
+	p := MVCCIncrementalIteratorProgress{
+		EmittedKeys:     int64(len(kvs)),
+		SkippedVersions: skippedVersions,
+	}
+	for _, kv := range kvs {
+		p.EmittedKeyBytes += int64(len(kv.Key.Key))
+		p.EmittedValueBytes += int64(len(kv.Value))
+		if len(kv.Value) == 0 {
+			p.EmittedDeletions++
+		}
+	}
+	return p
+}
+
+// ExpectedExportDigest computes, in a single uninterrupted pass, the digest an
+// export of the span between the supplied times should have.
+func ExpectedExportDigest(
+	e engine.Reader, span roachpb.Span, startTime, endTime hlc.Timestamp,
+) ([]byte, error) {
+	var kvs []engine.MVCCKeyValue
+	opts := MVCCIncrementalIteratorOptions{RetainKeyValues: true}
+	if err := IterateMVCCIncremental(context.Background(), e, span, startTime, endTime, opts,
+		func(kv engine.MVCCKeyValue) error {
+			kvs = append(kvs, kv)
+			return nil
+		},
+	); err != nil {
+		return nil, err
+	}
+	return DigestKVs(kvs), nil
+}
+
+// VerifyExportAdjacency checks that the chunks in the sink exactly tile the
+// supplied span, in order and without gaps or overlaps.
+func VerifyExportAdjacency(sink *FakeExportSink, span roachpb.Span) error {
+	next := span.Key
+	for i, c := range sink.Chunks() {
+		if !c.Span.Key.Equal(next) {
+			return errors.Errorf("chunk %d begins at %s; expected %s", i, c.Span.Key, next)
+		}
+		for _, kv := range c.KVs {
+			if kv.Key.Key.Compare(c.Span.Key) < 0 || kv.Key.Key.Compare(c.Span.EndKey) >= 0 {
+				return errors.Errorf("chunk %d with span %s contains key %s", i, c.Span, kv.Key)
+			}
+		}
+		next = c.Span.EndKey
+	}
+	if !next.Equal(span.EndKey) {
+		return errors.Errorf("chunks end at %s; expected %s", next, span.EndKey)
+	}
+	return nil
+}
+
+// VerifyExportDigest checks that the chunk digests and the digest of the last
+// manifest in the sink are consistent with the chunks' data and match the
+// expected digest.
+func VerifyExportDigest(sink *FakeExportSink, expected []byte) error {
+	manifests := sink.Manifests()
+	if len(manifests) == 0 {
+		return errors.New("no manifest was written")
+	}
+	var kvs []engine.MVCCKeyValue
+	for i, c := range sink.Chunks() {
+		if d := DigestKVs(c.KVs); !bytes.Equal(d, c.Digest) {
+			return errors.Errorf("chunk %d digest %x does not match its data (%x)", i, c.Digest, d)
+		}
+		kvs = append(kvs, c.KVs...)
+	}
+	manifest := manifests[len(manifests)-1]
+	if d := DigestKVs(kvs); !bytes.Equal(d, manifest.Digest) {
+		return errors.Errorf("manifest digest %x does not match chunk data (%x)", manifest.Digest, d)
+	}
+	if !bytes.Equal(manifest.Digest, expected) {
+		return errors.Errorf("manifest digest %x does not match expected digest %x",
+			manifest.Digest, expected)
+	}
+	return nil
+}
+
+// ExportTestDataKey returns the i'th key written by GenerateExportTestData.
+func ExportTestDataKey(i int) roachpb.Key {
+	return roachpb.Key(encoding.EncodeUvarintAscending([]byte("key-"), uint64(i)))
+}
+
+// GenerateExportTestData writes numKeys keys to the engine, each with between
+// one and maxVersions versions at distinct timestamps in [1, maxWallTime]. The
+// same seed always generates the same data.
+func GenerateExportTestData(
+	ctx context.Context, e engine.ReadWriter, seed int64, numKeys, maxVersions int, maxWallTime int64,
+) error {
+	if int64(maxVersions) > maxWallTime {
+		return errors.Errorf("cannot write %d versions in %d timestamps", maxVersions, maxWallTime)
+	}
+	rng := rand.New(rand.NewSource(seed))
+	for i := 0; i < numKeys; i++ {
+		key := ExportTestDataKey(i)
+		versions := 1 + rng.Intn(maxVersions)
+		// Pick distinct timestamps and write them in increasing order.
+		seen := make(map[int64]struct{}, versions)
+		var walls []int64
+		for len(walls) < versions {
+			wall := 1 + rng.Int63n(maxWallTime)
+			if _, ok := seen[wall]; ok {
+				continue
+			}
+			seen[wall] = struct{}{}
+			walls = append(walls, wall)
+		}
+		sort.Slice(walls, func(i, j int) bool { return walls[i] < walls[j] })
+		for _, wall := range walls {
+			value := roachpb.MakeValueFromString(fmt.Sprintf("value-%d-%d", i, wall))
+			ts := hlc.Timestamp{WallTime: wall}
+			if err := engine.MVCCPut(ctx, e, nil, key, ts, value, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package engineccl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+// TestExportTestHarness exercises an export which crashes after its third
+// chunk, is restarted, runs into an intent, and completes once the intent is
+// resolved.
+func TestExportTestHarness(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	const numKeys, chunkSize = 100, 10
+	if err := GenerateExportTestData(ctx, e, 1497033600, numKeys, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	span := roachpb.Span{Key: ExportTestDataKey(0), EndKey: ExportTestDataKey(numKeys)}
+	startTime, endTime := hlc.Timestamp{}, hlc.Timestamp{WallTime: 20}
+
+	// Write an intent in the eighth chunk.
+	intentKey := ExportTestDataKey(75)
+	txnID := uuid.MakeV4()
+	txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+		Key:       intentKey,
+		ID:        &txnID,
+		Epoch:     1,
+		Timestamp: hlc.Timestamp{WallTime: 15},
+	}}
+	if err := engine.MVCCPut(
+		ctx, e, nil, intentKey, txn.Timestamp, roachpb.MakeValueFromString("intent"), &txn,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &FakeExportSink{}
+	h := &ExportTestHarness{Engine: e, Sink: sink, ChunkSize: chunkSize, CrashAfterChunks: 3}
+
+	if err := h.Export(span, startTime, endTime); err != ErrSimulatedCrash {
+		t.Fatalf("expected simulated crash, got %v", err)
+	}
+	if n := len(sink.Chunks()); n != 3 {
+		t.Fatalf("expected 3 chunks after crash, got %d", n)
+	}
+
+	// The restarted export resumes after the third chunk, and stops at the
+	// intent, writing the data before it as a partial chunk.
+	err := h.Export(span, startTime, endTime)
+	if _, ok := errors.Cause(err).(*roachpb.WriteIntentError); !ok {
+		t.Fatalf("expected WriteIntentError, got %v", err)
+	}
+	chunks := sink.Chunks()
+	if n := len(chunks); n != 8 {
+		t.Fatalf("expected 8 chunks after intent collision, got %d", n)
+	}
+	if last := chunks[len(chunks)-1].Span.EndKey; !last.Equal(intentKey) {
+		t.Fatalf("expected the last chunk to end at the intent %s, got %s", intentKey, last)
+	}
+	if n := len(sink.Manifests()); n != 0 {
+		t.Fatalf("expected no manifest for an incomplete export, got %d", n)
+	}
+
+	intent := roachpb.Intent{Span: roachpb.Span{Key: intentKey}, Txn: txn.TxnMeta, Status: roachpb.COMMITTED}
+	if err := engine.MVCCResolveWriteIntent(ctx, e, nil, intent); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Export(span, startTime, endTime); err != nil {
+		t.Fatal(err)
+	}
+	// The partial chunk shifts the boundaries of the chunks which follow it.
+	if n := len(sink.Chunks()); n != numKeys/chunkSize+1 {
+		t.Fatalf("expected %d chunks, got %d", numKeys/chunkSize+1, n)
+	}
+	if n := len(sink.Manifests()); n != 1 {
+		t.Fatalf("expected 1 manifest, got %d", n)
+	}
+
+	if err := VerifyExportAdjacency(sink, span); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ExpectedExportDigest(e, span, startTime, endTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyExportDigest(sink, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stats of the manifest cover the data of every chunk, despite the
+	// restarts.
+	iter := NewMVCCIncrementalIterator(e, MVCCIncrementalIteratorOptions{
+		StartTime: startTime,
+		EndTime:   endTime,
+	})
+	defer iter.Close()
+	for iter.Reset(span.Key, span.EndKey); iter.Valid(); iter.Next() {
+	}
+	stats, err := iter.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestStats := sink.Manifests()[0].Stats
+	if a, e := manifestStats.EmittedKeys, stats.EmittedKeys; a != e {
+		t.Fatalf("expected %d keys in the manifest stats, got %d", e, a)
+	}
+	if a, e := manifestStats.EmittedValueBytes, stats.EmittedValueBytes; a != e {
+		t.Fatalf("expected %d value bytes in the manifest stats, got %d", e, a)
+	}
+}
+
+// TestExportTestHarnessIntentsAtEnd exercises an export of a large span which
+// runs into intents clustered at its end. The data before the intents is kept,
+// and only the conflicted tail is exported once the intents are resolved.
+func TestExportTestHarnessIntentsAtEnd(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	const numKeys, chunkSize = 1000, 100
+	if err := GenerateExportTestData(ctx, e, 1497033600, numKeys, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	span := roachpb.Span{Key: ExportTestDataKey(0), EndKey: ExportTestDataKey(numKeys)}
+	startTime, endTime := hlc.Timestamp{}, hlc.Timestamp{WallTime: 20}
+
+	var intents []roachpb.Intent
+	for _, i := range []int{990, 995, 999} {
+		key := ExportTestDataKey(i)
+		txnID := uuid.MakeV4()
+		txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+			Key:       key,
+			ID:        &txnID,
+			Epoch:     1,
+			Timestamp: hlc.Timestamp{WallTime: 15},
+		}}
+		if err := engine.MVCCPut(
+			ctx, e, nil, key, txn.Timestamp, roachpb.MakeValueFromString("intent"), &txn,
+		); err != nil {
+			t.Fatal(err)
+		}
+		intents = append(intents, roachpb.Intent{
+			Span: roachpb.Span{Key: key}, Txn: txn.TxnMeta, Status: roachpb.COMMITTED,
+		})
+	}
+
+	sink := &FakeExportSink{}
+	h := &ExportTestHarness{Engine: e, Sink: sink, ChunkSize: chunkSize}
+
+	err := h.Export(span, startTime, endTime)
+	conflict, ok := err.(*IntentConflictError)
+	if !ok {
+		t.Fatalf("expected IntentConflictError, got %v", err)
+	}
+	if n := len(conflict.Intents); n != len(intents) {
+		t.Fatalf("expected %d intents, got %d", len(intents), n)
+	}
+	expectedSpan := roachpb.Span{Key: ExportTestDataKey(990), EndKey: ExportTestDataKey(999).Next()}
+	if !conflict.ConflictSpan.Equal(expectedSpan) {
+		t.Fatalf("expected conflict span %s, got %s", expectedSpan, conflict.ConflictSpan)
+	}
+	// Nine full chunks and a partial chunk ending at the first intent.
+	chunks := sink.Chunks()
+	if n := len(chunks); n != 10 {
+		t.Fatalf("expected 10 chunks, got %d", n)
+	}
+	if last := chunks[len(chunks)-1].Span.EndKey; !last.Equal(conflict.ResumeKey) {
+		t.Fatalf("expected the last chunk to end at the resume key %s, got %s", conflict.ResumeKey, last)
+	}
+
+	for _, intent := range intents {
+		if err := engine.MVCCResolveWriteIntent(ctx, e, nil, intent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Export(span, startTime, endTime); err != nil {
+		t.Fatal(err)
+	}
+	// Only the conflicted tail was exported again, as a single chunk.
+	chunks = sink.Chunks()
+	if n := len(chunks); n != 11 {
+		t.Fatalf("expected 11 chunks, got %d", n)
+	}
+	if len(chunks[10].KVs) == 0 {
+		t.Fatal("expected the final chunk to contain the resolved intents")
+	}
+	if err := VerifyExportAdjacency(sink, span); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ExpectedExportDigest(e, span, startTime, endTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyExportDigest(sink, expected); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestExportTestHarnessDescriptorChanged verifies that the manifest of an
+// export records whether the range's descriptor changed while it ran,
+// including across a restart of the export.
+func TestExportTestHarnessDescriptorChanged(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	const numKeys, chunkSize = 100, 10
+	if err := GenerateExportTestData(ctx, e, 1497033600, numKeys, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	span := roachpb.Span{Key: ExportTestDataKey(0), EndKey: ExportTestDataKey(numKeys)}
+	startTime, endTime := hlc.Timestamp{}, hlc.Timestamp{WallTime: 20}
+
+	testCases := []struct {
+		name string
+		// splitDuringScan bumps the generation once the iterator is opened.
+		splitDuringScan bool
+		// splitAfterCrash bumps the generation before the export is
+		// restarted after a simulated crash.
+		splitAfterCrash bool
+		changed         bool
+	}{
+		{name: "unchanged"},
+		{name: "during scan", splitDuringScan: true, changed: true},
+		{name: "after crash", splitAfterCrash: true, changed: true},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			generation := int64(1)
+			sink := &FakeExportSink{}
+			h := &ExportTestHarness{
+				Engine:    e,
+				Sink:      sink,
+				ChunkSize: chunkSize,
+				DescriptorGeneration: func() int64 {
+					g := generation
+					if c.splitDuringScan {
+						generation = 2
+					}
+					return g
+				},
+			}
+			if c.splitAfterCrash {
+				h.CrashAfterChunks = 3
+				if err := h.Export(span, startTime, endTime); err != ErrSimulatedCrash {
+					t.Fatalf("expected simulated crash, got %v", err)
+				}
+				generation = 2
+			}
+			if err := h.Export(span, startTime, endTime); err != nil {
+				t.Fatal(err)
+			}
+
+			m := sink.Manifests()[0]
+			if m.StartDescriptorGeneration != 1 {
+				t.Errorf("expected start generation 1, got %d", m.StartDescriptorGeneration)
+			}
+			if e := generation; m.EndDescriptorGeneration != e {
+				t.Errorf("expected end generation %d, got %d", e, m.EndDescriptorGeneration)
+			}
+			if m.DescriptorChanged != c.changed {
+				t.Errorf("expected descriptor changed %t, got %t", c.changed, m.DescriptorChanged)
+			}
+		})
+	}
+}
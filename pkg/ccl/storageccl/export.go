@@ -9,10 +9,14 @@
 package storageccl
 
 import (
+	"bytes"
 	"crypto/sha512"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 
 	"golang.org/x/net/context"
 
@@ -23,21 +27,22 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/pkg/errors"
 )
 
-// ExportRequestLimit is the number of Export requests that can run at once.
-// Each extracts data from RocksDB to a temp file and then uploads it to cloud
-// storage. In order to not exhaust the disk or memory, or saturate the network,
-// limit the number of these that can be run in parallel. This number was chosen
-// by a guess. If SST files are likely to not be over 200MB, then 5 parallel
-// workers hopefully won't use more than 1GB of space in the temp directory. It
-// could be improved by more measured heuristics.
+// ExportRequestLimit is the default number of Export requests that each store
+// runs at once; see kv.export.max_concurrent. This number was chosen by a
+// guess. If SST files are likely to not be over 200MB, then 5 parallel workers
+// hopefully won't use more than 1GB of space in the temp directory. It could
+// be improved by more measured heuristics.
 const ExportRequestLimit = 5
 
-var exportRequestLimiter = makeConcurrentRequestLimiter(ExportRequestLimit)
+// exportBackgroundOperation is the purpose of the background operations
+// registered by exports.
+const exportBackgroundOperation = "export"
 
 func init() {
 	storage.SetExportCmd(storage.Command{
@@ -54,7 +59,8 @@ func declareKeysExport(
 }
 
 // evalExport dumps the requested keys into files of non-overlapping key ranges
-// in a format suitable for bulk ingest.
+// in a format suitable for bulk ingest. A file whose keys fall on both sides of
+// a copied sstable is listed once for each of the key ranges between them.
 func evalExport(
 	ctx context.Context, batch engine.ReadWriter, cArgs storage.CommandArgs, resp roachpb.Response,
 ) (storage.EvalResult, error) {
@@ -80,10 +86,12 @@ func evalExport(
 		}
 	}
 
-	if err := exportRequestLimiter.beginLimitedRequest(ctx); err != nil {
+	limiter := storeExportLimiter(cArgs)
+	endLimited, err := limiter.begin(ctx, cArgs.EvalCtx.StoreID())
+	if err != nil {
 		return storage.EvalResult{}, err
 	}
-	defer exportRequestLimiter.endLimitedRequest()
+	defer endLimited()
 	log.Infof(ctx, "export [%s,%s)", args.Key, args.EndKey)
 
 	exportStore, err := MakeExportStorage(ctx, args.Storage)
@@ -115,33 +123,129 @@ func evalExport(
 
 	// TODO(dan): Move all this iteration into cpp to avoid the cgo calls.
 	// TODO(dan): Consider checking ctx periodically during the MVCCIterate call.
-	iter := engineccl.NewMVCCIncrementalIterator(batch, args.StartTime, h.Timestamp)
+	iter := engineccl.NewMVCCIncrementalIterator(batch, engineccl.MVCCIncrementalIteratorOptions{
+		StartTime: args.StartTime,
+		EndTime:   h.Timestamp,
+		// An intent which is aborted while it is being exported contributes
+		// nothing, so there's no need to fail the export and retry.
+		SkipAbortedIntents: true,
+		GCThreshold:        gcThreshold,
+		Metrics:            iteratorMetrics(cArgs),
+		Engine:             cArgs.EvalCtx.Engine(),
+		AuditStopper:       cArgs.EvalCtx.Stopper(),
+		AuditSem:           auditSem(cArgs),
+	})
 	defer iter.Close()
-	for iter.Reset(args.Key, args.EndKey); iter.Valid(); iter.Next() {
-		if log.V(3) {
-			v := roachpb.Value{RawBytes: iter.UnsafeValue()}
-			log.Infof(ctx, "Export %s %s", iter.UnsafeKey(), v.PrettyPrint())
+	if err := iter.Error(); err != nil {
+		return storage.EvalResult{}, err
+	}
+
+	// The progress of the export is listed with the store's background
+	// operations while it runs.
+	var exported exportedData
+	finish := cArgs.EvalCtx.StartBackgroundOperation(ctx, storage.BackgroundOperation{
+		Purpose:   exportBackgroundOperation,
+		Owner:     fmt.Sprintf("export to %s", args.Storage.Provider),
+		Span:      args.Span,
+		StartTime: args.StartTime,
+		EndTime:   h.Timestamp,
+	}, func() string {
+		return fmt.Sprintf("exported %d keys (%s)", atomic.LoadInt64(&exported.keys),
+			humanizeutil.IBytes(atomic.LoadInt64(&exported.bytes)))
+	})
+	defer finish()
+
+	// The sstables which the export covers entirely are copied to files of
+	// their own where possible, and the keys between them are iterated over.
+	files := []roachpb.ExportResponse_File{}
+	covered, err := iter.CoveredSSTables(args.Key, args.EndKey)
+	if err != nil {
+		return storage.EvalResult{}, err
+	}
+	var copiedFrom []engine.SSTableInfo
+	for _, t := range covered {
+		name := fmt.Sprintf("%d.sst", parser.GenerateUniqueInt(cArgs.EvalCtx.NodeID()))
+		file, ok, err := exportSSTable(ctx, exportStore, cArgs.EvalCtx.GetTempPrefix(), name, t)
+		if err != nil {
+			return storage.EvalResult{}, err
+		}
+		if !ok {
+			continue
 		}
-		if err := sst.Add(engine.MVCCKeyValue{Key: iter.UnsafeKey(), Value: iter.UnsafeValue()}); err != nil {
-			return storage.EvalResult{}, errors.Wrapf(err, "adding key %s", iter.UnsafeKey())
+		// The copy isn't paced as it's made, but it's accounted for.
+		if err := limiter.pace(ctx, file.DataSize, true /* wait */); err != nil {
+			return storage.EvalResult{}, err
 		}
+		log.VEventf(ctx, 2, "copied sstable %s to %s", t.Path, file.Path)
+		files = append(files, file)
+		copiedFrom = append(copiedFrom, t)
+		atomic.AddInt64(&exported.bytes, file.DataSize)
 	}
-	if err := iter.Error(); err != nil {
-		// The error may be a WriteIntentError. In which case, returning it will
-		// cause this command to be retried.
-		return storage.EvalResult{}, err
+	// The coverage is computed from the live sstables of the engine rather
+	// than from the reader of the iteration, so a flush or compaction while
+	// the sstables were copied could make the export mix data from different
+	// points in time. The copies are checked against the coverage once they
+	// are made, and the spans of those whose sstables no longer cover them are
+	// iterated over instead.
+	if len(files) > 0 {
+		recovered, err := iter.CoveredSSTables(args.Key, args.EndKey)
+		if err != nil {
+			return storage.EvalResult{}, err
+		}
+		var dropped []roachpb.ExportResponse_File
+		files, dropped = stillCoveredCopies(files, copiedFrom, recovered)
+		for _, file := range dropped {
+			log.VEventf(ctx, 2, "sstable copied to %s changed while it was copied; "+
+				"iterating over %s instead", file.Path, file.Span)
+			atomic.AddInt64(&exported.bytes, -file.DataSize)
+			if err := exportStore.Delete(ctx, file.Path); err != nil {
+				log.Warningf(ctx, "could not delete stale copy %s: %+v", file.Path, err)
+			}
+		}
+	}
+	var copied []roachpb.Span
+	for _, file := range files {
+		copied = append(copied, file.Span)
+	}
+
+	// The bytes the iteration reads are paced with the store's rate limit as
+	// they're read, rather than per request.
+	pacer := exportPacer{limiter: limiter, iter: iter}
+	defer pacer.finish(ctx)
+	// The spans between the copied files are iterated over in turn, and the
+	// main file is reported under those which hold any of its keys, along with
+	// the size of those keys, so that the spans of the files don't overlap.
+	var mainFiles []roachpb.ExportResponse_File
+	var stats engineccl.MVCCIncrementalIteratorStats
+	for _, gap := range uncoveredSpans(args.Span, copied) {
+		before := atomic.LoadInt64(&exported.bytes)
+		_, gapStats, err := exportKeys(
+			ctx, iter, gap, &sst, 0 /* maxSize */, pacer.maybePace, &exported,
+		)
+		if err != nil {
+			return storage.EvalResult{}, err
+		}
+		if size := atomic.LoadInt64(&exported.bytes) - before; size > 0 {
+			mainFiles = append(mainFiles, roachpb.ExportResponse_File{Span: gap, DataSize: size})
+		}
+		stats.EmittedKeys += gapStats.EmittedKeys
+		stats.SkippedVersions += gapStats.SkippedVersions
+		stats.AbortedIntents += gapStats.AbortedIntents
+		stats.MaxTimestamp.Forward(gapStats.MaxTimestamp)
 	}
+	log.VEventf(ctx, 2, "exported %d keys (skipped %d versions, %d aborted intents) and "+
+		"copied %d sstables, max timestamp %s", stats.EmittedKeys, stats.SkippedVersions,
+		stats.AbortedIntents, len(copied), stats.MaxTimestamp)
 
 	if sst.DataSize == 0 {
 		// Let the defer Close the sstable.
-		reply.Files = []roachpb.ExportResponse_File{}
+		reply.Files = files
 		return storage.EvalResult{}, nil
 	}
 
 	if err := sst.Close(); err != nil {
 		return storage.EvalResult{}, err
 	}
-	size := sst.DataSize
 
 	// Compute the checksum before we upload and remove the local file.
 	checksum, err := sha512ChecksumFile(localPath)
@@ -153,16 +257,303 @@ func evalExport(
 		return storage.EvalResult{}, err
 	}
 
-	reply.Files = []roachpb.ExportResponse_File{{
-		Span:     args.Span,
-		Path:     filename,
-		DataSize: size,
-		Sha512:   checksum,
-	}}
+	for _, file := range mainFiles {
+		file.Path = filename
+		file.Sha512 = checksum
+		files = append(files, file)
+	}
+	reply.Files = files
 
 	return storage.EvalResult{}, nil
 }
 
+// stillCoveredCopies splits the files copied from the sstables in copiedFrom,
+// which are parallel to them, into those whose sstables are among the covered
+// sstables, which still hold exactly the data of their spans, and the others.
+func stillCoveredCopies(
+	files []roachpb.ExportResponse_File, copiedFrom, covered []engine.SSTableInfo,
+) (kept, dropped []roachpb.ExportResponse_File) {
+	live := make(map[string]struct{}, len(covered))
+	for _, t := range covered {
+		live[t.Path] = struct{}{}
+	}
+	for j, file := range files {
+		if _, ok := live[copiedFrom[j].Path]; ok {
+			kept = append(kept, file)
+		} else {
+			dropped = append(dropped, file)
+		}
+	}
+	return kept, dropped
+}
+
+// uncoveredSpans returns the parts of the span which are not covered by the
+// sorted, non-overlapping spans within it, in key order.
+func uncoveredSpans(span roachpb.Span, covered []roachpb.Span) []roachpb.Span {
+	var spans []roachpb.Span
+	start := span.Key
+	for _, c := range covered {
+		if start.Compare(c.Key) < 0 {
+			spans = append(spans, roachpb.Span{Key: start, EndKey: c.Key})
+		}
+		start = c.EndKey
+	}
+	if start.Compare(span.EndKey) < 0 {
+		spans = append(spans, roachpb.Span{Key: start, EndKey: span.EndKey})
+	}
+	return spans
+}
+
+// exportSSTable copies a live sstable, which an export covers entirely, to
+// the named file of its own. It returns false if the sstable can't be copied,
+// in which case its keys must be iterated over instead: only an ingested
+// sstable in the format of the files exports write can be, as the sstables the
+// engine writes itself have sequence numbers and a newer table format.
+func exportSSTable(
+	ctx context.Context,
+	exportStore ExportStorage,
+	tempPrefix, filename string,
+	t engine.SSTableInfo,
+) (roachpb.ExportResponse_File, bool, error) {
+	if t.ExternalVersion == 0 || t.FormatVersion != engine.SstFileWriterFormatVersion {
+		return roachpb.ExportResponse_File{}, false, nil
+	}
+	// Once open, the sstable remains readable even if it is compacted away.
+	// If it already has been, its keys are now in other sstables.
+	in, err := os.Open(t.Path)
+	if os.IsNotExist(err) {
+		return roachpb.ExportResponse_File{}, false, nil
+	} else if err != nil {
+		return roachpb.ExportResponse_File{}, false, err
+	}
+	defer in.Close()
+
+	temp, err := MakeExportFileTmpWriter(ctx, tempPrefix, exportStore, filename)
+	if err != nil {
+		return roachpb.ExportResponse_File{}, false, err
+	}
+	defer temp.Close(ctx)
+
+	out, err := os.OpenFile(temp.LocalFile(), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return roachpb.ExportResponse_File{}, false, err
+	}
+	h := sha512.New()
+	size, err := io.Copy(io.MultiWriter(out, h), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return roachpb.ExportResponse_File{}, false, errors.Wrapf(err, "copying sstable %s", t.Path)
+	}
+	if err := temp.Finish(ctx); err != nil {
+		return roachpb.ExportResponse_File{}, false, err
+	}
+
+	return roachpb.ExportResponse_File{
+		Span: roachpb.Span{Key: t.Start.Key, EndKey: t.End.Key.Next()},
+		Path: filename,
+		// The sizes of the keys and values aren't known without iterating
+		// over them, so the size of the file stands in for them.
+		DataSize: size,
+		Sha512:   h.Sum(nil),
+	}, true, nil
+}
+
+// exportedData counts the key/values added to an export's sstable. Its fields
+// are updated atomically, so that they may be read while the export runs.
+type exportedData struct {
+	keys, bytes int64
+}
+
+// exportKeys adds the key/values emitted by an iteration over the span to the
+// sstable, counting them in exported. If maxSize is positive, the iteration
+// stops at the first key after the exported bytes reach it, which is returned;
+// the versions of a key are never split between sstables. If pace is set, it
+// is called before each key/value is added. An intent conflict is returned as
+// a WriteIntentError, which causes the intents to be resolved and the export
+// to be retried.
+func exportKeys(
+	ctx context.Context,
+	iter *engineccl.MVCCIncrementalIterator,
+	span roachpb.Span,
+	sst *engine.RocksDBSstFileWriter,
+	maxSize int64,
+	pace func(context.Context) error,
+	exported *exportedData,
+) (resumeKey roachpb.Key, _ engineccl.MVCCIncrementalIteratorStats, _ error) {
+	var lastKey roachpb.Key
+	for iter.Reset(span.Key, span.EndKey); ; iter.Next() {
+		// The error of a failed iteration is handled with Finish, below.
+		if ok, _ := iter.ValidWithErr(); !ok {
+			break
+		}
+		key := iter.UnsafeKey()
+		if maxSize > 0 && !key.Key.Equal(lastKey) {
+			if atomic.LoadInt64(&exported.bytes) >= maxSize {
+				// A truncated export leaves the iteration incomplete, but any
+				// error it encountered was returned before the key at which it
+				// stopped.
+				return append(roachpb.Key(nil), key.Key...), engineccl.MVCCIncrementalIteratorStats{}, nil
+			}
+			lastKey = append(lastKey[:0], key.Key...)
+		}
+		if pace != nil {
+			if err := pace(ctx); err != nil {
+				return nil, engineccl.MVCCIncrementalIteratorStats{}, err
+			}
+		}
+		if log.V(3) {
+			v := roachpb.Value{RawBytes: iter.UnsafeValue()}
+			log.Infof(ctx, "Export %s %s", key, v.PrettyPrint())
+		}
+		if err := sst.Add(engine.MVCCKeyValue{Key: key, Value: iter.UnsafeValue()}); err != nil {
+			return nil, engineccl.MVCCIncrementalIteratorStats{}, errors.Wrapf(err, "adding key %s", key)
+		}
+		atomic.AddInt64(&exported.keys, 1)
+		atomic.AddInt64(&exported.bytes, int64(key.EncodedSize()+len(iter.UnsafeValue())))
+	}
+	stats, err := iter.Finish()
+	if err != nil {
+		if conflict, ok := err.(*engineccl.IntentConflictError); ok {
+			// Returning the intents as a WriteIntentError causes them to be
+			// resolved and the export to be retried. All of the intents in the
+			// span are included, so they are resolved together.
+			log.VEventf(ctx, 2, "%s", conflict)
+			return nil, engineccl.MVCCIncrementalIteratorStats{}, conflict.Cause()
+		}
+		return nil, engineccl.MVCCIncrementalIteratorStats{}, err
+	}
+	return nil, stats, nil
+}
+
+// ExportToSst writes all of the versions of the keys in the span which were
+// written in [startTime, endTime), as defined by hlc.TimestampWindow, to an
+// sstable, and returns its contents
+// along with an ExportMeta describing them. The sstable is built in a
+// temporary file under tempPrefix. If maxSize is positive, the export stops at
+// the first key after the data size of the sstable reaches it, which is then
+// the ResumeKey of the returned ExportMeta; the versions of a key are never
+// split between sstables. If there is nothing to export, the returned sstable
+// is nil.
+func ExportToSst(
+	ctx context.Context,
+	e engine.Reader,
+	tempPrefix string,
+	span roachpb.Span,
+	startTime, endTime hlc.Timestamp,
+	maxSize int64,
+) ([]byte, ExportMeta, error) {
+	meta := ExportMeta{Span: span, StartTime: startTime, EndTime: endTime}
+
+	dir, err := ioutil.TempDir(tempPrefix, "export")
+	if err != nil {
+		return nil, ExportMeta{}, err
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warningf(ctx, "could not remove temp dir %s: %+v", dir, err)
+		}
+	}()
+	path := filepath.Join(dir, "data.sst")
+
+	sst := engine.MakeRocksDBSstFileWriter()
+	if err := sst.Open(path); err != nil {
+		return nil, ExportMeta{}, err
+	}
+	defer func() {
+		// See the comment on the same in evalExport.
+		if err := sst.Close(); sst.DataSize > 0 && err != nil {
+			log.Warningf(ctx, "could not close sst writer %s: %+v", path, err)
+		}
+	}()
+
+	iter := engineccl.NewMVCCIncrementalIterator(e, engineccl.MVCCIncrementalIteratorOptions{
+		StartTime:   startTime,
+		EndTime:     endTime,
+		AllVersions: true,
+	})
+	defer iter.Close()
+	if err := iter.Error(); err != nil {
+		return nil, ExportMeta{}, err
+	}
+	var exported exportedData
+	resumeKey, _, err := exportKeys(ctx, iter, span, &sst, maxSize, nil /* pace */, &exported)
+	if err != nil {
+		return nil, ExportMeta{}, err
+	}
+	meta.KVCount, meta.DataSize = exported.keys, exported.bytes
+	if resumeKey != nil {
+		meta.ResumeKey = resumeKey
+		meta.Span.EndKey = resumeKey
+	}
+
+	if meta.KVCount == 0 {
+		// Empty sstables are not allowed; let the defer Close the writer.
+		return nil, meta, nil
+	}
+	if err := sst.Close(); err != nil {
+		return nil, ExportMeta{}, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, ExportMeta{}, err
+	}
+	if meta.Sha512, err = sha512ChecksumData(data); err != nil {
+		return nil, ExportMeta{}, err
+	}
+	return data, meta, nil
+}
+
+// VerifyExport checks that an sstable written by ExportToSst matches the
+// ExportMeta describing it: its checksum, the number and size of its
+// key/values, and that each of them is within the span and time range of the
+// export.
+func VerifyExport(sstBytes []byte, meta ExportMeta) error {
+	if len(sstBytes) == 0 {
+		if meta.KVCount != 0 || len(meta.Sha512) > 0 {
+			return errors.Errorf("export of %d keys is missing its sstable", meta.KVCount)
+		}
+		return nil
+	}
+	checksum, err := sha512ChecksumData(sstBytes)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(checksum, meta.Sha512) {
+		return errors.Errorf("checksum mismatch: sstable has %x, expected %x", checksum, meta.Sha512)
+	}
+
+	sst := engine.MakeRocksDBSstFileReader()
+	defer sst.Close()
+	if err := sst.IngestExternalFile(sstBytes); err != nil {
+		return err
+	}
+	var count, size int64
+	start, end := engine.MVCCKey{Key: keys.MinKey}, engine.MVCCKey{Key: keys.MaxKey}
+	window := hlc.TimestampWindow{Start: meta.StartTime, End: meta.EndTime}
+	if err := sst.Iterate(start, end, func(kv engine.MVCCKeyValue) (bool, error) {
+		if !meta.Span.Contains(roachpb.Span{Key: kv.Key.Key}) {
+			return false, errors.Errorf("key %s is outside of span %s", kv.Key, meta.Span)
+		}
+		if !window.Contains(kv.Key.Timestamp) {
+			return false, errors.Errorf("key %s is outside of time range %s", kv.Key, window)
+		}
+		count++
+		size += int64(kv.Key.EncodedSize() + len(kv.Value))
+		return false, nil
+	}); err != nil {
+		return err
+	}
+	if count != meta.KVCount {
+		return errors.Errorf("sstable has %d keys, expected %d", count, meta.KVCount)
+	}
+	if size != meta.DataSize {
+		return errors.Errorf("sstable has %d bytes of data, expected %d", size, meta.DataSize)
+	}
+	return nil
+}
+
 func sha512ChecksumData(data []byte) ([]byte, error) {
 	h := sha512.New()
 	if _, err := h.Write(data); err != nil {
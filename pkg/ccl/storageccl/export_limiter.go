@@ -0,0 +1,275 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package storageccl
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"github.com/cockroachdb/cockroach/pkg/ccl/storageccl/engineccl"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// exportMaxConcurrent is the number of export requests each store evaluates
+// at once. Each extracts data from RocksDB to a temp file and then uploads it
+// to cloud storage, so in order to not exhaust the disk or memory, or
+// saturate the network, the number which run in parallel is limited.
+var exportMaxConcurrent = settings.RegisterIntSetting(
+	"kv.export.max_concurrent",
+	"maximum number of export requests evaluated at once by each store (0 disables the limit)",
+	ExportRequestLimit,
+)
+
+// exportMaxRate is the rate at which the export requests of each store, taken
+// together, read data.
+var exportMaxRate = settings.RegisterByteSizeSetting(
+	"kv.export.max_rate",
+	"maximum number of bytes per second read by the export requests of each store "+
+		"(0 disables the limit)",
+	0,
+)
+
+// exportQueueTimeout is the time for which an export request waits for the
+// store to evaluate it before failing with an ExportThrottledError.
+var exportQueueTimeout = settings.RegisterNonNegativeDurationSetting(
+	"kv.export.queue_timeout",
+	"time for which an export request waits for the limit on concurrent exports "+
+		"before failing, so that it can be retried elsewhere",
+	time.Minute,
+)
+
+const (
+	// exportPaceBytes is the number of bytes an export reads between two
+	// waits on the rate limit, which smooths its reads without waiting for
+	// each key.
+	exportPaceBytes = 64 << 10
+	// exportRateBurst is the burst of the rate limit. It must be at least
+	// exportPaceBytes.
+	exportRateBurst = 1 << 20
+)
+
+// exportThrottledPrefix begins the message of every ExportThrottledError.
+const exportThrottledPrefix = "export throttled"
+
+// ExportThrottledError is returned by an export request which waited for the
+// store's limit on concurrent exports until its deadline: the earlier of its
+// context's deadline and kv.export.queue_timeout. The export read nothing, so
+// it can be retried, preferably against another replica.
+type ExportThrottledError struct {
+	StoreID roachpb.StoreID
+	// Waited is the time the request waited, and Limit the number of
+	// concurrent exports it waited for.
+	Waited time.Duration
+	Limit  int64
+}
+
+func (e *ExportThrottledError) Error() string {
+	return fmt.Sprintf("%s: waited %s for s%d to run fewer than %d exports",
+		exportThrottledPrefix, e.Waited, e.StoreID, e.Limit)
+}
+
+// IsExportThrottledError returns true if the error is an ExportThrottledError.
+// An error returned by an export request evaluated on another node has lost
+// its type, so it's recognized by its message instead.
+func IsExportThrottledError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := errors.Cause(err).(*ExportThrottledError); ok {
+		return true
+	}
+	return strings.HasPrefix(err.Error(), exportThrottledPrefix)
+}
+
+// exportLimiter is the admission control of the export requests of a store: it
+// bounds the number evaluated at once, which queue up to a deadline for their
+// turn, and the rate at which they read data, which they account for as they
+// read it. The limits are read from the cluster settings each time they are
+// applied, so that changes apply to the exports which follow.
+type exportLimiter struct {
+	waiting   *metric.Gauge
+	throttled *metric.Counter
+	bytes     *rate.Limiter
+
+	mu struct {
+		syncutil.Mutex
+		running int64
+		// released is closed, and replaced, when an export finishes.
+		released chan struct{}
+	}
+}
+
+// sharedExportLimiter limits the exports evaluated without a store's limiter.
+// See storeExportLimiter.
+var sharedExportLimiter = newExportLimiter(
+	metric.NewGauge(metaExportsWaiting), metric.NewCounter(metaExportsThrottled),
+)
+
+func newExportLimiter(waiting *metric.Gauge, throttled *metric.Counter) *exportLimiter {
+	l := &exportLimiter{
+		waiting:   waiting,
+		throttled: throttled,
+		bytes:     rate.NewLimiter(rate.Inf, exportRateBurst),
+	}
+	l.mu.released = make(chan struct{})
+	return l
+}
+
+// begin waits for the store to run fewer exports than exportMaxConcurrent,
+// for at most exportQueueTimeout, and returns the function to call once the
+// export finishes; it may be called more than once. If the export's turn
+// doesn't come in time, an *ExportThrottledError is returned, and the
+// context's error if it is done first. The expiry of the context's deadline
+// also results in an *ExportThrottledError, as the export was throttled
+// rather than abandoned.
+func (l *exportLimiter) begin(ctx context.Context, storeID roachpb.StoreID) (func(), error) {
+	release, released, limit := l.tryBegin()
+	if release != nil {
+		return release, nil
+	}
+
+	// If not, start a span and begin waiting.
+	ctx, span := tracing.ChildSpan(ctx, "export limiter")
+	defer tracing.FinishSpan(span)
+	l.waiting.Inc(1)
+	defer l.waiting.Dec(1)
+	start := timeutil.Now()
+	var timer timeutil.Timer
+	defer timer.Stop()
+	timer.Reset(exportQueueTimeout.Get())
+	for {
+		select {
+		case <-released:
+		case <-timer.C:
+			timer.Read = true
+			return nil, l.throttledError(storeID, start, limit)
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, l.throttledError(storeID, start, limit)
+			}
+			return nil, ctx.Err()
+		}
+		if release, released, limit = l.tryBegin(); release != nil {
+			return release, nil
+		}
+	}
+}
+
+// tryBegin begins an export if the store runs fewer than exportMaxConcurrent,
+// returning the function to call once it finishes. Otherwise, it returns the
+// channel which is closed once an export finishes, and the limit.
+func (l *exportLimiter) tryBegin() (release func(), released <-chan struct{}, limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit = exportMaxConcurrent.Get()
+	if limit > 0 && l.mu.running >= limit {
+		return nil, l.mu.released, limit
+	}
+	l.mu.running++
+	var once sync.Once
+	return func() { once.Do(l.end) }, nil, limit
+}
+
+func (l *exportLimiter) throttledError(
+	storeID roachpb.StoreID, start time.Time, limit int64,
+) error {
+	l.throttled.Inc(1)
+	return &ExportThrottledError{StoreID: storeID, Waited: timeutil.Since(start), Limit: limit}
+}
+
+func (l *exportLimiter) end() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mu.running--
+	close(l.mu.released)
+	l.mu.released = make(chan struct{})
+}
+
+// updateRate sets the rate limit from exportMaxRate, and returns false if
+// there is none.
+func (l *exportLimiter) updateRate() bool {
+	limit := rate.Inf
+	if r := exportMaxRate.Get(); r > 0 {
+		limit = rate.Limit(r)
+	}
+	if l.bytes.Limit() != limit {
+		l.bytes.SetLimit(limit)
+	}
+	return limit != rate.Inf
+}
+
+// pace waits for the rate limit to allow the reading of n bytes, which may
+// already have been read. If wait is false, the bytes are accounted for
+// without waiting, and the reads which follow wait for them instead.
+func (l *exportLimiter) pace(ctx context.Context, n int64, wait bool) error {
+	if !l.updateRate() {
+		return nil
+	}
+	for n > 0 {
+		// The limiter doesn't allow more than its burst at once.
+		chunk := n
+		if chunk > exportRateBurst {
+			chunk = exportRateBurst
+		}
+		if !wait {
+			l.bytes.ReserveN(timeutil.Now(), int(chunk))
+		} else if err := l.bytes.WaitN(ctx, int(chunk)); err != nil {
+			return errors.Wrap(err, "pacing export")
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// exportPacer accounts for the bytes read by an export's iteration, from the
+// progress of its iterator, and paces the iteration with the store's rate
+// limit every exportPaceBytes.
+type exportPacer struct {
+	limiter *exportLimiter
+	iter    *engineccl.MVCCIncrementalIterator
+	// paced is the number of bytes read by the iteration which were paced.
+	paced int64
+}
+
+// readBytes returns the number of key and value bytes the iteration read.
+func (p *exportPacer) readBytes() int64 {
+	progress := p.iter.Progress()
+	return progress.EmittedKeyBytes + progress.EmittedValueBytes
+}
+
+// maybePace paces the bytes read since the last pace, if there are at least
+// exportPaceBytes of them.
+func (p *exportPacer) maybePace(ctx context.Context) error {
+	if read := p.readBytes(); read-p.paced >= exportPaceBytes {
+		if err := p.limiter.pace(ctx, read-p.paced, true /* wait */); err != nil {
+			return err
+		}
+		p.paced = read
+	}
+	return nil
+}
+
+// finish accounts for the bytes read since the last pace without waiting: the
+// exports which follow wait for them instead.
+func (p *exportPacer) finish(ctx context.Context) {
+	read := p.readBytes()
+	_ = p.limiter.pace(ctx, read-p.paced, false /* wait */)
+	p.paced = read
+}
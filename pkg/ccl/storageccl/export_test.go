@@ -9,23 +9,35 @@
 package storageccl
 
 import (
+	"bytes"
 	"io/ioutil"
 	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/ccl/storageccl/engineccl"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
 
 func TestExport(t *testing.T) {
@@ -142,3 +154,661 @@ func TestExportGCThreshold(t *testing.T) {
 		t.Fatalf(`expected "must be after replica GC threshold" error got: %+v`, pErr)
 	}
 }
+
+// TestExportBackgroundOperations checks that an export and a concurrent time
+// series prune are listed as background operations of the store while they
+// run, and are gone once they complete.
+func TestExportBackgroundOperations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	// The first export and the first forced time series maintenance block
+	// once they are registered, until they are released.
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var blockedExport, blockedPrune int32
+	knobs := base.TestingKnobs{Store: &storage.StoreTestingKnobs{
+		BackgroundOperationStarted: func(op storage.BackgroundOperation) {
+			var blocked *int32
+			switch op.Purpose {
+			case exportBackgroundOperation:
+				blocked = &blockedExport
+			case storage.BackgroundOperationForcedTimeSeriesMaintenance:
+				blocked = &blockedPrune
+			default:
+				return
+			}
+			if atomic.CompareAndSwapInt32(blocked, 0, 1) {
+				started <- struct{}{}
+				<-release
+			}
+		},
+	}}
+	tc := testcluster.StartTestCluster(t, 1, base.TestClusterArgs{
+		ServerArgs: base.TestServerArgs{Knobs: knobs},
+	})
+	defer tc.Stopper().Stop(ctx)
+	kvDB := tc.Server(0).KVClient().(*client.DB)
+	store, err := tc.Servers[0].Stores().GetStore(tc.Servers[0].GetFirstStoreID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exportSpan := roachpb.Span{Key: keys.UserTableDataMin, EndKey: keys.MaxKey}
+	exportStart := hlc.Timestamp{WallTime: 1}
+	errs := make(chan error, 2)
+	go func() {
+		req := &roachpb.ExportRequest{
+			Span:      exportSpan,
+			StartTime: exportStart,
+			Storage: roachpb.ExportStorage{
+				Provider:  roachpb.ExportStorageProvider_LocalFile,
+				LocalFile: roachpb.ExportStorage_LocalFilePath{Path: dir},
+			},
+		}
+		_, pErr := client.SendWrapped(ctx, kvDB.GetSender(), req)
+		errs <- pErr.GoError()
+	}()
+	tsRepl := store.LookupReplica(roachpb.RKey(keys.TimeseriesPrefix), nil)
+	go func() {
+		_, err := store.ForceTimeSeriesMaintenance(ctx, tsRepl.RangeID)
+		errs <- err
+	}()
+	<-started
+	<-started
+
+	find := func(purpose string) (storage.BackgroundOperation, bool) {
+		for _, op := range store.BackgroundOperations() {
+			if op.Purpose == purpose {
+				return op, true
+			}
+		}
+		return storage.BackgroundOperation{}, false
+	}
+
+	export, ok := find(exportBackgroundOperation)
+	if !ok {
+		t.Fatalf("export not listed in %+v", store.BackgroundOperations())
+	}
+	if export.Owner != "export to LocalFile" {
+		t.Errorf("expected the export to be owned by its destination, got %q", export.Owner)
+	}
+	if !export.Span.Equal(exportSpan) {
+		t.Errorf("expected export span %s, got %s", exportSpan, export.Span)
+	}
+	if export.StartTime != exportStart || !exportStart.Less(export.EndTime) {
+		t.Errorf("unexpected export time window [%s, %s]", export.StartTime, export.EndTime)
+	}
+	if export.Progress != "exported 0 keys (0 B)" {
+		t.Errorf("unexpected export progress %q", export.Progress)
+	}
+
+	prune, ok := find(storage.BackgroundOperationForcedTimeSeriesMaintenance)
+	if !ok {
+		t.Fatalf("time series maintenance not listed in %+v", store.BackgroundOperations())
+	}
+	if prune.Owner != "timeSeriesMaintenance" {
+		t.Errorf("expected the prune to be owned by its queue, got %q", prune.Owner)
+	}
+	if prune.Span.Key.Compare(keys.TimeseriesPrefix) > 0 || prune.Span.EndKey.Compare(keys.TimeseriesPrefix) <= 0 {
+		t.Errorf("expected the prune's span %s to contain the time series", prune.Span)
+	}
+	if prune.StartTime != (hlc.Timestamp{}) || prune.EndTime != (hlc.Timestamp{}) {
+		t.Errorf("unexpected time window [%s, %s] of the prune", prune.StartTime, prune.EndTime)
+	}
+
+	for _, op := range []storage.BackgroundOperation{export, prune} {
+		if op.Started.IsZero() || op.Elapsed < 0 {
+			t.Errorf("%s: unexpected start %s and elapsed time %s", op.Purpose, op.Started, op.Elapsed)
+		}
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, purpose := range []string{
+		exportBackgroundOperation, storage.BackgroundOperationForcedTimeSeriesMaintenance,
+	} {
+		if op, ok := find(purpose); ok {
+			t.Errorf("expected %s to be gone once complete, got %+v", purpose, op)
+		}
+	}
+}
+
+// TestExportLimiter checks that a store limited to one export at a time runs
+// concurrent exports one after the other, and that an export which waits for
+// its turn for longer than the queue timeout fails with an export throttled
+// error.
+func TestExportLimiter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetInt(&exportMaxConcurrent, 1)()
+
+	ctx := context.Background()
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	// The exports which are running are counted once they are registered,
+	// which they are once the limiter lets them run, and the first export
+	// blocks until it is released.
+	var running, maxRunning, blocked int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(func() { close(release) })
+	knobs := base.TestingKnobs{Store: &storage.StoreTestingKnobs{
+		BackgroundOperationStarted: func(op storage.BackgroundOperation) {
+			if op.Purpose != exportBackgroundOperation {
+				return
+			}
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			if atomic.CompareAndSwapInt32(&blocked, 0, 1) {
+				started <- struct{}{}
+				<-release
+			}
+			atomic.AddInt32(&running, -1)
+		},
+	}}
+	tc := testcluster.StartTestCluster(t, 1, base.TestClusterArgs{
+		ServerArgs: base.TestServerArgs{Knobs: knobs},
+	})
+	defer tc.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(t, tc.Conns[0])
+	kvDB := tc.Server(0).KVClient().(*client.DB)
+	store, err := tc.Servers[0].Stores().GetStore(tc.Servers[0].GetFirstStoreID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := store.Registry()
+
+	sqlDB.Exec(`CREATE DATABASE export`)
+	sqlDB.Exec(`CREATE TABLE export.export (id INT PRIMARY KEY)`)
+	sqlDB.Exec(`INSERT INTO export.export VALUES (1), (2), (3)`)
+
+	export := func(ctx context.Context) error {
+		req := &roachpb.ExportRequest{
+			Span: roachpb.Span{Key: keys.UserTableDataMin, EndKey: keys.MaxKey},
+			Storage: roachpb.ExportStorage{
+				Provider:  roachpb.ExportStorageProvider_LocalFile,
+				LocalFile: roachpb.ExportStorage_LocalFilePath{Path: dir},
+			},
+		}
+		_, pErr := client.SendWrapped(ctx, kvDB.GetSender(), req)
+		return pErr.GoError()
+	}
+	value := func(name string) int64 {
+		var v int64
+		metrics.Each(func(n string, val interface{}) {
+			if n != name {
+				return
+			}
+			switch m := val.(type) {
+			case *metric.Gauge:
+				v = m.Value()
+			case *metric.Counter:
+				v = m.Count()
+			}
+		})
+		return v
+	}
+
+	// While the first of three concurrent exports runs, the other two wait.
+	const exports = 3
+	errs := make(chan error, exports)
+	for i := 0; i < exports; i++ {
+		go func() { errs <- export(ctx) }()
+	}
+	<-started
+	testutils.SucceedsSoon(t, func() error {
+		if v := value(metaExportsWaiting.Name); v != exports-1 {
+			return errors.Errorf("expected %d waiting exports, got %d", exports-1, v)
+		}
+		return nil
+	})
+	if n := atomic.LoadInt32(&running); n != 1 {
+		t.Fatalf("expected 1 running export, got %d", n)
+	}
+
+	// An export which waits for longer than the queue timeout is throttled,
+	// without affecting the others.
+	func() {
+		defer settings.TestingSetDuration(&exportQueueTimeout, 10*time.Millisecond)()
+		err := export(ctx)
+		if !IsExportThrottledError(err) {
+			t.Fatalf("expected an export throttled error, got %v", err)
+		}
+		if !testutils.IsError(err, "^export throttled: waited .* to run fewer than 1 exports$") {
+			t.Errorf("unexpected error message %q", err)
+		}
+	}()
+	if v := value(metaExportsThrottled.Name); v != 1 {
+		t.Errorf("expected 1 throttled export, got %d", v)
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	for i := 0; i < exports; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if max := atomic.LoadInt32(&maxRunning); max != 1 {
+		t.Errorf("expected the exports to run one at a time, got %d at once", max)
+	}
+	if v := value(metaExportsWaiting.Name); v != 0 {
+		t.Errorf("expected no waiting exports, got %d", v)
+	}
+}
+
+// TestExportSSTable checks that an ingested sstable which an export covers
+// entirely is copied to a file of its own, and that an sstable the engine
+// wrote itself, or one which isn't covered, is not.
+func TestExportSSTable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	eng, err := engine.NewRocksDB(
+		roachpb.Attributes{}, filepath.Join(dir, "db"), engine.RocksDBCache{}, 0, engine.DefaultMaxOpenFiles,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+
+	// Ingest an sstable of b1@2 and b2@3 in the format exports write.
+	ingested := filepath.Join(dir, "ingested.sst")
+	var expected []engine.MVCCKeyValue
+	sst := engine.MakeRocksDBSstFileWriter()
+	if err := sst.Open(ingested); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"b1", "b2"} {
+		kv := engine.MVCCKeyValue{
+			Key:   engine.MVCCKey{Key: roachpb.Key(key), Timestamp: hlc.Timestamp{WallTime: int64(i + 2)}},
+			Value: roachpb.MakeValueFromString(key).RawBytes,
+		}
+		if err := sst.Add(kv); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, kv)
+	}
+	if err := sst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.IngestExternalFile(ingested, engine.IngestExternalFileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// Have the engine write an sstable of c1@2.
+	if err := engine.MVCCPut(ctx, eng, nil, roachpb.Key("c1"), hlc.Timestamp{WallTime: 2},
+		roachpb.MakeValueFromString("c1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	exportDir := filepath.Join(dir, "export")
+	exportStore, err := makeLocalStorage(exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exportStore.Close()
+
+	covered := func(t *testing.T, startKey, endKey string) []roachpb.Key {
+		iter := engineccl.NewMVCCIncrementalIterator(eng, engineccl.MVCCIncrementalIteratorOptions{
+			EndTime: hlc.Timestamp{WallTime: 5},
+		})
+		defer iter.Close()
+		ssts, err := iter.CoveredSSTables(roachpb.Key(startKey), roachpb.Key(endKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var starts []roachpb.Key
+		for _, sst := range ssts {
+			file, ok, err := exportSSTable(ctx, exportStore, dir, "export.sst", sst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only the ingested sstable can be copied.
+			if isIngested := sst.Start.Key.Equal(roachpb.Key("b1")); ok != isIngested {
+				t.Fatalf("expected the sstable starting at %s to be copied: %t, got %t",
+					sst.Start.Key, isIngested, ok)
+			}
+			if ok {
+				checkExportedSSTable(t, filepath.Join(exportDir, file.Path), file, expected)
+			}
+			starts = append(starts, sst.Start.Key)
+		}
+		return starts
+	}
+
+	t.Run("full", func(t *testing.T) {
+		starts := covered(t, "a", "d")
+		if len(starts) != 2 {
+			t.Fatalf("expected both sstables to be covered, got %s", starts)
+		}
+	})
+	t.Run("partial", func(t *testing.T) {
+		starts := covered(t, "b2", "d")
+		if len(starts) != 1 || !starts[0].Equal(roachpb.Key("c1")) {
+			t.Fatalf("expected the sstable starting at c1 to be covered, got %s", starts)
+		}
+	})
+	t.Run("intent", func(t *testing.T) {
+		// An unflushed intent among the keys of the ingested sstable.
+		txnID := uuid.MakeV4()
+		txn := roachpb.Transaction{TxnMeta: enginepb.TxnMeta{
+			Key:       roachpb.Key("b15"),
+			ID:        &txnID,
+			Epoch:     1,
+			Timestamp: hlc.Timestamp{WallTime: 4},
+		}}
+		if err := engine.MVCCPut(ctx, eng, nil, txn.Key, txn.Timestamp,
+			roachpb.MakeValueFromString("b15"), &txn); err != nil {
+			t.Fatal(err)
+		}
+		starts := covered(t, "a", "d")
+		if len(starts) != 1 || !starts[0].Equal(roachpb.Key("c1")) {
+			t.Fatalf("expected the sstable starting at c1 to be covered, got %s", starts)
+		}
+	})
+}
+
+// TestStillCoveredCopies checks that the copies of sstables which a flush or
+// compaction removed from the covered sstables are dropped, so that their
+// spans are iterated over instead.
+func TestStillCoveredCopies(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	copiedFrom := []engine.SSTableInfo{{Path: "1.sst"}, {Path: "2.sst"}, {Path: "3.sst"}}
+	files := []roachpb.ExportResponse_File{{Path: "a"}, {Path: "b"}, {Path: "c"}}
+	covered := []engine.SSTableInfo{{Path: "3.sst"}, {Path: "1.sst"}, {Path: "4.sst"}}
+	kept, dropped := stillCoveredCopies(files, copiedFrom, covered)
+	if e := []roachpb.ExportResponse_File{files[0], files[2]}; !reflect.DeepEqual(kept, e) {
+		t.Errorf("expected %v to be kept, got %v", e, kept)
+	}
+	if e := []roachpb.ExportResponse_File{files[1]}; !reflect.DeepEqual(dropped, e) {
+		t.Errorf("expected %v to be dropped, got %v", e, dropped)
+	}
+}
+
+// checkExportedSSTable checks that the exported file at path contains the
+// expected key/values and matches its description.
+func checkExportedSSTable(
+	t *testing.T, path string, file roachpb.ExportResponse_File, expected []engine.MVCCKeyValue,
+) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum, err := sha512ChecksumData(contents); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(checksum, file.Sha512) {
+		t.Fatalf("expected checksum %x, got %x", checksum, file.Sha512)
+	}
+	if span := (roachpb.Span{Key: roachpb.Key("b1"), EndKey: roachpb.Key("b2").Next()}); !file.Span.Equal(span) {
+		t.Fatalf("expected span %s, got %s", span, file.Span)
+	}
+
+	sst := engine.MakeRocksDBSstFileReader()
+	defer sst.Close()
+	if err := sst.IngestExternalFile(contents); err != nil {
+		t.Fatal(err)
+	}
+	var kvs []engine.MVCCKeyValue
+	start, end := engine.MVCCKey{Key: keys.MinKey}, engine.MVCCKey{Key: keys.MaxKey}
+	if err := sst.Iterate(start, end, func(kv engine.MVCCKeyValue) (bool, error) {
+		kvs = append(kvs, kv)
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != len(expected) {
+		t.Fatalf("expected %d kvs, got %d", len(expected), len(kvs))
+	}
+	for i := range kvs {
+		if !kvs[i].Key.Equal(expected[i].Key) || !bytes.Equal(kvs[i].Value, expected[i].Value) {
+			t.Fatalf("%d: expected %s, got %s", i, expected[i].Key, kvs[i].Key)
+		}
+	}
+}
+
+// TestExportCopiedSSTableRoundTrip checks that an export which copies an
+// sstable lists its other keys under spans which don't overlap the copied
+// file, and that restoring each file within its span, as an import does,
+// reproduces the exported data.
+func TestExportCopiedSSTableRoundTrip(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+	// The store is on disk, as only the files of its sstables can be copied.
+	tc := testcluster.StartTestCluster(t, 1, base.TestClusterArgs{
+		ServerArgs: base.TestServerArgs{
+			StoreSpecs: []base.StoreSpec{{Path: filepath.Join(dir, "store")}},
+		},
+	})
+	defer tc.Stopper().Stop(ctx)
+	kvDB := tc.Server(0).KVClient().(*client.DB)
+	store, err := tc.Servers[0].Stores().GetStore(tc.Servers[0].GetFirstStoreID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := roachpb.Key(keys.MakeTablePrefix(100))
+	span := roachpb.Span{Key: prefix, EndKey: prefix.PrefixEnd()}
+	key := func(s string) roachpb.Key {
+		return append(append(roachpb.Key(nil), prefix...), s...)
+	}
+
+	// Ingest an sstable of b1@2 and b2@3 in the format exports write, and
+	// write a and c on either side of it.
+	scratch := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer scratch.Close()
+	for i, k := range []string{"b1", "b2"} {
+		if err := engine.MVCCPut(ctx, scratch, nil, key(k), hlc.Timestamp{WallTime: int64(i + 2)},
+			roachpb.MakeValueFromString(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _, err := ExportToSst(ctx, scratch, dir, span, hlc.Timestamp{}, hlc.Timestamp{WallTime: 5}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineccl.WriteAndIngestSst(ctx, store.Engine(), data); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if err := kvDB.Put(ctx, key(k), k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exportDir := filepath.Join(dir, "export")
+	req := &roachpb.ExportRequest{
+		Span: span,
+		Storage: roachpb.ExportStorage{
+			Provider:  roachpb.ExportStorageProvider_LocalFile,
+			LocalFile: roachpb.ExportStorage_LocalFilePath{Path: exportDir},
+		},
+	}
+	res, pErr := client.SendWrapped(ctx, kvDB.GetSender(), req)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	files := res.(*roachpb.ExportResponse).Files
+
+	// The copied sstable is listed first, followed by the main file under the
+	// spans on either side of it.
+	copiedSpan := roachpb.Span{Key: key("b1"), EndKey: key("b2").Next()}
+	expectedSpans := []roachpb.Span{
+		copiedSpan,
+		{Key: span.Key, EndKey: copiedSpan.Key},
+		{Key: copiedSpan.EndKey, EndKey: span.EndKey},
+	}
+	var spans []roachpb.Span
+	for _, file := range files {
+		spans = append(spans, file.Span)
+	}
+	if !reflect.DeepEqual(spans, expectedSpans) {
+		t.Fatalf("expected files of spans %s, got %s", expectedSpans, spans)
+	}
+	if files[1].Path != files[2].Path || files[0].Path == files[1].Path {
+		t.Fatalf("expected the keys besides the copied sstable in one file, got %+v", files)
+	}
+
+	// Restore each file within its span into an empty engine.
+	restored := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer restored.Close()
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(filepath.Join(exportDir, file.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sst := engine.MakeRocksDBSstFileReader()
+		defer sst.Close()
+		if err := sst.IngestExternalFile(contents); err != nil {
+			t.Fatal(err)
+		}
+		start, end := engine.MakeMVCCMetadataKey(file.Span.Key), engine.MakeMVCCMetadataKey(file.Span.EndKey)
+		if err := sst.Iterate(start, end, func(kv engine.MVCCKeyValue) (bool, error) {
+			return false, restored.Put(kv.Key, kv.Value)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start, end := engine.MakeMVCCMetadataKey(span.Key), engine.MakeMVCCMetadataKey(span.EndKey)
+	expected, err := engine.Scan(store.Engine(), start, end, 0 /* max */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := engine.Scan(restored, start, end, 0 /* max */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 4 {
+		t.Fatalf("expected 4 kvs in the store, got %d", len(expected))
+	}
+	if !reflect.DeepEqual(kvs, expected) {
+		t.Fatalf("expected %v to be restored, got %v", expected, kvs)
+	}
+}
+
+// TestExportToSst checks that the ExportMeta returned by ExportToSst describes
+// its sstable, survives a round trip through its encoding, and is rejected by
+// VerifyExport once the sstable is corrupted.
+func TestExportToSst(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+	for _, kv := range []struct {
+		key  string
+		wall int64
+	}{{"a", 1}, {"a", 3}, {"b", 2}, {"c", 4}, {"d", 2}} {
+		if err := engine.MVCCPut(ctx, e, nil, roachpb.Key(kv.key), hlc.Timestamp{WallTime: kv.wall},
+			roachpb.MakeValueFromString(kv.key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	span := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("d")}
+	endTime := hlc.Timestamp{WallTime: 4}
+
+	t.Run("full", func(t *testing.T) {
+		startTime := hlc.Timestamp{WallTime: 1}
+		data, meta, err := ExportToSst(ctx, e, dir, span, startTime, endTime, 0 /* maxSize */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Both versions of a, and b@2; c@4 is at the end time.
+		if meta.KVCount != 3 {
+			t.Fatalf("expected 3 keys, got %d", meta.KVCount)
+		}
+		if !meta.Span.Equal(span) || meta.ResumeKey != nil {
+			t.Fatalf("expected an untruncated export of %s, got %s resuming at %s",
+				span, meta.Span, meta.ResumeKey)
+		}
+		if meta.StartTime != startTime || meta.EndTime != endTime {
+			t.Fatalf("expected time range [%s,%s), got [%s,%s)",
+				startTime, endTime, meta.StartTime, meta.EndTime)
+		}
+		if err := VerifyExport(data, meta); err != nil {
+			t.Fatal(err)
+		}
+
+		encoded, err := protoutil.Marshal(&meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded ExportMeta
+		if err := decoded.Unmarshal(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(meta, decoded) {
+			t.Fatalf("expected %+v, got %+v", meta, decoded)
+		}
+		if err := VerifyExport(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		corrupted := append([]byte(nil), data...)
+		corrupted[len(corrupted)/2] ^= 0xff
+		if err := VerifyExport(corrupted, decoded); !testutils.IsError(err, "checksum mismatch") {
+			t.Fatalf("expected a checksum mismatch, got %v", err)
+		}
+		// The count of keys is checked independently of the checksum.
+		decoded.KVCount++
+		if err := VerifyExport(data, decoded); !testutils.IsError(err, "sstable has 3 keys") {
+			t.Fatalf("expected a key count mismatch, got %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		data, meta, err := ExportToSst(ctx, e, dir, span, hlc.Timestamp{}, endTime, 1 /* maxSize */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Both versions of a are exported together.
+		if meta.KVCount != 2 {
+			t.Fatalf("expected 2 keys, got %d", meta.KVCount)
+		}
+		if !meta.ResumeKey.Equal(roachpb.Key("b")) || !meta.Span.EndKey.Equal(roachpb.Key("b")) {
+			t.Fatalf("expected the export to be truncated at b, got %s resuming at %s",
+				meta.Span, meta.ResumeKey)
+		}
+		if err := VerifyExport(data, meta); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		data, meta, err := ExportToSst(ctx, e, dir, span, endTime, endTime, 0 /* maxSize */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data != nil || meta.KVCount != 0 {
+			t.Fatalf("expected nothing to be exported, got %d keys", meta.KVCount)
+		}
+		if err := VerifyExport(data, meta); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -11,6 +11,7 @@ package storageccl
 import (
 	"bytes"
 
+	"github.com/cockroachdb/cockroach/pkg/ccl/storageccl/engineccl"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
@@ -48,12 +49,15 @@ func (p prefixRewriter) rewriteKey(key []byte) ([]byte, bool) {
 
 // KeyRewriter rewrites old table IDs to new table IDs. It is able to descend
 // into interleaved keys, and is able to function on partial keys for spans
-// and splits.
+// and splits. It can rewrite the keys of an incremental iteration as they are
+// emitted; see engineccl.MVCCIncrementalIteratorOptions.KeyRewriter.
 type KeyRewriter struct {
 	prefixes prefixRewriter
 	descs    map[sqlbase.ID]*sqlbase.TableDescriptor
 }
 
+var _ engineccl.KeyRewriter = &KeyRewriter{}
+
 // MakeKeyRewriter creates a KeyRewriter. This includes a simple []byte
 // prefix rewriter to rewrite table IDs including prefix ends, and table
 // descriptor data to traverse interleaved keys to child tables.
@@ -0,0 +1,99 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package storageccl
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/ccl/storageccl/engineccl"
+	"github.com/cockroachdb/cockroach/pkg/storage"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+var (
+	metaExportsWaiting = metric.Metadata{
+		Name: "storageccl.export.waiting",
+		Help: "Number of export requests waiting for the store's export limiter"}
+	metaExportsThrottled = metric.Metadata{
+		Name: "storageccl.export.throttled",
+		Help: "Number of export requests which failed after waiting for the store's export limiter"}
+)
+
+// exportAuditLimit is the number of audits of the iterations of exports which
+// each store runs at once; see engineccl.AuditFraction. An audit rereads the
+// data of its iteration, so they are kept few.
+const exportAuditLimit = 2
+
+// storeMetrics are the metrics which this package maintains for each store,
+// along with the store's export limiter and audit semaphore, which are kept
+// with them as they are the state this package is given for each store.
+type storeMetrics struct {
+	Iterator         *engineccl.IteratorMetrics
+	ExportsWaiting   *metric.Gauge
+	ExportsThrottled *metric.Counter
+
+	exportLimiter *exportLimiter
+	auditSem      chan struct{}
+}
+
+// MetricStruct implements the metric.Struct interface.
+func (*storeMetrics) MetricStruct() {}
+
+var _ metric.Struct = (*storeMetrics)(nil)
+
+func newStoreMetrics() *storeMetrics {
+	m := &storeMetrics{
+		Iterator:         engineccl.NewIteratorMetrics(),
+		ExportsWaiting:   metric.NewGauge(metaExportsWaiting),
+		ExportsThrottled: metric.NewCounter(metaExportsThrottled),
+	}
+	m.exportLimiter = newExportLimiter(m.ExportsWaiting, m.ExportsThrottled)
+	m.auditSem = make(chan struct{}, exportAuditLimit)
+	return m
+}
+
+func init() {
+	storage.SetCCLMetrics(func() metric.Struct {
+		return newStoreMetrics()
+	})
+}
+
+// cclStoreMetrics returns the metrics of the store which is evaluating a
+// command, or nil if it has none.
+func cclStoreMetrics(cArgs storage.CommandArgs) *storeMetrics {
+	m, _ := cArgs.EvalCtx.CCLMetrics().(*storeMetrics)
+	return m
+}
+
+// iteratorMetrics returns the metrics of the iterators of the store which is
+// evaluating a command, or nil if it has none.
+func iteratorMetrics(cArgs storage.CommandArgs) *engineccl.IteratorMetrics {
+	if m := cclStoreMetrics(cArgs); m != nil {
+		return m.Iterator
+	}
+	return nil
+}
+
+// auditSem returns the semaphore limiting the audits of the iterations of the
+// store which is evaluating a command, or nil if it has none, in which case
+// the iterations aren't audited.
+func auditSem(cArgs storage.CommandArgs) chan struct{} {
+	if m := cclStoreMetrics(cArgs); m != nil {
+		return m.auditSem
+	}
+	return nil
+}
+
+// storeExportLimiter returns the export limiter of the store which is
+// evaluating a command. A store without one, which only happens in tests
+// evaluating commands outside of a store, shares a limiter with the others.
+func storeExportLimiter(cArgs storage.CommandArgs) *exportLimiter {
+	if m := cclStoreMetrics(cArgs); m != nil {
+		return m.exportLimiter
+	}
+	return sharedExportLimiter
+}
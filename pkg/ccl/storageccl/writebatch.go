@@ -18,6 +18,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 )
@@ -31,7 +32,9 @@ func init() {
 
 // evalWriteBatch applies the operations encoded in a BatchRepr. Any existing
 // data in the affected keyrange is first cleared (not tombstoned), which makes
-// this command idempotent.
+// this command idempotent, unless the request's Merge flag is set, in which
+// case the operations must all be merges of inline values and are applied on
+// top of the existing data.
 func evalWriteBatch(
 	ctx context.Context, batch engine.ReadWriter, cArgs storage.CommandArgs, _ roachpb.Response,
 ) (storage.EvalResult, error) {
@@ -57,6 +60,10 @@ func evalWriteBatch(
 	mvccStartKey := engine.MVCCKey{Key: args.Key}
 	mvccEndKey := engine.MVCCKey{Key: args.EndKey}
 
+	if args.Merge {
+		return evalMergeWriteBatch(batch, args.Data, mvccStartKey, mvccEndKey, h.Timestamp.WallTime, ms)
+	}
+
 	// Verify that the keys in the batch are within the range specified by the
 	// request header.
 	msBatch, err := engineccl.VerifyBatchRepr(args.Data, mvccStartKey, mvccEndKey, h.Timestamp.WallTime)
@@ -96,3 +103,40 @@ func evalWriteBatch(
 	}
 	return storage.EvalResult{}, nil
 }
+
+// evalMergeWriteBatch applies a BatchRepr of merges of inline values, within
+// [start, end), on top of the existing data. As the merged values depend on
+// the existing ones, the MVCCStats are adjusted by recomputing those of the
+// keyrange rather than from the BatchRepr alone. The merges are resolved in
+// the same raft command as they are read, so no concurrent write to the
+// keyrange is lost.
+func evalMergeWriteBatch(
+	batch engine.ReadWriter,
+	repr []byte,
+	start, end engine.MVCCKey,
+	nowNanos int64,
+	ms *enginepb.MVCCStats,
+) (storage.EvalResult, error) {
+	if err := engineccl.VerifyMergeBatchRepr(repr, start, end); err != nil {
+		return storage.EvalResult{}, err
+	}
+	computeStats := func() (enginepb.MVCCStats, error) {
+		iter := batch.NewIterator(false)
+		defer iter.Close()
+		return iter.ComputeStats(start, end, nowNanos)
+	}
+	existingStats, err := computeStats()
+	if err != nil {
+		return storage.EvalResult{}, err
+	}
+	if err := batch.ApplyBatchRepr(repr, false /* !sync */); err != nil {
+		return storage.EvalResult{}, err
+	}
+	mergedStats, err := computeStats()
+	if err != nil {
+		return storage.EvalResult{}, err
+	}
+	ms.Subtract(existingStats)
+	ms.Add(mergedStats)
+	return storage.EvalResult{}, nil
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 )
 
@@ -181,6 +182,92 @@ func TestWriteBatchMVCCStats(t *testing.T) {
 	}
 }
 
+func TestWriteBatchMerge(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	e := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer e.Close()
+
+	tsValue := func(samples ...roachpb.InternalTimeSeriesSample) roachpb.Value {
+		var v roachpb.Value
+		if err := v.SetProto(&roachpb.InternalTimeSeriesData{
+			StartTimestampNanos: 0,
+			SampleDurationNanos: 1,
+			Samples:             samples,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	computeStats := func() enginepb.MVCCStats {
+		iter := e.NewIterator(false)
+		defer iter.Close()
+		ms, err := iter.ComputeStats(engine.MVCCKey{Key: []byte("b")}, engine.MVCCKey{Key: []byte("c")}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ms
+	}
+
+	// A sample which is already in the span, as one merged concurrently with
+	// the computation of the batch would be.
+	key := roachpb.Key("bb")
+	existing := roachpb.InternalTimeSeriesSample{Offset: 1, Count: 1, Sum: 1}
+	if err := engine.MVCCMerge(ctx, e, nil, key, hlc.Timestamp{}, tsValue(existing)); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := roachpb.InternalTimeSeriesSample{Offset: 2, Count: 1, Sum: 2}
+	meta, err := protoutil.Marshal(&enginepb.MVCCMetadata{RawBytes: tsValue(merged).RawBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch engine.RocksDBBatchBuilder
+	batch.Merge(engine.MakeMVCCMetadataKey(key), meta)
+	span := roachpb.Span{Key: []byte("b"), EndKey: []byte("c")}
+	stats := computeStats()
+	cArgs := storage.CommandArgs{
+		Args: &roachpb.WriteBatchRequest{
+			Span:     span,
+			DataSpan: span,
+			Data:     batch.Finish(),
+			Merge:    true,
+		},
+		Stats: &stats,
+	}
+	if _, err := evalWriteBatch(ctx, e, cArgs, nil); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// The existing sample is kept, and the stats are those of the merged data.
+	value, _, err := engine.MVCCGet(ctx, e, key, hlc.Timestamp{}, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := value.GetTimeseries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []roachpb.InternalTimeSeriesSample{existing, merged}
+	if !reflect.DeepEqual(data.Samples, expected) {
+		t.Errorf("expected samples %v, got %v", expected, data.Samples)
+	}
+	if expectedStats := computeStats(); !reflect.DeepEqual(expectedStats, stats) {
+		t.Errorf("mvcc stats mismatch %+v != %+v", expectedStats, stats)
+	}
+
+	// A batch with the Merge flag may only contain merges.
+	var putBatch engine.RocksDBBatchBuilder
+	putBatch.Put(engine.MVCCKey{Key: key, Timestamp: hlc.Timestamp{WallTime: 1}}, tsValue(merged).RawBytes)
+	cArgs.Args.(*roachpb.WriteBatchRequest).Data = putBatch.Finish()
+	if _, err := evalWriteBatch(
+		ctx, e, cArgs, nil,
+	); !testutils.IsError(err, "unexpected entry type in merge batch") {
+		t.Fatalf("expected unexpected entry type error got: %+v", err)
+	}
+}
+
 func BenchmarkWriteBatch(b *testing.B) {
 	rng, _ := randutil.NewPseudoRand()
 	const payloadSize = 100
@@ -114,6 +114,7 @@ func printKeyValue(kv engine.MVCCKeyValue) (bool, error) {
 		tryRaftLogEntry,
 		tryRangeDescriptor,
 		tryMeta,
+		tryQueueHistory,
 		tryTxn,
 		tryRangeIDKey,
 	}
@@ -250,6 +251,34 @@ func tryTxn(kv engine.MVCCKeyValue) (string, error) {
 	return txn.String() + "\n", nil
 }
 
+func tryQueueHistory(kv engine.MVCCKeyValue) (string, error) {
+	_, suffix, _, err := keys.DecodeRangeKey(kv.Key.Key)
+	if err != nil {
+		return "", err
+	}
+	if !suffix.Equal(keys.LocalQueueHistorySuffix.AsRawKey()) {
+		return "", errors.New("not a queue history key")
+	}
+	var meta enginepb.MVCCMetadata
+	if err := meta.Unmarshal(kv.Value); err != nil {
+		return "", err
+	}
+	value := roachpb.Value{RawBytes: meta.RawBytes}
+	b, err := value.GetBytes()
+	if err != nil {
+		return "", err
+	}
+	history, err := storage.DecodeQueueHistory(b)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for _, outcome := range history {
+		fmt.Fprintf(&buf, "\n\t%s", outcome)
+	}
+	return buf.String() + "\n", nil
+}
+
 func tryRangeIDKey(kv engine.MVCCKeyValue) (string, error) {
 	if kv.Key.Timestamp != (hlc.Timestamp{}) {
 		return "", fmt.Errorf("range ID keys shouldn't have timestamps: %s", kv.Key)
@@ -17,6 +17,7 @@
 package gossip
 
 import (
+	"encoding/hex"
 	"regexp"
 	"strconv"
 	"strings"
@@ -74,6 +75,16 @@ const (
 	// The value if a config.SystemConfig which holds all key/value
 	// pairs in the system DB span.
 	KeySystemConfig = "system-db"
+
+	// KeyTimeSeriesPrunedPrefix is the key prefix for gossiping the time at
+	// which the time series data in a span was last pruned. The suffix is the
+	// hex-encoded span and the value is an hlc.Timestamp.
+	KeyTimeSeriesPrunedPrefix = "ts-pruned"
+
+	// KeyTimeSeriesNamesPrefix is the key prefix for gossiping the names of
+	// the time series of the metrics registered by a node. The suffix is the
+	// node ID and the value is a JSON-encoded list of names.
+	KeyTimeSeriesNamesPrefix = "ts-names"
 )
 
 // MakeKey creates a canonical key under which to gossip a piece of
@@ -130,3 +141,16 @@ func MakeStoreKey(storeID roachpb.StoreID) string {
 func MakeDeadReplicasKey(storeID roachpb.StoreID) string {
 	return MakeKey(KeyDeadReplicasPrefix, storeID.String())
 }
+
+// MakeTimeSeriesPrunedKey returns the gossip key under which the time at which
+// the time series data in the span was last pruned is gossiped.
+func MakeTimeSeriesPrunedKey(span roachpb.Span) string {
+	return MakeKey(KeyTimeSeriesPrunedPrefix,
+		hex.EncodeToString(span.Key), hex.EncodeToString(span.EndKey))
+}
+
+// MakeTimeSeriesNamesKey returns the gossip key under which the names of the
+// time series of the metrics registered by the node are gossiped.
+func MakeTimeSeriesNamesKey(nodeID roachpb.NodeID) string {
+	return MakeKey(KeyTimeSeriesNamesPrefix, nodeID.String())
+}
@@ -173,6 +173,12 @@ var (
 	LocalTransactionSuffix = roachpb.RKey("txn-")
 	// LocalQueueLastProcessedSuffix is the suffix for replica queue state keys.
 	LocalQueueLastProcessedSuffix = roachpb.RKey("qlpt")
+	// LocalQueueHistorySuffix is the suffix for keys recording the recent
+	// processing outcomes of a replica queue.
+	LocalQueueHistorySuffix = roachpb.RKey("qhst")
+	// LocalQueueResumeSuffix is the suffix for keys recording the position
+	// from which a replica queue resumes an interrupted pass over a replica.
+	LocalQueueResumeSuffix = roachpb.RKey("qres")
 
 	// Meta1Prefix is the first level of key addressing. It is selected such that
 	// all range addressing records sort before any system tables which they
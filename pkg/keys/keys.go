@@ -337,6 +337,18 @@ func QueueLastProcessedKey(key roachpb.RKey, queue string) roachpb.Key {
 	return MakeRangeKey(key, LocalQueueLastProcessedSuffix, roachpb.RKey(queue))
 }
 
+// QueueHistoryKey returns a range-local key for the recent processing
+// outcomes of the named queue.
+func QueueHistoryKey(key roachpb.RKey, queue string) roachpb.Key {
+	return MakeRangeKey(key, LocalQueueHistorySuffix, roachpb.RKey(queue))
+}
+
+// QueueResumeKey returns a range-local key for the position from which the
+// named queue resumes an interrupted pass over the range.
+func QueueResumeKey(key roachpb.RKey, queue string) roachpb.Key {
+	return MakeRangeKey(key, LocalQueueResumeSuffix, roachpb.RKey(queue))
+}
+
 // IsLocal performs a cheap check that returns true iff a range-local key is
 // passed, that is, a key for which `Addr` would return a non-identical RKey
 // (or a decoding error).
@@ -172,6 +172,8 @@ var (
 		{name: "RangeDescriptor", suffix: LocalRangeDescriptorSuffix, atEnd: true},
 		{name: "Transaction", suffix: LocalTransactionSuffix, atEnd: false},
 		{name: "QueueLastProcessed", suffix: LocalQueueLastProcessedSuffix, atEnd: false},
+		{name: "QueueHistory", suffix: LocalQueueHistorySuffix, atEnd: false},
+		{name: "QueueResume", suffix: LocalQueueResumeSuffix, atEnd: false},
 	}
 )
 
@@ -519,6 +521,8 @@ func prettyPrintInternal(key roachpb.Key, quoteRawKeys bool) string {
 //			/RangeDescriptor/[key]                       "\x01k"+[key]+"rdsc"
 //			/Transaction/addrKey:[key]/id:[id]	         "\x01k"+[key]+"txn-"+[txn-id]
 //			/QueueLastProcessed/addrKey:[key]/id:[queue] "\x01k"+[key]+"qlpt"+[queue]
+//			/QueueHistory/addrKey:[key]/id:[queue]       "\x01k"+[key]+"qhst"+[queue]
+//			/QueueResume/addrKey:[key]/id:[queue]        "\x01k"+[key]+"qres"+[queue]
 // /Local/Max                                        "\x02"
 //
 // /Meta1/[key]                                      "\x02"+[key]
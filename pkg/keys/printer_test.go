@@ -70,6 +70,8 @@ func TestPrettyPrint(t *testing.T) {
 		{RangeDescriptorKey(roachpb.RKey("111")), `/Local/Range/"111"/RangeDescriptor`},
 		{TransactionKey(roachpb.Key("111"), txnID), fmt.Sprintf(`/Local/Range/"111"/Transaction/addrKey:/id:%q`, txnID)},
 		{QueueLastProcessedKey(roachpb.RKey("111"), "foo"), `/Local/Range/"111"/QueueLastProcessed/addrKey:/id:"foo"`},
+		{QueueHistoryKey(roachpb.RKey("111"), "foo"), `/Local/Range/"111"/QueueHistory/addrKey:/id:"foo"`},
+		{QueueResumeKey(roachpb.RKey("111"), "foo"), `/Local/Range/"111"/QueueResume/addrKey:/id:"foo"`},
 
 		{LocalMax, `/Meta1/""`}, // LocalMax == Meta1Prefix
 
@@ -335,6 +335,12 @@ func NewServer(cfg Config, stopper *stop.Stopper) (*Server, error) {
 	s.registry.AddMetricStruct(s.pgServer.Metrics())
 
 	s.tsDB = ts.NewDB(s.db)
+	// Large batches of rollups are written as single WriteBatch requests
+	// rather than as one merge per key. WriteBatch is only implemented by CCL
+	// builds; other builds always write rollups as merges.
+	if storage.WriteBatchImplemented() {
+		s.tsDB.SetRollupIngester(ts.WriteBatchRollupIngester(s.db))
+	}
 	s.tsServer = ts.MakeServer(s.cfg.AmbientCtx, s.tsDB, s.cfg.TimeSeriesServerConfig, s.stopper)
 
 	// TODO(bdarnell): make StoreConfig configurable.
@@ -710,6 +716,12 @@ func (s *Server) Start(ctx context.Context) error {
 		s.cfg.AmbientCtx, s.recorder, s.cfg.MetricsSampleInterval, ts.Resolution10s, s.stopper,
 	)
 
+	// Begin gossiping the names of the time series of the registered metrics,
+	// from which time series maintenance identifies orphaned series.
+	s.tsDB.GossipKnownNames(
+		s.cfg.AmbientCtx, s.gossip, s.NodeID(), s.recorder, s.stopper,
+	)
+
 	// Begin recording status summaries.
 	s.node.startWriteSummaries(s.cfg.MetricsSampleInterval)
 
@@ -836,6 +848,12 @@ func (s *Server) Start(ctx context.Context) error {
 	s.mux.Handle(rangeDebugEndpoint, http.HandlerFunc(s.status.handleDebugRange))
 	s.mux.Handle(problemRangesDebugEndpoint, http.HandlerFunc(s.status.handleProblemRanges))
 	s.mux.Handle(certificatesDebugEndpoint, http.HandlerFunc(s.status.handleDebugCertificates))
+	s.mux.Handle(tsMaintenanceDebugEndpoint, http.HandlerFunc(s.status.handleDebugTimeSeriesMaintenance))
+	s.mux.Handle(tsSizesDebugEndpoint, http.HandlerFunc(s.status.handleDebugTimeSeriesSizes))
+	s.mux.Handle(tsProgressDebugEndpoint, http.HandlerFunc(s.status.handleDebugTimeSeriesProgress))
+	s.mux.Handle(queueHistoryDebugEndpoint, http.HandlerFunc(s.status.handleDebugQueueHistory))
+	s.mux.Handle(queuesDebugEndpoint, http.HandlerFunc(s.status.handleDebugQueues))
+	s.mux.Handle(backgroundOperationsDebugEndpoint, http.HandlerFunc(s.status.handleDebugBackgroundOperations))
 	log.Event(ctx, "added http endpoints")
 
 	// Before serving SQL requests, we have to make sure the database is
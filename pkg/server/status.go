@@ -24,6 +24,7 @@ import (
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 
@@ -45,7 +46,9 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
 	"github.com/cockroachdb/cockroach/pkg/server/status"
 	"github.com/cockroachdb/cockroach/pkg/storage"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/httputil"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
@@ -75,6 +78,36 @@ const (
 	// certificatesDebugEndpoint lists the certificates on a node.
 	certificatesDebugEndpoint = "/debug/certificates"
 
+	// tsMaintenanceDebugEndpoint lists the time series maintenance state of
+	// the ranges on this node, or forces time series maintenance of a specific
+	// range when POSTed to.
+	tsMaintenanceDebugEndpoint = "/debug/tsmaintenance"
+
+	// tsSizesDebugEndpoint lists the largest time series on the stores of
+	// this node, as measured by time series maintenance.
+	tsSizesDebugEndpoint = "/debug/tssizes"
+
+	// tsProgressDebugEndpoint reports the progress of the current pass of
+	// time series maintenance over the stores of this node.
+	tsProgressDebugEndpoint = "/debug/tsprogress"
+
+	// queueHistoryDebugEndpoint lists the recent queue processing outcomes
+	// recorded for a specific range on this node.
+	queueHistoryDebugEndpoint = "/debug/queuehistory"
+
+	// queuesDebugEndpoint lists the replicas waiting in the queues of the
+	// stores on this node.
+	queuesDebugEndpoint = "/debug/queues"
+
+	// backgroundOperationsDebugEndpoint lists the long-running operations,
+	// such as queue processing and exports, in flight on the stores on this
+	// node.
+	backgroundOperationsDebugEndpoint = "/debug/backgroundops"
+
+	// defaultQueuedReplicasLimit is the number of replicas listed for each
+	// queue by queuesDebugEndpoint, unless overridden by its "limit" parameter.
+	defaultQueuedReplicasLimit = 100
+
 	// raftStateDormant is used when there is no known raft state.
 	raftStateDormant = "StateDormant"
 )
@@ -647,6 +680,246 @@ func (s *statusServer) handleVars(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleDebugTimeSeriesMaintenance lists the time series maintenance state of
+// the local replicas on GET. On POST, it runs time series maintenance on the
+// local replicas of the range specified by the "id" parameter, and writes the
+// result for each store as JSON.
+func (s *statusServer) handleDebugTimeSeriesMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(httputil.ContentTypeHeader, httputil.PlaintextContentType)
+	switch r.Method {
+	case http.MethodGet:
+		s.writeTimeSeriesMaintenanceStatuses(w, r)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "time series maintenance can only be listed with GET or forced with POST",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	rangeIDString := r.URL.Query().Get("id")
+	if len(rangeIDString) == 0 {
+		http.Error(w, "no range ID provided, please specify one: debug/tsmaintenance?id=[range_id]",
+			http.StatusBadRequest)
+		return
+	}
+	rangeID, err := strconv.ParseInt(rangeIDString, 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make(map[roachpb.StoreID]storage.TimeSeriesMaintenanceResult)
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		if _, err := store.GetReplica(roachpb.RangeID(rangeID)); err != nil {
+			return nil
+		}
+		result, err := store.ForceTimeSeriesMaintenance(r.Context(), roachpb.RangeID(rangeID))
+		if err != nil {
+			return err
+		}
+		results[store.StoreID()] = result
+		return nil
+	}); err != nil {
+		log.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(results) == 0 {
+		http.Error(w, fmt.Sprintf("r%d not found on this node", rangeID), http.StatusNotFound)
+		return
+	}
+	body, err := marshalToJSON(results)
+	if err != nil {
+		log.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(httputil.ContentTypeHeader, httputil.JSONContentType)
+	_, _ = w.Write(body)
+}
+
+// writeTimeSeriesMaintenanceStatuses writes the time series maintenance state
+// of the replicas containing time series data on each local store.
+func (s *statusServer) writeTimeSeriesMaintenanceStatuses(w http.ResponseWriter, r *http.Request) {
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		statuses, err := store.TimeSeriesMaintenanceStatuses()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s:\n", store)
+		for _, ts := range statuses {
+			lastProcessed := "never"
+			if ts.LastProcessed != (hlc.Timestamp{}) {
+				lastProcessed = ts.LastProcessed.GoTime().String()
+			}
+			var overdue string
+			if ts.Overdue {
+				overdue = " (overdue)"
+			}
+			fmt.Fprintf(w, "\tr%d [%s,%s): last processed %s%s\n",
+				ts.RangeID, ts.StartKey, ts.EndKey, lastProcessed, overdue)
+		}
+		return nil
+	}); err != nil {
+		log.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleDebugTimeSeriesSizes writes the largest time series on each local
+// store, and the time at which each replica whose time series were measured
+// was last measured.
+func (s *statusServer) handleDebugTimeSeriesSizes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(httputil.ContentTypeHeader, httputil.PlaintextContentType)
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		report, err := store.TimeSeriesSizeReport()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s:\n", store)
+		for _, series := range report.Series {
+			fmt.Fprintf(w, "\t%s: %d keys, %s\n",
+				series.Name, series.Keys, humanizeutil.IBytes(series.Bytes))
+		}
+		fmt.Fprintf(w, "\tmeasured replicas:\n")
+		for _, repl := range report.Replicas {
+			fmt.Fprintf(w, "\t\tr%d: %s\n", repl.RangeID, repl.Measured.GoTime())
+		}
+		return nil
+	}); err != nil {
+		log.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleDebugTimeSeriesProgress writes the progress of the current pass of
+// time series maintenance on each local store, and its estimated completion
+// time.
+func (s *statusServer) handleDebugTimeSeriesProgress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(httputil.ContentTypeHeader, httputil.PlaintextContentType)
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		progress, err := store.TimeSeriesMaintenanceProgress()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: pass started %s: %d of %d replicas maintained (%.1f%%), ETA %s\n",
+			store, progress.PassStart, progress.Done, progress.Due, progress.PercentComplete,
+			progress.ETAString())
+		return nil
+	}); err != nil {
+		log.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleDebugQueueHistory writes the recent queue processing outcomes recorded
+// for the range specified by the "id" query parameter on each local store.
+func (s *statusServer) handleDebugQueueHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(httputil.ContentTypeHeader, httputil.PlaintextContentType)
+	rangeIDString := r.URL.Query().Get("id")
+	if len(rangeIDString) == 0 {
+		http.Error(w, "no range ID provided, please specify one: debug/queuehistory?id=[range_id]",
+			http.StatusBadRequest)
+		return
+	}
+	rangeID, err := strconv.ParseInt(rangeIDString, 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var found bool
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		histories, err := store.QueueHistories(r.Context(), roachpb.RangeID(rangeID))
+		if _, ok := err.(*roachpb.RangeNotFoundError); ok {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		found = true
+		names := make([]string, 0, len(histories))
+		for name := range histories {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "r%d on %s: %s\n", rangeID, store, name)
+			for _, outcome := range histories[name] {
+				fmt.Fprintf(w, "\t%s\n", outcome)
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("r%d not found on this node", rangeID), http.StatusNotFound)
+	}
+}
+
+// handleDebugQueues writes the replicas waiting in each queue of each local
+// store, highest priority first. The number of replicas listed for each queue
+// is capped by the "limit" query parameter.
+func (s *statusServer) handleDebugQueues(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(httputil.ContentTypeHeader, httputil.PlaintextContentType)
+	limit := defaultQueuedReplicasLimit
+	if limitString := r.URL.Query().Get("limit"); len(limitString) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(limitString); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", limitString), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		queued := store.QueuedReplicas(limit)
+		names := make([]string, 0, len(queued))
+		for name := range queued {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s: %s\n", store, name)
+			for _, q := range queued[name] {
+				fmt.Fprintf(w, "\tr%d: priority %0.3f, waiting %s (since %s)\n",
+					q.RangeID, q.Priority, q.Wait, q.Enqueued)
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleDebugBackgroundOperations writes the long-running operations in flight
+// on each local store, oldest first.
+func (s *statusServer) handleDebugBackgroundOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(httputil.ContentTypeHeader, httputil.PlaintextContentType)
+	if err := s.stores.VisitStores(func(store *storage.Store) error {
+		for _, op := range store.BackgroundOperations() {
+			fmt.Fprintf(w, "%s: %s by %s of %s", store, op.Purpose, op.Owner, op.Span)
+			if op.EndTime != (hlc.Timestamp{}) {
+				fmt.Fprintf(w, " between %s and %s", op.StartTime, op.EndTime)
+			}
+			fmt.Fprintf(w, ", running %s (since %s)", op.Elapsed, op.Started)
+			if op.Progress != "" {
+				fmt.Fprintf(w, ", %s", op.Progress)
+			}
+			if op.TraceID != 0 {
+				fmt.Fprintf(w, ", trace %d", op.TraceID)
+			}
+			fmt.Fprintln(w)
+		}
+		return nil
+	}); err != nil {
+		log.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // Ranges returns range info for the specified node.
 func (s *statusServer) Ranges(
 	ctx context.Context, req *serverpb.RangesRequest,
@@ -0,0 +1,128 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package settings
+
+import (
+	"fmt"
+	"sync"
+)
+
+// scopedOverride is an override made by a TestingSet*Scoped function which has
+// not yet been restored.
+type scopedOverride struct {
+	// target is the overridden reference, such as a **BoolSetting.
+	target interface{}
+	key    string
+	desc   string
+}
+
+// scopedOverrides are the active scoped overrides, in the order in which they
+// were made.
+var scopedOverrides struct {
+	sync.Mutex
+	active []*scopedOverride
+}
+
+// pushScopedOverride records an override of the target, which currently
+// refers to s, with the value v. It must be called before the override is
+// made.
+func pushScopedOverride(target interface{}, s Setting, v interface{}) *scopedOverride {
+	scopedOverrides.Lock()
+	defer scopedOverrides.Unlock()
+	key := "<unregistered>"
+	for k, ws := range registry {
+		if ws.setting == s {
+			key = k
+		}
+	}
+	// If the target is already overridden, s is the mock of the earlier
+	// override, which isn't registered.
+	for _, o := range scopedOverrides.active {
+		if o.target == target {
+			key = o.key
+		}
+	}
+	o := &scopedOverride{target: target, key: key, desc: fmt.Sprintf("%s=%v", key, v)}
+	scopedOverrides.active = append(scopedOverrides.active, o)
+	return o
+}
+
+// popScopedOverride removes the override from the active overrides. It panics
+// if the override was already restored, or if a later override of the same
+// setting is still active: restoring it would reinstate the setting as it was
+// before the earlier override, silently undoing the later one.
+func popScopedOverride(o *scopedOverride) {
+	scopedOverrides.Lock()
+	defer scopedOverrides.Unlock()
+	active := scopedOverrides.active
+	for i := len(active) - 1; i >= 0; i-- {
+		if active[i] == o {
+			scopedOverrides.active = append(active[:i:i], active[i+1:]...)
+			return
+		}
+		if active[i].target == o.target {
+			panic(fmt.Sprintf("override %s restored before the later override %s",
+				o.desc, active[i].desc))
+		}
+	}
+	panic(fmt.Sprintf("override %s restored twice", o.desc))
+}
+
+// TestingSetBoolScoped is like TestingSetBool, but the override is tracked
+// until the returned function restores it, so that a test which leaves it
+// active can be caught by TestingCheckScopedOverrides. Overrides of the same
+// setting must be restored in the reverse of the order in which they were
+// made; the returned function panics if they are not, or if it is called
+// twice.
+func TestingSetBoolScoped(s **BoolSetting, v bool) func() {
+	o := pushScopedOverride(s, *s, v)
+	restore := TestingSetBool(s, v)
+	return func() {
+		popScopedOverride(o)
+		restore()
+	}
+}
+
+// testingT is the subset of testing.TB used by TestingCheckScopedOverrides,
+// which keeps this package from depending on the testing package.
+type testingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// TestingCheckScopedOverrides fails a test which exits with an override made
+// by a TestingSet*Scoped function still active. Like leaktest.AfterTest, it is
+// used by calling
+//
+//   defer settings.TestingCheckScopedOverrides(t)()
+//
+// at the beginning of the test. Overrides which were already active when the
+// test began are ignored.
+func TestingCheckScopedOverrides(t testingT) func() {
+	scopedOverrides.Lock()
+	before := make(map[*scopedOverride]struct{}, len(scopedOverrides.active))
+	for _, o := range scopedOverrides.active {
+		before[o] = struct{}{}
+	}
+	scopedOverrides.Unlock()
+	return func() {
+		scopedOverrides.Lock()
+		defer scopedOverrides.Unlock()
+		for _, o := range scopedOverrides.active {
+			if _, ok := before[o]; !ok {
+				t.Errorf("setting override %s is still active", o.desc)
+			}
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package settings_test
 
 import (
+	"fmt"
 	"testing"
 	"time"
 	"unicode"
@@ -471,3 +472,89 @@ func TestHide(t *testing.T) {
 		t.Errorf("expected 'sekretz' to be hidden")
 	}
 }
+
+type recordingT struct {
+	errs []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func TestScopedOverrides(t *testing.T) {
+	defer settings.TestingCheckScopedOverrides(t)()
+
+	expectPanic := func(t *testing.T, re string, f func()) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				t.Fatalf("expected a panic matching %q", re)
+			}
+			if err := errors.Errorf("%v", r); !testutils.IsError(err, re) {
+				t.Fatalf("expected a panic matching %q, got %v", re, r)
+			}
+		}()
+		f()
+	}
+
+	t.Run("nested", func(t *testing.T) {
+		outer := settings.TestingSetBoolScoped(&boolFA, true)
+		inner := settings.TestingSetBoolScoped(&boolFA, false)
+		if expected, actual := false, boolFA.Get(); expected != actual {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+		inner()
+		if expected, actual := true, boolFA.Get(); expected != actual {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+		outer()
+		if expected, actual := false, boolFA.Get(); expected != actual {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	})
+
+	t.Run("independent", func(t *testing.T) {
+		// Overrides of different settings may be restored in any order.
+		f := settings.TestingSetBoolScoped(&boolFA, true)
+		g := settings.TestingSetBoolScoped(&boolTA, false)
+		f()
+		g()
+		if expected, actual := false, boolFA.Get(); expected != actual {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+		if expected, actual := true, boolTA.Get(); expected != actual {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		outer := settings.TestingSetBoolScoped(&boolFA, true)
+		inner := settings.TestingSetBoolScoped(&boolFA, false)
+		expectPanic(t, `override bool.f=true restored before the later override bool.f=false`, outer)
+		inner()
+		outer()
+	})
+
+	t.Run("twice", func(t *testing.T) {
+		f := settings.TestingSetBoolScoped(&boolFA, true)
+		f()
+		expectPanic(t, `override bool.f=true restored twice`, f)
+	})
+
+	t.Run("check", func(t *testing.T) {
+		var r recordingT
+		check := settings.TestingCheckScopedOverrides(&r)
+		f := settings.TestingSetBoolScoped(&boolFA, true)
+		check()
+		if len(r.errs) != 1 || r.errs[0] != "setting override bool.f=true is still active" {
+			t.Fatalf("expected the active override to be reported, got %q", r.errs)
+		}
+		f()
+
+		r.errs = nil
+		check()
+		if len(r.errs) != 0 {
+			t.Fatalf("expected no active overrides to be reported, got %q", r.errs)
+		}
+	})
+}
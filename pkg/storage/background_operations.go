@@ -0,0 +1,138 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// Purposes of the background operations started by this package.
+const (
+	// BackgroundOperationQueueProcessing is the purpose of the processing of a
+	// replica by a queue, whose owner is the queue.
+	BackgroundOperationQueueProcessing = "queue processing"
+	// BackgroundOperationForcedTimeSeriesMaintenance is the purpose of the
+	// time series maintenance of a replica forced by
+	// Store.ForceTimeSeriesMaintenance.
+	BackgroundOperationForcedTimeSeriesMaintenance = "forced time series maintenance"
+	// BackgroundOperationTimeSeriesSourcePrune is the purpose of the deletion
+	// of the time series data of sources from a replica by
+	// Store.PruneTimeSeriesSources.
+	BackgroundOperationTimeSeriesSourcePrune = "time series source prune"
+)
+
+// BackgroundOperation describes a long-running operation in flight on a
+// store, such as the processing of a replica by a queue or an incremental
+// iteration by an export. See Store.StartBackgroundOperation.
+type BackgroundOperation struct {
+	// Purpose describes what the operation does, and Owner what started it,
+	// such as a queue or an export.
+	Purpose string
+	Owner   string
+	// Span is the span of keys the operation reads or writes.
+	Span roachpb.Span
+	// StartTime and EndTime are the time window of an incremental iteration.
+	// They are zero for other operations.
+	StartTime, EndTime hlc.Timestamp
+	// Progress describes the progress of the operation, if it reports any.
+	Progress string
+	// Started is the time the operation started, and Elapsed the time it has
+	// been running since.
+	Started time.Time
+	Elapsed time.Duration
+	// TraceID is the ID of the trace of the operation, or zero if it isn't
+	// traced.
+	TraceID uint64
+}
+
+// backgroundOperations is the registry of the operations in flight on a
+// store.
+type backgroundOperations struct {
+	syncutil.Mutex
+	nextID int64
+	ops    map[int64]*backgroundOperation
+}
+
+type backgroundOperation struct {
+	BackgroundOperation
+	// progress, if set, returns the current Progress of the operation.
+	progress func() string
+}
+
+// StartBackgroundOperation registers a long-running operation, which is
+// listed by BackgroundOperations until the returned function is called once
+// it completes. The Started time and TraceID of the operation are set from
+// the clock and ctx. If progress is non-nil, it is called to describe the
+// progress of the operation whenever the operation is listed, and so must be
+// safe for concurrent use.
+func (s *Store) StartBackgroundOperation(
+	ctx context.Context, op BackgroundOperation, progress func() string,
+) (finish func()) {
+	op.Started = s.Clock().PhysicalTime()
+	op.TraceID = tracing.TraceIDFromContext(ctx)
+	s.backgroundOps.Lock()
+	if s.backgroundOps.ops == nil {
+		s.backgroundOps.ops = make(map[int64]*backgroundOperation)
+	}
+	s.backgroundOps.nextID++
+	id := s.backgroundOps.nextID
+	s.backgroundOps.ops[id] = &backgroundOperation{BackgroundOperation: op, progress: progress}
+	s.backgroundOps.Unlock()
+
+	if fn := s.cfg.TestingKnobs.BackgroundOperationStarted; fn != nil {
+		fn(op)
+	}
+	return func() {
+		s.backgroundOps.Lock()
+		delete(s.backgroundOps.ops, id)
+		s.backgroundOps.Unlock()
+	}
+}
+
+// BackgroundOperations returns a snapshot of the operations in flight on the
+// store, in the order they were started.
+func (s *Store) BackgroundOperations() []BackgroundOperation {
+	now := s.Clock().PhysicalTime()
+	s.backgroundOps.Lock()
+	ops := make([]*backgroundOperation, 0, len(s.backgroundOps.ops))
+	for _, op := range s.backgroundOps.ops {
+		ops = append(ops, op)
+	}
+	s.backgroundOps.Unlock()
+
+	res := make([]BackgroundOperation, len(ops))
+	for i, op := range ops {
+		res[i] = op.BackgroundOperation
+		res[i].Elapsed = now.Sub(op.Started)
+		if op.progress != nil {
+			res[i].Progress = op.progress()
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Started.Equal(res[j].Started) {
+			return res[i].Started.Before(res[j].Started)
+		}
+		return res[i].Purpose < res[j].Purpose
+	})
+	return res
+}
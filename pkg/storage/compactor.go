@@ -0,0 +1,120 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// maxPendingCompactionSuggestions is the maximum number of suggested
+// compactions awaiting processing. Further suggestions are dropped.
+const maxPendingCompactionSuggestions = 100
+
+// compactionSuggestion is a span of the engine which is expected to benefit
+// from compaction, along with an estimate of the bytes it would reclaim.
+type compactionSuggestion struct {
+	span  roachpb.Span
+	bytes int64
+}
+
+// compactor compacts spans of a store's engine which have been suggested by
+// the store, typically after large deletions. Without it, the space used by
+// deleted data is only reclaimed once RocksDB's own compactions happen to
+// touch the files containing it. Suggestions are processed one at a time by a
+// single worker, so that compactions don't compete with each other.
+type compactor struct {
+	// compactFn compacts a span of the engine.
+	compactFn func(from, to roachpb.Key, forceBottommost bool) error
+	// ch is signaled when a suggestion is added.
+	ch chan struct{}
+
+	mu struct {
+		syncutil.Mutex
+		pending []compactionSuggestion
+	}
+}
+
+func newCompactor(eng engine.Engine) *compactor {
+	return &compactor{
+		compactFn: eng.CompactRange,
+		ch:        make(chan struct{}, 1),
+	}
+}
+
+// suggest adds a suggested compaction. A suggestion for a span which is
+// already pending is merged into the pending suggestion.
+func (c *compactor) suggest(ctx context.Context, s compactionSuggestion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.mu.pending {
+		if c.mu.pending[i].span.Equal(s.span) {
+			c.mu.pending[i].bytes += s.bytes
+			return
+		}
+	}
+	if len(c.mu.pending) >= maxPendingCompactionSuggestions {
+		log.Warningf(ctx, "dropping suggested compaction of %s: %d suggestions pending",
+			s.span, len(c.mu.pending))
+		return
+	}
+	c.mu.pending = append(c.mu.pending, s)
+	select {
+	case c.ch <- struct{}{}:
+	default:
+	}
+}
+
+// start starts a worker which processes suggested compactions until the
+// stopper is stopped.
+func (c *compactor) start(ctx context.Context, stopper *stop.Stopper) {
+	stopper.RunWorker(ctx, func(ctx context.Context) {
+		for {
+			select {
+			case <-c.ch:
+				c.processPending(ctx, stopper)
+			case <-stopper.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// processPending compacts the spans of the pending suggestions.
+func (c *compactor) processPending(ctx context.Context, stopper *stop.Stopper) {
+	c.mu.Lock()
+	pending := c.mu.pending
+	c.mu.pending = nil
+	c.mu.Unlock()
+
+	for _, s := range pending {
+		select {
+		case <-stopper.ShouldQuiesce():
+			return
+		default:
+		}
+		log.VEventf(ctx, 2, "compacting %s to reclaim ~%d bytes", s.span, s.bytes)
+		// The deleted data is dropped as the tombstones above it are compacted
+		// into the bottommost level, which needn't be rewritten on its own.
+		if err := c.compactFn(s.span.Key, s.span.EndKey, false /* forceBottommost */); err != nil {
+			log.Warningf(ctx, "failed to compact %s: %s", s.span, err)
+		}
+	}
+}
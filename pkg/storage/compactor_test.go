@@ -0,0 +1,84 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// TestCompactorSuggestions verifies that suggested compactions are merged by
+// span, bounded in number, and compacted by the compactor's worker.
+func TestCompactorSuggestions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	var mu syncutil.Mutex
+	var compacted []roachpb.Span
+	c := &compactor{
+		compactFn: func(from, to roachpb.Key, _ bool) error {
+			mu.Lock()
+			defer mu.Unlock()
+			compacted = append(compacted, roachpb.Span{Key: from, EndKey: to})
+			return nil
+		},
+		ch: make(chan struct{}, 1),
+	}
+
+	spanA := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("b")}
+	spanB := roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("c")}
+	c.suggest(ctx, compactionSuggestion{span: spanA, bytes: 10})
+	c.suggest(ctx, compactionSuggestion{span: spanB, bytes: 20})
+	c.suggest(ctx, compactionSuggestion{span: spanA, bytes: 5})
+	expected := []compactionSuggestion{{span: spanA, bytes: 15}, {span: spanB, bytes: 20}}
+	if a := c.mu.pending; !reflect.DeepEqual(a, expected) {
+		t.Fatalf("expected pending suggestions %+v, got %+v", expected, a)
+	}
+
+	// Suggestions beyond the maximum are dropped.
+	for i := len(c.mu.pending); i < maxPendingCompactionSuggestions+10; i++ {
+		key := roachpb.Key{byte('d'), byte(i)}
+		c.suggest(ctx, compactionSuggestion{span: roachpb.Span{Key: key, EndKey: key.Next()}})
+	}
+	if a, e := len(c.mu.pending), maxPendingCompactionSuggestions; a != e {
+		t.Fatalf("expected %d pending suggestions, got %d", e, a)
+	}
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	c.start(ctx, stopper)
+	testutils.SucceedsSoon(t, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if a, e := len(compacted), maxPendingCompactionSuggestions; a != e {
+			return errors.Errorf("expected %d compactions, got %d", e, a)
+		}
+		return nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(compacted[:2], []roachpb.Span{spanA, spanB}) {
+		t.Fatalf("expected %s and %s to be compacted first, got %s", spanA, spanB, compacted[:2])
+	}
+}
@@ -28,10 +28,15 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 )
 
+// consistencyQueueMaintenanceSlots is the number of background maintenance
+// slots taken by a consistency check.
+const consistencyQueueMaintenanceSlots = 2
+
 type consistencyQueue struct {
 	*baseQueue
 	interval       time.Duration
 	replicaCountFn func() int
+	lastProcessed  *queueLastProcessedRegistry
 }
 
 // newConsistencyQueue returns a new instance of consistencyQueue.
@@ -46,12 +51,19 @@ func newConsistencyQueue(store *Store, gossip *gossip.Gossip) *consistencyQueue
 			maxSize:              defaultQueueMaxSize,
 			needsLease:           true,
 			acceptsUnsplitRanges: true,
+			historySize:          defaultQueueHistorySize,
 			successes:            store.metrics.ConsistencyQueueSuccesses,
 			failures:             store.metrics.ConsistencyQueueFailures,
 			pending:              store.metrics.ConsistencyQueuePending,
+			pendingHighWater:     store.metrics.ConsistencyQueuePendingHighWater,
+			sizeDropped:          store.metrics.ConsistencyQueueSizeDropped,
 			processingNanos:      store.metrics.ConsistencyQueueProcessingNanos,
+			timeouts:             store.metrics.ConsistencyQueueProcessTimeouts,
+			waitLatency:          store.metrics.ConsistencyQueueWaitLatency,
+			shouldQueueNanos:     store.metrics.ConsistencyQueueShouldQueueNanos,
 		},
 	)
+	q.lastProcessed = newQueueLastProcessedRegistry(store, q.name, store.DB())
 	return q
 }
 
@@ -60,11 +72,9 @@ func (q *consistencyQueue) shouldQueue(
 ) (bool, float64) {
 	shouldQ, priority := true, float64(0)
 	if !repl.store.cfg.TestingKnobs.DisableLastProcessedCheck {
-		lpTS, err := repl.getQueueLastProcessed(ctx, q.name)
-		if err != nil {
-			log.ErrEventf(ctx, "consistency queue last processed timestamp: %s", err)
-		}
-		if shouldQ, priority = shouldQueueAgain(now, lpTS, q.interval); !shouldQ {
+		shouldQ, priority = q.lastProcessed.ShouldProcessAgain(
+			ctx, repl.Desc(), now, q.interval, 0 /* jitterFraction */)
+		if !shouldQ {
 			return false, 0
 		}
 	}
@@ -84,14 +94,22 @@ func (q *consistencyQueue) shouldQueue(
 
 // process() is called on every range for which this node is a lease holder.
 func (q *consistencyQueue) process(
-	ctx context.Context, repl *Replica, _ config.SystemConfig,
+	ctx context.Context, repl *Replica, sysCfg config.SystemConfig,
 ) error {
+	// A consistency check reads all of the replica's data on every replica of
+	// the range, so it takes every background maintenance slot by default.
+	release, err := q.acquireMaintenanceSlots(ctx, repl, sysCfg, consistencyQueueMaintenanceSlots)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	req := roachpb.CheckConsistencyRequest{}
 	if _, pErr := repl.CheckConsistency(ctx, req); pErr != nil {
 		log.Error(ctx, pErr.GoError())
 	}
 	// Update the last processed time for this queue.
-	if err := repl.setQueueLastProcessed(ctx, q.name, repl.store.Clock().Now()); err != nil {
+	if err := q.lastProcessed.Set(ctx, repl.Desc(), repl.store.Clock().Now()); err != nil {
 		log.ErrEventf(ctx, "failed to update last processed time: %v", err)
 	}
 	return nil
@@ -0,0 +1,192 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// OutOfBoundsError is returned by a Reader restricted to a span of keys, such
+// as one created by Engine.NewSnapshotBounded, for a read outside of the span.
+type OutOfBoundsError struct {
+	Key    roachpb.Key
+	Bounds roachpb.Span
+}
+
+func (e *OutOfBoundsError) Error() string {
+	return fmt.Sprintf("key %s is outside of the reader's bounds %s", e.Key, e.Bounds)
+}
+
+// boundedReader restricts the reads of a Reader to the keys in [start, end).
+type boundedReader struct {
+	r      Reader
+	bounds roachpb.Span
+}
+
+var _ Reader = boundedReader{}
+
+// newBoundedReader returns a Reader which restricts the reads of the supplied
+// Reader to the keys in [start, end). Closing it closes the supplied Reader.
+func newBoundedReader(r Reader, start, end MVCCKey) Reader {
+	return boundedReader{r: r, bounds: roachpb.Span{Key: start.Key, EndKey: end.Key}}
+}
+
+// contains returns whether the key is within the bounds.
+func (b boundedReader) contains(key roachpb.Key) bool {
+	return key.Compare(b.bounds.Key) >= 0 && key.Compare(b.bounds.EndKey) < 0
+}
+
+// check returns an error if the key is outside of the bounds.
+func (b boundedReader) check(key roachpb.Key) error {
+	if !b.contains(key) {
+		return &OutOfBoundsError{Key: key, Bounds: b.bounds}
+	}
+	return nil
+}
+
+// checkSpan returns an error if the span [start, end) is not within the
+// bounds.
+func (b boundedReader) checkSpan(start, end roachpb.Key) error {
+	if err := b.check(start); err != nil {
+		return err
+	}
+	if end.Compare(b.bounds.EndKey) > 0 {
+		return &OutOfBoundsError{Key: end, Bounds: b.bounds}
+	}
+	return nil
+}
+
+func (b boundedReader) Close() {
+	b.r.Close()
+}
+
+func (b boundedReader) Closed() bool {
+	return b.r.Closed()
+}
+
+func (b boundedReader) Get(key MVCCKey) ([]byte, error) {
+	if err := b.check(key.Key); err != nil {
+		return nil, err
+	}
+	return b.r.Get(key)
+}
+
+func (b boundedReader) GetProto(
+	key MVCCKey, msg proto.Message,
+) (ok bool, keyBytes, valBytes int64, err error) {
+	if err := b.check(key.Key); err != nil {
+		return false, 0, 0, err
+	}
+	return b.r.GetProto(key, msg)
+}
+
+func (b boundedReader) Iterate(start, end MVCCKey, f func(MVCCKeyValue) (bool, error)) error {
+	if err := b.checkSpan(start.Key, end.Key); err != nil {
+		return err
+	}
+	return b.r.Iterate(start, end, f)
+}
+
+func (b boundedReader) NewIterator(prefix bool) Iterator {
+	return &boundedIterator{Iterator: b.r.NewIterator(prefix), reader: b}
+}
+
+func (b boundedReader) NewTimeBoundIterator(start, end hlc.Timestamp) Iterator {
+	return &boundedIterator{Iterator: b.r.NewTimeBoundIterator(start, end), reader: b}
+}
+
+// boundedIterator is an Iterator of a boundedReader. Seeking to a key before
+// the start of the bounds is an error, while an iterator which moves to or
+// past their end is exhausted, as if the end of the bounds were the end of the
+// engine. Stepping backwards out of the bounds exhausts the iterator too.
+type boundedIterator struct {
+	Iterator
+	reader boundedReader
+	err    error
+	// exhausted is set once the iterator is positioned outside of the
+	// bounds.
+	exhausted bool
+}
+
+func (i *boundedIterator) Seek(key MVCCKey) {
+	i.err, i.exhausted = nil, false
+	if key.Key.Compare(i.reader.bounds.Key) < 0 {
+		i.err = &OutOfBoundsError{Key: key.Key, Bounds: i.reader.bounds}
+		return
+	}
+	i.Iterator.Seek(key)
+	i.update()
+}
+
+func (i *boundedIterator) SeekReverse(key MVCCKey) {
+	i.err, i.exhausted = nil, false
+	if i.err = i.reader.check(key.Key); i.err != nil {
+		return
+	}
+	i.Iterator.SeekReverse(key)
+	i.update()
+}
+
+func (i *boundedIterator) Valid() (bool, error) {
+	if i.err != nil {
+		return false, i.err
+	}
+	if i.exhausted {
+		return false, nil
+	}
+	return i.Iterator.Valid()
+}
+
+func (i *boundedIterator) Next() {
+	i.Iterator.Next()
+	i.update()
+}
+
+func (i *boundedIterator) Prev() {
+	i.Iterator.Prev()
+	i.update()
+}
+
+func (i *boundedIterator) NextKey() {
+	i.Iterator.NextKey()
+	i.update()
+}
+
+func (i *boundedIterator) PrevKey() {
+	i.Iterator.PrevKey()
+	i.update()
+}
+
+func (i *boundedIterator) ComputeStats(
+	start, end MVCCKey, nowNanos int64,
+) (enginepb.MVCCStats, error) {
+	if err := i.reader.checkSpan(start.Key, end.Key); err != nil {
+		return enginepb.MVCCStats{}, err
+	}
+	return i.Iterator.ComputeStats(start, end, nowNanos)
+}
+
+// update marks the iterator as exhausted if it was moved out of the bounds.
+func (i *boundedIterator) update() {
+	if ok, err := i.Iterator.Valid(); err == nil && ok {
+		i.exhausted = !i.reader.contains(i.Iterator.UnsafeKey().Key)
+	}
+}
@@ -16,8 +16,12 @@
 // Author: Spencer Kimball (spencer.kimball@gmail.com)
 
 #include <algorithm>
+#include <cstdlib>
+#include <map>
+#include <mutex>
 #include <google/protobuf/stubs/stringprintf.h>
 #include "rocksdb/cache.h"
+#include "rocksdb/compaction_filter.h"
 #include "rocksdb/db.h"
 #include "rocksdb/env.h"
 #include "rocksdb/filter_policy.h"
@@ -45,6 +49,8 @@ struct DBCache {
   std::shared_ptr<rocksdb::Cache> rep;
 };
 
+class TimeSeriesCutoffs;
+
 struct DBEngine {
   rocksdb::DB* const rep;
 
@@ -64,9 +70,17 @@ struct DBEngine {
   virtual DBIterator* NewIter(rocksdb::ReadOptions*) = 0;
   virtual DBStatus GetStats(DBStatsResult* stats) = 0;
   virtual DBStatus EnvWriteFile(DBSlice path, DBSlice contents) = 0;
+  virtual DBStatus SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n) = 0;
 
   DBSSTable* GetSSTables(int* n);
   DBString GetUserProperties();
+
+  // sst_props caches the properties of the live sstables by their paths, as
+  // reading them for every call of GetSSTables, as on every metrics tick,
+  // is expensive. The sstables are immutable, so the properties are only read
+  // again once flushes, compactions or ingestions change the live sstables.
+  std::mutex sst_props_mu;
+  rocksdb::TablePropertiesCollection sst_props;
 };
 
 struct DBImpl : public DBEngine {
@@ -74,17 +88,20 @@ struct DBImpl : public DBEngine {
   std::unique_ptr<rocksdb::DB> rep_deleter;
   std::shared_ptr<rocksdb::Cache> block_cache;
   std::shared_ptr<DBEventListener> event_listener;
+  std::shared_ptr<TimeSeriesCutoffs> ts_cutoffs;
 
   // Construct a new DBImpl from the specified DB and Env. Both the DB
   // and Env will be deleted when the DBImpl is deleted. It is ok to
   // pass NULL for the Env.
   DBImpl(rocksdb::DB* r, rocksdb::Env* m, std::shared_ptr<rocksdb::Cache> bc,
-    std::shared_ptr<DBEventListener> event_listener)
+    std::shared_ptr<DBEventListener> event_listener,
+    std::shared_ptr<TimeSeriesCutoffs> ts_cutoffs)
       : DBEngine(r),
         memenv(m),
         rep_deleter(r),
         block_cache(bc),
-        event_listener(event_listener) {
+        event_listener(event_listener),
+        ts_cutoffs(ts_cutoffs) {
   }
   virtual ~DBImpl() {
     const rocksdb::Options &opts = rep->GetOptions();
@@ -105,10 +122,12 @@ struct DBImpl : public DBEngine {
   virtual DBIterator* NewIter(rocksdb::ReadOptions*);
   virtual DBStatus GetStats(DBStatsResult* stats);
   virtual DBStatus EnvWriteFile(DBSlice path, DBSlice contents);
+  virtual DBStatus SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n);
 };
 
 struct DBBatch : public DBEngine {
   int updates;
+  bool has_delete_range;
   rocksdb::WriteBatchWithIndex batch;
 
   DBBatch(DBEngine* db);
@@ -126,6 +145,7 @@ struct DBBatch : public DBEngine {
   virtual DBIterator* NewIter(rocksdb::ReadOptions*);
   virtual DBStatus GetStats(DBStatsResult* stats);
   virtual DBStatus EnvWriteFile(DBSlice path, DBSlice contents);
+  virtual DBStatus SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n);
 };
 
 struct DBWriteOnlyBatch : public DBEngine {
@@ -147,6 +167,7 @@ struct DBWriteOnlyBatch : public DBEngine {
   virtual DBIterator* NewIter(rocksdb::ReadOptions*);
   virtual DBStatus GetStats(DBStatsResult* stats);
   virtual DBStatus EnvWriteFile(DBSlice path, DBSlice contents);
+  virtual DBStatus SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n);
 };
 
 struct DBSnapshot : public DBEngine {
@@ -170,6 +191,7 @@ struct DBSnapshot : public DBEngine {
   virtual DBIterator* NewIter(rocksdb::ReadOptions*);
   virtual DBStatus GetStats(DBStatsResult* stats);
   virtual DBStatus EnvWriteFile(DBSlice path, DBSlice contents);
+  virtual DBStatus SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n);
 };
 
 struct DBIterator {
@@ -1340,11 +1362,65 @@ class BaseDeltaIterator : public rocksdb::Iterator {
   rocksdb::Slice prefix_start_key_;
 };
 
+// DecodeTableTimestamp decodes the timestamp stored in the named user
+// property of an sstable, returning false if it is absent or malformed.
+bool DecodeTableTimestamp(const rocksdb::UserCollectedProperties& userprops,
+                          const std::string& name, DBTimestamp* ts) {
+  auto prop = userprops.find(name);
+  if (prop == userprops.end() || prop->second.empty()) {
+    return false;
+  }
+  rocksdb::Slice buf(prop->second);
+  return DecodeTimestamp(&buf, &ts->wall_time, &ts->logical);
+}
+
+// DecodeTableCount decodes the count stored in the named user property of
+// an sstable, returning false if it is absent or malformed.
+bool DecodeTableCount(const rocksdb::UserCollectedProperties& userprops,
+                      const std::string& name, int64_t* count) {
+  auto prop = userprops.find(name);
+  if (prop == userprops.end() || prop->second.empty()) {
+    return false;
+  }
+  char* end;
+  *count = strtoll(prop->second.c_str(), &end, 10);
+  return *end == '\0';
+}
+
+// DecodeExternalFileVersion returns the version of the external sstable
+// format of an ingested sstable, which rocksdb::SstFileWriter stores as a
+// fixed32, or 0 for an sstable written by the engine.
+int DecodeExternalFileVersion(const rocksdb::UserCollectedProperties& userprops) {
+  auto prop = userprops.find("rocksdb.external_sst_file.version");
+  if (prop == userprops.end() || prop->second.size() != 4) {
+    return 0;
+  }
+  const unsigned char* p = reinterpret_cast<const unsigned char*>(prop->second.data());
+  return p[0] | (p[1] << 8) | (p[2] << 16) | (p[3] << 24);
+}
+
 }  // namespace
 
 DBSSTable* DBEngine::GetSSTables(int* n) {
   std::vector<rocksdb::LiveFileMetaData> metadata;
   rep->GetLiveFilesMetaData(&metadata);
+  // The properties are keyed by the path of the sstable. If they can't be
+  // read, the sstables are reported without timestamps.
+  rocksdb::TablePropertiesCollection props;
+  {
+    std::lock_guard<std::mutex> guard(sst_props_mu);
+    bool stale = sst_props.size() != metadata.size();
+    for (int i = 0; !stale && i < metadata.size(); i++) {
+      stale = sst_props.count(metadata[i].db_path + metadata[i].name) == 0;
+    }
+    if (stale) {
+      sst_props.clear();
+      if (!rep->GetPropertiesOfAllTables(&sst_props).ok()) {
+        sst_props.clear();
+      }
+    }
+    props = sst_props;
+  }
   *n = metadata.size();
   // We malloc the result so it can be deallocated by the caller using free().
   const int size = metadata.size() * sizeof(DBSSTable);
@@ -1367,6 +1443,24 @@ DBSSTable* DBEngine::GetSSTables(int* n) {
       DBString str = ToDBString(tmp);
       tables[i].end_key.key = DBSlice{str.data, str.len};
     }
+
+    const std::string path = metadata[i].db_path + metadata[i].name;
+    tables[i].path = ToDBString(path);
+    auto tbl = props.find(path);
+    if (tbl != props.end()) {
+      auto userprops = tbl->second->user_collected_properties;
+      tables[i].has_timestamps =
+          DecodeTableTimestamp(userprops, "crdb.ts.min", &tables[i].ts_min) &&
+          DecodeTableTimestamp(userprops, "crdb.ts.max", &tables[i].ts_max);
+      tables[i].format_version = tbl->second->format_version;
+      tables[i].external_version = DecodeExternalFileVersion(userprops);
+      tables[i].has_key_counts =
+          DecodeTableCount(userprops, "crdb.num.unversioned", &tables[i].unversioned_keys) &&
+          DecodeTableCount(userprops, "crdb.num.shadowed", &tables[i].shadowed_versions);
+      tables[i].num_entries = tbl->second->num_entries;
+      tables[i].raw_key_size = tbl->second->raw_key_size;
+      tables[i].raw_value_size = tbl->second->raw_value_size;
+    }
   }
   return tables;
 }
@@ -1412,6 +1506,7 @@ DBString DBEngine::GetUserProperties() {
 DBBatch::DBBatch(DBEngine* db)
     : DBEngine(db->rep),
       updates(0),
+      has_delete_range(false),
       batch(&kComparator) {
 }
 
@@ -1446,23 +1541,36 @@ class TimeBoundTblPropCollector : public rocksdb::TablePropertiesCollector {
     *properties = rocksdb::UserCollectedProperties{
         {"crdb.ts.min", ts_min_},
         {"crdb.ts.max", ts_max_},
+        {"crdb.num.unversioned", std::to_string(unversioned_)},
+        {"crdb.num.shadowed", std::to_string(shadowed_)},
     };
     return rocksdb::Status::OK();
   }
 
   rocksdb::Status AddUserKey(const rocksdb::Slice& user_key, const rocksdb::Slice& value, rocksdb::EntryType type,
                     rocksdb::SequenceNumber seq, uint64_t file_size) override {
-    rocksdb::Slice unused;
+    rocksdb::Slice key;
     rocksdb::Slice ts;
-    if (SplitKey(user_key, &unused, &ts) && !ts.empty()) {
-      ts.remove_prefix(1);  // The NUL prefix.
-      if (ts_max_.empty() || ts.compare(ts_max_) > 0) {
-        ts_max_.assign(ts.data(), ts.size());
-      }
-      if (ts_min_.empty() || ts.compare(ts_min_) < 0) {
-        ts_min_.assign(ts.data(), ts.size());
+    if (!SplitKey(user_key, &key, &ts)) {
+      return rocksdb::Status::OK();
+    }
+    if (ts.empty()) {
+      // An intent or an inline value.
+      unversioned_++;
+      if (type == rocksdb::kEntryPut) {
+        AddIntentTimestamp(value);
       }
+      return rocksdb::Status::OK();
     }
+    // The versions of a key are added newest first, so every version after
+    // the first is shadowed by a newer one in the same sstable.
+    if (key.compare(last_key_) == 0) {
+      shadowed_++;
+    } else {
+      last_key_.assign(key.data(), key.size());
+    }
+    ts.remove_prefix(1);  // The NUL prefix.
+    UpdateBounds(ts);
     return rocksdb::Status::OK();
   }
 
@@ -1471,8 +1579,36 @@ class TimeBoundTblPropCollector : public rocksdb::TablePropertiesCollector {
   }
 
  private:
+  void UpdateBounds(const rocksdb::Slice& ts) {
+    if (ts_max_.empty() || ts.compare(ts_max_) > 0) {
+      ts_max_.assign(ts.data(), ts.size());
+    }
+    if (ts_min_.empty() || ts.compare(ts_min_) < 0) {
+      ts_min_.assign(ts.data(), ts.size());
+    }
+  }
+
+  // AddIntentTimestamp includes the timestamp of an intent in the bounds of
+  // the sstable holding its metadata. The metadata is stored under a key
+  // without a timestamp, and its provisional value may be in another
+  // sstable, so without it a time-bound iterator could skip the sstable
+  // and miss the conflict with the intent.
+  void AddIntentTimestamp(const rocksdb::Slice& value) {
+    cockroach::storage::engine::enginepb::MVCCMetadata meta;
+    if (!meta.ParseFromArray(value.data(), value.size()) || !meta.has_txn()) {
+      return;
+    }
+    std::string ts;
+    EncodeTimestamp(ts, meta.timestamp().wall_time(), meta.timestamp().logical());
+    UpdateBounds(ts);
+  }
+
   std::string ts_min_;
   std::string ts_max_;
+  // last_key_ is the key of the last version added.
+  std::string last_key_;
+  int64_t unversioned_ = 0;
+  int64_t shadowed_ = 0;
 };
 
 class TimeBoundTblPropCollectorFactory : public rocksdb::TablePropertiesCollectorFactory {
@@ -1487,6 +1623,123 @@ class TimeBoundTblPropCollectorFactory : public rocksdb::TablePropertiesCollecto
   }
 };
 
+// kTimeSeriesPrefix is the prefix of the keys of time series data, the Go
+// keys.TimeseriesPrefix.
+const rocksdb::Slice kTimeSeriesPrefix("\x04tsd", 4);
+
+// TimeSeriesCutoffs are the oldest time slots of the time series data, by
+// resolution, which the compactions of a database retain. They are set from
+// Go, and read by each compaction as it starts.
+class TimeSeriesCutoffs {
+ public:
+  void Set(const DBTimeSeriesCutoff* cutoffs, int n) {
+    std::map<int64_t, int64_t> m;
+    for (int i = 0; i < n; i++) {
+      m[cutoffs[i].resolution] = cutoffs[i].min_timeslot;
+    }
+    std::lock_guard<std::mutex> guard(mu_);
+    cutoffs_.swap(m);
+  }
+
+  std::map<int64_t, int64_t> Get() const {
+    std::lock_guard<std::mutex> guard(mu_);
+    return cutoffs_;
+  }
+
+ private:
+  mutable std::mutex mu_;
+  std::map<int64_t, int64_t> cutoffs_;
+};
+
+// TimeSeriesCompactionFilter drops the time series data older than the
+// cutoffs of its resolution. The maintenance queue prunes such data by
+// deleting it, but the data and the tombstones deleting it linger until they
+// are compacted together into the bottommost level. Dropping the data as it
+// is compacted into the bottommost level spares the compactions which reach
+// it before the tombstones from rewriting it. Data is only dropped by the
+// compactions whose output is the bottommost level, whose input level is the
+// last or second to last: no older version of a key lies below their output,
+// so dropping a version can't expose one, and the data is only dropped once
+// it has settled rather than on every level it passes through. Keys which
+// can't be decoded as time series keys are kept.
+//
+// As each store compacts its engine independently, the replicas of a range
+// may disagree on the time series data which remains, and its MVCC stats
+// count the data dropped until the maintenance queue deletes it; see
+// timeSeriesCompactionFilterEnabled in Go.
+class TimeSeriesCompactionFilter : public rocksdb::CompactionFilter {
+ public:
+  TimeSeriesCompactionFilter(std::map<int64_t, int64_t> cutoffs, int num_levels)
+      : cutoffs_(std::move(cutoffs)),
+        num_levels_(num_levels) {
+  }
+
+  const char* Name() const override { return "TimeSeriesCompactionFilter"; }
+
+  Decision FilterV2(int level, const rocksdb::Slice& key, ValueType value_type,
+                    const rocksdb::Slice& existing_value, std::string* new_value,
+                    std::string* skip_until) const override {
+    // The level is the input level of the compaction, whose output is the
+    // next level, or the same one for the last level.
+    if (level < num_levels_ - 2) {
+      return Decision::kKeep;
+    }
+    return Expired(key) ? Decision::kRemove : Decision::kKeep;
+  }
+
+ private:
+  bool Expired(const rocksdb::Slice& encoded_key) const {
+    rocksdb::Slice key;
+    rocksdb::Slice ts;
+    if (!SplitKey(encoded_key, &key, &ts) || !key.starts_with(kTimeSeriesPrefix)) {
+      return false;
+    }
+    // The key is the prefix followed by the name of the series, its
+    // resolution and the time slot of its data, and its source.
+    key.remove_prefix(kTimeSeriesPrefix.size());
+    int64_t resolution;
+    int64_t timeslot;
+    if (!SkipBytesAscending(&key) ||
+        !DecodeVarintAscending(&key, &resolution) ||
+        !DecodeVarintAscending(&key, &timeslot)) {
+      return false;
+    }
+    const auto it = cutoffs_.find(resolution);
+    return it != cutoffs_.end() && timeslot < it->second;
+  }
+
+  const std::map<int64_t, int64_t> cutoffs_;
+  const int num_levels_;
+};
+
+class TimeSeriesCompactionFilterFactory : public rocksdb::CompactionFilterFactory {
+ public:
+  TimeSeriesCompactionFilterFactory(std::shared_ptr<TimeSeriesCutoffs> cutoffs, int num_levels)
+      : cutoffs_(cutoffs),
+        num_levels_(num_levels) {
+  }
+
+  std::unique_ptr<rocksdb::CompactionFilter> CreateCompactionFilter(
+      const rocksdb::CompactionFilter::Context& context) override {
+    std::map<int64_t, int64_t> cutoffs = cutoffs_->Get();
+    if (cutoffs.empty()) {
+      // Without cutoffs, everything is retained, and compactions are left
+      // unfiltered.
+      return nullptr;
+    }
+    return std::unique_ptr<rocksdb::CompactionFilter>(
+        new TimeSeriesCompactionFilter(std::move(cutoffs), num_levels_));
+  }
+
+  const char* Name() const override {
+    return "TimeSeriesCompactionFilterFactory";
+  }
+
+ private:
+  const std::shared_ptr<TimeSeriesCutoffs> cutoffs_;
+  const int num_levels_;
+};
+
 rocksdb::Options DBMakeOptions(DBOptions db_opts) {
   rocksdb::BlockBasedTableOptions table_options;
   if (db_opts.cache != nullptr) {
@@ -1630,6 +1883,12 @@ DBStatus DBOpen(DBEngine **db, DBSlice dir, DBOptions db_opts) {
   std::shared_ptr<DBEventListener> event_listener(new DBEventListener);
   options.listeners.emplace_back(event_listener);
 
+  // Drop the time series data older than the cutoffs set by
+  // DBSetTimeSeriesCutoffs, of which there are none to begin with.
+  std::shared_ptr<TimeSeriesCutoffs> ts_cutoffs(new TimeSeriesCutoffs);
+  options.compaction_filter_factory.reset(
+      new TimeSeriesCompactionFilterFactory(ts_cutoffs, options.num_levels));
+
   std::unique_ptr<rocksdb::Env> memenv;
   if (dir.len == 0) {
     memenv.reset(rocksdb::NewMemEnv(rocksdb::Env::Default()));
@@ -1643,7 +1902,7 @@ DBStatus DBOpen(DBEngine **db, DBSlice dir, DBOptions db_opts) {
   }
   *db = new DBImpl(db_ptr, memenv.release(),
       db_opts.cache != nullptr ? db_opts.cache->rep : nullptr,
-      event_listener);
+      event_listener, ts_cutoffs);
   return kSuccess;
 }
 
@@ -1673,6 +1932,51 @@ DBStatus DBCompact(DBEngine* db) {
   return ToDBStatus(db->rep->CompactRange(options, NULL, NULL));
 }
 
+DBStatus DBCompactRange(DBEngine* db, DBKey start, DBKey end, bool force_bottommost) {
+  rocksdb::CompactRangeOptions options;
+  // See DBCompact. Forcing the compaction of the bottom level is necessary
+  // for deletion tombstones in the range to be dropped, and for sstables
+  // written before a change of settings or table property collectors to be
+  // rewritten. Otherwise, it is skipped explicitly, as by default it is
+  // compacted whenever there is a compaction filter, which there always is.
+  options.bottommost_level_compaction = rocksdb::BottommostLevelCompaction::kSkip;
+  if (force_bottommost) {
+    options.bottommost_level_compaction = rocksdb::BottommostLevelCompaction::kForce;
+  }
+  const std::string start_key = EncodeKey(start);
+  const std::string end_key = EncodeKey(end);
+  const rocksdb::Slice start_slice(start_key);
+  const rocksdb::Slice end_slice(end_key);
+  return ToDBStatus(db->rep->CompactRange(options, &start_slice, &end_slice));
+}
+
+DBStatus DBSetTimeSeriesCutoffs(DBEngine* db, DBTimeSeriesCutoff* cutoffs, int num_cutoffs) {
+  return db->SetTimeSeriesCutoffs(cutoffs, num_cutoffs);
+}
+
+DBStatus DBApproximateDiskBytes(DBEngine* db, DBKey start, DBKey end, uint64_t* size) {
+  const std::string start_key = EncodeKey(start);
+  const std::string end_key = EncodeKey(end);
+  const rocksdb::Range r(start_key, end_key);
+  const uint8_t flags = rocksdb::DB::SizeApproximationFlags::INCLUDE_FILES |
+      rocksdb::DB::SizeApproximationFlags::INCLUDE_MEMTABLES;
+  db->rep->GetApproximateSizes(&r, 1, size, flags);
+  return kSuccess;
+}
+
+DBStatus DBMemTableOverlaps(DBEngine* db, DBKey start, DBKey end, bool* overlaps) {
+  // A memtable-only iterator sees just the keys which haven't been flushed
+  // to sstables, including those in the immutable memtables.
+  rocksdb::ReadOptions opts;
+  opts.read_tier = rocksdb::kMemtableTier;
+  opts.total_order_seek = true;
+  std::unique_ptr<rocksdb::Iterator> iter(db->rep->NewIterator(opts));
+  const std::string end_key = EncodeKey(end);
+  iter->Seek(EncodeKey(start));
+  *overlaps = iter->Valid() && kComparator.Compare(iter->key(), end_key) < 0;
+  return ToDBStatus(iter->status());
+}
+
 DBStatus DBImpl::Put(DBKey key, DBSlice value) {
   rocksdb::WriteOptions options;
   return ToDBStatus(rep->Put(options, EncodeKey(key), ToSlice(value)));
@@ -1730,6 +2034,9 @@ DBStatus DBImpl::Get(DBKey key, DBString* value) {
 }
 
 DBStatus DBBatch::Get(DBKey key, DBString* value) {
+  if (has_delete_range) {
+    return FmtStatus("cannot read from a batch containing delete range entries");
+  }
   rocksdb::ReadOptions read_opts;
   DBGetter base(rep, read_opts, EncodeKey(key));
   if (updates == 0) {
@@ -1783,10 +2090,14 @@ DBStatus DBImpl::DeleteRange(DBKey start, DBKey end) {
 }
 
 DBStatus DBBatch::DeleteRange(DBKey start, DBKey end) {
-  // TODO(peter): We don't support iteration on a batch containing a
-  // range tombstone, so prohibit such tombstones from behing added to
-  // a readable batch.
-  return FmtStatus("unsupported");
+  // The range tombstone is added to the underlying WriteBatch, bypassing
+  // the index which does not support them. We don't support reads from a
+  // batch containing a range tombstone, so all subsequent reads from the
+  // batch fail.
+  ++updates;
+  has_delete_range = true;
+  batch.GetWriteBatch()->DeleteRange(EncodeKey(start), EncodeKey(end));
+  return kSuccess;
 }
 
 DBStatus DBWriteOnlyBatch::DeleteRange(DBKey start, DBKey end) {
@@ -1941,6 +2252,11 @@ DBIterator* DBImpl::NewIter(rocksdb::ReadOptions* read_opts) {
 
 DBIterator* DBBatch::NewIter(rocksdb::ReadOptions* read_opts) {
   DBIterator* iter = new DBIterator;
+  if (has_delete_range) {
+    iter->rep.reset(rocksdb::NewErrorIterator(rocksdb::Status::NotSupported(
+        "cannot read from a batch containing delete range entries")));
+    return iter;
+  }
   rocksdb::Iterator* base = rep->NewIterator(*read_opts);
   rocksdb::WBWIIterator* delta = batch.NewIterator();
   iter->rep.reset(new BaseDeltaIterator(base, delta, read_opts->prefix_same_as_start));
@@ -1970,6 +2286,16 @@ DBStatus DBImpl::GetStats(DBStatsResult* stats) {
   std::string table_readers_mem_estimate;
   rep->GetProperty("rocksdb.estimate-table-readers-mem", &table_readers_mem_estimate);
 
+  std::string l0_file_count;
+  rep->GetProperty("rocksdb.num-files-at-level0", &l0_file_count);
+
+  uint64_t write_stopped = 0;
+  rep->GetIntProperty("rocksdb.is-write-stopped", &write_stopped);
+  uint64_t delayed_write_rate = 0;
+  rep->GetIntProperty("rocksdb.actual-delayed-write-rate", &delayed_write_rate);
+  uint64_t pending_compaction_bytes = 0;
+  rep->GetIntProperty("rocksdb.estimate-pending-compaction-bytes", &pending_compaction_bytes);
+
   stats->block_cache_hits = (int64_t)s->getTickerCount(rocksdb::BLOCK_CACHE_HIT);
   stats->block_cache_misses = (int64_t)s->getTickerCount(rocksdb::BLOCK_CACHE_MISS);
   stats->block_cache_usage = (int64_t)block_cache->GetUsage();
@@ -1984,6 +2310,11 @@ DBStatus DBImpl::GetStats(DBStatsResult* stats) {
   stats->flushes = (int64_t)event_listener->GetFlushes();
   stats->compactions = (int64_t)event_listener->GetCompactions();
   stats->table_readers_mem_estimate = std::stoll(table_readers_mem_estimate);
+  stats->write_stopped = write_stopped != 0;
+  stats->write_delayed = delayed_write_rate != 0;
+  stats->pending_compaction_bytes_estimate = (int64_t)pending_compaction_bytes;
+  stats->l0_file_count = std::stoll(l0_file_count);
+  stats->keys_written = (int64_t)s->getTickerCount(rocksdb::NUMBER_KEYS_WRITTEN);
   return kSuccess;
 }
 
@@ -2030,10 +2361,31 @@ DBStatus DBSnapshot::EnvWriteFile(DBSlice path, DBSlice contents) {
   return FmtStatus("unsupported");
 }
 
+DBStatus DBImpl::SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n) {
+  ts_cutoffs->Set(cutoffs, n);
+  return kSuccess;
+}
+
+DBStatus DBBatch::SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n) {
+  return FmtStatus("unsupported");
+}
+
+DBStatus DBWriteOnlyBatch::SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n) {
+  return FmtStatus("unsupported");
+}
+
+DBStatus DBSnapshot::SetTimeSeriesCutoffs(const DBTimeSeriesCutoff* cutoffs, int n) {
+  return FmtStatus("unsupported");
+}
+
 DBStatus DBEnvWriteFile(DBEngine* db, DBSlice path, DBSlice contents) {
   return db->EnvWriteFile(path, contents);
 }
 
+DBStatus DBEnvDeleteFile(DBEngine* db, DBSlice path) {
+  return ToDBStatus(db->rep->GetEnv()->DeleteFile(ToString(path)));
+}
+
 DBIterator* DBNewIter(DBEngine* db, bool prefix) {
   rocksdb::ReadOptions opts;
   opts.prefix_same_as_start = prefix;
@@ -2041,12 +2393,20 @@ DBIterator* DBNewIter(DBEngine* db, bool prefix) {
   return db->NewIter(&opts);
 }
 
-DBIterator* DBNewTimeBoundIter(DBEngine* db, DBTimestamp min_ts, DBTimestamp max_ts) {
-  const std::string min = EncodeTimestamp(min_ts);
-  const std::string max = EncodeTimestamp(max_ts);
+// TimestampWindowOverlaps returns whether any of the encoded timestamps
+// [min, max] is in the window with the encoded bounds [start, end). It must
+// agree with hlc.TimestampWindow.Overlaps.
+bool TimestampWindowOverlaps(const std::string& start, const std::string& end,
+                             const std::string& min, const std::string& max) {
+  return start.compare(end) < 0 && end.compare(min) > 0 && start.compare(max) <= 0;
+}
+
+DBIterator* DBNewTimeBoundIter(DBEngine* db, DBTimestampWindow window) {
+  const std::string start = EncodeTimestamp(window.start);
+  const std::string end = EncodeTimestamp(window.end);
   rocksdb::ReadOptions opts;
   opts.total_order_seek = true;
-  opts.table_filter = [min, max](const rocksdb::TableProperties& props) {
+  opts.table_filter = [start, end](const rocksdb::TableProperties& props) {
     auto userprops = props.user_collected_properties;
     auto tbl_min = userprops.find("crdb.ts.min");
     if (tbl_min == userprops.end() || tbl_min->second.empty()) {
@@ -2056,9 +2416,9 @@ DBIterator* DBNewTimeBoundIter(DBEngine* db, DBTimestamp min_ts, DBTimestamp max
     if (tbl_max == userprops.end() || tbl_max->second.empty()) {
       return true;
     }
-    // If the timestamp range of the table overlaps with the timestamp range we
-    // want to iterate, the table might contain timestamps we care about.
-    return max.compare(tbl_min->second) >= 0 && min.compare(tbl_max->second) <= 0;
+    // If the timestamp range of the table overlaps with the window we want to
+    // iterate, the table might contain timestamps we care about.
+    return TimestampWindowOverlaps(start, end, tbl_min->second, tbl_max->second);
   };
   return db->NewIter(&opts);
 }
@@ -2323,13 +2683,14 @@ DBString DBGetUserProperties(DBEngine* db) {
   return db->GetUserProperties();
 }
 
-DBStatus DBIngestExternalFile(DBEngine* db, DBSlice path) {
+DBStatus DBIngestExternalFile(DBEngine* db, DBSlice path, bool move_file, bool allow_global_seqno,
+                              bool allow_blocking_flush) {
   const std::vector<std::string> paths = { ToString(path) };
   rocksdb::IngestExternalFileOptions ifo;
-  ifo.move_files = false;
+  ifo.move_files = move_file;
   ifo.snapshot_consistency = true;
-  ifo.allow_global_seqno = false;
-  ifo.allow_blocking_flush = false;
+  ifo.allow_global_seqno = allow_global_seqno;
+  ifo.allow_blocking_flush = allow_blocking_flush;
 
   rocksdb::Status status = db->rep->IngestExternalFile(
       db->rep->DefaultColumnFamily(), paths, ifo);
@@ -2362,12 +2723,17 @@ DBSstFileWriter* DBSstFileWriterNew() {
   // The original LevelDB compatible format. We explicitly set the checksum too
   // to guard against the silent version upconversion. See
   // https://github.com/facebook/rocksdb/blob/972f96b3fbae1a4675043bdf4279c9072ad69645/include/rocksdb/table.h#L198
+  // Keep in sync with SstFileWriterFormatVersion.
   table_options.format_version = 0;
   table_options.checksum = rocksdb::kCRC32c;
 
   rocksdb::Options* options = new rocksdb::Options();
   options->comparator = &kComparator;
   options->table_factory.reset(rocksdb::NewBlockBasedTableFactory(table_options));
+  // Record the same properties as the engine's sstables, so that ingested
+  // sstables can be skipped by time-bound iterators too.
+  options->table_properties_collector_factories.emplace_back(
+      new TimeBoundTblPropCollectorFactory());
 
   return new DBSstFileWriter(options);
 }
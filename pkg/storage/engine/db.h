@@ -54,6 +54,13 @@ typedef struct {
   int32_t logical;
 } DBTimestamp;
 
+// DBTimestampWindow is the time range [start, end) of an incremental
+// iteration. See hlc.TimestampWindow.
+typedef struct {
+  DBTimestamp start;
+  DBTimestamp end;
+} DBTimestampWindow;
+
 typedef struct {
   bool valid;
   DBKey key;
@@ -106,6 +113,34 @@ DBStatus DBFlush(DBEngine* db);
 // Forces an immediate compaction over all keys.
 DBStatus DBCompact(DBEngine* db);
 
+// Forces an immediate compaction over the keys in the range [start,end). The
+// sstables of the bottommost level are only rewritten if they overlap
+// sstables of other levels, unless force_bottommost is set.
+DBStatus DBCompactRange(DBEngine* db, DBKey start, DBKey end, bool force_bottommost);
+
+// DBTimeSeriesCutoff is the oldest time slot of the time series data at a
+// resolution which the compactions of a database retain. The resolution and
+// time slot are those encoded in the time series keys.
+typedef struct {
+  int64_t resolution;
+  int64_t min_timeslot;
+} DBTimeSeriesCutoff;
+
+// Sets the cutoffs below which the compactions of a database drop time
+// series data, replacing the previous ones. The data of a resolution without
+// a cutoff, and all of it if there are none, is retained, which is the case
+// until the cutoffs are first set. Only a database created by DBOpen()
+// supports cutoffs.
+DBStatus DBSetTimeSeriesCutoffs(DBEngine* db, DBTimeSeriesCutoff* cutoffs, int num_cutoffs);
+
+// Stores the approximate number of bytes on disk, including data in the
+// mem-tables, occupied by the keys in the range [start,end) in "size".
+DBStatus DBApproximateDiskBytes(DBEngine* db, DBKey start, DBKey end, uint64_t* size);
+
+// Sets overlaps if the memtables, which hold the writes not yet flushed to
+// sstables, contain a key in the range [start, end).
+DBStatus DBMemTableOverlaps(DBEngine* db, DBKey start, DBKey end, bool* overlaps);
+
 // Sets the database entry for "key" to "value".
 DBStatus DBPut(DBEngine* db, DBKey key, DBSlice value);
 
@@ -167,7 +202,11 @@ DBEngine* DBNewBatch(DBEngine* db, bool writeOnly);
 // DBIterDestroy().
 DBIterator* DBNewIter(DBEngine* db, bool prefix);
 
-DBIterator* DBNewTimeBoundIter(DBEngine* db, DBTimestamp min_ts, DBTimestamp max_ts);
+// Creates a new time-bound iterator, which skips the sstables whose
+// timestamps don't overlap the window, as defined by
+// hlc.TimestampWindow.Overlaps. Like DBNewIter, it is the callers
+// responsibility to call DBIterDestroy().
+DBIterator* DBNewTimeBoundIter(DBEngine* db, DBTimestampWindow window);
 
 // Destroys an iterator, freeing up any associated memory.
 void DBIterDestroy(DBIterator* iter);
@@ -234,6 +273,15 @@ typedef struct {
   int64_t flushes;
   int64_t compactions;
   int64_t table_readers_mem_estimate;
+  // write_stopped and write_delayed are set while RocksDB stops or slows
+  // writes because flushes or compactions are falling behind.
+  bool write_stopped;
+  bool write_delayed;
+  int64_t pending_compaction_bytes_estimate;
+  int64_t l0_file_count;
+  // keys_written counts the entries, including range tombstones, of the
+  // batches written to RocksDB.
+  int64_t keys_written;
 } DBStatsResult;
 
 DBStatus DBGetStats(DBEngine* db, DBStatsResult* stats);
@@ -243,10 +291,34 @@ typedef struct {
   uint64_t size;
   DBKey start_key;
   DBKey end_key;
+  // has_timestamps is set if the sstable has the crdb.ts.min and crdb.ts.max
+  // properties, which are then decoded into ts_min and ts_max.
+  bool has_timestamps;
+  DBTimestamp ts_min;
+  DBTimestamp ts_max;
+  // path is the path of the sstable file.
+  DBString path;
+  // format_version is the version of the sstable's table format.
+  // external_version is the version of the external sstable format of an
+  // ingested sstable, and 0 for an sstable written by the engine.
+  int format_version;
+  int external_version;
+  // has_key_counts is set if the sstable has the crdb.num.unversioned and
+  // crdb.num.shadowed properties, which are then decoded into
+  // unversioned_keys and shadowed_versions.
+  bool has_key_counts;
+  int64_t unversioned_keys;
+  int64_t shadowed_versions;
+  // num_entries is the number of entries in the sstable, and raw_key_size
+  // and raw_value_size the total size of their keys and values, from the
+  // sstable's table properties.
+  int64_t num_entries;
+  int64_t raw_key_size;
+  int64_t raw_value_size;
 } DBSSTable;
 
 // Retrieve stats about all of the live sstables. Note that the tables
-// array must be freed along with the start_key and end_key of each
+// array must be freed along with the start_key, end_key and path of each
 // table.
 DBSSTable* DBGetSSTables(DBEngine* db, int* n);
 
@@ -257,8 +329,13 @@ DBString DBGetUserProperties(DBEngine* db);
 
 // Bulk adds the file at the given path to a database. See the RocksDB
 // documentation on `IngestExternalFile` for the various restrictions on what
-// can be added.
-DBStatus DBIngestExternalFile(DBEngine* db, DBSlice path);
+// can be added. If move_file is true, the file is moved into the database
+// rather than copied. If allow_global_seqno is true, a file which overlaps
+// existing data is assigned a sequence number newer than that data, and if
+// allow_blocking_flush is true, the memtable is flushed first if the file
+// overlaps it; otherwise, the ingestion of such a file fails.
+DBStatus DBIngestExternalFile(DBEngine* db, DBSlice path, bool move_file, bool allow_global_seqno,
+                              bool allow_blocking_flush);
 
 typedef struct DBSstFileWriter DBSstFileWriter;
 
@@ -283,6 +360,9 @@ void DBRunLDB(int argc, char** argv);
 // DBEnvWriteFile writes the given data as a new "file" in the given engine.
 DBStatus DBEnvWriteFile(DBEngine* db, DBSlice path, DBSlice contents);
 
+// DBEnvDeleteFile deletes the "file" at the given path in the given engine.
+DBStatus DBEnvDeleteFile(DBEngine* db, DBSlice path);
+
 #ifdef __cplusplus
 }  // extern "C"
 #endif
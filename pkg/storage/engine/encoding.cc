@@ -15,6 +15,7 @@
 // Author: Spencer Kimball (spencer.kimball@gmail.com)
 // Author: Peter Mattis (peter@cockroachlabs.com)
 
+#include <limits>
 #include "rocksdb/slice.h"
 #include "encoding.h"
 
@@ -61,3 +62,78 @@ bool DecodeUint64(rocksdb::Slice* buf, uint64_t* value) {
   buf->remove_prefix(N);
   return true;
 }
+
+// The constants of the Go encoding package used by DecodeVarintAscending and
+// SkipBytesAscending.
+const uint8_t kIntMin = 0x80;
+const uint8_t kIntMax = 0xfd;
+const int kIntMaxWidth = 8;
+const int kIntZero = kIntMin + kIntMaxWidth;
+const int kIntSmall = kIntMax - kIntZero - kIntMaxWidth;
+const uint8_t kBytesMarker = 0x12;
+const uint8_t kEscape = 0x00;
+const uint8_t kEscapedTerm = 0x01;
+const uint8_t kEscaped00 = 0xff;
+
+bool DecodeVarintAscending(rocksdb::Slice* buf, int64_t* value) {
+  if (buf->empty()) {
+    return false;
+  }
+  const uint8_t* b = reinterpret_cast<const uint8_t*>(buf->data());
+  int length = int(b[0]) - kIntZero;
+  if (length < 0) {
+    // A negative value, whose bytes are ones-complemented.
+    length = -length;
+    if (buf->size() < 1 + length) {
+      return false;
+    }
+    int64_t v = 0;
+    for (int i = 1; i <= length; i++) {
+      v = (v << 8) | int64_t(uint8_t(~b[i]));
+    }
+    *value = ~v;
+    buf->remove_prefix(1 + length);
+    return true;
+  }
+  if (length <= kIntSmall) {
+    // The value is encoded in the tag.
+    *value = length;
+    buf->remove_prefix(1);
+    return true;
+  }
+  length -= kIntSmall;
+  if (length > 8 || buf->size() < 1 + length) {
+    return false;
+  }
+  uint64_t v = 0;
+  for (int i = 1; i <= length; i++) {
+    v = (v << 8) | uint64_t(b[i]);
+  }
+  if (v > uint64_t(std::numeric_limits<int64_t>::max())) {
+    return false;
+  }
+  *value = int64_t(v);
+  buf->remove_prefix(1 + length);
+  return true;
+}
+
+bool SkipBytesAscending(rocksdb::Slice* buf) {
+  const uint8_t* b = reinterpret_cast<const uint8_t*>(buf->data());
+  if (buf->empty() || b[0] != kBytesMarker) {
+    return false;
+  }
+  for (size_t i = 1; i + 1 < buf->size(); i++) {
+    if (b[i] != kEscape) {
+      continue;
+    }
+    if (b[i + 1] == kEscapedTerm) {
+      buf->remove_prefix(i + 2);
+      return true;
+    }
+    if (b[i + 1] != kEscaped00) {
+      return false;
+    }
+    i++;
+  }
+  return false;
+}
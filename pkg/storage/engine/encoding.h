@@ -35,6 +35,16 @@ bool DecodeUint32(rocksdb::Slice* buf, uint32_t* value);
 // true on a successful decode. The decoded value is returned in *value.
 bool DecodeUint64(rocksdb::Slice* buf, uint64_t* value);
 
+// DecodeVarintAscending decodes a varint encoded by the Go function
+// encoding.EncodeVarintAscending from a buffer, returning true on a
+// successful decode. The decoded value is returned in *value.
+bool DecodeVarintAscending(rocksdb::Slice* buf, int64_t* value);
+
+// SkipBytesAscending removes a byte string encoded by the Go function
+// encoding.EncodeBytesAscending from the front of a buffer, returning true
+// on success.
+bool SkipBytesAscending(rocksdb::Slice* buf);
+
 #endif // ROACHLIB_ENCODING_H
 
 // local variables:
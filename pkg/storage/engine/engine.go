@@ -124,8 +124,9 @@ type Reader interface {
 	// iterator to free resources.
 	NewIterator(prefix bool) Iterator
 	// NewTimeBoundIterator is like NewIterator, but the underlying iterator will
-	// efficiently skip over SSTs that contain no MVCC keys in the time range
-	// [start, end].
+	// efficiently skip over SSTs that contain no MVCC keys which must be read by
+	// an iteration over the time range [start, end): those whose timestamps
+	// don't overlap it, as defined by hlc.TimestampWindow.Overlaps.
 	NewTimeBoundIterator(start, end hlc.Timestamp) Iterator
 }
 
@@ -143,7 +144,9 @@ type Writer interface {
 	Clear(key MVCCKey) error
 	// ClearRange removes a set of entries, from start (inclusive) to end
 	// (exclusive). Similar to Clear, this method actually removes entries from
-	// the storage engine.
+	// the storage engine. It does so with a single range deletion tombstone,
+	// which readable batches do not index: all reads from a batch fail once
+	// ClearRange has been called on it.
 	ClearRange(start, end MVCCKey) error
 	// ClearIterRange removes a set of entries, from start (inclusive) to end
 	// (exclusive). Similar to Clear and ClearRange, this method actually removes
@@ -175,6 +178,23 @@ type ReadWriter interface {
 	Writer
 }
 
+// IngestExternalFileOptions are the options of an ingestion of an sstable by
+// Engine.IngestExternalFile. With none of them set, the sstable is copied into
+// the engine, and the ingestion fails if the sstable overlaps data in the
+// memtable, or data which is newer than the level it can be placed in.
+type IngestExternalFileOptions struct {
+	// MoveFile causes the sstable to be moved rather than copied into the
+	// engine.
+	MoveFile bool
+	// AllowGlobalSeqNo lets an sstable which overlaps existing data be
+	// assigned a sequence number newer than that data, so that its keys
+	// shadow those of the existing data.
+	AllowGlobalSeqNo bool
+	// AllowBlockingFlush lets an sstable which overlaps the memtable be
+	// ingested once the memtable is flushed, blocking writes meanwhile.
+	AllowBlockingFlush bool
+}
+
 // Engine is the interface that wraps the core operations of a key/value store.
 type Engine interface {
 	ReadWriter
@@ -182,6 +202,15 @@ type Engine interface {
 	Attrs() roachpb.Attributes
 	// Capacity returns capacity details for the engine's available storage.
 	Capacity() (roachpb.StoreCapacity, error)
+	// ApproximateDiskBytes returns an approximation of the on-disk size,
+	// including data not yet flushed, of the keys in the range [from, to).
+	ApproximateDiskBytes(from, to roachpb.Key) (uint64, error)
+	// CompactRange forces compaction of the keys in the range [from, to),
+	// dropping the tombstones of deleted data. Unless forceBottommost is set,
+	// the sstables of the bottommost level are only rewritten if data of other
+	// levels is compacted into them; forcing their compaction rewrites every
+	// sstable in the range, such as to add table properties they lack.
+	CompactRange(from, to roachpb.Key, forceBottommost bool) error
 	// Flush causes the engine to write all in-memory data to disk
 	// immediately.
 	Flush() error
@@ -189,6 +218,23 @@ type Engine interface {
 	GetStats() (*Stats, error)
 	// GetTempDir returns a path under which tempdirs or tempfiles can be created.
 	GetTempDir() string
+	// GetAuxiliaryDir returns a path in the engine's env under which files
+	// which are not part of the engine's data, such as sstables staged for
+	// ingestion, can be written by WriteFile.
+	GetAuxiliaryDir() string
+	// WriteFile writes data to the file at the given path of the engine's env.
+	WriteFile(filename string, data []byte) error
+	// DeleteFile deletes the file at the given path of the engine's env.
+	DeleteFile(filename string) error
+	// IngestExternalFile links the sstable at the given path of the engine's
+	// env into the engine, after which its keys are visible to new iterators.
+	// See IngestExternalFileOptions for how an sstable which overlaps the
+	// engine's existing data is ingested.
+	IngestExternalFile(path string, opts IngestExternalFileOptions) error
+	// SetTimeSeriesCutoffs sets the cutoffs below which the engine's
+	// compactions drop time series data, replacing the previous ones. An
+	// empty set of cutoffs retains all of it.
+	SetTimeSeriesCutoffs(cutoffs []TimeSeriesCutoff) error
 	// NewBatch returns a new instance of a batched engine which wraps
 	// this engine. Batched engines accumulate all mutations and apply
 	// them atomically on a call to Commit().
@@ -208,6 +254,12 @@ type Engine interface {
 	// by invoking Close(). Note that snapshots must not be used after the
 	// original engine has been stopped.
 	NewSnapshot() Reader
+	// NewSnapshotBounded is like NewSnapshot, but the snapshot only reads the
+	// keys in [start, end). Reads outside of the bounds return an
+	// *OutOfBoundsError, and its iterators are exhausted once they reach the
+	// end of the bounds. Engines which can do so avoid pinning the data outside
+	// of the bounds for the lifetime of the snapshot.
+	NewSnapshotBounded(start, end MVCCKey) Reader
 	// SetTempDir overrides the tempdir path returned by GetTempDir.
 	SetTempDir(dir string) error
 }
@@ -256,6 +308,19 @@ type Stats struct {
 	Flushes                  int64
 	Compactions              int64
 	TableReadersMemEstimate  int64
+	// WriteStopped and WriteDelayed are set while the engine stops or slows
+	// writes because flushes or compactions are falling behind.
+	WriteStopped bool
+	WriteDelayed bool
+	// PendingCompactionBytesEstimate estimates the bytes compactions must
+	// rewrite to bring every level of the engine under its target size.
+	PendingCompactionBytesEstimate int64
+	// L0FileCount is the number of sstables in level 0, which every read must
+	// consult and which trigger write stalls when they accumulate.
+	L0FileCount int64
+	// KeysWritten is the number of entries, counting each range deletion
+	// tombstone as one, of the batches written to the engine.
+	KeysWritten int64
 }
 
 // PutProto sets the given key to the protobuf-serialized byte string
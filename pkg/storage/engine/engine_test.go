@@ -31,6 +31,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
@@ -629,6 +630,28 @@ func TestEngineDeleteRangeBatch(t *testing.T) {
 	})
 }
 
+func TestEngineDeleteRangeReadableBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testEngineDeleteRange(t, func(engine Engine, start, end MVCCKey) error {
+		batch := engine.NewBatch()
+		defer batch.Close()
+		if err := batch.ClearRange(start, end); err != nil {
+			return err
+		}
+		// Reads from a batch containing a range tombstone fail.
+		if _, err := batch.Get(start); !testutils.IsError(err, "delete range") {
+			return errors.Errorf("expected read from batch to fail, got %v", err)
+		}
+		iter := batch.NewIterator(false)
+		defer iter.Close()
+		iter.Seek(start)
+		if _, err := iter.Valid(); !testutils.IsError(err, "delete range") {
+			return errors.Errorf("expected iteration of batch to fail, got %v", err)
+		}
+		return batch.Commit(false)
+	})
+}
+
 func TestEngineDeleteIterRange(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	testEngineDeleteRange(t, func(engine Engine, start, end MVCCKey) error {
@@ -774,6 +797,66 @@ func TestSnapshotMethods(t *testing.T) {
 	}, t)
 }
 
+// TestSnapshotBounded verifies that a bounded snapshot reads the keys within
+// its bounds, and refuses to read the keys outside of them.
+func TestSnapshotBounded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	runWithAllEngines(func(engine Engine, t *testing.T) {
+		keys := []MVCCKey{mvccKey("a"), mvccKey("b"), mvccKey("c"), mvccKey("d")}
+		insertKeys(keys, engine, t)
+
+		snap := engine.NewSnapshotBounded(mvccKey("b"), mvccKey("d"))
+		defer snap.Close()
+
+		// Reads within the bounds succeed.
+		if val, err := snap.Get(mvccKey("b")); err != nil {
+			t.Fatal(err)
+		} else if val == nil {
+			t.Fatal("expected a value for \"b\"")
+		}
+		if err := snap.Iterate(mvccKey("b"), mvccKey("d"), func(MVCCKeyValue) (bool, error) {
+			return false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reads outside of the bounds fail.
+		for _, key := range []MVCCKey{mvccKey("a"), mvccKey("d")} {
+			if _, err := snap.Get(key); err == nil {
+				t.Errorf("%s: expected an error", key)
+			} else if _, ok := err.(*OutOfBoundsError); !ok {
+				t.Errorf("%s: expected an OutOfBoundsError, got %v", key, err)
+			}
+		}
+		if err := snap.Iterate(mvccKey("a"), mvccKey("d"), func(MVCCKeyValue) (bool, error) {
+			return false, nil
+		}); !testutils.IsError(err, "outside of the reader's bounds") {
+			t.Errorf("expected an out of bounds error, got %v", err)
+		}
+
+		// An iterator stops at the end of the bounds, and can't seek to a key
+		// before their start.
+		iter := snap.NewIterator(false)
+		defer iter.Close()
+		var found []MVCCKey
+		for iter.Seek(mvccKey("b")); ; iter.Next() {
+			if ok, err := iter.Valid(); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				break
+			}
+			found = append(found, iter.Key())
+		}
+		if e := keys[1:3]; !reflect.DeepEqual(e, found) {
+			t.Errorf("expected keys %v, got %v", e, found)
+		}
+		iter.Seek(mvccKey("a"))
+		if _, err := iter.Valid(); !testutils.IsError(err, "outside of the reader's bounds") {
+			t.Errorf("expected an out of bounds error, got %v", err)
+		}
+	}, t)
+}
+
 func insertKeys(keys []MVCCKey, engine Engine, t *testing.T) {
 	insertKeysAndValues(keys, nil, engine, t)
 }
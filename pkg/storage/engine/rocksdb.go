@@ -29,6 +29,7 @@ import (
 	"runtime/debug"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -109,6 +110,28 @@ type SSTableInfo struct {
 	Size  int64
 	Start MVCCKey
 	End   MVCCKey
+	// TsMin and TsMax are the minimum and maximum MVCC timestamps in the
+	// sstable, from the properties used by time-bound iterators to skip it.
+	// They are nil if the sstable lacks the properties, in which case a
+	// time-bound iterator can never skip it.
+	TsMin, TsMax *hlc.Timestamp
+	// Path is the path of the sstable file.
+	Path string
+	// FormatVersion is the version of the sstable's table format.
+	// ExternalVersion is the version of the external sstable format of an
+	// ingested sstable, and 0 for an sstable written by the engine, whose
+	// sequence numbers prevent it from being ingested elsewhere.
+	FormatVersion   int
+	ExternalVersion int
+	// UnversionedKeys is the number of keys without an MVCC timestamp, such
+	// as intents, in the sstable, and ShadowedVersions the number of versions
+	// which are older than another version of the same key in the sstable.
+	// They are nil if the sstable lacks the properties.
+	UnversionedKeys, ShadowedVersions *int64
+	// NumEntries is the number of entries in the sstable, and RawKeyBytes and
+	// RawValueBytes the total size of their keys, including timestamps, and
+	// values. They are zero if the sstable's properties can't be read.
+	NumEntries, RawKeyBytes, RawValueBytes int64
 }
 
 // SSTableInfos is a slice of SSTableInfo structures.
@@ -293,10 +316,25 @@ type RocksDB struct {
 	attrs        roachpb.Attributes // Attributes for this engine
 	dir          string             // The data directory
 	tempDir      string             // A path for storing temp files (ideally under dir).
+	auxDir       string             // A path in the engine's env for auxiliary files.
 	cache        RocksDBCache       // Shared cache.
 	maxSize      int64              // Used for calculating rebalancing and free space.
 	maxOpenFiles int                // The maximum number of open files this instance will use.
 	deallocated  chan struct{}      // Closed when the underlying handle is deallocated.
+	// closing is 1 once Close has been called. Accessed atomically.
+	closing int32
+
+	// iters counts the open iterators over the engine, which the deallocation
+	// of the underlying handle waits for. See Close.
+	iters struct {
+		syncutil.Mutex
+		open int
+		// drained, if non-nil, is closed once no iterators are open.
+		drained chan struct{}
+		// deferred is true if Close gave up waiting for the iterators, leaving
+		// the deallocation of the handle to the last of them to be closed.
+		deferred bool
+	}
 
 	commit struct {
 		syncutil.Mutex
@@ -342,6 +380,11 @@ func NewRocksDB(
 		return nil, err
 	}
 
+	r.auxDir = filepath.Join(dir, "auxiliary")
+	if err := os.MkdirAll(r.auxDir, 0755); err != nil {
+		return nil, err
+	}
+
 	if err := r.open(); err != nil {
 		return nil, err
 	}
@@ -355,6 +398,8 @@ func newMemRocksDB(attrs roachpb.Attributes, cache RocksDBCache, maxSize int64)
 		cache:       cache.ref(),
 		maxSize:     maxSize,
 		deallocated: make(chan struct{}),
+		// The files of an in-memory engine's env are in memory too.
+		auxDir: "auxiliary",
 	}
 
 	if err := r.SetTempDir(os.TempDir()); err != nil {
@@ -432,12 +477,37 @@ func (r *RocksDB) open() error {
 	return nil
 }
 
-// Close closes the database by deallocating the underlying handle.
+// ErrEngineClosed is returned by an iterator over an engine which was closed
+// while the iterator was open.
+var ErrEngineClosed = errors.New("engine closed")
+
+// closeIteratorsTimeout is the time for which Close waits for the open
+// iterators over the engine to be closed before deallocating its handle.
+var closeIteratorsTimeout = 10 * time.Second
+
+// Close closes the database by deallocating the underlying handle. Once Close
+// is called, the open iterators over the engine, and over its snapshots and
+// batches, fail with ErrEngineClosed, but the handle they read from is only
+// deallocated once they are all closed:
+// Close waits for them for up to closeIteratorsTimeout, after which the last
+// of them to be closed deallocates it.
 func (r *RocksDB) Close() {
 	if r.rdb == nil {
 		log.Errorf(context.TODO(), "closing unopened rocksdb instance")
 		return
 	}
+	r.iters.Lock()
+	if !atomic.CompareAndSwapInt32(&r.closing, 0, 1) {
+		r.iters.Unlock()
+		log.Errorf(context.TODO(), "closing rocksdb instance %s twice", r)
+		return
+	}
+	if r.iters.open > 0 {
+		r.iters.drained = make(chan struct{})
+	}
+	drained := r.iters.drained
+	r.iters.Unlock()
+
 	if len(r.dir) == 0 {
 		if log.V(1) {
 			log.Infof(context.TODO(), "closing in-memory rocksdb instance")
@@ -445,17 +515,67 @@ func (r *RocksDB) Close() {
 	} else {
 		log.Infof(context.TODO(), "closing rocksdb instance at %q", r.dir)
 	}
-	if r.rdb != nil {
-		C.DBClose(r.rdb)
-		r.rdb = nil
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-time.After(closeIteratorsTimeout):
+			r.iters.Lock()
+			r.iters.deferred = r.iters.open > 0
+			open, deferred := r.iters.open, r.iters.deferred
+			r.iters.Unlock()
+			if deferred {
+				log.Errorf(context.TODO(), "%d iterators over rocksdb instance %s are still open after %s; "+
+					"it will be closed once they are", open, r, closeIteratorsTimeout)
+				return
+			}
+		}
 	}
+	r.deallocate()
+}
+
+// deallocate deallocates the underlying handle, once no iterators over it
+// are open.
+func (r *RocksDB) deallocate() {
+	C.DBClose(r.rdb)
+	r.rdb = nil
 	r.cache.Release()
 	close(r.deallocated)
 }
 
-// Closed returns true if the engine is closed.
+// Closed returns true if the engine is closed, or is being closed.
 func (r *RocksDB) Closed() bool {
-	return r.rdb == nil
+	return atomic.LoadInt32(&r.closing) == 1
+}
+
+// acquireIterator records that an iterator over the engine is open, and
+// returns false if the engine is closed or being closed instead.
+func (r *RocksDB) acquireIterator() bool {
+	r.iters.Lock()
+	defer r.iters.Unlock()
+	if r.Closed() {
+		return false
+	}
+	r.iters.open++
+	return true
+}
+
+// releaseIterator records that an iterator over the engine was closed. If
+// it was the last one, Close is notified, or, if it stopped waiting, the
+// handle is deallocated.
+func (r *RocksDB) releaseIterator() {
+	r.iters.Lock()
+	r.iters.open--
+	drained := r.iters.open == 0 && r.iters.drained != nil
+	deferred := drained && r.iters.deferred
+	if drained {
+		close(r.iters.drained)
+		r.iters.drained = nil
+	}
+	r.iters.Unlock()
+	if deferred {
+		log.Infof(context.TODO(), "closing rocksdb instance %s after its last iterator was closed", r)
+		r.deallocate()
+	}
 }
 
 // Attrs returns the list of attributes describing this engine. This
@@ -601,6 +721,75 @@ func (r *RocksDB) Compact() error {
 	return statusToError(C.DBCompact(r.rdb))
 }
 
+// CompactRange forces compaction of the keys in the range [from, to).
+func (r *RocksDB) CompactRange(from, to roachpb.Key, forceBottommost bool) error {
+	return statusToError(C.DBCompactRange(r.rdb, goToCKey(MakeMVCCMetadataKey(from)),
+		goToCKey(MakeMVCCMetadataKey(to)), C.bool(forceBottommost)))
+}
+
+// TimeSeriesCutoff is the oldest time slot of the time series data at a
+// resolution which the compactions of an engine retain. The resolution and
+// time slot are those encoded in the time series keys; see ts.MakeDataKey.
+type TimeSeriesCutoff struct {
+	Resolution  int64
+	MinTimeslot int64
+}
+
+// SetTimeSeriesCutoffs sets the cutoffs below which the compactions of the
+// engine drop time series data, replacing the previous ones. The data of a
+// resolution without a cutoff, and all of it if there are none, is retained,
+// which is the case until the cutoffs are first set.
+func (r *RocksDB) SetTimeSeriesCutoffs(cutoffs []TimeSeriesCutoff) error {
+	cCutoffs := make([]C.DBTimeSeriesCutoff, len(cutoffs))
+	for i, c := range cutoffs {
+		cCutoffs[i] = C.DBTimeSeriesCutoff{
+			resolution:   C.int64_t(c.Resolution),
+			min_timeslot: C.int64_t(c.MinTimeslot),
+		}
+	}
+	var ptr *C.DBTimeSeriesCutoff
+	if len(cCutoffs) > 0 {
+		ptr = &cCutoffs[0]
+	}
+	return statusToError(C.DBSetTimeSeriesCutoffs(r.rdb, ptr, C.int(len(cCutoffs))))
+}
+
+// IngestExternalFile links the sstable at the given path of the engine's
+// environment, as written by WriteFile, into the engine. See the RocksDB
+// documentation on `IngestExternalFile` for the various restrictions on what
+// can be added.
+func (r *RocksDB) IngestExternalFile(path string, opts IngestExternalFileOptions) error {
+	return statusToError(C.DBIngestExternalFile(
+		r.rdb,
+		goToCSlice([]byte(path)),
+		C.bool(opts.MoveFile),
+		C.bool(opts.AllowGlobalSeqNo),
+		C.bool(opts.AllowBlockingFlush),
+	))
+}
+
+// ApproximateDiskBytes returns an approximation of the on-disk size of the
+// keys in the range [from, to), including data in the mem-tables.
+func (r *RocksDB) ApproximateDiskBytes(from, to roachpb.Key) (uint64, error) {
+	var size C.uint64_t
+	if err := statusToError(C.DBApproximateDiskBytes(r.rdb, goToCKey(MakeMVCCMetadataKey(from)),
+		goToCKey(MakeMVCCMetadataKey(to)), &size)); err != nil {
+		return 0, err
+	}
+	return uint64(size), nil
+}
+
+// MemTableOverlaps returns whether the mem-tables, which hold the writes not
+// yet flushed to sstables, contain a key in the range [from, to).
+func (r *RocksDB) MemTableOverlaps(from, to roachpb.Key) (bool, error) {
+	var overlaps C.bool
+	if err := statusToError(C.DBMemTableOverlaps(r.rdb, goToCKey(MakeMVCCMetadataKey(from)),
+		goToCKey(MakeMVCCMetadataKey(to)), &overlaps)); err != nil {
+		return false, err
+	}
+	return bool(overlaps), nil
+}
+
 // Destroy destroys the underlying filesystem data associated with the database.
 func (r *RocksDB) Destroy() error {
 	return statusToError(C.DBDestroy(goToCSlice([]byte(r.dir))))
@@ -619,7 +808,7 @@ func (r *RocksDB) NewIterator(prefix bool) Iterator {
 // NewTimeBoundIterator is like NewIterator, but returns a time-bound iterator.
 func (r *RocksDB) NewTimeBoundIterator(start, end hlc.Timestamp) Iterator {
 	it := &rocksDBIterator{}
-	it.initTimeBound(r.rdb, start, end, r)
+	it.initTimeBound(r.rdb, hlc.TimestampWindow{Start: start, End: end}, r)
 	return it
 }
 
@@ -635,6 +824,14 @@ func (r *RocksDB) NewSnapshot() Reader {
 	}
 }
 
+// NewSnapshotBounded creates a snapshot which only reads the keys in
+// [start, end). A RocksDB snapshot is a sequence number which retains the data
+// visible at it across the whole engine, so this snapshot pins as much as one
+// returned by NewSnapshot; only its reads are restricted.
+func (r *RocksDB) NewSnapshotBounded(start, end MVCCKey) Reader {
+	return newBoundedReader(r.NewSnapshot(), start, end)
+}
+
 // NewBatch returns a new batch wrapping this rocksdb engine.
 func (r *RocksDB) NewBatch() Batch {
 	return newRocksDBBatch(r, false /* writeOnly */)
@@ -668,6 +865,20 @@ func (r *RocksDB) GetSSTables() SSTableInfos {
 		r.Size = int64(tv.size)
 		r.Start = cToGoKey(tv.start_key)
 		r.End = cToGoKey(tv.end_key)
+		if bool(tv.has_timestamps) {
+			r.TsMin = &hlc.Timestamp{WallTime: int64(tv.ts_min.wall_time), Logical: int32(tv.ts_min.logical)}
+			r.TsMax = &hlc.Timestamp{WallTime: int64(tv.ts_max.wall_time), Logical: int32(tv.ts_max.logical)}
+		}
+		r.Path = cStringToGoString(tv.path)
+		r.FormatVersion = int(tv.format_version)
+		r.ExternalVersion = int(tv.external_version)
+		if bool(tv.has_key_counts) {
+			unversioned, shadowed := int64(tv.unversioned_keys), int64(tv.shadowed_versions)
+			r.UnversionedKeys, r.ShadowedVersions = &unversioned, &shadowed
+		}
+		r.NumEntries = int64(tv.num_entries)
+		r.RawKeyBytes = int64(tv.raw_key_size)
+		r.RawValueBytes = int64(tv.raw_value_size)
 		if ptr := tv.start_key.key.data; ptr != nil {
 			C.free(unsafe.Pointer(ptr))
 		}
@@ -681,6 +892,19 @@ func (r *RocksDB) GetSSTables() SSTableInfos {
 	return res
 }
 
+// SSTableInfosWithTimestamps returns the metadata, including the MVCC
+// timestamp bounds, of the live sstables overlapping the keys in [start, end).
+func (r *RocksDB) SSTableInfosWithTimestamps(start, end roachpb.Key) SSTableInfos {
+	var res SSTableInfos
+	for _, t := range r.GetSSTables() {
+		// The end key of an sstable is inclusive.
+		if t.End.Key.Compare(start) >= 0 && t.Start.Key.Compare(end) < 0 {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
 // getUserProperties fetches the user properties stored in each sstable's
 // metadata.
 func (r *RocksDB) getUserProperties() (enginepb.SSTUserPropertiesCollection, error) {
@@ -715,6 +939,12 @@ func (r *RocksDB) GetStats() (*Stats, error) {
 		Flushes:                  int64(s.flushes),
 		Compactions:              int64(s.compactions),
 		TableReadersMemEstimate:  int64(s.table_readers_mem_estimate),
+
+		WriteStopped:                   bool(s.write_stopped),
+		WriteDelayed:                   bool(s.write_delayed),
+		PendingCompactionBytesEstimate: int64(s.pending_compaction_bytes_estimate),
+		L0FileCount:                    int64(s.l0_file_count),
+		KeysWritten:                    int64(s.keys_written),
 	}, nil
 }
 
@@ -853,9 +1083,6 @@ func (r *distinctBatch) Clear(key MVCCKey) error {
 }
 
 func (r *distinctBatch) ClearRange(start, end MVCCKey) error {
-	if !r.writeOnly {
-		panic("readable batch")
-	}
 	r.flushMutations()
 	r.flushes++ // make sure that Repr() doesn't take a shortcut
 	return dbClearRange(r.batch, start, end)
@@ -1080,9 +1307,6 @@ func (r *rocksDBBatch) Clear(key MVCCKey) error {
 }
 
 func (r *rocksDBBatch) ClearRange(start, end MVCCKey) error {
-	if !r.writeOnly {
-		panic("readable batch")
-	}
 	if r.distinctOpen {
 		panic("distinct batch open")
 	}
@@ -1281,6 +1505,11 @@ type dbIteratorGetter interface {
 
 type rocksDBIterator struct {
 	engine Reader
+	// parent is the RocksDB instance which the iterator reads from, directly
+	// or through one of its snapshots or batches, if any. The iterator is
+	// counted among the instance's open iterators while iter is non-nil. See
+	// RocksDB.Close.
+	parent *RocksDB
 	iter   *C.DBIterator
 	valid  bool
 	reseek bool
@@ -1316,30 +1545,96 @@ func (r *rocksDBIterator) getIter() *C.DBIterator {
 }
 
 func (r *rocksDBIterator) init(rdb *C.DBEngine, prefix bool, engine Reader) {
+	if !r.acquireParent(engine) {
+		return
+	}
 	r.iter = C.DBNewIter(rdb, C.bool(prefix))
 	if r.iter == nil {
 		panic("unable to create iterator")
 	}
-	r.engine = engine
 }
 
-func (r *rocksDBIterator) initTimeBound(rdb *C.DBEngine, start, end hlc.Timestamp, engine Reader) {
-	r.iter = C.DBNewTimeBoundIter(rdb, goToCTimestamp(start), goToCTimestamp(end))
+func (r *rocksDBIterator) initTimeBound(
+	rdb *C.DBEngine, window hlc.TimestampWindow, engine Reader,
+) {
+	if !r.acquireParent(engine) {
+		return
+	}
+	r.iter = C.DBNewTimeBoundIter(rdb, C.DBTimestampWindow{
+		start: goToCTimestamp(window.Start),
+		end:   goToCTimestamp(window.End),
+	})
 	if r.iter == nil {
 		panic("unable to create iterator")
 	}
+}
+
+// rocksDBParent returns the RocksDB instance which the supplied engine reads
+// from: the engine itself if it is a RocksDB instance, or the instance of a
+// snapshot or batch. It returns nil for other engines.
+func rocksDBParent(engine Reader) *RocksDB {
+	switch e := engine.(type) {
+	case *RocksDB:
+		return e
+	case *rocksDBSnapshot:
+		return e.parent
+	case *rocksDBBatch:
+		return e.parent
+	case *distinctBatch:
+		return e.parent
+	default:
+		return nil
+	}
+}
+
+// acquireParent sets the engine of the iterator, and counts the iterator
+// among the open iterators of the RocksDB instance which the engine reads
+// from, if any (see rocksDBParent). It returns false if the instance is
+// closed or being closed, in which case the iterator is left without an
+// underlying iterator, and fails with ErrEngineClosed.
+func (r *rocksDBIterator) acquireParent(engine Reader) bool {
 	r.engine = engine
+	if parent := rocksDBParent(engine); parent != nil {
+		r.parent = parent
+		if !parent.acquireIterator() {
+			r.setClosed()
+			return false
+		}
+	}
+	return true
 }
 
-func (r *rocksDBIterator) checkEngineOpen() {
+// checkEngineOpen returns true if the engine of the iterator is open. An
+// iterator over a RocksDB instance, or over one of its snapshots or batches,
+// which is being closed is invalidated with ErrEngineClosed instead; the
+// instance is only deallocated once the iterator is closed. An iterator over
+// a closed snapshot or batch of an open instance panics.
+func (r *rocksDBIterator) checkEngineOpen() bool {
+	if r.parent != nil && (r.iter == nil || r.parent.Closed()) {
+		r.setClosed()
+		return false
+	}
 	if r.engine.Closed() {
 		panic("iterator used after backing engine closed")
 	}
+	return true
+}
+
+// setClosed invalidates the iterator with ErrEngineClosed.
+func (r *rocksDBIterator) setClosed() {
+	r.valid = false
+	r.key = C.DBKey{}
+	r.value = C.DBSlice{}
+	r.err = ErrEngineClosed
 }
 
 func (r *rocksDBIterator) destroy() {
+	parent, acquired := r.parent, r.iter != nil
 	C.DBIterDestroy(r.iter)
 	*r = rocksDBIterator{}
+	if parent != nil && acquired {
+		parent.releaseIterator()
+	}
 }
 
 // The following methods implement the Iterator interface.
@@ -1349,7 +1644,9 @@ func (r *rocksDBIterator) Close() {
 }
 
 func (r *rocksDBIterator) Seek(key MVCCKey) {
-	r.checkEngineOpen()
+	if !r.checkEngineOpen() {
+		return
+	}
 	if len(key.Key) == 0 {
 		// start=Key("") needs special treatment since we need
 		// to access start[0] in an explicit seek.
@@ -1364,7 +1661,9 @@ func (r *rocksDBIterator) Seek(key MVCCKey) {
 }
 
 func (r *rocksDBIterator) SeekReverse(key MVCCKey) {
-	r.checkEngineOpen()
+	if !r.checkEngineOpen() {
+		return
+	}
 	if len(key.Key) == 0 {
 		r.setState(C.DBIterSeekToLast(r.iter))
 	} else {
@@ -1392,22 +1691,30 @@ func (r *rocksDBIterator) Valid() (bool, error) {
 }
 
 func (r *rocksDBIterator) Next() {
-	r.checkEngineOpen()
+	if !r.checkEngineOpen() {
+		return
+	}
 	r.setState(C.DBIterNext(r.iter, false /* !skip_current_key_versions */))
 }
 
 func (r *rocksDBIterator) Prev() {
-	r.checkEngineOpen()
+	if !r.checkEngineOpen() {
+		return
+	}
 	r.setState(C.DBIterPrev(r.iter, false /* !skip_current_key_versions */))
 }
 
 func (r *rocksDBIterator) NextKey() {
-	r.checkEngineOpen()
+	if !r.checkEngineOpen() {
+		return
+	}
 	r.setState(C.DBIterNext(r.iter, true /* skip_current_key_versions */))
 }
 
 func (r *rocksDBIterator) PrevKey() {
-	r.checkEngineOpen()
+	if !r.checkEngineOpen() {
+		return
+	}
 	r.setState(C.DBIterPrev(r.iter, true /* skip_current_key_versions */))
 }
 
@@ -1452,6 +1759,9 @@ func (r *rocksDBIterator) setState(state C.DBIterState) {
 func (r *rocksDBIterator) ComputeStats(
 	start, end MVCCKey, nowNanos int64,
 ) (enginepb.MVCCStats, error) {
+	if !r.checkEngineOpen() {
+		return enginepb.MVCCStats{}, r.err
+	}
 	result := C.MVCCComputeStats(r.iter, goToCKey(start), goToCKey(end), C.int64_t(nowNanos))
 	return cStatsToGoStats(result, nowNanos)
 }
@@ -1681,6 +1991,9 @@ func dbClearIterRange(rdb *C.DBEngine, iter Iterator, start, end MVCCKey) error
 	if !ok {
 		return errors.Errorf("%T is not a RocksDB iterator", iter)
 	}
+	if it, ok := iter.(*rocksDBIterator); ok && !it.checkEngineOpen() {
+		return it.err
+	}
 	return statusToError(C.DBDeleteIterRange(rdb, getter.getIter(), goToCKey(start), goToCKey(end)))
 }
 
@@ -1743,7 +2056,7 @@ func (fr *RocksDBSstFileReader) IngestExternalFile(data []byte) error {
 	if err := fr.rocksDB.WriteFile(filename, data); err != nil {
 		return err
 	}
-	return statusToError(C.DBIngestExternalFile(fr.rocksDB.rdb, goToCSlice([]byte(filename))))
+	return fr.rocksDB.IngestExternalFile(filename, IngestExternalFileOptions{})
 }
 
 // Iterate iterates over the keys between start inclusive and end
@@ -1771,6 +2084,11 @@ func (fr *RocksDBSstFileReader) Close() {
 	fr.rocksDB.RocksDB = nil
 }
 
+// SstFileWriterFormatVersion is the version of the table format of the
+// sstables written by RocksDBSstFileWriter, which is set in
+// DBSstFileWriterNew.
+const SstFileWriterFormatVersion = 0
+
 // RocksDBSstFileWriter creates a file suitable for importing with
 // RocksDBSstFileReader.
 type RocksDBSstFileWriter struct {
@@ -1848,7 +2166,18 @@ func (r *RocksDB) SetTempDir(d string) error {
 	return nil
 }
 
+// GetAuxiliaryDir returns the path in this RocksDB's env under which
+// auxiliary files, such as those staged for ingestion, are written.
+func (r *RocksDB) GetAuxiliaryDir() string {
+	return r.auxDir
+}
+
 // WriteFile writes data to a file in this RocksDB's env.
 func (r *RocksDB) WriteFile(filename string, data []byte) error {
 	return statusToError(C.DBEnvWriteFile(r.rdb, goToCSlice([]byte(filename)), goToCSlice(data)))
 }
+
+// DeleteFile deletes a file in this RocksDB's env.
+func (r *RocksDB) DeleteFile(filename string) error {
+	return statusToError(C.DBEnvDeleteFile(r.rdb, goToCSlice([]byte(filename))))
+}
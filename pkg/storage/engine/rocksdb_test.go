@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -589,3 +590,316 @@ func TestRocksDBTimeBound(t *testing.T) {
 		t.Fatalf("got max %v expected %v", sst.TsMax, maxTimestamp)
 	}
 }
+
+func TestRocksDBSSTableTimestamps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	dir, dirCleanup := testutils.TempDir(t)
+	defer dirCleanup()
+
+	rocksdb, err := NewRocksDB(roachpb.Attributes{}, dir, RocksDBCache{}, 0, DefaultMaxOpenFiles)
+	if err != nil {
+		t.Fatalf("could not create new rocksdb db instance at %s: %v", dir, err)
+	}
+	defer rocksdb.Close()
+
+	// The keys are written in order so that each flush creates a separate
+	// sstable. The sstable of "b" has no versioned keys, and so lacks the
+	// timestamp properties.
+	for _, batch := range [][]MVCCKey{
+		{
+			{Key: roachpb.Key("a1"), Timestamp: hlc.Timestamp{WallTime: 1}},
+			{Key: roachpb.Key("a2"), Timestamp: hlc.Timestamp{WallTime: 3, Logical: 1}},
+			{Key: roachpb.Key("a2"), Timestamp: hlc.Timestamp{WallTime: 2}},
+		},
+		{MakeMVCCMetadataKey(roachpb.Key("b"))},
+	} {
+		for _, key := range batch {
+			if err := rocksdb.Put(key, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rocksdb.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ssts := rocksdb.SSTableInfosWithTimestamps(roachpb.Key("a"), roachpb.Key("b"))
+	if len(ssts) != 1 {
+		t.Fatalf("expected 1 sstable, got %d: %s", len(ssts), ssts)
+	}
+	if min := (hlc.Timestamp{WallTime: 1}); ssts[0].TsMin == nil || *ssts[0].TsMin != min {
+		t.Errorf("expected min %s, got %v", min, ssts[0].TsMin)
+	}
+	if max := (hlc.Timestamp{WallTime: 3, Logical: 1}); ssts[0].TsMax == nil || *ssts[0].TsMax != max {
+		t.Errorf("expected max %s, got %v", max, ssts[0].TsMax)
+	}
+	if u, s := ssts[0].UnversionedKeys, ssts[0].ShadowedVersions; u == nil || *u != 0 || s == nil || *s != 1 {
+		t.Errorf("expected 0 unversioned keys and 1 shadowed version, got %v and %v", u, s)
+	}
+	if ssts[0].ExternalVersion != 0 {
+		t.Errorf("expected an sstable written by the engine, got external version %d",
+			ssts[0].ExternalVersion)
+	}
+	if _, err := os.Stat(ssts[0].Path); err != nil {
+		t.Error(err)
+	}
+
+	ssts = rocksdb.SSTableInfosWithTimestamps(roachpb.Key("b"), roachpb.Key("c"))
+	if len(ssts) != 1 {
+		t.Fatalf("expected 1 sstable, got %d: %s", len(ssts), ssts)
+	}
+	if ssts[0].TsMin != nil || ssts[0].TsMax != nil {
+		t.Errorf("expected no timestamps, got [%v, %v]", ssts[0].TsMin, ssts[0].TsMax)
+	}
+	if u := ssts[0].UnversionedKeys; u == nil || *u != 1 {
+		t.Errorf("expected 1 unversioned key, got %v", u)
+	}
+
+	if ssts := rocksdb.SSTableInfosWithTimestamps(roachpb.Key("c"), roachpb.Key("d")); len(ssts) != 0 {
+		t.Errorf("expected no sstables, got %s", ssts)
+	}
+
+	// The properties of the sstable written by a compaction are read, rather
+	// than those cached for the sstables it replaced.
+	if err := rocksdb.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	ssts = rocksdb.SSTableInfosWithTimestamps(roachpb.Key("a"), roachpb.Key("c"))
+	if len(ssts) != 1 {
+		t.Fatalf("expected 1 sstable, got %d: %s", len(ssts), ssts)
+	}
+	if u := ssts[0].UnversionedKeys; u == nil || *u != 1 {
+		t.Errorf("expected 1 unversioned key, got %v", u)
+	}
+	if max := (hlc.Timestamp{WallTime: 3, Logical: 1}); ssts[0].TsMax == nil || *ssts[0].TsMax != max {
+		t.Errorf("expected max %s, got %v", max, ssts[0].TsMax)
+	}
+}
+
+func TestRocksDBMemTableOverlaps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rocksdb := NewInMem(roachpb.Attributes{}, testCacheSize)
+	defer rocksdb.Close()
+
+	key := MVCCKey{Key: roachpb.Key("b"), Timestamp: hlc.Timestamp{WallTime: 1}}
+	if err := rocksdb.Put(key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for _, flushed := range []bool{false, true} {
+		if flushed {
+			if err := rocksdb.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, tc := range []struct {
+			from, to string
+			expected bool
+		}{
+			{"a", "b", false},
+			{"a", "c", !flushed},
+			{"b", "b\x00", !flushed},
+			{"c", "d", false},
+		} {
+			overlaps, err := rocksdb.MemTableOverlaps(roachpb.Key(tc.from), roachpb.Key(tc.to))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if overlaps != tc.expected {
+				t.Errorf("flushed=%t: expected [%s, %s) to overlap %t, got %t",
+					flushed, tc.from, tc.to, tc.expected, overlaps)
+			}
+		}
+	}
+}
+
+func TestRocksDBCompactRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rocksdb := NewInMem(roachpb.Attributes{}, testCacheSize)
+	defer rocksdb.Close()
+
+	value := []byte(strings.Repeat("x", 1000))
+	for i := 0; i < 1000; i++ {
+		key := MakeMVCCMetadataKey(roachpb.Key(fmt.Sprintf("a%04d", i)))
+		if err := rocksdb.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rocksdb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	from, to := roachpb.Key("a"), roachpb.Key("b")
+	before, err := rocksdb.ApproximateDiskBytes(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == 0 {
+		t.Fatal("expected a non-zero size before deletion")
+	}
+	if empty, err := rocksdb.ApproximateDiskBytes(to, roachpb.Key("c")); err != nil {
+		t.Fatal(err)
+	} else if empty != 0 {
+		t.Fatalf("expected an empty range to have no size, got %d", empty)
+	}
+
+	if err := rocksdb.ClearRange(MakeMVCCMetadataKey(from), MakeMVCCMetadataKey(to)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rocksdb.CompactRange(from, to, true /* forceBottommost */); err != nil {
+		t.Fatal(err)
+	}
+	after, err := rocksdb.ApproximateDiskBytes(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("expected size to decrease after deletion and compaction, got %d -> %d", before, after)
+	}
+}
+
+// TestRocksDBCloseWithOpenIterator verifies that an iterator over an engine
+// which is closed while the iterator is in use fails with ErrEngineClosed,
+// and that the engine is only deallocated once the iterator is closed, even
+// if Close gives up waiting for it. The same holds for iterators over the
+// engine's snapshots and batches.
+func TestRocksDBCloseWithOpenIterator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	open := func(t *testing.T) *RocksDB {
+		db := NewInMem(roachpb.Attributes{}, 1<<20).RocksDB
+		for i := 0; i < 1000; i++ {
+			if err := db.Put(mvccKey(fmt.Sprintf("%04d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+	expectDeallocated := func(t *testing.T, db *RocksDB, expected bool) {
+		select {
+		case <-db.deallocated:
+			if !expected {
+				t.Fatal("expected the engine not to be deallocated")
+			}
+		case <-time.After(10 * time.Millisecond):
+			if expected {
+				t.Fatal("expected the engine to be deallocated")
+			}
+		}
+	}
+
+	t.Run("scan", func(t *testing.T) {
+		db := open(t)
+		iter := db.NewIterator(false)
+		// Scan the engine over and over from another goroutine, until the
+		// scan fails.
+		errCh := make(chan error, 1)
+		go func() {
+			defer iter.Close()
+			for iter.Seek(NilKey); ; iter.Next() {
+				if ok, err := iter.Valid(); err != nil {
+					errCh <- err
+					return
+				} else if !ok {
+					iter.Seek(NilKey)
+				}
+			}
+		}()
+		// Close waits for the scan to fail and close its iterator.
+		db.Close()
+		if err := <-errCh; err != ErrEngineClosed {
+			t.Fatalf("expected %v, got %v", ErrEngineClosed, err)
+		}
+		expectDeallocated(t, db, true)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		defer func(timeout time.Duration) {
+			closeIteratorsTimeout = timeout
+		}(closeIteratorsTimeout)
+		closeIteratorsTimeout = time.Millisecond
+
+		db := open(t)
+		iter := db.NewIterator(false)
+		iter.Seek(NilKey)
+		if ok, err := iter.Valid(); !ok {
+			t.Fatalf("expected a valid iterator, got %v", err)
+		}
+		// Close gives up waiting for the iterator, which keeps the engine
+		// from being deallocated, but fails from then on.
+		db.Close()
+		if !db.Closed() {
+			t.Fatal("expected the engine to be closed")
+		}
+		expectDeallocated(t, db, false)
+		iter.Next()
+		if ok, err := iter.Valid(); ok || err != ErrEngineClosed {
+			t.Fatalf("expected %v, got valid=%t, err=%v", ErrEngineClosed, ok, err)
+		}
+		// So does an iterator created once the engine is closed.
+		after := db.NewIterator(false)
+		after.Seek(NilKey)
+		if ok, err := after.Valid(); ok || err != ErrEngineClosed {
+			t.Fatalf("expected %v, got valid=%t, err=%v", ErrEngineClosed, ok, err)
+		}
+		after.Close()
+		expectDeallocated(t, db, false)
+
+		// The last iterator to be closed deallocates the engine.
+		iter.Close()
+		expectDeallocated(t, db, true)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		defer func(timeout time.Duration) {
+			closeIteratorsTimeout = timeout
+		}(closeIteratorsTimeout)
+		closeIteratorsTimeout = time.Millisecond
+
+		db := open(t)
+		snap := db.NewSnapshot()
+		iter := snap.NewIterator(false)
+		iter.Seek(NilKey)
+		if ok, err := iter.Valid(); !ok {
+			t.Fatalf("expected a valid iterator, got %v", err)
+		}
+		// An iterator over a snapshot keeps the engine from being deallocated
+		// like an iterator over the engine, and fails once it is closed.
+		db.Close()
+		expectDeallocated(t, db, false)
+		iter.Next()
+		if ok, err := iter.Valid(); ok || err != ErrEngineClosed {
+			t.Fatalf("expected %v, got valid=%t, err=%v", ErrEngineClosed, ok, err)
+		}
+		snap.Close()
+		expectDeallocated(t, db, false)
+		iter.Close()
+		expectDeallocated(t, db, true)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		defer func(timeout time.Duration) {
+			closeIteratorsTimeout = timeout
+		}(closeIteratorsTimeout)
+		closeIteratorsTimeout = time.Millisecond
+
+		db := open(t)
+		batch := db.NewBatch()
+		iter := batch.NewIterator(false)
+		iter.Seek(NilKey)
+		if ok, err := iter.Valid(); !ok {
+			t.Fatalf("expected a valid iterator, got %v", err)
+		}
+		db.Close()
+		expectDeallocated(t, db, false)
+		iter.Next()
+		if ok, err := iter.Valid(); ok || err != ErrEngineClosed {
+			t.Fatalf("expected %v, got valid=%t, err=%v", ErrEngineClosed, ok, err)
+		}
+		// The iterators of a batch are only closed with the batch.
+		iter.Close()
+		expectDeallocated(t, db, false)
+		batch.Close()
+		expectDeallocated(t, db, true)
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// engineHealthMaxL0Files is the number of level 0 sstables of a store's
+// engine above which background work is deferred. Every read consults each
+// level 0 sstable, and RocksDB stalls writes once too many accumulate.
+var engineHealthMaxL0Files = settings.RegisterIntSetting(
+	"storage.engine_health.max_l0_files",
+	"number of level 0 sstables of a store's engine above which background work is deferred "+
+		"(0 disables)",
+	20,
+)
+
+// engineHealthMaxPendingCompactionBytes is the estimate of the bytes awaiting
+// compaction in a store's engine above which background work is deferred.
+var engineHealthMaxPendingCompactionBytes = settings.RegisterByteSizeSetting(
+	"storage.engine_health.max_pending_compaction_bytes",
+	"estimated bytes awaiting compaction in a store's engine above which background work is "+
+		"deferred (0 disables)",
+	32<<30, // 32 GiB
+)
+
+// engineHealthRecoveryFraction is the fraction of the thresholds above which
+// an engine which was unhealthy is still considered unhealthy. It keeps the
+// health from flapping, and background work from resuming at full tilt, while
+// the engine hovers around a threshold.
+var engineHealthRecoveryFraction = settings.RegisterNonNegativeFloatSetting(
+	"storage.engine_health.recovery_fraction",
+	"fraction of the engine health thresholds which an unhealthy engine must fall below "+
+		"before background work resumes",
+	0.75,
+)
+
+// engineHealthRefreshInterval is the minimum interval between retrievals of
+// the stats of the engine by engineHealth.
+const engineHealthRefreshInterval = time.Second
+
+// engineHealth determines whether a store's engine is healthy enough for
+// background work, such as time series maintenance, from the engine's stats.
+// The engine is unhealthy while it stops or slows writes, or while it has more
+// level 0 sstables or more data awaiting compaction than the configured
+// thresholds. Once unhealthy, it stays so until it falls below a fraction of
+// the thresholds.
+type engineHealth struct {
+	statsFn func() (*engine.Stats, error)
+	// refreshInterval is the minimum interval between calls to statsFn.
+	refreshInterval time.Duration
+
+	mu struct {
+		syncutil.Mutex
+		refreshed time.Time
+		// reason is the reason the engine was last found unhealthy, or empty
+		// if it was healthy.
+		reason string
+	}
+}
+
+func newEngineHealth(statsFn func() (*engine.Stats, error)) *engineHealth {
+	return &engineHealth{
+		statsFn:         statsFn,
+		refreshInterval: engineHealthRefreshInterval,
+	}
+}
+
+// unhealthyReason returns the reason the engine is unfit for background work,
+// or the empty string if it is healthy. The stats of the engine are retrieved
+// at most once per refresh interval; the engine's last known health stands in
+// between retrievals, or if they fail.
+func (h *engineHealth) unhealthyReason() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := timeutil.Now()
+	if !h.mu.refreshed.IsZero() && now.Sub(h.mu.refreshed) < h.refreshInterval {
+		return h.mu.reason
+	}
+	h.mu.refreshed = now
+	stats, err := h.statsFn()
+	if err != nil {
+		return h.mu.reason
+	}
+	h.mu.reason = engineUnhealthyReason(*stats, h.mu.reason != "")
+	return h.mu.reason
+}
+
+// engineUnhealthyReason returns the reason an engine with the supplied stats
+// is unfit for background work, or the empty string if it is healthy. The
+// thresholds are scaled down by the recovery fraction if the engine was
+// unhealthy.
+func engineUnhealthyReason(stats engine.Stats, wasUnhealthy bool) string {
+	if stats.WriteStopped {
+		return "engine writes are stopped"
+	}
+	if stats.WriteDelayed {
+		return "engine writes are delayed"
+	}
+	scale := 1.0
+	if wasUnhealthy {
+		scale = engineHealthRecoveryFraction.Get()
+		if scale > 1 {
+			scale = 1
+		}
+	}
+	if max := engineHealthMaxL0Files.Get(); max > 0 {
+		if threshold := int64(scale * float64(max)); stats.L0FileCount > threshold {
+			return fmt.Sprintf("%d level 0 sstables exceed %d", stats.L0FileCount, threshold)
+		}
+	}
+	if max := engineHealthMaxPendingCompactionBytes.Get(); max > 0 {
+		if threshold := int64(scale * float64(max)); stats.PendingCompactionBytesEstimate > threshold {
+			return fmt.Sprintf("%s pending compaction exceeds %s",
+				humanizeutil.IBytes(stats.PendingCompactionBytesEstimate), humanizeutil.IBytes(threshold))
+		}
+	}
+	return ""
+}
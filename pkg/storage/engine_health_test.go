@@ -0,0 +1,102 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestEngineHealth verifies that the engine is unhealthy while it stalls
+// writes or exceeds a threshold, and that once unhealthy it only recovers
+// after falling below the recovery fraction of the thresholds.
+func TestEngineHealth(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetInt(&engineHealthMaxL0Files, 20)()
+	defer settings.TestingSetByteSize(&engineHealthMaxPendingCompactionBytes, 1000)()
+	defer settings.TestingSetFloat(&engineHealthRecoveryFraction, 0.5)()
+
+	var stats engine.Stats
+	var statsErr error
+	h := newEngineHealth(func() (*engine.Stats, error) {
+		if statsErr != nil {
+			return nil, statsErr
+		}
+		s := stats
+		return &s, nil
+	})
+	h.refreshInterval = 0
+
+	testCases := []struct {
+		stats   engine.Stats
+		err     error
+		healthy bool
+	}{
+		{engine.Stats{}, nil, true},
+		{engine.Stats{L0FileCount: 20, PendingCompactionBytesEstimate: 1000}, nil, true},
+		{engine.Stats{L0FileCount: 21}, nil, false},
+		// The engine stays unhealthy until it falls to half the thresholds.
+		{engine.Stats{L0FileCount: 15}, nil, false},
+		{engine.Stats{L0FileCount: 10}, nil, true},
+		{engine.Stats{L0FileCount: 15}, nil, true},
+		{engine.Stats{PendingCompactionBytesEstimate: 1001}, nil, false},
+		{engine.Stats{PendingCompactionBytesEstimate: 600}, nil, false},
+		{engine.Stats{PendingCompactionBytesEstimate: 500}, nil, true},
+		{engine.Stats{WriteDelayed: true}, nil, false},
+		// The last known health stands in while stats can't be retrieved.
+		{engine.Stats{}, errors.New("boom"), false},
+		{engine.Stats{}, nil, true},
+		{engine.Stats{WriteStopped: true}, nil, false},
+		{engine.Stats{}, nil, true},
+	}
+	for i, c := range testCases {
+		stats, statsErr = c.stats, c.err
+		if reason := h.unhealthyReason(); (reason == "") != c.healthy {
+			t.Errorf("%d: expected healthy=%t, got reason %q", i, c.healthy, reason)
+		}
+	}
+
+	// Disabled thresholds are ignored.
+	defer settings.TestingSetInt(&engineHealthMaxL0Files, 0)()
+	stats = engine.Stats{L0FileCount: 1000}
+	if reason := h.unhealthyReason(); reason != "" {
+		t.Errorf("expected the engine to be healthy, got reason %q", reason)
+	}
+}
+
+// TestEngineHealthRefreshInterval verifies that the stats of the engine are
+// retrieved at most once per refresh interval.
+func TestEngineHealthRefreshInterval(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var calls int
+	h := newEngineHealth(func() (*engine.Stats, error) {
+		calls++
+		return &engine.Stats{WriteStopped: true}, nil
+	})
+	for i := 0; i < 3; i++ {
+		if reason := h.unhealthyReason(); reason == "" {
+			t.Fatal("expected the engine to be unhealthy")
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected stats to be retrieved once, got %d", calls)
+	}
+}
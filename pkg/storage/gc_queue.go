@@ -105,7 +105,12 @@ func newGCQueue(store *Store, gossip *gossip.Gossip) *gcQueue {
 			successes:            store.metrics.GCQueueSuccesses,
 			failures:             store.metrics.GCQueueFailures,
 			pending:              store.metrics.GCQueuePending,
+			pendingHighWater:     store.metrics.GCQueuePendingHighWater,
+			sizeDropped:          store.metrics.GCQueueSizeDropped,
 			processingNanos:      store.metrics.GCQueueProcessingNanos,
+			timeouts:             store.metrics.GCQueueProcessTimeouts,
+			waitLatency:          store.metrics.GCQueueWaitLatency,
+			shouldQueueNanos:     store.metrics.GCQueueShouldQueueNanos,
 		},
 	)
 	return gcq
@@ -443,7 +448,12 @@ func processLocalKeyRange(
 			if err := handleOneTransaction(kv); err != nil {
 				return err
 			}
-		} else if suffix.Equal(keys.LocalQueueLastProcessedSuffix.AsRawKey()) {
+		} else if suffix.Equal(keys.LocalQueueLastProcessedSuffix.AsRawKey()) ||
+			suffix.Equal(keys.LocalQueueHistorySuffix.AsRawKey()) ||
+			suffix.Equal(keys.LocalQueueResumeSuffix.AsRawKey()) {
+			// Queue histories and resume positions are keyed by range start
+			// key just like last processed timestamps, and go stale in the
+			// same way.
 			if err := handleOneQueueLastProcessed(kv, roachpb.RKey(rangeKey)); err != nil {
 				return err
 			}
@@ -109,6 +109,33 @@ func (s *Store) ForceTimeSeriesMaintenanceQueueProcess() {
 	forceScanAndProcess(s, s.tsMaintenanceQueue.baseQueue)
 }
 
+// TimeSeriesMaintenanceQueueAccelerated re-evaluates the store's capacity and
+// returns whether the time series maintenance queue is in low disk mode.
+func (s *Store) TimeSeriesMaintenanceQueueAccelerated() bool {
+	return s.tsMaintenanceQueue.isAccelerated(context.TODO())
+}
+
+// TimeSeriesMaintenanceQueueShouldQueue invokes the shouldQueue method on the
+// store's time series maintenance queue.
+func (s *Store) TimeSeriesMaintenanceQueueShouldQueue(
+	ctx context.Context, now hlc.Timestamp, r *Replica,
+) (bool, float64) {
+	return s.tsMaintenanceQueue.shouldQueue(ctx, now, r, config.SystemConfig{})
+}
+
+// SetTimeSeriesMaintenanceBeforeLastProcessed sets a function to be called by
+// the store's time series maintenance queue once a replica has been pruned and
+// before its last processed time is recorded.
+func (s *Store) SetTimeSeriesMaintenanceBeforeLastProcessed(fn func() error) {
+	s.tsMaintenanceQueue.beforeLastProcessedFn = fn
+}
+
+// TimeSeriesMaintenanceQueueTimer invokes the timer method on the store's
+// time series maintenance queue.
+func (s *Store) TimeSeriesMaintenanceQueueTimer(duration time.Duration) time.Duration {
+	return s.tsMaintenanceQueue.timer(duration)
+}
+
 // ForceRaftSnapshotQueueProcess iterates over all ranges, enqueuing
 // any that need raft snapshots, then processes the raft snapshot
 // queue.
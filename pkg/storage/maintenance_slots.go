@@ -0,0 +1,160 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/config"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// maintenanceSlotsSetting is the number of background maintenance slots of
+// each store. The heavy queues, whose processing is IO-intensive, acquire
+// slots while they process a replica, so that they don't all compete for the
+// disk at once, as after a restart, and make the store fall behind on Raft.
+// The time series maintenance queue takes one slot per replica, and the
+// consistency checker two, so that by default the consistency checker runs
+// alone.
+var maintenanceSlotsSetting = settings.RegisterIntSetting(
+	"storage.maintenance.slots",
+	"number of background maintenance slots of each store, which bound the IO-intensive work "+
+		"of its heavy queues (0 disables)",
+	2,
+)
+
+// maintenanceSlotTimeout is the time for which a heavy queue waits for a
+// background maintenance slot before giving up on the replica, which is
+// requeued.
+var maintenanceSlotTimeout = settings.RegisterNonNegativeDurationSetting(
+	"storage.maintenance.slot_timeout",
+	"time for which a heavy queue waits for a background maintenance slot before requeuing "+
+		"the replica",
+	10*time.Second,
+)
+
+// maintenanceSlotRequeueDelay is the delay after which a replica which timed
+// out waiting for a background maintenance slot is queued again.
+const maintenanceSlotRequeueDelay = time.Minute
+
+// errMaintenanceSlotsUnavailable is returned by maintenanceSlots.acquire when
+// the slots don't become available in time. It is a deferredError, so that a
+// queue which returns it from queueImpl.process neither fails the replica nor
+// counts it as processed.
+var errMaintenanceSlotsUnavailable error = &processDeferredError{
+	reason: "background maintenance slots unavailable",
+}
+
+// maintenanceSlots is a weighted semaphore bounding the background
+// maintenance done by a store at once. Its capacity is read from capacityFn on
+// each acquisition, so that changes to the setting apply to the acquisitions
+// which follow; a capacity of zero or less disables the bound. An acquisition
+// of more slots than the capacity is reduced to the capacity, so that it
+// proceeds once every slot is free.
+type maintenanceSlots struct {
+	capacityFn func() int64
+	// inUse is a gauge measuring the slots acquired.
+	inUse *metric.Gauge
+
+	mu struct {
+		syncutil.Mutex
+		used int64
+		// released is closed, and replaced, when slots are released.
+		released chan struct{}
+	}
+}
+
+func newMaintenanceSlots(capacityFn func() int64, inUse *metric.Gauge) *maintenanceSlots {
+	s := &maintenanceSlots{capacityFn: capacityFn, inUse: inUse}
+	s.mu.released = make(chan struct{})
+	return s
+}
+
+// acquire acquires n slots, waiting at most the supplied timeout for them to
+// become available. The returned function releases them; it may be called
+// more than once. If the slots don't become available in time,
+// errMaintenanceSlotsUnavailable is returned, and the context's error if it
+// is done first.
+func (s *maintenanceSlots) acquire(
+	ctx context.Context, n int64, timeout time.Duration,
+) (func(), error) {
+	var timer timeutil.Timer
+	defer timer.Stop()
+	timer.Reset(timeout)
+	for {
+		s.mu.Lock()
+		capacity := s.capacityFn()
+		if capacity > 0 && n > capacity {
+			n = capacity
+		}
+		if capacity <= 0 || s.mu.used+n <= capacity {
+			s.mu.used += n
+			s.inUse.Inc(n)
+			s.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { s.release(n) }) }, nil
+		}
+		released := s.mu.released
+		s.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			timer.Read = true
+			return nil, errMaintenanceSlotsUnavailable
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *maintenanceSlots) release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.used -= n
+	s.inUse.Dec(n)
+	close(s.mu.released)
+	s.mu.released = make(chan struct{})
+}
+
+// acquireMaintenanceSlots acquires n of the store's background maintenance
+// slots for the processing of the replica by a heavy queue, waiting at most
+// maintenanceSlotTimeout. If they don't become available in time, the replica
+// is requeued after maintenanceSlotRequeueDelay at the priority which
+// queueImpl.shouldQueue gives it, if any, and errMaintenanceSlotsUnavailable is
+// returned: the caller must return the error, so that the replica is counted
+// as neither processed nor failed.
+func (bq *baseQueue) acquireMaintenanceSlots(
+	ctx context.Context, repl *Replica, sysCfg config.SystemConfig, n int64,
+) (release func(), _ error) {
+	release, err := bq.store.maintenanceSlots.acquire(ctx, n, maintenanceSlotTimeout.Get())
+	if err != errMaintenanceSlotsUnavailable {
+		return release, err
+	}
+	log.VEventf(ctx, 2, "%s; requeuing in %s", err, maintenanceSlotRequeueDelay)
+	if should, priority := bq.impl.shouldQueue(
+		ctx, bq.store.Clock().Now(), repl, sysCfg,
+	); should {
+		bq.requeueAfter(ctx, repl, maintenanceSlotRequeueDelay, priority)
+	}
+	return nil, err
+}
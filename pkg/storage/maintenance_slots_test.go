@@ -0,0 +1,260 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/config"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// TestMaintenanceSlots verifies that acquisitions of background maintenance
+// slots wait for the slots to be released, up to a timeout, and follow changes
+// to the capacity.
+func TestMaintenanceSlots(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	capacity := int64(2)
+	inUse := metric.NewGauge(metric.Metadata{Name: "inuse"})
+	s := newMaintenanceSlots(func() int64 { return capacity }, inUse)
+	expectInUse := func(expected int64) {
+		if v := inUse.Value(); v != expected {
+			t.Fatalf("expected %d slots in use, got %d", expected, v)
+		}
+	}
+	acquire := func(n int64, timeout time.Duration) func() {
+		release, err := s.acquire(ctx, n, timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return release
+	}
+
+	release1 := acquire(1, 0)
+	release2 := acquire(1, 0)
+	expectInUse(2)
+	if _, err := s.acquire(ctx, 1, time.Millisecond); err != errMaintenanceSlotsUnavailable {
+		t.Fatalf("expected %v, got %v", errMaintenanceSlotsUnavailable, err)
+	}
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.acquire(cancelledCtx, 1, time.Minute); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	// A waiting acquisition proceeds once a slot is released. Releasing twice
+	// releases the slot once.
+	acquired := make(chan func())
+	go func() {
+		release, err := s.acquire(ctx, 1, time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	release1()
+	release1()
+	release3 := <-acquired
+	expectInUse(2)
+
+	// An acquisition of more slots than the capacity waits for all of them.
+	go func() {
+		release, err := s.acquire(ctx, 5, time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	release2()
+	select {
+	case <-acquired:
+		t.Fatal("expected the acquisition to wait for every slot")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release3()
+	release4 := <-acquired
+	expectInUse(2)
+	release4()
+	expectInUse(0)
+
+	// Without a capacity, acquisitions don't wait.
+	capacity = 0
+	release5 := acquire(10, 0)
+	release6 := acquire(10, 0)
+	expectInUse(20)
+	release5()
+	release6()
+	expectInUse(0)
+}
+
+// heavyQueueImpl is a testQueueImpl whose processing holds a background
+// maintenance slot until it is unblocked, and which records the number of
+// replicas holding a slot at once.
+type heavyQueueImpl struct {
+	testQueueImpl
+	bq      *baseQueue
+	unblock chan struct{}
+
+	mu struct {
+		syncutil.Mutex
+		inSlot, maxInSlot int
+		processed         []roachpb.RangeID
+	}
+}
+
+func (hq *heavyQueueImpl) process(ctx context.Context, r *Replica, cfg config.SystemConfig) error {
+	release, err := hq.bq.acquireMaintenanceSlots(ctx, r, cfg, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	hq.mu.Lock()
+	hq.mu.inSlot++
+	if hq.mu.inSlot > hq.mu.maxInSlot {
+		hq.mu.maxInSlot = hq.mu.inSlot
+	}
+	hq.mu.Unlock()
+	<-hq.unblock
+	hq.mu.Lock()
+	hq.mu.inSlot--
+	hq.mu.processed = append(hq.mu.processed, r.RangeID)
+	hq.mu.Unlock()
+	return hq.testQueueImpl.process(ctx, r, cfg)
+}
+
+// TestBaseQueueMaintenanceSlots verifies that two replicas processed at once
+// by a heavy queue are serialized by a single background maintenance slot,
+// and that the replica which times out waiting for it is requeued without
+// being failed or backed off.
+func TestBaseQueueMaintenanceSlots(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetInt(&maintenanceSlotsSetting, 1)()
+	defer settings.TestingSetDuration(&maintenanceSlotTimeout, 10*time.Millisecond)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	// Remove replica for range 1 since it encompasses the entire keyspace.
+	repl1, err := tc.store.GetReplica(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.store.RemoveReplica(context.Background(), repl1, *repl1.Desc(), true); err != nil {
+		t.Fatal(err)
+	}
+	var repls []*Replica
+	for i := 0; i < 2; i++ {
+		id := roachpb.RangeID(1001 + i)
+		repl := createReplica(tc.store, id,
+			roachpb.RKey(fmt.Sprintf("%d", id)), roachpb.RKey(fmt.Sprintf("%d/end", id)))
+		if err := tc.store.AddReplica(repl); err != nil {
+			t.Fatal(err)
+		}
+		repls = append(repls, repl)
+	}
+
+	hq := &heavyQueueImpl{
+		testQueueImpl: testQueueImpl{
+			shouldQueueFn: func(now hlc.Timestamp, r *Replica) (shouldQueue bool, priority float64) {
+				return true, float64(r.RangeID)
+			},
+		},
+		unblock: make(chan struct{}),
+	}
+	bq := makeTestBaseQueue("test", hq, tc.store, tc.gossip, queueConfig{
+		maxSize:              len(repls),
+		acceptsUnsplitRanges: true,
+		concurrency:          len(repls),
+		failureBackoff:       time.Minute,
+	})
+	hq.bq = bq
+	bq.Start(tc.Clock(), stopper)
+	for _, repl := range repls {
+		bq.MaybeAdd(repl, hlc.Timestamp{})
+	}
+
+	// One replica takes the slot, and the other times out waiting for it and
+	// is requeued.
+	var loser roachpb.RangeID
+	testutils.SucceedsSoon(t, func() error {
+		bq.mu.Lock()
+		defer bq.mu.Unlock()
+		if len(bq.mu.requeues) != 1 {
+			return errors.Errorf("expected 1 requeued replica, got %d", len(bq.mu.requeues))
+		}
+		for rangeID := range bq.mu.requeues {
+			loser = rangeID
+		}
+		return nil
+	})
+	// The timeout is neither a failure nor a success, and doesn't back the
+	// replica off.
+	if v := bq.failures.Count(); v != 0 {
+		t.Fatalf("expected no failures, got %d", v)
+	}
+	if v := bq.successes.Count(); v != 0 {
+		t.Fatalf("expected no successes, got %d", v)
+	}
+	if v := bq.backedOff.Value(); v != 0 {
+		t.Fatalf("expected no backed off replicas, got %d", v)
+	}
+	bq.mu.Lock()
+	_, backedOff := bq.mu.backoffs[loser]
+	bq.mu.Unlock()
+	if backedOff {
+		t.Fatalf("expected r%d not to be backed off", loser)
+	}
+	hq.mu.Lock()
+	inSlot := hq.mu.inSlot
+	hq.mu.Unlock()
+	if inSlot != 1 {
+		t.Fatalf("expected 1 replica holding the slot, got %d", inSlot)
+	}
+	if v := tc.store.metrics.MaintenanceSlotsInUse.Value(); v != 1 {
+		t.Fatalf("expected 1 slot in use, got %d", v)
+	}
+
+	close(hq.unblock)
+	testutils.SucceedsSoon(t, func() error {
+		if v := tc.store.metrics.MaintenanceSlotsInUse.Value(); v != 0 {
+			return errors.Errorf("expected no slots in use, got %d", v)
+		}
+		return nil
+	})
+	hq.mu.Lock()
+	defer hq.mu.Unlock()
+	if hq.mu.maxInSlot != 1 {
+		t.Errorf("expected at most 1 replica holding the slot at once, got %d", hq.mu.maxInSlot)
+	}
+	if len(hq.mu.processed) != 1 || hq.mu.processed[0] == loser {
+		t.Errorf("expected only the winner of r%d to have been processed, got %v", loser, hq.mu.processed)
+	}
+}
@@ -199,6 +199,9 @@ var (
 	metaRdbNumSSTables = metric.Metadata{
 		Name: "rocksdb.num-sstables",
 		Help: "Number of rocksdb SSTables"}
+	metaRdbTimestampBackfillBytes = metric.Metadata{
+		Name: "rocksdb.timestamp-backfill.remaining-bytes",
+		Help: "Number of bytes of rocksdb SSTables lacking timestamp properties which remain to be rewritten"}
 
 	// Range event metrics.
 	metaRangeSplits = metric.Metadata{
@@ -401,6 +404,212 @@ var (
 	metaTimeSeriesMaintenanceQueueProcessingNanos = metric.Metadata{
 		Name: "queue.tsmaintenance.processingnanos",
 		Help: "Nanoseconds spent processing replicas in the time series maintenance queue"}
+	metaTimeSeriesMaintenanceQueueAccelerated = metric.Metadata{
+		Name: "queue.tsmaintenance.accelerated",
+		Help: "Whether time series maintenance is accelerated due to low available disk (1) or not (0)"}
+	metaTimeSeriesMaintenanceQueueDeleteRate = metric.Metadata{
+		Name: "queue.tsmaintenance.deleterate",
+		Help: "Effective rate of deletion batches issued by time series pruning (0 if unlimited)"}
+	metaTimeSeriesMaintenanceQueueDeclined = metric.Metadata{
+		Name: "queue.tsmaintenance.declined",
+		Help: "Number of replicas not maintained because the store was draining or overloaded"}
+	metaTimeSeriesMaintenanceQueueSourcePrunedKeys = metric.Metadata{
+		Name: "queue.tsmaintenance.sourcepruned.keys",
+		Help: "Number of time series keys deleted by the pruning of dead sources"}
+	metaTimeSeriesMaintenanceQueueSourcePrunedBytes = metric.Metadata{
+		Name: "queue.tsmaintenance.sourcepruned.bytes",
+		Help: "Number of bytes of time series data deleted by the pruning of dead sources"}
+	metaTimeSeriesMaintenanceQueueDryRunKeys = metric.Metadata{
+		Name: "queue.tsmaintenance.dryrun.keys",
+		Help: "Number of time series keys which the latest dry runs of time series maintenance estimated pruning would delete"}
+	metaTimeSeriesMaintenanceQueueDryRunBytes = metric.Metadata{
+		Name: "queue.tsmaintenance.dryrun.bytes",
+		Help: "Number of bytes of time series data which the latest dry runs of time series maintenance estimated pruning would delete"}
+
+	// Replica queue timeout metrics.
+	metaGCQueueProcessTimeouts = metric.Metadata{
+		Name: "queue.gc.process.timeout",
+		Help: "Number of replicas whose processing timed out in the GC queue"}
+	metaRaftLogQueueProcessTimeouts = metric.Metadata{
+		Name: "queue.raftlog.process.timeout",
+		Help: "Number of replicas whose processing timed out in the Raft log queue"}
+	metaRaftSnapshotQueueProcessTimeouts = metric.Metadata{
+		Name: "queue.raftsnapshot.process.timeout",
+		Help: "Number of replicas whose processing timed out in the Raft repair queue"}
+	metaConsistencyQueueProcessTimeouts = metric.Metadata{
+		Name: "queue.consistency.process.timeout",
+		Help: "Number of replicas whose processing timed out in the consistency checker queue"}
+	metaReplicaGCQueueProcessTimeouts = metric.Metadata{
+		Name: "queue.replicagc.process.timeout",
+		Help: "Number of replicas whose processing timed out in the replica GC queue"}
+	metaReplicateQueueProcessTimeouts = metric.Metadata{
+		Name: "queue.replicate.process.timeout",
+		Help: "Number of replicas whose processing timed out in the replicate queue"}
+	metaSplitQueueProcessTimeouts = metric.Metadata{
+		Name: "queue.split.process.timeout",
+		Help: "Number of replicas whose processing timed out in the split queue"}
+	metaTimeSeriesMaintenanceQueueProcessTimeouts = metric.Metadata{
+		Name: "queue.tsmaintenance.process.timeout",
+		Help: "Number of replicas whose processing timed out in the time series maintenance queue"}
+
+	// Replica queue wait metrics.
+	metaGCQueueWaitLatency = metric.Metadata{
+		Name: "queue.gc.waitlatency",
+		Help: "Latency between the queuing of replicas and their processing by the GC queue"}
+	metaRaftLogQueueWaitLatency = metric.Metadata{
+		Name: "queue.raftlog.waitlatency",
+		Help: "Latency between the queuing of replicas and their processing by the Raft log queue"}
+	metaRaftSnapshotQueueWaitLatency = metric.Metadata{
+		Name: "queue.raftsnapshot.waitlatency",
+		Help: "Latency between the queuing of replicas and their processing by the Raft repair queue"}
+	metaConsistencyQueueWaitLatency = metric.Metadata{
+		Name: "queue.consistency.waitlatency",
+		Help: "Latency between the queuing of replicas and their processing by the consistency checker queue"}
+	metaReplicaGCQueueWaitLatency = metric.Metadata{
+		Name: "queue.replicagc.waitlatency",
+		Help: "Latency between the queuing of replicas and their processing by the replica GC queue"}
+	metaReplicateQueueWaitLatency = metric.Metadata{
+		Name: "queue.replicate.waitlatency",
+		Help: "Latency between the queuing of replicas and their processing by the replicate queue"}
+	metaSplitQueueWaitLatency = metric.Metadata{
+		Name: "queue.split.waitlatency",
+		Help: "Latency between the queuing of replicas and their processing by the split queue"}
+	metaTimeSeriesMaintenanceQueueWaitLatency = metric.Metadata{
+		Name: "queue.tsmaintenance.waitlatency",
+		Help: "Latency between the queuing of replicas and their processing by the time series maintenance queue"}
+
+	// Replica queue processing latency metrics.
+	metaTimeSeriesMaintenanceQueueProcessingLatency = metric.Metadata{
+		Name: "queue.tsmaintenance.processinglatency",
+		Help: "Latency of the successful processing of replicas by the time series maintenance queue"}
+	metaTimeSeriesMaintenanceQueueProcessingFailureLatency = metric.Metadata{
+		Name: "queue.tsmaintenance.processingfailurelatency",
+		Help: "Latency of the failed or timed out processing of replicas by the time series maintenance queue"}
+
+	// Replica queue backoff metrics.
+	metaTimeSeriesMaintenanceQueueBackedOff = metric.Metadata{
+		Name: "queue.tsmaintenance.backedoff",
+		Help: "Number of replicas backed off by the time series maintenance queue after repeated processing failures"}
+
+	// Replica queue memory metrics.
+	metaTimeSeriesMaintenanceQueueMemBytes = metric.Metadata{
+		Name: "queue.tsmaintenance.membytes",
+		Help: "Estimated memory retained by the replicas queued in the time series maintenance queue"}
+	metaTimeSeriesMaintenanceQueueMemDropped = metric.Metadata{
+		Name: "queue.tsmaintenance.memdropped",
+		Help: "Number of replicas dropped or not queued because the time series maintenance queue exhausted its memory budget"}
+
+	// Replica queue size metrics.
+	metaGCQueueSizeDropped = metric.Metadata{
+		Name: "queue.gc.sizedropped",
+		Help: "Number of replicas dropped or not queued because the GC queue was at its maximum size"}
+	metaRaftLogQueueSizeDropped = metric.Metadata{
+		Name: "queue.raftlog.sizedropped",
+		Help: "Number of replicas dropped or not queued because the Raft log queue was at its maximum size"}
+	metaRaftSnapshotQueueSizeDropped = metric.Metadata{
+		Name: "queue.raftsnapshot.sizedropped",
+		Help: "Number of replicas dropped or not queued because the Raft repair queue was at its maximum size"}
+	metaConsistencyQueueSizeDropped = metric.Metadata{
+		Name: "queue.consistency.sizedropped",
+		Help: "Number of replicas dropped or not queued because the consistency checker queue was at its maximum size"}
+	metaReplicaGCQueueSizeDropped = metric.Metadata{
+		Name: "queue.replicagc.sizedropped",
+		Help: "Number of replicas dropped or not queued because the replica GC queue was at its maximum size"}
+	metaReplicateQueueSizeDropped = metric.Metadata{
+		Name: "queue.replicate.sizedropped",
+		Help: "Number of replicas dropped or not queued because the replicate queue was at its maximum size"}
+	metaSplitQueueSizeDropped = metric.Metadata{
+		Name: "queue.split.sizedropped",
+		Help: "Number of replicas dropped or not queued because the split queue was at its maximum size"}
+	metaTimeSeriesMaintenanceQueueSizeDropped = metric.Metadata{
+		Name: "queue.tsmaintenance.sizedropped",
+		Help: "Number of replicas dropped or not queued because the time series maintenance queue was at its maximum size"}
+	metaGCQueuePendingHighWater = metric.Metadata{
+		Name: "queue.gc.pendinghighwater",
+		Help: "Highest number of replicas pending in the GC queue"}
+	metaRaftLogQueuePendingHighWater = metric.Metadata{
+		Name: "queue.raftlog.pendinghighwater",
+		Help: "Highest number of replicas pending in the Raft log queue"}
+	metaRaftSnapshotQueuePendingHighWater = metric.Metadata{
+		Name: "queue.raftsnapshot.pendinghighwater",
+		Help: "Highest number of replicas pending in the Raft repair queue"}
+	metaConsistencyQueuePendingHighWater = metric.Metadata{
+		Name: "queue.consistency.pendinghighwater",
+		Help: "Highest number of replicas pending in the consistency checker queue"}
+	metaReplicaGCQueuePendingHighWater = metric.Metadata{
+		Name: "queue.replicagc.pendinghighwater",
+		Help: "Highest number of replicas pending in the replica GC queue"}
+	metaReplicateQueuePendingHighWater = metric.Metadata{
+		Name: "queue.replicate.pendinghighwater",
+		Help: "Highest number of replicas pending in the replicate queue"}
+	metaSplitQueuePendingHighWater = metric.Metadata{
+		Name: "queue.split.pendinghighwater",
+		Help: "Highest number of replicas pending in the split queue"}
+	metaTimeSeriesMaintenanceQueuePendingHighWater = metric.Metadata{
+		Name: "queue.tsmaintenance.pendinghighwater",
+		Help: "Highest number of replicas pending in the time series maintenance queue"}
+
+	// Replica queue failure class metrics.
+	metaTimeSeriesMaintenanceQueueFailuresLease = metric.Metadata{
+		Name: "queue.tsmaintenance.process.failure.lease",
+		Help: "Number of replicas which failed processing in the time series maintenance queue due to the range lease"}
+	metaTimeSeriesMaintenanceQueueFailuresContextCanceled = metric.Metadata{
+		Name: "queue.tsmaintenance.process.failure.context-canceled",
+		Help: "Number of replicas which failed processing in the time series maintenance queue due to a canceled or expired context"}
+	metaTimeSeriesMaintenanceQueueFailuresKV = metric.Metadata{
+		Name: "queue.tsmaintenance.process.failure.kv",
+		Help: "Number of replicas which failed processing in the time series maintenance queue due to a KV error"}
+	metaTimeSeriesMaintenanceQueueFailuresOther = metric.Metadata{
+		Name: "queue.tsmaintenance.process.failure.other",
+		Help: "Number of replicas which failed processing in the time series maintenance queue due to other errors"}
+
+	// Replica queue shouldQueue metrics.
+	metaGCQueueShouldQueueNanos = metric.Metadata{
+		Name: "queue.gc.shouldqueuenanos",
+		Help: "Nanoseconds spent deciding whether to queue replicas in the GC queue"}
+	metaRaftLogQueueShouldQueueNanos = metric.Metadata{
+		Name: "queue.raftlog.shouldqueuenanos",
+		Help: "Nanoseconds spent deciding whether to queue replicas in the Raft log queue"}
+	metaRaftSnapshotQueueShouldQueueNanos = metric.Metadata{
+		Name: "queue.raftsnapshot.shouldqueuenanos",
+		Help: "Nanoseconds spent deciding whether to queue replicas in the Raft repair queue"}
+	metaConsistencyQueueShouldQueueNanos = metric.Metadata{
+		Name: "queue.consistency.shouldqueuenanos",
+		Help: "Nanoseconds spent deciding whether to queue replicas in the consistency checker queue"}
+	metaReplicaGCQueueShouldQueueNanos = metric.Metadata{
+		Name: "queue.replicagc.shouldqueuenanos",
+		Help: "Nanoseconds spent deciding whether to queue replicas in the replica GC queue"}
+	metaReplicateQueueShouldQueueNanos = metric.Metadata{
+		Name: "queue.replicate.shouldqueuenanos",
+		Help: "Nanoseconds spent deciding whether to queue replicas in the replicate queue"}
+	metaSplitQueueShouldQueueNanos = metric.Metadata{
+		Name: "queue.split.shouldqueuenanos",
+		Help: "Nanoseconds spent deciding whether to queue replicas in the split queue"}
+	metaTimeSeriesMaintenanceQueueShouldQueueNanos = metric.Metadata{
+		Name: "queue.tsmaintenance.shouldqueuenanos",
+		Help: "Nanoseconds spent deciding whether to queue replicas in the time series maintenance queue"}
+	metaTimeSeriesMaintenanceQueueShouldQueueDeferrals = metric.Metadata{
+		Name: "queue.tsmaintenance.shouldqueuedeferrals",
+		Help: "Number of replicas deferred to the next scanner pass because the time series maintenance queue exhausted its shouldQueue time budget"}
+
+	// Replica queue cache metrics.
+	metaQueueCacheHits = metric.Metadata{
+		Name: "queue.cache.hits",
+		Help: "Number of lookups of per-replica data cached by the replica queues which were hits"}
+	metaQueueCacheMisses = metric.Metadata{
+		Name: "queue.cache.misses",
+		Help: "Number of lookups of per-replica data cached by the replica queues which were misses"}
+	metaQueueCacheEvictions = metric.Metadata{
+		Name: "queue.cache.evictions",
+		Help: "Number of entries evicted from the replica queue cache to stay within its memory budget"}
+	metaQueueCacheBytes = metric.Metadata{
+		Name: "queue.cache.bytes",
+		Help: "Estimated memory used by the per-replica data cached by the replica queues"}
+
+	// Background maintenance slot metrics.
+	metaMaintenanceSlotsInUse = metric.Metadata{
+		Name: "queue.maintenance.slots.inuse",
+		Help: "Number of background maintenance slots acquired by the heavy replica queues"}
 
 	// GCInfo cumulative totals.
 	metaGCNumKeysAffected = metric.Metadata{
@@ -455,9 +664,25 @@ var (
 		Help: "Number of requests that have been stuck for a long time in raft"}
 )
 
+// newCCLMetrics, if set, constructs the metrics which the CCL packages
+// maintain for each store. See SetCCLMetrics.
+var newCCLMetrics func() metric.Struct
+
+// SetCCLMetrics allows setting the function constructing the metrics which the
+// CCL packages maintain for each store, such as those of their iterators. The
+// metrics are added to the registry of each store when it is constructed, and
+// are available to commands through ReplicaEvalContext.CCLMetrics. Only
+// allowed to be called by Init.
+func SetCCLMetrics(fn func() metric.Struct) {
+	// This is safe if SetCCLMetrics is only called at init time.
+	newCCLMetrics = fn
+}
+
 // StoreMetrics is the set of metrics for a given store.
 type StoreMetrics struct {
 	registry *metric.Registry
+	// cclMetrics are the metrics constructed by newCCLMetrics, if set.
+	cclMetrics metric.Struct
 
 	// Replica metrics.
 	ReplicaCount                  *metric.Counter // Does not include reserved replicas.
@@ -525,6 +750,7 @@ type StoreMetrics struct {
 	RdbTableReadersMemEstimate  *metric.Gauge
 	RdbReadAmplification        *metric.Gauge
 	RdbNumSSTables              *metric.Gauge
+	RdbTimestampBackfillBytes   *metric.Gauge
 
 	// TODO(mrtracy): This should be removed as part of #4465. This is only
 	// maintained to keep the current structure of StatusSummaries; it would be
@@ -611,6 +837,92 @@ type StoreMetrics struct {
 	TimeSeriesMaintenanceQueueFailures        *metric.Counter
 	TimeSeriesMaintenanceQueuePending         *metric.Gauge
 	TimeSeriesMaintenanceQueueProcessingNanos *metric.Counter
+	TimeSeriesMaintenanceQueueAccelerated     *metric.Gauge
+	TimeSeriesMaintenanceQueueDeleteRate      *metric.GaugeFloat64
+	TimeSeriesMaintenanceQueueDeclined        *metric.Counter
+
+	// Time series source pruning metrics.
+	TimeSeriesMaintenanceQueueSourcePrunedKeys  *metric.Counter
+	TimeSeriesMaintenanceQueueSourcePrunedBytes *metric.Counter
+
+	// Time series maintenance dry run metrics.
+	TimeSeriesMaintenanceQueueDryRunKeys  *metric.Gauge
+	TimeSeriesMaintenanceQueueDryRunBytes *metric.Gauge
+
+	// Replica queue timeout metrics.
+	GCQueueProcessTimeouts                    *metric.Counter
+	RaftLogQueueProcessTimeouts               *metric.Counter
+	RaftSnapshotQueueProcessTimeouts          *metric.Counter
+	ConsistencyQueueProcessTimeouts           *metric.Counter
+	ReplicaGCQueueProcessTimeouts             *metric.Counter
+	ReplicateQueueProcessTimeouts             *metric.Counter
+	SplitQueueProcessTimeouts                 *metric.Counter
+	TimeSeriesMaintenanceQueueProcessTimeouts *metric.Counter
+
+	// Replica queue wait metrics.
+	GCQueueWaitLatency                    *metric.Histogram
+	RaftLogQueueWaitLatency               *metric.Histogram
+	RaftSnapshotQueueWaitLatency          *metric.Histogram
+	ConsistencyQueueWaitLatency           *metric.Histogram
+	ReplicaGCQueueWaitLatency             *metric.Histogram
+	ReplicateQueueWaitLatency             *metric.Histogram
+	SplitQueueWaitLatency                 *metric.Histogram
+	TimeSeriesMaintenanceQueueWaitLatency *metric.Histogram
+
+	// Replica queue processing latency metrics.
+	TimeSeriesMaintenanceQueueProcessingLatency        *metric.Histogram
+	TimeSeriesMaintenanceQueueProcessingFailureLatency *metric.Histogram
+
+	// Replica queue backoff metrics.
+	TimeSeriesMaintenanceQueueBackedOff *metric.Gauge
+
+	// Replica queue memory metrics.
+	TimeSeriesMaintenanceQueueMemBytes   *metric.Gauge
+	TimeSeriesMaintenanceQueueMemDropped *metric.Counter
+
+	// Replica queue size metrics.
+	GCQueueSizeDropped                         *metric.Counter
+	RaftLogQueueSizeDropped                    *metric.Counter
+	RaftSnapshotQueueSizeDropped               *metric.Counter
+	ConsistencyQueueSizeDropped                *metric.Counter
+	ReplicaGCQueueSizeDropped                  *metric.Counter
+	ReplicateQueueSizeDropped                  *metric.Counter
+	SplitQueueSizeDropped                      *metric.Counter
+	TimeSeriesMaintenanceQueueSizeDropped      *metric.Counter
+	GCQueuePendingHighWater                    *metric.Gauge
+	RaftLogQueuePendingHighWater               *metric.Gauge
+	RaftSnapshotQueuePendingHighWater          *metric.Gauge
+	ConsistencyQueuePendingHighWater           *metric.Gauge
+	ReplicaGCQueuePendingHighWater             *metric.Gauge
+	ReplicateQueuePendingHighWater             *metric.Gauge
+	SplitQueuePendingHighWater                 *metric.Gauge
+	TimeSeriesMaintenanceQueuePendingHighWater *metric.Gauge
+
+	// Replica queue failure class metrics.
+	TimeSeriesMaintenanceQueueFailuresLease           *metric.Counter
+	TimeSeriesMaintenanceQueueFailuresContextCanceled *metric.Counter
+	TimeSeriesMaintenanceQueueFailuresKV              *metric.Counter
+	TimeSeriesMaintenanceQueueFailuresOther           *metric.Counter
+
+	// Replica queue shouldQueue metrics.
+	GCQueueShouldQueueNanos                        *metric.Counter
+	RaftLogQueueShouldQueueNanos                   *metric.Counter
+	RaftSnapshotQueueShouldQueueNanos              *metric.Counter
+	ConsistencyQueueShouldQueueNanos               *metric.Counter
+	ReplicaGCQueueShouldQueueNanos                 *metric.Counter
+	ReplicateQueueShouldQueueNanos                 *metric.Counter
+	SplitQueueShouldQueueNanos                     *metric.Counter
+	TimeSeriesMaintenanceQueueShouldQueueNanos     *metric.Counter
+	TimeSeriesMaintenanceQueueShouldQueueDeferrals *metric.Counter
+
+	// Replica queue cache metrics.
+	QueueCacheHits      *metric.Counter
+	QueueCacheMisses    *metric.Counter
+	QueueCacheEvictions *metric.Counter
+	QueueCacheBytes     *metric.Gauge
+
+	// Background maintenance slot metrics.
+	MaintenanceSlotsInUse *metric.Gauge
 
 	// GCInfo cumulative totals.
 	GCNumKeysAffected            *metric.Counter
@@ -708,6 +1020,7 @@ func newStoreMetrics(histogramWindow time.Duration) *StoreMetrics {
 		RdbTableReadersMemEstimate:  metric.NewGauge(metaRdbTableReadersMemEstimate),
 		RdbReadAmplification:        metric.NewGauge(metaRdbReadAmplification),
 		RdbNumSSTables:              metric.NewGauge(metaRdbNumSSTables),
+		RdbTimestampBackfillBytes:   metric.NewGauge(metaRdbTimestampBackfillBytes),
 
 		// Range event metrics.
 		RangeSplits:                     metric.NewCounter(metaRangeSplits),
@@ -787,6 +1100,114 @@ func newStoreMetrics(histogramWindow time.Duration) *StoreMetrics {
 		TimeSeriesMaintenanceQueueFailures:        metric.NewCounter(metaTimeSeriesMaintenanceQueueSuccesses),
 		TimeSeriesMaintenanceQueuePending:         metric.NewGauge(metaTimeSeriesMaintenanceQueuePending),
 		TimeSeriesMaintenanceQueueProcessingNanos: metric.NewCounter(metaTimeSeriesMaintenanceQueueProcessingNanos),
+		TimeSeriesMaintenanceQueueAccelerated:     metric.NewGauge(metaTimeSeriesMaintenanceQueueAccelerated),
+		TimeSeriesMaintenanceQueueDeleteRate:      metric.NewGaugeFloat64(metaTimeSeriesMaintenanceQueueDeleteRate),
+		TimeSeriesMaintenanceQueueDeclined:        metric.NewCounter(metaTimeSeriesMaintenanceQueueDeclined),
+
+		// Time series source pruning metrics.
+		TimeSeriesMaintenanceQueueSourcePrunedKeys:  metric.NewCounter(metaTimeSeriesMaintenanceQueueSourcePrunedKeys),
+		TimeSeriesMaintenanceQueueSourcePrunedBytes: metric.NewCounter(metaTimeSeriesMaintenanceQueueSourcePrunedBytes),
+
+		// Time series maintenance dry run metrics.
+		TimeSeriesMaintenanceQueueDryRunKeys:  metric.NewGauge(metaTimeSeriesMaintenanceQueueDryRunKeys),
+		TimeSeriesMaintenanceQueueDryRunBytes: metric.NewGauge(metaTimeSeriesMaintenanceQueueDryRunBytes),
+
+		// Replica queue timeout metrics.
+		GCQueueProcessTimeouts:                    metric.NewCounter(metaGCQueueProcessTimeouts),
+		RaftLogQueueProcessTimeouts:               metric.NewCounter(metaRaftLogQueueProcessTimeouts),
+		RaftSnapshotQueueProcessTimeouts:          metric.NewCounter(metaRaftSnapshotQueueProcessTimeouts),
+		ConsistencyQueueProcessTimeouts:           metric.NewCounter(metaConsistencyQueueProcessTimeouts),
+		ReplicaGCQueueProcessTimeouts:             metric.NewCounter(metaReplicaGCQueueProcessTimeouts),
+		ReplicateQueueProcessTimeouts:             metric.NewCounter(metaReplicateQueueProcessTimeouts),
+		SplitQueueProcessTimeouts:                 metric.NewCounter(metaSplitQueueProcessTimeouts),
+		TimeSeriesMaintenanceQueueProcessTimeouts: metric.NewCounter(metaTimeSeriesMaintenanceQueueProcessTimeouts),
+
+		// Replica queue wait metrics.
+		GCQueueWaitLatency: metric.NewHistogram(
+			metaGCQueueWaitLatency, histogramWindow, queueWaitMaxLatency.Nanoseconds(), 1,
+		),
+		RaftLogQueueWaitLatency: metric.NewHistogram(
+			metaRaftLogQueueWaitLatency, histogramWindow, queueWaitMaxLatency.Nanoseconds(), 1,
+		),
+		RaftSnapshotQueueWaitLatency: metric.NewHistogram(
+			metaRaftSnapshotQueueWaitLatency, histogramWindow, queueWaitMaxLatency.Nanoseconds(), 1,
+		),
+		ConsistencyQueueWaitLatency: metric.NewHistogram(
+			metaConsistencyQueueWaitLatency, histogramWindow, queueWaitMaxLatency.Nanoseconds(), 1,
+		),
+		ReplicaGCQueueWaitLatency: metric.NewHistogram(
+			metaReplicaGCQueueWaitLatency, histogramWindow, queueWaitMaxLatency.Nanoseconds(), 1,
+		),
+		ReplicateQueueWaitLatency: metric.NewHistogram(
+			metaReplicateQueueWaitLatency, histogramWindow, queueWaitMaxLatency.Nanoseconds(), 1,
+		),
+		SplitQueueWaitLatency: metric.NewHistogram(
+			metaSplitQueueWaitLatency, histogramWindow, queueWaitMaxLatency.Nanoseconds(), 1,
+		),
+		TimeSeriesMaintenanceQueueWaitLatency: metric.NewHistogram(
+			metaTimeSeriesMaintenanceQueueWaitLatency, histogramWindow, queueWaitMaxLatency.Nanoseconds(), 1,
+		),
+
+		// Replica queue processing latency metrics.
+		TimeSeriesMaintenanceQueueProcessingLatency: metric.NewHistogram(
+			metaTimeSeriesMaintenanceQueueProcessingLatency, histogramWindow,
+			queueProcessingMaxLatency.Nanoseconds(), 1,
+		),
+		TimeSeriesMaintenanceQueueProcessingFailureLatency: metric.NewHistogram(
+			metaTimeSeriesMaintenanceQueueProcessingFailureLatency, histogramWindow,
+			queueProcessingMaxLatency.Nanoseconds(), 1,
+		),
+
+		// Replica queue backoff metrics.
+		TimeSeriesMaintenanceQueueBackedOff: metric.NewGauge(metaTimeSeriesMaintenanceQueueBackedOff),
+
+		// Replica queue memory metrics.
+		TimeSeriesMaintenanceQueueMemBytes:   metric.NewGauge(metaTimeSeriesMaintenanceQueueMemBytes),
+		TimeSeriesMaintenanceQueueMemDropped: metric.NewCounter(metaTimeSeriesMaintenanceQueueMemDropped),
+
+		// Replica queue size metrics.
+		GCQueueSizeDropped:                         metric.NewCounter(metaGCQueueSizeDropped),
+		RaftLogQueueSizeDropped:                    metric.NewCounter(metaRaftLogQueueSizeDropped),
+		RaftSnapshotQueueSizeDropped:               metric.NewCounter(metaRaftSnapshotQueueSizeDropped),
+		ConsistencyQueueSizeDropped:                metric.NewCounter(metaConsistencyQueueSizeDropped),
+		ReplicaGCQueueSizeDropped:                  metric.NewCounter(metaReplicaGCQueueSizeDropped),
+		ReplicateQueueSizeDropped:                  metric.NewCounter(metaReplicateQueueSizeDropped),
+		SplitQueueSizeDropped:                      metric.NewCounter(metaSplitQueueSizeDropped),
+		TimeSeriesMaintenanceQueueSizeDropped:      metric.NewCounter(metaTimeSeriesMaintenanceQueueSizeDropped),
+		GCQueuePendingHighWater:                    metric.NewGauge(metaGCQueuePendingHighWater),
+		RaftLogQueuePendingHighWater:               metric.NewGauge(metaRaftLogQueuePendingHighWater),
+		RaftSnapshotQueuePendingHighWater:          metric.NewGauge(metaRaftSnapshotQueuePendingHighWater),
+		ConsistencyQueuePendingHighWater:           metric.NewGauge(metaConsistencyQueuePendingHighWater),
+		ReplicaGCQueuePendingHighWater:             metric.NewGauge(metaReplicaGCQueuePendingHighWater),
+		ReplicateQueuePendingHighWater:             metric.NewGauge(metaReplicateQueuePendingHighWater),
+		SplitQueuePendingHighWater:                 metric.NewGauge(metaSplitQueuePendingHighWater),
+		TimeSeriesMaintenanceQueuePendingHighWater: metric.NewGauge(metaTimeSeriesMaintenanceQueuePendingHighWater),
+
+		// Replica queue failure class metrics.
+		TimeSeriesMaintenanceQueueFailuresLease:           metric.NewCounter(metaTimeSeriesMaintenanceQueueFailuresLease),
+		TimeSeriesMaintenanceQueueFailuresContextCanceled: metric.NewCounter(metaTimeSeriesMaintenanceQueueFailuresContextCanceled),
+		TimeSeriesMaintenanceQueueFailuresKV:              metric.NewCounter(metaTimeSeriesMaintenanceQueueFailuresKV),
+		TimeSeriesMaintenanceQueueFailuresOther:           metric.NewCounter(metaTimeSeriesMaintenanceQueueFailuresOther),
+
+		// Replica queue shouldQueue metrics.
+		GCQueueShouldQueueNanos:                        metric.NewCounter(metaGCQueueShouldQueueNanos),
+		RaftLogQueueShouldQueueNanos:                   metric.NewCounter(metaRaftLogQueueShouldQueueNanos),
+		RaftSnapshotQueueShouldQueueNanos:              metric.NewCounter(metaRaftSnapshotQueueShouldQueueNanos),
+		ConsistencyQueueShouldQueueNanos:               metric.NewCounter(metaConsistencyQueueShouldQueueNanos),
+		ReplicaGCQueueShouldQueueNanos:                 metric.NewCounter(metaReplicaGCQueueShouldQueueNanos),
+		ReplicateQueueShouldQueueNanos:                 metric.NewCounter(metaReplicateQueueShouldQueueNanos),
+		SplitQueueShouldQueueNanos:                     metric.NewCounter(metaSplitQueueShouldQueueNanos),
+		TimeSeriesMaintenanceQueueShouldQueueNanos:     metric.NewCounter(metaTimeSeriesMaintenanceQueueShouldQueueNanos),
+		TimeSeriesMaintenanceQueueShouldQueueDeferrals: metric.NewCounter(metaTimeSeriesMaintenanceQueueShouldQueueDeferrals),
+
+		// Replica queue cache metrics.
+		QueueCacheHits:      metric.NewCounter(metaQueueCacheHits),
+		QueueCacheMisses:    metric.NewCounter(metaQueueCacheMisses),
+		QueueCacheEvictions: metric.NewCounter(metaQueueCacheEvictions),
+		QueueCacheBytes:     metric.NewGauge(metaQueueCacheBytes),
+
+		// Background maintenance slot metrics.
+		MaintenanceSlotsInUse: metric.NewGauge(metaMaintenanceSlotsInUse),
 
 		// GCInfo cumulative totals.
 		GCNumKeysAffected:            metric.NewCounter(metaGCNumKeysAffected),
@@ -823,6 +1244,10 @@ func newStoreMetrics(histogramWindow time.Duration) *StoreMetrics {
 	sm.raftRcvdMessages[raftpb.MsgTimeoutNow] = sm.RaftRcvdMsgTimeoutNow
 
 	storeRegistry.AddMetricStruct(sm)
+	if newCCLMetrics != nil {
+		sm.cclMetrics = newCCLMetrics()
+		storeRegistry.AddMetricStruct(sm.cclMetrics)
+	}
 
 	return sm
 }
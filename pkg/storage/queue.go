@@ -18,6 +18,7 @@ package storage
 
 import (
 	"container/heap"
+	"sort"
 	"sync"
 	"time"
 
@@ -27,6 +28,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/config"
 	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
@@ -45,6 +48,25 @@ const (
 	defaultProcessTimeout = 1 * time.Minute
 	// defaultQueueMaxSize is the default max size for a queue.
 	defaultQueueMaxSize = 10000
+	// maxQueueFailureBackoff caps the backoff of a replica which repeatedly
+	// fails processing (see queueConfig.failureBackoff).
+	maxQueueFailureBackoff = time.Hour
+	// queueItemMemSize is the estimated memory retained by a queued replica:
+	// its replicaItem, and its entries in the priority queue and in the map
+	// of queued replicas. It is charged to queueConfig.memAcc.
+	queueItemMemSize = 128
+	// queueProcessingMaxLatency is the maximum latency tracked by the
+	// processing latency histograms of queues. It is far above the latency
+	// histograms' default, as processing a replica may take many minutes.
+	queueProcessingMaxLatency = time.Hour
+	// queueWaitMaxLatency is the maximum latency tracked by the wait latency
+	// histograms of queues. Like queueProcessingMaxLatency, it is far above
+	// the latency histograms' default, as a replica may wait for many minutes
+	// behind the others queued, or behind a requeue delay.
+	queueWaitMaxLatency = time.Hour
+	// queueProcessingDurationSmoothing is the weight of the latest processing
+	// duration in the moving average which paces concurrent processing.
+	queueProcessingDurationSmoothing = 0.2
 )
 
 // a purgatoryError indicates a replica processing failure which indicates
@@ -55,10 +77,40 @@ type purgatoryError interface {
 	purgatoryErrorMarker() // dummy method for unique interface
 }
 
+// a deferredError indicates that queueImpl.process put off the processing of
+// the replica, which it arranged to be requeued (see requeueAfter), rather
+// than failing it. The replica is counted as neither processed nor failed,
+// and is not backed off.
+type deferredError interface {
+	error
+	deferredErrorMarker() // dummy method for unique interface
+}
+
+// processDeferredError is a deferredError with the reason the processing was
+// put off.
+type processDeferredError struct {
+	reason string
+}
+
+func (e *processDeferredError) Error() string {
+	return e.reason
+}
+
+func (*processDeferredError) deferredErrorMarker() {}
+
+// isDeferredError returns whether the error returned by processReplica
+// indicates that the processing of the replica was put off.
+func isDeferredError(err error) bool {
+	_, ok := errors.Cause(err).(deferredError)
+	return ok
+}
+
 // A replicaItem holds a replica and its priority for use with a priority queue.
 type replicaItem struct {
 	value    roachpb.RangeID
 	priority float64
+	// enqueued is the time the item was added to the queue.
+	enqueued time.Time
 	// The index is needed by update and is maintained by the heap.Interface methods.
 	index int // The index of the item in the heap.
 }
@@ -135,6 +187,24 @@ func shouldQueueAgain(now, last hlc.Timestamp, minInterval time.Duration) (bool,
 	return false, 0
 }
 
+// jitterInterval returns the interval adjusted by a deterministic jitter of up
+// to the given fraction of it, in either direction, derived from the range ID.
+// Using the returned interval with shouldQueueAgain spreads out the replicas
+// which were last processed at the same time, such as after a restart of the
+// cluster, while the jitter of each replica is the same on every call so that
+// it doesn't flap in and out of eligibility.
+func jitterInterval(interval time.Duration, rangeID roachpb.RangeID, fraction float64) time.Duration {
+	// Mix the bits of the range ID (with the splitmix64 finalizer) so that
+	// consecutive range IDs have unrelated jitters.
+	x := uint64(rangeID) + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	// u is uniformly distributed in [-1, 1).
+	u := 2*float64(x>>11)/(1<<53) - 1
+	return interval + time.Duration(u*fraction*float64(interval))
+}
+
 type queueImpl interface {
 	// shouldQueue accepts current time, a replica, and the system config
 	// and returns whether it should be queued and if so, at what priority.
@@ -166,6 +236,17 @@ type queueConfig struct {
 	// needsLease controls whether this queue requires the range lease to
 	// operate on a replica.
 	needsLease bool
+	// ignoresSystemConfig controls whether this queue adds and processes
+	// replicas before the system config has been gossiped. By default a queue
+	// neither adds nor processes a replica without it. A queue which doesn't
+	// consult the system config passed to queueImpl.shouldQueue and
+	// queueImpl.process can set it, so that it runs on a node which hasn't
+	// received the system config, as after a restart or while it is
+	// partitioned from the node gossiping it; such a queue is passed an empty
+	// system config, and the ranges it is given aren't checked for required
+	// splits, until the system config is available. Of the store's queues,
+	// only the time series maintenance queue sets it.
+	ignoresSystemConfig bool
 	// acceptsUnsplitRanges controls whether this queue can process ranges that
 	// need to be split due to zone config settings. Ranges are checked before
 	// calling queueImpl.shouldQueue and queueImpl.process.
@@ -174,18 +255,99 @@ type queueConfig struct {
 	// want to try to replicate a range until we know which zone it is in and
 	// therefore how many replicas are required).
 	acceptsUnsplitRanges bool
-	// processTimeout is the timeout for processing a replica.
+	// processTimeout is the timeout for processing a replica. A replica
+	// whose processing by the main processing loop times out is requeued at a
+	// reduced priority (see timedOutPriority), so that a replica which wedges
+	// its processing neither blocks the queue nor is forgotten. Such a replica
+	// is not backed off (see failureBackoff). Defaults to
+	// defaultProcessTimeout.
 	processTimeout time.Duration
+	// historySize is the number of recent processing outcomes persisted for
+	// each replica (see Replica.GetQueueHistory). Zero disables recording.
+	historySize int
+	// shouldQueueBudget, if non-zero, is the time which may be spent in
+	// queueImpl.shouldQueue during each pass of the replica scanner. Once it is
+	// exhausted, replicas are not considered for the rest of the pass, so that
+	// an expensive shouldQueue can't slow the scanner down for all queues.
+	// Replicas are visited in a random order, so deferred replicas are likely
+	// to be considered in the next pass.
+	shouldQueueBudget time.Duration
+	// concurrency is the maximum number of replicas processed at once. A
+	// replica is never processed concurrently with itself. Defaults to 1.
+	concurrency int
+	// concurrencySetting, if non-nil, overrides concurrency, so that it can be
+	// changed at runtime.
+	concurrencySetting *settings.IntSetting
+	// enabledSetting, if non-nil, enables and disables the queue at runtime.
+	// While it is disabled, replicas are not added to the queue, and those
+	// already queued are dropped when the queue next dequeues, so that the
+	// scanner repopulates the queue once it is re-enabled.
+	enabledSetting *settings.BoolSetting
 	// successes is a counter of replicas processed successfully.
 	successes *metric.Counter
 	// failures is a counter of replicas which failed processing.
 	failures *metric.Counter
+	// classifyError, if non-nil, replaces classifyQueueError as the function
+	// which buckets processing errors into the classes counted by
+	// failuresByClass.
+	classifyError func(error) queueFailureClass
+	// failuresByClass, if non-nil, holds counters of replicas which failed
+	// processing, by the class of their error. Failures of a class without a
+	// counter are only counted by failures.
+	failuresByClass map[queueFailureClass]*metric.Counter
 	// pending is a gauge measuring current replica count pending.
 	pending *metric.Gauge
+	// pendingHighWater is a gauge measuring the highest replica count pending
+	// since the queue was created.
+	pendingHighWater *metric.Gauge
+	// sizeDropped is a counter of replicas dropped, or not queued, because the
+	// queue was at maxSize.
+	sizeDropped *metric.Counter
 	// processingNanos is a counter measuring total nanoseconds spent processing replicas.
 	processingNanos *metric.Counter
+	// processingLatency, if non-nil, is a histogram of the time spent in
+	// queueImpl.process by replicas processed successfully, and
+	// processingFailureLatency, if non-nil, by replicas whose processing
+	// failed or timed out. Unlike processingNanos, they reveal whether the
+	// time is spent by a few slow replicas or by many fast ones.
+	processingLatency        *metric.Histogram
+	processingFailureLatency *metric.Histogram
+	// timeouts is a counter of replicas whose processing timed out.
+	timeouts *metric.Counter
+	// waitLatency is a histogram of the time replicas spend queued before
+	// being dequeued for processing.
+	waitLatency *metric.Histogram
+	// failureBackoff, if non-zero, is the time for which a replica which
+	// failed processing is not re-added to the queue by MaybeAdd, so that a
+	// replica which keeps failing doesn't fail in a tight loop. The backoff
+	// doubles with each consecutive failure, up to maxQueueFailureBackoff,
+	// and is reset once the replica is processed successfully. Replicas sent
+	// to purgatory, and replicas whose processing timed out, which are
+	// requeued instead, are not backed off.
+	failureBackoff time.Duration
+	// backedOff is a gauge measuring the number of replicas currently backed
+	// off. It must be set if failureBackoff is.
+	backedOff *metric.Gauge
 	// purgatory is a gauge measuring current replica count in purgatory.
 	purgatory *metric.Gauge
+	// shouldQueueNanos is a counter measuring total nanoseconds spent in
+	// queueImpl.shouldQueue.
+	shouldQueueNanos *metric.Counter
+	// shouldQueueDeferrals is a counter of replicas which weren't considered
+	// because shouldQueueBudget was exhausted.
+	shouldQueueDeferrals *metric.Counter
+	// memAcc, if non-nil, is the account to which queueItemMemSize is charged
+	// for each queued replica, and released once it is dequeued or removed.
+	// Once the account's budget is exhausted, the lowest priority replicas
+	// are dropped to make room for replicas of higher priority, and replicas
+	// of lower priority aren't queued, so that a store under memory pressure
+	// sheds queued replicas rather than growing its queues to maxSize.
+	memAcc *mon.BoundAccount
+	// memBytes is a gauge measuring the bytes charged to memAcc, and
+	// memDropped a counter of the replicas dropped, or not queued, because its
+	// budget was exhausted. They must be set if memAcc is.
+	memBytes   *metric.Gauge
+	memDropped *metric.Counter
 }
 
 // baseQueue is the base implementation of the replicaQueue interface.
@@ -221,13 +383,31 @@ type baseQueue struct {
 		stopped     bool
 		// Some tests in this package disable queues.
 		disabled bool
+		// shouldQueueSpent is the time spent in shouldQueue during the current
+		// scanner pass.
+		shouldQueueSpent time.Duration
+		// sizeDropLogged is set once a replica dropped because the queue was
+		// at maxSize has been logged during the current scanner pass, so that
+		// a queue which is falling behind logs once per pass rather than once
+		// per replica.
+		sizeDropLogged bool
+		// processing holds the IDs of the replicas being processed, which
+		// are at most maxConcurrency(). This is needed because the main
+		// processing loop, the purgatory loop and DrainQueue can all process
+		// replicas.
+		processing map[roachpb.RangeID]struct{}
+		// processingDone is closed, and replaced, when the processing of a
+		// replica finishes.
+		processingDone chan struct{}
+		// backoffs holds the replicas which failed processing since they were
+		// last processed successfully, if failureBackoff is set.
+		backoffs map[roachpb.RangeID]*queueBackoff
+		// requeues holds the replicas with a pending requeueAfter.
+		requeues map[roachpb.RangeID]struct{}
+		// avgProcessing is the exponentially weighted moving average of the
+		// durations of the processing of replicas by the main processing loop.
+		avgProcessing time.Duration
 	}
-
-	// processMu synchronizes execution of processing for a single queue,
-	// ensuring that we never process more than a single replica at a time. This
-	// is needed because both the main processing loop and the purgatory loop can
-	// process replicas.
-	processMu sync.Locker
 }
 
 // newBaseQueue returns a new instance of baseQueue with the specified
@@ -243,6 +423,12 @@ func newBaseQueue(
 	if cfg.processTimeout == 0 {
 		cfg.processTimeout = defaultProcessTimeout
 	}
+	if cfg.concurrency == 0 {
+		cfg.concurrency = 1
+	}
+	if cfg.classifyError == nil {
+		cfg.classifyError = classifyQueueError
+	}
 
 	ambient := store.cfg.AmbientCtx
 	ambient.AddLogTag(name, nil)
@@ -258,7 +444,10 @@ func newBaseQueue(
 	}
 	bq.mu.Locker = new(syncutil.Mutex)
 	bq.mu.replicas = map[roachpb.RangeID]*replicaItem{}
-	bq.processMu = new(syncutil.Mutex)
+	bq.mu.processing = map[roachpb.RangeID]struct{}{}
+	bq.mu.processingDone = make(chan struct{})
+	bq.mu.backoffs = map[roachpb.RangeID]*queueBackoff{}
+	bq.mu.requeues = map[roachpb.RangeID]struct{}{}
 
 	return &bq
 }
@@ -291,6 +480,78 @@ func (bq *baseQueue) Disabled() bool {
 	return bq.mu.disabled
 }
 
+// settingEnabled returns false if the queue is disabled by its
+// enabledSetting. Unlike Disabled, it reflects the cluster setting rather than
+// SetDisabled.
+func (bq *baseQueue) settingEnabled() bool {
+	return bq.enabledSetting == nil || bq.enabledSetting.Get()
+}
+
+// maxConcurrency returns the maximum number of replicas processed at once.
+func (bq *baseQueue) maxConcurrency() int {
+	if bq.concurrencySetting != nil {
+		if c := bq.concurrencySetting.Get(); c > 0 {
+			return int(c)
+		}
+	}
+	return bq.concurrency
+}
+
+// acquireProcessing blocks until the replica with the supplied range ID may
+// be processed: until fewer than maxConcurrency() replicas, none of which is
+// the replica, are being processed. It must be paired with a call to
+// releaseProcessing, unless it returns an error because the context is done.
+func (bq *baseQueue) acquireProcessing(ctx context.Context, rangeID roachpb.RangeID) error {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if err := bq.waitForProcessingLocked(ctx, func() bool {
+		_, busy := bq.mu.processing[rangeID]
+		return !busy && len(bq.mu.processing) < bq.maxConcurrency()
+	}); err != nil {
+		return err
+	}
+	bq.mu.processing[rangeID] = struct{}{}
+	return nil
+}
+
+// waitForProcessingSlot blocks until fewer than maxConcurrency() replicas are
+// being processed. Unlike acquireProcessing, it doesn't claim the slot.
+func (bq *baseQueue) waitForProcessingSlot(ctx context.Context) error {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	return bq.waitForProcessingLocked(ctx, func() bool {
+		return len(bq.mu.processing) < bq.maxConcurrency()
+	})
+}
+
+// waitForProcessingLocked blocks until ready returns true, re-evaluating it
+// each time the processing of a replica finishes, or until the context is
+// done. bq.mu must be held; it is released while waiting.
+func (bq *baseQueue) waitForProcessingLocked(ctx context.Context, ready func() bool) error {
+	for !ready() {
+		done := bq.mu.processingDone
+		bq.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			bq.mu.Lock()
+			return ctx.Err()
+		}
+		bq.mu.Lock()
+	}
+	return nil
+}
+
+// releaseProcessing marks the processing of the replica with the supplied
+// range ID as finished.
+func (bq *baseQueue) releaseProcessing(rangeID roachpb.RangeID) {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	delete(bq.mu.processing, rangeID)
+	close(bq.mu.processingDone)
+	bq.mu.processingDone = make(chan struct{})
+}
+
 // Start launches a goroutine to process entries in the queue. The
 // provided stopper is used to finish processing.
 func (bq *baseQueue) Start(clock *hlc.Clock, stopper *stop.Stopper) {
@@ -324,7 +585,7 @@ func (bq *baseQueue) MaybeAdd(repl *Replica, now hlc.Timestamp) {
 	bq.mu.Lock()
 	defer bq.mu.Unlock()
 
-	if bq.mu.stopped || bq.mu.disabled {
+	if bq.mu.stopped || bq.mu.disabled || !bq.settingEnabled() {
 		return
 	}
 
@@ -334,7 +595,14 @@ func (bq *baseQueue) MaybeAdd(repl *Replica, now hlc.Timestamp) {
 
 	ctx := repl.AnnotateCtx(bq.AnnotateCtx(context.TODO()))
 
-	if !cfgOk {
+	if bq.backedOffLocked(repl.RangeID, bq.store.Clock().PhysicalTime()) {
+		if log.V(3) {
+			log.Infof(ctx, "backed off after repeated failures; not adding")
+		}
+		return
+	}
+
+	if !cfgOk && !bq.ignoresSystemConfig {
 		if log.V(1) {
 			log.Infof(ctx, "no system config available. skipping")
 		}
@@ -362,12 +630,34 @@ func (bq *baseQueue) MaybeAdd(repl *Replica, now hlc.Timestamp) {
 		}
 	}
 
+	if bq.shouldQueueBudget > 0 && bq.mu.shouldQueueSpent >= bq.shouldQueueBudget {
+		if log.V(2) {
+			log.Infof(ctx, "shouldQueue budget of %s exhausted; deferring to next scanner pass",
+				bq.shouldQueueBudget)
+		}
+		bq.shouldQueueDeferrals.Inc(1)
+		return
+	}
+	start := timeutil.Now()
 	should, priority := bq.impl.shouldQueue(ctx, now, repl, cfg)
+	elapsed := timeutil.Since(start)
+	bq.mu.shouldQueueSpent += elapsed
+	bq.shouldQueueNanos.Inc(elapsed.Nanoseconds())
 	if _, err := bq.addInternal(ctx, repl.Desc(), should, priority); !isExpectedQueueError(err) {
 		log.Errorf(ctx, "unable to add: %s", err)
 	}
 }
 
+// startScanPass implements scanPassObserver. It resets the time spent in
+// shouldQueue against shouldQueueBudget, and allows the next replica dropped
+// because the queue is at maxSize to be logged.
+func (bq *baseQueue) startScanPass() {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	bq.mu.shouldQueueSpent = 0
+	bq.mu.sizeDropLogged = false
+}
+
 func (bq *baseQueue) requiresSplit(cfg config.SystemConfig, repl *Replica) bool {
 	if bq.acceptsUnsplitRanges {
 		return false
@@ -392,7 +682,7 @@ func (bq *baseQueue) addInternal(
 		return false, errQueueStopped
 	}
 
-	if bq.mu.disabled {
+	if bq.mu.disabled || !bq.settingEnabled() {
 		if log.V(3) {
 			log.Infof(ctx, "queue disabled")
 		}
@@ -433,13 +723,39 @@ func (bq *baseQueue) addInternal(
 	if log.V(3) {
 		log.Infof(ctx, "adding: priority=%0.3f", priority)
 	}
-	item = &replicaItem{value: desc.RangeID, priority: priority}
+	if !bq.reserveItemMemLocked(ctx, priority) {
+		if log.V(1) {
+			log.Infof(ctx, "memory budget exhausted; not adding at priority %0.3f", priority)
+		}
+		return false, nil
+	}
+	item = &replicaItem{
+		value:    desc.RangeID,
+		priority: priority,
+		enqueued: bq.store.Clock().PhysicalTime(),
+	}
 	bq.add(item)
 
 	// If adding this replica has pushed the queue past its maximum size,
-	// remove the lowest priority element.
-	if pqLen := bq.mu.priorityQ.Len(); pqLen > bq.maxSize {
-		bq.remove(bq.mu.priorityQ[pqLen-1])
+	// remove the lowest priority element, which may be the replica itself.
+	if bq.mu.priorityQ.Len() > bq.maxSize {
+		drop := bq.lowestPriorityLocked()
+		if item.priority <= drop.priority {
+			drop = item
+		}
+		bq.sizeDropped.Inc(1)
+		if !bq.mu.sizeDropLogged {
+			bq.mu.sizeDropLogged = true
+			log.Warningf(ctx, "queue at its maximum size of %d; dropping r%d queued at priority %0.3f",
+				bq.maxSize, drop.value, drop.priority)
+		}
+		bq.remove(drop)
+		if drop == item {
+			return false, nil
+		}
+	}
+	if pending := int64(bq.mu.priorityQ.Len()); pending > bq.pendingHighWater.Value() {
+		bq.pendingHighWater.Update(pending)
 	}
 	// Signal the processLoop that a replica has been added.
 	select {
@@ -459,6 +775,10 @@ func (bq *baseQueue) MaybeRemove(rangeID roachpb.RangeID) {
 		return
 	}
 
+	if _, ok := bq.mu.backoffs[rangeID]; ok {
+		delete(bq.mu.backoffs, rangeID)
+		bq.updateBackedOffLocked(bq.store.Clock().PhysicalTime())
+	}
 	if item, ok := bq.mu.replicas[rangeID]; ok {
 		ctx := bq.AnnotateCtx(context.TODO())
 		if log.V(3) {
@@ -473,6 +793,9 @@ func (bq *baseQueue) MaybeRemove(rangeID roachpb.RangeID) {
 func (bq *baseQueue) processLoop(clock *hlc.Clock, stopper *stop.Stopper) {
 	ctx := bq.AnnotateCtx(context.Background())
 	stopper.RunWorker(ctx, func(ctx context.Context) {
+		// stopCtx interrupts waiting for a processing slot when the stopper
+		// stops.
+		stopCtx := stopper.WithCancel(ctx)
 		defer func() {
 			bq.mu.Lock()
 			bq.mu.stopped = true
@@ -503,26 +826,58 @@ func (bq *baseQueue) processLoop(clock *hlc.Clock, stopper *stop.Stopper) {
 					// In case we're in a test, still block on the impl.
 					bq.impl.timer(0)
 				}
-			// Process replicas as the timer expires.
+			// Process replicas as the timer expires. Processing is asynchronous
+			// so that up to maxConcurrency() replicas are processed at once;
+			// without concurrency, the loop waits for it to finish. Replicas
+			// stay queued while all processing slots are taken.
 			case <-nextTime:
-				repl := bq.pop()
+				if err := bq.waitForProcessingSlot(stopCtx); err != nil {
+					return
+				}
+				repl, priority := bq.popWithPriority()
 				var duration time.Duration
 				if repl != nil {
 					annotatedCtx := repl.AnnotateCtx(ctx)
-					if stopper.RunTask(annotatedCtx, func(annotatedCtx context.Context) {
+					if err := bq.acquireProcessing(stopCtx, repl.RangeID); err != nil {
+						return
+					}
+					concurrency := bq.maxConcurrency()
+					done := make(chan struct{})
+					// elapsed is the duration of the processing of the replica,
+					// set before done is closed.
+					var elapsed time.Duration
+					if err := stopper.RunAsyncTask(annotatedCtx, func(annotatedCtx context.Context) {
+						defer close(done)
+						defer bq.releaseProcessing(repl.RangeID)
 						start := timeutil.Now()
 						if err := bq.processReplica(annotatedCtx, repl, clock); err != nil {
 							// Maybe add failing replica to purgatory if the queue supports it.
 							bq.maybeAddToPurgatory(annotatedCtx, repl, err, clock, stopper)
+							if isProcessTimeout(err) {
+								bq.requeueTimedOut(annotatedCtx, repl, priority)
+							}
 						}
-						duration = timeutil.Since(start)
+						elapsed = timeutil.Since(start)
 						if log.V(2) {
-							log.Infof(annotatedCtx, "done %s", duration)
+							log.Infof(annotatedCtx, "done %s", elapsed)
 						}
-						bq.processingNanos.Inc(duration.Nanoseconds())
-					}) != nil {
+						bq.processingNanos.Inc(elapsed.Nanoseconds())
+						bq.recordProcessingDuration(elapsed)
+					}); err != nil {
+						bq.releaseProcessing(repl.RangeID)
 						return
 					}
+					if concurrency <= 1 {
+						<-done
+						duration = elapsed
+					} else {
+						// The replica is still being processed, so the timer is
+						// paced by the average processing duration. As it paces
+						// the processing of the queue as a whole, each replica
+						// being processed concurrently accounts for a fraction of
+						// the processing time.
+						duration = bq.avgProcessingDuration() / time.Duration(concurrency)
+					}
 				}
 				if bq.Length() == 0 {
 					nextTime = nil
@@ -534,25 +889,44 @@ func (bq *baseQueue) processLoop(clock *hlc.Clock, stopper *stop.Stopper) {
 	})
 }
 
+// recordProcessingDuration folds the duration of the processing of a replica
+// into the moving average returned by avgProcessingDuration.
+func (bq *baseQueue) recordProcessingDuration(d time.Duration) {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if bq.mu.avgProcessing == 0 {
+		bq.mu.avgProcessing = d
+		return
+	}
+	bq.mu.avgProcessing += time.Duration(
+		queueProcessingDurationSmoothing * float64(d-bq.mu.avgProcessing))
+}
+
+// avgProcessingDuration returns the moving average of the durations of the
+// processing of replicas by the main processing loop.
+func (bq *baseQueue) avgProcessingDuration() time.Duration {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	return bq.mu.avgProcessing
+}
+
 // processReplica processes a single replica. This should not be
 // called externally to the queue. bq.mu.Lock must not be held
-// while calling this method.
+// while calling this method, and the caller must have acquired the
+// replica's processing (see acquireProcessing).
 func (bq *baseQueue) processReplica(
 	queueCtx context.Context, repl *Replica, clock *hlc.Clock,
 ) error {
-	bq.processMu.Lock()
-	defer bq.processMu.Unlock()
-
 	// Load the system config.
 	cfg, ok := bq.gossip.GetSystemConfig()
-	if !ok {
+	if !ok && !bq.ignoresSystemConfig {
 		if log.V(1) {
 			log.Infof(queueCtx, "no system config available, skipping")
 		}
 		return nil
 	}
 
-	if bq.requiresSplit(cfg, repl) {
+	if ok && bq.requiresSplit(cfg, repl) {
 		// Range needs to be split due to zone configs, but queue does
 		// not accept unsplit ranges.
 		if log.V(3) {
@@ -608,16 +982,149 @@ func (bq *baseQueue) processReplica(
 	if log.V(3) {
 		log.Infof(queueCtx, "processing")
 	}
-	if err := bq.impl.process(ctx, repl, cfg); err != nil {
+	desc := repl.Desc()
+	finish := bq.store.StartBackgroundOperation(ctx, BackgroundOperation{
+		Purpose: BackgroundOperationQueueProcessing,
+		Owner:   bq.name,
+		Span:    roachpb.Span{Key: desc.StartKey.AsRawKey(), EndKey: desc.EndKey.AsRawKey()},
+	}, nil /* progress */)
+	defer finish()
+	start := timeutil.Now()
+	processStart := clock.PhysicalTime()
+	liveBytesBefore := repl.GetMVCCStats().LiveBytes
+	err := bq.impl.process(ctx, repl, cfg)
+	if isDeferredError(err) {
+		log.VEventf(ctx, 1, "processing deferred: %s", err)
+		return err
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		bq.timeouts.Inc(1)
+		err = errors.Wrapf(ctx.Err(), "processing timed out after %s: %s", bq.processTimeout, err)
+	}
+	bq.recordProcessingLatency(clock.PhysicalTime().Sub(processStart), err)
+	if bq.historySize > 0 {
+		outcome := QueueOutcome{
+			Time:            clock.Now(),
+			Duration:        timeutil.Since(start),
+			ErrorClass:      queueErrorClass(err),
+			LiveBytesBefore: liveBytesBefore,
+			LiveBytesAfter:  repl.GetMVCCStats().LiveBytes,
+		}
+		// Record the outcome outside of the processing timeout so that
+		// timeouts are recorded too.
+		recordCtx := repl.AnnotateCtx(queueCtx)
+		if err := repl.recordQueueOutcome(recordCtx, bq.name, outcome, bq.historySize); err != nil {
+			log.ErrEventf(ctx, "failed to record queue outcome: %s", err)
+		}
+	}
+	if err != nil {
 		return err
 	}
 	if log.V(3) {
 		log.Infof(ctx, "done")
 	}
 	bq.successes.Inc(1)
+	bq.resetBackoff(repl.RangeID)
 	return nil
 }
 
+// recordProcessingLatency records the latency of a call to queueImpl.process
+// which returned err in the histogram of its outcome, if the queue has one.
+func (bq *baseQueue) recordProcessingLatency(latency time.Duration, err error) {
+	h := bq.processingLatency
+	if err != nil {
+		h = bq.processingFailureLatency
+	}
+	if h != nil {
+		h.RecordValue(latency.Nanoseconds())
+	}
+}
+
+// queueBackoff records the consecutive processing failures of a replica.
+type queueBackoff struct {
+	failures int
+	// until is the time at which the replica may be re-added to the queue.
+	until time.Time
+}
+
+// failureBackoffDuration returns the backoff after the supplied number of
+// consecutive failures, given the backoff after the first failure.
+func failureBackoffDuration(initial time.Duration, failures int) time.Duration {
+	backoff := initial
+	for i := 1; i < failures && backoff < maxQueueFailureBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxQueueFailureBackoff {
+		backoff = maxQueueFailureBackoff
+	}
+	return backoff
+}
+
+// recordFailure records a processing failure of the replica, backing it off if
+// the queue backs off failing replicas.
+func (bq *baseQueue) recordFailure(ctx context.Context, rangeID roachpb.RangeID) {
+	if bq.failureBackoff == 0 {
+		return
+	}
+	now := bq.store.Clock().PhysicalTime()
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	b, ok := bq.mu.backoffs[rangeID]
+	if !ok {
+		b = &queueBackoff{}
+		bq.mu.backoffs[rangeID] = b
+	}
+	b.failures++
+	backoff := failureBackoffDuration(bq.failureBackoff, b.failures)
+	b.until = now.Add(backoff)
+	bq.updateBackedOffLocked(now)
+	if log.V(1) {
+		log.Infof(ctx, "backing off for %s after %d consecutive failures", backoff, b.failures)
+	}
+}
+
+// resetBackoff forgets the failures of the replica once it has been processed
+// successfully.
+func (bq *baseQueue) resetBackoff(rangeID roachpb.RangeID) {
+	if bq.failureBackoff == 0 {
+		return
+	}
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if _, ok := bq.mu.backoffs[rangeID]; ok {
+		delete(bq.mu.backoffs, rangeID)
+		bq.updateBackedOffLocked(bq.store.Clock().PhysicalTime())
+	}
+}
+
+// backedOffLocked returns whether the replica is currently backed off. Caller
+// must hold mutex.
+func (bq *baseQueue) backedOffLocked(rangeID roachpb.RangeID, now time.Time) bool {
+	b, ok := bq.mu.backoffs[rangeID]
+	if !ok {
+		return false
+	}
+	if now.Before(b.until) {
+		return true
+	}
+	// The backoff has expired, though the failures are remembered until the
+	// replica is processed successfully.
+	bq.updateBackedOffLocked(now)
+	return false
+}
+
+// updateBackedOffLocked updates the gauge of backed off replicas. Caller must
+// hold mutex.
+func (bq *baseQueue) updateBackedOffLocked(now time.Time) {
+	var n int64
+	for _, b := range bq.mu.backoffs {
+		if now.Before(b.until) {
+			n++
+		}
+	}
+	bq.backedOff.Update(n)
+}
+
 // maybeAddToPurgatory possibly adds the specified replica to the
 // purgatory queue, which holds replicas which have failed
 // processing. To be added, the failing error must implement
@@ -627,13 +1134,23 @@ func (bq *baseQueue) processReplica(
 func (bq *baseQueue) maybeAddToPurgatory(
 	ctx context.Context, repl *Replica, triggeringErr error, clock *hlc.Clock, stopper *stop.Stopper,
 ) {
+	// A replica whose processing was put off has already been requeued.
+	if isDeferredError(triggeringErr) {
+		return
+	}
+
 	// Increment failures metric here to capture all error returns from
 	// process().
-	bq.failures.Inc(1)
+	bq.recordFailureClass(triggeringErr)
 
 	// Check whether the failure is a purgatory error and whether the queue supports it.
 	if _, ok := triggeringErr.(purgatoryError); !ok || bq.impl.purgatoryChan() == nil {
 		log.Error(ctx, triggeringErr)
+		// A replica whose processing timed out is requeued at a reduced
+		// priority rather than backed off (see requeueTimedOut).
+		if !isProcessTimeout(triggeringErr) {
+			bq.recordFailure(ctx, repl.RangeID)
+		}
 		return
 	}
 	bq.mu.Lock()
@@ -689,6 +1206,10 @@ func (bq *baseQueue) maybeAddToPurgatory(
 					}
 					annotatedCtx := repl.AnnotateCtx(ctx)
 					if stopper.RunTask(annotatedCtx, func(annotatedCtx context.Context) {
+						if err := bq.acquireProcessing(annotatedCtx, repl.RangeID); err != nil {
+							return
+						}
+						defer bq.releaseProcessing(repl.RangeID)
 						if err := bq.processReplica(annotatedCtx, repl, clock); err != nil {
 							bq.maybeAddToPurgatory(annotatedCtx, repl, err, clock, stopper)
 						}
@@ -722,24 +1243,220 @@ func (bq *baseQueue) maybeAddToPurgatory(
 	})
 }
 
+// isProcessTimeout returns whether the error returned by processReplica
+// indicates that the processing of the replica timed out.
+func isProcessTimeout(err error) bool {
+	return errors.Cause(err) == context.DeadlineExceeded
+}
+
+// queueFailureClass is a class of errors returned by processReplica, by which
+// processing failures are counted.
+type queueFailureClass int
+
+const (
+	// queueFailureOther is the class of errors which fit no other class.
+	queueFailureOther queueFailureClass = iota
+	// queueFailureLease is the class of errors due to the replica not holding,
+	// or failing to acquire, the range lease.
+	queueFailureLease
+	// queueFailureContextCanceled is the class of errors due to the processing
+	// context being canceled or timing out.
+	queueFailureContextCanceled
+	// queueFailureKV is the class of errors returned by the KV layer.
+	queueFailureKV
+)
+
+func (c queueFailureClass) String() string {
+	switch c {
+	case queueFailureLease:
+		return "lease"
+	case queueFailureContextCanceled:
+		return "context-canceled"
+	case queueFailureKV:
+		return "kv"
+	default:
+		return "other"
+	}
+}
+
+// classifyQueueError is the default classification of processing errors.
+func classifyQueueError(err error) queueFailureClass {
+	switch cause := errors.Cause(err).(type) {
+	case *roachpb.NotLeaseHolderError, *roachpb.LeaseRejectedError:
+		return queueFailureLease
+	case roachpb.ErrorDetailInterface:
+		return queueFailureKV
+	default:
+		if cause == context.Canceled || cause == context.DeadlineExceeded {
+			return queueFailureContextCanceled
+		}
+		return queueFailureOther
+	}
+}
+
+// recordFailureClass counts a processing failure, both in the failures metric
+// and by the class of its error.
+func (bq *baseQueue) recordFailureClass(err error) {
+	bq.failures.Inc(1)
+	if c, ok := bq.failuresByClass[bq.classifyError(err)]; ok {
+		c.Inc(1)
+	}
+}
+
+// timedOutPriority returns the priority at which a replica queued at the
+// supplied priority is requeued after its processing timed out. The priority
+// is reduced so that the other queued replicas are processed first.
+func timedOutPriority(priority float64) float64 {
+	if priority > 0 {
+		return priority / 2
+	}
+	return priority - 1
+}
+
+// requeueTimedOut requeues a replica whose processing timed out, unless it
+// was added back to the queue or to purgatory in the meantime, or is backed
+// off after an earlier failure, in which case it is left to be re-added by
+// MaybeAdd once the backoff expires. The timeout itself doesn't back the
+// replica off.
+func (bq *baseQueue) requeueTimedOut(ctx context.Context, repl *Replica, priority float64) {
+	now := bq.store.Clock().PhysicalTime()
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	if _, ok := bq.mu.replicas[repl.RangeID]; ok {
+		return
+	}
+	if bq.backedOffLocked(repl.RangeID, now) {
+		if log.V(1) {
+			log.Infof(ctx, "not requeuing after timeout while backed off")
+		}
+		return
+	}
+	priority = timedOutPriority(priority)
+	if log.V(1) {
+		log.Infof(ctx, "requeuing after timeout: priority=%0.3f", priority)
+	}
+	if _, err := bq.addInternal(ctx, repl.Desc(), true, priority); err != nil && log.V(1) {
+		log.Infof(ctx, "unable to requeue after timeout: %s", err)
+	}
+}
+
+// requeueAfter adds the replica to the queue at the supplied priority once
+// the supplied delay has passed. It is called by queueImpl.process when it
+// stops with work remaining, so that the replica is revisited soon rather than
+// on the next pass of the replica scanner. The replica is added regardless of
+// queueImpl.shouldQueue. A replica has at most one pending requeue; further
+// requests while it is pending are ignored.
+func (bq *baseQueue) requeueAfter(
+	ctx context.Context, repl *Replica, after time.Duration, priority float64,
+) {
+	bq.mu.Lock()
+	if _, ok := bq.mu.requeues[repl.RangeID]; ok {
+		bq.mu.Unlock()
+		return
+	}
+	bq.mu.requeues[repl.RangeID] = struct{}{}
+	bq.mu.Unlock()
+	done := func() {
+		bq.mu.Lock()
+		delete(bq.mu.requeues, repl.RangeID)
+		bq.mu.Unlock()
+	}
+
+	// The processing context may be canceled as soon as process returns.
+	ctx = repl.AnnotateCtx(bq.AnnotateCtx(context.Background()))
+	if log.V(1) {
+		log.Infof(ctx, "requeuing in %s: priority=%0.3f", after, priority)
+	}
+	stopper := bq.store.Stopper()
+	if err := stopper.RunAsyncTask(ctx, func(ctx context.Context) {
+		defer done()
+		var timer timeutil.Timer
+		defer timer.Stop()
+		timer.Reset(after)
+		select {
+		case <-timer.C:
+			timer.Read = true
+		case <-stopper.ShouldStop():
+			return
+		}
+		if _, err := bq.Add(repl, priority); err != nil && log.V(1) {
+			log.Infof(ctx, "unable to requeue: %s", err)
+		}
+	}); err != nil {
+		done()
+	}
+}
+
 // pop dequeues the highest priority replica, if any, in the queue. Expects
 // mutex to be locked.
 func (bq *baseQueue) pop() *Replica {
+	repl, _ := bq.popWithPriority()
+	return repl
+}
+
+// popWithPriority is like pop, but also returns the priority at which the
+// replica was queued.
+func (bq *baseQueue) popWithPriority() (*Replica, float64) {
 	var repl *Replica
+	var priority float64
 	for repl == nil {
 		bq.mu.Lock()
 
+		if !bq.settingEnabled() {
+			bq.dropQueuedLocked()
+		}
 		if bq.mu.priorityQ.Len() == 0 {
 			bq.mu.Unlock()
-			return nil
+			return nil, 0
 		}
 		item := heap.Pop(&bq.mu.priorityQ).(*replicaItem)
 		bq.pending.Update(int64(bq.mu.priorityQ.Len()))
 		delete(bq.mu.replicas, item.value)
+		bq.releaseItemMemLocked()
 		bq.mu.Unlock()
+		bq.waitLatency.RecordValue(bq.store.Clock().PhysicalTime().Sub(item.enqueued).Nanoseconds())
 		repl, _ = bq.store.GetReplica(item.value)
+		priority = item.priority
 	}
-	return repl
+	return repl, priority
+}
+
+// QueuedReplica describes a replica waiting in a queue.
+type QueuedReplica struct {
+	RangeID  roachpb.RangeID
+	Priority float64
+	// Enqueued is the time the replica was added to the queue, and Wait the
+	// time it has been waiting since.
+	Enqueued time.Time
+	Wait     time.Duration
+}
+
+// Queued returns a snapshot of the replicas waiting in the queue, in the order
+// of their priorities, highest first. At most limit replicas are returned,
+// unless limit is zero.
+func (bq *baseQueue) Queued(limit int) []QueuedReplica {
+	now := bq.store.Clock().PhysicalTime()
+	bq.mu.Lock()
+	queued := make([]QueuedReplica, 0, bq.mu.priorityQ.Len())
+	for _, item := range bq.mu.priorityQ {
+		queued = append(queued, QueuedReplica{
+			RangeID:  item.value,
+			Priority: item.priority,
+			Enqueued: item.enqueued,
+			Wait:     now.Sub(item.enqueued),
+		})
+	}
+	bq.mu.Unlock()
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].Priority != queued[j].Priority {
+			return queued[i].Priority > queued[j].Priority
+		}
+		return queued[i].RangeID < queued[j].RangeID
+	})
+	if limit > 0 && len(queued) > limit {
+		queued = queued[:limit]
+	}
+	return queued
 }
 
 // add adds an element to the priority queue. Caller must hold mutex.
@@ -749,6 +1466,20 @@ func (bq *baseQueue) add(item *replicaItem) {
 	bq.mu.replicas[item.value] = item
 }
 
+// dropQueuedLocked removes every replica from the priority queue, leaving
+// purgatory untouched. Caller must hold mutex.
+func (bq *baseQueue) dropQueuedLocked() {
+	if n := bq.mu.priorityQ.Len(); n > 0 && log.V(1) {
+		log.Infof(bq.AnnotateCtx(context.TODO()), "queue disabled; dropping %d queued replicas", n)
+	}
+	for bq.mu.priorityQ.Len() > 0 {
+		item := heap.Pop(&bq.mu.priorityQ).(*replicaItem)
+		delete(bq.mu.replicas, item.value)
+		bq.releaseItemMemLocked()
+	}
+	bq.pending.Update(0)
+}
+
 // remove removes an element from purgatory (if it's experienced an
 // error) or from the priority queue by index. Caller must hold mutex.
 func (bq *baseQueue) remove(item *replicaItem) {
@@ -758,10 +1489,63 @@ func (bq *baseQueue) remove(item *replicaItem) {
 	} else {
 		heap.Remove(&bq.mu.priorityQ, item.index)
 		bq.pending.Update(int64(bq.mu.priorityQ.Len()))
+		bq.releaseItemMemLocked()
 	}
 	delete(bq.mu.replicas, item.value)
 }
 
+// reserveItemMemLocked charges the memory of a replica about to be queued at
+// the supplied priority to memAcc, if set. While the account's budget is
+// exhausted, the lowest priority replica queued is dropped, provided its
+// priority is lower than the supplied one; otherwise false is returned, and
+// the replica must not be queued. Caller must hold mutex.
+func (bq *baseQueue) reserveItemMemLocked(ctx context.Context, priority float64) bool {
+	if bq.memAcc == nil {
+		return true
+	}
+	for {
+		err := bq.memAcc.Grow(ctx, queueItemMemSize)
+		if err == nil {
+			bq.memBytes.Inc(queueItemMemSize)
+			return true
+		}
+		lowest := bq.lowestPriorityLocked()
+		if lowest == nil || lowest.priority >= priority {
+			bq.memDropped.Inc(1)
+			return false
+		}
+		if log.V(1) {
+			log.Infof(ctx, "%s; dropping %s queued at priority %0.3f", err, lowest.value, lowest.priority)
+		}
+		bq.memDropped.Inc(1)
+		bq.remove(lowest)
+	}
+}
+
+// releaseItemMemLocked releases the memory of a replica removed from the
+// priority queue from memAcc, if set. Caller must hold mutex.
+func (bq *baseQueue) releaseItemMemLocked() {
+	if bq.memAcc == nil {
+		return
+	}
+	// Shrinking an account can't fail.
+	_ = bq.memAcc.ResizeItem(bq.AnnotateCtx(context.TODO()), queueItemMemSize, 0)
+	bq.memBytes.Dec(queueItemMemSize)
+}
+
+// lowestPriorityLocked returns the replica queued at the lowest priority, or
+// nil if the queue is empty. Unlike the highest priority replica, it isn't
+// kept at a known position by the heap. Caller must hold mutex.
+func (bq *baseQueue) lowestPriorityLocked() *replicaItem {
+	var lowest *replicaItem
+	for _, item := range bq.mu.priorityQ {
+		if lowest == nil || item.priority < lowest.priority {
+			lowest = item
+		}
+	}
+	return lowest
+}
+
 // DrainQueue locks the queue and processes the remaining queued replicas. It
 // processes the replicas in the order they're queued in, one at a time.
 // Exposed for testing only.
@@ -779,9 +1563,14 @@ func (bq *baseQueue) DrainQueue(clock *hlc.Clock) {
 	ctx := bq.AnnotateCtx(context.TODO())
 	for repl := bq.pop(); repl != nil; repl = bq.pop() {
 		annotatedCtx := repl.AnnotateCtx(ctx)
-		if err := bq.processReplica(annotatedCtx, repl, clock); err != nil {
-			bq.failures.Inc(1)
+		if err := bq.acquireProcessing(annotatedCtx, repl.RangeID); err != nil {
+			log.Error(annotatedCtx, err)
+			continue
+		}
+		if err := bq.processReplica(annotatedCtx, repl, clock); err != nil && !isDeferredError(err) {
+			bq.recordFailureClass(err)
 			log.Error(annotatedCtx, err)
 		}
+		bq.releaseProcessing(repl.RangeID)
 	}
 }
@@ -0,0 +1,124 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// queueCacheEntryOverhead is the estimated memory used by a queue cache
+// entry, excluding the size of its value.
+const queueCacheEntryOverhead = 128
+
+// queueCacheMaxBytes bounds the memory used by a store's queueCache.
+var queueCacheMaxBytes = settings.RegisterByteSizeSetting(
+	"kv.queue.cache.max_bytes",
+	"maximum memory used by a store's replica queues to cache per-replica data",
+	16<<20,
+)
+
+// queueCacheKey identifies an entry of a queueCache: the data cached for a
+// range under a name chosen by the queue caching it.
+type queueCacheKey struct {
+	name    string
+	rangeID roachpb.RangeID
+}
+
+type queueCacheEntry struct {
+	value interface{}
+	bytes int64
+}
+
+// queueCache is an LRU cache of the data which the replica queues of a store
+// compute per replica, such as the results of expensive probes. It is shared
+// by the queues so that the memory used by the cached data of a store with
+// many replicas is bounded by queueCacheMaxBytes in total. As an entry can be
+// evicted at any time, the cached data must be recomputable on a miss.
+type queueCache struct {
+	hits, misses, evictions *metric.Counter
+	bytesGauge              *metric.Gauge
+
+	mu struct {
+		syncutil.Mutex
+		cache *cache.UnorderedCache
+		// bytes is the estimated memory used by the cached entries.
+		bytes int64
+	}
+}
+
+func newQueueCache(metrics *StoreMetrics) *queueCache {
+	c := &queueCache{
+		hits:       metrics.QueueCacheHits,
+		misses:     metrics.QueueCacheMisses,
+		evictions:  metrics.QueueCacheEvictions,
+		bytesGauge: metrics.QueueCacheBytes,
+	}
+	c.mu.cache = cache.NewUnorderedCache(cache.Config{
+		Policy: cache.CacheLRU,
+		// Called with c.mu held.
+		ShouldEvict: func(_ int, _, _ interface{}) bool {
+			if c.mu.bytes > queueCacheMaxBytes.Get() {
+				c.evictions.Inc(1)
+				return true
+			}
+			return false
+		},
+		OnEvicted: func(_, value interface{}) {
+			c.mu.bytes -= value.(queueCacheEntry).bytes
+		},
+	})
+	return c
+}
+
+// get returns the value cached for the range under the supplied name.
+func (c *queueCache) get(name string, rangeID roachpb.RangeID) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.mu.cache.Get(queueCacheKey{name: name, rangeID: rangeID})
+	if !ok {
+		c.misses.Inc(1)
+		return nil, false
+	}
+	c.hits.Inc(1)
+	return v.(queueCacheEntry).value, true
+}
+
+// add caches the value for the range under the supplied name, replacing any
+// value already cached. The caller supplies an estimate of the memory used by
+// the value. Adding a value may evict the least recently used entries,
+// including the value itself if it exceeds the budget on its own.
+func (c *queueCache) add(name string, rangeID roachpb.RangeID, value interface{}, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := queueCacheKey{name: name, rangeID: rangeID}
+	// The replaced entry is removed first so that its size is accounted for.
+	c.mu.cache.Del(key)
+	bytes += queueCacheEntryOverhead + int64(len(name))
+	c.mu.bytes += bytes
+	c.mu.cache.Add(key, queueCacheEntry{value: value, bytes: bytes})
+	c.bytesGauge.Update(c.mu.bytes)
+}
+
+// del removes the value cached for the range under the supplied name, if any.
+func (c *queueCache) del(name string, rangeID roachpb.RangeID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.cache.Del(queueCacheKey{name: name, rangeID: rangeID})
+	c.bytesGauge.Update(c.mu.bytes)
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestQueueCacheEviction verifies that the queue cache evicts its least
+// recently used entries to stay within its byte budget, and that it accounts
+// for the memory of replaced and removed entries.
+func TestQueueCacheEviction(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Each entry below uses queueCacheEntryOverhead+len("a")+10 bytes, and two
+	// of them fit in the budget.
+	const entryBytes = queueCacheEntryOverhead + 1 + 10
+	defer settings.TestingSetByteSize(&queueCacheMaxBytes, 2*entryBytes+10)()
+
+	metrics := newStoreMetrics(time.Minute)
+	c := newQueueCache(metrics)
+
+	expect := func(rangeID roachpb.RangeID, expected interface{}) {
+		v, ok := c.get("a", rangeID)
+		if expected == nil {
+			if ok {
+				t.Fatalf("expected r%d not to be cached, got %v", rangeID, v)
+			}
+		} else if !ok || v != expected {
+			t.Fatalf("expected r%d to be cached as %v, got %v (%t)", rangeID, expected, v, ok)
+		}
+	}
+	expectMetrics := func(hits, misses, evictions, bytes int64) {
+		if a := metrics.QueueCacheHits.Count(); a != hits {
+			t.Fatalf("expected %d hits, got %d", hits, a)
+		}
+		if a := metrics.QueueCacheMisses.Count(); a != misses {
+			t.Fatalf("expected %d misses, got %d", misses, a)
+		}
+		if a := metrics.QueueCacheEvictions.Count(); a != evictions {
+			t.Fatalf("expected %d evictions, got %d", evictions, a)
+		}
+		if a := metrics.QueueCacheBytes.Value(); a != bytes {
+			t.Fatalf("expected %d bytes, got %d", bytes, a)
+		}
+	}
+
+	c.add("a", 1, "one", 10)
+	c.add("a", 2, "two", 10)
+	expectMetrics(0, 0, 0, 2*entryBytes)
+	// Using r1 makes r2 the least recently used entry, which is evicted once r3
+	// is added.
+	expect(1, "one")
+	c.add("a", 3, "three", 10)
+	expect(2, nil)
+	expect(1, "one")
+	expect(3, "three")
+	expectMetrics(3, 1, 1, 2*entryBytes)
+
+	// The same range is cached separately under another name.
+	if _, ok := c.get("b", 1); ok {
+		t.Fatal("expected no entry for r1 under another name")
+	}
+
+	// Replacing an entry accounts for the size of the replaced value.
+	c.add("a", 1, "uno", 15)
+	expect(1, "uno")
+	expectMetrics(4, 2, 1, 2*entryBytes+5)
+
+	c.del("a", 1)
+	expect(1, nil)
+	expectMetrics(4, 3, 1, entryBytes)
+
+	// An entry exceeding the budget on its own evicts everything, itself
+	// included.
+	c.add("a", 4, "four", 2*entryBytes)
+	expect(3, nil)
+	expect(4, nil)
+	expectMetrics(4, 5, 3, 0)
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// defaultQueueHistorySize is the number of recent processing outcomes
+// persisted per replica by queues which record their history.
+const defaultQueueHistorySize = 5
+
+// queueHistoryVersion is the version of the encoding of a queue history
+// record. It must be incremented whenever the encoding changes.
+const queueHistoryVersion = 1
+
+// Error classes recorded in a QueueOutcome.
+const (
+	queueErrorClassTimeout   = "timeout"
+	queueErrorClassPurgatory = "purgatory"
+	queueErrorClassOther     = "error"
+)
+
+// QueueOutcome records the result of a single attempt by a queue to process a
+// replica.
+type QueueOutcome struct {
+	// Time is the time at which processing completed.
+	Time hlc.Timestamp
+	// Duration is the time spent processing the replica.
+	Duration time.Duration
+	// ErrorClass is empty if processing succeeded, and otherwise a coarse
+	// classification of the error.
+	ErrorClass string
+	// LiveBytesBefore and LiveBytesAfter are the replica's live bytes before
+	// and after processing.
+	LiveBytesBefore int64
+	LiveBytesAfter  int64
+}
+
+func (o QueueOutcome) String() string {
+	result := "ok"
+	if o.ErrorClass != "" {
+		result = o.ErrorClass
+	}
+	return fmt.Sprintf("%s: %s in %s, live bytes %d -> %d",
+		o.Time, result, o.Duration, o.LiveBytesBefore, o.LiveBytesAfter)
+}
+
+// queueErrorClass returns the class of error recorded in a QueueOutcome for
+// the supplied processing error.
+func queueErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	if _, ok := err.(purgatoryError); ok {
+		return queueErrorClassPurgatory
+	}
+	if errors.Cause(err) == context.DeadlineExceeded {
+		return queueErrorClassTimeout
+	}
+	return queueErrorClassOther
+}
+
+// EncodeQueueHistory encodes a list of queue outcomes into the versioned
+// format persisted at keys.QueueHistoryKey.
+func EncodeQueueHistory(history []QueueOutcome) []byte {
+	b := []byte{queueHistoryVersion}
+	b = encoding.EncodeUvarintAscending(b, uint64(len(history)))
+	for _, o := range history {
+		b = encoding.EncodeVarintAscending(b, o.Time.WallTime)
+		b = encoding.EncodeVarintAscending(b, int64(o.Time.Logical))
+		b = encoding.EncodeVarintAscending(b, o.Duration.Nanoseconds())
+		b = encoding.EncodeBytesAscending(b, []byte(o.ErrorClass))
+		b = encoding.EncodeVarintAscending(b, o.LiveBytesBefore)
+		b = encoding.EncodeVarintAscending(b, o.LiveBytesAfter)
+	}
+	return b
+}
+
+// DecodeQueueHistory decodes a list of queue outcomes encoded by
+// EncodeQueueHistory.
+func DecodeQueueHistory(b []byte) ([]QueueOutcome, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if b[0] != queueHistoryVersion {
+		return nil, errors.Errorf("unknown queue history version %d", b[0])
+	}
+	b, n, err := encoding.DecodeUvarintAscending(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	history := make([]QueueOutcome, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var o QueueOutcome
+		var logical, duration int64
+		var class []byte
+		if b, o.Time.WallTime, err = encoding.DecodeVarintAscending(b); err != nil {
+			return nil, err
+		}
+		if b, logical, err = encoding.DecodeVarintAscending(b); err != nil {
+			return nil, err
+		}
+		if b, duration, err = encoding.DecodeVarintAscending(b); err != nil {
+			return nil, err
+		}
+		if b, class, err = encoding.DecodeBytesAscending(b, nil); err != nil {
+			return nil, err
+		}
+		if b, o.LiveBytesBefore, err = encoding.DecodeVarintAscending(b); err != nil {
+			return nil, err
+		}
+		if b, o.LiveBytesAfter, err = encoding.DecodeVarintAscending(b); err != nil {
+			return nil, err
+		}
+		o.Time.Logical = int32(logical)
+		o.Duration = time.Duration(duration)
+		o.ErrorClass = string(class)
+		history = append(history, o)
+	}
+	if len(b) != 0 {
+		return nil, errors.Errorf("%d trailing bytes in queue history", len(b))
+	}
+	return history, nil
+}
+
+// GetQueueHistory returns the recent processing outcomes of the named queue
+// for this replica, oldest first.
+func (r *Replica) GetQueueHistory(ctx context.Context, queue string) ([]QueueOutcome, error) {
+	key := keys.QueueHistoryKey(r.Desc().StartKey, queue)
+	value, _, err := engine.MVCCGet(ctx, r.store.Engine(), key, hlc.Timestamp{}, true, nil)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	b, err := value.GetBytes()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeQueueHistory(b)
+}
+
+// recordQueueOutcome appends an outcome to the history of the named queue
+// for this replica, retaining at most maxEntries of the most recent outcomes.
+func (r *Replica) recordQueueOutcome(
+	ctx context.Context, queue string, outcome QueueOutcome, maxEntries int,
+) error {
+	history, err := r.GetQueueHistory(ctx, queue)
+	if err != nil {
+		// A corrupt or unreadable history is replaced rather than blocking the
+		// recording of new outcomes.
+		log.Warningf(ctx, "discarding unreadable %s queue history: %s", queue, err)
+		history = nil
+	}
+	history = append(history, outcome)
+	if len(history) > maxEntries {
+		history = history[len(history)-maxEntries:]
+	}
+	key := keys.QueueHistoryKey(r.Desc().StartKey, queue)
+	return r.store.DB().PutInline(ctx, key, EncodeQueueHistory(history))
+}
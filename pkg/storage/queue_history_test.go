@@ -0,0 +1,153 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+func TestQueueHistoryEncoding(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	history := []QueueOutcome{
+		{
+			Time:            hlc.Timestamp{WallTime: 100, Logical: 2},
+			Duration:        time.Second,
+			LiveBytesBefore: 1000,
+			LiveBytesAfter:  400,
+		},
+		{
+			Time:            hlc.Timestamp{WallTime: 200},
+			Duration:        time.Minute,
+			ErrorClass:      queueErrorClassTimeout,
+			LiveBytesBefore: 400,
+			LiveBytesAfter:  400,
+		},
+	}
+	decoded, err := DecodeQueueHistory(EncodeQueueHistory(history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(history, decoded) {
+		t.Fatalf("expected %v, got %v", history, decoded)
+	}
+
+	b := EncodeQueueHistory(history)
+	b[0] = queueHistoryVersion + 1
+	if _, err := DecodeQueueHistory(b); !testutils.IsError(err, "unknown queue history version") {
+		t.Fatalf("expected unknown version error, got %v", err)
+	}
+}
+
+func TestQueueErrorClass(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{nil, ""},
+		{errors.New("boom"), queueErrorClassOther},
+		{errors.Wrap(context.DeadlineExceeded, "processing"), queueErrorClassTimeout},
+		{&testError{}, queueErrorClassPurgatory},
+	}
+	for i, c := range testCases {
+		if a := queueErrorClass(c.err); a != c.expected {
+			t.Errorf("%d: expected class %q for %v, got %q", i, c.expected, c.err, a)
+		}
+	}
+}
+
+// TestQueueHistoryTrimmedAndPersisted verifies that a replica's queue history
+// retains only the most recent outcomes and survives a restart of the store.
+func TestQueueHistoryTrimmedAndPersisted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	eng := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer eng.Close()
+
+	const queue = "test"
+	tc := testContext{engine: eng}
+	stopper := stop.NewStopper()
+	tc.Start(t, stopper)
+
+	var all []QueueOutcome
+	for i := 0; i < defaultQueueHistorySize+3; i++ {
+		outcome := QueueOutcome{
+			Time:            tc.Clock().Now(),
+			Duration:        time.Duration(i) * time.Millisecond,
+			LiveBytesBefore: int64(i),
+			LiveBytesAfter:  int64(i + 1),
+		}
+		if i%2 == 1 {
+			outcome.ErrorClass = queueErrorClassOther
+		}
+		if err := tc.repl.recordQueueOutcome(ctx, queue, outcome, defaultQueueHistorySize); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, outcome)
+	}
+	expected := all[len(all)-defaultQueueHistorySize:]
+
+	history, err := tc.repl.GetQueueHistory(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Fatalf("expected %v, got %v", expected, history)
+	}
+
+	// Other queues' histories are unaffected.
+	if history, err := tc.repl.GetQueueHistory(ctx, "other"); err != nil {
+		t.Fatal(err)
+	} else if len(history) != 0 {
+		t.Fatalf("expected no history for another queue, got %v", history)
+	}
+
+	// Restart the store on the same engine.
+	stopper.Stop(ctx)
+	stopper = stop.NewStopper()
+	defer stopper.Stop(ctx)
+	cfg := TestStoreConfig(tc.Clock())
+	cfg.Transport = NewDummyRaftTransport()
+	store := NewStore(cfg, eng, &roachpb.NodeDescriptor{NodeID: 1})
+	if err := store.Start(ctx, stopper); err != nil {
+		t.Fatal(err)
+	}
+	repl, err := store.GetReplica(tc.repl.RangeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err = repl.GetQueueHistory(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Fatalf("expected %v after restart, got %v", expected, history)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+// queueLastProcessedMaxFutureOffset is the amount by which a last processed
+// timestamp may be ahead of the clock before it is considered bogus. Such
+// timestamps are found in stores restored from a backup of a cluster whose
+// clock was ahead, and a queue honoring them wouldn't process the replica
+// until the clock caught up.
+const queueLastProcessedMaxFutureOffset = time.Hour
+
+// queueLastProcessedRegistry records the time at which a queue last processed
+// each range, for queues which process each replica periodically, such as the
+// consistency and time series maintenance queues. The timestamps are stored
+// inline at the range-local keys.QueueLastProcessedKey of each range, read
+// from the local engine and written through the KV client.
+//
+// A timestamp which can't be decoded, or which is ahead of the clock by more
+// than queueLastProcessedMaxFutureOffset, is treated as missing, so that the
+// range is processed rather than failing every pass or never being processed.
+type queueLastProcessedRegistry struct {
+	queue   string
+	engine  engine.Reader
+	db      *client.DB
+	clock   *hlc.Clock
+	ambient log.AmbientContext
+	// stopperFn returns the stopper which runs the resets of bogus
+	// timestamps. A store's stopper is only known once it is started.
+	stopperFn func() *stop.Stopper
+	// onSet, if non-nil, is called once the timestamp of a range is written.
+	onSet func(roachpb.RangeID)
+}
+
+// newQueueLastProcessedRegistry returns the registry of the named queue of the
+// store, which writes timestamps through the supplied client and notifies the
+// store's waiters (see Store.WaitForQueueProcessing) of them.
+func newQueueLastProcessedRegistry(
+	store *Store, queue string, db *client.DB,
+) *queueLastProcessedRegistry {
+	return &queueLastProcessedRegistry{
+		queue:     queue,
+		engine:    store.Engine(),
+		db:        db,
+		clock:     store.Clock(),
+		ambient:   store.cfg.AmbientCtx,
+		stopperFn: store.Stopper,
+		onSet: func(rangeID roachpb.RangeID) {
+			store.notifyQueueProcessed(queue, rangeID)
+		},
+	}
+}
+
+// Get returns the time at which the queue last processed the range, or the
+// zero timestamp if it never has. A bogus timestamp is logged and reset
+// asynchronously, so that it is only reported once.
+func (r *queueLastProcessedRegistry) Get(
+	ctx context.Context, desc *roachpb.RangeDescriptor,
+) (hlc.Timestamp, error) {
+	key := keys.QueueLastProcessedKey(desc.StartKey, r.queue)
+	value, _, err := engine.MVCCGet(ctx, r.engine, key, hlc.Timestamp{}, true, nil)
+	if err != nil || value == nil {
+		return hlc.Timestamp{}, err
+	}
+	timestamp, reason := r.decode(*value)
+	if reason != "" {
+		log.Warningf(ctx, "ignoring %s last processed timestamp: %s", r.queue, reason)
+		r.reset(desc)
+		return hlc.Timestamp{}, nil
+	}
+	return timestamp, nil
+}
+
+// Set records that the queue processed the range at the supplied time.
+func (r *queueLastProcessedRegistry) Set(
+	ctx context.Context, desc *roachpb.RangeDescriptor, timestamp hlc.Timestamp,
+) error {
+	key := keys.QueueLastProcessedKey(desc.StartKey, r.queue)
+	if err := r.db.PutInline(ctx, key, &timestamp); err != nil {
+		return err
+	}
+	if r.onSet != nil {
+		r.onSet(desc.RangeID)
+	}
+	return nil
+}
+
+// ShouldProcessAgain returns whether the range is due to be processed again at
+// now, given the minimum interval between two runs of the queue on a range,
+// and if so, at what priority (see shouldQueueAgain). If jitterFraction is
+// positive, the interval is jittered by up to that fraction, with the range ID
+// as the seed (see jitterInterval). A failure to read the last processed
+// timestamp is logged, and the range treated as never processed.
+func (r *queueLastProcessedRegistry) ShouldProcessAgain(
+	ctx context.Context,
+	desc *roachpb.RangeDescriptor,
+	now hlc.Timestamp,
+	interval time.Duration,
+	jitterFraction float64,
+) (bool, float64) {
+	lpTS, err := r.Get(ctx, desc)
+	if err != nil {
+		log.ErrEventf(ctx, "%s last processed timestamp: %s", r.queue, err)
+	}
+	if jitterFraction > 0 {
+		interval = jitterInterval(interval, desc.RangeID, jitterFraction)
+	}
+	return shouldQueueAgain(now, lpTS, interval)
+}
+
+// Scan returns the last processed timestamps of all of the ranges with
+// replicas in the engine, keyed by range start key. It reads them with a
+// single scan of the range-local keys rather than a read per range. Bogus
+// timestamps are omitted, but not reset.
+func (r *queueLastProcessedRegistry) Scan() (map[string]hlc.Timestamp, error) {
+	iter := r.engine.NewIterator(false)
+	defer iter.Close()
+
+	endKey := engine.MakeMVCCMetadataKey(keys.LocalRangeMax)
+	result := make(map[string]hlc.Timestamp)
+	var meta enginepb.MVCCMetadata
+	for iter.Seek(engine.MakeMVCCMetadataKey(keys.LocalRangePrefix)); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return nil, err
+		} else if !ok || !iter.UnsafeKey().Less(endKey) {
+			break
+		}
+		if iter.UnsafeKey().IsValue() {
+			// Last processed timestamps are written inline.
+			continue
+		}
+		startKey, suffix, detail, err := keys.DecodeRangeKey(iter.UnsafeKey().Key)
+		if err != nil {
+			return nil, err
+		}
+		if !suffix.Equal(keys.LocalQueueLastProcessedSuffix.AsRawKey()) || string(detail) != r.queue {
+			continue
+		}
+		if err := iter.ValueProto(&meta); err != nil {
+			return nil, err
+		}
+		if timestamp, reason := r.decode(roachpb.Value{RawBytes: meta.RawBytes}); reason == "" {
+			result[string(startKey)] = timestamp
+		}
+	}
+	return result, nil
+}
+
+// decode returns the timestamp stored in the value, or the reason it is bogus.
+func (r *queueLastProcessedRegistry) decode(value roachpb.Value) (hlc.Timestamp, string) {
+	var timestamp hlc.Timestamp
+	if err := value.GetProto(&timestamp); err != nil {
+		return hlc.Timestamp{}, "undecodable: " + err.Error()
+	}
+	if now := r.clock.Now(); timestamp.GoTime().Sub(now.GoTime()) > queueLastProcessedMaxFutureOffset {
+		return hlc.Timestamp{}, timestamp.String() + " is ahead of the clock at " + now.String()
+	}
+	return timestamp, ""
+}
+
+// reset asynchronously replaces the last processed timestamp of the range
+// with the zero timestamp.
+func (r *queueLastProcessedRegistry) reset(desc *roachpb.RangeDescriptor) {
+	ctx := r.ambient.AnnotateCtx(context.Background())
+	if err := r.stopperFn().RunAsyncTask(ctx, func(ctx context.Context) {
+		if err := r.Set(ctx, desc, hlc.Timestamp{}); err != nil {
+			log.Warningf(ctx, "failed to reset %s last processed timestamp: %s", r.queue, err)
+		}
+	}); err != nil {
+		log.Warningf(ctx, "failed to reset %s last processed timestamp: %s", r.queue, err)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+// newTestQueueLastProcessedRegistry returns a registry of the named queue which
+// reads from the engine, and writes to it through a client which applies puts
+// to the engine directly, rather than through a store.
+func newTestQueueLastProcessedRegistry(
+	eng engine.Engine, clock *hlc.Clock, stopper *stop.Stopper, queue string,
+) *queueLastProcessedRegistry {
+	db := client.NewDB(client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		for _, union := range ba.Requests {
+			put, ok := union.GetInner().(*roachpb.PutRequest)
+			if !ok {
+				return nil, roachpb.NewErrorf("unexpected request %s", union.GetInner().Method())
+			}
+			if err := engine.MVCCPut(ctx, eng, nil, put.Key, hlc.Timestamp{}, put.Value, nil); err != nil {
+				return nil, roachpb.NewError(err)
+			}
+		}
+		return ba.CreateReply(), nil
+	}), clock)
+	return &queueLastProcessedRegistry{
+		queue:     queue,
+		engine:    eng,
+		db:        db,
+		clock:     clock,
+		stopperFn: func() *stop.Stopper { return stopper },
+	}
+}
+
+// TestQueueLastProcessedRegistry verifies that the registry reads and writes
+// the last processed timestamps of ranges, decides from them whether the
+// ranges are due to be processed again, and treats bogus timestamps as
+// missing.
+func TestQueueLastProcessedRegistry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	eng := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	stopper.AddCloser(eng)
+	manual := hlc.NewManualClock(int64(time.Hour))
+	clock := hlc.NewClock(manual.UnixNano, time.Nanosecond)
+
+	ctx := context.Background()
+	r := newTestQueueLastProcessedRegistry(eng, clock, stopper, "test")
+	other := newTestQueueLastProcessedRegistry(eng, clock, stopper, "other")
+	var notified []roachpb.RangeID
+	r.onSet = func(rangeID roachpb.RangeID) { notified = append(notified, rangeID) }
+
+	descs := []*roachpb.RangeDescriptor{
+		{RangeID: 1, StartKey: roachpb.RKeyMin, EndKey: roachpb.RKey("a")},
+		{RangeID: 2, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("b")},
+		{RangeID: 3, StartKey: roachpb.RKey("b"), EndKey: roachpb.RKeyMax},
+	}
+	expectLastProcessed := func(desc *roachpb.RangeDescriptor, expected hlc.Timestamp) {
+		if lp, err := r.Get(ctx, desc); err != nil {
+			t.Fatal(err)
+		} else if lp != expected {
+			t.Fatalf("r%d: expected last processed timestamp %s, got %s", desc.RangeID, expected, lp)
+		}
+	}
+
+	// Ranges which were never processed are due.
+	now := clock.Now()
+	for _, desc := range descs {
+		expectLastProcessed(desc, hlc.Timestamp{})
+		if shouldQ, priority := r.ShouldProcessAgain(ctx, desc, now, time.Hour, 0); !shouldQ {
+			t.Fatalf("r%d: expected a range never processed to be due", desc.RangeID)
+		} else if priority != 0 {
+			t.Fatalf("r%d: expected priority 0, got %f", desc.RangeID, priority)
+		}
+	}
+
+	// Once processed, a range is due after the interval, at a priority which
+	// grows with the time since.
+	for _, desc := range descs[:2] {
+		if err := r.Set(ctx, desc, now); err != nil {
+			t.Fatal(err)
+		}
+		expectLastProcessed(desc, now)
+	}
+	if err := other.Set(ctx, descs[2], now); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []roachpb.RangeID{1, 2}; !reflect.DeepEqual(notified, expected) {
+		t.Fatalf("expected notifications of %v, got %v", expected, notified)
+	}
+	expectLastProcessed(descs[2], hlc.Timestamp{})
+	if shouldQ, _ := r.ShouldProcessAgain(ctx, descs[0], clock.Now(), time.Hour, 0); shouldQ {
+		t.Fatal("expected a range processed just now not to be due")
+	}
+	manual.Increment(int64(2 * time.Hour))
+	if shouldQ, priority := r.ShouldProcessAgain(ctx, descs[0], clock.Now(), time.Hour, 0); !shouldQ {
+		t.Fatal("expected a range processed two intervals ago to be due")
+	} else if priority < 2 {
+		t.Fatalf("expected a priority of at least 2, got %f", priority)
+	}
+
+	// The interval is jittered by the range ID.
+	later := clock.Now()
+	for _, desc := range descs[:2] {
+		expShouldQ, expPriority := shouldQueueAgain(
+			later, now, jitterInterval(3*time.Hour, desc.RangeID, 0.5))
+		shouldQ, priority := r.ShouldProcessAgain(ctx, desc, later, 3*time.Hour, 0.5)
+		if shouldQ != expShouldQ || priority != expPriority {
+			t.Fatalf("r%d: expected (%t, %f), got (%t, %f)",
+				desc.RangeID, expShouldQ, expPriority, shouldQ, priority)
+		}
+	}
+
+	// The ranges are enumerated with a single scan, which only returns the
+	// timestamps of the registry's queue.
+	if lastProcessed, err := r.Scan(); err != nil {
+		t.Fatal(err)
+	} else if expected := map[string]hlc.Timestamp{
+		string(descs[0].StartKey): now,
+		string(descs[1].StartKey): now,
+	}; !reflect.DeepEqual(lastProcessed, expected) {
+		t.Fatalf("expected %v, got %v", expected, lastProcessed)
+	}
+
+	// Timestamps too far ahead of the clock, and undecodable ones, are treated
+	// as missing, omitted by scans, and reset.
+	r.onSet = nil
+	future := clock.Now().Add(int64(2*queueLastProcessedMaxFutureOffset), 0)
+	if err := r.Set(ctx, descs[0], future); err != nil {
+		t.Fatal(err)
+	}
+	var garbage roachpb.Value
+	garbage.SetBytes([]byte{0xff, 0xff})
+	if err := engine.MVCCPut(
+		ctx, eng, nil, keys.QueueLastProcessedKey(descs[1].StartKey, r.queue), hlc.Timestamp{}, garbage, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if lastProcessed, err := r.Scan(); err != nil {
+		t.Fatal(err)
+	} else if len(lastProcessed) != 0 {
+		t.Fatalf("expected bogus timestamps to be omitted, got %v", lastProcessed)
+	}
+	for _, desc := range descs[:2] {
+		if shouldQ, _ := r.ShouldProcessAgain(ctx, desc, clock.Now(), time.Hour, 0); !shouldQ {
+			t.Fatalf("r%d: expected a range with a bogus timestamp to be due", desc.RangeID)
+		}
+		key := keys.QueueLastProcessedKey(desc.StartKey, r.queue)
+		testutils.SucceedsSoon(t, func() error {
+			var timestamp hlc.Timestamp
+			if ok, err := engine.MVCCGetProto(
+				ctx, eng, key, hlc.Timestamp{}, true, nil, &timestamp,
+			); err != nil {
+				return err
+			} else if !ok || timestamp != (hlc.Timestamp{}) {
+				return fmt.Errorf("r%d: expected the timestamp to be reset, got %s", desc.RangeID, timestamp)
+			}
+			return nil
+		})
+	}
+}
+
+// TestQueueLastProcessedRegistryCompatibility verifies that the registry reads
+// the last processed timestamps which queues recorded before it existed, and
+// writes them at the same keys.
+func TestQueueLastProcessedRegistryCompatibility(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	eng := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	stopper.AddCloser(eng)
+	manual := hlc.NewManualClock(int64(time.Hour))
+	clock := hlc.NewClock(manual.UnixNano, time.Nanosecond)
+
+	ctx := context.Background()
+	const queue = "timeSeriesMaintenance"
+	desc := &roachpb.RangeDescriptor{RangeID: 1, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("b")}
+	// The key, spelled out as it was written by Replica.setQueueLastProcessed.
+	legacyKey := keys.MakeRangeKey(desc.StartKey, roachpb.RKey("qlpt"), roachpb.RKey(queue))
+	legacy := clock.Now()
+	if err := engine.MVCCPutProto(ctx, eng, nil, legacyKey, hlc.Timestamp{}, nil, &legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestQueueLastProcessedRegistry(eng, clock, stopper, queue)
+	if lp, err := r.Get(ctx, desc); err != nil {
+		t.Fatal(err)
+	} else if lp != legacy {
+		t.Fatalf("expected last processed timestamp %s, got %s", legacy, lp)
+	}
+	if lastProcessed, err := r.Scan(); err != nil {
+		t.Fatal(err)
+	} else if expected := map[string]hlc.Timestamp{
+		string(desc.StartKey): legacy,
+	}; !reflect.DeepEqual(lastProcessed, expected) {
+		t.Fatalf("expected %v, got %v", expected, lastProcessed)
+	}
+
+	manual.Increment(1)
+	now := clock.Now()
+	if err := r.Set(ctx, desc, now); err != nil {
+		t.Fatal(err)
+	}
+	var timestamp hlc.Timestamp
+	if ok, err := engine.MVCCGetProto(
+		ctx, eng, legacyKey, hlc.Timestamp{}, true, nil, &timestamp,
+	); err != nil {
+		t.Fatal(err)
+	} else if !ok || timestamp != now {
+		t.Fatalf("expected %s to be written at %s, got %s", now, legacyKey, timestamp)
+	}
+}
@@ -19,6 +19,7 @@ package storage
 import (
 	"container/heap"
 	"fmt"
+	"math"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -26,15 +27,20 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/config"
 	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/rpc"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 )
 
 // testQueueImpl implements queueImpl with a closure for shouldQueue.
@@ -82,8 +88,15 @@ func makeTestBaseQueue(
 	cfg.successes = metric.NewCounter(metric.Metadata{Name: "processed"})
 	cfg.failures = metric.NewCounter(metric.Metadata{Name: "failures"})
 	cfg.pending = metric.NewGauge(metric.Metadata{Name: "pending"})
+	cfg.pendingHighWater = metric.NewGauge(metric.Metadata{Name: "pendinghighwater"})
+	cfg.sizeDropped = metric.NewCounter(metric.Metadata{Name: "sizedropped"})
 	cfg.processingNanos = metric.NewCounter(metric.Metadata{Name: "processingnanos"})
+	cfg.timeouts = metric.NewCounter(metric.Metadata{Name: "timeouts"})
+	cfg.waitLatency = metric.NewLatency(metric.Metadata{Name: "waitlatency"}, time.Minute)
+	cfg.backedOff = metric.NewGauge(metric.Metadata{Name: "backedoff"})
 	cfg.purgatory = metric.NewGauge(metric.Metadata{Name: "purgatory"})
+	cfg.shouldQueueNanos = metric.NewCounter(metric.Metadata{Name: "shouldqueuenanos"})
+	cfg.shouldQueueDeferrals = metric.NewCounter(metric.Metadata{Name: "shouldqueuedeferrals"})
 	return newBaseQueue(name, impl, store, gossip, cfg)
 }
 
@@ -362,6 +375,378 @@ func TestBaseQueueProcess(t *testing.T) {
 	close(testQueue.blocker)
 }
 
+// TestBaseQueueQueued verifies the snapshot of the replicas waiting in a
+// queue, and the measurement of their wait when they are dequeued.
+func TestBaseQueueQueued(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	var repls []*Replica
+	for i := 0; i < 3; i++ {
+		id := roachpb.RangeID(1001 + i)
+		repl := createReplica(tc.store, id,
+			roachpb.RKey(fmt.Sprintf("%d", id)), roachpb.RKey(fmt.Sprintf("%d/end", id)))
+		if err := tc.store.AddReplica(repl); err != nil {
+			t.Fatal(err)
+		}
+		repls = append(repls, repl)
+	}
+
+	testQueue := &testQueueImpl{}
+	bq := makeTestBaseQueue("test", testQueue, tc.store, tc.gossip, queueConfig{maxSize: 3})
+
+	// The replicas are queued a second apart, at priorities which don't match
+	// the order in which they are queued.
+	priorities := []float64{2, 3, 1}
+	start := tc.manualClock.UnixNano()
+	for i, repl := range repls {
+		if i > 0 {
+			tc.manualClock.Increment(time.Second.Nanoseconds())
+		}
+		if _, err := bq.Add(repl, priorities[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tc.manualClock.Increment(time.Second.Nanoseconds())
+
+	expected := []QueuedReplica{
+		{RangeID: 1002, Priority: 3, Enqueued: time.Unix(0, start+time.Second.Nanoseconds()), Wait: 2 * time.Second},
+		{RangeID: 1001, Priority: 2, Enqueued: time.Unix(0, start), Wait: 3 * time.Second},
+		{RangeID: 1003, Priority: 1, Enqueued: time.Unix(0, start+2*time.Second.Nanoseconds()), Wait: time.Second},
+	}
+	check := func(limit int, expected []QueuedReplica) {
+		queued := bq.Queued(limit)
+		if len(queued) != len(expected) {
+			t.Fatalf("expected %d queued replicas with limit %d, got %+v", len(expected), limit, queued)
+		}
+		for i, q := range queued {
+			e := expected[i]
+			if q.RangeID != e.RangeID || q.Priority != e.Priority || !q.Enqueued.Equal(e.Enqueued) || q.Wait != e.Wait {
+				t.Errorf("%d: expected %+v, got %+v", i, e, q)
+			}
+		}
+	}
+	check(0, expected)
+	check(2, expected[:2])
+
+	// Dequeuing the highest priority replica measures its wait.
+	if repl := bq.pop(); repl != repls[1] {
+		t.Fatalf("expected r1002 to be dequeued, got %v", repl)
+	}
+	if n := bq.waitLatency.TotalCount(); n != 1 {
+		t.Fatalf("expected 1 measured wait, got %d", n)
+	}
+	// The histogram only has one significant digit of precision.
+	if min := bq.waitLatency.Min(); min < time.Second.Nanoseconds() {
+		t.Fatalf("expected a measured wait of about 2s, got %s", time.Duration(min))
+	}
+	check(0, expected[1:])
+}
+
+// TestBaseQueueMemoryBudget verifies that the replicas queued are charged to
+// the queue's memory account, that the lowest priority replicas are dropped
+// once its budget is exhausted, and that the memory is released once the
+// replicas are dequeued.
+func TestBaseQueueMemoryBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	var repls []*Replica
+	for i := 0; i < 5; i++ {
+		id := roachpb.RangeID(1001 + i)
+		repl := createReplica(tc.store, id,
+			roachpb.RKey(fmt.Sprintf("%d", id)), roachpb.RKey(fmt.Sprintf("%d/end", id)))
+		if err := tc.store.AddReplica(repl); err != nil {
+			t.Fatal(err)
+		}
+		repls = append(repls, repl)
+	}
+
+	ctx := context.Background()
+	const budget = 3 * queueItemMemSize
+	monitor := mon.MakeMonitor("test", nil, nil, 0, math.MaxInt64)
+	monitor.Start(ctx, nil, mon.MakeStandaloneBudget(budget))
+	memAcc := monitor.MakeBoundAccount()
+	testQueue := &testQueueImpl{}
+	bq := makeTestBaseQueue("test", testQueue, tc.store, tc.gossip, queueConfig{
+		maxSize:    10,
+		memAcc:     &memAcc,
+		memBytes:   metric.NewGauge(metric.Metadata{Name: "membytes"}),
+		memDropped: metric.NewCounter(metric.Metadata{Name: "memdropped"}),
+	})
+
+	expectQueued := func(expected ...roachpb.RangeID) {
+		queued := bq.Queued(0)
+		if len(queued) != len(expected) {
+			t.Fatalf("expected %d queued replicas, got %+v", len(expected), queued)
+		}
+		for i, q := range queued {
+			if q.RangeID != expected[i] {
+				t.Fatalf("%d: expected r%d, got %+v", i, expected[i], q)
+			}
+		}
+		if membytes := bq.memBytes.Value(); membytes != int64(len(expected))*queueItemMemSize {
+			t.Fatalf("expected %d bytes charged for %d queued replicas, got %d",
+				int64(len(expected))*queueItemMemSize, len(expected), membytes)
+		}
+	}
+	add := func(repl *Replica, priority float64, expectAdded bool) {
+		if added, err := bq.Add(repl, priority); err != nil {
+			t.Fatal(err)
+		} else if added != expectAdded {
+			t.Fatalf("r%d: expected added=%t, got %t", repl.RangeID, expectAdded, added)
+		}
+	}
+
+	// The budget fits three replicas.
+	add(repls[0], 2, true)
+	add(repls[1], 3, true)
+	add(repls[2], 1, true)
+	expectQueued(1002, 1001, 1003)
+
+	// A fourth replica of higher priority drops the lowest priority one.
+	add(repls[3], 4, true)
+	expectQueued(1004, 1002, 1001)
+	// A replica of lower priority than all of those queued isn't queued.
+	add(repls[4], 0.5, false)
+	expectQueued(1004, 1002, 1001)
+	if dropped := bq.memDropped.Count(); dropped != 2 {
+		t.Fatalf("expected 2 dropped replicas, got %d", dropped)
+	}
+
+	// Dequeuing and removing replicas releases their memory.
+	if repl := bq.pop(); repl != repls[3] {
+		t.Fatalf("expected r1004 to be dequeued, got %v", repl)
+	}
+	bq.MaybeRemove(1001)
+	expectQueued(1002)
+	bq.DrainQueue(tc.Clock())
+	expectQueued()
+	if err := memAcc.Grow(ctx, budget); err != nil {
+		t.Fatalf("expected the whole budget to be available once drained: %s", err)
+	}
+	memAcc.Close(ctx)
+	monitor.Stop(ctx)
+}
+
+// TestBaseQueueMaxSize verifies that a queue at its maximum size retains the
+// highest priority replicas, counting those it drops or doesn't queue, and
+// that it tracks the highest number of replicas pending.
+func TestBaseQueueMaxSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	var repls []*Replica
+	for i := 0; i < 6; i++ {
+		id := roachpb.RangeID(1001 + i)
+		repl := createReplica(tc.store, id,
+			roachpb.RKey(fmt.Sprintf("%d", id)), roachpb.RKey(fmt.Sprintf("%d/end", id)))
+		if err := tc.store.AddReplica(repl); err != nil {
+			t.Fatal(err)
+		}
+		repls = append(repls, repl)
+	}
+
+	testQueue := &testQueueImpl{}
+	bq := makeTestBaseQueue("test", testQueue, tc.store, tc.gossip, queueConfig{maxSize: 3})
+
+	expectQueued := func(expected ...roachpb.RangeID) {
+		queued := bq.Queued(0)
+		if len(queued) != len(expected) {
+			t.Fatalf("expected %d queued replicas, got %+v", len(expected), queued)
+		}
+		for i, q := range queued {
+			if q.RangeID != expected[i] {
+				t.Fatalf("%d: expected r%d, got %+v", i, expected[i], q)
+			}
+		}
+	}
+	expectDropped := func(expected int64) {
+		if dropped := bq.sizeDropped.Count(); dropped != expected {
+			t.Fatalf("expected %d dropped replicas, got %d", expected, dropped)
+		}
+	}
+	add := func(repl *Replica, priority float64, expectAdded bool) {
+		if added, err := bq.Add(repl, priority); err != nil {
+			t.Fatal(err)
+		} else if added != expectAdded {
+			t.Fatalf("r%d: expected added=%t, got %t", repl.RangeID, expectAdded, added)
+		}
+	}
+
+	add(repls[0], 2, true)
+	add(repls[1], 3, true)
+	add(repls[2], 1, true)
+	expectQueued(1002, 1001, 1003)
+	expectDropped(0)
+
+	// A replica of higher priority drops the lowest priority one, wherever
+	// the heap keeps it.
+	add(repls[3], 5, true)
+	expectQueued(1004, 1002, 1001)
+	expectDropped(1)
+	// A replica of lower priority than all of those queued isn't queued, nor
+	// is one of the same priority as the lowest.
+	add(repls[4], 0.5, false)
+	add(repls[5], 2, false)
+	expectQueued(1004, 1002, 1001)
+	expectDropped(3)
+	add(repls[5], 4, true)
+	expectQueued(1004, 1006, 1002)
+	expectDropped(4)
+
+	if v := bq.pending.Value(); v != 3 {
+		t.Errorf("expected 3 pending replicas; got %d", v)
+	}
+	if v := bq.pendingHighWater.Value(); v != 3 {
+		t.Errorf("expected a high-water mark of 3 pending replicas; got %d", v)
+	}
+
+	// Drops are logged once per scanner pass.
+	bq.mu.Lock()
+	logged := bq.mu.sizeDropLogged
+	bq.mu.Unlock()
+	if !logged {
+		t.Error("expected a dropped replica to have been logged")
+	}
+	bq.startScanPass()
+	bq.mu.Lock()
+	logged = bq.mu.sizeDropLogged
+	bq.mu.Unlock()
+	if logged {
+		t.Error("expected the next dropped replica to be logged in the new scanner pass")
+	}
+
+	// The high-water mark outlives the replicas pending.
+	bq.DrainQueue(tc.Clock())
+	expectQueued()
+	if v := bq.pendingHighWater.Value(); v != 3 {
+		t.Errorf("expected a high-water mark of 3 pending replicas; got %d", v)
+	}
+}
+
+// TestBaseQueueFailureBackoff verifies that a replica which repeatedly fails
+// processing is backed off exponentially, up to a maximum, that the backoff is
+// reset once it is processed successfully, and that a replica whose
+// processing timed out is requeued rather than backed off.
+func TestBaseQueueFailureBackoff(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	repl := createReplica(tc.store, 1001, roachpb.RKey("1001"), roachpb.RKey("1001/end"))
+	if err := tc.store.AddReplica(repl); err != nil {
+		t.Fatal(err)
+	}
+
+	const backoff = time.Minute
+	testQueue := &testQueueImpl{
+		shouldQueueFn: func(now hlc.Timestamp, r *Replica) (bool, float64) {
+			return true, 1.0
+		},
+		err: errors.New("failure"),
+	}
+	bq := makeTestBaseQueue("test", testQueue, tc.store, tc.gossip,
+		queueConfig{maxSize: 1, failureBackoff: backoff})
+
+	ctx := context.Background()
+	process := func() error {
+		if r := bq.pop(); r != repl {
+			t.Fatalf("expected r1001 to be dequeued, got %v", r)
+		}
+		err := bq.processReplica(ctx, repl, tc.Clock())
+		if err != nil {
+			bq.maybeAddToPurgatory(ctx, repl, err, tc.Clock(), stopper)
+		}
+		return err
+	}
+	expectQueued := func(expected bool) {
+		bq.MaybeAdd(repl, tc.Clock().Now())
+		if queued := bq.Length() == 1; queued != expected {
+			t.Fatalf("expected queued %t, got %t", expected, queued)
+		}
+	}
+	expectBackedOff := func(expected int64) {
+		if a := bq.backedOff.Value(); a != expected {
+			t.Fatalf("expected %d backed off replicas, got %d", expected, a)
+		}
+	}
+
+	// Each consecutive failure doubles the backoff, up to the maximum.
+	for _, expected := range []time.Duration{
+		backoff, 2 * backoff, 4 * backoff, 8 * backoff, 16 * backoff, 32 * backoff,
+		maxQueueFailureBackoff, maxQueueFailureBackoff,
+	} {
+		expectQueued(true)
+		if err := process(); err == nil {
+			t.Fatal("expected processing to fail")
+		}
+		expectBackedOff(1)
+		tc.manualClock.Increment((expected - time.Second).Nanoseconds())
+		expectQueued(false)
+		tc.manualClock.Increment(time.Second.Nanoseconds())
+	}
+	expectQueued(true)
+	expectBackedOff(0)
+
+	// A success resets the backoff, so the next failure backs off from the
+	// start.
+	testQueue.err = nil
+	if err := process(); err != nil {
+		t.Fatal(err)
+	}
+	expectQueued(true)
+	testQueue.err = errors.New("failure")
+	if err := process(); err == nil {
+		t.Fatal("expected processing to fail")
+	}
+	tc.manualClock.Increment(backoff.Nanoseconds())
+	expectQueued(true)
+
+	// Removing the replica forgets its failures.
+	if err := process(); err == nil {
+		t.Fatal("expected processing to fail")
+	}
+	expectBackedOff(1)
+	bq.MaybeRemove(repl.RangeID)
+	expectBackedOff(0)
+	expectQueued(true)
+
+	// A timeout doesn't back the replica off, so that it is requeued.
+	testQueue.err = errors.Wrap(context.DeadlineExceeded, "timed out")
+	if err := process(); err == nil {
+		t.Fatal("expected processing to fail")
+	}
+	expectBackedOff(0)
+	bq.requeueTimedOut(ctx, repl, 1.0)
+	if l := bq.Length(); l != 1 {
+		t.Fatalf("expected the timed out replica to be requeued, got %d queued", l)
+	}
+
+	// A replica backed off by another failure is left to be re-added by
+	// MaybeAdd once its backoff expires.
+	testQueue.err = errors.New("failure")
+	if err := process(); err == nil {
+		t.Fatal("expected processing to fail")
+	}
+	expectBackedOff(1)
+	bq.requeueTimedOut(ctx, repl, 1.0)
+	if l := bq.Length(); l != 0 {
+		t.Fatalf("expected the backed off replica not to be requeued, got %d queued", l)
+	}
+}
+
 // TestBaseQueueAddRemove adds then removes a range; ensure range is
 // not processed.
 func TestBaseQueueAddRemove(t *testing.T) {
@@ -524,6 +909,60 @@ func TestAcceptsUnsplitRanges(t *testing.T) {
 	})
 }
 
+// newTestGossipWithoutSystemConfig returns a gossip instance which is never
+// connected, and so never delivers a system config.
+func newTestGossipWithoutSystemConfig(
+	t *testing.T, clock *hlc.Clock, stopper *stop.Stopper,
+) *gossip.Gossip {
+	rpcContext := rpc.NewContext(log.AmbientContext{}, &base.Config{Insecure: true}, clock, stopper)
+	server := rpc.NewServer(rpcContext) // never started
+	g := gossip.NewTest(1, rpcContext, server, stopper, metric.NewRegistry())
+	if _, ok := g.GetSystemConfig(); ok {
+		t.Fatal("expected no system config")
+	}
+	return g
+}
+
+// TestBaseQueueIgnoresSystemConfig verifies that a queue neither adds nor
+// processes replicas until the system config is gossiped, unless it ignores
+// the system config, in which case it does both.
+func TestBaseQueueIgnoresSystemConfig(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	g := newTestGossipWithoutSystemConfig(t, tc.Clock(), stopper)
+	for _, ignoresSystemConfig := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ignoresSystemConfig=%t", ignoresSystemConfig), func(t *testing.T) {
+			testQueue := &testQueueImpl{
+				shouldQueueFn: func(now hlc.Timestamp, r *Replica) (bool, float64) {
+					return true, 1.0
+				},
+			}
+			bq := makeTestBaseQueue("test", testQueue, tc.store, g,
+				queueConfig{maxSize: 1, ignoresSystemConfig: ignoresSystemConfig})
+
+			expected := 0
+			if ignoresSystemConfig {
+				expected = 1
+			}
+			bq.MaybeAdd(tc.repl, tc.Clock().Now())
+			if l := bq.Length(); l != expected {
+				t.Fatalf("expected %d queued replicas, got %d", expected, l)
+			}
+			if err := bq.processReplica(ctx, tc.repl, tc.Clock()); err != nil {
+				t.Fatal(err)
+			}
+			if pc := testQueue.getProcessed(); pc != expected {
+				t.Fatalf("expected %d processed replicas, got %d", expected, pc)
+			}
+		})
+	}
+}
+
 type testError struct{}
 
 func (*testError) Error() string {
@@ -729,8 +1168,125 @@ func TestBaseQueueProcessTimeout(t *testing.T) {
 		if v := bq.failures.Count(); v != 1 {
 			return errors.Errorf("expected 1 failed replicas; got %d", v)
 		}
+		if v := bq.timeouts.Count(); v != 1 {
+			return errors.Errorf("expected 1 timed out replicas; got %d", v)
+		}
 		return nil
 	})
+
+	// The replica is requeued at a reduced priority rather than dropped.
+	bq.mu.Lock()
+	item, ok := bq.mu.replicas[r.RangeID]
+	bq.mu.Unlock()
+	if !ok {
+		t.Fatal("expected the timed out replica to be requeued")
+	}
+	if e := timedOutPriority(1.0); item.priority != e {
+		t.Errorf("expected the replica to be requeued at priority %f; got %f", e, item.priority)
+	}
+
+	// The queue moves on and processes the requeued replica again.
+	ptQueue.blocker <- struct{}{}
+	testutils.SucceedsSoon(t, func() error {
+		if pc := ptQueue.getProcessed(); pc != 2 {
+			return errors.Errorf("expected 2 processed replicas; got %d", pc)
+		}
+		if v := bq.timeouts.Count(); v != 2 {
+			return errors.Errorf("expected 2 timed out replicas; got %d", v)
+		}
+		return nil
+	})
+	close(ptQueue.blocker)
+}
+
+// latencyQueueImpl advances a manual clock by latency while processing each
+// replica. It then blocks until its processing times out if hang is set, and
+// otherwise returns err.
+type latencyQueueImpl struct {
+	testQueueImpl
+	manual  *hlc.ManualClock
+	latency time.Duration
+	hang    bool
+}
+
+func (lq *latencyQueueImpl) process(
+	ctx context.Context, r *Replica, cfg config.SystemConfig,
+) error {
+	lq.manual.Increment(lq.latency.Nanoseconds())
+	if lq.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return lq.testQueueImpl.process(ctx, r, cfg)
+}
+
+// TestBaseQueueProcessingLatency verifies that the latency of each processing
+// of a replica is recorded in the queue's latency histogram for its outcome,
+// failures and timeouts included, and that a queue without the histograms
+// processes replicas as usual.
+func TestBaseQueueProcessingLatency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	lq := &latencyQueueImpl{manual: tc.manualClock}
+	newQueue := func(withHistograms bool) *baseQueue {
+		cfg := queueConfig{
+			maxSize:              1,
+			processTimeout:       10 * time.Millisecond,
+			acceptsUnsplitRanges: true,
+		}
+		if withHistograms {
+			cfg.processingLatency = metric.NewHistogram(
+				metric.Metadata{Name: "processinglatency"}, time.Minute, int64(time.Hour), 1)
+			cfg.processingFailureLatency = metric.NewHistogram(
+				metric.Metadata{Name: "processingfailurelatency"}, time.Minute, int64(time.Hour), 1)
+		}
+		return makeTestBaseQueue("test", lq, tc.store, tc.gossip, cfg)
+	}
+	bq := newQueue(true)
+	process := func(latency time.Duration, err error, hang bool) {
+		lq.latency, lq.err, lq.hang = latency, err, hang
+		if pErr := bq.processReplica(ctx, tc.repl, tc.Clock()); (pErr == nil) != (err == nil && !hang) {
+			t.Fatalf("unexpected processing error: %v", pErr)
+		}
+	}
+	expectLatencies := func(h *metric.Histogram, count int64, min, max time.Duration) {
+		snap := h.Snapshot()
+		if a := snap.TotalCount(); a != count {
+			t.Fatalf("%s: expected %d latencies, got %d", h.GetName(), count, a)
+		}
+		// The histograms only track one significant figure.
+		if a := time.Duration(snap.Min()); a < min*9/10 || a > min*11/10 {
+			t.Errorf("%s: expected a minimum latency of about %s, got %s", h.GetName(), min, a)
+		}
+		if a := time.Duration(snap.Max()); a < max*9/10 || a > max*11/10 {
+			t.Errorf("%s: expected a maximum latency of about %s, got %s", h.GetName(), max, a)
+		}
+	}
+
+	// A single slow replica stands out from the fast ones.
+	process(time.Second, nil, false)
+	process(time.Second, nil, false)
+	process(20*time.Minute, nil, false)
+	process(5*time.Second, errors.New("injected error"), false)
+	process(30*time.Second, nil, true /* hang */)
+	if a := bq.timeouts.Count(); a != 1 {
+		t.Fatalf("expected 1 timeout, got %d", a)
+	}
+	expectLatencies(bq.processingLatency, 3, time.Second, 20*time.Minute)
+	expectLatencies(bq.processingFailureLatency, 2, 5*time.Second, 30*time.Second)
+
+	// Without the histograms, latencies are simply not recorded.
+	bq = newQueue(false)
+	process(time.Second, nil, false)
+	process(time.Second, errors.New("injected error"), false)
+	if a := bq.successes.Count(); a != 1 {
+		t.Fatalf("expected 1 success, got %d", a)
+	}
 }
 
 // processTimeQueueImpl spends 5ms on each process request.
@@ -784,6 +1340,152 @@ func TestBaseQueueTimeMetric(t *testing.T) {
 	})
 }
 
+// concurrentQueueImpl blocks processing until unblocked, and records the
+// number of replicas processed at once.
+type concurrentQueueImpl struct {
+	testQueueImpl
+	unblock chan struct{}
+
+	mu struct {
+		syncutil.Mutex
+		inFlight, maxInFlight int
+	}
+}
+
+func (cq *concurrentQueueImpl) process(
+	ctx context.Context, r *Replica, cfg config.SystemConfig,
+) error {
+	cq.mu.Lock()
+	cq.mu.inFlight++
+	if cq.mu.inFlight > cq.mu.maxInFlight {
+		cq.mu.maxInFlight = cq.mu.inFlight
+	}
+	cq.mu.Unlock()
+	defer func() {
+		cq.mu.Lock()
+		cq.mu.inFlight--
+		cq.mu.Unlock()
+	}()
+	<-cq.unblock
+	return cq.testQueueImpl.process(ctx, r, cfg)
+}
+
+func (cq *concurrentQueueImpl) getInFlight() (inFlight, maxInFlight int) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	return cq.mu.inFlight, cq.mu.maxInFlight
+}
+
+// TestBaseQueueConcurrency verifies that a queue processes up to its
+// concurrency of replicas at once, and accounts for all of them in its
+// metrics.
+func TestBaseQueueConcurrency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	// Remove replica for range 1 since it encompasses the entire keyspace.
+	repl1, err := tc.store.GetReplica(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.store.RemoveReplica(context.Background(), repl1, *repl1.Desc(), true); err != nil {
+		t.Fatal(err)
+	}
+	const numReplicas, concurrency = 5, 2
+	var repls []*Replica
+	for i := 0; i < numReplicas; i++ {
+		id := roachpb.RangeID(1001 + i)
+		repl := createReplica(tc.store, id,
+			roachpb.RKey(fmt.Sprintf("%d", id)), roachpb.RKey(fmt.Sprintf("%d/end", id)))
+		if err := tc.store.AddReplica(repl); err != nil {
+			t.Fatal(err)
+		}
+		repls = append(repls, repl)
+	}
+
+	cq := &concurrentQueueImpl{
+		testQueueImpl: testQueueImpl{
+			shouldQueueFn: func(now hlc.Timestamp, r *Replica) (shouldQueue bool, priority float64) {
+				return true, float64(r.RangeID)
+			},
+		},
+		unblock: make(chan struct{}),
+	}
+	bq := makeTestBaseQueue("test", cq, tc.store, tc.gossip, queueConfig{
+		maxSize:              numReplicas,
+		acceptsUnsplitRanges: true,
+		concurrency:          concurrency,
+	})
+	bq.Start(tc.Clock(), stopper)
+	for _, repl := range repls {
+		bq.MaybeAdd(repl, hlc.Timestamp{})
+	}
+
+	// The queue processes as many replicas as it may at once, and no more.
+	testutils.SucceedsSoon(t, func() error {
+		if inFlight, _ := cq.getInFlight(); inFlight != concurrency {
+			return errors.Errorf("expected %d replicas being processed; got %d", concurrency, inFlight)
+		}
+		if v := bq.pending.Value(); v != numReplicas-concurrency {
+			return errors.Errorf("expected %d pending replicas; got %d", numReplicas-concurrency, v)
+		}
+		return nil
+	})
+	if v := bq.successes.Count(); v != 0 {
+		t.Errorf("expected 0 processed replicas; got %d", v)
+	}
+
+	close(cq.unblock)
+	testutils.SucceedsSoon(t, func() error {
+		if pc := cq.getProcessed(); pc != numReplicas {
+			return errors.Errorf("expected %d processed replicas; got %d", numReplicas, pc)
+		}
+		if v := bq.successes.Count(); v != numReplicas {
+			return errors.Errorf("expected %d successful replicas; got %d", numReplicas, v)
+		}
+		if v := bq.pending.Value(); v != 0 {
+			return errors.Errorf("expected 0 pending replicas; got %d", v)
+		}
+		return nil
+	})
+	if v := bq.failures.Count(); v != 0 {
+		t.Errorf("expected 0 failed replicas; got %d", v)
+	}
+	if _, maxInFlight := cq.getInFlight(); maxInFlight != concurrency {
+		t.Errorf("expected at most %d replicas processed at once; got %d", concurrency, maxInFlight)
+	}
+}
+
+// TestBaseQueueAvgProcessingDuration verifies that the average which paces
+// concurrent processing follows the processing durations gradually, so that a
+// single slow replica doesn't delay the replicas which follow by its duration.
+func TestBaseQueueAvgProcessingDuration(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	bq := makeTestBaseQueue("test", &testQueueImpl{}, tc.store, tc.gossip, queueConfig{})
+	bq.recordProcessingDuration(time.Second)
+	if a := bq.avgProcessingDuration(); a != time.Second {
+		t.Fatalf("expected the first duration to be the average, got %s", a)
+	}
+	bq.recordProcessingDuration(time.Hour)
+	if a := bq.avgProcessingDuration(); a <= time.Second || a >= time.Hour/2 {
+		t.Fatalf("expected the average to move towards a slow replica's duration, got %s", a)
+	}
+	for i := 0; i < 100; i++ {
+		bq.recordProcessingDuration(time.Second)
+	}
+	if a := bq.avgProcessingDuration(); a > 2*time.Second {
+		t.Fatalf("expected the average to return to the fast replicas' duration, got %s", a)
+	}
+}
+
 func TestBaseQueueShouldQueueAgain(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	testCases := []struct {
@@ -814,6 +1516,113 @@ func TestBaseQueueShouldQueueAgain(t *testing.T) {
 	}
 }
 
+// TestJitterInterval verifies that jitterInterval spreads out the times at
+// which replicas last processed at the same time become due again, and that
+// the jitter of a range is stable.
+func TestJitterInterval(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const numRanges = 100
+	const interval = 24 * time.Hour
+	const fraction = 0.1
+	minDue := time.Duration((1 - fraction) * float64(interval))
+	maxDue := time.Duration((1 + fraction) * float64(interval))
+
+	manual := hlc.NewManualClock(1)
+	clock := hlc.NewClock(manual.UnixNano, time.Nanosecond)
+	last := clock.Now()
+	for id := roachpb.RangeID(1); id <= numRanges; id++ {
+		if a, e := jitterInterval(interval, id, fraction), jitterInterval(interval, id, fraction); a != e {
+			t.Fatalf("r%d: expected a stable jitter, got %s and %s", id, e, a)
+		}
+	}
+
+	// Advance the clock by a minute at a time through the jitter window,
+	// noting the tick at which each range becomes due. No range may become
+	// ineligible once it is due.
+	const tick = time.Minute
+	manual.Increment(minDue.Nanoseconds() - tick.Nanoseconds())
+	due := make(map[roachpb.RangeID]bool)
+	perTick := make(map[int]int)
+	for i := 0; time.Duration(i)*tick <= maxDue-minDue+tick; i++ {
+		now := clock.Now()
+		for id := roachpb.RangeID(1); id <= numRanges; id++ {
+			shouldQ, _ := shouldQueueAgain(now, last, jitterInterval(interval, id, fraction))
+			if due[id] && !shouldQ {
+				t.Fatalf("r%d: became ineligible after being due", id)
+			}
+			if shouldQ && !due[id] {
+				if i == 0 {
+					t.Fatalf("r%d: due before the jitter window", id)
+				}
+				due[id] = true
+				perTick[i]++
+			}
+		}
+		manual.Increment(tick.Nanoseconds())
+	}
+	if len(due) != numRanges {
+		t.Fatalf("expected all %d ranges to be due by the end of the jitter window, got %d",
+			numRanges, len(due))
+	}
+	// The window spans ~288 ticks, so the ranges should be spread out over
+	// many of them rather than bunched up in a few.
+	if len(perTick) < numRanges/2 {
+		t.Fatalf("expected the ranges to become due over at least %d ticks, got %d: %v",
+			numRanges/2, len(perTick), perTick)
+	}
+	for i, n := range perTick {
+		if n > 5 {
+			t.Fatalf("expected at most 5 ranges to become due at once, got %d at tick %d", n, i)
+		}
+	}
+}
+
+// TestBaseQueueShouldQueueBudget verifies that once a queue has spent its
+// shouldQueue budget for a scanner pass, replicas are deferred until the next
+// pass.
+func TestBaseQueueShouldQueueBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	r, err := tc.store.GetReplica(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const budget = time.Millisecond
+	var calls int
+	testQueue := &testQueueImpl{
+		shouldQueueFn: func(now hlc.Timestamp, r *Replica) (shouldQueue bool, priority float64) {
+			// Each call exhausts the entire budget.
+			calls++
+			time.Sleep(budget)
+			return false, 0
+		},
+	}
+	bq := makeTestBaseQueue("test", testQueue, tc.store, tc.gossip,
+		queueConfig{maxSize: 1, shouldQueueBudget: budget})
+
+	for pass := 1; pass <= 3; pass++ {
+		bq.startScanPass()
+		for i := 0; i < 5; i++ {
+			bq.MaybeAdd(r, hlc.Timestamp{})
+		}
+		if calls != pass {
+			t.Fatalf("pass %d: expected %d calls to shouldQueue; got %d", pass, pass, calls)
+		}
+		if e, a := int64(4*pass), bq.shouldQueueDeferrals.Count(); e != a {
+			t.Fatalf("pass %d: expected %d deferrals; got %d", pass, e, a)
+		}
+		if min, a := time.Duration(pass)*budget, time.Duration(bq.shouldQueueNanos.Count()); a < min {
+			t.Fatalf("pass %d: expected >= %s in shouldQueue; got %s", pass, min, a)
+		}
+	}
+}
+
 // TestBaseQueueDisable verifies that disabling a queue prevents calls
 // to both shouldQueue and process.
 func TestBaseQueueDisable(t *testing.T) {
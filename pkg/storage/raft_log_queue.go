@@ -74,7 +74,12 @@ func newRaftLogQueue(store *Store, db *client.DB, gossip *gossip.Gossip) *raftLo
 			successes:            store.metrics.RaftLogQueueSuccesses,
 			failures:             store.metrics.RaftLogQueueFailures,
 			pending:              store.metrics.RaftLogQueuePending,
+			pendingHighWater:     store.metrics.RaftLogQueuePendingHighWater,
+			sizeDropped:          store.metrics.RaftLogQueueSizeDropped,
 			processingNanos:      store.metrics.RaftLogQueueProcessingNanos,
+			timeouts:             store.metrics.RaftLogQueueProcessTimeouts,
+			waitLatency:          store.metrics.RaftLogQueueWaitLatency,
+			shouldQueueNanos:     store.metrics.RaftLogQueueShouldQueueNanos,
 		},
 	)
 	return rlq
@@ -60,7 +60,12 @@ func newRaftSnapshotQueue(store *Store, g *gossip.Gossip, clock *hlc.Clock) *raf
 			successes:            store.metrics.RaftSnapshotQueueSuccesses,
 			failures:             store.metrics.RaftSnapshotQueueFailures,
 			pending:              store.metrics.RaftSnapshotQueuePending,
+			pendingHighWater:     store.metrics.RaftSnapshotQueuePendingHighWater,
+			sizeDropped:          store.metrics.RaftSnapshotQueueSizeDropped,
 			processingNanos:      store.metrics.RaftSnapshotQueueProcessingNanos,
+			timeouts:             store.metrics.RaftSnapshotQueueProcessTimeouts,
+			waitLatency:          store.metrics.RaftSnapshotQueueWaitLatency,
+			shouldQueueNanos:     store.metrics.RaftSnapshotQueueShouldQueueNanos,
 		},
 	)
 	return rq
@@ -1503,17 +1503,13 @@ func (r *Replica) setLastReplicaGCTimestamp(ctx context.Context, timestamp hlc.T
 }
 
 // getQueueLastProcessed returns the last processed timestamp for the
-// specified queue, or the zero timestamp if not available.
+// specified queue, or the zero timestamp if not available. Bogus timestamps
+// are treated as missing (see queueLastProcessedRegistry).
 func (r *Replica) getQueueLastProcessed(ctx context.Context, queue string) (hlc.Timestamp, error) {
-	key := keys.QueueLastProcessedKey(r.Desc().StartKey, queue)
-	var timestamp hlc.Timestamp
-	if r.store != nil {
-		_, err := engine.MVCCGetProto(ctx, r.store.Engine(), key, hlc.Timestamp{}, true, nil, &timestamp)
-		if err != nil {
-			return hlc.Timestamp{}, err
-		}
+	if r.store == nil {
+		return hlc.Timestamp{}, nil
 	}
-	return timestamp, nil
+	return r.queueLastProcessed(queue).Get(ctx, r.Desc())
 }
 
 // setQueueLastProcessed writes the last processed timestamp for the
@@ -1521,8 +1517,13 @@ func (r *Replica) getQueueLastProcessed(ctx context.Context, queue string) (hlc.
 func (r *Replica) setQueueLastProcessed(
 	ctx context.Context, queue string, timestamp hlc.Timestamp,
 ) error {
-	key := keys.QueueLastProcessedKey(r.Desc().StartKey, queue)
-	return r.store.DB().PutInline(ctx, key, &timestamp)
+	return r.queueLastProcessed(queue).Set(ctx, r.Desc(), timestamp)
+}
+
+// queueLastProcessed returns the registry of the last processed timestamps of
+// the specified queue, which writes them through the store's client.
+func (r *Replica) queueLastProcessed(queue string) *queueLastProcessedRegistry {
+	return newQueueLastProcessedRegistry(r.store, queue, r.store.DB())
 }
 
 // RaftStatus returns the current raft status of the replica. It returns nil
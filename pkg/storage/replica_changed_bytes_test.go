@@ -0,0 +1,119 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"math/rand"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+// TestReplicaApproximateChangedBytes checks that the estimate of the bytes
+// changed since a timestamp is never less than the exact size of the versions
+// written since then, and that it doesn't count the sstables whose versions
+// are all older.
+func TestReplicaApproximateChangedBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	store, manual := createTestStore(t, stopper)
+	eng := store.Engine()
+
+	// Like the data loaded by the incremental iterator benchmarks: each batch
+	// writes its own keys at timestamps in its own time span, and is flushed
+	// to an sstable of its own.
+	const numKeys, numBatches, batchTimeSpan, valueBytes = 1000, 10, 10, 64
+	rng := rand.New(rand.NewSource(1))
+	for b := 0; b < numBatches; b++ {
+		batch := eng.NewBatch()
+		for i := b * numKeys / numBatches; i < (b+1)*numKeys/numBatches; i++ {
+			key := encoding.EncodeUvarintAscending(append(roachpb.Key(nil), keys.UserTableDataMin...), uint64(i))
+			ts := hlc.Timestamp{WallTime: int64(b*batchTimeSpan) + 1 + rng.Int63n(batchTimeSpan)}
+			value := roachpb.MakeValueFromBytes(randutil.RandBytes(rng, valueBytes))
+			if err := engine.MVCCPut(ctx, batch, nil, key, ts, value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := batch.Commit(false /* !sync */); err != nil {
+			t.Fatal(err)
+		}
+		batch.Close()
+		if err := eng.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manual.Increment(int64(numBatches * batchTimeSpan))
+	now := store.Clock().Now()
+
+	// exactBytes returns the size of the versions of the range's keys in
+	// (since, now].
+	exactBytes := func(since hlc.Timestamp) int64 {
+		var bytes int64
+		if err := eng.Iterate(
+			engine.MakeMVCCMetadataKey(roachpb.KeyMin), engine.MakeMVCCMetadataKey(roachpb.KeyMax),
+			func(kv engine.MVCCKeyValue) (bool, error) {
+				if since.Less(kv.Key.Timestamp) && !now.Less(kv.Key.Timestamp) {
+					bytes += int64(kv.Key.EncodedSize() + len(kv.Value))
+				}
+				return false, nil
+			},
+		); err != nil {
+			t.Fatal(err)
+		}
+		return bytes
+	}
+	for _, since := range []hlc.Timestamp{
+		now,
+		{WallTime: numBatches * batchTimeSpan},
+		{WallTime: numBatches * batchTimeSpan / 2},
+		{WallTime: batchTimeSpan},
+		{},
+	} {
+		estimate, err := store.ApproximateChangedBytes(ctx, 1 /* rangeID */, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The range covers every sstable entirely.
+		if exact := exactBytes(since); estimate < exact {
+			t.Errorf("since %s: estimate %d is less than the exact size %d", since, estimate, exact)
+		}
+	}
+
+	// No version is newer than now, so no sstable counts.
+	tables := eng.(sstableLister).GetSSTables()
+	span := roachpb.Span{Key: roachpb.KeyMin, EndKey: roachpb.KeyMax}
+	if bytes := changedSSTableBytes(tables, span, now, now); bytes != 0 {
+		t.Errorf("expected no sstables to count since %s, got %d bytes", now, bytes)
+	}
+	if bytes := changedSSTableBytes(tables, span, hlc.Timestamp{}, now); bytes == 0 {
+		t.Errorf("expected the sstables to count since %s", hlc.Timestamp{})
+	}
+
+	if _, err := store.ApproximateChangedBytes(ctx, 100 /* rangeID */, hlc.Timestamp{}); err == nil {
+		t.Error("expected an error for a missing range")
+	}
+}
@@ -374,6 +374,13 @@ func evalDeleteRange(
 	h := cArgs.Header
 	reply := resp.(*roachpb.DeleteRangeResponse)
 
+	if deletesDroppableTimeSeries(args.Span) {
+		cArgs.Stats.ContainsEstimates = true
+	}
+	if args.UseRangeTombstone {
+		return evalDeleteRangeTombstone(ctx, batch, cArgs, reply)
+	}
+
 	var timestamp hlc.Timestamp
 	if !args.Inline {
 		timestamp = h.Timestamp
@@ -395,6 +402,86 @@ func evalDeleteRange(
 	return EvalResult{}, err
 }
 
+// evalDeleteRangeTombstone deletes the inline values of the span of a
+// DeleteRange with UseRangeTombstone set using a single range deletion
+// tombstone in the engine, rather than one tombstone per key. The MVCC stats
+// are adjusted by the stats of the span, computed by the engine in a single
+// pass over it, which is cheaper than deleting the keys one by one but still
+// reads every key in the span. The span is read once more to check that it
+// holds no versioned values, whose history the tombstone would wipe out.
+//
+// As no reads from the batch are possible once it contains the tombstone, no
+// later request of the same batch may read from it.
+func evalDeleteRangeTombstone(
+	ctx context.Context,
+	batch engine.ReadWriter,
+	cArgs CommandArgs,
+	reply *roachpb.DeleteRangeResponse,
+) (EvalResult, error) {
+	args := cArgs.Args.(*roachpb.DeleteRangeRequest)
+	h := cArgs.Header
+
+	if h.Txn != nil {
+		return EvalResult{}, errors.Errorf("cannot delete range with a range tombstone in a transaction")
+	}
+	if !args.Inline {
+		return EvalResult{}, errors.Errorf("cannot delete range with a range tombstone unless inline")
+	}
+	if args.ReturnKeys {
+		return EvalResult{}, errors.Errorf("cannot return the keys deleted with a range tombstone")
+	}
+	if cArgs.MaxKeys != math.MaxInt64 {
+		return EvalResult{}, errors.Errorf("cannot limit the keys deleted with a range tombstone")
+	}
+
+	from := engine.MakeMVCCMetadataKey(args.Key)
+	to := engine.MakeMVCCMetadataKey(args.EndKey)
+	iter := batch.NewIterator(false)
+	delta, err := iter.ComputeStats(from, to, h.Timestamp.WallTime)
+	iter.Close()
+	if err != nil {
+		return EvalResult{}, err
+	}
+	if delta.IntentCount != 0 {
+		return EvalResult{}, errors.Errorf(
+			"cannot delete range with a range tombstone over %d intents", delta.IntentCount)
+	}
+	// The tombstone deletes every version of the keys in the span, so it must
+	// not be used to wipe out MVCC history. An inline value is counted by both
+	// KeyCount and ValCount, so the stats reveal keys with several versions;
+	// keys with a single version are found by the scan which follows.
+	if delta.ValCount != delta.KeyCount {
+		return EvalResult{}, errors.Errorf(
+			"cannot delete range with a range tombstone over versioned values")
+	}
+	if versioned, err := hasVersionedValues(batch, from, to); err != nil {
+		return EvalResult{}, err
+	} else if versioned {
+		return EvalResult{}, errors.Errorf(
+			"cannot delete range with a range tombstone over versioned values")
+	}
+
+	log.VEventf(ctx, 2, "deleting %d keys with a range tombstone", delta.KeyCount)
+	cArgs.Stats.Subtract(delta)
+	reply.NumKeys = delta.KeyCount
+	return EvalResult{}, batch.ClearRange(from, to)
+}
+
+// hasVersionedValues returns whether any of the keys between the supplied keys
+// has a versioned value, rather than an inline one.
+func hasVersionedValues(reader engine.Reader, from, to engine.MVCCKey) (bool, error) {
+	iter := reader.NewIterator(false)
+	defer iter.Close()
+	for iter.Seek(from); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil || !ok || !iter.UnsafeKey().Less(to) {
+			return false, err
+		}
+		if iter.UnsafeKey().IsValue() {
+			return true, nil
+		}
+	}
+}
+
 // evalScan scans the key range specified by start key through end key
 // in ascending order up to some maximum number of results. maxKeys
 // stores the number of scan results remaining for this batch
@@ -2119,6 +2206,9 @@ func (r *Replica) CheckConsistency(
 			Version:    replicaChecksumVersion,
 			ChecksumID: id,
 			Snapshot:   args.WithDiff,
+			// The replicas may disagree on the time series data while the
+			// compactions of their stores drop it.
+			SkipTimeSeries: timeSeriesCompactionFilterEnabled.Get(),
 		}
 		ba.Add(checkArgs)
 		ba.Timestamp = r.store.Clock().Now()
@@ -2229,7 +2319,7 @@ func (r *Replica) CheckConsistency(
 }
 
 const (
-	replicaChecksumVersion    = 2
+	replicaChecksumVersion    = 3
 	replicaChecksumGCInterval = time.Hour
 )
 
@@ -2314,10 +2404,14 @@ func evalComputeChecksum(
 	return pd, nil
 }
 
-// sha512 computes the SHA512 hash of all the replica data at the snapshot.
-// It will dump all the k:v data into snapshot if it is provided.
+// sha512 computes the SHA512 hash of all the replica data at the snapshot,
+// except for the time series data if skipTimeSeries is set. It will dump all
+// the k:v data into snapshot if it is provided.
 func (r *Replica) sha512(
-	desc roachpb.RangeDescriptor, snap engine.Reader, snapshot *roachpb.RaftSnapshotData,
+	desc roachpb.RangeDescriptor,
+	snap engine.Reader,
+	snapshot *roachpb.RaftSnapshotData,
+	skipTimeSeries bool,
 ) ([]byte, error) {
 	hasher := sha512.New()
 	tombstoneKey := engine.MakeMVCCMetadataKey(keys.RaftTombstoneKey(desc.RangeID))
@@ -2341,6 +2435,12 @@ func (r *Replica) sha512(
 			// key space.
 			continue
 		}
+		if skipTimeSeries && bytes.HasPrefix(key.Key, keys.TimeseriesPrefix) {
+			// Skip the time series data, which the compactions of each store's
+			// engine may drop independently; see
+			// timeSeriesCompactionFilterEnabled.
+			continue
+		}
 		value := iter.Value()
 
 		if snapshot != nil {
@@ -2373,6 +2473,28 @@ func (r *Replica) sha512(
 	return hasher.Sum(sha), nil
 }
 
+// IncrementalChecksum computes the digest of the versions of the replica's
+// data written between startTime (inclusive) and endTime (exclusive), at a
+// snapshot of its store's engine. Unlike the checksums computed by
+// ComputeChecksum, which hash all of the replica's data, it only reads the
+// data changed since the window's start, which is all a check following a
+// successful one at startTime needs to compare. The digests of the replicas
+// of a range for the same window match if their data does, provided each of
+// them has applied the writes in the window.
+func (r *Replica) IncrementalChecksum(
+	ctx context.Context, startTime, endTime hlc.Timestamp,
+) ([]byte, error) {
+	desc := r.Desc()
+	span := roachpb.Span{Key: desc.StartKey.AsRawKey(), EndKey: desc.EndKey.AsRawKey()}
+	// The range-local keys of the first range aren't versioned.
+	if span.Key.Compare(keys.LocalMax) < 0 {
+		span.Key = keys.LocalMax
+	}
+	snap := r.store.Engine().NewSnapshot()
+	defer snap.Close()
+	return incrementalChecksumFn(ctx, snap, span, startTime, endTime)
+}
+
 func makeUnimplementedCommand(method roachpb.Method) Command {
 	return Command{
 		DeclareKeys: DefaultDeclareKeys,
@@ -2388,12 +2510,28 @@ var exportCmd = makeUnimplementedCommand(roachpb.Export)
 var importCmdFn ImportCmdFunc = func(context.Context, CommandArgs) (*roachpb.ImportResponse, error) {
 	return &roachpb.ImportResponse{}, errors.Errorf("unimplemented command: %s", roachpb.Import)
 }
+var incrementalChecksumFn IncrementalChecksumFunc = func(
+	context.Context, engine.Reader, roachpb.Span, hlc.Timestamp, hlc.Timestamp,
+) ([]byte, error) {
+	return nil, errors.New("incremental checksums are not supported")
+}
+
+// writeBatchImplemented is set by SetWriteBatchCmd.
+var writeBatchImplemented bool
 
 // SetWriteBatchCmd allows setting the function that will be called as the
 // implementation of the WriteBatch command. Only allowed to be called by Init.
 func SetWriteBatchCmd(cmd Command) {
 	// This is safe if SetWriteBatchCmd is only called at init time.
 	commands[roachpb.WriteBatch] = cmd
+	writeBatchImplemented = true
+}
+
+// WriteBatchImplemented returns whether the WriteBatch command is
+// implemented, which it is once SetWriteBatchCmd has been called, as it is by
+// CCL builds.
+func WriteBatchImplemented() bool {
+	return writeBatchImplemented
 }
 
 // SetExportCmd allows setting the function that will be called as the
@@ -2414,6 +2552,20 @@ func SetImportCmd(fn ImportCmdFunc) {
 	importCmdFn = fn
 }
 
+// IncrementalChecksumFunc is the type of the function that computes the
+// order-independent digest of the versions of a span written between
+// startTime (inclusive) and endTime (exclusive).
+type IncrementalChecksumFunc func(
+	ctx context.Context, reader engine.Reader, span roachpb.Span, startTime, endTime hlc.Timestamp,
+) ([]byte, error)
+
+// SetIncrementalChecksumFn allows setting the function that will be called by
+// Replica.IncrementalChecksum. Only allowed to be called by Init.
+func SetIncrementalChecksumFn(fn IncrementalChecksumFunc) {
+	// This is safe if SetIncrementalChecksumFn is only called at init time.
+	incrementalChecksumFn = fn
+}
+
 // ReplicaSnapshotDiff is a part of a []ReplicaSnapshotDiff which represents a diff between
 // two replica snapshots. For now it's only a diff between their KV pairs.
 type ReplicaSnapshotDiff struct {
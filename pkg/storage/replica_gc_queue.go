@@ -101,7 +101,12 @@ func newReplicaGCQueue(store *Store, db *client.DB, gossip *gossip.Gossip) *repl
 			successes:            store.metrics.ReplicaGCQueueSuccesses,
 			failures:             store.metrics.ReplicaGCQueueFailures,
 			pending:              store.metrics.ReplicaGCQueuePending,
+			pendingHighWater:     store.metrics.ReplicaGCQueuePendingHighWater,
+			sizeDropped:          store.metrics.ReplicaGCQueueSizeDropped,
 			processingNanos:      store.metrics.ReplicaGCQueueProcessingNanos,
+			timeouts:             store.metrics.ReplicaGCQueueProcessTimeouts,
+			waitLatency:          store.metrics.ReplicaGCQueueWaitLatency,
+			shouldQueueNanos:     store.metrics.ReplicaGCQueueShouldQueueNanos,
 		},
 	)
 	return rgcq
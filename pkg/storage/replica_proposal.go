@@ -356,7 +356,7 @@ func (r *Replica) computeChecksumPostApply(
 		if args.Snapshot {
 			snapshot = &roachpb.RaftSnapshotData{}
 		}
-		sha, err := r.sha512(desc, snap, snapshot)
+		sha, err := r.sha512(desc, snap, snapshot, args.SkipTimeSeries)
 		if err != nil {
 			log.Errorf(ctx, "%v", err)
 			sha = nil
@@ -30,7 +30,9 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
 )
 
 // replicaStateLoader contains accessor methods to read or write the
@@ -593,6 +595,20 @@ func (rec ReplicaEvalContext) Tracer() opentracing.Tracer {
 	return rec.repl.store.Tracer()
 }
 
+// StartBackgroundOperation registers a long-running operation on the
+// Replica's store. See Store.StartBackgroundOperation.
+func (rec ReplicaEvalContext) StartBackgroundOperation(
+	ctx context.Context, op BackgroundOperation, progress func() string,
+) (finish func()) {
+	return rec.repl.store.StartBackgroundOperation(ctx, op, progress)
+}
+
+// CCLMetrics returns the metrics which the CCL packages maintain for the
+// Replica's store, or nil if none are set. See SetCCLMetrics.
+func (rec ReplicaEvalContext) CCLMetrics() metric.Struct {
+	return rec.repl.store.metrics.cclMetrics
+}
+
 // DB returns the Replica's client DB.
 func (rec ReplicaEvalContext) DB() *client.DB {
 	return rec.repl.store.DB()
@@ -604,6 +620,12 @@ func (rec ReplicaEvalContext) Engine() engine.Engine {
 	return rec.repl.store.Engine()
 }
 
+// Stopper returns the stopper of the Replica's store, which runs the
+// background work started by the evaluation of a command.
+func (rec ReplicaEvalContext) Stopper() *stop.Stopper {
+	return rec.repl.store.Stopper()
+}
+
 // AbortCache returns the Replica's AbortCache.
 func (rec ReplicaEvalContext) AbortCache() *AbortCache {
 	// Despite its name, the abort cache doesn't hold on-disk data in
@@ -6416,6 +6416,70 @@ func TestComputeChecksumVersioning(t *testing.T) {
 	}
 }
 
+// TestReplicaChecksumSkipsTimeSeries checks that the checksum of a replica
+// covers its time series data unless asked to skip it, as it is while the
+// compactions of each store may drop the data independently.
+func TestReplicaChecksumSkipsTimeSeries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	checksum := func(skipTimeSeries bool) []byte {
+		snap := tc.engine.NewSnapshot()
+		defer snap.Close()
+		sha, err := tc.repl.sha512(*tc.repl.Desc(), snap, nil, skipTimeSeries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha
+	}
+	put := func(key roachpb.Key) {
+		if err := tc.engine.Put(engine.MakeMVCCMetadataKey(key), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, beforeSkipped := checksum(false), checksum(true)
+	put(append(append(roachpb.Key(nil), keys.TimeseriesPrefix...), "metric"...))
+	if after := checksum(false); bytes.Equal(before, after) {
+		t.Error("expected time series data to change the checksum")
+	}
+	if after := checksum(true); !bytes.Equal(beforeSkipped, after) {
+		t.Error("expected skipped time series data to leave the checksum unchanged")
+	}
+	put(roachpb.Key("a"))
+	if after := checksum(true); bytes.Equal(beforeSkipped, after) {
+		t.Error("expected other data to change the checksum")
+	}
+}
+
+func TestDeletesDroppableTimeSeries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tsKey := append(append(roachpb.Key(nil), keys.TimeseriesPrefix...), "metric"...)
+	testCases := []struct {
+		span    roachpb.Span
+		enabled bool
+		expect  bool
+	}{
+		{roachpb.Span{Key: tsKey, EndKey: tsKey.PrefixEnd()}, true, true},
+		{roachpb.Span{Key: tsKey, EndKey: tsKey.PrefixEnd()}, false, false},
+		{roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("b")}, true, false},
+		{roachpb.Span{Key: keys.MinKey, EndKey: keys.MaxKey}, true, true},
+		{roachpb.Span{Key: keys.MinKey, EndKey: keys.TimeseriesPrefix}, true, false},
+		{roachpb.Span{Key: keys.TimeseriesPrefix.PrefixEnd(), EndKey: keys.MaxKey}, true, false},
+	}
+	for i, test := range testCases {
+		func() {
+			defer settings.TestingSetBool(&timeSeriesCompactionFilterEnabled, test.enabled)()
+			if actual := deletesDroppableTimeSeries(test.span); actual != test.expect {
+				t.Errorf("%d: expected %t for %s, got %t", i, test.expect, test.span, actual)
+			}
+		}()
+	}
+}
+
 func TestNewReplicaCorruptionError(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	for i, tc := range []struct {
@@ -7847,3 +7911,66 @@ func TestCommandTooLarge(t *testing.T) {
 		t.Fatalf("did not get expected error: %v", pErr)
 	}
 }
+
+// TestReplicaGetQueueLastProcessed verifies that last processed timestamps
+// which are missing, undecodable or too far ahead of the clock are treated as
+// missing, and that the latter two are reset.
+func TestReplicaGetQueueLastProcessed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	const queue = "test"
+	key := keys.QueueLastProcessedKey(tc.repl.Desc().StartKey, queue)
+	expectLastProcessed := func(expected hlc.Timestamp) {
+		if lp, err := tc.repl.getQueueLastProcessed(ctx, queue); err != nil {
+			t.Fatal(err)
+		} else if lp != expected {
+			t.Fatalf("expected last processed timestamp %s, got %s", expected, lp)
+		}
+	}
+	expectReset := func() {
+		testutils.SucceedsSoon(t, func() error {
+			var timestamp hlc.Timestamp
+			if ok, err := engine.MVCCGetProto(
+				ctx, tc.store.Engine(), key, hlc.Timestamp{}, true, nil, &timestamp,
+			); err != nil {
+				return err
+			} else if !ok || timestamp != (hlc.Timestamp{}) {
+				return fmt.Errorf("expected the timestamp to be reset, got %s", timestamp)
+			}
+			return nil
+		})
+	}
+
+	// A missing timestamp.
+	expectLastProcessed(hlc.Timestamp{})
+
+	// Timestamps ahead of the clock by less than the maximum offset are
+	// honored.
+	ahead := tc.Clock().Now().Add(int64(queueLastProcessedMaxFutureOffset/2), 0)
+	if err := tc.repl.setQueueLastProcessed(ctx, queue, ahead); err != nil {
+		t.Fatal(err)
+	}
+	expectLastProcessed(ahead)
+
+	// Timestamps further ahead are not.
+	future := tc.Clock().Now().Add(int64(2*queueLastProcessedMaxFutureOffset), 0)
+	if err := tc.repl.setQueueLastProcessed(ctx, queue, future); err != nil {
+		t.Fatal(err)
+	}
+	expectLastProcessed(hlc.Timestamp{})
+	expectReset()
+
+	// Nor are undecodable timestamps.
+	var garbage roachpb.Value
+	garbage.SetBytes([]byte{0xff, 0xff})
+	if err := engine.MVCCPut(ctx, tc.store.Engine(), nil, key, hlc.Timestamp{}, garbage, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectLastProcessed(hlc.Timestamp{})
+	expectReset()
+}
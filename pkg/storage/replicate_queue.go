@@ -115,8 +115,13 @@ func newReplicateQueue(
 			successes:            store.metrics.ReplicateQueueSuccesses,
 			failures:             store.metrics.ReplicateQueueFailures,
 			pending:              store.metrics.ReplicateQueuePending,
+			pendingHighWater:     store.metrics.ReplicateQueuePendingHighWater,
+			sizeDropped:          store.metrics.ReplicateQueueSizeDropped,
 			processingNanos:      store.metrics.ReplicateQueueProcessingNanos,
+			timeouts:             store.metrics.ReplicateQueueProcessTimeouts,
+			waitLatency:          store.metrics.ReplicateQueueWaitLatency,
 			purgatory:            store.metrics.ReplicateQueuePurgatory,
+			shouldQueueNanos:     store.metrics.ReplicateQueueShouldQueueNanos,
 		},
 	)
 
@@ -46,6 +46,12 @@ type replicaQueue interface {
 	MaybeRemove(roachpb.RangeID)
 }
 
+// A scanPassObserver is a replicaQueue which is notified at the start of each
+// pass of the replica scanner over all replicas.
+type scanPassObserver interface {
+	startScanPass()
+}
+
 // A replicaSet provides access to a sequence of replicas to consider
 // for inclusion in replica queues. There are no requirements for the
 // ordering of the iteration.
@@ -265,6 +271,11 @@ func (rs *replicaScanner) scanLoop(clock *hlc.Clock, stopper *stop.Stopper) {
 				}
 				continue
 			}
+			for _, q := range rs.queues {
+				if o, ok := q.(scanPassObserver); ok {
+					o.startScanPass()
+				}
+			}
 			var shouldStop bool
 			count := 0
 			rs.replicas.Visit(func(repl *Replica) bool {
@@ -56,7 +56,12 @@ func newSplitQueue(store *Store, db *client.DB, gossip *gossip.Gossip) *splitQue
 			successes:            store.metrics.SplitQueueSuccesses,
 			failures:             store.metrics.SplitQueueFailures,
 			pending:              store.metrics.SplitQueuePending,
+			pendingHighWater:     store.metrics.SplitQueuePendingHighWater,
+			sizeDropped:          store.metrics.SplitQueueSizeDropped,
 			processingNanos:      store.metrics.SplitQueueProcessingNanos,
+			timeouts:             store.metrics.SplitQueueProcessTimeouts,
+			waitLatency:          store.metrics.SplitQueueWaitLatency,
+			shouldQueueNanos:     store.metrics.SplitQueueShouldQueueNanos,
 		},
 	)
 	return sq
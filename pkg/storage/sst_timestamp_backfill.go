@@ -0,0 +1,168 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// sstTimestampBackfillEnabled enables the rewriting of sstables lacking the
+// timestamp properties used by time-bound iterators to skip them, such as
+// those written before the properties were introduced.
+var sstTimestampBackfillEnabled = settings.RegisterBoolSetting(
+	"kv.sst_timestamp_backfill.enabled",
+	"if true, sstables lacking the timestamp properties which let incremental "+
+		"iterations skip them are gradually rewritten",
+	false,
+)
+
+// sstTimestampBackfillInterval is the interval between the rewrites of
+// sstables lacking timestamp properties, which keeps the rewrites from
+// competing with foreground traffic.
+var sstTimestampBackfillInterval = settings.RegisterNonNegativeDurationSetting(
+	"kv.sst_timestamp_backfill.interval",
+	"interval between the rewrites of sstables lacking timestamp properties",
+	time.Minute,
+)
+
+// sstTimestampBackfillSpans are the spans whose sstables are rewritten: those
+// read by incremental iterations.
+var sstTimestampBackfillSpans = []roachpb.Span{
+	{Key: keys.TimeseriesPrefix, EndKey: keys.TimeseriesPrefix.PrefixEnd()},
+	{Key: keys.UserTableDataMin, EndKey: keys.MaxKey},
+}
+
+// sstableLister is implemented by the engines which can list their sstables,
+// such as *engine.RocksDB.
+type sstableLister interface {
+	GetSSTables() engine.SSTableInfos
+}
+
+// sstTimestampBackfiller rewrites, one at a time and at a low rate, the
+// sstables of a store's engine which lack timestamp properties. Time-bound
+// iterators can never skip such sstables, and without a rewrite they may
+// remain for months, until RocksDB's own compactions happen to touch them.
+type sstTimestampBackfiller struct {
+	lister sstableLister
+	// compactFn compacts a span of the engine.
+	compactFn func(from, to roachpb.Key, forceBottommost bool) error
+	// remainingBytes is the size of the sstables which remain to be
+	// rewritten, as of the last pass.
+	remainingBytes *metric.Gauge
+}
+
+// newSSTTimestampBackfiller returns a backfiller of the engine's sstables, or
+// nil if the engine can't list them.
+func newSSTTimestampBackfiller(
+	eng engine.Engine, remainingBytes *metric.Gauge,
+) *sstTimestampBackfiller {
+	lister, ok := eng.(sstableLister)
+	if !ok {
+		return nil
+	}
+	return &sstTimestampBackfiller{
+		lister:         lister,
+		compactFn:      eng.CompactRange,
+		remainingBytes: remainingBytes,
+	}
+}
+
+// pending returns the sstables overlapping sstTimestampBackfillSpans which
+// lack timestamp properties, in the order in which they are rewritten. An
+// sstable which has the key counts recorded along with the timestamps was
+// written, or already rewritten, by the current property collector, and only
+// lacks timestamps because it holds no versioned keys, such as one of inline
+// time series data, so it is done.
+func (b *sstTimestampBackfiller) pending() engine.SSTableInfos {
+	var pending engine.SSTableInfos
+	for _, t := range b.lister.GetSSTables() {
+		if t.TsMin != nil && t.TsMax != nil || t.UnversionedKeys != nil {
+			continue
+		}
+		for _, span := range sstTimestampBackfillSpans {
+			// The end key of an sstable is inclusive.
+			if t.End.Key.Compare(span.Key) >= 0 && t.Start.Key.Compare(span.EndKey) < 0 {
+				pending = append(pending, t)
+				break
+			}
+		}
+	}
+	return pending
+}
+
+// backfillOne rewrites the first pending sstable, if any, and updates the
+// remaining bytes. It returns whether an sstable was rewritten.
+func (b *sstTimestampBackfiller) backfillOne(ctx context.Context) (bool, error) {
+	pending := b.pending()
+	b.remainingBytes.Update(sstableBytes(pending))
+	if len(pending) == 0 {
+		return false, nil
+	}
+	t := pending[0]
+	log.VEventf(ctx, 2, "rewriting sstable [%s, %s] at level %d lacking timestamp properties",
+		t.Start, t.End, t.Level)
+	// The bottommost level must be compacted too, or a bottommost sstable
+	// wouldn't be rewritten.
+	if err := b.compactFn(t.Start.Key, t.End.Key.Next(), true /* forceBottommost */); err != nil {
+		return false, err
+	}
+	b.remainingBytes.Update(sstableBytes(b.pending()))
+	return true, nil
+}
+
+// sstableBytes returns the total size of the sstables.
+func sstableBytes(tables engine.SSTableInfos) int64 {
+	var bytes int64
+	for _, t := range tables {
+		bytes += t.Size
+	}
+	return bytes
+}
+
+// start starts a worker which, while sstTimestampBackfillEnabled is set,
+// rewrites an sstable every sstTimestampBackfillInterval until the stopper is
+// stopped.
+func (b *sstTimestampBackfiller) start(ctx context.Context, stopper *stop.Stopper) {
+	stopper.RunWorker(ctx, func(ctx context.Context) {
+		var timer timeutil.Timer
+		defer timer.Stop()
+		for {
+			timer.Reset(sstTimestampBackfillInterval.Get())
+			select {
+			case <-timer.C:
+				timer.Read = true
+			case <-stopper.ShouldStop():
+				return
+			}
+			if !sstTimestampBackfillEnabled.Get() {
+				continue
+			}
+			if _, err := b.backfillOne(ctx); err != nil {
+				log.Warningf(ctx, "failed to rewrite sstable lacking timestamp properties: %s", err)
+			}
+		}
+	})
+}
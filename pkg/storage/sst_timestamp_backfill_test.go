@@ -0,0 +1,152 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+// fakeSSTableLister lists a fixed set of sstables, whose rewrite by a
+// compaction is simulated by giving them timestamp properties.
+type fakeSSTableLister struct {
+	tables engine.SSTableInfos
+}
+
+func (l *fakeSSTableLister) GetSSTables() engine.SSTableInfos {
+	return l.tables
+}
+
+// compact gives the sstables within [from, to) the properties the current
+// property collector records.
+func (l *fakeSSTableLister) compact(from, to roachpb.Key) {
+	for i := range l.tables {
+		t := &l.tables[i]
+		if t.Start.Key.Compare(from) >= 0 && t.End.Key.Compare(to) < 0 {
+			ts := hlc.Timestamp{WallTime: 1}
+			var unversioned int64
+			t.TsMin, t.TsMax, t.UnversionedKeys = &ts, &ts, &unversioned
+		}
+	}
+}
+
+// TestSSTTimestampBackfill verifies that the sstables lacking timestamp
+// properties in the backfilled spans are rewritten one at a time, forcing the
+// compaction of the bottommost level, until none remain, and that those which
+// lack them only because they hold no versioned keys are not.
+func TestSSTTimestampBackfill(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tableKey := func(table uint32, key string) engine.MVCCKey {
+		return engine.MakeMVCCMetadataKey(append(keys.MakeTablePrefix(table), key...))
+	}
+	ts := hlc.Timestamp{WallTime: 5}
+	var unversioned int64 = 2
+	lister := &fakeSSTableLister{tables: engine.SSTableInfos{
+		// The sstable of table 10 is outside of the backfilled spans.
+		{Level: 6, Size: 10, Start: tableKey(10, "a"), End: tableKey(10, "b")},
+		// The sstables of tables 100 and 101 lack the properties.
+		{Level: 6, Size: 20, Start: tableKey(100, "a"), End: tableKey(100, "b")},
+		{Level: 5, Size: 30, Start: tableKey(101, "a"), End: tableKey(101, "a")},
+		// That of table 102 has them.
+		{Level: 4, Size: 40, Start: tableKey(102, "a"), End: tableKey(102, "a"), TsMin: &ts, TsMax: &ts},
+		// That of the time series holds only inline data, so it has the key
+		// counts but no timestamps.
+		{Level: 6, Size: 50, Start: engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix),
+			End: engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix), UnversionedKeys: &unversioned},
+	}}
+	remaining := metric.NewGauge(metric.Metadata{Name: "remaining"})
+	var compacted []roachpb.Span
+	b := &sstTimestampBackfiller{
+		lister: lister,
+		compactFn: func(from, to roachpb.Key, forceBottommost bool) error {
+			if !forceBottommost {
+				t.Errorf("expected the compaction of [%s, %s) to force the bottommost level", from, to)
+			}
+			compacted = append(compacted, roachpb.Span{Key: from, EndKey: to})
+			lister.compact(from, to)
+			return nil
+		},
+		remainingBytes: remaining,
+	}
+	if pending := b.pending(); len(pending) != 2 {
+		t.Fatalf("expected 2 sstables to backfill, got %v", pending)
+	}
+
+	for i := 0; ; i++ {
+		rewritten, err := b.backfillOne(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rewritten {
+			break
+		}
+		if i == 0 {
+			if v := remaining.Value(); v != 30 {
+				t.Errorf("expected 30 remaining bytes after the first rewrite, got %d", v)
+			}
+		}
+		if i > 2 {
+			t.Fatalf("expected at most 2 rewrites, still pending: %v", b.pending())
+		}
+	}
+	if len(compacted) != 2 {
+		t.Fatalf("expected 2 rewrites, got %v", compacted)
+	}
+	if v := remaining.Value(); v != 0 {
+		t.Errorf("expected no remaining bytes, got %d", v)
+	}
+}
+
+// TestSSTTimestampBackfillInline verifies that an sstable of the engine which
+// holds only inline data, and so has no timestamp properties, is not
+// backfilled, as rewriting it wouldn't add them.
+func TestSSTTimestampBackfillInline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	eng := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer eng.Close()
+	key := engine.MakeMVCCMetadataKey(append(keys.TimeseriesPrefix, "a"...))
+	if err := eng.Put(key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ssts := eng.GetSSTables()
+	if len(ssts) != 1 || ssts[0].TsMin != nil || ssts[0].UnversionedKeys == nil {
+		t.Fatalf("expected an sstable with key counts but no timestamps, got %v", ssts)
+	}
+
+	b := newSSTTimestampBackfiller(eng, metric.NewGauge(metric.Metadata{Name: "remaining"}))
+	if b == nil {
+		t.Fatal("expected the in-memory engine to support the backfill")
+	}
+	if rewritten, err := b.backfillOne(ctx); err != nil {
+		t.Fatal(err)
+	} else if rewritten {
+		t.Fatal("expected the sstable of inline data not to be rewritten")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"io"
 	"math"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -403,6 +404,23 @@ type Store struct {
 	metrics            *StoreMetrics
 	intentResolver     *intentResolver
 	raftEntryCache     *raftEntryCache
+	compactor          *compactor              // Suggested compactions
+	sstBackfiller      *sstTimestampBackfiller // Rewrites sstables lacking timestamps; nil if unsupported
+	queueCache         *queueCache             // Per-replica data cached by the queues
+	engineHealth       *engineHealth           // Whether the engine can take background work
+	maintenanceSlots   *maintenanceSlots       // Bounds the IO-intensive work of heavy queues
+
+	// queueProcessedMu holds, for each queue and range waited on by
+	// WaitForQueueProcessing, a channel which is closed when the last
+	// processed timestamp of the range's replica for the queue is next set.
+	queueProcessedMu struct {
+		syncutil.Mutex
+		chans map[queueProcessedKey]chan struct{}
+	}
+
+	// backgroundOps are the long-running operations in flight on the store.
+	// See StartBackgroundOperation.
+	backgroundOps backgroundOperations
 
 	// gossipRangeCountdown and leaseRangeCountdown are countdowns of
 	// changes to range and leaseholder counts, after which the store
@@ -779,6 +797,15 @@ type StoreTestingKnobs struct {
 	// DisableTimeSeriesMaintenanceQueue disables the time series maintenance
 	// queue.
 	DisableTimeSeriesMaintenanceQueue bool
+	// TimeSeriesDataStoreSnapshotOverride, if set, is called with the store's
+	// engine in place of taking a snapshot of it for the time series
+	// maintenance queue, so that a test can substitute a prepared reader for
+	// the TimeSeriesDataStore to read. The queue closes the returned reader.
+	TimeSeriesDataStoreSnapshotOverride func(engine.Engine) engine.Reader
+	// TimeSeriesPruneEvent, if set, is called with the span of the replica and
+	// the timestamp passed to each call to TimeSeriesDataStore.PruneTimeSeries
+	// by the time series maintenance queue.
+	TimeSeriesPruneEvent func(span roachpb.RSpan, now hlc.Timestamp)
 	// DisableScanner disables the replica scanner.
 	DisableScanner bool
 	// DisablePeriodicGossips disables periodic gossiping.
@@ -815,6 +842,9 @@ type StoreTestingKnobs struct {
 	// only changes in the number of replicas can cause the store to gossip its
 	// capacity.
 	DisableLeaseCapacityGossip bool
+	// BackgroundOperationStarted is called with each operation registered by
+	// StartBackgroundOperation, once it is listed by BackgroundOperations.
+	BackgroundOperationStarted func(BackgroundOperation)
 }
 
 var _ base.ModuleTestingKnobs = &StoreTestingKnobs{}
@@ -931,6 +961,13 @@ func NewStore(cfg StoreConfig, eng engine.Engine, nodeDesc *roachpb.NodeDescript
 	s.tsCacheMu.Unlock()
 
 	s.snapshotApplySem = make(chan struct{}, cfg.concurrentSnapshotApplyLimit)
+	s.compactor = newCompactor(s.engine)
+	s.sstBackfiller = newSSTTimestampBackfiller(s.engine, s.metrics.RdbTimestampBackfillBytes)
+	s.queueCache = newQueueCache(s.metrics)
+	s.engineHealth = newEngineHealth(s.engine.GetStats)
+	s.maintenanceSlots = newMaintenanceSlots(func() int64 {
+		return maintenanceSlotsSetting.Get()
+	}, s.metrics.MaintenanceSlotsInUse)
 
 	if s.cfg.Gossip != nil {
 		// Add range scanner and configure with queues.
@@ -1213,6 +1250,10 @@ func (s *Store) Start(ctx context.Context, stopper *stop.Stopper) error {
 	// Start Raft processing goroutines.
 	s.cfg.Transport.Listen(s.StoreID(), s)
 	s.processRaft()
+	s.compactor.start(s.AnnotateCtx(context.Background()), s.stopper)
+	if s.sstBackfiller != nil {
+		s.sstBackfiller.start(s.AnnotateCtx(context.Background()), s.stopper)
+	}
 
 	// Gossip is only ever nil while bootstrapping a cluster and
 	// in unittests.
@@ -1251,6 +1292,11 @@ func (s *Store) Start(ctx context.Context, stopper *stop.Stopper) error {
 			}
 		})
 
+		// Keep the cutoffs of the engine's time series compaction filter
+		// current. The retention they follow is known once the system config
+		// has been gossiped.
+		s.startTimeSeriesCompactionFilter(ctx)
+
 		// Run metrics computation up front to populate initial statistics.
 		if err = s.ComputeMetrics(ctx, -1); err != nil {
 			log.Infof(ctx, "%s: failed initial metrics computation: %s", s, err)
@@ -4034,6 +4080,255 @@ func (s *Store) GetTempPrefix() string {
 	return s.engine.GetTempDir()
 }
 
+// ForceTimeSeriesMaintenance runs time series maintenance on the replica of
+// the specified range immediately, and returns a description of the run. The
+// replica is processed even if it was processed recently; a successful run
+// records a new last processed timestamp as usual.
+func (s *Store) ForceTimeSeriesMaintenance(
+	ctx context.Context, rangeID roachpb.RangeID,
+) (TimeSeriesMaintenanceResult, error) {
+	if s.tsMaintenanceQueue == nil {
+		return TimeSeriesMaintenanceResult{}, errors.Errorf("%s: time series maintenance is not enabled", s)
+	}
+	repl, err := s.GetReplica(rangeID)
+	if err != nil {
+		return TimeSeriesMaintenanceResult{}, err
+	}
+	return s.tsMaintenanceQueue.forceMaintenance(repl.AnnotateCtx(ctx), repl)
+}
+
+// PruneTimeSeriesSources deletes all of the time series data of the supplied
+// sources, such as decommissioned nodes, from the replica of the specified
+// range, regardless of its age, and returns a description of the deletion.
+// The data of other sources is untouched.
+func (s *Store) PruneTimeSeriesSources(
+	ctx context.Context, rangeID roachpb.RangeID, sources []string,
+) (TimeSeriesSourcePruneSummary, error) {
+	if s.tsMaintenanceQueue == nil {
+		return TimeSeriesSourcePruneSummary{}, errors.Errorf("%s: time series maintenance is not enabled", s)
+	}
+	repl, err := s.GetReplica(rangeID)
+	if err != nil {
+		return TimeSeriesSourcePruneSummary{}, err
+	}
+	return s.tsMaintenanceQueue.pruneSources(repl.AnnotateCtx(ctx), repl, sources)
+}
+
+// SuggestCompaction suggests a compaction of the span [start, end) of the
+// store's engine, which is expected to reclaim approximately the supplied
+// number of bytes. Suggested compactions are performed asynchronously.
+func (s *Store) SuggestCompaction(ctx context.Context, start, end roachpb.Key, bytes int64) {
+	s.compactor.suggest(ctx, compactionSuggestion{
+		span:  roachpb.Span{Key: start, EndKey: end},
+		bytes: bytes,
+	})
+}
+
+// queueProcessedKey identifies the replica of a range processed by a queue.
+type queueProcessedKey struct {
+	queue   string
+	rangeID roachpb.RangeID
+}
+
+// queueProcessedChan returns a channel which is closed when the last
+// processed timestamp of the range's replica for the named queue is next set.
+func (s *Store) queueProcessedChan(queue string, rangeID roachpb.RangeID) <-chan struct{} {
+	s.queueProcessedMu.Lock()
+	defer s.queueProcessedMu.Unlock()
+	if s.queueProcessedMu.chans == nil {
+		s.queueProcessedMu.chans = make(map[queueProcessedKey]chan struct{})
+	}
+	key := queueProcessedKey{queue: queue, rangeID: rangeID}
+	ch, ok := s.queueProcessedMu.chans[key]
+	if !ok {
+		ch = make(chan struct{})
+		s.queueProcessedMu.chans[key] = ch
+	}
+	return ch
+}
+
+// notifyQueueProcessed wakes up the callers of WaitForQueueProcessing waiting
+// on the range's replica for the named queue. It is called once the last
+// processed timestamp has been set.
+func (s *Store) notifyQueueProcessed(queue string, rangeID roachpb.RangeID) {
+	s.queueProcessedMu.Lock()
+	defer s.queueProcessedMu.Unlock()
+	key := queueProcessedKey{queue: queue, rangeID: rangeID}
+	if ch, ok := s.queueProcessedMu.chans[key]; ok {
+		close(ch)
+		delete(s.queueProcessedMu.chans, key)
+	}
+}
+
+// WaitForQueueProcessing blocks until the last processed timestamp of the
+// range's replica for the named queue is after since, and returns it. It
+// returns immediately if the timestamp is after since already, and otherwise
+// waits to be notified that the queue processed the replica, or for the
+// context to be done. Only the processing by the queues of this store is
+// waited for.
+func (s *Store) WaitForQueueProcessing(
+	ctx context.Context, queue string, rangeID roachpb.RangeID, since hlc.Timestamp,
+) (hlc.Timestamp, error) {
+	for {
+		// The channel is obtained before the timestamp is read, so that an
+		// update in between is not missed.
+		ch := s.queueProcessedChan(queue, rangeID)
+		repl, err := s.GetReplica(rangeID)
+		if err != nil {
+			return hlc.Timestamp{}, err
+		}
+		lpTS, err := repl.getQueueLastProcessed(ctx, queue)
+		if err != nil {
+			return hlc.Timestamp{}, err
+		}
+		if since.Less(lpTS) {
+			return lpTS, nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return hlc.Timestamp{}, ctx.Err()
+		}
+	}
+}
+
+// TimeSeriesMaintenanceStatus describes the time series maintenance state of a
+// replica containing time series data.
+type TimeSeriesMaintenanceStatus struct {
+	RangeID  roachpb.RangeID
+	StartKey roachpb.RKey
+	EndKey   roachpb.RKey
+	// LastProcessed is the time the replica was last processed by the time
+	// series maintenance queue, or zero if it never has been.
+	LastProcessed hlc.Timestamp
+	// Overdue is true if the replica has not been processed within twice
+	// TimeSeriesMaintenanceInterval.
+	Overdue bool
+}
+
+// TimeSeriesMaintenanceStatuses returns the time series maintenance state of
+// each replica on the store which contains time series data, ordered by start
+// key.
+func (s *Store) TimeSeriesMaintenanceStatuses() ([]TimeSeriesMaintenanceStatus, error) {
+	if s.tsMaintenanceQueue == nil {
+		return nil, errors.Errorf("%s: time series maintenance is not enabled", s)
+	}
+	lastProcessed, err := s.tsMaintenanceQueue.lastProcessed.Scan()
+	if err != nil {
+		return nil, err
+	}
+	now := s.Clock().Now()
+	var statuses []TimeSeriesMaintenanceStatus
+	newStoreReplicaVisitor(s).Visit(func(repl *Replica) bool {
+		desc := repl.Desc()
+		if !s.tsMaintenanceQueue.containsTimeSeries(desc) {
+			return true
+		}
+		lpTS := lastProcessed[string(desc.StartKey)]
+		statuses = append(statuses, TimeSeriesMaintenanceStatus{
+			RangeID:       desc.RangeID,
+			StartKey:      desc.StartKey,
+			EndKey:        desc.EndKey,
+			LastProcessed: lpTS,
+			Overdue:       now.GoTime().Sub(lpTS.GoTime()) > 2*TimeSeriesMaintenanceInterval,
+		})
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartKey.Less(statuses[j].StartKey)
+	})
+	return statuses, nil
+}
+
+// TimeSeriesMaintenanceProgress returns the progress of the current pass of
+// time series maintenance over the replicas of the store, with an estimate of
+// the time at which it completes.
+func (s *Store) TimeSeriesMaintenanceProgress() (TimeSeriesMaintenanceProgress, error) {
+	if s.tsMaintenanceQueue == nil {
+		return TimeSeriesMaintenanceProgress{}, errors.Errorf("%s: time series maintenance is not enabled", s)
+	}
+	return s.tsMaintenanceQueue.maintenanceProgress()
+}
+
+// TimeSeriesSizeReport returns the sizes of the largest time series on the
+// store, as last measured by the time series maintenance of each replica.
+func (s *Store) TimeSeriesSizeReport() (TimeSeriesSizeReport, error) {
+	if s.tsMaintenanceQueue == nil {
+		return TimeSeriesSizeReport{}, errors.Errorf("%s: time series maintenance is not enabled", s)
+	}
+	return s.tsMaintenanceQueue.sizeReport(), nil
+}
+
+// QueueHistories returns the recent processing outcomes recorded by the
+// store's queues for the specified range, keyed by queue name.
+func (s *Store) QueueHistories(
+	ctx context.Context, rangeID roachpb.RangeID,
+) (map[string][]QueueOutcome, error) {
+	repl, err := s.GetReplica(rangeID)
+	if err != nil {
+		return nil, err
+	}
+	var queues []*baseQueue
+	if s.consistencyQueue != nil {
+		queues = append(queues, s.consistencyQueue.baseQueue)
+	}
+	if s.tsMaintenanceQueue != nil {
+		queues = append(queues, s.tsMaintenanceQueue.baseQueue)
+	}
+	histories := make(map[string][]QueueOutcome)
+	for _, q := range queues {
+		if q.historySize == 0 {
+			continue
+		}
+		history, err := repl.GetQueueHistory(ctx, q.name)
+		if err != nil {
+			return nil, err
+		}
+		histories[q.name] = history
+	}
+	return histories, nil
+}
+
+// QueuedReplicas returns a snapshot of the replicas waiting in each of the
+// store's queues, keyed by queue name. At most limit replicas, those of the
+// highest priorities, are returned for each queue, unless limit is zero.
+func (s *Store) QueuedReplicas(limit int) map[string][]QueuedReplica {
+	queued := make(map[string][]QueuedReplica)
+	if s.scanner == nil {
+		// The store has no queues without gossip.
+		return queued
+	}
+	queues := []*baseQueue{
+		s.gcQueue.baseQueue,
+		s.splitQueue.baseQueue,
+		s.replicateQueue.baseQueue,
+		s.replicaGCQueue.baseQueue,
+		s.raftLogQueue.baseQueue,
+		s.raftSnapshotQueue.baseQueue,
+		s.consistencyQueue.baseQueue,
+	}
+	if s.tsMaintenanceQueue != nil {
+		queues = append(queues, s.tsMaintenanceQueue.baseQueue)
+	}
+	for _, q := range queues {
+		queued[q.name] = q.Queued(limit)
+	}
+	return queued
+}
+
+// ApproximateChangedBytes returns the estimate of the size of the data written
+// after since to the replica of the specified range. See
+// Replica.ApproximateChangedBytes.
+func (s *Store) ApproximateChangedBytes(
+	ctx context.Context, rangeID roachpb.RangeID, since hlc.Timestamp,
+) (int64, error) {
+	repl, err := s.GetReplica(rangeID)
+	if err != nil {
+		return 0, err
+	}
+	return repl.ApproximateChangedBytes(ctx, since)
+}
+
 // The methods below can be used to control a store's queues. Stopping a queue
 // is only meant to happen in tests.
 
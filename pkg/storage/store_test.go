@@ -2635,3 +2635,71 @@ func TestSnapshotRateLimit(t *testing.T) {
 		})
 	}
 }
+
+// TestWaitForQueueProcessing verifies that WaitForQueueProcessing returns as
+// soon as a replica's last processed timestamp for a queue is after the
+// supplied timestamp, and otherwise waits for it to be set or for its context
+// to be done.
+func TestWaitForQueueProcessing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	const queue = "test"
+	rangeID := tc.repl.RangeID
+	ts1 := tc.Clock().Now()
+	if err := tc.repl.setQueueLastProcessed(ctx, queue, ts1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The timestamp is already after since.
+	if lpTS, err := tc.store.WaitForQueueProcessing(ctx, queue, rangeID, ts1.Prev()); err != nil {
+		t.Fatal(err)
+	} else if lpTS != ts1 {
+		t.Fatalf("expected last processed timestamp %s, got %s", ts1, lpTS)
+	}
+
+	// A waiter is woken up once the replica is processed again.
+	type result struct {
+		lpTS hlc.Timestamp
+		err  error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		lpTS, err := tc.store.WaitForQueueProcessing(ctx, queue, rangeID, ts1)
+		resultC <- result{lpTS, err}
+	}()
+	testutils.SucceedsSoon(t, func() error {
+		tc.store.queueProcessedMu.Lock()
+		defer tc.store.queueProcessedMu.Unlock()
+		if _, ok := tc.store.queueProcessedMu.chans[queueProcessedKey{queue, rangeID}]; !ok {
+			return errors.New("waiter not yet registered")
+		}
+		return nil
+	})
+	select {
+	case r := <-resultC:
+		t.Fatalf("expected the waiter to block, got %+v", r)
+	default:
+	}
+	tc.manualClock.Increment(1)
+	ts2 := tc.Clock().Now()
+	if err := tc.repl.setQueueLastProcessed(ctx, queue, ts2); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-resultC; r.err != nil {
+		t.Fatal(r.err)
+	} else if r.lpTS != ts2 {
+		t.Fatalf("expected last processed timestamp %s, got %s", ts2, r.lpTS)
+	}
+
+	// The waiter gives up once its context is done.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := tc.store.WaitForQueueProcessing(timeoutCtx, queue, rangeID, ts2); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
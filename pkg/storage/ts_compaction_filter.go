@@ -0,0 +1,129 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// timeSeriesCompactionFilterEnabled controls whether the compactions of a
+// store's engine drop the time series data older than its retention. The
+// maintenance queue prunes such data by deleting it, but the data and its
+// tombstones linger until they are compacted together into the bottommost
+// level, which the compaction filter speeds up. Only the compactions into the
+// bottommost level drop data.
+//
+// The data is dropped outside of raft, by each store when its engine happens
+// to compact it, so while it awaits pruning the replicas of a range may
+// disagree on it. Time series data is therefore left out of the checksums of
+// the consistency checker while the filter is enabled (see Replica.sha512).
+// Nor do the MVCC stats of a range account for the data dropped: they would
+// keep counting it once the maintenance queue prunes it, as the pruning only
+// subtracts the stats of the data which remains, so the pruning marks them as
+// estimates (see deletesDroppableTimeSeries), which the next split of the
+// range recomputes. The checksums cover the time series data again once the
+// filter is disabled, so it should only be disabled once the data it dropped
+// has been pruned, and only enabled once every node skips the data in its
+// checksums.
+var timeSeriesCompactionFilterEnabled = settings.RegisterBoolSetting(
+	"timeseries.storage.compaction_filter.enabled",
+	"drop time series data older than its retention when the engine compacts it",
+	false,
+)
+
+const (
+	// timeSeriesCompactionCutoffsInterval is the interval at which each store
+	// refreshes the cutoffs below which its engine's compactions drop time
+	// series data.
+	timeSeriesCompactionCutoffsInterval = 10 * time.Minute
+	// timeSeriesCompactionFilterGrace is added to the retention of each
+	// resolution for the compaction filter, so that the maintenance queue has
+	// the time to roll the data up before compactions drop it: data which
+	// outlives its retention is rolled up by the next maintenance of its
+	// replica, which is due within the jittered maintenance interval and
+	// completes within the processing timeout, and the cutoffs in effect may
+	// be up to a refresh interval old.
+	timeSeriesCompactionFilterGrace = TimeSeriesMaintenanceInterval +
+		time.Duration(timeSeriesMaintenanceIntervalJitter*float64(TimeSeriesMaintenanceInterval)) +
+		timeSeriesMaintenanceProcessTimeout + timeSeriesCompactionCutoffsInterval
+)
+
+// timeSeriesCompactionCutoffs returns the cutoffs below which the compactions
+// of the store's engine drop time series data, or none if they shouldn't drop
+// any: when the compaction filter is disabled, when maintenance is disabled or
+// only dry runs, as the data then isn't rolled up before the filter would drop
+// it, or when the retention can't be determined because the cluster settings,
+// which might shorten it from the defaults, haven't been received with the
+// system config yet.
+func (s *Store) timeSeriesCompactionCutoffs() []engine.TimeSeriesCutoff {
+	if !timeSeriesCompactionFilterEnabled.Get() || s.cfg.TimeSeriesDataStore == nil ||
+		s.cfg.Gossip == nil {
+		return nil
+	}
+	if !timeSeriesMaintenanceEnabled.Get() || timeSeriesMaintenanceDryRun.Get() {
+		return nil
+	}
+	if _, ok := s.cfg.Gossip.GetSystemConfig(); !ok {
+		return nil
+	}
+	retention := timeSeriesRetention()
+	for res, ttl := range retention {
+		if ttl > 0 {
+			retention[res] = ttl + timeSeriesCompactionFilterGrace
+		}
+	}
+	return s.cfg.TimeSeriesDataStore.CompactionCutoffs(s.cfg.Clock.Now(), retention)
+}
+
+// startTimeSeriesCompactionFilter periodically refreshes the cutoffs below
+// which the compactions of the store's engine drop time series data. If
+// refreshing them fails, the previous cutoffs remain in effect until the next
+// refresh; until the first one, no data is dropped.
+func (s *Store) startTimeSeriesCompactionFilter(ctx context.Context) {
+	s.stopper.RunWorker(ctx, func(ctx context.Context) {
+		ticker := time.NewTicker(timeSeriesCompactionCutoffsInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.engine.SetTimeSeriesCutoffs(s.timeSeriesCompactionCutoffs()); err != nil {
+				log.Warningf(ctx, "failed to set the time series compaction cutoffs: %s", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-s.stopper.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// deletesDroppableTimeSeries returns whether a deletion of the span may
+// delete time series data of which the compaction filter dropped some
+// versions on some replicas, so that the MVCC stats of the deletion, computed
+// from the data which remains, don't subtract the data dropped.
+func deletesDroppableTimeSeries(span roachpb.Span) bool {
+	if !timeSeriesCompactionFilterEnabled.Get() {
+		return false
+	}
+	return span.Key.Compare(keys.TimeseriesPrefix.PrefixEnd()) < 0 &&
+		span.EndKey.Compare(keys.TimeseriesPrefix) > 0
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// timeSeriesMaintenanceProgressWindow is the number of the most recently
+// maintained replicas from which the rate of maintenance is estimated.
+const timeSeriesMaintenanceProgressWindow = 20
+
+// TimeSeriesMaintenanceProgress describes the progress of the current pass of
+// the time series maintenance queue over the replicas of a store.
+type TimeSeriesMaintenanceProgress struct {
+	// PassStart is the time at which the current pass began.
+	PassStart time.Time `json:"pass_start"`
+	// Due is the number of replicas containing time series data which are due
+	// to be maintained in the pass, including those added to the store during
+	// it, and Done the number of them maintained so far.
+	Due  int `json:"due"`
+	Done int `json:"done"`
+	// PercentComplete is the percentage of the due replicas which were
+	// maintained. A pass without due replicas is complete.
+	PercentComplete float64 `json:"percent_complete"`
+	// ETA is the estimated time at which the pass completes, at the rate at
+	// which the most recent replicas were maintained. It is zero if the pass
+	// is complete, or if the time is unknown: nothing was maintained yet, or
+	// the estimate has passed without the pass completing, as when the queue
+	// is stalled.
+	ETA time.Time `json:"eta"`
+}
+
+// ETAString returns the ETA of the pass, or a description of why it has none.
+func (p TimeSeriesMaintenanceProgress) ETAString() string {
+	if p.Done >= p.Due {
+		return "complete"
+	}
+	if p.ETA.IsZero() {
+		return "unknown"
+	}
+	return p.ETA.String()
+}
+
+// timeSeriesMaintenanceCompletion records the maintenance of a replica.
+type timeSeriesMaintenanceCompletion struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// timeSeriesMaintenanceProgressTracker tracks the progress of the passes of
+// the time series maintenance queue. A pass begins when the progress is first
+// observed, and every interval thereafter; every replica containing time
+// series data is due once in each pass, as its last processed time is less
+// than an interval before the pass ends. Replicas which are added to the store
+// during a pass, such as by splits, are added to those due, and replicas which
+// are removed from it before they are maintained are dropped from them.
+type timeSeriesMaintenanceProgressTracker struct {
+	clock    *hlc.Clock
+	interval time.Duration
+
+	mu struct {
+		syncutil.Mutex
+		passStart time.Time
+		due       map[roachpb.RangeID]struct{}
+		done      map[roachpb.RangeID]struct{}
+		// recent holds the completions of the most recently maintained
+		// replicas, oldest first, regardless of the pass.
+		recent []timeSeriesMaintenanceCompletion
+	}
+}
+
+func newTimeSeriesMaintenanceProgressTracker(
+	clock *hlc.Clock, interval time.Duration,
+) *timeSeriesMaintenanceProgressTracker {
+	return &timeSeriesMaintenanceProgressTracker{clock: clock, interval: interval}
+}
+
+// maybeStartPassLocked begins a new pass if there is none, or if the current
+// one began an interval ago.
+func (t *timeSeriesMaintenanceProgressTracker) maybeStartPassLocked(now time.Time) {
+	if !t.mu.passStart.IsZero() && now.Sub(t.mu.passStart) < t.interval {
+		return
+	}
+	t.mu.passStart = now
+	t.mu.due = make(map[roachpb.RangeID]struct{})
+	t.mu.done = make(map[roachpb.RangeID]struct{})
+}
+
+// observe updates the replicas due in the current pass from the last
+// processed times of the replicas of the store which contain time series
+// data.
+func (t *timeSeriesMaintenanceProgressTracker) observe(lastProcessed map[roachpb.RangeID]hlc.Timestamp) {
+	now := t.clock.PhysicalTime()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maybeStartPassLocked(now)
+	for rangeID, lpTS := range lastProcessed {
+		t.mu.due[rangeID] = struct{}{}
+		if !lpTS.GoTime().Before(t.mu.passStart) {
+			t.mu.done[rangeID] = struct{}{}
+		}
+	}
+	for rangeID := range t.mu.due {
+		if _, ok := lastProcessed[rangeID]; !ok {
+			if _, ok := t.mu.done[rangeID]; !ok {
+				delete(t.mu.due, rangeID)
+			}
+		}
+	}
+}
+
+// recordProcessed records that the replica of the range was maintained, which
+// took the supplied duration.
+func (t *timeSeriesMaintenanceProgressTracker) recordProcessed(
+	rangeID roachpb.RangeID, duration time.Duration,
+) {
+	now := t.clock.PhysicalTime()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maybeStartPassLocked(now)
+	t.mu.due[rangeID] = struct{}{}
+	t.mu.done[rangeID] = struct{}{}
+	t.mu.recent = append(t.mu.recent, timeSeriesMaintenanceCompletion{at: now, duration: duration})
+	if n := len(t.mu.recent); n > timeSeriesMaintenanceProgressWindow {
+		t.mu.recent = append(t.mu.recent[:0], t.mu.recent[n-timeSeriesMaintenanceProgressWindow:]...)
+	}
+}
+
+// progress returns the progress of the current pass. The time taken by each
+// replica is estimated as the mean interval between the recent completions,
+// which includes the pauses between replicas, or as the duration of the
+// maintenance of the only recently maintained replica.
+func (t *timeSeriesMaintenanceProgressTracker) progress() TimeSeriesMaintenanceProgress {
+	now := t.clock.PhysicalTime()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maybeStartPassLocked(now)
+	p := TimeSeriesMaintenanceProgress{
+		PassStart:       t.mu.passStart,
+		Due:             len(t.mu.due),
+		Done:            len(t.mu.done),
+		PercentComplete: 100,
+	}
+	if p.Due == 0 || p.Done >= p.Due {
+		return p
+	}
+	p.PercentComplete = 100 * float64(p.Done) / float64(p.Due)
+
+	n := len(t.mu.recent)
+	if n == 0 {
+		return p
+	}
+	last := t.mu.recent[n-1]
+	perReplica := last.duration
+	if n > 1 {
+		perReplica = last.at.Sub(t.mu.recent[0].at) / time.Duration(n-1)
+	}
+	if perReplica <= 0 {
+		return p
+	}
+	if eta := last.at.Add(time.Duration(p.Due-p.Done) * perReplica); eta.After(now) {
+		p.ETA = eta
+	}
+	return p
+}
+
+// maintenanceProgress returns the progress of the current pass of the queue
+// over the store's replicas, updated from their last processed times.
+func (q *timeSeriesMaintenanceQueue) maintenanceProgress() (TimeSeriesMaintenanceProgress, error) {
+	lastProcessed, err := q.lastProcessed.Scan()
+	if err != nil {
+		return TimeSeriesMaintenanceProgress{}, err
+	}
+	replicas := make(map[roachpb.RangeID]hlc.Timestamp)
+	newStoreReplicaVisitor(q.store).Visit(func(repl *Replica) bool {
+		desc := repl.Desc()
+		if q.containsTimeSeries(desc) {
+			replicas[desc.RangeID] = lastProcessed[string(desc.StartKey)]
+		}
+		return true
+	})
+	q.progress.observe(replicas)
+	return q.progress.progress(), nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestTimeSeriesMaintenanceProgress verifies the progress and completion
+// estimates of the passes of time series maintenance, as replicas are
+// maintained, added during a pass, and as the queue stalls.
+func TestTimeSeriesMaintenanceProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	manual := hlc.NewManualClock(int64(100 * time.Hour))
+	clock := hlc.NewClock(manual.UnixNano, time.Nanosecond)
+	tracker := newTimeSeriesMaintenanceProgressTracker(clock, TimeSeriesMaintenanceInterval)
+
+	expect := func(due, done int, percent float64, eta string) {
+		p := tracker.progress()
+		if p.Due != due || p.Done != done || p.PercentComplete != percent || p.ETAString() != eta {
+			t.Fatalf("expected %d of %d done (%.1f%%), ETA %s; got %d of %d done (%.1f%%), ETA %s",
+				done, due, percent, eta, p.Done, p.Due, p.PercentComplete, p.ETAString())
+		}
+	}
+	at := func(d time.Duration) string {
+		return time.Unix(0, int64(100*time.Hour+d)).UTC().String()
+	}
+
+	// A pass without due replicas is complete.
+	tracker.observe(nil)
+	expect(0, 0, 100, "complete")
+	passStart := clock.PhysicalTime()
+
+	// Replicas processed before the pass began are due in it; those processed
+	// since are done.
+	before := hlc.Timestamp{WallTime: int64(99 * time.Hour)}
+	since := hlc.Timestamp{WallTime: int64(100 * time.Hour)}
+	tracker.observe(map[roachpb.RangeID]hlc.Timestamp{
+		1: before, 2: before, 3: {}, 4: since,
+	})
+	// Nothing was maintained yet, so the rate is unknown.
+	expect(4, 1, 25, "unknown")
+
+	// With a single replica maintained, the time it took is the estimate.
+	manual.Increment(int64(10 * time.Minute))
+	tracker.recordProcessed(1, time.Minute)
+	expect(4, 2, 50, at(12*time.Minute))
+
+	// With more, the mean interval between them is the estimate.
+	manual.Increment(int64(15 * time.Minute))
+	tracker.recordProcessed(2, time.Minute)
+	expect(4, 3, 75, at(25*time.Minute+15*time.Minute))
+
+	// A split adds a replica to those due.
+	tracker.observe(map[roachpb.RangeID]hlc.Timestamp{
+		1: since, 2: since, 3: {}, 4: since, 5: {},
+	})
+	expect(5, 3, 60, at(25*time.Minute+30*time.Minute))
+
+	// A replica removed before it was maintained is no longer due.
+	tracker.observe(map[roachpb.RangeID]hlc.Timestamp{
+		1: since, 2: since, 3: {}, 4: since,
+	})
+	expect(4, 3, 75, at(25*time.Minute+15*time.Minute))
+
+	// Once the estimate has passed without progress, it is unknown rather
+	// than in the past.
+	manual.Increment(int64(time.Hour))
+	expect(4, 3, 75, "unknown")
+
+	tracker.recordProcessed(3, time.Minute)
+	expect(4, 4, 100, "complete")
+
+	// The next pass begins an interval after the last, with every replica
+	// due again. The rate of the last pass carries over.
+	manual.Increment(int64(TimeSeriesMaintenanceInterval))
+	tracker.observe(map[roachpb.RangeID]hlc.Timestamp{
+		1: since, 2: since, 3: since, 4: since,
+	})
+	p := tracker.progress()
+	if !p.PassStart.After(passStart) {
+		t.Fatalf("expected a new pass after %s, got %s", passStart, p.PassStart)
+	}
+	expect(4, 0, 0, "unknown")
+	manual.Increment(int64(time.Minute))
+	tracker.recordProcessed(1, time.Minute)
+	if p := tracker.progress(); p.ETA.IsZero() || !p.ETA.After(clock.PhysicalTime()) {
+		t.Fatalf("expected an ETA after %s, got %s", clock.PhysicalTime(), p.ETAString())
+	}
+}
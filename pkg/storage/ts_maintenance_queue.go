@@ -17,40 +17,432 @@
 package storage
 
 import (
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/config"
 	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 )
 
 const (
 	// TimeSeriesMaintenanceInterval is the minimum interval between two
 	// time series maintenance runs on a replica.
 	TimeSeriesMaintenanceInterval = 24 * time.Hour // daily
+	// timeSeriesMaintenanceIntervalJitter is the fraction of
+	// TimeSeriesMaintenanceInterval by which the interval of each replica is
+	// jittered, so that the replicas maintained at the same time, as after a
+	// restart, don't all become due at the same time again.
+	timeSeriesMaintenanceIntervalJitter = 0.1
+
+	// timeSeriesMaintenanceAcceleratedPriorityBoost is added to the priority
+	// of replicas queued while the store is low on disk.
+	timeSeriesMaintenanceAcceleratedPriorityBoost = 10
+	// timeSeriesMaintenanceAcceleratedDeleteRateMultiplier is applied to the
+	// configured delete rate while the store is low on disk.
+	timeSeriesMaintenanceAcceleratedDeleteRateMultiplier = 4
+	// timeSeriesMaintenancePrunableBytesPriorityScale is the number of
+	// estimated prunable bytes which adds one to a replica's priority.
+	timeSeriesMaintenancePrunableBytesPriorityScale = 1 << 20 // 1 MiB
+	// timeSeriesMaintenanceShouldQueueBudget is the time which the queue may
+	// spend in shouldQueue, which probes the engine to estimate prunable bytes,
+	// during each pass of the replica scanner.
+	timeSeriesMaintenanceShouldQueueBudget = time.Second
+	// timeSeriesMaintenanceProcessTimeout bounds the maintenance of a replica.
+	// Pruning is paced by the delete rate and each of its series is bounded by
+	// timeSeriesMaintenanceSeriesTimeout, so this is generous; it guards against
+	// a wedged deletion, such as one stuck behind an unavailable range.
+	timeSeriesMaintenanceProcessTimeout = 10 * time.Minute
+	// timeSeriesMaintenanceFailureBackoff is the time for which a replica is
+	// not requeued after failing maintenance, doubling with each consecutive
+	// failure. Maintenance typically fails when the engine is struggling, which
+	// retrying immediately only worsens.
+	timeSeriesMaintenanceFailureBackoff = time.Minute
+	// timeSeriesMaintenanceTruncatedRequeueDelay is the delay after which a
+	// replica whose pruning stopped at timeSeriesMaintenancePassBytes is
+	// queued again to prune the rest of its time series.
+	timeSeriesMaintenanceTruncatedRequeueDelay = 10 * time.Second
+	// timeSeriesMaintenanceDeclinedRequeueDelay is the delay after which a
+	// replica whose maintenance was declined is queued again, to be maintained
+	// if conditions have improved.
+	timeSeriesMaintenanceDeclinedRequeueDelay = time.Minute
+	// timeSeriesResumeSaveTimeout bounds the write of the resume record of a
+	// replica whose pruning failed part way, which is issued even if the
+	// context of the processing is done.
+	timeSeriesResumeSaveTimeout = 5 * time.Second
+	// timeSeriesMaintenanceRecountInterval is the minimum interval between two
+	// counts of the replicas containing time series data, by which the queue
+	// is paced (see timer).
+	timeSeriesMaintenanceRecountInterval = time.Minute
+	// timeSeriesMaintenanceQueueMemBudget is the memory which the replicas
+	// queued for time series maintenance may retain (see queueConfig.memAcc).
+	// Few ranges contain time series, so it is far below the memory of
+	// defaultQueueMaxSize replicas.
+	timeSeriesMaintenanceQueueMemBudget = 256 << 10 // 256 KiB
+	// timeSeriesContainsCacheName and timeSeriesPartialPassCacheName are the
+	// names under which the queue caches per-replica data in the store's
+	// queueCache.
+	timeSeriesContainsCacheName    = "tsmaintenance.contains"
+	timeSeriesPartialPassCacheName = "tsmaintenance.partial"
+)
+
+// timeSeriesMaintenanceLowDiskFraction is the fraction of total store capacity
+// below which available capacity is considered low. While the store is low on
+// disk, time series maintenance is accelerated: replicas are queued at a
+// boosted priority and processed without pacing.
+var timeSeriesMaintenanceLowDiskFraction = settings.RegisterNonNegativeFloatSetting(
+	"timeseries.maintenance.low_disk_fraction",
+	"fraction of store capacity below which available disk space accelerates time series maintenance (0 disables)",
+	0.1,
+)
+
+// timeSeriesMaintenanceDeleteRate is the maximum rate, in deletion batches per
+// second, at which time series pruning issues deletions. It protects foreground
+// traffic from the large deletions issued when a backlog of old time series
+// data is first pruned. If pruning adapts its rate to foreground latency (see
+// deleteRateController), this is the rate at which it starts.
+var timeSeriesMaintenanceDeleteRate = settings.RegisterNonNegativeFloatSetting(
+	"timeseries.maintenance.delete_rate",
+	"maximum number of time series deletion batches issued per second by pruning, "+
+		"or the initial rate if it adapts to latency (0 disables the limit)",
+	10,
+)
+
+// timeSeriesMaintenancePruneSliceDuration is the span of time of the data of a
+// time series which pruning deletes at a time. A series with a large backlog
+// of old data, as after an outage of maintenance, would otherwise be deleted
+// by a single deletion spanning weeks of data.
+var timeSeriesMaintenancePruneSliceDuration = settings.RegisterNonNegativeDurationSetting(
+	"timeseries.maintenance.prune_slice_duration",
+	"span of time of the data of a time series deleted at a time by pruning (0 disables slicing)",
+	24*time.Hour,
+)
+
+// timeSeriesMaintenancePruneBatchKeys is the maximum number of keys deleted by
+// each deletion batch issued by pruning.
+var timeSeriesMaintenancePruneBatchKeys = settings.RegisterIntSetting(
+	"timeseries.maintenance.prune_batch_keys",
+	"maximum number of keys deleted by each time series deletion batch issued by pruning "+
+		"(0 disables the limit)",
+	10000,
+)
+
+// timeSeriesMaintenanceRangeTombstones enables the deletion of the data pruned
+// by the time series maintenance queue with range deletion tombstones. Nodes
+// unaware of them delete the keys one by one without the limit of
+// timeseries.maintenance.prune_batch_keys, so it should only be enabled once
+// every node of the cluster supports them.
+var timeSeriesMaintenanceRangeTombstones = settings.RegisterBoolSetting(
+	"timeseries.maintenance.range_tombstones.enabled",
+	"if true, time series data is pruned with range deletion tombstones in the storage "+
+		"engine rather than with a tombstone per key",
+	false,
+)
+
+// timeSeriesResolution10sTTL and timeSeriesResolution30mTTL are the ages
+// beyond which time series data at the 10 second and 30 minute resolutions is
+// pruned. They are read by each pass of the queue, so a change applies from
+// the next pass.
+var timeSeriesResolution10sTTL = settings.RegisterDurationSetting(
+	"timeseries.storage.resolution_10s.ttl",
+	"age beyond which time series data at the 10 second resolution is pruned "+
+		"(0 or negative never prunes it)",
+	30*24*time.Hour,
+)
+
+var timeSeriesResolution30mTTL = settings.RegisterDurationSetting(
+	"timeseries.storage.resolution_30m.ttl",
+	"age beyond which time series data at the 30 minute resolution is pruned "+
+		"(0 or negative never prunes it)",
+	365*24*time.Hour,
+)
+
+// timeSeriesRetention returns the retention configured by the cluster
+// settings.
+func timeSeriesRetention() TimeSeriesRetention {
+	return TimeSeriesRetention{
+		"10s": timeSeriesResolution10sTTL.Get(),
+		"30m": timeSeriesResolution30mTTL.Get(),
+	}
+}
+
+// timeSeriesMaintenanceMaxReadAmplification is the read amplification of the
+// store's engine above which the store is considered overloaded, and time
+// series maintenance is deferred. A high read amplification indicates that
+// compactions are falling behind, which leads to write stalls.
+var timeSeriesMaintenanceMaxReadAmplification = settings.RegisterIntSetting(
+	"timeseries.maintenance.max_read_amplification",
+	"read amplification of a store's engine above which time series maintenance is deferred "+
+		"(0 disables)",
+	0,
+)
+
+// timeSeriesMaintenanceSeriesTimeout bounds the time spent pruning a single
+// time series of a replica, so that one enormous series can't starve the
+// others.
+var timeSeriesMaintenanceSeriesTimeout = settings.RegisterNonNegativeDurationSetting(
+	"timeseries.maintenance.series_timeout",
+	"maximum time spent pruning a single time series of a replica (0 disables)",
+	time.Minute,
+)
+
+// timeSeriesMaintenanceEnabled pauses the time series maintenance queue while
+// false, such as to stop it issuing deletions during a capacity emergency.
+var timeSeriesMaintenanceEnabled = settings.RegisterBoolSetting(
+	"timeseries.maintenance.enabled",
+	"if false, time series data is neither rolled up nor pruned, and queued replicas are dropped",
+	true,
+)
+
+// timeSeriesMaintenanceConcurrency is the number of replicas whose time series
+// are maintained at once. Pruning a replica is mostly spent waiting on the
+// deletions it issues, so maintaining a few replicas in parallel shortens a
+// pass over a store with many replicas; the deletions of all of them are still
+// paced by the shared delete rate.
+var timeSeriesMaintenanceConcurrency = settings.RegisterIntSetting(
+	"timeseries.maintenance.concurrency",
+	"number of replicas whose time series data is maintained concurrently by each store",
+	2,
+)
+
+// timeSeriesMaintenanceCompactionThreshold is the number of keys which pruning
+// must delete from a replica for the queue to suggest a compaction of the
+// replica's time series data, so that the space is reclaimed promptly.
+var timeSeriesMaintenanceCompactionThreshold = settings.RegisterIntSetting(
+	"timeseries.maintenance.compaction_threshold",
+	"number of time series keys deleted by pruning a replica above which a compaction "+
+		"of the replica's time series data is suggested (0 disables)",
+	10000,
+)
+
+// timeSeriesMaintenancePassBytes bounds the data pruned from a replica by one
+// pass of the queue, so that a replica with a large backlog, as after an
+// outage of maintenance, doesn't hog the queue and the delete rate.
+var timeSeriesMaintenancePassBytes = settings.RegisterByteSizeSetting(
+	"timeseries.maintenance.pass_bytes",
+	"number of bytes of time series data pruned from a replica in one pass, after which "+
+		"the rest of the replica is pruned by another pass shortly after (0 disables)",
+	256<<20, // 256 MiB
+)
+
+// timeSeriesMaintenancePrunedFreshness is the time for which the maintenance
+// of a replica is advertised in gossip, so that a replica of the same range on
+// another store, as after a lease transfer, isn't maintained again needlessly
+// (see recentlyPrunedElsewhere). It defaults to the shortest jittered
+// TimeSeriesMaintenanceInterval, so that the range isn't maintained elsewhere
+// any sooner than the replica which pruned it would have maintained it again.
+var timeSeriesMaintenancePrunedFreshness = settings.RegisterNonNegativeDurationSetting(
+	"timeseries.maintenance.pruned_freshness",
+	"time for which time series maintenance of a range is advertised in gossip, during which "+
+		"other stores don't maintain the range again (0 disables)",
+	time.Duration((1-timeSeriesMaintenanceIntervalJitter)*float64(TimeSeriesMaintenanceInterval)),
+)
+
+// timeSeriesMaintenanceDryRun makes the queue estimate the data which pruning
+// would delete instead of maintaining replicas, so that the effect of shorter
+// retention can be assessed before any data is deleted.
+var timeSeriesMaintenanceDryRun = settings.RegisterBoolSetting(
+	"timeseries.maintenance.dry_run",
+	"if true, time series maintenance only estimates the data pruning would delete, "+
+		"and neither rolls up nor prunes any data",
+	false,
+)
+
+// timeSeriesOrphanGracePeriod is the age beyond which the data of a time
+// series whose name is no longer that of a registered metric, such as after
+// the metric was removed, is deleted regardless of the retention. Zero, the
+// default, retains orphaned series for the retention like any other.
+var timeSeriesOrphanGracePeriod = settings.RegisterNonNegativeDurationSetting(
+	"timeseries.storage.orphan_grace_period",
+	"age of its newest data beyond which a time series of a metric which is no longer "+
+		"registered by any node is deleted entirely (0 disables)",
+	0,
 )
 
+// TimeSeriesDeleteLimiter paces the deletion batches issued while pruning time
+// series data. It is satisfied by *rate.Limiter.
+type TimeSeriesDeleteLimiter interface {
+	Wait(context.Context) error
+}
+
+// TimeSeriesRetention is the age beyond which time series data is pruned at
+// each resolution, keyed by the name of the resolution, such as "10s". Data at
+// a resolution which is absent is retained for the default of the time series
+// system; data at a resolution with a zero or negative retention is neither
+// pruned nor rolled up.
+type TimeSeriesRetention map[string]time.Duration
+
+// TimeSeriesPruneOptions controls how TimeSeriesDataStore.PruneTimeSeries
+// issues deletions.
+type TimeSeriesPruneOptions struct {
+	// DeleteLimiter, if non-nil, is waited on before each deletion batch.
+	DeleteLimiter TimeSeriesDeleteLimiter
+	// MaxSliceDuration, if positive, is the span of time of the data of a
+	// series deleted at a time. Each slice is deleted by one or more batches,
+	// each committed before the next is issued, oldest first.
+	MaxSliceDuration time.Duration
+	// MaxKeysPerBatch, if positive, is the maximum number of keys deleted by
+	// each deletion batch. It does not apply to UseRangeTombstones.
+	MaxKeysPerBatch int64
+	// UseRangeTombstones, if set, deletes the data of each deletion batch with
+	// a range deletion tombstone in the storage engine of each range, rather
+	// than with a tombstone per key. See roachpb.DeleteRangeRequest.
+	UseRangeTombstones bool
+	// Retention is the age beyond which data is pruned at each resolution. A
+	// nil Retention retains each resolution for its default.
+	Retention TimeSeriesRetention
+	// OrphanGracePeriod, if positive, is the age beyond which all of the data
+	// of a series whose name is not among KnownNames is deleted, once its
+	// newest sample is older than it. Nothing is deleted as an orphan if
+	// KnownNames is nil.
+	OrphanGracePeriod time.Duration
+	// KnownNames are the names of the time series of the metrics currently
+	// registered in the cluster. See TimeSeriesDataStore.KnownTimeSeriesNames.
+	KnownNames map[string]struct{}
+	// Summary, if non-nil, is populated with a summary of the pruning.
+	Summary *TimeSeriesPruneSummary
+}
+
+// TimeSeriesPruneSummary describes the work performed by a call to
+// TimeSeriesDataStore.PruneTimeSeries.
+type TimeSeriesPruneSummary struct {
+	// SeriesPruned is the number of time series, counted separately at each
+	// resolution, from which old data was deleted.
+	SeriesPruned int `json:"series_pruned"`
+	// KeysDeleted and BytesDeleted measure the time series data deleted.
+	KeysDeleted  int64 `json:"keys_deleted"`
+	BytesDeleted int64 `json:"bytes_deleted"`
+	// Retained measures the time series data which pruning left in place.
+	Retained TimeSeriesSize `json:"retained"`
+	// Thresholds maps the name of each resolution to the time before which
+	// data at that resolution was pruned. Resolutions which are never pruned
+	// are omitted.
+	Thresholds map[string]time.Time `json:"thresholds"`
+	// OrphansDeleted is the number of time series, counted once regardless of
+	// their resolutions, which were deleted entirely as orphans.
+	OrphansDeleted int `json:"orphans_deleted"`
+	// Truncated is set if pruning stopped at timeSeriesMaintenancePassBytes,
+	// leaving some time series to be pruned by a later pass.
+	Truncated bool `json:"truncated"`
+	// ResumeKey is the first key which may not have been pruned: the end of
+	// the series' data in the key range once pruning succeeds, or, if pruning
+	// failed part way, the key up to which the batches which succeeded pruned
+	// the data. Only ResumeKey is populated if pruning fails.
+	ResumeKey roachpb.Key `json:"resume_key,omitempty"`
+}
+
+// add accumulates the summary of pruning another time series.
+func (s *TimeSeriesPruneSummary) add(other TimeSeriesPruneSummary) {
+	s.SeriesPruned += other.SeriesPruned
+	s.KeysDeleted += other.KeysDeleted
+	s.BytesDeleted += other.BytesDeleted
+	s.Retained.Keys += other.Retained.Keys
+	s.Retained.Bytes += other.Retained.Bytes
+	s.OrphansDeleted += other.OrphansDeleted
+	if s.Thresholds == nil {
+		s.Thresholds = other.Thresholds
+	}
+}
+
+// TimeSeriesSourcePruneSummary describes the data deleted by a call to
+// TimeSeriesDataStore.PruneTimeSeriesSources.
+type TimeSeriesSourcePruneSummary struct {
+	// Sources are the sources whose data was deleted.
+	Sources []string `json:"sources"`
+	// KeysDeleted and BytesDeleted measure the time series data deleted.
+	KeysDeleted  int64 `json:"keys_deleted"`
+	BytesDeleted int64 `json:"bytes_deleted"`
+	// KeysDeletedBySource is the number of keys deleted of each source.
+	KeysDeletedBySource map[string]int64 `json:"keys_deleted_by_source"`
+}
+
 // TimeSeriesDataStore is an interface defined in the storage package that can
 // be implemented by the higher-level time series system. This allows the
 // storage queues to run periodic time series maintenance; importantly, this
 // maintenance can then be informed by data from the local store.
 type TimeSeriesDataStore interface {
 	ContainsTimeSeries(roachpb.RKey, roachpb.RKey) bool
-	PruneTimeSeries(
+	// MayNeedMaintenance is a cheap preflight check, consulted before a
+	// snapshot is taken for RollupTimeSeries and PruneTimeSeries. It returns
+	// false if the supplied MVCC stats of the key range show that there is no
+	// time series data for maintenance to examine.
+	MayNeedMaintenance(roachpb.RKey, roachpb.RKey, enginepb.MVCCStats) bool
+	// EstimatePrunableBytes returns a cheap, bounded-cost estimate of the
+	// number of bytes of time series data in the key range which would be
+	// removed by a call to PruneTimeSeries at the supplied timestamp with the
+	// supplied retention.
+	EstimatePrunableBytes(
+		context.Context, engine.Reader, roachpb.RKey, roachpb.RKey, hlc.Timestamp,
+		TimeSeriesRetention,
+	) (int64, error)
+	// RollupTimeSeries downsamples time series data in the key range which is
+	// old enough to be pruned under the supplied retention into a lower
+	// resolution, so that it is retained after the source data is pruned. It
+	// must be idempotent. Temporary files, if any, are written in the supplied
+	// directory.
+	RollupTimeSeries(
 		context.Context, engine.Reader, roachpb.RKey, roachpb.RKey, *client.DB, hlc.Timestamp,
+		TimeSeriesRetention, string,
+	) error
+	// EstimatePrune returns the summary of the pruning which a call to
+	// PruneTimeSeries for each time series in the key range would perform at
+	// the supplied timestamp with the supplied retention, as determined from
+	// the snapshot, without deleting anything.
+	EstimatePrune(
+		context.Context, engine.Reader, roachpb.RKey, roachpb.RKey, hlc.Timestamp,
+		TimeSeriesRetention,
+	) (TimeSeriesPruneSummary, error)
+	// ListTimeSeriesNames returns the names of the time series with data in
+	// the key range of the supplied snapshot.
+	ListTimeSeriesNames(context.Context, engine.Reader, roachpb.RKey, roachpb.RKey) ([]string, error)
+	// KnownTimeSeriesNames returns the names of the time series of the metrics
+	// registered by the nodes of the cluster, and false if they are not yet
+	// known, as shortly after the node starts.
+	KnownTimeSeriesNames() (map[string]struct{}, bool)
+	// PruneTimeSeries prunes the old data of the named time series in the key
+	// range, in the slices and batches bounded by the options, or deletes all
+	// of it if the series is orphaned under the options. If it fails
+	// part way, the data deleted by the batches which succeeded stays deleted,
+	// and the position from which pruning may resume is recorded in the
+	// summary, if any.
+	PruneTimeSeries(
+		context.Context, engine.Reader, roachpb.RKey, roachpb.RKey, string, *client.DB,
+		hlc.Timestamp, TimeSeriesPruneOptions,
 	) error
+	// PruneTimeSeriesSources deletes all of the data of the supplied sources
+	// from the time series in the key range, regardless of its age, waiting
+	// on the limiter, if non-nil, before each deletion batch.
+	PruneTimeSeriesSources(
+		context.Context, engine.Reader, roachpb.RKey, roachpb.RKey, []string, *client.DB,
+		TimeSeriesDeleteLimiter,
+	) (TimeSeriesSourcePruneSummary, error)
+	// CompactionCutoffs returns the cutoffs below which the compactions of
+	// the store's engine may drop time series data at the supplied timestamp
+	// with the supplied retention. See engine.TimeSeriesCutoff.
+	CompactionCutoffs(hlc.Timestamp, TimeSeriesRetention) []engine.TimeSeriesCutoff
 }
 
 // timeSeriesMaintenanceQueue identifies replicas that contain time series
 // data and performs necessary data maintenance on the time series located in
-// the replica. Currently, maintenance involves pruning time series data older
-// than a certain threshold.
+// the replica. Currently, maintenance involves rolling up time series data
+// older than a certain threshold into a lower resolution, and then pruning it.
 //
 // Logic for time series maintenance is implemented in a higher level time
 // series package; this queue uses the TimeSeriesDataStore interface to call
@@ -71,12 +463,127 @@ type TimeSeriesDataStore interface {
 // for multiple nodes to attempt to prune the same time series concurrently.
 // In this situation, each node would compute the same delete range based on
 // the current timestamp; the first will succeed, all others will become
-// a no-op.
+// a no-op. Similarly, rollups computed from the same source data are identical,
+// so concurrent rollups of the same series write the same values.
 type timeSeriesMaintenanceQueue struct {
 	*baseQueue
 	tsData         TimeSeriesDataStore
 	replicaCountFn func() int
-	db             *client.DB
+	// countTimeSeriesReplicasFn, if set, returns the number of replicas of the
+	// store which contain time series data. See timeSeriesReplicaCount.
+	countTimeSeriesReplicasFn func() int
+	db                        *client.DB
+	// lastProcessed records the time at which each replica was maintained.
+	// It writes through db, the client which issued the replica's deletions,
+	// in a batch of its own, so that the record cannot be applied ahead of
+	// them.
+	lastProcessed *queueLastProcessedRegistry
+	// memMonitor bounds the memory retained by the queued replicas, which is
+	// charged to memAcc, to timeSeriesMaintenanceQueueMemBudget.
+	memMonitor mon.MemoryMonitor
+	memAcc     mon.BoundAccount
+	// newSnapshotFn returns the snapshot of the store's engine which
+	// maintenance of a replica reads from, bounded to the replica's keys.
+	newSnapshotFn func(start, end engine.MVCCKey) engine.Reader
+	// suggestCompactionFn suggests a compaction of a span of the store's
+	// engine after a large prune.
+	suggestCompactionFn func(ctx context.Context, start, end roachpb.Key, bytes int64)
+	// beforeLastProcessedFn, if set, is called once a replica has been pruned
+	// and before its last processed time is recorded. An error returned by it
+	// fails maintenance without recording the time. It is only used in tests,
+	// to simulate a crash between the two.
+	beforeLastProcessedFn func() error
+	// pruneEventFn, if set, is called with the span of the replica and the
+	// timestamp passed to each call to TimeSeriesDataStore.PruneTimeSeries.
+	// It is set by StoreTestingKnobs.TimeSeriesPruneEvent.
+	pruneEventFn func(span roachpb.RSpan, now hlc.Timestamp)
+	// truncatedRequeueDelay is the delay after which a replica whose pruning
+	// was truncated is queued again.
+	truncatedRequeueDelay time.Duration
+	// declinedRequeueDelay is the delay after which a replica whose
+	// maintenance was declined is queued again.
+	declinedRequeueDelay time.Duration
+
+	// capacityFn returns the total and available capacity of the store, as
+	// last recorded in the store's capacity gauges.
+	capacityFn func() (capacity, available int64)
+	// accelerated is 1 while the queue is in low disk mode. Accessed
+	// atomically.
+	accelerated      int32
+	acceleratedGauge *metric.Gauge
+	// deleteRate paces the deletions issued by pruning.
+	deleteRate *deleteRateController
+	// drainingFn and readAmplificationFn return the state of the store which
+	// determines whether maintenance is declined, along with engineHealth. See
+	// declineReason.
+	drainingFn          func() bool
+	readAmplificationFn func() int64
+	engineHealth        *engineHealth
+	declined            *metric.Counter
+	// sourcePrunedKeys and sourcePrunedBytes count the data deleted by
+	// pruneSources.
+	sourcePrunedKeys  *metric.Counter
+	sourcePrunedBytes *metric.Counter
+	// dryRunKeys and dryRunBytes report the data which dry runs estimated
+	// pruning would delete: the sums of the latest estimates of the replicas
+	// held in dryRuns. See estimatePrune.
+	dryRunKeys  *metric.Gauge
+	dryRunBytes *metric.Gauge
+	dryRuns     struct {
+		syncutil.Mutex
+		estimates map[roachpb.RangeID]dryRunEstimate
+	}
+	// sizes holds the sizes of the largest time series of each replica, as
+	// measured by its last maintenance. See Store.TimeSeriesSizeReport.
+	sizes *timeSeriesSizeTracker
+	// progress tracks the progress of the current pass over the store's
+	// replicas. See Store.TimeSeriesMaintenanceProgress.
+	progress *timeSeriesMaintenanceProgressTracker
+
+	// tsReplicas caches the result of countTimeSeriesReplicasFn.
+	tsReplicas struct {
+		syncutil.Mutex
+		count   int
+		counted time.Time
+	}
+
+	// cache holds, by range ID, the results of tsData.ContainsTimeSeries (see
+	// containsTimeSeries) and the time series pruned by the last pass over a
+	// replica which failed to prune others (see pruneAll).
+	cache *queueCache
+}
+
+// containsTimeSeriesResult is the value cached for the result of
+// ContainsTimeSeries. The bounds of the descriptor the result was computed for
+// are stored alongside it, so that a result is not used after the range splits
+// or merges.
+type containsTimeSeriesResult struct {
+	startKey, endKey roachpb.RKey
+	contains         bool
+}
+
+// dryRunEstimate is the data which a dry run estimated pruning a replica
+// would delete.
+type dryRunEstimate struct {
+	keys, bytes int64
+}
+
+// partialPrunePass is the record of a pass over a replica which failed to
+// prune some of its time series. The timestamp is that of the first such pass;
+// the series pruned by it and by any retries are accumulated in pruned.
+type partialPrunePass struct {
+	timestamp hlc.Timestamp
+	pruned    map[string]struct{}
+}
+
+// size returns an estimate of the memory used by the record.
+func (p partialPrunePass) size() int64 {
+	const perNameOverhead = 48
+	var size int64
+	for name := range p.pruned {
+		size += int64(len(name)) + perNameOverhead
+	}
+	return size
 }
 
 // newTimeSeriesMaintenanceQueue returns a new instance of
@@ -88,74 +595,838 @@ func newTimeSeriesMaintenanceQueue(
 		tsData:         tsData,
 		replicaCountFn: store.ReplicaCount,
 		db:             db,
+		newSnapshotFn:  store.Engine().NewSnapshotBounded,
+		capacityFn: func() (int64, int64) {
+			return store.metrics.Capacity.Value(), store.metrics.Available.Value()
+		},
+		acceleratedGauge: store.metrics.TimeSeriesMaintenanceQueueAccelerated,
+		deleteRate: newDeleteRateController(
+			latencyFromHistogram(store.metrics.RaftCommandCommitLatency, deleteRateLatencyQuantile),
+			store.metrics.TimeSeriesMaintenanceQueueDeleteRate,
+		),
+		suggestCompactionFn:   store.SuggestCompaction,
+		drainingFn:            store.IsDraining,
+		truncatedRequeueDelay: timeSeriesMaintenanceTruncatedRequeueDelay,
+		declinedRequeueDelay:  timeSeriesMaintenanceDeclinedRequeueDelay,
+		readAmplificationFn:   store.metrics.RdbReadAmplification.Value,
+		engineHealth:          store.engineHealth,
+		declined:              store.metrics.TimeSeriesMaintenanceQueueDeclined,
+		sourcePrunedKeys:      store.metrics.TimeSeriesMaintenanceQueueSourcePrunedKeys,
+		sourcePrunedBytes:     store.metrics.TimeSeriesMaintenanceQueueSourcePrunedBytes,
+		dryRunKeys:            store.metrics.TimeSeriesMaintenanceQueueDryRunKeys,
+		dryRunBytes:           store.metrics.TimeSeriesMaintenanceQueueDryRunBytes,
+		sizes:                 newTimeSeriesSizeTracker(timeSeriesSizeReportLimit),
+		progress:              newTimeSeriesMaintenanceProgressTracker(store.Clock(), TimeSeriesMaintenanceInterval),
+		cache:                 store.queueCache,
 	}
+	q.countTimeSeriesReplicasFn = func() int {
+		var count int
+		newStoreReplicaVisitor(store).Visit(func(repl *Replica) bool {
+			if q.containsTimeSeries(repl.Desc()) {
+				count++
+			}
+			return true
+		})
+		return count
+	}
+	if fn := store.cfg.TestingKnobs.TimeSeriesDataStoreSnapshotOverride; fn != nil {
+		eng := store.Engine()
+		q.newSnapshotFn = func(_, _ engine.MVCCKey) engine.Reader { return fn(eng) }
+	}
+	q.pruneEventFn = store.cfg.TestingKnobs.TimeSeriesPruneEvent
+	q.memMonitor = mon.MakeMonitor("timeSeriesMaintenanceQueue", nil, nil, 0, math.MaxInt64)
+	q.memMonitor.Start(context.Background(), nil,
+		mon.MakeStandaloneBudget(timeSeriesMaintenanceQueueMemBudget))
+	q.memAcc = q.memMonitor.MakeBoundAccount()
 	q.baseQueue = newBaseQueue(
 		"timeSeriesMaintenance", q, store, g,
 		queueConfig{
 			maxSize:              defaultQueueMaxSize,
 			needsLease:           true,
+			ignoresSystemConfig:  true,
 			acceptsUnsplitRanges: true,
+			processTimeout:       timeSeriesMaintenanceProcessTimeout,
+			failureBackoff:       timeSeriesMaintenanceFailureBackoff,
+			historySize:          defaultQueueHistorySize,
+			shouldQueueBudget:    timeSeriesMaintenanceShouldQueueBudget,
+			concurrencySetting:   timeSeriesMaintenanceConcurrency,
+			enabledSetting:       timeSeriesMaintenanceEnabled,
 			successes:            store.metrics.TimeSeriesMaintenanceQueueSuccesses,
 			failures:             store.metrics.TimeSeriesMaintenanceQueueFailures,
-			pending:              store.metrics.TimeSeriesMaintenanceQueuePending,
-			processingNanos:      store.metrics.TimeSeriesMaintenanceQueueProcessingNanos,
+			failuresByClass: map[queueFailureClass]*metric.Counter{
+				queueFailureLease:           store.metrics.TimeSeriesMaintenanceQueueFailuresLease,
+				queueFailureContextCanceled: store.metrics.TimeSeriesMaintenanceQueueFailuresContextCanceled,
+				queueFailureKV:              store.metrics.TimeSeriesMaintenanceQueueFailuresKV,
+				queueFailureOther:           store.metrics.TimeSeriesMaintenanceQueueFailuresOther,
+			},
+			pending:                  store.metrics.TimeSeriesMaintenanceQueuePending,
+			pendingHighWater:         store.metrics.TimeSeriesMaintenanceQueuePendingHighWater,
+			sizeDropped:              store.metrics.TimeSeriesMaintenanceQueueSizeDropped,
+			processingNanos:          store.metrics.TimeSeriesMaintenanceQueueProcessingNanos,
+			processingLatency:        store.metrics.TimeSeriesMaintenanceQueueProcessingLatency,
+			processingFailureLatency: store.metrics.TimeSeriesMaintenanceQueueProcessingFailureLatency,
+			timeouts:                 store.metrics.TimeSeriesMaintenanceQueueProcessTimeouts,
+			waitLatency:              store.metrics.TimeSeriesMaintenanceQueueWaitLatency,
+			backedOff:                store.metrics.TimeSeriesMaintenanceQueueBackedOff,
+			shouldQueueNanos:         store.metrics.TimeSeriesMaintenanceQueueShouldQueueNanos,
+			shouldQueueDeferrals:     store.metrics.TimeSeriesMaintenanceQueueShouldQueueDeferrals,
+			memAcc:                   &q.memAcc,
+			memBytes:                 store.metrics.TimeSeriesMaintenanceQueueMemBytes,
+			memDropped:               store.metrics.TimeSeriesMaintenanceQueueMemDropped,
 		},
 	)
+	q.lastProcessed = newQueueLastProcessedRegistry(store, q.name, db)
 
 	return q
 }
 
+// containsTimeSeries returns whether the range described by desc contains time
+// series data. The result of TimeSeriesDataStore.ContainsTimeSeries is cached
+// per range, and is recomputed if the range's bounds have changed or the
+// result was evicted.
+func (q *timeSeriesMaintenanceQueue) containsTimeSeries(desc *roachpb.RangeDescriptor) bool {
+	if v, ok := q.cache.get(timeSeriesContainsCacheName, desc.RangeID); ok {
+		result := v.(containsTimeSeriesResult)
+		if result.startKey.Equal(desc.StartKey) && result.endKey.Equal(desc.EndKey) {
+			return result.contains
+		}
+	}
+
+	contains := q.tsData.ContainsTimeSeries(desc.StartKey, desc.EndKey)
+	q.cache.add(timeSeriesContainsCacheName, desc.RangeID, containsTimeSeriesResult{
+		startKey: desc.StartKey,
+		endKey:   desc.EndKey,
+		contains: contains,
+	}, int64(len(desc.StartKey)+len(desc.EndKey)))
+	return contains
+}
+
+// isLowDisk returns true if available capacity is below the supplied fraction
+// of total capacity. Unknown (zero) capacity is never considered low.
+func isLowDisk(capacity, available int64, fraction float64) bool {
+	if fraction <= 0 || capacity <= 0 {
+		return false
+	}
+	return float64(available) < fraction*float64(capacity)
+}
+
+// isAccelerated returns whether the queue is currently in low disk mode,
+// re-evaluating the store's capacity gauges. Transitions between modes are
+// logged and reflected in the accelerated gauge.
+func (q *timeSeriesMaintenanceQueue) isAccelerated(ctx context.Context) bool {
+	capacity, available := q.capacityFn()
+	accelerated := isLowDisk(capacity, available, timeSeriesMaintenanceLowDiskFraction.Get())
+	var newVal int32
+	if accelerated {
+		newVal = 1
+	}
+	if old := atomic.SwapInt32(&q.accelerated, newVal); old != newVal {
+		q.acceleratedGauge.Update(int64(newVal))
+		if accelerated {
+			log.Infof(ctx, "available capacity %d of %d is low; accelerating time series maintenance",
+				available, capacity)
+		} else {
+			log.Infof(ctx, "available capacity %d of %d has recovered; resuming normal time series maintenance",
+				available, capacity)
+		}
+	}
+	return accelerated
+}
+
+// declineReason returns the reason for which the queue should currently
+// decline to maintain replicas, or the empty string if it should not. Large
+// deletions would compete with a draining store shedding its leases, and with
+// the foreground traffic of an overloaded store.
+func (q *timeSeriesMaintenanceQueue) declineReason() string {
+	if q.drainingFn() {
+		return "store is draining"
+	}
+	if max := timeSeriesMaintenanceMaxReadAmplification.Get(); max > 0 {
+		if readAmp := q.readAmplificationFn(); readAmp > max {
+			return fmt.Sprintf("read amplification %d exceeds %d", readAmp, max)
+		}
+	}
+	return q.engineHealth.unhealthyReason()
+}
+
 func (q *timeSeriesMaintenanceQueue) shouldQueue(
 	ctx context.Context, now hlc.Timestamp, repl *Replica, _ config.SystemConfig,
 ) (shouldQ bool, priority float64) {
+	if q.declineReason() != "" {
+		return false, 0
+	}
 	if !repl.store.cfg.TestingKnobs.DisableLastProcessedCheck {
-		lpTS, err := repl.getQueueLastProcessed(ctx, q.name)
-		if err != nil {
-			log.ErrEventf(ctx, "time series maintenance queue last processed timestamp: %s", err)
-		}
-		shouldQ, priority = shouldQueueAgain(now, lpTS, TimeSeriesMaintenanceInterval)
+		shouldQ, priority = q.lastProcessed.ShouldProcessAgain(ctx, repl.Desc(), now,
+			TimeSeriesMaintenanceInterval, timeSeriesMaintenanceIntervalJitter)
 		if !shouldQ {
 			return
 		}
+		if q.recentlyPrunedElsewhere(ctx, repl.Desc(), now) {
+			return false, 0
+		}
 	}
 	desc := repl.Desc()
-	if q.tsData.ContainsTimeSeries(desc.StartKey, desc.EndKey) {
-		return
+	if q.containsTimeSeries(desc) {
+		// Replicas with more data to prune are processed first.
+		prunableBytes, err := q.tsData.EstimatePrunableBytes(
+			ctx, repl.store.Engine(), desc.StartKey, desc.EndKey, now, timeSeriesRetention(),
+		)
+		if err != nil {
+			log.ErrEventf(ctx, "estimating prunable time series bytes: %s", err)
+		}
+		priority += float64(prunableBytes) / timeSeriesMaintenancePrunableBytesPriorityScale
+		if q.isAccelerated(ctx) {
+			priority += timeSeriesMaintenanceAcceleratedPriorityBoost
+		}
+		return true, priority
 	}
 	return false, 0
 }
 
 func (q *timeSeriesMaintenanceQueue) process(
 	ctx context.Context, repl *Replica, sysCfg config.SystemConfig,
+) error {
+	// Conditions may have changed since the replica was queued. A declined
+	// replica is neither failed nor counted as processed, and its last
+	// processed time is left untouched; it is requeued to be maintained once
+	// conditions improve.
+	if reason := q.declineReason(); reason != "" {
+		log.VEventf(ctx, 2, "declining time series maintenance: %s; requeuing in %s",
+			reason, q.declinedRequeueDelay)
+		q.declined.Inc(1)
+		q.requeueAfter(ctx, repl, q.declinedRequeueDelay, 0)
+		return &processDeferredError{reason: "time series maintenance declined: " + reason}
+	}
+	// Pruning issues deletions of large swathes of data, so it takes a
+	// background maintenance slot for each replica maintained at once.
+	release, err := q.acquireMaintenanceSlots(ctx, repl, sysCfg, 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if timeSeriesMaintenanceDryRun.Get() {
+		return q.estimatePrune(ctx, repl)
+	}
+	start := timeutil.Now()
+	var summary TimeSeriesPruneSummary
+	if err := q.maintain(ctx, repl, &summary); err != nil {
+		return err
+	}
+	if !summary.Truncated {
+		q.progress.recordProcessed(repl.RangeID, timeutil.Since(start))
+	}
+	q.recordDryRun(repl.RangeID, nil)
+	if summary.Truncated {
+		// Without a cheap estimate of the data left to prune, the data just
+		// pruned stands in for it in the priority.
+		priority := float64(summary.BytesDeleted) / timeSeriesMaintenancePrunableBytesPriorityScale
+		q.requeueAfter(ctx, repl, q.truncatedRequeueDelay, priority)
+	}
+	// Deleted data is only reclaimed once compactions happen to touch it, so
+	// suggest a compaction after a large prune.
+	if threshold := timeSeriesMaintenanceCompactionThreshold.Get(); threshold > 0 &&
+		summary.KeysDeleted > threshold {
+		desc := repl.Desc()
+		if span, ok := timeSeriesSpan(desc.StartKey, desc.EndKey); ok {
+			log.VEventf(ctx, 2, "pruned %d keys; suggesting compaction of %s", summary.KeysDeleted, span)
+			q.suggestCompactionFn(ctx, span.Key, span.EndKey, summary.BytesDeleted)
+		}
+	}
+	return nil
+}
+
+// estimatePrune estimates the time series data which pruning the replica
+// would delete, and logs and records it. Nothing is written: the data is
+// neither rolled up nor pruned, and the last processed time is left untouched,
+// so that the replica is maintained as usual once dry runs are disabled.
+func (q *timeSeriesMaintenanceQueue) estimatePrune(ctx context.Context, repl *Replica) error {
+	desc := repl.Desc()
+	now := repl.store.Clock().Now()
+	snap := q.newSnapshotFn(
+		engine.MakeMVCCMetadataKey(desc.StartKey.AsRawKey()),
+		engine.MakeMVCCMetadataKey(desc.EndKey.AsRawKey()),
+	)
+	defer snap.Close()
+	summary, err := q.tsData.EstimatePrune(
+		ctx, snap, desc.StartKey, desc.EndKey, now, timeSeriesRetention(),
+	)
+	if err != nil {
+		return err
+	}
+	q.recordDryRun(repl.RangeID, &dryRunEstimate{keys: summary.KeysDeleted, bytes: summary.BytesDeleted})
+	if summary.KeysDeleted > 0 {
+		log.Infof(ctx, "dry run: pruning would delete %d keys (%d bytes) of %d time series",
+			summary.KeysDeleted, summary.BytesDeleted, summary.SeriesPruned)
+	}
+	return nil
+}
+
+// recordDryRun replaces the estimate of the replica's dry runs with the
+// supplied one, or discards it if nil, and updates the dry run gauges. As a
+// replica which is only estimated is never marked processed, it is estimated
+// anew each time the scanner visits it, and its earlier estimates must not
+// be counted again.
+func (q *timeSeriesMaintenanceQueue) recordDryRun(rangeID roachpb.RangeID, e *dryRunEstimate) {
+	q.dryRuns.Lock()
+	defer q.dryRuns.Unlock()
+	if e == nil {
+		if _, ok := q.dryRuns.estimates[rangeID]; !ok {
+			return
+		}
+		delete(q.dryRuns.estimates, rangeID)
+	} else {
+		if q.dryRuns.estimates == nil {
+			q.dryRuns.estimates = make(map[roachpb.RangeID]dryRunEstimate)
+		}
+		q.dryRuns.estimates[rangeID] = *e
+	}
+	var total dryRunEstimate
+	for _, e := range q.dryRuns.estimates {
+		total.keys += e.keys
+		total.bytes += e.bytes
+	}
+	q.dryRunKeys.Update(total.keys)
+	q.dryRunBytes.Update(total.bytes)
+}
+
+// maintain rolls up and prunes the time series data of the replica, and
+// records the time at which it did so. If summary is non-nil, it is populated
+// with a summary of the pruning. If the pruning is truncated, the time is not
+// recorded, as the replica still holds data to prune. If the pruning is
+// truncated or fails part way, the position from which it may resume is
+// persisted, and the next attempt resumes the pass from there rather than from
+// the start of the replica, even after a restart (see loadResume). The sizes of
+// the data which pruning leaves in the replica's time series are recorded for
+// the store's TimeSeriesSizeReport.
+func (q *timeSeriesMaintenanceQueue) maintain(
+	ctx context.Context, repl *Replica, summary *TimeSeriesPruneSummary,
 ) error {
 	desc := repl.Desc()
-	snap := repl.store.Engine().NewSnapshot()
 	now := repl.store.Clock().Now()
+	// The retention is read once, so that the rollup and the pruning of every
+	// series agree on it even if the settings change mid-pass.
+	retention := timeSeriesRetention()
+	// Avoid the cost of a snapshot if the replica has no data to maintain.
+	if !q.tsData.MayNeedMaintenance(desc.StartKey, desc.EndKey, repl.GetMVCCStats()) {
+		log.VEventf(ctx, 2, "skipping replica without time series data")
+		q.sizes.record(desc, now, nil, true /* complete */)
+		if err := q.lastProcessed.Set(ctx, desc, now); err != nil {
+			log.ErrEventf(ctx, "failed to update last processed time: %v", err)
+		}
+		return nil
+	}
+	// An interrupted pass is resumed at its own timestamp, from its resume
+	// key onwards.
+	start := desc.StartKey
+	resume, resumeFound := q.loadResume(ctx, desc, now)
+	if resume != nil {
+		log.VEventf(ctx, 2, "resuming the pass at %s from %s", resume.Now, resume.ResumeKey)
+		start, now = resume.ResumeKey, resume.Now
+	}
+	// The snapshot is bounded to the replica's keys, so that a read of
+	// another replica's data fails rather than silently observing it.
+	snap := q.newSnapshotFn(
+		engine.MakeMVCCMetadataKey(desc.StartKey.AsRawKey()),
+		engine.MakeMVCCMetadataKey(desc.EndKey.AsRawKey()),
+	)
 	defer snap.Close()
-	if err := q.tsData.PruneTimeSeries(ctx, snap, desc.StartKey, desc.EndKey, q.db, now); err != nil {
+	// Rollups must be materialized before the source data is pruned. If the
+	// rollup fails, the replica is left unpruned so it is retried.
+	if err := q.tsData.RollupTimeSeries(
+		ctx, snap, start, desc.EndKey, q.db, now, retention, repl.GetTempPrefix(),
+	); err != nil {
 		return err
 	}
-	// Update the last processed time for this queue.
-	if err := repl.setQueueLastProcessed(ctx, q.name, now); err != nil {
+	// The sizes are measured by the pruning of each series. A pass which
+	// resumes an interrupted one, or retries one which failed to prune some
+	// series, doesn't reach every series, so the sizes last measured for
+	// the others are kept.
+	pass := q.takePartialPass(desc.RangeID, now)
+	retried := len(pass.pruned) > 0
+	sizes := make(map[string]TimeSeriesSize)
+	truncated, resumeKey, err := q.pruneAll(
+		ctx, snap, desc, start, now, retention, pass, summary, sizes,
+	)
+	if resumeKey != nil {
+		// The context may be done, as when the store is draining, but the
+		// position must still be recorded.
+		saveCtx, cancel := context.WithTimeout(
+			repl.AnnotateCtx(q.AnnotateCtx(context.Background())), timeSeriesResumeSaveTimeout)
+		defer cancel()
+		if err := q.saveResume(saveCtx, desc, resumeKey, now); err != nil {
+			log.ErrEventf(ctx, "failed to record resume key: %v", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// The sizes are those of the descriptor which was pruned, so they aren't
+	// recorded if the range has since split or merged.
+	if !rangeBoundsChanged(desc, repl.Desc()) {
+		q.sizes.record(desc, now, sizes, resume == nil && !retried && !truncated)
+	}
+	if truncated {
+		log.VEventf(ctx, 2, "pruning truncated at %s; not updating last processed time", resumeKey)
+		if summary != nil {
+			summary.Truncated = true
+		}
+		return nil
+	}
+	if fn := q.beforeLastProcessedFn; fn != nil {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	// The resume record is cleared before the last processed time is written,
+	// so that a stale record cannot outlive the pass.
+	if resumeFound {
+		if err := q.clearResume(ctx, desc); err != nil {
+			log.ErrEventf(ctx, "failed to clear resume record: %v", err)
+		}
+	}
+	// The range may have split or merged while it was pruned, in which case
+	// the time must not be recorded for the descriptor which was pruned.
+	if cur := repl.Desc(); rangeBoundsChanged(desc, cur) {
+		q.finishChangedDescriptor(ctx, repl, desc, cur, now)
+		return nil
+	}
+	// Update the last processed time for this queue. It claims that the data
+	// older than the pruning thresholds at now is gone, so it is only written
+	// once pruneAll has returned, by which point the response to every
+	// deletion has been received. Should the node crash before it is written,
+	// the next pass prunes the replica again, which is harmless as deletions
+	// are idempotent.
+	if err := q.lastProcessed.Set(ctx, desc, now); err != nil {
 		log.ErrEventf(ctx, "failed to update last processed time: %v", err)
 	}
+	q.gossipPruned(ctx, desc, now)
 	return nil
 }
 
+// rangeBoundsChanged returns whether the bounds of the current descriptor of a
+// replica, cur, differ from those of the descriptor which was pruned.
+func rangeBoundsChanged(pruned, cur *roachpb.RangeDescriptor) bool {
+	return !cur.StartKey.Equal(pruned.StartKey) || !cur.EndKey.Equal(pruned.EndKey)
+}
+
+// finishChangedDescriptor records the maintenance of a replica whose range
+// split or merged while it was pruned, changing its descriptor from pruned to
+// cur. The last processed time claims that the range's data was pruned, so it
+// is only recorded if cur lies within the pruned span, as after a split. A
+// range which grew, as by a merge, is requeued instead, to prune the data it
+// gained. The replicas of the store which took over the rest of the pruned
+// span, such as the right-hand side of a split, have no last processed time of
+// their own, so they are offered to the queue rather than left to the scanner.
+func (q *timeSeriesMaintenanceQueue) finishChangedDescriptor(
+	ctx context.Context, repl *Replica, pruned, cur *roachpb.RangeDescriptor, now hlc.Timestamp,
+) {
+	log.VEventf(ctx, 2, "range changed from %s to %s while it was maintained", pruned, cur)
+	if !cur.StartKey.Less(pruned.StartKey) && !pruned.EndKey.Less(cur.EndKey) {
+		if err := q.lastProcessed.Set(ctx, cur, now); err != nil {
+			log.ErrEventf(ctx, "failed to update last processed time: %v", err)
+		}
+		q.gossipPruned(ctx, cur, now)
+	} else {
+		q.requeueAfter(ctx, repl, q.truncatedRequeueDelay, 0)
+	}
+	q.hintReplicas(repl.store, pruned.StartKey, cur.StartKey, now)
+	q.hintReplicas(repl.store, cur.EndKey, pruned.EndKey, now)
+}
+
+// hintReplicas offers the store's replicas holding the keys in [start, end),
+// if any, to the queue.
+func (q *timeSeriesMaintenanceQueue) hintReplicas(
+	store *Store, start, end roachpb.RKey, now hlc.Timestamp,
+) {
+	for key := start; key.Less(end); {
+		sibling := store.LookupReplica(key, nil)
+		if sibling == nil {
+			return
+		}
+		q.MaybeAdd(sibling, now)
+		key = sibling.Desc().EndKey
+	}
+}
+
+// gossipPruned advertises that the time series data of the replica was pruned
+// at now. See recentlyPrunedElsewhere.
+func (q *timeSeriesMaintenanceQueue) gossipPruned(
+	ctx context.Context, desc *roachpb.RangeDescriptor, now hlc.Timestamp,
+) {
+	freshness := timeSeriesMaintenancePrunedFreshness.Get()
+	span, ok := timeSeriesSpan(desc.StartKey, desc.EndKey)
+	if freshness == 0 || !ok {
+		return
+	}
+	if err := q.gossip.AddInfoProto(gossip.MakeTimeSeriesPrunedKey(span), &now, freshness); err != nil {
+		log.ErrEventf(ctx, "failed to gossip time series maintenance: %s", err)
+	}
+}
+
+// recentlyPrunedElsewhere returns whether gossip shows the time series data of
+// the replica to have been pruned within timeseries.maintenance.pruned_freshness
+// of now, typically by the former leaseholder of the range on another store,
+// in which case maintaining it again would be wasted work. Gossip about the
+// maintenance of a span other than the replica's, such as before a split, is
+// disregarded, as is stale or missing gossip.
+func (q *timeSeriesMaintenanceQueue) recentlyPrunedElsewhere(
+	ctx context.Context, desc *roachpb.RangeDescriptor, now hlc.Timestamp,
+) bool {
+	freshness := timeSeriesMaintenancePrunedFreshness.Get()
+	span, ok := timeSeriesSpan(desc.StartKey, desc.EndKey)
+	if freshness == 0 || !ok {
+		return false
+	}
+	var pruned hlc.Timestamp
+	if err := q.gossip.GetInfoProto(gossip.MakeTimeSeriesPrunedKey(span), &pruned); err != nil {
+		return false
+	}
+	if now.GoTime().Sub(pruned.GoTime()) >= freshness {
+		return false
+	}
+	log.VEventf(ctx, 2, "time series maintenance advertised in gossip at %s; not queueing", pruned)
+	return true
+}
+
+// pruneAll prunes each time series in the replica's key range separately, and
+// with its own timeout. A failure to prune one series does not prevent the
+// others from being pruned; the failures are aggregated into the returned
+// error. Once timeSeriesMaintenancePassBytes have been pruned, the remaining
+// series are left to a later pass, and true is returned with the key after
+// the last series pruned, from which the pass resumes. The series which were
+// pruned are remembered in the partial pass, so that they are skipped when
+// the replica is retried, unless the record of them is evicted from the cache
+// in the meantime. The size of the data which pruning left in each series is
+// recorded in sizes.
+//
+// Only the series from the start key onwards are pruned, which is the start
+// of the replica unless an interrupted pass is resumed. If pruning fails, the
+// key from which the first failed series may resume is returned with the
+// error, if the series reported one; every series before it was pruned.
+func (q *timeSeriesMaintenanceQueue) pruneAll(
+	ctx context.Context,
+	snap engine.Reader,
+	desc *roachpb.RangeDescriptor,
+	start roachpb.RKey,
+	now hlc.Timestamp,
+	retention TimeSeriesRetention,
+	pass partialPrunePass,
+	summary *TimeSeriesPruneSummary,
+	sizes map[string]TimeSeriesSize,
+) (truncated bool, resumeKey roachpb.RKey, _ error) {
+	names, err := q.tsData.ListTimeSeriesNames(ctx, snap, start, desc.EndKey)
+	if err != nil {
+		return false, nil, err
+	}
+	limiter := q.deleteRate.startPass(q.isAccelerated(ctx))
+	defer q.deleteRate.endPass()
+	budget := timeSeriesMaintenancePassBytes.Get()
+	// The known names are read once, so that every series of the replica is
+	// matched against the same names.
+	var knownNames map[string]struct{}
+	orphanGracePeriod := timeSeriesOrphanGracePeriod.Get()
+	if orphanGracePeriod > 0 {
+		var ok bool
+		if knownNames, ok = q.tsData.KnownTimeSeriesNames(); !ok {
+			log.VEventf(ctx, 2, "time series names not yet known; not pruning orphaned series")
+			orphanGracePeriod = 0
+		}
+	}
+	var prunedBytes int64
+	var prunedEnd roachpb.RKey
+	var failed []string
+	var firstErr error
+	for _, name := range names {
+		if _, ok := pass.pruned[name]; ok {
+			continue
+		}
+		if budget > 0 && prunedBytes >= budget {
+			truncated = true
+			break
+		}
+		var seriesSummary TimeSeriesPruneSummary
+		opts := TimeSeriesPruneOptions{
+			DeleteLimiter:    limiter,
+			MaxSliceDuration: timeSeriesMaintenancePruneSliceDuration.Get(),
+			MaxKeysPerBatch:  timeSeriesMaintenancePruneBatchKeys.Get(),
+			Retention:        retention,
+
+			UseRangeTombstones: timeSeriesMaintenanceRangeTombstones.Get(),
+		}
+		if orphanGracePeriod > 0 {
+			opts.OrphanGracePeriod = orphanGracePeriod
+			opts.KnownNames = knownNames
+		}
+		// The summary is always requested, as it reports the key from which
+		// a failed series may resume.
+		opts.Summary = &seriesSummary
+		if err := q.pruneSeries(ctx, snap, desc, start, name, now, opts); err != nil {
+			if firstErr == nil {
+				firstErr = err
+				resumeKey = roachpb.RKey(seriesSummary.ResumeKey)
+			}
+			if ctx.Err() != nil {
+				// The queue is stopping or processing timed out; there is
+				// no point in attempting the remaining series.
+				return false, resumeKey, err
+			}
+			log.VEventf(ctx, 2, "failed to prune time series %s: %s", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		pass.pruned[name] = struct{}{}
+		prunedBytes += seriesSummary.BytesDeleted
+		prunedEnd = roachpb.RKey(seriesSummary.ResumeKey)
+		if summary != nil {
+			summary.add(seriesSummary)
+		}
+		sizes[name] = seriesSummary.Retained
+	}
+	if len(failed) > 0 || truncated {
+		q.cache.add(timeSeriesPartialPassCacheName, desc.RangeID, pass, pass.size())
+	}
+	if len(failed) > 0 {
+		return false, resumeKey, errors.Wrapf(firstErr, "failed to prune %d of %d time series (%s)",
+			len(failed), len(names), strings.Join(failed, ", "))
+	}
+	if truncated {
+		return true, prunedEnd, nil
+	}
+	return false, nil, nil
+}
+
+// pruneSeries prunes a single time series of the replica from the start key
+// onwards, subject to timeSeriesMaintenanceSeriesTimeout.
+func (q *timeSeriesMaintenanceQueue) pruneSeries(
+	ctx context.Context,
+	snap engine.Reader,
+	desc *roachpb.RangeDescriptor,
+	start roachpb.RKey,
+	name string,
+	now hlc.Timestamp,
+	opts TimeSeriesPruneOptions,
+) error {
+	if timeout := timeSeriesMaintenanceSeriesTimeout.Get(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if fn := q.pruneEventFn; fn != nil {
+		fn(roachpb.RSpan{Key: desc.StartKey, EndKey: desc.EndKey}, now)
+	}
+	return q.tsData.PruneTimeSeries(ctx, snap, start, desc.EndKey, name, q.db, now, opts)
+}
+
+// takePartialPass removes and returns the record of the last pass over the
+// range, if that pass failed to prune some time series and happened recently
+// enough that the series it did prune need not be pruned again. Otherwise, a
+// new record is returned.
+func (q *timeSeriesMaintenanceQueue) takePartialPass(
+	rangeID roachpb.RangeID, now hlc.Timestamp,
+) partialPrunePass {
+	if v, ok := q.cache.get(timeSeriesPartialPassCacheName, rangeID); ok {
+		q.cache.del(timeSeriesPartialPassCacheName, rangeID)
+		pass := v.(partialPrunePass)
+		if shouldQ, _ := shouldQueueAgain(now, pass.timestamp, TimeSeriesMaintenanceInterval); !shouldQ {
+			return pass
+		}
+	}
+	return partialPrunePass{timestamp: now, pruned: make(map[string]struct{})}
+}
+
+// TimeSeriesMaintenanceResult describes a manually triggered run of time
+// series maintenance on a replica.
+type TimeSeriesMaintenanceResult struct {
+	RangeID roachpb.RangeID        `json:"range_id"`
+	Prune   TimeSeriesPruneSummary `json:"prune"`
+	// DiskBytesBefore and DiskBytesAfter are the approximate on-disk sizes of
+	// the time series data in the replica's key range before maintenance and
+	// after it, including any compaction.
+	DiskBytesBefore uint64 `json:"disk_bytes_before"`
+	DiskBytesAfter  uint64 `json:"disk_bytes_after"`
+	// Duration is the time taken by maintenance, including any compaction.
+	Duration time.Duration `json:"duration"`
+	// Compacted is true if the time series data in the replica's key range was
+	// compacted after pruning, reclaiming the space of the deleted data.
+	Compacted bool `json:"compacted"`
+}
+
+// timeSeriesSpan returns the intersection of the supplied key range with the
+// time series keyspace, and false if it is empty.
+func timeSeriesSpan(start, end roachpb.RKey) (roachpb.Span, bool) {
+	span := roachpb.Span{Key: keys.TimeseriesPrefix, EndKey: keys.TimeseriesPrefix.PrefixEnd()}
+	if k := start.AsRawKey(); span.Key.Compare(k) < 0 {
+		span.Key = k
+	}
+	if k := end.AsRawKey(); k.Compare(span.EndKey) < 0 {
+		span.EndKey = k
+	}
+	return span, span.Key.Compare(span.EndKey) < 0
+}
+
+// forceMaintenance runs time series maintenance on the replica immediately,
+// regardless of when it was last processed. Unlike process, it measures the
+// on-disk size of the replica's time series data before and after, and
+// compacts the data if any was pruned so that the measurement reflects the
+// reclaimed space. As the flush, pruning and compaction are IO-intensive, a
+// forced run holds a background maintenance slot of the store throughout, as
+// the queue's processing does, so that concurrent forced runs don't all hit
+// the disk at once; it fails with errMaintenanceSlotsUnavailable if none
+// becomes available in time.
+func (q *timeSeriesMaintenanceQueue) forceMaintenance(
+	ctx context.Context, repl *Replica,
+) (TimeSeriesMaintenanceResult, error) {
+	result := TimeSeriesMaintenanceResult{RangeID: repl.RangeID}
+	if _, pErr := repl.redirectOnOrAcquireLease(ctx); pErr != nil {
+		return result, errors.Wrapf(pErr.GoError(), "%s: could not obtain lease", repl)
+	}
+	// Don't race with the processing of the replica by the queue.
+	if err := q.acquireProcessing(ctx, repl.RangeID); err != nil {
+		return result, err
+	}
+	defer q.releaseProcessing(repl.RangeID)
+	release, err := repl.store.maintenanceSlots.acquire(ctx, 1, maintenanceSlotTimeout.Get())
+	if err != nil {
+		return result, err
+	}
+	defer release()
+
+	eng := repl.store.Engine()
+	desc := repl.Desc()
+	finish := repl.store.StartBackgroundOperation(ctx, BackgroundOperation{
+		Purpose: BackgroundOperationForcedTimeSeriesMaintenance,
+		Owner:   q.name,
+		Span:    roachpb.Span{Key: desc.StartKey.AsRawKey(), EndKey: desc.EndKey.AsRawKey()},
+	}, nil /* progress */)
+	defer finish()
+	span, ok := timeSeriesSpan(desc.StartKey, desc.EndKey)
+	measure := func() (uint64, error) {
+		if !ok {
+			return 0, nil
+		}
+		return eng.ApproximateDiskBytes(span.Key, span.EndKey)
+	}
+
+	start := timeutil.Now()
+	// Flush so that the measurement is not skewed by data in the mem-tables,
+	// whose size is only roughly estimated.
+	if err := eng.Flush(); err != nil {
+		return result, err
+	}
+	if result.DiskBytesBefore, err = measure(); err != nil {
+		return result, err
+	}
+	if err := q.maintain(ctx, repl, &result.Prune); err != nil {
+		return result, err
+	}
+	if ok && result.Prune.SeriesPruned > 0 {
+		if err := eng.CompactRange(span.Key, span.EndKey, false /* forceBottommost */); err != nil {
+			return result, err
+		}
+		result.Compacted = true
+	}
+	if result.DiskBytesAfter, err = measure(); err != nil {
+		return result, err
+	}
+	result.Duration = timeutil.Since(start)
+	return result, nil
+}
+
+// pruneSources deletes all of the time series data of the supplied sources
+// from the replica, regardless of its age. Unlike maintain, it doesn't record
+// a last processed time, as the replica's other data is left as it is. Each
+// source whose data is deleted is recorded in the log, so that the deletion
+// of data which is never pruned otherwise can be audited.
+func (q *timeSeriesMaintenanceQueue) pruneSources(
+	ctx context.Context, repl *Replica, sources []string,
+) (TimeSeriesSourcePruneSummary, error) {
+	if _, pErr := repl.redirectOnOrAcquireLease(ctx); pErr != nil {
+		return TimeSeriesSourcePruneSummary{}, errors.Wrapf(pErr.GoError(), "%s: could not obtain lease", repl)
+	}
+	// Don't race with the processing of the replica by the queue.
+	if err := q.acquireProcessing(ctx, repl.RangeID); err != nil {
+		return TimeSeriesSourcePruneSummary{}, err
+	}
+	defer q.releaseProcessing(repl.RangeID)
+
+	desc := repl.Desc()
+	finish := repl.store.StartBackgroundOperation(ctx, BackgroundOperation{
+		Purpose: BackgroundOperationTimeSeriesSourcePrune,
+		Owner:   q.name,
+		Span:    roachpb.Span{Key: desc.StartKey.AsRawKey(), EndKey: desc.EndKey.AsRawKey()},
+	}, nil /* progress */)
+	defer finish()
+	snap := q.newSnapshotFn(
+		engine.MakeMVCCMetadataKey(desc.StartKey.AsRawKey()),
+		engine.MakeMVCCMetadataKey(desc.EndKey.AsRawKey()),
+	)
+	defer snap.Close()
+	limiter := q.deleteRate.startPass(q.isAccelerated(ctx))
+	defer q.deleteRate.endPass()
+	summary, err := q.tsData.PruneTimeSeriesSources(
+		ctx, snap, desc.StartKey, desc.EndKey, sources, q.db, limiter,
+	)
+	// Some of the data may have been deleted before an error.
+	q.sourcePrunedKeys.Inc(summary.KeysDeleted)
+	q.sourcePrunedBytes.Inc(summary.BytesDeleted)
+	for _, source := range sources {
+		if n := summary.KeysDeletedBySource[source]; n > 0 {
+			log.Infof(ctx, "deleted %d time series keys of source %q", n, source)
+		}
+	}
+	return summary, err
+}
+
 func (q *timeSeriesMaintenanceQueue) timer(duration time.Duration) time.Duration {
-	// An interval between replicas to space consistency checks out over
-	// the check interval.
-	replicaCount := q.replicaCountFn()
-	if replicaCount == 0 {
+	// While the store is low on disk, don't pace processing at all; pruning
+	// is one of the few automatic levers for reclaiming space.
+	if q.isAccelerated(q.AnnotateCtx(context.TODO())) {
+		return 0
+	}
+	// Only the replicas containing time series data are processed, so it is
+	// their number which the interval is spread over.
+	replicaCount, ok := q.timeSeriesReplicaCount()
+	if !ok {
+		replicaCount = q.replicaCountFn()
+	}
+	return timeSeriesMaintenancePause(TimeSeriesMaintenanceInterval, replicaCount, duration)
+}
+
+// timeSeriesMaintenancePause returns the pause after the processing of a
+// replica, which took the supplied duration, which spaces the processing of
+// the supplied number of replicas out over the interval. There is no pause if
+// there are no replicas, or if processing took longer than the share of the
+// interval of each replica.
+func timeSeriesMaintenancePause(
+	interval time.Duration, replicaCount int, duration time.Duration,
+) time.Duration {
+	if replicaCount <= 0 {
 		return 0
 	}
-	replInterval := TimeSeriesMaintenanceInterval / time.Duration(replicaCount)
+	replInterval := interval / time.Duration(replicaCount)
 	if replInterval < duration {
 		return 0
 	}
 	return replInterval - duration
 }
 
+// timeSeriesReplicaCount returns the number of replicas of the store which
+// contain time series data, recounting them if they were last counted more
+// than timeSeriesMaintenanceRecountInterval ago. It returns false if the
+// number is unknown.
+func (q *timeSeriesMaintenanceQueue) timeSeriesReplicaCount() (int, bool) {
+	if q.countTimeSeriesReplicasFn == nil {
+		return 0, false
+	}
+	q.tsReplicas.Lock()
+	defer q.tsReplicas.Unlock()
+	if now := timeutil.Now(); now.Sub(q.tsReplicas.counted) >= timeSeriesMaintenanceRecountInterval {
+		q.tsReplicas.count = q.countTimeSeriesReplicasFn()
+		q.tsReplicas.counted = now
+	}
+	return q.tsReplicas.count, true
+}
+
 func (*timeSeriesMaintenanceQueue) purgatoryChan() <-chan struct{} {
 	return nil
 }
@@ -0,0 +1,1453 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/config"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+// fakeTimeSeriesDataStore is a TimeSeriesDataStore which considers every range
+// to contain time series data, and returns canned prunable byte estimates
+// keyed by range start key. It records the maintenance operations invoked on
+// it in order, and counts calls to ContainsTimeSeries. Its maintenance
+// preflight declines ranges with empty stats if skipEmpty is set. Every range
+// contains the time series in names, or a single series if names is empty.
+// Pruning a series fails with its error in pruneErrs, blocks until canceled if
+// it is the hang series, and otherwise deletes deleteSpan, if set, through
+// the supplied client and reports keysDeleted deleted keys. The data of each
+// series in names lies under the time series prefix followed by its name, and
+// only the series from the start key onwards are listed; a pruned series
+// reports the end of its data as the key from which the pass may resume, and
+// a failed series reports its key in resumeKeys, if any.
+// The names of the series pruned are recorded in order, as are the start keys
+// of their key ranges, the retentions passed to the rollups and prunings, and
+// the options of the prunings. A pruned series reports the size in sizes,
+// keyed by its name, as the data it retains. The known time series names are
+// knownNames, if set.
+type fakeTimeSeriesDataStore struct {
+	estimates     map[string]int64
+	rollupErr     error
+	skipEmpty     bool
+	keysDeleted   int64
+	names         []string
+	pruneErrs     map[string]error
+	resumeKeys    map[string]roachpb.Key
+	hang          string
+	deleteSpan    roachpb.Span
+	calls         []string
+	pruned        []string
+	pruneStarts   []roachpb.RKey
+	retentions    []TimeSeriesRetention
+	pruneOpts     []TimeSeriesPruneOptions
+	containsCalls int
+	sizes         map[string]TimeSeriesSize
+	knownNames    map[string]struct{}
+	// pruneFn, if set, is called as each series is pruned.
+	pruneFn func(name string)
+}
+
+func (f *fakeTimeSeriesDataStore) ContainsTimeSeries(start, end roachpb.RKey) bool {
+	f.containsCalls++
+	return true
+}
+
+func (f *fakeTimeSeriesDataStore) MayNeedMaintenance(
+	_, _ roachpb.RKey, stats enginepb.MVCCStats,
+) bool {
+	f.calls = append(f.calls, "preflight")
+	return !f.skipEmpty || stats != (enginepb.MVCCStats{})
+}
+
+func (f *fakeTimeSeriesDataStore) EstimatePrunableBytes(
+	_ context.Context, _ engine.Reader, start, _ roachpb.RKey, _ hlc.Timestamp, _ TimeSeriesRetention,
+) (int64, error) {
+	return f.estimates[string(start)], nil
+}
+
+func (f *fakeTimeSeriesDataStore) RollupTimeSeries(
+	_ context.Context,
+	_ engine.Reader,
+	_, _ roachpb.RKey,
+	_ *client.DB,
+	_ hlc.Timestamp,
+	retention TimeSeriesRetention,
+	_ string,
+) error {
+	f.calls = append(f.calls, "rollup")
+	f.retentions = append(f.retentions, retention)
+	return f.rollupErr
+}
+
+func (f *fakeTimeSeriesDataStore) EstimatePrune(
+	context.Context, engine.Reader, roachpb.RKey, roachpb.RKey, hlc.Timestamp, TimeSeriesRetention,
+) (TimeSeriesPruneSummary, error) {
+	f.calls = append(f.calls, "estimate")
+	return TimeSeriesPruneSummary{
+		SeriesPruned: 1,
+		KeysDeleted:  f.keysDeleted,
+		BytesDeleted: f.keysDeleted * 100,
+	}, nil
+}
+
+func (f *fakeTimeSeriesDataStore) ListTimeSeriesNames(
+	_ context.Context, _ engine.Reader, start, _ roachpb.RKey,
+) ([]string, error) {
+	if len(f.names) == 0 {
+		return []string{"test.series"}, nil
+	}
+	var names []string
+	for _, name := range f.names {
+		if start.Less(fakeTimeSeriesKey(name).PrefixEnd()) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// fakeTimeSeriesKey returns the key under which the fakeTimeSeriesDataStore
+// holds the data of the named series.
+func fakeTimeSeriesKey(name string) roachpb.RKey {
+	return roachpb.RKey(string(keys.TimeseriesPrefix) + name)
+}
+
+func (f *fakeTimeSeriesDataStore) PruneTimeSeries(
+	ctx context.Context,
+	_ engine.Reader,
+	start, _ roachpb.RKey,
+	name string,
+	db *client.DB,
+	_ hlc.Timestamp,
+	opts TimeSeriesPruneOptions,
+) error {
+	f.calls = append(f.calls, "prune")
+	f.pruned = append(f.pruned, name)
+	f.pruneStarts = append(f.pruneStarts, start)
+	f.retentions = append(f.retentions, opts.Retention)
+	f.pruneOpts = append(f.pruneOpts, opts)
+	if f.pruneFn != nil {
+		f.pruneFn(name)
+	}
+	if err := f.pruneErrs[name]; err != nil {
+		if opts.Summary != nil {
+			opts.Summary.ResumeKey = f.resumeKeys[name]
+		}
+		return err
+	}
+	if name == f.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if f.deleteSpan.Key != nil {
+		if err := db.DelRange(ctx, f.deleteSpan.Key, f.deleteSpan.EndKey); err != nil {
+			return err
+		}
+	}
+	if opts.Summary != nil {
+		opts.Summary.KeysDeleted = f.keysDeleted
+		opts.Summary.BytesDeleted = f.keysDeleted * 100
+		opts.Summary.Retained = f.sizes[name]
+		opts.Summary.ResumeKey = fakeTimeSeriesKey(name).PrefixEnd().AsRawKey()
+	}
+	return nil
+}
+
+func (f *fakeTimeSeriesDataStore) PruneTimeSeriesSources(
+	context.Context, engine.Reader, roachpb.RKey, roachpb.RKey, []string, *client.DB,
+	TimeSeriesDeleteLimiter,
+) (TimeSeriesSourcePruneSummary, error) {
+	f.calls = append(f.calls, "prune sources")
+	return TimeSeriesSourcePruneSummary{}, nil
+}
+
+func (f *fakeTimeSeriesDataStore) KnownTimeSeriesNames() (map[string]struct{}, bool) {
+	return f.knownNames, f.knownNames != nil
+}
+
+func (f *fakeTimeSeriesDataStore) CompactionCutoffs(
+	hlc.Timestamp, TimeSeriesRetention,
+) []engine.TimeSeriesCutoff {
+	return nil
+}
+
+// TestTimeSeriesMaintenanceQueuePriority verifies that replicas with a larger
+// estimate of prunable time series data are processed first.
+func TestTimeSeriesMaintenanceQueuePriority(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	// Remove replica for range 1 since it encompasses the entire keyspace.
+	repl1, err := tc.store.GetReplica(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.store.RemoveReplica(context.Background(), repl1, *repl1.Desc(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	small := createReplica(tc.store, 1001, roachpb.RKey("1001"), roachpb.RKey("1001/end"))
+	large := createReplica(tc.store, 1002, roachpb.RKey("1002"), roachpb.RKey("1002/end"))
+	none := createReplica(tc.store, 1003, roachpb.RKey("1003"), roachpb.RKey("1003/end"))
+	for _, r := range []*Replica{small, large, none} {
+		if err := tc.store.AddReplica(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tsData := &fakeTimeSeriesDataStore{
+		estimates: map[string]int64{
+			"1001": 1 << 20,
+			"1002": 1 << 30,
+		},
+	}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	// Add the replicas in the opposite order of their expected processing.
+	now := tc.Clock().Now()
+	for _, r := range []*Replica{none, small, large} {
+		q.MaybeAdd(r, now)
+	}
+	if l := q.Length(); l != 3 {
+		t.Fatalf("expected 3 queued replicas; got %d", l)
+	}
+	for i, expected := range []*Replica{large, small, none} {
+		if r := q.pop(); r != expected {
+			t.Errorf("%d: expected replica %s; got %v", i, expected, r)
+		}
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueRollup verifies that rollups are computed
+// before pruning, and that a failed rollup prevents both pruning and the
+// update of the replica's last processed timestamp.
+func TestTimeSeriesMaintenanceQueueRollup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{rollupErr: errors.New("injected rollup error")}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); !testutils.IsError(err, "injected rollup error") {
+		t.Fatalf("expected injected rollup error, got %v", err)
+	}
+	if e, a := []string{"preflight", "rollup"}, tsData.calls; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expected calls %v, got %v", e, a)
+	}
+	if lp, err := tc.repl.getQueueLastProcessed(ctx, q.name); err != nil {
+		t.Fatal(err)
+	} else if lp != (hlc.Timestamp{}) {
+		t.Fatalf("expected last processed timestamp to be unset after failed rollup, got %s", lp)
+	}
+
+	tsData.rollupErr = nil
+	tsData.calls = nil
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"preflight", "rollup", "prune"}, tsData.calls; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expected calls %v, got %v", e, a)
+	}
+	if lp, err := tc.repl.getQueueLastProcessed(ctx, q.name); err != nil {
+		t.Fatal(err)
+	} else if lp == (hlc.Timestamp{}) {
+		t.Fatal("expected last processed timestamp to be set")
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueRetention verifies that the rollup and pruning
+// of a replica are passed the retention configured by the cluster settings as
+// of the pass, so that a change of the settings applies from the next pass.
+func TestTimeSeriesMaintenanceQueueRetention(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	for i, ttls := range []struct {
+		ttl10s, ttl30m time.Duration
+	}{
+		{7 * 24 * time.Hour, 90 * 24 * time.Hour},
+		// Retaining a resolution forever is passed through as such.
+		{time.Hour, 0},
+		{-time.Hour, 2 * time.Hour},
+	} {
+		func() {
+			defer settings.TestingSetDuration(&timeSeriesResolution10sTTL, ttls.ttl10s)()
+			defer settings.TestingSetDuration(&timeSeriesResolution30mTTL, ttls.ttl30m)()
+			tsData.retentions = nil
+			if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		expected := TimeSeriesRetention{"10s": ttls.ttl10s, "30m": ttls.ttl30m}
+		e, a := []TimeSeriesRetention{expected, expected}, tsData.retentions
+		if !reflect.DeepEqual(e, a) {
+			t.Fatalf("%d: expected retentions %v, got %v", i, e, a)
+		}
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueOrphans verifies that the pruning of a replica
+// is passed the grace period of orphaned time series and the known time series
+// names only while the grace period is set and the names are known.
+func TestTimeSeriesMaintenanceQueueOrphans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	known := map[string]struct{}{"test.series": {}}
+
+	for i, c := range []struct {
+		grace         time.Duration
+		knownNames    map[string]struct{}
+		expectedGrace time.Duration
+	}{
+		// Orphaned series are retained by default.
+		{0, known, 0},
+		// They are retained until the names are known.
+		{time.Hour, nil, 0},
+		{time.Hour, known, time.Hour},
+	} {
+		func() {
+			defer settings.TestingSetDuration(&timeSeriesOrphanGracePeriod, c.grace)()
+			tsData.knownNames = c.knownNames
+			tsData.pruneOpts = nil
+			if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		if len(tsData.pruneOpts) != 1 {
+			t.Fatalf("%d: expected 1 pruning, got %d", i, len(tsData.pruneOpts))
+		}
+		opts := tsData.pruneOpts[0]
+		if opts.OrphanGracePeriod != c.expectedGrace {
+			t.Fatalf("%d: expected grace period %s, got %s", i, c.expectedGrace, opts.OrphanGracePeriod)
+		}
+		var expectedNames map[string]struct{}
+		if c.expectedGrace > 0 {
+			expectedNames = known
+		}
+		if !reflect.DeepEqual(expectedNames, opts.KnownNames) {
+			t.Fatalf("%d: expected known names %v, got %v", i, expectedNames, opts.KnownNames)
+		}
+	}
+}
+
+// TestTimeSeriesMaintenanceQueuePreflight verifies that no snapshot is taken
+// of a replica which the data store's preflight check declines, and that the
+// replica is nevertheless considered processed.
+func TestTimeSeriesMaintenanceQueuePreflight(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	// A newly created replica has no data. It need not be added to the store,
+	// as its range-local keys are addressed to the bootstrapped range.
+	empty := createReplica(tc.store, 1001, roachpb.RKey("1001"), roachpb.RKey("1001/end"))
+
+	tsData := &fakeTimeSeriesDataStore{skipEmpty: true}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	snapshots := 0
+	var bounds roachpb.Span
+	q.newSnapshotFn = func(start, end engine.MVCCKey) engine.Reader {
+		snapshots++
+		bounds = roachpb.Span{Key: start.Key, EndKey: end.Key}
+		return tc.store.Engine().NewSnapshotBounded(start, end)
+	}
+
+	// The new replica has no data and is skipped without a snapshot.
+	if err := q.process(ctx, empty, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"preflight"}, tsData.calls; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expected calls %v, got %v", e, a)
+	}
+	if snapshots != 0 {
+		t.Fatalf("expected no snapshot to be taken, got %d", snapshots)
+	}
+	if lp, err := empty.getQueueLastProcessed(ctx, q.name); err != nil {
+		t.Fatal(err)
+	} else if lp == (hlc.Timestamp{}) {
+		t.Fatal("expected last processed timestamp to be set")
+	}
+
+	// The bootstrapped range has data and is snapshotted and maintained.
+	tsData.calls = nil
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"preflight", "rollup", "prune"}, tsData.calls; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expected calls %v, got %v", e, a)
+	}
+	if snapshots != 1 {
+		t.Fatalf("expected 1 snapshot to be taken, got %d", snapshots)
+	}
+	desc := tc.repl.Desc()
+	if e := (roachpb.Span{
+		Key: desc.StartKey.AsRawKey(), EndKey: desc.EndKey.AsRawKey(),
+	}); !e.Equal(bounds) {
+		t.Fatalf("expected snapshot bounded to %s, got %s", e, bounds)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueSuggestCompaction verifies that a compaction
+// of the replica's time series data is suggested only after a prune which
+// deleted more keys than the threshold.
+func TestTimeSeriesMaintenanceQueueSuggestCompaction(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetInt(&timeSeriesMaintenanceCompactionThreshold, 100)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	var suggested []compactionSuggestion
+	q.suggestCompactionFn = func(_ context.Context, start, end roachpb.Key, bytes int64) {
+		suggested = append(suggested, compactionSuggestion{
+			span:  roachpb.Span{Key: start, EndKey: end},
+			bytes: bytes,
+		})
+	}
+
+	for i, c := range []struct {
+		keysDeleted int64
+		suggest     bool
+	}{
+		{0, false},
+		{100, false},
+		{101, true},
+	} {
+		suggested = nil
+		tsData.keysDeleted = c.keysDeleted
+		if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		var expected []compactionSuggestion
+		if c.suggest {
+			expected = []compactionSuggestion{{
+				span:  roachpb.Span{Key: keys.TimeseriesPrefix, EndKey: keys.TimeseriesPrefix.PrefixEnd()},
+				bytes: c.keysDeleted * 100,
+			}}
+		}
+		if !reflect.DeepEqual(suggested, expected) {
+			t.Errorf("%d: expected suggestions %+v after deleting %d keys, got %+v",
+				i, expected, c.keysDeleted, suggested)
+		}
+	}
+
+	// A threshold of zero disables suggestions.
+	defer settings.TestingSetInt(&timeSeriesMaintenanceCompactionThreshold, 0)()
+	suggested = nil
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(suggested) != 0 {
+		t.Errorf("expected no suggestions when disabled, got %+v", suggested)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueDeclined verifies that the queue neither
+// queues nor maintains replicas while the store is draining, its read
+// amplification exceeds the configured maximum or its engine is unhealthy,
+// that declined replicas are requeued without being failed, and that they are
+// maintained once conditions improve.
+func TestTimeSeriesMaintenanceQueueDeclined(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetInt(&timeSeriesMaintenanceMaxReadAmplification, 0)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	draining := false
+	q.drainingFn = func() bool { return draining }
+	readAmp := int64(0)
+	q.readAmplificationFn = func() int64 { return readAmp }
+	var stats engine.Stats
+	q.engineHealth = newEngineHealth(func() (*engine.Stats, error) { return &stats, nil })
+	q.engineHealth.refreshInterval = 0
+	q.declinedRequeueDelay = time.Hour
+
+	expectDeclined := func(declined int64) {
+		if shouldQ, _ := q.shouldQueue(ctx, tc.Clock().Now(), tc.repl, config.SystemConfig{}); shouldQ {
+			t.Fatal("expected replica not to be queued")
+		}
+		if err := q.process(ctx, tc.repl, config.SystemConfig{}); !isDeferredError(err) {
+			t.Fatalf("expected maintenance to be deferred, got %v", err)
+		}
+		if len(tsData.calls) != 0 {
+			t.Fatalf("expected no maintenance, got calls %v", tsData.calls)
+		}
+		q.mu.Lock()
+		_, requeued := q.mu.requeues[tc.repl.RangeID]
+		q.mu.Unlock()
+		if !requeued {
+			t.Fatal("expected the declined replica to be requeued")
+		}
+		if lp, err := tc.repl.getQueueLastProcessed(ctx, q.name); err != nil {
+			t.Fatal(err)
+		} else if lp != (hlc.Timestamp{}) {
+			t.Fatalf("expected last processed timestamp to be unset, got %s", lp)
+		}
+		if a := q.declined.Count(); a != declined {
+			t.Fatalf("expected %d declined replicas, got %d", declined, a)
+		}
+	}
+
+	draining = true
+	expectDeclined(1)
+	draining = false
+
+	// Read amplification is ignored until a maximum is configured.
+	readAmp = 50
+	if shouldQ, _ := q.shouldQueue(ctx, tc.Clock().Now(), tc.repl, config.SystemConfig{}); !shouldQ {
+		t.Fatal("expected replica to be queued without a maximum read amplification")
+	}
+	defer settings.TestingSetInt(&timeSeriesMaintenanceMaxReadAmplification, 20)()
+	expectDeclined(2)
+	readAmp = 20
+
+	stats.WriteStopped = true
+	expectDeclined(3)
+	stats.WriteStopped = false
+
+	if shouldQ, _ := q.shouldQueue(ctx, tc.Clock().Now(), tc.repl, config.SystemConfig{}); !shouldQ {
+		t.Fatal("expected replica to be queued")
+	}
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"preflight", "rollup", "prune"}, tsData.calls; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expected calls %v, got %v", e, a)
+	}
+}
+
+// TestTimeSeriesMaintenanceForceSlots verifies that forced maintenance waits
+// for a background maintenance slot, and fails without maintaining the replica
+// if none becomes available in time.
+func TestTimeSeriesMaintenanceForceSlots(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetInt(&maintenanceSlotsSetting, 1)()
+	defer settings.TestingSetDuration(&maintenanceSlotTimeout, 10*time.Millisecond)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	release, err := tc.store.maintenanceSlots.acquire(ctx, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.forceMaintenance(ctx, tc.repl); err != errMaintenanceSlotsUnavailable {
+		t.Fatalf("expected %v, got %v", errMaintenanceSlotsUnavailable, err)
+	}
+	if len(tsData.calls) != 0 {
+		t.Fatalf("expected the replica not to be maintained, got calls %v", tsData.calls)
+	}
+
+	release()
+	if _, err := q.forceMaintenance(ctx, tc.repl); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"preflight", "rollup", "prune"}, tsData.calls; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expected calls %v, got %v", e, a)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueDryRun verifies that a dry run only
+// estimates the data which pruning would delete, leaving the data and the
+// last processed time untouched, and reports the latest estimate in the
+// metrics, without counting the estimates of repeated dry runs again.
+func TestTimeSeriesMaintenanceQueueDryRun(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetBool(&timeSeriesMaintenanceDryRun, true)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	key := roachpb.Key("a")
+	if err := tc.store.DB().Put(ctx, key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	tsData := &fakeTimeSeriesDataStore{
+		keysDeleted: 10,
+		deleteSpan:  roachpb.Span{Key: key, EndKey: key.Next()},
+	}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	for i := 1; i <= 2; i++ {
+		if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if e, a := []string{"preflight", "estimate"}, tsData.calls; !reflect.DeepEqual(e, a) {
+			t.Fatalf("expected calls %v, got %v", e, a)
+		}
+		tsData.calls = nil
+		if lp, err := tc.repl.getQueueLastProcessed(ctx, q.name); err != nil {
+			t.Fatal(err)
+		} else if lp != (hlc.Timestamp{}) {
+			t.Fatalf("expected last processed timestamp to be unset, got %s", lp)
+		}
+		if e, a := int64(10), q.dryRunKeys.Value(); e != a {
+			t.Fatalf("expected %d dry run keys, got %d", e, a)
+		}
+		if e, a := int64(1000), q.dryRunBytes.Value(); e != a {
+			t.Fatalf("expected %d dry run bytes, got %d", e, a)
+		}
+	}
+	if kv, err := tc.store.DB().Get(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if !kv.Exists() {
+		t.Fatal("expected the dry run not to delete any data")
+	}
+
+	// Once dry runs are disabled, the replica is maintained as usual.
+	defer settings.TestingSetBool(&timeSeriesMaintenanceDryRun, false)()
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"preflight", "rollup", "prune"}, tsData.calls; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expected calls %v, got %v", e, a)
+	}
+	if kv, err := tc.store.DB().Get(ctx, key); err != nil {
+		t.Fatal(err)
+	} else if kv.Exists() {
+		t.Fatal("expected pruning to delete the data")
+	}
+	if k, b := q.dryRunKeys.Value(), q.dryRunBytes.Value(); k != 0 || b != 0 {
+		t.Fatalf("expected the estimate to be discarded, got %d keys and %d bytes", k, b)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueuePartialPrune verifies that each time series is
+// pruned separately, that a series which fails or times out does not prevent
+// the later series from being pruned, and that a retry of the replica only
+// prunes the series which failed.
+func TestTimeSeriesMaintenanceQueuePartialPrune(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetDuration(&timeSeriesMaintenanceSeriesTimeout, 10*time.Millisecond)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{
+		names:     []string{"a", "b", "c", "d"},
+		pruneErrs: map[string]error{"b": errors.New("injected failure")},
+		hang:      "c",
+	}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	expectPass := func(expPruned []string, expErr string) {
+		tsData.pruned = nil
+		prevLP, err := tc.repl.getQueueLastProcessed(ctx, q.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = q.process(ctx, tc.repl, config.SystemConfig{})
+		if !testutils.IsError(err, expErr) {
+			t.Fatalf("expected error %q, got %v", expErr, err)
+		}
+		if !reflect.DeepEqual(tsData.pruned, expPruned) {
+			t.Fatalf("expected series %v to be pruned, got %v", expPruned, tsData.pruned)
+		}
+		lp, err := tc.repl.getQueueLastProcessed(ctx, q.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated := lp != prevLP; updated != (expErr == "") {
+			t.Fatalf("expected last processed timestamp to be updated: %t, got %s", expErr == "", lp)
+		}
+	}
+
+	// The series after the failed and hung series are still pruned.
+	expectPass([]string{"a", "b", "c", "d"}, `failed to prune 2 of 4 time series \(b, c\)`)
+	// Only the failed series are retried.
+	tsData.hang = ""
+	expectPass([]string{"b", "c"}, `failed to prune 1 of 4 time series \(b\)`)
+	delete(tsData.pruneErrs, "b")
+	expectPass([]string{"b"}, "")
+	// A subsequent pass prunes every series.
+	expectPass([]string{"a", "b", "c", "d"}, "")
+
+	// If the record of the pruned series is evicted from the cache, a retry
+	// prunes them again.
+	defer settings.TestingSetByteSize(&queueCacheMaxBytes, 1)()
+	tsData.pruneErrs["b"] = errors.New("injected failure")
+	expectPass([]string{"a", "b", "c", "d"}, `failed to prune 1 of 4 time series \(b\)`)
+	delete(tsData.pruneErrs, "b")
+	expectPass([]string{"a", "b", "c", "d"}, "")
+}
+
+// TestTimeSeriesMaintenanceQueueResume verifies that a pass over a replica
+// which fails part way is resumed by a restarted queue from the key recorded
+// for it, at the timestamp of the interrupted pass, that the record is
+// cleared once the pass completes, and that a record older than an interval
+// is ignored.
+func TestTimeSeriesMaintenanceQueueResume(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// The record of the series pruned by the failed pass is evicted from the
+	// cache, as it is lost by a restart.
+	defer settings.TestingSetByteSize(&queueCacheMaxBytes, 1)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	desc := tc.repl.Desc()
+	resumeKey := roachpb.Key(string(keys.TimeseriesPrefix) + "b")
+	tsData := &fakeTimeSeriesDataStore{
+		names:      []string{"a", "b", "c"},
+		pruneErrs:  map[string]error{"b": errors.New("injected failure")},
+		resumeKeys: map[string]roachpb.Key{"b": resumeKey},
+	}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	expectStarts := func(expected roachpb.RKey) {
+		if len(tsData.pruneStarts) == 0 {
+			t.Fatal("expected series to be pruned")
+		}
+		for i, start := range tsData.pruneStarts {
+			if !start.Equal(expected) {
+				t.Fatalf("expected %s to be pruned from %s, got %s",
+					tsData.pruned[i], expected, start)
+			}
+		}
+	}
+
+	// The pass fails at the resume key of the first failed series.
+	passStart := tc.Clock().Now()
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); !testutils.IsError(err, "injected failure") {
+		t.Fatalf("expected an injected failure, got %v", err)
+	}
+	expectStarts(desc.StartKey)
+	record, found := q.loadResume(ctx, desc, tc.Clock().Now())
+	if record == nil || !found {
+		t.Fatal("expected a resume record")
+	}
+	if !record.ResumeKey.Equal(roachpb.RKey(resumeKey)) || record.Now.Less(passStart) {
+		t.Fatalf("expected to resume the pass after %s from %s, got %+v", passStart, resumeKey, record)
+	}
+
+	// A restarted queue resumes from the recorded key, at the timestamp of
+	// the interrupted pass.
+	tc.manualClock.Increment(int64(time.Hour))
+	delete(tsData.pruneErrs, "b")
+	tsData.pruned, tsData.pruneStarts = nil, nil
+	q = newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	expectStarts(roachpb.RKey(resumeKey))
+	if lp, err := tc.repl.getQueueLastProcessed(ctx, q.name); err != nil {
+		t.Fatal(err)
+	} else if lp != record.Now {
+		t.Fatalf("expected last processed timestamp %s, got %s", record.Now, lp)
+	}
+	if _, found := q.loadResume(ctx, desc, tc.Clock().Now()); found {
+		t.Fatal("expected the resume record to be cleared")
+	}
+
+	// A record of a pass older than an interval is ignored and cleared.
+	stale := tc.Clock().Now().Add(-TimeSeriesMaintenanceInterval.Nanoseconds()-1, 0)
+	if err := q.saveResume(ctx, desc, roachpb.RKey(resumeKey), stale); err != nil {
+		t.Fatal(err)
+	}
+	tsData.pruned, tsData.pruneStarts = nil, nil
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	expectStarts(desc.StartKey)
+	if _, found := q.loadResume(ctx, desc, tc.Clock().Now()); found {
+		t.Fatal("expected the resume record to be cleared")
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueCrashOrdering verifies that the last processed
+// time of a replica is only recorded once its deletions have completed, so
+// that a crash between the two leaves the time stale rather than claiming that
+// retained data was pruned.
+func TestTimeSeriesMaintenanceQueueCrashOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	span := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("b")}
+	tsData := &fakeTimeSeriesDataStore{deleteSpan: span}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	write := func() {
+		if err := tc.store.DB().Put(ctx, span.Key, "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retained := func() bool {
+		kv, err := tc.store.DB().Get(ctx, span.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kv.Exists()
+	}
+	lastProcessed := func() hlc.Timestamp {
+		lp, err := tc.repl.getQueueLastProcessed(ctx, q.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lp
+	}
+
+	// A crash before the deletion completes retains the data, and the last
+	// processed time is not recorded.
+	write()
+	prevLP := lastProcessed()
+	tsData.pruneErrs = map[string]error{"test.series": errors.New("injected crash")}
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); !testutils.IsError(err, "injected crash") {
+		t.Fatalf("expected injected crash, got %v", err)
+	}
+	if !retained() {
+		t.Fatal("expected data to be retained")
+	}
+	if lp := lastProcessed(); lp != prevLP {
+		t.Fatalf("expected last processed time %s to be stale, got %s", prevLP, lp)
+	}
+
+	// A crash after the deletion completes, but before the last processed time
+	// is recorded, leaves the time stale. By the time it would be recorded, the
+	// deletion's response has been received.
+	tsData.pruneErrs = nil
+	q.beforeLastProcessedFn = func() error {
+		if retained() {
+			t.Error("expected data to be deleted before the last processed time is recorded")
+		}
+		return errors.New("injected crash")
+	}
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); !testutils.IsError(err, "injected crash") {
+		t.Fatalf("expected injected crash, got %v", err)
+	}
+	if lp := lastProcessed(); lp != prevLP {
+		t.Fatalf("expected last processed time %s to be stale, got %s", prevLP, lp)
+	}
+
+	// The next pass prunes the replica again, and records the time.
+	q.beforeLastProcessedFn = nil
+	write()
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if retained() {
+		t.Fatal("expected data to be deleted")
+	}
+	if lp := lastProcessed(); !prevLP.Less(lp) {
+		t.Fatalf("expected last processed time to advance past %s, got %s", prevLP, lp)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueEnabled verifies that disabling the queue by
+// its cluster setting drops the queued replicas and prevents more from being
+// queued, and that once it is re-enabled replicas are queued and processed as
+// before, without the last processed time being updated more than once.
+func TestTimeSeriesMaintenanceQueueEnabled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	expectQueued := func(expected int) {
+		if l := q.Length(); l != expected {
+			t.Fatalf("expected %d queued replicas, got %d", expected, l)
+		}
+		if p := q.pending.Value(); p != int64(expected) {
+			t.Fatalf("expected %d pending replicas, got %d", expected, p)
+		}
+	}
+	lastProcessed := func() hlc.Timestamp {
+		lp, err := tc.repl.getQueueLastProcessed(ctx, q.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lp
+	}
+
+	q.MaybeAdd(tc.repl, tc.Clock().Now())
+	expectQueued(1)
+
+	// Disabling the queue drops the queued replica once the queue dequeues,
+	// and no replica can be queued while it is disabled.
+	reset := settings.TestingSetBool(&timeSeriesMaintenanceEnabled, false)
+	if r := q.pop(); r != nil {
+		t.Fatalf("expected no replica to be dequeued, got %s", r)
+	}
+	expectQueued(0)
+	q.MaybeAdd(tc.repl, tc.Clock().Now())
+	expectQueued(0)
+	if _, err := q.Add(tc.repl, 1); err != errQueueDisabled {
+		t.Fatalf("expected %v, got %v", errQueueDisabled, err)
+	}
+	if len(tsData.calls) != 0 {
+		t.Fatalf("expected no maintenance while disabled, got %v", tsData.calls)
+	}
+	if lp := lastProcessed(); lp != (hlc.Timestamp{}) {
+		t.Fatalf("expected no last processed time, got %s", lp)
+	}
+
+	// Once re-enabled, the replica is queued and processed again.
+	reset()
+	q.MaybeAdd(tc.repl, tc.Clock().Now())
+	expectQueued(1)
+	r := q.pop()
+	if r != tc.repl {
+		t.Fatalf("expected %s to be dequeued, got %v", tc.repl, r)
+	}
+	if err := q.process(ctx, r, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	lp := lastProcessed()
+	if lp == (hlc.Timestamp{}) {
+		t.Fatal("expected the last processed time to be recorded")
+	}
+
+	// Having just been processed, the replica isn't queued again, so its last
+	// processed time isn't updated again.
+	tc.manualClock.Increment(1)
+	q.MaybeAdd(tc.repl, tc.Clock().Now())
+	expectQueued(0)
+	if a := lastProcessed(); a != lp {
+		t.Fatalf("expected last processed time %s, got %s", lp, a)
+	}
+	if e := []string{"preflight", "rollup", "prune"}; !reflect.DeepEqual(tsData.calls, e) {
+		t.Fatalf("expected calls %v, got %v", e, tsData.calls)
+	}
+}
+
+// TestTimeSeriesMaintenanceStatuses verifies that the store reports the last
+// processed timestamps of replicas containing time series data, and flags
+// replicas which have not been processed recently as overdue.
+func TestTimeSeriesMaintenanceStatuses(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, &fakeTimeSeriesDataStore{})
+	tc.store.tsMaintenanceQueue = q
+
+	// Timestamps recorded by other queues are ignored.
+	if err := tc.repl.setQueueLastProcessed(ctx, "other", tc.Clock().Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkStatus := func(expectedLastProcessed hlc.Timestamp, expectedOverdue bool) {
+		statuses, err := tc.store.TimeSeriesMaintenanceStatuses()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 1 {
+			t.Fatalf("expected 1 status, got %+v", statuses)
+		}
+		status := statuses[0]
+		if status.RangeID != tc.repl.RangeID {
+			t.Errorf("expected status for r%d, got r%d", tc.repl.RangeID, status.RangeID)
+		}
+		if status.LastProcessed != expectedLastProcessed {
+			t.Errorf("expected last processed %s, got %s", expectedLastProcessed, status.LastProcessed)
+		}
+		if status.Overdue != expectedOverdue {
+			t.Errorf("expected overdue %t, got %t", expectedOverdue, status.Overdue)
+		}
+	}
+
+	tc.manualClock.Increment(int64(3 * TimeSeriesMaintenanceInterval))
+	checkStatus(hlc.Timestamp{}, true)
+
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	lastProcessed, err := tc.repl.getQueueLastProcessed(ctx, q.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastProcessed == (hlc.Timestamp{}) {
+		t.Fatal("expected last processed timestamp to be set")
+	}
+	checkStatus(lastProcessed, false)
+
+	tc.manualClock.Increment(int64(3 * TimeSeriesMaintenanceInterval))
+	checkStatus(lastProcessed, true)
+}
+
+// TestTimeSeriesMaintenanceSizeReport verifies that maintenance records the
+// sizes of the data which pruning leaves in the replica's time series, and
+// that the store reports them.
+func TestTimeSeriesMaintenanceSizeReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{
+		names:       []string{"a", "b", "c"},
+		keysDeleted: 1,
+		sizes: map[string]TimeSeriesSize{
+			"a": {Keys: 10, Bytes: 1000},
+			"b": {Keys: 30, Bytes: 3000},
+			"c": {Keys: 20, Bytes: 2000},
+		},
+	}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	q.sizes.limit = 2
+	tc.store.tsMaintenanceQueue = q
+
+	report, err := tc.store.TimeSeriesSizeReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Series) != 0 || len(report.Replicas) != 0 {
+		t.Fatalf("expected an empty report before maintenance, got %+v", report)
+	}
+
+	before := tc.Clock().Now()
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = tc.store.TimeSeriesSizeReport(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []NamedTimeSeriesSize{
+		{Name: "b", TimeSeriesSize: TimeSeriesSize{Keys: 30, Bytes: 3000}},
+		{Name: "c", TimeSeriesSize: TimeSeriesSize{Keys: 20, Bytes: 2000}},
+	}
+	if !reflect.DeepEqual(expected, report.Series) {
+		t.Errorf("expected series %+v, got %+v", expected, report.Series)
+	}
+	if len(report.Replicas) != 1 || report.Replicas[0].RangeID != tc.repl.RangeID ||
+		report.Replicas[0].Measured.Less(before) {
+		t.Errorf("expected r%d to be measured after %s, got %+v", tc.repl.RangeID, before, report.Replicas)
+	}
+
+	// The sizes measured by a pass during which the range's bounds changed,
+	// as by a split, are not recorded under the bounds which were pruned.
+	measured := func() hlc.Timestamp {
+		q.sizes.mu.Lock()
+		defer q.sizes.mu.Unlock()
+		return q.sizes.mu.replicas[tc.repl.RangeID].measured
+	}
+	prevMeasured := measured()
+	oldDesc := *tc.repl.Desc()
+	setDesc := func(desc roachpb.RangeDescriptor) {
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		tc.repl.setDescWithoutProcessUpdate(&desc)
+	}
+	defer setDesc(oldDesc)
+	tsData.pruneFn = func(string) {
+		newDesc := oldDesc
+		newDesc.EndKey = roachpb.RKey("m")
+		setDesc(newDesc)
+	}
+	tc.manualClock.Increment(1)
+	if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if m := measured(); m != prevMeasured {
+		t.Errorf("expected r%d to remain measured at %s, got %s", tc.repl.RangeID, prevMeasured, m)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueContainsCache verifies that the result of
+// ContainsTimeSeries is cached per range, and recomputed once the range's
+// bounds change.
+func TestTimeSeriesMaintenanceQueueContainsCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+
+	desc := roachpb.RangeDescriptor{
+		RangeID:  10,
+		StartKey: roachpb.RKey("a"),
+		EndKey:   roachpb.RKey("z"),
+	}
+	checkCalls := func(expected int) {
+		if !q.containsTimeSeries(&desc) {
+			t.Fatalf("expected r%d to contain time series", desc.RangeID)
+		}
+		if tsData.containsCalls != expected {
+			t.Fatalf("expected %d calls to ContainsTimeSeries, got %d", expected, tsData.containsCalls)
+		}
+	}
+
+	checkCalls(1)
+	// Repeated lookups are served by the cache.
+	checkCalls(1)
+	checkCalls(1)
+
+	// Splitting the range changes its bounds, invalidating the cached result.
+	desc.EndKey = roachpb.RKey("m")
+	checkCalls(2)
+	checkCalls(2)
+
+	// The right hand side of the split is a different range.
+	desc = roachpb.RangeDescriptor{
+		RangeID:  11,
+		StartKey: roachpb.RKey("m"),
+		EndKey:   roachpb.RKey("z"),
+	}
+	checkCalls(3)
+	checkCalls(3)
+
+	// Merging the ranges back together invalidates the cached result again.
+	desc = roachpb.RangeDescriptor{
+		RangeID:  10,
+		StartKey: roachpb.RKey("a"),
+		EndKey:   roachpb.RKey("z"),
+	}
+	checkCalls(4)
+
+	// If the cache can't hold the result, it is recomputed on every lookup.
+	defer settings.TestingSetByteSize(&queueCacheMaxBytes, 1)()
+	checkCalls(5)
+	checkCalls(6)
+}
+
+// TestTimeSeriesMaintenanceQueueFailureClasses verifies that processing
+// failures are counted by the class of their error.
+func TestTimeSeriesMaintenanceQueueFailureClasses(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	metrics := tc.store.metrics
+
+	testCases := []struct {
+		err     error
+		counter *metric.Counter
+	}{
+		{&roachpb.NotLeaseHolderError{}, metrics.TimeSeriesMaintenanceQueueFailuresLease},
+		{context.Canceled, metrics.TimeSeriesMaintenanceQueueFailuresContextCanceled},
+		{&roachpb.RangeNotFoundError{RangeID: tc.repl.RangeID}, metrics.TimeSeriesMaintenanceQueueFailuresKV},
+		{errors.New("injected failure"), metrics.TimeSeriesMaintenanceQueueFailuresOther},
+	}
+	for i, c := range testCases {
+		tsData.pruneErrs = map[string]error{"test.series": c.err}
+		if _, err := q.Add(tc.repl, 1); err != nil {
+			t.Fatal(err)
+		}
+		q.DrainQueue(tc.Clock())
+
+		if a, e := q.failures.Count(), int64(i+1); a != e {
+			t.Fatalf("%d: expected %d failures, got %d", i, e, a)
+		}
+		for j, o := range testCases {
+			var e int64
+			if j <= i {
+				e = 1
+			}
+			if a := o.counter.Count(); a != e {
+				t.Errorf("%d: expected %s to be %d, got %d", i, o.counter.GetName(), e, a)
+			}
+		}
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueTruncatedPass verifies that a pass which
+// reaches timeseries.maintenance.pass_bytes leaves the remaining series to a
+// later pass, which is queued shortly after and resumes after the series
+// pruned even if the record of them is lost, and that the last processed time
+// of the replica is only recorded once every series has been pruned.
+func TestTimeSeriesMaintenanceQueueTruncatedPass(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Each series is pruned of 100 bytes, so a pass prunes two series.
+	defer settings.TestingSetByteSize(&timeSeriesMaintenancePassBytes, 150)()
+	// The record of the series pruned by the truncated pass is evicted from
+	// the cache, as it is lost by a restart.
+	defer settings.TestingSetByteSize(&queueCacheMaxBytes, 1)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	tsData := &fakeTimeSeriesDataStore{
+		names:       []string{"a", "b", "c"},
+		keysDeleted: 1,
+	}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, tsData)
+	q.truncatedRequeueDelay = 0
+
+	expectPass := func(expPruned []string) {
+		tsData.pruned = nil
+		if err := q.process(ctx, tc.repl, config.SystemConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tsData.pruned, expPruned) {
+			t.Fatalf("expected series %v to be pruned, got %v", expPruned, tsData.pruned)
+		}
+	}
+	lastProcessed := func() hlc.Timestamp {
+		lp, err := tc.repl.getQueueLastProcessed(ctx, q.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lp
+	}
+	requeueDone := func() error {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if len(q.mu.requeues) != 0 {
+			return errors.New("requeue pending")
+		}
+		return nil
+	}
+
+	// The first pass is truncated, so the replica is queued again without its
+	// last processed time being recorded.
+	expectPass([]string{"a", "b"})
+	if lp := lastProcessed(); lp != (hlc.Timestamp{}) {
+		t.Fatalf("expected no last processed time, got %s", lp)
+	}
+	record, _ := q.loadResume(ctx, tc.repl.Desc(), tc.Clock().Now())
+	if resumeKey := fakeTimeSeriesKey("b").PrefixEnd(); record == nil || !record.ResumeKey.Equal(resumeKey) {
+		t.Fatalf("expected to resume the pass from %s, got %+v", resumeKey, record)
+	}
+	testutils.SucceedsSoon(t, requeueDone)
+	if r := q.pop(); r != tc.repl {
+		t.Fatalf("expected %s to be requeued, got %v", tc.repl, r)
+	}
+
+	// The second pass prunes the remaining series and records the time.
+	expectPass([]string{"c"})
+	if lp := lastProcessed(); lp == (hlc.Timestamp{}) {
+		t.Fatal("expected the last processed time to be recorded")
+	}
+	testutils.SucceedsSoon(t, requeueDone)
+	if l := q.Length(); l != 0 {
+		t.Fatalf("expected no queued replicas, got %d", l)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueGossip verifies that a store doesn't maintain
+// a replica whose time series data another store advertised in gossip to have
+// recently pruned, and falls back to maintaining it once the advertisement is
+// stale.
+func TestTimeSeriesMaintenanceQueueGossip(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	const freshness = time.Minute
+	defer settings.TestingSetDuration(&timeSeriesMaintenancePrunedFreshness, freshness)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	// The stores share the gossip instance of the first.
+	tc1, tc2 := testContext{}, testContext{}
+	tc1.Start(t, stopper)
+	tc2.Start(t, stopper)
+
+	ctx := context.Background()
+	q1 := newTimeSeriesMaintenanceQueue(tc1.store, tc1.store.DB(), tc1.gossip, &fakeTimeSeriesDataStore{})
+	q2 := newTimeSeriesMaintenanceQueue(tc2.store, tc2.store.DB(), tc1.gossip, &fakeTimeSeriesDataStore{})
+	expectShouldQueue := func(expected bool) {
+		if shouldQ, _ := q2.shouldQueue(ctx, tc2.Clock().Now(), tc2.repl, config.SystemConfig{}); shouldQ != expected {
+			t.Fatalf("expected shouldQueue %t, got %t", expected, shouldQ)
+		}
+	}
+
+	// Without gossip, the second store maintains its replica.
+	expectShouldQueue(true)
+
+	// Once the first store advertises maintaining its replica of the range,
+	// the second store declines to.
+	if err := q1.process(ctx, tc1.repl, config.SystemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	expectShouldQueue(false)
+
+	// The advertisement is disregarded if it is disabled, or once it is stale.
+	reset := settings.TestingSetDuration(&timeSeriesMaintenancePrunedFreshness, 0)
+	expectShouldQueue(true)
+	reset()
+	tc2.manualClock.Increment(freshness.Nanoseconds() - 1)
+	expectShouldQueue(false)
+	tc2.manualClock.Increment(1)
+	expectShouldQueue(true)
+}
+
+func TestTimeSeriesMaintenancePause(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const interval = 24 * time.Hour
+	testCases := []struct {
+		replicaCount int
+		duration     time.Duration
+		expected     time.Duration
+	}{
+		{0, 0, 0},
+		{0, time.Second, 0},
+		{-1, 0, 0},
+		{1, 0, interval},
+		{1, time.Hour, 23 * time.Hour},
+		{1, 2 * interval, 0},
+		{24, 0, time.Hour},
+		{24, time.Minute, 59 * time.Minute},
+		{24, time.Hour, 0},
+		{24, 2 * time.Hour, 0},
+	}
+	for i, c := range testCases {
+		if a := timeSeriesMaintenancePause(interval, c.replicaCount, c.duration); a != c.expected {
+			t.Errorf("%d: expected a pause of %s after %s with %d replicas, got %s",
+				i, c.expected, c.duration, c.replicaCount, a)
+		}
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueTimer verifies that the queue is paced by the
+// number of replicas containing time series data, which is only recounted
+// periodically, or else by the number of replicas.
+func TestTimeSeriesMaintenanceQueueTimer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), tc.gossip, &fakeTimeSeriesDataStore{})
+	q.replicaCountFn = func() int { return 100 }
+
+	// The store's only replica contains time series data.
+	if e, a := TimeSeriesMaintenanceInterval, q.timer(0); e != a {
+		t.Fatalf("expected a pause of %s, got %s", e, a)
+	}
+
+	// The count is cached until it is recounted.
+	counts := 0
+	tsReplicas := 4
+	q.countTimeSeriesReplicasFn = func() int {
+		counts++
+		return tsReplicas
+	}
+	q.tsReplicas.counted = time.Time{}
+	for i := 0; i < 2; i++ {
+		if e, a := TimeSeriesMaintenanceInterval/4, q.timer(0); e != a {
+			t.Fatalf("%d: expected a pause of %s, got %s", i, e, a)
+		}
+	}
+	if counts != 1 {
+		t.Fatalf("expected the replicas to be counted once, got %d", counts)
+	}
+	tsReplicas = 0
+	q.tsReplicas.counted = q.tsReplicas.counted.Add(-timeSeriesMaintenanceRecountInterval)
+	if a := q.timer(0); a != 0 {
+		t.Fatalf("expected no pause without replicas to maintain, got %s", a)
+	}
+
+	// Without a count, the queue falls back to the number of replicas.
+	q.countTimeSeriesReplicasFn = nil
+	if e, a := TimeSeriesMaintenanceInterval/100, q.timer(0); e != a {
+		t.Fatalf("expected a pause of %s, got %s", e, a)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueWithoutSystemConfig verifies that replicas are
+// queued and maintained before the system config is gossiped.
+func TestTimeSeriesMaintenanceQueueWithoutSystemConfig(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	g := newTestGossipWithoutSystemConfig(t, tc.Clock(), stopper)
+	tsData := &fakeTimeSeriesDataStore{}
+	q := newTimeSeriesMaintenanceQueue(tc.store, tc.store.DB(), g, tsData)
+
+	q.MaybeAdd(tc.repl, tc.Clock().Now())
+	if r := q.pop(); r != tc.repl {
+		t.Fatalf("expected the replica to be queued, got %v", r)
+	}
+	if err := q.processReplica(ctx, tc.repl, tc.Clock()); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"preflight", "rollup", "prune"}, tsData.calls; !reflect.DeepEqual(e, a) {
+		t.Fatalf("expected calls %v, got %v", e, a)
+	}
+}
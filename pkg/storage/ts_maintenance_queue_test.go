@@ -32,6 +32,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/server"
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/ts"
@@ -61,12 +62,73 @@ func (m *modelTimeSeriesDataStore) ContainsTimeSeries(start, end roachpb.RKey) b
 	return true
 }
 
+func (m *modelTimeSeriesDataStore) MayNeedMaintenance(
+	start, end roachpb.RKey, _ enginepb.MVCCStats,
+) bool {
+	return true
+}
+
+func (m *modelTimeSeriesDataStore) EstimatePrunableBytes(
+	ctx context.Context,
+	reader engine.Reader,
+	start, end roachpb.RKey,
+	now hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+) (int64, error) {
+	if reader == nil {
+		m.t.Fatal("EstimatePrunableBytes was passed a nil reader")
+	}
+	return 0, nil
+}
+
+func (m *modelTimeSeriesDataStore) RollupTimeSeries(
+	ctx context.Context,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	db *client.DB,
+	now hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+	tempDir string,
+) error {
+	if snapshot == nil {
+		m.t.Fatal("RollupTimeSeries was passed a nil snapshot")
+	}
+	if db == nil {
+		m.t.Fatal("RollupTimeSeries was passed a nil client.DB")
+	}
+	return nil
+}
+
+func (m *modelTimeSeriesDataStore) EstimatePrune(
+	ctx context.Context,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	now hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+) (storage.TimeSeriesPruneSummary, error) {
+	if snapshot == nil {
+		m.t.Fatal("EstimatePrune was passed a nil snapshot")
+	}
+	return storage.TimeSeriesPruneSummary{}, nil
+}
+
+func (m *modelTimeSeriesDataStore) ListTimeSeriesNames(
+	ctx context.Context, snapshot engine.Reader, start, end roachpb.RKey,
+) ([]string, error) {
+	if snapshot == nil {
+		m.t.Fatal("ListTimeSeriesNames was passed a nil snapshot")
+	}
+	return []string{"model.series"}, nil
+}
+
 func (m *modelTimeSeriesDataStore) PruneTimeSeries(
 	ctx context.Context,
 	snapshot engine.Reader,
 	start, end roachpb.RKey,
+	_ string,
 	db *client.DB,
 	now hlc.Timestamp,
+	_ storage.TimeSeriesPruneOptions,
 ) error {
 	if snapshot == nil {
 		m.t.Fatal("PruneTimeSeries was passed a nil snapshot")
@@ -86,6 +148,23 @@ func (m *modelTimeSeriesDataStore) PruneTimeSeries(
 	return nil
 }
 
+func (m *modelTimeSeriesDataStore) PruneTimeSeriesSources(
+	context.Context, engine.Reader, roachpb.RKey, roachpb.RKey, []string, *client.DB,
+	storage.TimeSeriesDeleteLimiter,
+) (storage.TimeSeriesSourcePruneSummary, error) {
+	return storage.TimeSeriesSourcePruneSummary{}, nil
+}
+
+func (m *modelTimeSeriesDataStore) KnownTimeSeriesNames() (map[string]struct{}, bool) {
+	return nil, false
+}
+
+func (m *modelTimeSeriesDataStore) CompactionCutoffs(
+	hlc.Timestamp, storage.TimeSeriesRetention,
+) []engine.TimeSeriesCutoff {
+	return nil
+}
+
 // TestTimeSeriesMaintenanceQueue verifies shouldQueue and process method
 // pass the correct data to the store's TimeSeriesData
 func TestTimeSeriesMaintenanceQueue(t *testing.T) {
@@ -198,8 +277,10 @@ func TestTimeSeriesMaintenanceQueue(t *testing.T) {
 	}
 	model.Unlock()
 
-	// Move clock forward and force to scan again.
-	manual.Increment(storage.TimeSeriesMaintenanceInterval.Nanoseconds())
+	// Move clock forward and force to scan again. The interval of each replica
+	// is jittered by up to a fraction of TimeSeriesMaintenanceInterval, so the
+	// clock is moved forward far enough for every replica to be due.
+	manual.Increment(2 * storage.TimeSeriesMaintenanceInterval.Nanoseconds())
 	store.ForceTimeSeriesMaintenanceQueueProcess()
 	testutils.SucceedsSoon(t, func() error {
 		model.Lock()
@@ -214,6 +295,302 @@ func TestTimeSeriesMaintenanceQueue(t *testing.T) {
 	})
 }
 
+// TestTimeSeriesMaintenanceQueueForce verifies that a replica can be forced
+// through time series maintenance regardless of when it was last processed.
+func TestTimeSeriesMaintenanceQueueForce(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	model := &modelTimeSeriesDataStore{
+		t:                  t,
+		pruneSeenStartKeys: make(map[string]struct{}),
+		pruneSeenEndKeys:   make(map[string]struct{}),
+	}
+
+	manual := hlc.NewManualClock(1)
+	cfg := storage.TestStoreConfig(hlc.NewClock(manual.UnixNano, time.Nanosecond))
+	cfg.TimeSeriesDataStore = model
+	cfg.TestingKnobs.DisableScanner = true
+	cfg.TestingKnobs.DisableSplitQueue = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	store := createTestStoreWithConfig(t, stopper, cfg)
+
+	splitKeys := []roachpb.Key{roachpb.Key("b"), roachpb.Key("a")}
+	for _, k := range splitKeys {
+		repl := store.LookupReplica(roachpb.RKey(k), nil)
+		args := adminSplitArgs(k, k)
+		if _, pErr := client.SendWrappedWith(context.Background(), store, roachpb.Header{
+			RangeID: repl.RangeID,
+		}, args); pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if _, ok := store.Gossip().GetSystemConfig(); !ok {
+			return fmt.Errorf("system config not yet available")
+		}
+		return nil
+	})
+	repl := store.LookupReplica(roachpb.RKey("a"), nil)
+
+	// Force the replica twice. The second run happens well within
+	// TimeSeriesMaintenanceInterval of the first, so would be skipped by the
+	// scanner.
+	for i := 1; i <= 2; i++ {
+		manual.Increment(1)
+		now := store.Clock().Now()
+		if _, err := store.ForceTimeSeriesMaintenance(context.TODO(), repl.RangeID); err != nil {
+			t.Fatal(err)
+		}
+		testutils.SucceedsSoon(t, func() error {
+			model.Lock()
+			defer model.Unlock()
+			if a, e := model.pruneCalled, i; a != e {
+				return errors.Errorf("PruneTimeSeries called %d times; expected %d", a, e)
+			}
+			return nil
+		})
+		testutils.SucceedsSoon(t, func() error {
+			ts, err := repl.GetQueueLastProcessed(context.TODO(), "timeSeriesMaintenance")
+			if err != nil {
+				return err
+			}
+			if ts.Less(now) {
+				return errors.Errorf("expected last processed %s > %s", ts, now)
+			}
+			return nil
+		})
+	}
+
+	model.Lock()
+	defer model.Unlock()
+	if a, e := model.pruneSeenStartKeys, map[string]struct{}{splitKeys[1].String(): {}}; !reflect.DeepEqual(a, e) {
+		t.Errorf("start keys seen by PruneTimeSeries did not match expectation: %s", pretty.Diff(a, e))
+	}
+	if a, e := model.pruneSeenEndKeys, map[string]struct{}{splitKeys[0].String(): {}}; !reflect.DeepEqual(a, e) {
+		t.Errorf("end keys seen by PruneTimeSeries did not match expectation: %s", pretty.Diff(a, e))
+	}
+}
+
+// snapshotRecordingTimeSeriesDataStore is a modelTimeSeriesDataStore which
+// records the keys that PruneTimeSeries finds in the snapshots it is passed.
+type snapshotRecordingTimeSeriesDataStore struct {
+	*modelTimeSeriesDataStore
+	prunedKeys []string
+}
+
+func (s *snapshotRecordingTimeSeriesDataStore) PruneTimeSeries(
+	ctx context.Context,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	name string,
+	db *client.DB,
+	now hlc.Timestamp,
+	opts storage.TimeSeriesPruneOptions,
+) error {
+	var keys []string
+	if err := snapshot.Iterate(
+		engine.MakeMVCCMetadataKey(start.AsRawKey()),
+		engine.MakeMVCCMetadataKey(end.AsRawKey()),
+		func(kv engine.MVCCKeyValue) (bool, error) {
+			keys = append(keys, string(kv.Key.Key))
+			return false, nil
+		},
+	); err != nil {
+		return err
+	}
+	s.Lock()
+	s.prunedKeys = append(s.prunedKeys, keys...)
+	s.Unlock()
+	return s.modelTimeSeriesDataStore.PruneTimeSeries(ctx, snapshot, start, end, name, db, now, opts)
+}
+
+// TestTimeSeriesMaintenanceQueueSnapshotOverride verifies that the testing
+// knobs substitute a prepared reader for the snapshot of the store's engine
+// which the time series maintenance queue prunes from, and report the span and
+// timestamp of each prune.
+func TestTimeSeriesMaintenanceQueueSnapshotOverride(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	// The canned reader holds data the store doesn't.
+	canned := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	stopper.AddCloser(canned)
+	cannedKeys := []string{"a1", "a2", "a3"}
+	for _, k := range cannedKeys {
+		key := engine.MVCCKey{Key: roachpb.Key(k), Timestamp: hlc.Timestamp{WallTime: 1}}
+		if err := canned.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	model := &snapshotRecordingTimeSeriesDataStore{
+		modelTimeSeriesDataStore: &modelTimeSeriesDataStore{
+			t:                  t,
+			pruneSeenStartKeys: make(map[string]struct{}),
+			pruneSeenEndKeys:   make(map[string]struct{}),
+		},
+	}
+	type pruneEvent struct {
+		span roachpb.RSpan
+		now  hlc.Timestamp
+	}
+	var mu syncutil.Mutex
+	var events []pruneEvent
+
+	manual := hlc.NewManualClock(1)
+	cfg := storage.TestStoreConfig(hlc.NewClock(manual.UnixNano, time.Nanosecond))
+	cfg.TimeSeriesDataStore = model
+	cfg.TestingKnobs.DisableScanner = true
+	cfg.TestingKnobs.DisableSplitQueue = true
+	cfg.TestingKnobs.TimeSeriesDataStoreSnapshotOverride = func(engine.Engine) engine.Reader {
+		// The queue closes the reader, so it is given a snapshot of the
+		// canned engine rather than the engine itself.
+		return canned.NewSnapshot()
+	}
+	cfg.TestingKnobs.TimeSeriesPruneEvent = func(span roachpb.RSpan, now hlc.Timestamp) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, pruneEvent{span: span, now: now})
+	}
+	store := createTestStoreWithConfig(t, stopper, cfg)
+
+	// The store's own data in the range isn't seen by the prune.
+	if _, pErr := client.SendWrapped(
+		context.Background(), rg1(store), putArgs(roachpb.Key("a-live"), []byte("value")),
+	); pErr != nil {
+		t.Fatal(pErr)
+	}
+	for _, k := range []roachpb.Key{roachpb.Key("a"), roachpb.Key("b")} {
+		repl := store.LookupReplica(roachpb.RKey(k), nil)
+		if _, pErr := client.SendWrappedWith(context.Background(), store, roachpb.Header{
+			RangeID: repl.RangeID,
+		}, adminSplitArgs(k, k)); pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+
+	repl := store.LookupReplica(roachpb.RKey("a"), nil)
+	manual.Increment(1)
+	now := store.Clock().Now()
+	if _, err := store.ForceTimeSeriesMaintenance(context.TODO(), repl.RangeID); err != nil {
+		t.Fatal(err)
+	}
+
+	model.Lock()
+	if !reflect.DeepEqual(model.prunedKeys, cannedKeys) {
+		t.Errorf("expected the prune to see %v, got %v", cannedKeys, model.prunedKeys)
+	}
+	model.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 prune, got %+v", events)
+	}
+	expSpan := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("b")}
+	if !events[0].span.Equal(expSpan) {
+		t.Errorf("expected the prune of %s, got %s", expSpan, events[0].span)
+	}
+	if events[0].now.Less(now) {
+		t.Errorf("expected the prune at or after %s, got %s", now, events[0].now)
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueSplit verifies that when a range splits after
+// it is pruned and before its last processed time is recorded, the time is
+// recorded for the left-hand side, and the right-hand side is queued for
+// maintenance of its own, after which neither is maintained again.
+func TestTimeSeriesMaintenanceQueueSplit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	model := &modelTimeSeriesDataStore{
+		t:                  t,
+		pruneSeenStartKeys: make(map[string]struct{}),
+		pruneSeenEndKeys:   make(map[string]struct{}),
+	}
+
+	manual := hlc.NewManualClock(1)
+	cfg := storage.TestStoreConfig(hlc.NewClock(manual.UnixNano, time.Nanosecond))
+	cfg.TimeSeriesDataStore = model
+	cfg.TestingKnobs.DisableScanner = true
+	cfg.TestingKnobs.DisableSplitQueue = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	store := createTestStoreWithConfig(t, stopper, cfg)
+	testutils.SucceedsSoon(t, func() error {
+		if _, ok := store.Gossip().GetSystemConfig(); !ok {
+			return fmt.Errorf("system config not yet available")
+		}
+		return nil
+	})
+
+	// Split the range once it has been pruned. Only the first pass splits.
+	splitKey := roachpb.Key("b")
+	lhs := store.LookupReplica(roachpb.RKeyMin, nil)
+	var split bool
+	store.SetTimeSeriesMaintenanceBeforeLastProcessed(func() error {
+		if split {
+			return nil
+		}
+		split = true
+		_, pErr := client.SendWrappedWith(context.Background(), store, roachpb.Header{
+			RangeID: lhs.RangeID,
+		}, adminSplitArgs(splitKey, splitKey))
+		return pErr.GoError()
+	})
+
+	manual.Increment(1)
+	now := store.Clock().Now()
+	if _, err := store.ForceTimeSeriesMaintenance(context.TODO(), lhs.RangeID); err != nil {
+		t.Fatal(err)
+	}
+	rhs := store.LookupReplica(roachpb.RKey(splitKey), nil)
+	if rhs == nil || rhs.RangeID == lhs.RangeID {
+		t.Fatalf("expected the range to be split at %s", splitKey)
+	}
+
+	// The right-hand side is maintained without waiting for the scanner.
+	checkConverged := func() error {
+		model.Lock()
+		defer model.Unlock()
+		if a, e := model.pruneCalled, 2; a != e {
+			return errors.Errorf("PruneTimeSeries called %d times; expected %d", a, e)
+		}
+		if a, e := model.pruneSeenStartKeys, map[string]struct{}{
+			roachpb.KeyMin.String(): {}, splitKey.String(): {},
+		}; !reflect.DeepEqual(a, e) {
+			return errors.Errorf("start keys seen by PruneTimeSeries did not match expectation: %s",
+				pretty.Diff(a, e))
+		}
+		return nil
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if err := checkConverged(); err != nil {
+			return err
+		}
+		for _, repl := range []*storage.Replica{lhs, rhs} {
+			ts, err := repl.GetQueueLastProcessed(context.TODO(), "timeSeriesMaintenance")
+			if err != nil {
+				return err
+			}
+			if ts.Less(now) {
+				return errors.Errorf("%s: expected last processed %s > %s", repl, ts, now)
+			}
+		}
+		return nil
+	})
+
+	// Neither side is due again.
+	store.ForceTimeSeriesMaintenanceQueueProcess()
+	if err := checkConverged(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // TestTimeSeriesMaintenanceQueueServer verifies that the time series
 // maintenance queue runs correctly on a test server.
 func TestTimeSeriesMaintenanceQueueServer(t *testing.T) {
@@ -318,3 +695,208 @@ func TestTimeSeriesMaintenanceQueueServer(t *testing.T) {
 		return nil
 	})
 }
+
+// TestForceTimeSeriesMaintenanceResult verifies that manually forced time
+// series maintenance reports its work, and that pruning reduces the on-disk
+// size of the time series data.
+func TestForceTimeSeriesMaintenanceResult(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			Store: &storage.StoreTestingKnobs{
+				DisableScanner: true,
+			},
+		},
+	})
+	defer s.Stopper().Stop(context.TODO())
+	tsrv := s.(*server.TestServer)
+	tsdb := tsrv.TsDB()
+
+	// Populate a series with one datapoint in each of many slabs, all older
+	// than the pruning threshold, and one recent datapoint.
+	const numSlabs = 1000
+	seriesName := "test.metric"
+	sourceName := "source1"
+	now := tsrv.Clock().PhysicalNow()
+	farPast := now - (ts.Resolution10s.PruneThreshold() * 2)
+	slabDuration := ts.Resolution10s.SlabDuration()
+	var datapoints []tspb.TimeSeriesDatapoint
+	for i := numSlabs; i > 0; i-- {
+		datapoints = append(datapoints, tspb.TimeSeriesDatapoint{
+			TimestampNanos: farPast - int64(i)*slabDuration,
+			Value:          float64(i),
+		})
+	}
+	datapoints = append(datapoints, tspb.TimeSeriesDatapoint{TimestampNanos: now, Value: 1})
+	if err := tsdb.StoreData(context.TODO(), ts.Resolution10s, []tspb.TimeSeriesData{
+		{
+			Name:       seriesName,
+			Source:     sourceName,
+			Datapoints: datapoints,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := tsrv.Stores().GetStore(roachpb.StoreID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ts.MakeDataKey(seriesName, sourceName, ts.Resolution10s, farPast)
+	repl := store.LookupReplica(roachpb.RKey(key), nil)
+	result, err := store.ForceTimeSeriesMaintenance(context.TODO(), repl.RangeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.RangeID != repl.RangeID {
+		t.Errorf("expected result for r%d, got r%d", repl.RangeID, result.RangeID)
+	}
+	if result.Prune.SeriesPruned == 0 {
+		t.Errorf("expected at least one series to be pruned, got %+v", result.Prune)
+	}
+	if _, ok := result.Prune.Thresholds[ts.Resolution10s.String()]; !ok {
+		t.Errorf("expected a pruning threshold for resolution %s, got %+v",
+			ts.Resolution10s, result.Prune.Thresholds)
+	}
+	if !result.Compacted {
+		t.Error("expected the time series data to be compacted")
+	}
+	if result.DiskBytesBefore == 0 || result.DiskBytesAfter >= result.DiskBytesBefore {
+		t.Errorf("expected disk bytes to decrease from a non-zero size, got %d -> %d",
+			result.DiskBytesBefore, result.DiskBytesAfter)
+	}
+}
+
+// TestPruneTimeSeriesSources verifies that pruning the time series sources of
+// a replica deletes all of their data, and only theirs.
+func TestPruneTimeSeriesSources(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, _, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			Store: &storage.StoreTestingKnobs{
+				DisableScanner: true,
+			},
+		},
+	})
+	defer s.Stopper().Stop(context.TODO())
+	tsrv := s.(*server.TestServer)
+
+	// Recent data isn't pruned by maintenance, but is deleted with its source.
+	seriesName := "test.metric"
+	now := tsrv.Clock().PhysicalNow()
+	var data []tspb.TimeSeriesData
+	for _, source := range []string{"live", "dead"} {
+		data = append(data, tspb.TimeSeriesData{
+			Name:       seriesName,
+			Source:     source,
+			Datapoints: []tspb.TimeSeriesDatapoint{{TimestampNanos: now, Value: 1}},
+		})
+	}
+	if err := tsrv.TsDB().StoreData(context.TODO(), ts.Resolution10s, data); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := tsrv.Stores().GetStore(roachpb.StoreID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveKey := ts.MakeDataKey(seriesName, "live", ts.Resolution10s, now)
+	deadKey := ts.MakeDataKey(seriesName, "dead", ts.Resolution10s, now)
+	repl := store.LookupReplica(roachpb.RKey(deadKey), nil)
+	summary, err := store.PruneTimeSeriesSources(context.TODO(), repl.RangeID, []string{"dead"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.KeysDeleted != 1 || summary.KeysDeletedBySource["dead"] != 1 {
+		t.Errorf("expected a key of the dead source to be deleted, got %+v", summary)
+	}
+	if a := store.Metrics().TimeSeriesMaintenanceQueueSourcePrunedKeys.Count(); a != 1 {
+		t.Errorf("expected 1 pruned key to be counted, got %d", a)
+	}
+
+	for _, c := range []struct {
+		key    roachpb.Key
+		exists bool
+	}{
+		{liveKey, true},
+		{deadKey, false},
+	} {
+		value, _, err := engine.MVCCGet(
+			context.TODO(), store.Engine(), c.key, hlc.Timestamp{}, true /* consistent */, nil, /* txn */
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists := value != nil; exists != c.exists {
+			t.Errorf("expected the key %s to exist %t, got %t", c.key, c.exists, exists)
+		}
+	}
+}
+
+// TestTimeSeriesMaintenanceQueueLowDisk verifies that the time series
+// maintenance queue accelerates while the store's available capacity is low
+// and reverts to normal operation when capacity recovers.
+func TestTimeSeriesMaintenanceQueueLowDisk(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	model := &modelTimeSeriesDataStore{
+		t:                  t,
+		pruneSeenStartKeys: make(map[string]struct{}),
+		pruneSeenEndKeys:   make(map[string]struct{}),
+	}
+
+	manual := hlc.NewManualClock(1)
+	cfg := storage.TestStoreConfig(hlc.NewClock(manual.UnixNano, time.Nanosecond))
+	cfg.TimeSeriesDataStore = model
+	cfg.TestingKnobs.DisableScanner = true
+	cfg.TestingKnobs.DisableSplitQueue = true
+	cfg.TestingKnobs.DisableLastProcessedCheck = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	store := createTestStoreWithConfig(t, stopper, cfg)
+	repl := store.LookupReplica(roachpb.RKeyMin, nil)
+	metrics := store.Metrics()
+
+	for i, tc := range []struct {
+		available   int64
+		accelerated bool
+	}{
+		{available: 500, accelerated: false},
+		{available: 50, accelerated: true},
+		{available: 50, accelerated: true},
+		{available: 500, accelerated: false},
+	} {
+		metrics.Capacity.Update(1000)
+		metrics.Available.Update(tc.available)
+
+		if a, e := store.TimeSeriesMaintenanceQueueAccelerated(), tc.accelerated; a != e {
+			t.Fatalf("%d: accelerated = %t; expected %t", i, a, e)
+		}
+		var expGauge int64
+		if tc.accelerated {
+			expGauge = 1
+		}
+		if a, e := metrics.TimeSeriesMaintenanceQueueAccelerated.Value(), expGauge; a != e {
+			t.Fatalf("%d: accelerated gauge = %d; expected %d", i, a, e)
+		}
+
+		shouldQ, priority := store.TimeSeriesMaintenanceQueueShouldQueue(
+			context.TODO(), store.Clock().Now(), repl,
+		)
+		if !shouldQ {
+			t.Fatalf("%d: expected replica to be queued", i)
+		}
+		if a := priority > 0; a != tc.accelerated {
+			t.Fatalf("%d: priority %f boosted = %t; expected %t", i, priority, a, tc.accelerated)
+		}
+
+		// The pacing floor is bypassed only while accelerated.
+		if a, e := store.TimeSeriesMaintenanceQueueTimer(0) == 0, tc.accelerated; a != e {
+			t.Fatalf("%d: zero pacing = %t; expected %t", i, a, e)
+		}
+	}
+}
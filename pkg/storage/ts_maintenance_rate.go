@@ -0,0 +1,240 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+const (
+	// deleteRateAdjustInterval is the minimum interval between two
+	// adjustments of the delete rate. It is on the order of the window of the
+	// store's latency histograms, so that each adjustment observes the effect
+	// of the previous one.
+	deleteRateAdjustInterval = 10 * time.Second
+	// deleteRateDecreaseFactor is applied to the delete rate when the latency
+	// increase exceeds the target.
+	deleteRateDecreaseFactor = 0.5
+	// deleteRateIncreaseFactor is applied to the delete rate when the latency
+	// increase is below half of the target.
+	deleteRateIncreaseFactor = 1.2
+	// deleteRateLatencyQuantile is the quantile of the store's raft command
+	// commit latency used as the foreground latency signal.
+	deleteRateLatencyQuantile = 99
+)
+
+// timeSeriesMaintenanceTargetLatencyIncrease is the increase in foreground
+// latency which pruning may cause while adapting its delete rate.
+var timeSeriesMaintenanceTargetLatencyIncrease = settings.RegisterNonNegativeDurationSetting(
+	"timeseries.maintenance.target_latency_increase",
+	"target increase in p99 raft command commit latency while pruning time series, "+
+		"to which the delete rate adapts (0 disables adaptation)",
+	20*time.Millisecond,
+)
+
+// timeSeriesMaintenanceMinDeleteRate and timeSeriesMaintenanceMaxDeleteRate
+// bound the delete rate while it adapts to foreground latency.
+var timeSeriesMaintenanceMinDeleteRate = settings.RegisterNonNegativeFloatSetting(
+	"timeseries.maintenance.min_delete_rate",
+	"minimum number of time series deletion batches issued per second by adaptive pruning",
+	1,
+)
+
+var timeSeriesMaintenanceMaxDeleteRate = settings.RegisterNonNegativeFloatSetting(
+	"timeseries.maintenance.max_delete_rate",
+	"maximum number of time series deletion batches issued per second by adaptive pruning",
+	100,
+)
+
+// adjustDeleteRate returns the delete rate which should follow the current
+// rate, given the increase in foreground latency observed since pruning
+// started. The rate is decreased multiplicatively when the increase exceeds
+// the target, increased when it is comfortably below the target, and is
+// always kept within [minRate, maxRate].
+func adjustDeleteRate(
+	current float64, latencyIncrease, target time.Duration, minRate, maxRate float64,
+) float64 {
+	next := current
+	if latencyIncrease > target {
+		next *= deleteRateDecreaseFactor
+	} else if latencyIncrease < target/2 {
+		next *= deleteRateIncreaseFactor
+	}
+	return clampDeleteRate(next, minRate, maxRate)
+}
+
+// clampDeleteRate returns the delete rate limited to [minRate, maxRate]. If
+// the bounds are inverted, minRate takes precedence.
+func clampDeleteRate(r, minRate, maxRate float64) float64 {
+	if r > maxRate {
+		r = maxRate
+	}
+	if r < minRate {
+		r = minRate
+	}
+	return r
+}
+
+// deleteRateController paces the deletions issued by time series pruning. When
+// timeSeriesMaintenanceTargetLatencyIncrease is set, it acts as a feedback
+// controller: a foreground latency baseline is sampled at the start of a pass
+// while no other pass is running, the latency is sampled again while pruning
+// waits to issue deletions, and the delete rate is adjusted to keep the
+// difference under the target. The passes running concurrently share the
+// baseline, as one sampled while another pass deletes would already include
+// the latency caused by its deletions. The learned rate is retained across
+// passes. Otherwise, the static rate from
+// timeSeriesMaintenanceDeleteRate is used.
+type deleteRateController struct {
+	// latencyFn returns the current foreground latency signal.
+	latencyFn func() time.Duration
+	// rateGauge reports the effective delete rate; zero if unlimited.
+	rateGauge *metric.GaugeFloat64
+	// adjustInterval is the minimum interval between two adjustments.
+	adjustInterval time.Duration
+	limiter        *rate.Limiter
+
+	mu struct {
+		syncutil.Mutex
+		// adaptive is true while the current pass adapts its rate.
+		adaptive bool
+		// learned is the adapted rate, excluding any acceleration. It is zero
+		// until the first adaptive pass.
+		learned float64
+		// multiplier is applied to the learned rate to obtain the effective
+		// rate, accelerating pruning while the store is low on disk.
+		multiplier float64
+		// passes is the number of passes running.
+		passes int
+		// baseline is the latency sampled at the start of the first of the
+		// running passes, if sampled is set.
+		baseline     time.Duration
+		sampled      bool
+		lastAdjusted time.Time
+	}
+}
+
+func newDeleteRateController(
+	latencyFn func() time.Duration, rateGauge *metric.GaugeFloat64,
+) *deleteRateController {
+	return &deleteRateController{
+		latencyFn:      latencyFn,
+		rateGauge:      rateGauge,
+		adjustInterval: deleteRateAdjustInterval,
+		limiter:        rate.NewLimiter(rate.Inf, 1 /* burst */),
+	}
+}
+
+// latencyFromHistogram returns a function sampling the supplied quantile of the
+// windowed latency histogram.
+func latencyFromHistogram(h *metric.Histogram, quantile float64) func() time.Duration {
+	return func() time.Duration {
+		windowed, _ := h.Windowed()
+		return time.Duration(windowed.ValueAtQuantile(quantile))
+	}
+}
+
+// startPass prepares the controller for a pruning pass and returns the limiter
+// which the pass should wait on before each deletion batch. Each call must be
+// followed by one to endPass once the pass is done.
+func (c *deleteRateController) startPass(accelerated bool) TimeSeriesDeleteLimiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mu.passes++
+	c.mu.multiplier = 1
+	if accelerated {
+		c.mu.multiplier = timeSeriesMaintenanceAcceleratedDeleteRateMultiplier
+	}
+	initial := timeSeriesMaintenanceDeleteRate.Get()
+	c.mu.adaptive = initial > 0 && timeSeriesMaintenanceTargetLatencyIncrease.Get() > 0
+	switch {
+	case initial <= 0:
+		c.setRateLocked(0)
+	case !c.mu.adaptive:
+		c.setRateLocked(initial * c.mu.multiplier)
+	default:
+		if c.mu.learned == 0 {
+			c.mu.learned = clampDeleteRate(
+				initial, timeSeriesMaintenanceMinDeleteRate.Get(),
+				timeSeriesMaintenanceMaxDeleteRate.Get(),
+			)
+		}
+		if !c.mu.sampled {
+			c.mu.baseline = c.latencyFn()
+			c.mu.sampled = true
+			c.mu.lastAdjusted = timeutil.Now()
+		}
+		c.setRateLocked(c.mu.learned * c.mu.multiplier)
+	}
+	return c
+}
+
+// endPass records the end of a pass started by startPass. Once no pass is
+// running, the next one samples a new baseline.
+func (c *deleteRateController) endPass() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.passes--; c.mu.passes == 0 {
+		c.mu.sampled = false
+	}
+}
+
+// setRateLocked sets the effective delete rate, where zero means unlimited.
+func (c *deleteRateController) setRateLocked(r float64) {
+	if r <= 0 {
+		c.limiter.SetLimit(rate.Inf)
+	} else {
+		c.limiter.SetLimit(rate.Limit(r))
+	}
+	c.rateGauge.Update(r)
+}
+
+// maybeAdjust samples the latency signal and, if the adjust interval has
+// elapsed, adjusts the delete rate of an adaptive pass.
+func (c *deleteRateController) maybeAdjust(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.mu.adaptive || timeutil.Since(c.mu.lastAdjusted) < c.adjustInterval {
+		return
+	}
+	increase := c.latencyFn() - c.mu.baseline
+	prev := c.mu.learned
+	c.mu.learned = adjustDeleteRate(
+		prev, increase, timeSeriesMaintenanceTargetLatencyIncrease.Get(),
+		timeSeriesMaintenanceMinDeleteRate.Get(), timeSeriesMaintenanceMaxDeleteRate.Get(),
+	)
+	c.mu.lastAdjusted = timeutil.Now()
+	if c.mu.learned != prev {
+		log.VEventf(ctx, 2, "latency increased by %s while pruning; adjusted delete rate from %.2f to %.2f",
+			increase, prev, c.mu.learned)
+		c.setRateLocked(c.mu.learned * c.mu.multiplier)
+	}
+}
+
+// Wait implements TimeSeriesDeleteLimiter.
+func (c *deleteRateController) Wait(ctx context.Context) error {
+	c.maybeAdjust(ctx)
+	return c.limiter.Wait(ctx)
+}
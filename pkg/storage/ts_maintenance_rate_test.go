@@ -0,0 +1,141 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+func rateEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestAdjustDeleteRate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const target = 20 * time.Millisecond
+	testCases := []struct {
+		current  float64
+		increase time.Duration
+		expected float64
+	}{
+		// Well under the target: speed up.
+		{10, 0, 12},
+		{10, -5 * time.Millisecond, 12},
+		// Close to the target: hold steady.
+		{10, 15 * time.Millisecond, 10},
+		{10, target, 10},
+		// Over the target: back off.
+		{10, 25 * time.Millisecond, 5},
+		// Bounded by the minimum and maximum rates.
+		{1.5, time.Second, 1},
+		{90, 0, 100},
+	}
+	for i, c := range testCases {
+		if a := adjustDeleteRate(c.current, c.increase, target, 1, 100); !rateEqual(a, c.expected) {
+			t.Errorf("%d: expected rate %.2f after latency increase of %s, got %.2f",
+				i, c.expected, c.increase, a)
+		}
+	}
+}
+
+// TestDeleteRateController drives the controller with synthetic latency
+// samples and verifies that it adjusts the effective rate in the expected
+// direction, retaining the learned rate across passes, and that concurrent
+// passes share the baseline of the first of them.
+func TestDeleteRateController(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer settings.TestingSetFloat(&timeSeriesMaintenanceDeleteRate, 10)()
+	defer settings.TestingSetFloat(&timeSeriesMaintenanceMinDeleteRate, 1)()
+	defer settings.TestingSetFloat(&timeSeriesMaintenanceMaxDeleteRate, 100)()
+	defer settings.TestingSetDuration(&timeSeriesMaintenanceTargetLatencyIncrease, 20*time.Millisecond)()
+
+	ctx := context.Background()
+	latency := 10 * time.Millisecond
+	gauge := metric.NewGaugeFloat64(metric.Metadata{Name: "test"})
+	c := newDeleteRateController(func() time.Duration { return latency }, gauge)
+	c.adjustInterval = 0
+
+	expectRate := func(expected float64) {
+		if a := gauge.Value(); !rateEqual(a, expected) {
+			t.Fatalf("expected gauge %.2f, got %.2f", expected, a)
+		}
+		if a := c.limiter.Limit(); !rateEqual(float64(a), expected) {
+			t.Fatalf("expected limit %.2f, got %.2f", expected, a)
+		}
+	}
+	wait := func() {
+		// The limiter is waited on with a canceled context, which adjusts the
+		// rate without waiting for a token.
+		cancelCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		_ = c.Wait(cancelCtx)
+	}
+
+	// The first pass starts at the configured delete rate.
+	c.startPass(false /* accelerated */)
+	expectRate(10)
+
+	// Latency well above the baseline halves the rate.
+	latency = 50 * time.Millisecond
+	wait()
+	expectRate(5)
+	wait()
+	expectRate(2.5)
+
+	// Latency back near the baseline speeds pruning up again.
+	latency = 10 * time.Millisecond
+	wait()
+	expectRate(3)
+
+	// A pass starting while the first runs doesn't sample the latency the
+	// deletions of the first caused as its baseline.
+	latency = 40 * time.Millisecond
+	c.startPass(false /* accelerated */)
+	expectRate(3)
+	wait()
+	expectRate(1.5)
+	c.endPass()
+	c.endPass()
+
+	// The next pass resumes at the learned rate, measured against a new
+	// baseline.
+	c.startPass(false /* accelerated */)
+	expectRate(1.5)
+	wait()
+	expectRate(1.8)
+	c.endPass()
+
+	// Acceleration multiplies the learned rate.
+	c.startPass(true /* accelerated */)
+	expectRate(1.8 * timeSeriesMaintenanceAcceleratedDeleteRateMultiplier)
+	c.endPass()
+
+	// Without a latency target, the static rate applies.
+	defer settings.TestingSetDuration(&timeSeriesMaintenanceTargetLatencyIncrease, 0)()
+	c.startPass(false /* accelerated */)
+	expectRate(10)
+	latency = time.Second
+	wait()
+	expectRate(10)
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// timeSeriesResumeVersion is the version of the encoding of the resume
+// records of the time series maintenance queue.
+const timeSeriesResumeVersion byte = 1
+
+// timeSeriesResumeRecord records the position from which the time series
+// maintenance queue resumes a pass over a replica which was interrupted part
+// way, such as by a restart of the node. It is persisted inline at the
+// range-local keys.QueueResumeKey of the range.
+type timeSeriesResumeRecord struct {
+	// ResumeKey is the first key of the replica's span which may not have
+	// been pruned by the pass.
+	ResumeKey roachpb.RKey
+	// Now is the timestamp of the interrupted pass, which the resumed pass
+	// prunes at, so that the data on either side of ResumeKey is pruned to the
+	// same thresholds.
+	Now hlc.Timestamp
+}
+
+// encodeTimeSeriesResumeRecord encodes a resume record into the versioned
+// format persisted at keys.QueueResumeKey.
+func encodeTimeSeriesResumeRecord(r timeSeriesResumeRecord) []byte {
+	b := []byte{timeSeriesResumeVersion}
+	b = encoding.EncodeVarintAscending(b, r.Now.WallTime)
+	b = encoding.EncodeVarintAscending(b, int64(r.Now.Logical))
+	return encoding.EncodeBytesAscending(b, r.ResumeKey)
+}
+
+// decodeTimeSeriesResumeRecord decodes a resume record encoded by
+// encodeTimeSeriesResumeRecord.
+func decodeTimeSeriesResumeRecord(b []byte) (timeSeriesResumeRecord, error) {
+	var r timeSeriesResumeRecord
+	if len(b) == 0 || b[0] != timeSeriesResumeVersion {
+		return r, errors.Errorf("unknown time series resume record version")
+	}
+	b, wallTime, err := encoding.DecodeVarintAscending(b[1:])
+	if err != nil {
+		return r, err
+	}
+	b, logical, err := encoding.DecodeVarintAscending(b)
+	if err != nil {
+		return r, err
+	}
+	b, resumeKey, err := encoding.DecodeBytesAscending(b, nil)
+	if err != nil {
+		return r, err
+	}
+	if len(b) != 0 {
+		return r, errors.Errorf("%d trailing bytes in time series resume record", len(b))
+	}
+	r.ResumeKey = roachpb.RKey(resumeKey)
+	r.Now = hlc.Timestamp{WallTime: wallTime, Logical: int32(logical)}
+	return r, nil
+}
+
+// loadResume returns the resume record of the replica, if it is usable at
+// now, and whether a record was found at all, usable or not. A record is
+// unusable if its pass began more than TimeSeriesMaintenanceInterval before
+// now, by which time the replica is due for a pass of its own, or if its
+// resume key lies outside of the replica's span. An unreadable record is
+// logged and treated as unusable.
+func (q *timeSeriesMaintenanceQueue) loadResume(
+	ctx context.Context, desc *roachpb.RangeDescriptor, now hlc.Timestamp,
+) (_ *timeSeriesResumeRecord, found bool) {
+	key := keys.QueueResumeKey(desc.StartKey, q.name)
+	value, _, err := engine.MVCCGet(ctx, q.store.Engine(), key, hlc.Timestamp{}, true, nil)
+	if err != nil || value == nil {
+		if err != nil {
+			log.ErrEventf(ctx, "failed to read resume record: %s", err)
+		}
+		return nil, false
+	}
+	b, err := value.GetBytes()
+	if err != nil {
+		log.Warningf(ctx, "ignoring unreadable time series resume record: %s", err)
+		return nil, true
+	}
+	record, err := decodeTimeSeriesResumeRecord(b)
+	if err != nil {
+		log.Warningf(ctx, "ignoring unreadable time series resume record: %s", err)
+		return nil, true
+	}
+	if now.GoTime().Sub(record.Now.GoTime()) > TimeSeriesMaintenanceInterval {
+		log.VEventf(ctx, 2, "ignoring resume record of the pass at %s", record.Now)
+		return nil, true
+	}
+	if record.ResumeKey.Less(desc.StartKey) || !record.ResumeKey.Less(desc.EndKey) {
+		log.VEventf(ctx, 2, "ignoring resume key %s outside of %s", record.ResumeKey, desc)
+		return nil, true
+	}
+	return &record, true
+}
+
+// saveResume records that the pass over the replica at now may resume from
+// the resume key. It is written through the same client as the deletions of
+// the pass, after the responses to them were received.
+func (q *timeSeriesMaintenanceQueue) saveResume(
+	ctx context.Context, desc *roachpb.RangeDescriptor, resumeKey roachpb.RKey, now hlc.Timestamp,
+) error {
+	key := keys.QueueResumeKey(desc.StartKey, q.name)
+	record := timeSeriesResumeRecord{ResumeKey: resumeKey, Now: now}
+	return q.db.PutInline(ctx, key, encodeTimeSeriesResumeRecord(record))
+}
+
+// clearResume deletes the resume record of the replica.
+func (q *timeSeriesMaintenanceQueue) clearResume(
+	ctx context.Context, desc *roachpb.RangeDescriptor,
+) error {
+	key := keys.QueueResumeKey(desc.StartKey, q.name)
+	b := &client.Batch{}
+	b.AddRawRequest(&roachpb.DeleteRangeRequest{
+		Span:   roachpb.Span{Key: key, EndKey: key.Next()},
+		Inline: true,
+	})
+	return q.db.Run(ctx, b)
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// timeSeriesSizeReportLimit is the number of time series, the largest, whose
+// sizes are retained for each replica and listed by a TimeSeriesSizeReport.
+const timeSeriesSizeReportLimit = 20
+
+// TimeSeriesSize measures the data of a time series.
+type TimeSeriesSize struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// NamedTimeSeriesSize is the size of the named time series.
+type NamedTimeSeriesSize struct {
+	Name string `json:"name"`
+	TimeSeriesSize
+}
+
+// smaller orders sizes by bytes, and then by name, so that the order is total.
+func (s NamedTimeSeriesSize) smaller(other NamedTimeSeriesSize) bool {
+	if s.Bytes != other.Bytes {
+		return s.Bytes < other.Bytes
+	}
+	return s.Name > other.Name
+}
+
+// topTimeSeriesSizes retains the largest of the sizes added to it, up to a
+// fixed number of them. It is a min-heap, so that the smallest retained size
+// is the one displaced by a larger size.
+type topTimeSeriesSizes struct {
+	limit int
+	sizes []NamedTimeSeriesSize
+}
+
+var _ heap.Interface = &topTimeSeriesSizes{}
+
+func (t *topTimeSeriesSizes) Len() int           { return len(t.sizes) }
+func (t *topTimeSeriesSizes) Less(i, j int) bool { return t.sizes[i].smaller(t.sizes[j]) }
+func (t *topTimeSeriesSizes) Swap(i, j int)      { t.sizes[i], t.sizes[j] = t.sizes[j], t.sizes[i] }
+
+func (t *topTimeSeriesSizes) Push(x interface{}) {
+	t.sizes = append(t.sizes, x.(NamedTimeSeriesSize))
+}
+
+func (t *topTimeSeriesSizes) Pop() interface{} {
+	old := t.sizes
+	n := len(old)
+	x := old[n-1]
+	t.sizes = old[:n-1]
+	return x
+}
+
+// add retains the size if it is among the largest added so far.
+func (t *topTimeSeriesSizes) add(size NamedTimeSeriesSize) {
+	if len(t.sizes) < t.limit {
+		heap.Push(t, size)
+		return
+	}
+	if t.limit == 0 || !t.sizes[0].smaller(size) {
+		return
+	}
+	t.sizes[0] = size
+	heap.Fix(t, 0)
+}
+
+// sorted empties t, returning the retained sizes, largest first.
+func (t *topTimeSeriesSizes) sorted() []NamedTimeSeriesSize {
+	sorted := make([]NamedTimeSeriesSize, len(t.sizes))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(t).(NamedTimeSeriesSize)
+	}
+	return sorted
+}
+
+// TimeSeriesSizeReplica identifies a replica whose time series sizes are
+// included in a TimeSeriesSizeReport, and when they were measured.
+type TimeSeriesSizeReplica struct {
+	RangeID  roachpb.RangeID `json:"range_id"`
+	Measured hlc.Timestamp   `json:"measured"`
+}
+
+// TimeSeriesSizeReport lists the largest time series on a store, as measured
+// by the time series maintenance queue, which measures the time series of a
+// replica each time it maintains it. Only the largest time series of each
+// replica are retained, so a time series whose data is small in every replica
+// may be missing from the report, and the sizes of those listed are lower
+// bounds.
+type TimeSeriesSizeReport struct {
+	// Series are the sizes of the largest time series, summed over the
+	// replicas, largest first.
+	Series []NamedTimeSeriesSize `json:"series"`
+	// Replicas are the replicas whose sizes were summed, ordered by range ID.
+	Replicas []TimeSeriesSizeReplica `json:"replicas"`
+}
+
+// replicaTimeSeriesSizes is the record of the sizes of the largest time series
+// of a replica. The bounds of the descriptor the sizes were measured for are
+// stored alongside them, so that they are not reported after the range splits
+// or merges.
+type replicaTimeSeriesSizes struct {
+	startKey, endKey roachpb.RKey
+	measured         hlc.Timestamp
+	sizes            []NamedTimeSeriesSize
+}
+
+// timeSeriesSizeTracker holds the sizes of the largest time series of each
+// replica, as last measured by its maintenance.
+type timeSeriesSizeTracker struct {
+	// limit is the number of time series retained for each replica and
+	// reported.
+	limit int
+
+	mu struct {
+		syncutil.Mutex
+		replicas map[roachpb.RangeID]replicaTimeSeriesSizes
+	}
+}
+
+func newTimeSeriesSizeTracker(limit int) *timeSeriesSizeTracker {
+	t := &timeSeriesSizeTracker{limit: limit}
+	t.mu.replicas = make(map[roachpb.RangeID]replicaTimeSeriesSizes)
+	return t
+}
+
+// record replaces the sizes of the replica described by desc with the largest
+// of the supplied sizes, measured at the supplied time. Series without data
+// are omitted. Unless the sizes are complete, measuring every series of the
+// replica, the sizes last recorded for the series they lack are retained, as
+// long as the replica's bounds haven't changed.
+func (t *timeSeriesSizeTracker) record(
+	desc *roachpb.RangeDescriptor,
+	measured hlc.Timestamp,
+	sizes map[string]TimeSeriesSize,
+	complete bool,
+) {
+	top := topTimeSeriesSizes{limit: t.limit}
+	for name, size := range sizes {
+		if size != (TimeSeriesSize{}) {
+			top.add(NamedTimeSeriesSize{Name: name, TimeSeriesSize: size})
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.mu.replicas[desc.RangeID]; ok && !complete &&
+		desc.StartKey.Equal(prev.startKey) && desc.EndKey.Equal(prev.endKey) {
+		for _, s := range prev.sizes {
+			if _, ok := sizes[s.Name]; !ok {
+				top.add(s)
+			}
+		}
+	}
+	t.mu.replicas[desc.RangeID] = replicaTimeSeriesSizes{
+		startKey: desc.StartKey,
+		endKey:   desc.EndKey,
+		measured: measured,
+		sizes:    top.sorted(),
+	}
+}
+
+// report sums the sizes recorded for the replicas, and returns the largest
+// time series. descFn returns the current descriptor of the replica of a
+// range, or nil if the store no longer has one; the sizes of replicas which
+// were removed, or whose bounds have changed since they were measured, are
+// discarded.
+func (t *timeSeriesSizeTracker) report(
+	descFn func(roachpb.RangeID) *roachpb.RangeDescriptor,
+) TimeSeriesSizeReport {
+	var report TimeSeriesSizeReport
+	totals := make(map[string]TimeSeriesSize)
+	t.mu.Lock()
+	for rangeID, r := range t.mu.replicas {
+		desc := descFn(rangeID)
+		if desc == nil || !desc.StartKey.Equal(r.startKey) || !desc.EndKey.Equal(r.endKey) {
+			delete(t.mu.replicas, rangeID)
+			continue
+		}
+		for _, s := range r.sizes {
+			total := totals[s.Name]
+			total.Keys += s.Keys
+			total.Bytes += s.Bytes
+			totals[s.Name] = total
+		}
+		report.Replicas = append(report.Replicas, TimeSeriesSizeReplica{
+			RangeID:  rangeID,
+			Measured: r.measured,
+		})
+	}
+	t.mu.Unlock()
+
+	top := topTimeSeriesSizes{limit: t.limit}
+	for name, size := range totals {
+		top.add(NamedTimeSeriesSize{Name: name, TimeSeriesSize: size})
+	}
+	report.Series = top.sorted()
+	sort.Slice(report.Replicas, func(i, j int) bool {
+		return report.Replicas[i].RangeID < report.Replicas[j].RangeID
+	})
+	return report
+}
+
+// sizeReport returns the report of the sizes of the time series measured by
+// the maintenance of the store's replicas.
+func (q *timeSeriesMaintenanceQueue) sizeReport() TimeSeriesSizeReport {
+	return q.sizes.report(func(rangeID roachpb.RangeID) *roachpb.RangeDescriptor {
+		repl, err := q.store.GetReplica(rangeID)
+		if err != nil {
+			return nil
+		}
+		return repl.Desc()
+	})
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestTopTimeSeriesSizes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	size := func(name string, bytes int64) NamedTimeSeriesSize {
+		return NamedTimeSeriesSize{Name: name, TimeSeriesSize: TimeSeriesSize{Keys: 1, Bytes: bytes}}
+	}
+	testCases := []struct {
+		limit    int
+		sizes    []NamedTimeSeriesSize
+		expected []NamedTimeSeriesSize
+	}{
+		{3, nil, []NamedTimeSeriesSize{}},
+		{0, []NamedTimeSeriesSize{size("a", 1)}, []NamedTimeSeriesSize{}},
+		{
+			3,
+			[]NamedTimeSeriesSize{size("a", 1), size("b", 3), size("c", 2)},
+			[]NamedTimeSeriesSize{size("b", 3), size("c", 2), size("a", 1)},
+		},
+		{
+			2,
+			[]NamedTimeSeriesSize{size("a", 1), size("b", 5), size("c", 2), size("d", 4), size("e", 3)},
+			[]NamedTimeSeriesSize{size("b", 5), size("d", 4)},
+		},
+		// Ties are broken by name.
+		{
+			2,
+			[]NamedTimeSeriesSize{size("c", 1), size("b", 1), size("a", 1)},
+			[]NamedTimeSeriesSize{size("a", 1), size("b", 1)},
+		},
+	}
+	for i, c := range testCases {
+		top := topTimeSeriesSizes{limit: c.limit}
+		for _, s := range c.sizes {
+			top.add(s)
+		}
+		if a := top.sorted(); !reflect.DeepEqual(c.expected, a) {
+			t.Errorf("%d: expected %+v, got %+v", i, c.expected, a)
+		}
+	}
+}
+
+// TestTimeSeriesSizeTrackerReport verifies that the report sums the largest
+// time series of each replica, and discards the sizes of replicas which were
+// removed or whose bounds changed.
+func TestTimeSeriesSizeTrackerReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	descs := map[roachpb.RangeID]*roachpb.RangeDescriptor{
+		1: {RangeID: 1, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("b")},
+		2: {RangeID: 2, StartKey: roachpb.RKey("b"), EndKey: roachpb.RKey("c")},
+		3: {RangeID: 3, StartKey: roachpb.RKey("c"), EndKey: roachpb.RKey("d")},
+	}
+	descFn := func(rangeID roachpb.RangeID) *roachpb.RangeDescriptor {
+		return descs[rangeID]
+	}
+
+	tracker := newTimeSeriesSizeTracker(2)
+	tracker.record(descs[1], hlc.Timestamp{WallTime: 1}, map[string]TimeSeriesSize{
+		"a": {Keys: 10, Bytes: 1000},
+		"b": {Keys: 5, Bytes: 500},
+		"c": {Keys: 1, Bytes: 100},
+	}, true /* complete */)
+	tracker.record(descs[2], hlc.Timestamp{WallTime: 2}, map[string]TimeSeriesSize{
+		"a": {Keys: 10, Bytes: 1000},
+		"c": {Keys: 25, Bytes: 2500},
+		"d": {Keys: 2, Bytes: 200},
+	}, true /* complete */)
+	tracker.record(descs[3], hlc.Timestamp{WallTime: 3}, nil, true /* complete */)
+
+	// Only the two largest series of each replica are retained, so c is
+	// missing the size of its data in r1.
+	expected := TimeSeriesSizeReport{
+		Series: []NamedTimeSeriesSize{
+			{Name: "c", TimeSeriesSize: TimeSeriesSize{Keys: 25, Bytes: 2500}},
+			{Name: "a", TimeSeriesSize: TimeSeriesSize{Keys: 20, Bytes: 2000}},
+		},
+		Replicas: []TimeSeriesSizeReplica{
+			{RangeID: 1, Measured: hlc.Timestamp{WallTime: 1}},
+			{RangeID: 2, Measured: hlc.Timestamp{WallTime: 2}},
+			{RangeID: 3, Measured: hlc.Timestamp{WallTime: 3}},
+		},
+	}
+	if report := tracker.report(descFn); !reflect.DeepEqual(expected, report) {
+		t.Fatalf("expected %+v, got %+v", expected, report)
+	}
+
+	// The sizes of r1 no longer describe it once it splits, and those of r3
+	// are discarded once it is removed.
+	descs[1] = &roachpb.RangeDescriptor{RangeID: 1, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("a5")}
+	delete(descs, 3)
+	expected = TimeSeriesSizeReport{
+		Series: []NamedTimeSeriesSize{
+			{Name: "c", TimeSeriesSize: TimeSeriesSize{Keys: 25, Bytes: 2500}},
+			{Name: "a", TimeSeriesSize: TimeSeriesSize{Keys: 10, Bytes: 1000}},
+		},
+		Replicas: []TimeSeriesSizeReplica{
+			{RangeID: 2, Measured: hlc.Timestamp{WallTime: 2}},
+		},
+	}
+	if report := tracker.report(descFn); !reflect.DeepEqual(expected, report) {
+		t.Fatalf("expected %+v, got %+v", expected, report)
+	}
+	if l := len(tracker.mu.replicas); l != 1 {
+		t.Fatalf("expected the sizes of 1 replica to be retained, got %d", l)
+	}
+}
+
+// TestTimeSeriesSizeTrackerIncomplete verifies that an incomplete measurement
+// of a replica's time series retains the sizes last recorded for the series
+// it lacks, while a complete one replaces them all.
+func TestTimeSeriesSizeTrackerIncomplete(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	desc := &roachpb.RangeDescriptor{RangeID: 1, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("b")}
+	descFn := func(roachpb.RangeID) *roachpb.RangeDescriptor { return desc }
+	tracker := newTimeSeriesSizeTracker(3)
+	tracker.record(desc, hlc.Timestamp{WallTime: 1}, map[string]TimeSeriesSize{
+		"a": {Keys: 10, Bytes: 1000},
+		"b": {Keys: 5, Bytes: 500},
+		"c": {Keys: 1, Bytes: 100},
+	}, true /* complete */)
+
+	// The series left without data by the incomplete measurement is omitted.
+	tracker.record(desc, hlc.Timestamp{WallTime: 2}, map[string]TimeSeriesSize{
+		"b": {Keys: 7, Bytes: 700},
+		"c": {},
+	}, false /* complete */)
+	expected := []NamedTimeSeriesSize{
+		{Name: "a", TimeSeriesSize: TimeSeriesSize{Keys: 10, Bytes: 1000}},
+		{Name: "b", TimeSeriesSize: TimeSeriesSize{Keys: 7, Bytes: 700}},
+	}
+	if report := tracker.report(descFn); !reflect.DeepEqual(expected, report.Series) {
+		t.Fatalf("expected %+v, got %+v", expected, report.Series)
+	}
+
+	tracker.record(desc, hlc.Timestamp{WallTime: 3}, map[string]TimeSeriesSize{
+		"b": {Keys: 8, Bytes: 800},
+	}, true /* complete */)
+	expected = []NamedTimeSeriesSize{
+		{Name: "b", TimeSeriesSize: TimeSeriesSize{Keys: 8, Bytes: 800}},
+	}
+	if report := tracker.report(descFn); !reflect.DeepEqual(expected, report.Series) {
+		t.Fatalf("expected %+v, got %+v", expected, report.Series)
+	}
+}
@@ -31,6 +31,12 @@ import (
 // DB provides Cockroach's Time Series API.
 type DB struct {
 	db *client.DB
+	// rollupIngester, if set, ingests large batches of rollups as SSTs. See
+	// SetRollupIngester.
+	rollupIngester RollupIngester
+	// knownNames are the names of the time series of the metrics registered
+	// by the nodes of the cluster. See GossipKnownNames.
+	knownNames knownNames
 }
 
 // NewDB creates a new DB instance.
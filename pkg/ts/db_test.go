@@ -30,6 +30,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/localtestcluster"
@@ -221,20 +222,24 @@ func (tm *testModel) storeTimeSeriesData(r Resolution, data []tspb.TimeSeriesDat
 // of time series/resolution pairs will be considered for deletion.
 func (tm *testModel) prune(nowNanos int64, timeSeries ...timeSeriesResolutionInfo) {
 	// Prune time series from the system under test.
-	if err := pruneTimeSeries(
+	if _, _, err := pruneTimeSeries(
 		context.TODO(),
+		tm.LocalTestCluster.Eng,
+		roachpb.RKeyMin,
+		roachpb.RKeyMax,
 		tm.LocalTestCluster.DB,
 		timeSeries,
 		hlc.Timestamp{
 			WallTime: nowNanos,
 			Logical:  0,
 		},
+		storage.TimeSeriesPruneOptions{},
 	); err != nil {
 		tm.t.Fatalf("error pruning time series data: %s", err)
 	}
 
 	// Prune data from the model.
-	thresholds := computeThresholds(nowNanos)
+	thresholds := computeThresholds(nowNanos, nil)
 	for k := range tm.modelData {
 		name, _, res, ts, err := DecodeDataKey(roachpb.Key(k))
 		if err != nil {
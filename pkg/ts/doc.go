@@ -90,11 +90,10 @@ different nodes, will be stored contiguously in the key space. Data from all
 sources in a series can thus be queried in a single scan.
 
 
-Unused Feature: Multiple resolutions
+Multiple resolutions
 
-CockroachDB time series database has rudimentary support for a planned feature:
-recording the same series at multiple sample durations, commonly known as a
-"rollup".
+CockroachDB time series database supports recording the same series at multiple
+sample durations, commonly known as a "rollup".
 
 For example, a single series may be recorded with a sample size of 10 seconds,
 but also record the same data with a sample size of 1 hour. The 1 hour data will
@@ -107,10 +106,12 @@ supports a fixed set of Resolutions; each Resolution has a fixed sample duration
 and a slab duration. For example, the resolution "Resolution10s" has a sample
 duration of 10 seconds and a slab duration of 1 hour.
 
-This feature was planned and slightly informs our key structure (resolution
-information is encoded in every time series key); however, all time series in
-CockroachDB are currently recorded at a downsample duration of 10 seconds, and a
-slab duration of 1 hour.
+Resolution information is encoded in every time series key. All time series in
+CockroachDB are recorded at a downsample duration of 10 seconds, and a slab
+duration of 1 hour. Before 10 second data is pruned by the time series
+maintenance queue, it is rolled up into "Resolution30m", which has a sample
+duration of 30 minutes and a slab duration of 1 day, and which is retained for
+much longer.
 
 
 Example
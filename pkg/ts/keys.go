@@ -75,13 +75,18 @@ func MakeDataKey(name string, source string, r Resolution, timestamp int64) roac
 // makeDataKeySeriesPrefix creates a key prefix for a time series at a specific
 // resolution.
 func makeDataKeySeriesPrefix(name string, r Resolution) roachpb.Key {
+	return encoding.EncodeVarintAscending(makeDataKeyNamePrefix(name), int64(r))
+}
+
+// makeDataKeyNamePrefix creates a key prefix for a time series at all
+// resolutions.
+func makeDataKeyNamePrefix(name string) roachpb.Key {
 	k := append(roachpb.Key(nil), keys.TimeseriesPrefix...)
-	k = encoding.EncodeBytesAscending(k, []byte(name))
-	k = encoding.EncodeVarintAscending(k, int64(r))
-	return k
+	return encoding.EncodeBytesAscending(k, []byte(name))
 }
 
-// DecodeDataKey decodes a time series key into its components.
+// DecodeDataKey decodes a time series key into its components. The timestamp
+// of a key of an unknown resolution is zero.
 func DecodeDataKey(key roachpb.Key) (string, string, Resolution, int64, error) {
 	// Detect and remove prefix.
 	remainder := key
@@ -111,7 +116,13 @@ func decodeDataKeySuffix(key roachpb.Key) (string, string, Resolution, int64, er
 	if err != nil {
 		return "", "", 0, 0, err
 	}
-	timestamp := timeslot * resolution.SlabDuration()
+	// The data of an unknown resolution, such as one which has been
+	// deprecated, has no known slab duration, and its timestamp is returned as
+	// zero.
+	var timestamp int64
+	if slabDuration, ok := slabDurationByResolution[resolution]; ok {
+		timestamp = timeslot * slabDuration
+	}
 	// The remaining bytes are the source.
 	source := remainder
 
@@ -0,0 +1,160 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ts
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/gossip"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// knownNamesGossipInterval is the interval at which each node gossips the
+// names of the time series of its registered metrics.
+const knownNamesGossipInterval = time.Minute
+
+// knownNamesTTL is the time for which the names gossiped by a node are
+// considered known, after which the names of a node which stopped gossiping
+// them, such as one which was removed from the cluster, are disregarded.
+const knownNamesTTL = 3 * knownNamesGossipInterval
+
+// knownNamesInfo is the set of names gossiped by a node, and the time at which
+// it was received.
+type knownNamesInfo struct {
+	names    []string
+	received time.Time
+}
+
+// knownNames holds the names of the time series of the metrics registered by
+// each node of the cluster, keyed by the gossip key of the node.
+type knownNames struct {
+	syncutil.Mutex
+	byKey map[string]knownNamesInfo
+}
+
+// record records the names gossiped under the key, received at the supplied
+// time.
+func (k *knownNames) record(key string, names []string, received time.Time) {
+	k.Lock()
+	defer k.Unlock()
+	if k.byKey == nil {
+		k.byKey = make(map[string]knownNamesInfo)
+	}
+	k.byKey[key] = knownNamesInfo{names: names, received: received}
+}
+
+// get returns the union of the names received within knownNamesTTL of now,
+// and false if there are none.
+func (k *knownNames) get(now time.Time) (map[string]struct{}, bool) {
+	k.Lock()
+	defer k.Unlock()
+	var result map[string]struct{}
+	for _, info := range k.byKey {
+		if now.Sub(info.received) >= knownNamesTTL {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]struct{})
+		}
+		for _, name := range info.names {
+			result[name] = struct{}{}
+		}
+	}
+	return result, result != nil
+}
+
+// KnownTimeSeriesNames returns the names of the time series of the metrics
+// registered by the nodes of the cluster, as gossiped by GossipKnownNames
+// within knownNamesTTL, and false if no node's names were received in that
+// time.
+func (tsdb *DB) KnownTimeSeriesNames() (map[string]struct{}, bool) {
+	return tsdb.knownNames.get(timeutil.Now())
+}
+
+// GossipKnownNames begins a goroutine which periodically gossips the names of
+// the time series of the supplied source, the metrics registered by the node,
+// and records the names gossiped by every node for KnownTimeSeriesNames. The
+// goroutine runs until the supplied stop.Stopper is stopped.
+func (tsdb *DB) GossipKnownNames(
+	ambient log.AmbientContext,
+	g *gossip.Gossip,
+	nodeID roachpb.NodeID,
+	source DataSource,
+	stopper *stop.Stopper,
+) {
+	g.RegisterCallback(
+		gossip.MakePrefixPattern(gossip.KeyTimeSeriesNamesPrefix),
+		func(key string, value roachpb.Value) {
+			bytes, err := value.GetBytes()
+			if err != nil {
+				log.Warningf(ambient.AnnotateCtx(context.Background()),
+					"invalid time series names gossiped under %s: %s", key, err)
+				return
+			}
+			var names []string
+			if err := json.Unmarshal(bytes, &names); err != nil {
+				log.Warningf(ambient.AnnotateCtx(context.Background()),
+					"invalid time series names gossiped under %s: %s", key, err)
+				return
+			}
+			tsdb.knownNames.record(key, names, timeutil.Now())
+		},
+	)
+
+	key := gossip.MakeTimeSeriesNamesKey(nodeID)
+	stopper.RunWorker(context.TODO(), func(context.Context) {
+		ctx := ambient.AnnotateCtx(context.Background())
+		ticker := time.NewTicker(knownNamesGossipInterval)
+		defer ticker.Stop()
+		for {
+			if names := timeSeriesNames(source.GetTimeSeriesData()); len(names) > 0 {
+				if bytes, err := json.Marshal(names); err != nil {
+					log.Warningf(ctx, "failed to encode time series names: %s", err)
+				} else if err := g.AddInfo(key, bytes, knownNamesTTL); err != nil {
+					log.Warningf(ctx, "failed to gossip time series names: %s", err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-stopper.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// timeSeriesNames returns the distinct names of the supplied data, sorted.
+func timeSeriesNames(data []tspb.TimeSeriesData) []string {
+	seen := make(map[string]struct{}, len(data))
+	var names []string
+	for _, d := range data {
+		if _, ok := seen[d.Name]; ok {
+			continue
+		}
+		seen[d.Name] = struct{}{}
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	return names
+}
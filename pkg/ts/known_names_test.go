@@ -0,0 +1,52 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ts
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestKnownNames verifies that the known names are the union of the names
+// gossiped by the nodes, less those of nodes which stopped gossiping them.
+func TestKnownNames(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	var k knownNames
+	now := time.Unix(1475700000, 0)
+
+	if names, ok := k.get(now); ok {
+		t.Fatalf("expected no known names, got %v", names)
+	}
+
+	k.record("ts-names:1", timeSeriesNames([]tspb.TimeSeriesData{
+		{Name: "cr.node.a"}, {Name: "cr.store.b"}, {Name: "cr.store.b"},
+	}), now.Add(-knownNamesTTL))
+	k.record("ts-names:2", []string{"cr.node.a", "cr.node.c"}, now.Add(-time.Minute))
+	expected := map[string]struct{}{"cr.node.a": {}, "cr.node.c": {}}
+	if names, ok := k.get(now); !ok || !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected known names %v, got %v", expected, names)
+	}
+
+	// Names gossiped again are known again.
+	k.record("ts-names:1", []string{"cr.node.a", "cr.store.b"}, now)
+	expected["cr.store.b"] = struct{}{}
+	if names, ok := k.get(now); !ok || !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected known names %v, got %v", expected, names)
+	}
+}
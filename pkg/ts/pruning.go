@@ -17,6 +17,11 @@
 package ts
 
 import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
@@ -24,7 +29,9 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
 )
 
 var (
@@ -38,35 +45,579 @@ func (tsdb *DB) ContainsTimeSeries(start, end roachpb.RKey) bool {
 	return !lastTSRKey.Less(start) && !end.Less(firstTSRKey)
 }
 
-// PruneTimeSeries prunes old data for any time series found in the supplied
-// key range.
+// MayNeedMaintenance returns false if the supplied MVCC stats show that the
+// given key range contains no time series data. Time series are stored as
+// inline values in the global keyspace, so a range without any live or
+// historical keys cannot contain data to roll up or prune.
+func (tsdb *DB) MayNeedMaintenance(start, end roachpb.RKey, stats enginepb.MVCCStats) bool {
+	return stats.KeyCount > 0 && tsdb.ContainsTimeSeries(start, end)
+}
+
+// ListTimeSeriesNames returns the names of the time series which have data in
+// the supplied key range of the snapshot, in key order. Each name is listed
+// once, regardless of the number of resolutions, sources and timestamps at
+// which it has data.
+func (tsdb *DB) ListTimeSeriesNames(
+	ctx context.Context, snapshot engine.Reader, start, end roachpb.RKey,
+) ([]string, error) {
+	var names []string
+
+	iter := snapshot.NewIterator(false)
+	defer iter.Close()
+
+	next, last := timeSeriesSearchBounds(start, end)
+	for iter.Seek(next); ; iter.Seek(next) {
+		if ok, err := iter.Valid(); err != nil {
+			return nil, err
+		} else if !ok || !iter.Less(last) {
+			break
+		}
+		name, _, _, _, err := DecodeDataKey(iter.Key().Key)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		next = engine.MakeMVCCMetadataKey(makeDataKeyNamePrefix(name).PrefixEnd())
+	}
+	return names, nil
+}
+
+// TimeSeriesSizes returns the number of keys and bytes of the data of each time
+// series in the supplied key range of the snapshot, keyed by name, summed over
+// all of the resolutions and sources of the series. Unlike ListTimeSeriesNames,
+// it examines every key.
+func (tsdb *DB) TimeSeriesSizes(
+	ctx context.Context, snapshot engine.Reader, start, end roachpb.RKey,
+) (map[string]storage.TimeSeriesSize, error) {
+	sizes := make(map[string]storage.TimeSeriesSize)
+
+	iter := snapshot.NewIterator(false)
+	defer iter.Close()
+
+	next, last := timeSeriesSearchBounds(start, end)
+	for iter.Seek(next); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return nil, err
+		} else if !ok || !iter.Less(last) {
+			break
+		}
+		unsafeKey := iter.UnsafeKey()
+		name, _, _, _, err := DecodeDataKey(unsafeKey.Key)
+		if err != nil {
+			return nil, err
+		}
+		size := sizes[name]
+		size.Keys++
+		size.Bytes += int64(unsafeKey.EncodedSize() + len(iter.UnsafeValue()))
+		sizes[name] = size
+	}
+	return sizes, nil
+}
+
+// PruneTimeSeries prunes old data for the named time series, at any resolution
+// found in the supplied key range.
 //
 // The snapshot should be supplied by a local store, and is used only to
-// discover the names of time series which are store in that snapshot. The KV
-// client is then used to prune old data from the discovered series.
+// discover the resolutions at which the series is stored in that snapshot. The
+// KV client is then used to prune old data from the discovered series.
 //
 // The snapshot is used for key discovery (as opposed to the KV client) because
 // the task of pruning time series is distributed across the cluster to the
 // individual ranges which contain that time series data. Because replicas of
 // those ranges are guaranteed to have time series data locally, we can use the
 // snapshot to quickly obtain a set of keys to be pruned with no network calls.
+//
+// The data of each series is deleted in slices and batches bounded by the
+// supplied options. If they contain a Summary, it is populated once pruning
+// succeeds, with the end of the series' data in the key range as the key from
+// which the pruning of the following series may resume, and the size of the
+// data which pruning left in place, measured in the snapshot without reading
+// the data pruned. The keys deleted are counted by the responses to the
+// deletions, and their bytes extrapolated from a sample of at most
+// maxPrunableBytesEstimateKeys of them, measured in the snapshot, so that the
+// data deleted is not scanned in full. If pruning fails part way, only the
+// key from which it may resume is recorded in the summary. If the options
+// contain a DeleteLimiter, it is waited on before each deletion batch is
+// issued.
+//
+// If the options carry the known time series names and an orphan grace
+// period, and the name is not among the known names, the series is orphaned:
+// its metric is no longer registered. All of its data in the key range is
+// then deleted, regardless of the retention, once its newest sample is older
+// than the grace period.
 func (tsdb *DB) PruneTimeSeries(
 	ctx context.Context,
 	snapshot engine.Reader,
 	start, end roachpb.RKey,
+	name string,
 	db *client.DB,
 	timestamp hlc.Timestamp,
+	opts storage.TimeSeriesPruneOptions,
 ) error {
-	series, err := findTimeSeries(snapshot, start, end, timestamp)
+	// Restrict the key range to the data of the named series.
+	prefix := makeDataKeyNamePrefix(name)
+	if nameStart := roachpb.RKey(prefix); start.Less(nameStart) {
+		start = nameStart
+	}
+	if nameEnd := roachpb.RKey(prefix.PrefixEnd()); nameEnd.Less(end) {
+		end = nameEnd
+	}
+	if start.Less(end) && isOrphanedTimeSeries(name, opts) {
+		stale, resolutions, err := orphanIsStale(snapshot, start, end, name, timestamp, opts.OrphanGracePeriod)
+		if err != nil {
+			return err
+		}
+		if stale {
+			return tsdb.pruneOrphanedTimeSeries(
+				ctx, snapshot, start, end, name, resolutions, db, timestamp, opts,
+			)
+		}
+	}
+	var series []timeSeriesResolutionInfo
+	var err error
+	if start.Less(end) {
+		if series, err = findTimeSeries(snapshot, start, end, timestamp, opts.Retention); err != nil {
+			return err
+		}
+	}
+	var sampleBytes int64
+	var sampleKeys int
+	var retained storage.TimeSeriesSize
+	if opts.Summary != nil && len(series) > 0 {
+		// Sample the data to be deleted in the snapshot, from which the
+		// deletions are determined.
+		if sampleBytes, sampleKeys, _, err = estimatePrunableBytes(
+			snapshot, start, end, timestamp, opts.Retention, maxPrunableBytesEstimateKeys,
+		); err != nil {
+			return err
+		}
+	}
+	if opts.Summary != nil && start.Less(end) {
+		if retained, err = measureRetained(snapshot, start, end, timestamp, opts.Retention); err != nil {
+			return err
+		}
+	}
+	resumeKey, numKeys, err := pruneTimeSeries(ctx, snapshot, start, end, db, series, timestamp, opts)
 	if err != nil {
-		return err
+		if opts.Summary != nil {
+			opts.Summary.ResumeKey = resumeKey
+		}
+		return errors.Wrapf(err, "pruning of %s stopped at %s", name, resumeKey)
+	}
+	if summary := opts.Summary; summary != nil {
+		summary.SeriesPruned = len(series)
+		summary.KeysDeleted = numKeys
+		summary.BytesDeleted = extrapolateBytes(numKeys, sampleBytes, sampleKeys)
+		summary.Retained = retained
+		summary.Thresholds = thresholdTimes(timestamp, opts.Retention)
+		summary.ResumeKey = end.AsRawKey()
+	}
+	return nil
+}
+
+// measureRetained returns the number of keys and bytes of the time series data
+// in the supplied key range of the reader which pruning at the supplied
+// timestamp with the supplied retention leaves in place. The data of each
+// name/resolution pair which is old enough to be pruned precedes the rest of
+// it, so it is skipped with a seek, and only the retained keys are read.
+func measureRetained(
+	reader engine.Reader,
+	startKey, endKey roachpb.RKey,
+	now hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+) (storage.TimeSeriesSize, error) {
+	var size storage.TimeSeriesSize
+
+	iter := reader.NewIterator(false)
+	defer iter.Close()
+
+	next, end := timeSeriesSearchBounds(startKey, endKey)
+	thresholds := computeThresholds(now.WallTime, retention)
+
+	// seriesEnd is the end of the name/resolution pair of the last key found,
+	// and cutoff the end key of the deletion of its data, before which all of
+	// its keys are pruned.
+	var seriesEnd, cutoff roachpb.Key
+	for iter.Seek(next); ; {
+		if ok, err := iter.Valid(); err != nil {
+			return storage.TimeSeriesSize{}, err
+		} else if !ok || !iter.Less(end) {
+			break
+		}
+		unsafeKey := iter.UnsafeKey()
+		if seriesEnd == nil || unsafeKey.Key.Compare(seriesEnd) >= 0 {
+			name, _, res, _, err := DecodeDataKey(unsafeKey.Key)
+			if err != nil {
+				return storage.TimeSeriesSize{}, err
+			}
+			seriesEnd = makeDataKeySeriesPrefix(name, res).PrefixEnd()
+			cutoff = nil
+			if threshold, ok := thresholds[res]; !ok {
+				// The data of unknown resolutions is pruned entirely.
+				cutoff = seriesEnd
+			} else if threshold != math.MinInt64 {
+				cutoff = MakeDataKey(name, "", res, threshold)
+			}
+		}
+		if cutoff != nil && unsafeKey.Key.Compare(cutoff) < 0 {
+			iter.Seek(engine.MakeMVCCMetadataKey(cutoff))
+			continue
+		}
+		size.Keys++
+		size.Bytes += int64(unsafeKey.EncodedSize() + len(iter.UnsafeValue()))
+		iter.Next()
+	}
+	return size, nil
+}
+
+// isOrphanedTimeSeries returns whether the named time series is orphaned under
+// the options, as its name is not among their known names.
+func isOrphanedTimeSeries(name string, opts storage.TimeSeriesPruneOptions) bool {
+	if opts.OrphanGracePeriod <= 0 || opts.KnownNames == nil {
+		return false
 	}
-	return pruneTimeSeries(ctx, db, series, timestamp)
+	_, known := opts.KnownNames[name]
+	return !known
+}
+
+// orphanIsStale returns whether all of the data of the named time series in
+// the key range of the snapshot is older than the grace period at the
+// timestamp, along with the resolutions at which the series has data there. A
+// series without data is not stale. The timestamp of a key is the start of its
+// slab, which may hold samples up to a slab duration newer, so a slab is only
+// stale once it ends before the cutoff; at each resolution, only the keys from
+// the last slab which may be stale onwards are examined. The data of unknown
+// resolutions, whose slabs have no known duration, is stale, as it is pruned
+// regardless of its age.
+func orphanIsStale(
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	name string,
+	timestamp hlc.Timestamp,
+	gracePeriod time.Duration,
+) (bool, []Resolution, error) {
+	cutoff := timestamp.WallTime - gracePeriod.Nanoseconds()
+
+	iter := snapshot.NewIterator(false)
+	defer iter.Close()
+
+	var resolutions []Resolution
+	next, last := timeSeriesSearchBounds(start, end)
+	for iter.Seek(next); ; iter.Seek(next) {
+		if ok, err := iter.Valid(); err != nil {
+			return false, nil, err
+		} else if !ok || !iter.Less(last) {
+			break
+		}
+		_, _, res, _, err := DecodeDataKey(iter.UnsafeKey().Key)
+		if err != nil {
+			return false, nil, err
+		}
+		resolutions = append(resolutions, res)
+		seriesEnd := engine.MakeMVCCMetadataKey(makeDataKeySeriesPrefix(name, res).PrefixEnd())
+		slabNanos, ok := slabDurationByResolution[res]
+		if !ok {
+			next = seriesEnd
+			continue
+		}
+
+		if recent := engine.MakeMVCCMetadataKey(
+			MakeDataKey(name, "", res, cutoff-slabNanos),
+		); next.Less(recent) {
+			iter.Seek(recent)
+		}
+		for ; ; iter.Next() {
+			if ok, err := iter.Valid(); err != nil {
+				return false, nil, err
+			} else if !ok || !iter.Less(seriesEnd) || !iter.Less(last) {
+				break
+			}
+			_, _, _, tsNanos, err := DecodeDataKey(iter.UnsafeKey().Key)
+			if err != nil {
+				return false, nil, err
+			}
+			if tsNanos+slabNanos > cutoff {
+				return false, nil, nil
+			}
+		}
+		next = seriesEnd
+	}
+	return len(resolutions) > 0, resolutions, nil
+}
+
+// pruneOrphanedTimeSeries deletes all of the data of the orphaned time series
+// in the key range, at the supplied resolutions, in batches bounded by the
+// options, and populates their summary, if any, as PruneTimeSeries does. The
+// data is deleted in a single slice, as none of it is retained.
+func (tsdb *DB) pruneOrphanedTimeSeries(
+	ctx context.Context,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	name string,
+	resolutions []Resolution,
+	db *client.DB,
+	timestamp hlc.Timestamp,
+	opts storage.TimeSeriesPruneOptions,
+) error {
+	var sampleBytes int64
+	var sampleKeys int
+	if opts.Summary != nil {
+		var err error
+		if sampleBytes, sampleKeys, err = sampleKeyBytes(
+			snapshot, start, end, maxPrunableBytesEstimateKeys,
+		); err != nil {
+			return err
+		}
+	}
+	log.VEventf(ctx, 2, "deleting orphaned time series %s", name)
+	var numKeys int64
+	for from, to := start.AsRawKey(), end.AsRawKey(); from.Compare(to) < 0; {
+		next, batchKeys, err := pruneBatch(ctx, db, from, to, opts)
+		if err != nil {
+			if opts.Summary != nil {
+				opts.Summary.ResumeKey = from
+			}
+			return errors.Wrapf(err, "deletion of orphaned %s stopped at %s", name, from)
+		}
+		numKeys += batchKeys
+		from = next
+	}
+	if summary := opts.Summary; summary != nil {
+		summary.SeriesPruned = len(resolutions)
+		summary.OrphansDeleted = 1
+		summary.KeysDeleted = numKeys
+		summary.BytesDeleted = extrapolateBytes(numKeys, sampleBytes, sampleKeys)
+		summary.Thresholds = thresholdTimes(timestamp, opts.Retention)
+		summary.ResumeKey = end.AsRawKey()
+	}
+	return nil
+}
+
+// EstimatePrune returns the summary of the pruning of all of the time series
+// in the supplied key range at the supplied timestamp with the supplied
+// retention, as PruneTimeSeries would populate it, measured in the snapshot
+// without deleting anything. As with EstimatePrunableBytes, at most
+// maxPrunableBytesEstimateKeys keys are examined, so if the range contains
+// more prunable keys than that, the keys and bytes deleted are lower bounds.
+func (tsdb *DB) EstimatePrune(
+	ctx context.Context,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	timestamp hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+) (storage.TimeSeriesPruneSummary, error) {
+	series, err := findTimeSeries(snapshot, start, end, timestamp, retention)
+	if err != nil {
+		return storage.TimeSeriesPruneSummary{}, err
+	}
+	summary := storage.TimeSeriesPruneSummary{
+		SeriesPruned: len(series),
+		Thresholds:   thresholdTimes(timestamp, retention),
+	}
+	if len(series) > 0 {
+		bytes, numKeys, _, err := estimatePrunableBytes(
+			snapshot, start, end, timestamp, retention, maxPrunableBytesEstimateKeys,
+		)
+		if err != nil {
+			return storage.TimeSeriesPruneSummary{}, err
+		}
+		summary.KeysDeleted = int64(numKeys)
+		summary.BytesDeleted = bytes
+	}
+	return summary, nil
+}
+
+// thresholdTimes returns the time before which data at each resolution is
+// pruned at the supplied timestamp with the supplied retention, keyed by the
+// name of the resolution. Resolutions which are never pruned are omitted.
+func thresholdTimes(
+	timestamp hlc.Timestamp, retention storage.TimeSeriesRetention,
+) map[string]time.Time {
+	times := make(map[string]time.Time, len(pruneThresholdByResolution))
+	for res, threshold := range computeThresholds(timestamp.WallTime, retention) {
+		if threshold == math.MinInt64 {
+			continue
+		}
+		times[res.String()] = time.Unix(0, threshold).UTC()
+	}
+	return times
+}
+
+// CompactionCutoffs returns the cutoffs below which the compactions of a
+// store's engine may drop time series data at the supplied timestamp with the
+// supplied retention: at each resolution, the oldest time slot whose slab
+// isn't entirely older than the pruning threshold. A resolution which is
+// never pruned has no cutoff.
+func (tsdb *DB) CompactionCutoffs(
+	timestamp hlc.Timestamp, retention storage.TimeSeriesRetention,
+) []engine.TimeSeriesCutoff {
+	var cutoffs []engine.TimeSeriesCutoff
+	for res, threshold := range computeThresholds(timestamp.WallTime, retention) {
+		if threshold <= 0 {
+			continue
+		}
+		cutoffs = append(cutoffs, engine.TimeSeriesCutoff{
+			Resolution:  int64(res),
+			MinTimeslot: threshold / res.SlabDuration(),
+		})
+	}
+	sort.Slice(cutoffs, func(i, j int) bool {
+		return cutoffs[i].Resolution < cutoffs[j].Resolution
+	})
+	return cutoffs
+}
+
+// pruneSourcesBatchSize is the number of keys deleted by each batch issued by
+// PruneTimeSeriesSources.
+const pruneSourcesBatchSize = 1000
+
+// PruneTimeSeriesSources deletes all of the data of the supplied sources, such
+// as decommissioned nodes, from the time series in the supplied key range,
+// regardless of its age.
+//
+// As with PruneTimeSeries, the snapshot is used to discover the keys to
+// delete, which are then deleted with the KV client. The source of a key is
+// its last component, so the keys of the sources are interleaved with those
+// of the other sources of each series, and are deleted one by one in batches
+// of pruneSourcesBatchSize keys. The limiter, if non-nil, is waited on before
+// each batch is issued.
+func (tsdb *DB) PruneTimeSeriesSources(
+	ctx context.Context,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	sources []string,
+	db *client.DB,
+	limiter storage.TimeSeriesDeleteLimiter,
+) (storage.TimeSeriesSourcePruneSummary, error) {
+	summary := storage.TimeSeriesSourcePruneSummary{
+		Sources:             sources,
+		KeysDeletedBySource: make(map[string]int64, len(sources)),
+	}
+	dead := make(map[string]struct{}, len(sources))
+	for _, source := range sources {
+		dead[source] = struct{}{}
+	}
+	if len(dead) == 0 {
+		return summary, nil
+	}
+
+	b := &client.Batch{}
+	var batched int
+	flush := func() error {
+		if batched == 0 {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		if err := db.Run(ctx, b); err != nil {
+			return err
+		}
+		b = &client.Batch{}
+		batched = 0
+		return nil
+	}
+
+	iter := snapshot.NewIterator(false)
+	defer iter.Close()
+	next, last := timeSeriesSearchBounds(start, end)
+	for iter.Seek(next); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return summary, err
+		} else if !ok || !iter.Less(last) {
+			break
+		}
+		unsafeKey := iter.UnsafeKey()
+		_, source, _, _, err := DecodeDataKey(unsafeKey.Key)
+		if err != nil {
+			return summary, err
+		}
+		if _, ok := dead[source]; !ok {
+			continue
+		}
+		summary.KeysDeleted++
+		summary.BytesDeleted += int64(unsafeKey.EncodedSize() + len(iter.UnsafeValue()))
+		summary.KeysDeletedBySource[source]++
+		key := iter.Key().Key
+		b.AddRawRequest(&roachpb.DeleteRangeRequest{
+			Span:   roachpb.Span{Key: key, EndKey: key.Next()},
+			Inline: true,
+		})
+		if batched++; batched == pruneSourcesBatchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+	return summary, flush()
 }
 
 // Assert that DB implements the necessary interface from the storage package.
 var _ storage.TimeSeriesDataStore = (*DB)(nil)
 
+// maxPrunableBytesEstimateKeys is the maximum number of keys examined by
+// EstimatePrunableBytes and EstimatePrune, and sampled to measure the bytes
+// deleted by PruneTimeSeries.
+const maxPrunableBytesEstimateKeys = 10000
+
+// sampleKeyBytes sums the key and value sizes of at most maxKeys keys of the
+// time series data in the supplied key range of the reader, from its start,
+// and counts the keys.
+func sampleKeyBytes(
+	reader engine.Reader, startKey, endKey roachpb.RKey, maxKeys int,
+) (bytes int64, numKeys int, err error) {
+	iter := reader.NewIterator(false)
+	defer iter.Close()
+
+	next, end := timeSeriesSearchBounds(startKey, endKey)
+	for iter.Seek(next); numKeys < maxKeys; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return 0, 0, err
+		} else if !ok || !iter.Less(end) {
+			break
+		}
+		bytes += int64(iter.UnsafeKey().EncodedSize() + len(iter.UnsafeValue()))
+		numKeys++
+	}
+	return bytes, numKeys, nil
+}
+
+// extrapolateBytes returns the bytes of numKeys keys of time series data, as
+// extrapolated from a sample of sampleKeys of them which totaled sampleBytes.
+// It is exact if the sample covers every key.
+func extrapolateBytes(numKeys, sampleBytes int64, sampleKeys int) int64 {
+	if sampleKeys == 0 {
+		return 0
+	}
+	return numKeys * sampleBytes / int64(sampleKeys)
+}
+
+// EstimatePrunableBytes returns an estimate of the number of bytes of time
+// series data in the supplied key range which are old enough to be pruned at
+// the supplied timestamp with the supplied retention.
+//
+// The estimate is computed by scanning the supplied reader, skipping the
+// retained portion of each time series. To bound its cost, at most
+// maxPrunableBytesEstimateKeys keys are examined; if the range contains more
+// prunable keys than that, the returned estimate is a lower bound.
+func (tsdb *DB) EstimatePrunableBytes(
+	ctx context.Context,
+	reader engine.Reader,
+	start, end roachpb.RKey,
+	timestamp hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+) (int64, error) {
+	bytes, _, _, err := estimatePrunableBytes(
+		reader, start, end, timestamp, retention, maxPrunableBytesEstimateKeys,
+	)
+	return bytes, err
+}
+
 type timeSeriesResolutionInfo struct {
 	Name       string
 	Resolution Resolution
@@ -82,30 +633,18 @@ type timeSeriesResolutionInfo struct {
 // intended to be called by a storage queue which can inspect the local data for
 // a single range without the need for expensive network calls.
 func findTimeSeries(
-	snapshot engine.Reader, startKey, endKey roachpb.RKey, now hlc.Timestamp,
+	snapshot engine.Reader,
+	startKey, endKey roachpb.RKey,
+	now hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
 ) ([]timeSeriesResolutionInfo, error) {
 	var results []timeSeriesResolutionInfo
 
 	iter := snapshot.NewIterator(false)
 	defer iter.Close()
 
-	// Set start boundary for the search, which is the lesser of the range start
-	// key and the beginning of time series data.
-	start := engine.MakeMVCCMetadataKey(startKey.AsRawKey())
-	next := engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix)
-	if next.Less(start) {
-		next = start
-	}
-
-	// Set end boundary for the search, which is the lesser of the range end key
-	// and the end of time series data.
-	end := engine.MakeMVCCMetadataKey(endKey.AsRawKey())
-	lastTS := engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix.PrefixEnd())
-	if lastTS.Less(end) {
-		end = lastTS
-	}
-
-	thresholds := computeThresholds(now.WallTime)
+	next, end := timeSeriesSearchBounds(startKey, endKey)
+	thresholds := computeThresholds(now.WallTime, retention)
 
 	for iter.Seek(next); ; iter.Seek(next) {
 		if ok, err := iter.Valid(); err != nil {
@@ -138,13 +677,143 @@ func findTimeSeries(
 	return results, nil
 }
 
+// timeSeriesSearchBounds returns the bounds of a search for time series data in
+// the supplied key range: the greater of the range start key and the beginning
+// of time series data, and the lesser of the range end key and the end of time
+// series data.
+func timeSeriesSearchBounds(startKey, endKey roachpb.RKey) (engine.MVCCKey, engine.MVCCKey) {
+	start := engine.MakeMVCCMetadataKey(startKey.AsRawKey())
+	next := engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix)
+	if next.Less(start) {
+		next = start
+	}
+
+	end := engine.MakeMVCCMetadataKey(endKey.AsRawKey())
+	lastTS := engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix.PrefixEnd())
+	if lastTS.Less(end) {
+		end = lastTS
+	}
+	return next, end
+}
+
+// estimatePrunableBytes sums the key and value sizes of time series data in
+// the supplied key range which is older than the pruning threshold for its
+// resolution, and counts the keys of that data. Once a key which is not
+// eligible for pruning is found, the remainder of its name/resolution pair is
+// skipped, as later keys for the same series are newer. At most maxKeys keys
+// are examined; the number of keys examined is returned along with the
+// estimate.
+func estimatePrunableBytes(
+	reader engine.Reader,
+	startKey, endKey roachpb.RKey,
+	now hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+	maxKeys int,
+) (bytes int64, numKeys int, scanned int, err error) {
+	iter := reader.NewIterator(false)
+	defer iter.Close()
+
+	next, end := timeSeriesSearchBounds(startKey, endKey)
+	thresholds := computeThresholds(now.WallTime, retention)
+
+	for iter.Seek(next); scanned < maxKeys; {
+		if ok, err := iter.Valid(); err != nil {
+			return 0, 0, 0, err
+		} else if !ok || !iter.Less(end) {
+			break
+		}
+		scanned++
+		unsafeKey := iter.UnsafeKey()
+		name, _, res, tsNanos, err := DecodeDataKey(unsafeKey.Key)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if threshold, ok := thresholds[res]; !ok || threshold > tsNanos {
+			bytes += int64(unsafeKey.EncodedSize() + len(iter.UnsafeValue()))
+			numKeys++
+			iter.Next()
+			continue
+		}
+		iter.Seek(engine.MakeMVCCMetadataKey(makeDataKeySeriesPrefix(name, res).PrefixEnd()))
+	}
+	return bytes, numKeys, scanned, nil
+}
+
+// IterateTimeSeriesOlderThan calls fn with the key of each slab of time series
+// data in the supplied key range of the reader whose samples all precede the
+// cutoff, in key order. A slab precedes the cutoff if its key sorts before
+// MakeDataKey(name, "", res, cutoff), which is the end key of the deletion of
+// the data older than the cutoff, so that the slabs found are exactly those
+// such a deletion removes. The slabs of each name/resolution pair are ordered
+// by timestamp, so once a slab which doesn't precede the cutoff is found, the
+// rest of the pair is skipped with a seek, and none of its newer slabs are
+// read. The data of unknown resolutions, whose slabs have no known duration,
+// is skipped likewise.
+//
+// If fn returns an error, the iteration stops and the error is returned.
+func IterateTimeSeriesOlderThan(
+	reader engine.Reader,
+	startKey, endKey roachpb.RKey,
+	cutoff time.Time,
+	fn func(key roachpb.Key) error,
+) error {
+	iter := reader.NewIterator(false)
+	defer iter.Close()
+
+	next, end := timeSeriesSearchBounds(startKey, endKey)
+	cutoffNanos := cutoff.UnixNano()
+
+	// seriesEnd is the end of the name/resolution pair of the last key found,
+	// and cutoffKey the key of its slab containing the cutoff, or nil if its
+	// resolution is unknown.
+	var seriesEnd, cutoffKey roachpb.Key
+	for iter.Seek(next); ; {
+		if ok, err := iter.Valid(); err != nil {
+			return err
+		} else if !ok || !iter.Less(end) {
+			return nil
+		}
+		key := iter.UnsafeKey().Key
+		if seriesEnd == nil || key.Compare(seriesEnd) >= 0 {
+			name, _, res, _, err := DecodeDataKey(key)
+			if err != nil {
+				return err
+			}
+			seriesEnd = makeDataKeySeriesPrefix(name, res).PrefixEnd()
+			cutoffKey = nil
+			if _, ok := slabDurationByResolution[res]; ok {
+				cutoffKey = MakeDataKey(name, "", res, cutoffNanos)
+			}
+		}
+		if cutoffKey != nil && key.Compare(cutoffKey) < 0 {
+			if err := fn(iter.Key().Key); err != nil {
+				return err
+			}
+			iter.Next()
+			continue
+		}
+		iter.Seek(engine.MakeMVCCMetadataKey(seriesEnd))
+	}
+}
+
+// errPrunableKeyFound stops the search for the oldest data of a time series in
+// pruneTimeSeries.
+var errPrunableKeyFound = errors.New("prunable key found")
+
 // pruneTimeSeries will prune data for the supplied set of time series. Time
 // series series are identified by name and resolution.
 //
 // For each time series supplied, the pruning operation will delete all data
-// older than a constant threshold. The threshold is different depending on the
+// older than a threshold. The threshold is different depending on the
 // resolution; typically, lower-resolution time series data will be retained for
-// a longer period.
+// a longer period. The thresholds are the defaults of the resolutions unless
+// overridden by opts.Retention. The deletion of each time series starts at its
+// oldest data in the snapshot, found with IterateTimeSeriesOlderThan, and a
+// time series without data older than its threshold isn't deleted from at all.
+//
+// Only the data in the key range [startKey, endKey) is read and deleted, as the
+// snapshot may be bounded to the range being maintained, which can start or end
+// in the middle of a time series.
 //
 // If data is stored at a resolution which is not known to the system, it is
 // assumed that the resolution has been deprecated and all data for that time
@@ -152,49 +821,203 @@ func findTimeSeries(
 //
 // As range deletion of inline data is an idempotent operation, it is safe to
 // run this operation concurrently on multiple nodes at the same time.
+//
+// The data of each time series is deleted in slices of at most
+// opts.MaxSliceDuration of data, oldest first, each of which is deleted by
+// batches of at most opts.MaxKeysPerBatch keys. The snapshot is used to find
+// where the slices start, so that periods without data don't cost a batch. If
+// a limiter is supplied, it is waited on before each batch is issued; the
+// context is checked between batches so that a draining store stops promptly.
+// The response to each batch is received before the next is issued, and
+// before pruneTimeSeries returns, so that a caller may record that the data
+// was pruned once it returns.
+//
+// The number of keys deleted, as reported by the responses to the batches, is
+// returned. If a batch fails, the start key of its span is returned with the
+// error. The data which the earlier batches deleted stays deleted, so pruning
+// may resume from that key.
 func pruneTimeSeries(
-	ctx context.Context, db *client.DB, timeSeriesList []timeSeriesResolutionInfo, now hlc.Timestamp,
-) error {
-	thresholds := computeThresholds(now.WallTime)
+	ctx context.Context,
+	snapshot engine.Reader,
+	startKey, endKey roachpb.RKey,
+	db *client.DB,
+	timeSeriesList []timeSeriesResolutionInfo,
+	now hlc.Timestamp,
+	opts storage.TimeSeriesPruneOptions,
+) (resumeKey roachpb.Key, numKeys int64, _ error) {
+	thresholds := computeThresholds(now.WallTime, opts.Retention)
 
-	b := &client.Batch{}
 	for _, timeSeries := range timeSeriesList {
 		// Time series data for a specific resolution falls in a contiguous key
 		// range, and can be deleted with a DelRange command.
 
-		// The start key is the prefix unique to this name/resolution pair.
+		// The start key is the prefix unique to this name/resolution pair, and
+		// the series ends at its PrefixEnd; both are restricted to the key range.
 		start := makeDataKeySeriesPrefix(timeSeries.Name, timeSeries.Resolution)
+		seriesEnd := start.PrefixEnd()
+		if rangeStart := startKey.AsRawKey(); start.Compare(rangeStart) < 0 {
+			start = rangeStart
+		}
+		if rangeEnd := endKey.AsRawKey(); rangeEnd.Compare(seriesEnd) < 0 {
+			seriesEnd = rangeEnd
+		}
+		if start.Compare(seriesEnd) >= 0 {
+			continue
+		}
 
 		// The end key can be created by generating a time series key with the
 		// threshold timestamp for the resolution. If the resolution is not
-		// supported, the start key's PrefixEnd is used instead (which will clear
-		// the time series entirely).
+		// supported, the end of the series is used instead (which will clear
+		// the time series entirely, in a single slice).
 		var end roachpb.Key
 		threshold, ok := thresholds[timeSeries.Resolution]
 		if ok {
 			end = MakeDataKey(timeSeries.Name, "", timeSeries.Resolution, threshold)
+			if seriesEnd.Compare(end) < 0 {
+				end = seriesEnd
+			}
+
+			var oldest roachpb.Key
+			if err := IterateTimeSeriesOlderThan(
+				snapshot, roachpb.RKey(start), roachpb.RKey(seriesEnd), time.Unix(0, threshold),
+				func(key roachpb.Key) error {
+					oldest = key
+					return errPrunableKeyFound
+				},
+			); err != nil && err != errPrunableKeyFound {
+				return start, numKeys, err
+			}
+			if oldest == nil {
+				continue
+			}
+			start = oldest
 		} else {
-			end = start.PrefixEnd()
+			end = seriesEnd
 		}
 
-		b.AddRawRequest(&roachpb.DeleteRangeRequest{
-			Span: roachpb.Span{
-				Key:    start,
-				EndKey: end,
-			},
-			Inline: true,
-		})
+		sliceEnds := []roachpb.Key{end}
+		if ok && opts.MaxSliceDuration > 0 {
+			var err error
+			sliceEnds, err = findPruneSliceEnds(snapshot, timeSeries, start, end, opts.MaxSliceDuration)
+			if err != nil {
+				return start, numKeys, err
+			}
+		}
+		for _, sliceEnd := range sliceEnds {
+			for start.Compare(sliceEnd) < 0 {
+				next, batchKeys, err := pruneBatch(ctx, db, start, sliceEnd, opts)
+				if err != nil {
+					return start, numKeys, err
+				}
+				numKeys += batchKeys
+				start = next
+			}
+		}
 	}
 
-	return db.Run(ctx, b)
+	return nil, numKeys, nil
+}
+
+// findPruneSliceEnds returns the end keys of the slices, of at most
+// sliceDuration of data each, in which the data of the time series between the
+// start and end keys is deleted; the last of them is the end key. Each slice
+// starts at the oldest data remaining in the snapshot, so that no slice is
+// empty, and spans at least one slab. No slices are returned if there is no
+// data to delete.
+func findPruneSliceEnds(
+	snapshot engine.Reader,
+	timeSeries timeSeriesResolutionInfo,
+	start, end roachpb.Key,
+	sliceDuration time.Duration,
+) ([]roachpb.Key, error) {
+	sliceNanos := sliceDuration.Nanoseconds()
+	if slabNanos := timeSeries.Resolution.SlabDuration(); sliceNanos < slabNanos {
+		sliceNanos = slabNanos
+	}
+
+	iter := snapshot.NewIterator(false)
+	defer iter.Close()
+
+	var sliceEnds []roachpb.Key
+	for next := start; ; {
+		iter.Seek(engine.MakeMVCCMetadataKey(next))
+		if ok, err := iter.Valid(); err != nil {
+			return nil, err
+		} else if !ok || iter.UnsafeKey().Key.Compare(end) >= 0 {
+			return sliceEnds, nil
+		}
+		_, _, _, tsNanos, err := DecodeDataKey(iter.UnsafeKey().Key)
+		if err != nil {
+			return nil, err
+		}
+		next = MakeDataKey(timeSeries.Name, "", timeSeries.Resolution, tsNanos+sliceNanos)
+		if next.Compare(end) >= 0 {
+			return append(sliceEnds, end), nil
+		}
+		sliceEnds = append(sliceEnds, next)
+	}
+}
+
+// pruneBatch issues a single batch deleting the time series data between the
+// start and end keys, or the first opts.MaxKeysPerBatch keys of it, once the
+// context and the limiter allow. It returns the key from which the deletion
+// of the rest of the data must continue, which is the end key once all of it
+// has been deleted, and the number of keys the batch deleted. With
+// opts.UseRangeTombstones, all of the data is deleted by range deletion
+// tombstones regardless of opts.MaxKeysPerBatch.
+func pruneBatch(
+	ctx context.Context, db *client.DB, start, end roachpb.Key, opts storage.TimeSeriesPruneOptions,
+) (roachpb.Key, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	if opts.DeleteLimiter != nil {
+		if err := opts.DeleteLimiter.Wait(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	b := &client.Batch{}
+	if opts.MaxKeysPerBatch > 0 && !opts.UseRangeTombstones {
+		b.Header.MaxSpanRequestKeys = opts.MaxKeysPerBatch
+	}
+	b.AddRawRequest(&roachpb.DeleteRangeRequest{
+		Span: roachpb.Span{
+			Key:    start,
+			EndKey: end,
+		},
+		Inline:            true,
+		UseRangeTombstone: opts.UseRangeTombstones,
+	})
+	if err := db.Run(ctx, b); err != nil {
+		return nil, 0, err
+	}
+	header := b.RawResponse().Responses[0].GetInner().Header()
+	if resume := header.ResumeSpan; resume != nil {
+		return resume.Key, header.NumKeys, nil
+	}
+	return end, header.NumKeys, nil
 }
 
 // computeThresholds returns a map of timestamps for each resolution supported
 // by the system. Data at a resolution which is older than the threshold
 // timestamp for that resolution is considered eligible for deletion.
-func computeThresholds(timestamp int64) map[Resolution]int64 {
+//
+// The retention of a resolution, if present, replaces its default threshold.
+// A resolution with a zero or negative retention is never pruned; its
+// threshold is math.MinInt64, which no data is older than.
+func computeThresholds(
+	timestamp int64, retention storage.TimeSeriesRetention,
+) map[Resolution]int64 {
 	result := make(map[Resolution]int64, len(pruneThresholdByResolution))
 	for k, v := range pruneThresholdByResolution {
+		if ttl, ok := retention[k.String()]; ok {
+			if ttl <= 0 {
+				result[k] = math.MinInt64
+				continue
+			}
+			v = ttl.Nanoseconds()
+		}
 		result[k] = timestamp - v
 	}
 	return result
@@ -17,13 +17,25 @@
 package ts
 
 import (
+	"fmt"
+	"math"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 )
@@ -74,6 +86,31 @@ func TestContainsTimeSeries(t *testing.T) {
 	}
 }
 
+func TestMayNeedMaintenance(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tsdb := (*DB)(nil)
+
+	tsStart := roachpb.RKey(MakeDataKey("metric", "", Resolution10s, 0))
+	for i, tcase := range []struct {
+		start    roachpb.RKey
+		end      roachpb.RKey
+		stats    enginepb.MVCCStats
+		expected bool
+	}{
+		{tsStart, roachpb.RKeyMax, enginepb.MVCCStats{KeyCount: 1}, true},
+		// No keys in the range: nothing to maintain.
+		{tsStart, roachpb.RKeyMax, enginepb.MVCCStats{}, false},
+		// Only system data in the range.
+		{tsStart, roachpb.RKeyMax, enginepb.MVCCStats{SysCount: 10, SysBytes: 1000}, false},
+		// Keys outside of the time series keyspace.
+		{roachpb.RKey("a"), roachpb.RKey("b"), enginepb.MVCCStats{KeyCount: 1}, false},
+	} {
+		if actual := tsdb.MayNeedMaintenance(tcase.start, tcase.end, tcase.stats); actual != tcase.expected {
+			t.Errorf("case %d: was %t, expected %t", i, actual, tcase.expected)
+		}
+	}
+}
+
 func TestFindTimeSeries(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	tm := newTestModel(t)
@@ -279,7 +316,7 @@ func TestFindTimeSeries(t *testing.T) {
 		},
 	} {
 		snap := e.NewSnapshot()
-		actual, err := findTimeSeries(snap, tcase.start, tcase.end, tcase.timestamp)
+		actual, err := findTimeSeries(snap, tcase.start, tcase.end, tcase.timestamp, nil)
 		snap.Close()
 		if err != nil {
 			t.Fatalf("case %d: unexpected error %q", i, err)
@@ -291,6 +328,218 @@ func TestFindTimeSeries(t *testing.T) {
 	}
 }
 
+// TestListTimeSeriesNames verifies that the names of the time series in a key
+// range are listed once each, and that pruning a named series leaves the
+// others untouched.
+func TestListTimeSeriesNames(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// Arbitrary timestamp
+	var now int64 = 1475700000 * 1e9
+
+	// "metric.a" is a prefix of "metric.ab", but their keys are disjoint.
+	metrics := []string{"metric.a", "metric.ab", "metric.z"}
+	for _, metric := range metrics {
+		for _, resolution := range []Resolution{Resolution10s, resolution1ns} {
+			tm.storeTimeSeriesData(resolution, []tspb.TimeSeriesData{
+				{
+					Name:   metric,
+					Source: "source1",
+					Datapoints: []tspb.TimeSeriesDatapoint{
+						{
+							TimestampNanos: now,
+							Value:          1,
+						},
+						{
+							TimestampNanos: now - int64(365*24*time.Hour),
+							Value:          2,
+						},
+					},
+				},
+			})
+		}
+	}
+	tm.assertKeyCount(12)
+
+	ctx := context.Background()
+	snap := tm.LocalTestCluster.Eng.NewSnapshot()
+	defer snap.Close()
+	for i, tcase := range []struct {
+		start, end roachpb.RKey
+		expected   []string
+	}{
+		{roachpb.RKeyMin, roachpb.RKeyMax, metrics},
+		{roachpb.RKey(MakeDataKey(metrics[0], "", resolution1ns, 0)), roachpb.RKeyMax, metrics},
+		{roachpb.RKey(MakeDataKey(metrics[1], "", Resolution10s, 0)), roachpb.RKeyMax, metrics[1:]},
+		{roachpb.RKeyMin, roachpb.RKey(MakeDataKey(metrics[2], "", Resolution10s, 0)), metrics[:2]},
+		{roachpb.RKeyMin, roachpb.RKey(keys.TimeseriesPrefix), nil},
+	} {
+		actual, err := tm.DB.ListTimeSeriesNames(ctx, snap, tcase.start, tcase.end)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error %q", i, err)
+		}
+		if !reflect.DeepEqual(actual, tcase.expected) {
+			t.Errorf("case %d: got %v, expected %v", i, actual, tcase.expected)
+		}
+	}
+
+	var summary storage.TimeSeriesPruneSummary
+	if err := tm.DB.PruneTimeSeries(
+		ctx, snap, roachpb.RKeyMin, roachpb.RKeyMax, metrics[0], tm.LocalTestCluster.DB,
+		hlc.Timestamp{WallTime: now}, storage.TimeSeriesPruneOptions{Summary: &summary},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if summary.SeriesPruned != 2 || summary.KeysDeleted != 2 {
+		t.Fatalf("expected 2 series and 2 keys to be pruned, got %+v", summary)
+	}
+	tm.assertKeyCount(10)
+}
+
+// TestEstimatePrune verifies that EstimatePrune summarizes the pruning of
+// every time series in a key range as pruning them does, without deleting
+// anything, and that pruning measures the data it leaves in place.
+func TestEstimatePrune(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// Arbitrary timestamp
+	var now int64 = 1475700000 * 1e9
+
+	metrics := []string{"metric.a", "metric.b"}
+	for _, metric := range metrics {
+		for _, resolution := range []Resolution{Resolution10s, resolution1ns} {
+			tm.storeTimeSeriesData(resolution, []tspb.TimeSeriesData{
+				{
+					Name:   metric,
+					Source: "source1",
+					Datapoints: []tspb.TimeSeriesDatapoint{
+						{
+							TimestampNanos: now,
+							Value:          1,
+						},
+						{
+							TimestampNanos: now - int64(365*24*time.Hour),
+							Value:          2,
+						},
+					},
+				},
+			})
+		}
+	}
+	tm.assertKeyCount(8)
+
+	ctx := context.Background()
+	snap := tm.LocalTestCluster.Eng.NewSnapshot()
+	defer snap.Close()
+	timestamp := hlc.Timestamp{WallTime: now}
+	estimate, err := tm.DB.EstimatePrune(ctx, snap, roachpb.RKeyMin, roachpb.RKeyMax, timestamp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.SeriesPruned != 4 || estimate.KeysDeleted != 4 || estimate.BytesDeleted == 0 {
+		t.Fatalf("expected 4 series and 4 keys to be pruned, got %+v", estimate)
+	}
+	tm.assertKeyCount(8)
+
+	var pruned storage.TimeSeriesPruneSummary
+	retained := make(map[string]storage.TimeSeriesSize)
+	for _, metric := range metrics {
+		var summary storage.TimeSeriesPruneSummary
+		if err := tm.DB.PruneTimeSeries(
+			ctx, snap, roachpb.RKeyMin, roachpb.RKeyMax, metric, tm.LocalTestCluster.DB,
+			timestamp, storage.TimeSeriesPruneOptions{Summary: &summary},
+		); err != nil {
+			t.Fatal(err)
+		}
+		pruned.SeriesPruned += summary.SeriesPruned
+		pruned.KeysDeleted += summary.KeysDeleted
+		pruned.BytesDeleted += summary.BytesDeleted
+		pruned.Thresholds = summary.Thresholds
+		retained[metric] = summary.Retained
+	}
+	if !reflect.DeepEqual(estimate, pruned) {
+		t.Fatalf("expected the estimate %+v to match the pruning %+v", estimate, pruned)
+	}
+	tm.assertKeyCount(4)
+
+	after := tm.LocalTestCluster.Eng.NewSnapshot()
+	defer after.Close()
+	sizes, err := tm.DB.TimeSeriesSizes(ctx, after, roachpb.RKeyMin, roachpb.RKeyMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, retained) {
+		t.Fatalf("expected the retained data %+v to match the data left %+v", retained, sizes)
+	}
+}
+
+func TestTimeSeriesSizes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// Arbitrary timestamp
+	var now int64 = 1475700000 * 1e9
+
+	for _, metric := range []string{"metric.a", "metric.b"} {
+		for _, source := range []string{"source1", "source2"} {
+			tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+				{
+					Name:   metric,
+					Source: source,
+					Datapoints: []tspb.TimeSeriesDatapoint{
+						{
+							TimestampNanos: now,
+							Value:          1,
+						},
+						{
+							TimestampNanos: now - int64(24*time.Hour),
+							Value:          2,
+						},
+					},
+				},
+			})
+		}
+	}
+	tm.assertKeyCount(8)
+
+	ctx := context.Background()
+	snap := tm.LocalTestCluster.Eng.NewSnapshot()
+	defer snap.Close()
+	sizes, err := tm.DB.TimeSeriesSizes(ctx, snap, roachpb.RKeyMin, roachpb.RKeyMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 {
+		t.Fatalf("expected the sizes of 2 series, got %+v", sizes)
+	}
+	for name, size := range sizes {
+		if size.Keys != 4 || size.Bytes == 0 {
+			t.Errorf("expected %s to have 4 keys, got %+v", name, size)
+		}
+	}
+
+	// Only the series in the key range are measured.
+	prefix := makeDataKeyNamePrefix("metric.a")
+	restricted, err := tm.DB.TimeSeriesSizes(
+		ctx, snap, roachpb.RKey(prefix), roachpb.RKey(prefix.PrefixEnd()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]storage.TimeSeriesSize{"metric.a": sizes["metric.a"]}
+	if !reflect.DeepEqual(expected, restricted) {
+		t.Fatalf("expected %+v, got %+v", expected, restricted)
+	}
+}
+
 func TestPruneTimeSeries(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	tm := newTestModel(t)
@@ -390,3 +639,1068 @@ func TestPruneTimeSeries(t *testing.T) {
 	tm.assertModelCorrect()
 	tm.assertKeyCount(0)
 }
+
+func TestEstimatePrunableBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+	for _, metric := range []string{"metric.a", "metric.z"} {
+		for _, source := range []string{"source1", "source2"} {
+			tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+				{
+					Name:   metric,
+					Source: source,
+					Datapoints: []tspb.TimeSeriesDatapoint{
+						{
+							TimestampNanos: now - int64(365*24*time.Hour),
+							Value:          1,
+						},
+						{
+							TimestampNanos: now - int64(364*24*time.Hour),
+							Value:          2,
+						},
+						{
+							TimestampNanos: now,
+							Value:          3,
+						},
+					},
+				},
+			})
+		}
+	}
+	tm.assertKeyCount(12)
+
+	e := tm.LocalTestCluster.Eng
+	nowTS := hlc.Timestamp{WallTime: now}
+
+	// Nothing is prunable at the time of the oldest data.
+	bytes, _, _, err := estimatePrunableBytes(
+		e, roachpb.RKeyMin, roachpb.RKeyMax, hlc.Timestamp{WallTime: now - int64(365*24*time.Hour)},
+		nil, 100,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes != 0 {
+		t.Fatalf("expected no prunable bytes, got %d", bytes)
+	}
+
+	// Eight keys are prunable; the four retained keys are skipped after the
+	// first retained key of each series is examined.
+	full, numKeys, scanned, err := estimatePrunableBytes(
+		e, roachpb.RKeyMin, roachpb.RKeyMax, nowTS, nil, 100,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full <= 0 {
+		t.Fatalf("expected prunable bytes, got %d", full)
+	}
+	if a, e := numKeys, 8; a != e {
+		t.Fatalf("expected %d prunable keys, got %d", e, a)
+	}
+	if a, e := scanned, 10; a != e {
+		t.Fatalf("expected %d keys to be scanned, got %d", e, a)
+	}
+
+	// The scan is capped at the supplied number of keys.
+	capped, _, scanned, err := estimatePrunableBytes(
+		e, roachpb.RKeyMin, roachpb.RKeyMax, nowTS, nil, 3,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, e := scanned, 3; a != e {
+		t.Fatalf("expected %d keys to be scanned, got %d", e, a)
+	}
+	if capped <= 0 || capped >= full {
+		t.Fatalf("expected capped estimate %d to be positive and less than %d", capped, full)
+	}
+
+	// A retention overrides the default threshold of its resolution, and a
+	// resolution retained forever has nothing to prune.
+	for _, tcase := range []struct {
+		retention storage.TimeSeriesRetention
+		numKeys   int
+	}{
+		{storage.TimeSeriesRetention{"10s": 364*24*time.Hour + time.Hour}, 4},
+		{storage.TimeSeriesRetention{"30m": 0}, 8},
+		{storage.TimeSeriesRetention{"10s": 0}, 0},
+		{storage.TimeSeriesRetention{"10s": -time.Hour}, 0},
+	} {
+		_, numKeys, _, err := estimatePrunableBytes(
+			e, roachpb.RKeyMin, roachpb.RKeyMax, nowTS, tcase.retention, 100,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, e := numKeys, tcase.numKeys; a != e {
+			t.Errorf("%v: expected %d prunable keys, got %d", tcase.retention, e, a)
+		}
+		thresholds := thresholdTimes(nowTS, tcase.retention)
+		for res, ttl := range tcase.retention {
+			if _, ok := thresholds[res]; ok != (ttl > 0) {
+				t.Errorf("%v: expected a threshold for %s: %t, got %v",
+					tcase.retention, res, ttl > 0, thresholds)
+			}
+		}
+	}
+}
+
+// TestExtrapolateBytes verifies that the bytes deleted by pruning are
+// extrapolated from the sample of the data deleted, and are exact when the
+// sample covers all of it.
+func TestExtrapolateBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		numKeys, sampleBytes int64
+		sampleKeys           int
+		expected             int64
+	}{
+		{0, 0, 0, 0},
+		{10, 0, 0, 0},
+		{10, 1000, 10, 1000},
+		{1000, 1000, 10, 100000},
+		{5, 1000, 10, 500},
+	} {
+		if a := extrapolateBytes(tc.numKeys, tc.sampleBytes, tc.sampleKeys); a != tc.expected {
+			t.Errorf("%d keys sampled as %d keys of %d bytes: expected %d bytes, got %d",
+				tc.numKeys, tc.sampleKeys, tc.sampleBytes, tc.expected, a)
+		}
+	}
+}
+
+// countingReader counts the seeks and steps of the iterators of the reader it
+// wraps, measuring how many keys an iteration reads.
+type countingReader struct {
+	engine.Reader
+	seeks, nexts int
+}
+
+func (r *countingReader) NewIterator(prefix bool) engine.Iterator {
+	return &countingIterator{Iterator: r.Reader.NewIterator(prefix), r: r}
+}
+
+type countingIterator struct {
+	engine.Iterator
+	r *countingReader
+}
+
+func (it *countingIterator) Seek(key engine.MVCCKey) {
+	it.r.seeks++
+	it.Iterator.Seek(key)
+}
+
+func (it *countingIterator) Next() {
+	it.r.nexts++
+	it.Iterator.Next()
+}
+
+// TestIterateTimeSeriesOlderThan verifies that only the slabs preceding the
+// cutoff are visited, and that the newer slabs of each series are skipped by
+// seeking rather than read.
+func TestIterateTimeSeriesOlderThan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// Each of the series has a slab per hour for 100 hours, of which the
+	// first 10 precede the cutoff.
+	const numSlabs, numOld = 100, 10
+	hour := int64(time.Hour)
+	var now int64 = 1475700000 * 1e9
+	first := now - now%hour - numSlabs*hour
+	cutoff := time.Unix(0, first+numOld*hour)
+	metrics := []string{"metric.a", "metric.b"}
+	sources := []string{"source1", "source2", "source3"}
+	for _, metric := range metrics {
+		for _, source := range sources {
+			var datapoints []tspb.TimeSeriesDatapoint
+			for i := int64(0); i < numSlabs; i++ {
+				datapoints = append(datapoints, tspb.TimeSeriesDatapoint{
+					TimestampNanos: first + i*hour + hour/2,
+					Value:          float64(i),
+				})
+			}
+			tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+				{Name: metric, Source: source, Datapoints: datapoints},
+			})
+		}
+	}
+	tm.assertKeyCount(len(metrics) * len(sources) * numSlabs)
+
+	var expected []roachpb.Key
+	for _, metric := range metrics {
+		for i := int64(0); i < numOld; i++ {
+			for _, source := range sources {
+				expected = append(expected, MakeDataKey(metric, source, Resolution10s, first+i*hour))
+			}
+		}
+	}
+
+	reader := &countingReader{Reader: tm.LocalTestCluster.Eng}
+	var found []roachpb.Key
+	if err := IterateTimeSeriesOlderThan(
+		reader, roachpb.RKeyMin, roachpb.RKeyMax, cutoff, func(key roachpb.Key) error {
+			found = append(found, key)
+			return nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected keys %s, got %s", expected, found)
+	}
+	// Each old slab is stepped over, and the first newer slab of each series
+	// is followed by a seek past the rest of the series.
+	if a, e := reader.nexts, len(expected); a != e {
+		t.Errorf("expected %d steps, got %d", e, a)
+	}
+	if a, e := reader.seeks, 1+len(metrics); a != e {
+		t.Errorf("expected %d seeks, got %d", e, a)
+	}
+
+	// The iteration is restricted to the supplied key range.
+	found = nil
+	if err := IterateTimeSeriesOlderThan(
+		tm.LocalTestCluster.Eng,
+		roachpb.RKey(makeDataKeyNamePrefix(metrics[1])), roachpb.RKeyMax,
+		cutoff, func(key roachpb.Key) error {
+			found = append(found, key)
+			return nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if a, e := found, expected[len(expected)/2:]; !reflect.DeepEqual(a, e) {
+		t.Fatalf("expected keys %s, got %s", e, a)
+	}
+
+	// An error returned by fn stops the iteration.
+	found = nil
+	if err := IterateTimeSeriesOlderThan(
+		tm.LocalTestCluster.Eng, roachpb.RKeyMin, roachpb.RKeyMax, cutoff,
+		func(key roachpb.Key) error {
+			found = append(found, key)
+			return errors.New("injected failure")
+		},
+	); !testutils.IsError(err, "injected failure") {
+		t.Fatalf("expected an injected failure, got %v", err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected the iteration to stop at the first key, got %s", found)
+	}
+}
+
+// TestPruneTimeSeriesUnknownResolution verifies that the data of a resolution
+// which is no longer known is deleted whole by pruning, is skipped by
+// IterateTimeSeriesOlderThan and is stale as an orphan, rather than crashing
+// any of them on its unknown slab duration. It also verifies that a slab straddling the pruning threshold is
+// kept, whether or not older slabs of its series are pruned along with it.
+func TestPruneTimeSeriesUnknownResolution(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+	ctx := context.Background()
+
+	// The threshold of resolution1ns falls in the middle of a slab.
+	var now int64 = 1475700000*1e9 + 5
+	const unknown Resolution = 5
+	unknownPrefix := makeDataKeySeriesPrefix("metric.old", unknown)
+	for slot := int64(0); slot < 3; slot++ {
+		key := encoding.EncodeVarintAscending(append(roachpb.Key(nil), unknownPrefix...), slot)
+		key = append(key, "source1"...)
+		if err := engine.MVCCPut(
+			ctx, tm.Eng, nil, key, hlc.Timestamp{}, roachpb.MakeValueFromString("old"), nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countKeys := func(prefix roachpb.Key) int {
+		kvs, _, _, err := engine.MVCCScan(ctx, tm.Eng, prefix, prefix.PrefixEnd(),
+			math.MaxInt64, tm.Clock.Now(), true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(kvs)
+	}
+
+	// One series has only the slab straddling the threshold, and the other an
+	// older slab too.
+	threshold := now - resolution1ns.PruneThreshold()
+	slab := resolution1ns.SlabDuration()
+	straddling := threshold - threshold%slab + 1
+	tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{
+		{
+			Name:       "metric.lone",
+			Source:     "source1",
+			Datapoints: []tspb.TimeSeriesDatapoint{{TimestampNanos: straddling, Value: 1}},
+		},
+		{
+			Name:   "metric.older",
+			Source: "source1",
+			Datapoints: []tspb.TimeSeriesDatapoint{
+				{TimestampNanos: straddling - 2*slab, Value: 1},
+				{TimestampNanos: straddling, Value: 2},
+			},
+		},
+	})
+
+	var found []roachpb.Key
+	if err := IterateTimeSeriesOlderThan(
+		tm.Eng, roachpb.RKeyMin, roachpb.RKeyMax, time.Unix(0, threshold),
+		func(key roachpb.Key) error {
+			found = append(found, key)
+			return nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	expected := []roachpb.Key{MakeDataKey("metric.older", "source1", resolution1ns, straddling-2*slab)}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected keys %s, got %s", expected, found)
+	}
+
+	// An orphan with data only at the unknown resolution is stale.
+	stale, resolutions, err := orphanIsStale(
+		tm.Eng, roachpb.RKeyMin, roachpb.RKeyMax, "metric.old", hlc.Timestamp{WallTime: now}, time.Hour,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale || !reflect.DeepEqual(resolutions, []Resolution{unknown}) {
+		t.Fatalf("expected the orphan to be stale at resolution %d, got %t at %v", unknown, stale, resolutions)
+	}
+
+	series, err := findTimeSeries(tm.Eng, roachpb.RKeyMin, roachpb.RKeyMax, hlc.Timestamp{WallTime: now}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pruneTimeSeries(
+		ctx, tm.Eng, roachpb.RKeyMin, roachpb.RKeyMax, tm.LocalTestCluster.DB, series,
+		hlc.Timestamp{WallTime: now}, storage.TimeSeriesPruneOptions{},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(unknownPrefix); n != 0 {
+		t.Errorf("expected the data of the unknown resolution to be deleted, found %d keys", n)
+	}
+	for _, name := range []string{"metric.lone", "metric.older"} {
+		if n := countKeys(makeDataKeySeriesPrefix(name, resolution1ns)); n != 1 {
+			t.Errorf("%s: expected only the straddling slab to be kept, found %d keys", name, n)
+		}
+	}
+}
+
+// simulatedLimiter wraps a rate.Limiter, advancing a simulated clock instead of
+// sleeping when the limiter would block. The simulated time at which each call
+// to Wait returned is recorded.
+type simulatedLimiter struct {
+	limiter *rate.Limiter
+	now     time.Time
+	waits   []time.Time
+}
+
+func (l *simulatedLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r := l.limiter.ReserveN(l.now, 1)
+	l.now = l.now.Add(r.DelayFrom(l.now))
+	l.waits = append(l.waits, l.now)
+	return nil
+}
+
+// TestCompactionCutoffs verifies that the compactions of an engine with the
+// cutoffs returned by CompactionCutoffs drop the time series data older than
+// its retention, and keep the data in its retention and the other keys.
+func TestCompactionCutoffs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	eng := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer eng.Close()
+
+	// The 10s resolution has a slab per hour for 10 hours, of which the first
+	// 4 are older than its retention, and the 30m resolution, which is never
+	// pruned, has a slab per day for 2 days.
+	hour := int64(time.Hour)
+	var now int64 = 1475700000 * 1e9
+	first := now - now%hour - 10*hour
+	retention := storage.TimeSeriesRetention{
+		Resolution10s.String(): time.Duration(now - first - 4*hour),
+		Resolution30m.String(): 0,
+	}
+	var expired, retained []roachpb.Key
+	for _, source := range []string{"1", "2"} {
+		for i := int64(0); i < 10; i++ {
+			key := MakeDataKey("metric.a", source, Resolution10s, first+i*hour)
+			if i < 4 {
+				expired = append(expired, key)
+			} else {
+				retained = append(retained, key)
+			}
+		}
+		for i := int64(0); i < 2; i++ {
+			retained = append(retained,
+				MakeDataKey("metric.a", source, Resolution30m, first+i*24*hour))
+		}
+	}
+	// Keys which aren't time series data, or can't be decoded as such, are
+	// retained.
+	retained = append(retained,
+		roachpb.Key("a"),
+		append(append(roachpb.Key(nil), keys.TimeseriesPrefix...), "garbage"...),
+		keys.TimeseriesPrefix.PrefixEnd(),
+	)
+	for _, key := range append(append([]roachpb.Key(nil), expired...), retained...) {
+		if err := eng.Put(engine.MakeMVCCMetadataKey(key), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	compactAndCheck := func(expected []roachpb.Key) {
+		if err := eng.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := eng.CompactRange(keys.MinKey, keys.MaxKey, true /* forceBottommost */); err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]struct{})
+		if err := eng.Iterate(
+			engine.MakeMVCCMetadataKey(keys.MinKey), engine.MakeMVCCMetadataKey(keys.MaxKey),
+			func(kv engine.MVCCKeyValue) (bool, error) {
+				found[string(kv.Key.Key)] = struct{}{}
+				return false, nil
+			},
+		); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range expected {
+			if _, ok := found[string(key)]; !ok {
+				t.Errorf("expected %s to be retained", key)
+			}
+		}
+		if len(found) != len(expected) {
+			t.Errorf("expected %d keys to be retained, got %d", len(expected), len(found))
+		}
+	}
+
+	// Until the engine has cutoffs, compactions retain everything.
+	compactAndCheck(append(append([]roachpb.Key(nil), expired...), retained...))
+
+	cutoffs := (*DB)(nil).CompactionCutoffs(hlc.Timestamp{WallTime: now}, retention)
+	expectedCutoffs := []engine.TimeSeriesCutoff{{
+		Resolution:  int64(Resolution10s),
+		MinTimeslot: (first + 4*hour) / Resolution10s.SlabDuration(),
+	}}
+	if !reflect.DeepEqual(cutoffs, expectedCutoffs) {
+		t.Fatalf("expected cutoffs %+v, got %+v", expectedCutoffs, cutoffs)
+	}
+	if err := eng.SetTimeSeriesCutoffs(cutoffs); err != nil {
+		t.Fatal(err)
+	}
+	compactAndCheck(retained)
+
+	// Without cutoffs, compactions retain everything again.
+	if err := eng.SetTimeSeriesCutoffs(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range expired {
+		if err := eng.Put(engine.MakeMVCCMetadataKey(key), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compactAndCheck(append(append([]roachpb.Key(nil), expired...), retained...))
+}
+
+func TestPruneTimeSeriesDeleteRate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+	const numSeries = 10
+	var series []timeSeriesResolutionInfo
+	for i := 0; i < numSeries; i++ {
+		name := fmt.Sprintf("metric.%d", i)
+		tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+			{
+				Name:   name,
+				Source: "source1",
+				Datapoints: []tspb.TimeSeriesDatapoint{
+					{
+						TimestampNanos: now - int64(365*24*time.Hour),
+						Value:          1,
+					},
+				},
+			},
+		})
+		series = append(series, timeSeriesResolutionInfo{Name: name, Resolution: Resolution10s})
+	}
+	tm.assertKeyCount(numSeries)
+
+	// A cancelled context stops pruning before any deletion is issued.
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := pruneTimeSeries(
+		cancelledCtx, tm.LocalTestCluster.Eng, roachpb.RKeyMin, roachpb.RKeyMax, tm.LocalTestCluster.DB, series,
+		hlc.Timestamp{WallTime: now}, storage.TimeSeriesPruneOptions{},
+	); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	tm.assertKeyCount(numSeries)
+
+	const batchesPerSecond = 2
+	limiter := &simulatedLimiter{
+		limiter: rate.NewLimiter(batchesPerSecond, 1 /* burst */),
+		now:     time.Unix(0, 0),
+	}
+	if _, _, err := pruneTimeSeries(
+		context.Background(), tm.LocalTestCluster.Eng, roachpb.RKeyMin, roachpb.RKeyMax, tm.LocalTestCluster.DB, series,
+		hlc.Timestamp{WallTime: now}, storage.TimeSeriesPruneOptions{DeleteLimiter: limiter},
+	); err != nil {
+		t.Fatal(err)
+	}
+	tm.assertKeyCount(0)
+
+	if a, e := len(limiter.waits), numSeries; a != e {
+		t.Fatalf("expected %d delete batches, got %d", e, a)
+	}
+	batchesBySecond := make(map[int64]int)
+	for _, w := range limiter.waits {
+		batchesBySecond[w.Unix()]++
+	}
+	for sec, count := range batchesBySecond {
+		if count != batchesPerSecond {
+			t.Errorf("%d delete batches issued in simulated second %d; expected %d",
+				count, sec, batchesPerSecond)
+		}
+	}
+}
+
+// TestPruneTimeSeriesSlices verifies that a series with a backlog of old data
+// is pruned in slices of bounded duration, each deleted by batches of a bounded
+// number of keys, and that a failure part way leaves the data deleted by the
+// earlier batches deleted and reports where pruning may resume.
+func TestPruneTimeSeriesSlices(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+	// Each of the series has one key per hour for ten days of old data, and
+	// one recent key which is retained.
+	const backlogKeys = 10 * 24
+	oldest := now - int64(365*24*time.Hour)
+	metrics := []string{"metric.a", "metric.b"}
+	for _, metric := range metrics {
+		var datapoints []tspb.TimeSeriesDatapoint
+		for i := 0; i < backlogKeys; i++ {
+			datapoints = append(datapoints, tspb.TimeSeriesDatapoint{
+				TimestampNanos: oldest + int64(i)*int64(time.Hour),
+				Value:          float64(i),
+			})
+		}
+		datapoints = append(datapoints, tspb.TimeSeriesDatapoint{TimestampNanos: now, Value: 1})
+		tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+			{Name: metric, Source: "source1", Datapoints: datapoints},
+		})
+	}
+	countKeys := func(name string) int {
+		prefix := makeDataKeySeriesPrefix(name, Resolution10s)
+		kvs, err := engine.Scan(tm.LocalTestCluster.Eng, engine.MakeMVCCMetadataKey(prefix),
+			engine.MakeMVCCMetadataKey(prefix.PrefixEnd()), 0 /* max */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(kvs)
+	}
+
+	// The deletions are issued through a DB which records each of them, and
+	// fails the one at index failAt, if any.
+	type deletion struct {
+		span    roachpb.Span
+		maxKeys int64
+		numKeys int64
+	}
+	var deletions []deletion
+	failAt := -1
+	db := client.NewDB(client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		arg, ok := ba.GetArg(roachpb.DeleteRange)
+		if !ok {
+			return tm.LocalTestCluster.Sender.Send(ctx, ba)
+		}
+		deletions = append(deletions, deletion{span: arg.Header(), maxKeys: ba.MaxSpanRequestKeys})
+		if len(deletions)-1 == failAt {
+			return nil, roachpb.NewErrorf("injected failure")
+		}
+		br, pErr := tm.LocalTestCluster.Sender.Send(ctx, ba)
+		if pErr == nil {
+			deletions[len(deletions)-1].numKeys = br.Responses[0].GetInner().Header().NumKeys
+		}
+		return br, pErr
+	}), tm.LocalTestCluster.Clock)
+
+	const maxKeysPerBatch = 10
+	opts := storage.TimeSeriesPruneOptions{
+		MaxSliceDuration: 24 * time.Hour,
+		MaxKeysPerBatch:  maxKeysPerBatch,
+	}
+	prune := func(name string) (storage.TimeSeriesPruneSummary, error) {
+		snap := tm.LocalTestCluster.Eng.NewSnapshot()
+		defer snap.Close()
+		var summary storage.TimeSeriesPruneSummary
+		opts.Summary = &summary
+		err := tm.DB.PruneTimeSeries(
+			context.Background(), snap, roachpb.RKeyMin, roachpb.RKeyMax, name, db,
+			hlc.Timestamp{WallTime: now}, opts,
+		)
+		return summary, err
+	}
+
+	// Each day of data is a slice of 24 keys, deleted by batches of 10, 10 and
+	// 4 keys ending at the end of the day.
+	if _, err := prune(metrics[0]); err != nil {
+		t.Fatal(err)
+	}
+	if a, e := countKeys(metrics[0]), 1; a != e {
+		t.Fatalf("expected %d keys to remain, got %d", e, a)
+	}
+	if a, e := len(deletions), 30; a != e {
+		t.Fatalf("expected %d deletion batches, got %d", e, a)
+	}
+	slabNanos := Resolution10s.SlabDuration()
+	firstSlab := oldest - oldest%slabNanos
+	for i, d := range deletions {
+		if d.maxKeys != maxKeysPerBatch {
+			t.Errorf("%d: expected a limit of %d keys, got %d", i, maxKeysPerBatch, d.maxKeys)
+		}
+		if a, e := d.numKeys, []int64{10, 10, 4}[i%3]; a != e {
+			t.Errorf("%d: expected %d keys to be deleted, got %d", i, e, a)
+		}
+		sliceEnd := firstSlab + int64(i/3+1)*int64(24*time.Hour)
+		if a, e := d.span.EndKey, MakeDataKey(metrics[0], "", Resolution10s, sliceEnd); !a.Equal(e) {
+			t.Errorf("%d: expected the deletion to end at %s, got %s", i, e, a)
+		}
+	}
+
+	// The fifth batch fails after the first slice and part of the second have
+	// been deleted.
+	deletions = nil
+	failAt = 4
+	summary, err := prune(metrics[1])
+	if !testutils.IsError(err, "injected failure") {
+		t.Fatalf("expected an injected failure, got %v", err)
+	}
+	if a, e := len(deletions), failAt+1; a != e {
+		t.Fatalf("expected %d deletion batches, got %d", e, a)
+	}
+	if a, e := summary.ResumeKey, deletions[failAt].span.Key; !a.Equal(e) {
+		t.Errorf("expected pruning to resume at %s, got %s", e, a)
+	}
+	if a, e := countKeys(metrics[1]), backlogKeys+1-34; a != e {
+		t.Fatalf("expected %d keys to remain, got %d", e, a)
+	}
+
+	// Pruning again deletes the rest of the old data.
+	failAt = -1
+	if _, err := prune(metrics[1]); err != nil {
+		t.Fatal(err)
+	}
+	if a, e := countKeys(metrics[1]), 1; a != e {
+		t.Fatalf("expected %d keys to remain, got %d", e, a)
+	}
+}
+
+// TestPruneTimeSeriesSplitSeries verifies that a range starting or ending in
+// the middle of a time series only prunes its own part of the series, reading
+// it through a snapshot bounded to the range, as the maintenance queue does.
+func TestPruneTimeSeriesSplitSeries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+	const name = "metric.split"
+	// The series has one key per hour for ten hours of old data, and one
+	// recent key which is retained.
+	const backlogKeys = 10
+	oldest := now - int64(365*24*time.Hour)
+	var datapoints []tspb.TimeSeriesDatapoint
+	for i := 0; i < backlogKeys; i++ {
+		datapoints = append(datapoints, tspb.TimeSeriesDatapoint{
+			TimestampNanos: oldest + int64(i)*int64(time.Hour),
+			Value:          float64(i),
+		})
+	}
+	datapoints = append(datapoints, tspb.TimeSeriesDatapoint{TimestampNanos: now, Value: 1})
+	tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+		{Name: name, Source: "source1", Datapoints: datapoints},
+	})
+	countKeys := func() int {
+		prefix := makeDataKeySeriesPrefix(name, Resolution10s)
+		kvs, err := engine.Scan(tm.LocalTestCluster.Eng, engine.MakeMVCCMetadataKey(prefix),
+			engine.MakeMVCCMetadataKey(prefix.PrefixEnd()), 0 /* max */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(kvs)
+	}
+
+	// The ranges are split at the key of the sixth hour of old data.
+	split := MakeDataKey(name, "source1", Resolution10s, oldest+6*int64(time.Hour))
+	prune := func(start, end roachpb.Key) storage.TimeSeriesPruneSummary {
+		snap := tm.LocalTestCluster.Eng.NewSnapshotBounded(
+			engine.MakeMVCCMetadataKey(start), engine.MakeMVCCMetadataKey(end),
+		)
+		defer snap.Close()
+		var summary storage.TimeSeriesPruneSummary
+		if err := tm.DB.PruneTimeSeries(
+			context.Background(), snap, roachpb.RKey(start), roachpb.RKey(end), name,
+			tm.LocalTestCluster.DB, hlc.Timestamp{WallTime: now}, storage.TimeSeriesPruneOptions{
+				MaxSliceDuration: time.Hour,
+				Summary:          &summary,
+			},
+		); err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	// The right-hand range starts in the middle of the series, and prunes the
+	// old data after the split only.
+	if summary := prune(split, keys.TimeseriesPrefix.PrefixEnd()); summary.KeysDeleted != 4 {
+		t.Errorf("expected 4 keys to be deleted by the right-hand range, got %d", summary.KeysDeleted)
+	}
+	if a, e := countKeys(), 7; a != e {
+		t.Fatalf("expected %d keys to remain, got %d", e, a)
+	}
+	// The left-hand range ends in the middle of the series, and prunes the old
+	// data before the split.
+	if summary := prune(keys.TimeseriesPrefix, split); summary.KeysDeleted != 6 {
+		t.Errorf("expected 6 keys to be deleted by the left-hand range, got %d", summary.KeysDeleted)
+	}
+	if a, e := countKeys(), 1; a != e {
+		t.Fatalf("expected %d keys to remain, got %d", e, a)
+	}
+}
+
+// TestPruneOrphanedTimeSeries verifies that all of the data of a time series
+// whose name is not known is deleted once its newest sample is older than the
+// grace period, and that neither a recently written unknown series nor a known
+// series is deleted.
+func TestPruneOrphanedTimeSeries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+	const gracePeriod = 24 * time.Hour
+	// Each series has data from ten days ago onwards, up to its newest sample.
+	newest := map[string]int64{
+		"metric.orphan":   now - int64(2*gracePeriod),
+		"metric.recent":   now - int64(time.Minute),
+		"metric.known":    now - int64(2*gracePeriod),
+		"metric.boundary": now - int64(gracePeriod) + int64(time.Minute),
+	}
+	for name, last := range newest {
+		for _, source := range []string{"source1", "source2"} {
+			tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{{
+				Name:   name,
+				Source: source,
+				Datapoints: []tspb.TimeSeriesDatapoint{
+					{TimestampNanos: now - int64(10*24*time.Hour), Value: 1},
+					{TimestampNanos: last, Value: 2},
+				},
+			}})
+		}
+	}
+	countKeys := func(name string) int {
+		prefix := makeDataKeyNamePrefix(name)
+		kvs, err := engine.Scan(tm.LocalTestCluster.Eng, engine.MakeMVCCMetadataKey(prefix),
+			engine.MakeMVCCMetadataKey(prefix.PrefixEnd()), 0 /* max */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(kvs)
+	}
+
+	// The deletions are issued through a DB which records them.
+	var deletions []roachpb.Span
+	db := client.NewDB(client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		if arg, ok := ba.GetArg(roachpb.DeleteRange); ok {
+			deletions = append(deletions, arg.Header())
+		}
+		return tm.LocalTestCluster.Sender.Send(ctx, ba)
+	}), tm.LocalTestCluster.Clock)
+
+	opts := storage.TimeSeriesPruneOptions{
+		OrphanGracePeriod: gracePeriod,
+		KnownNames:        map[string]struct{}{"metric.known": {}},
+	}
+	prune := func(name string) storage.TimeSeriesPruneSummary {
+		snap := tm.LocalTestCluster.Eng.NewSnapshot()
+		defer snap.Close()
+		var summary storage.TimeSeriesPruneSummary
+		opts.Summary = &summary
+		if err := tm.DB.PruneTimeSeries(
+			context.Background(), snap, roachpb.RKeyMin, roachpb.RKeyMax, name, db,
+			hlc.Timestamp{WallTime: now}, opts,
+		); err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	for _, name := range []string{"metric.recent", "metric.known", "metric.boundary"} {
+		keys := countKeys(name)
+		if summary := prune(name); summary.OrphansDeleted != 0 {
+			t.Errorf("%s: expected no orphans to be deleted, got %d", name, summary.OrphansDeleted)
+		}
+		if len(deletions) != 0 {
+			t.Errorf("%s: expected no deletions, got %v", name, deletions)
+		}
+		if a := countKeys(name); a != keys {
+			t.Errorf("%s: expected %d keys to remain, got %d", name, keys, a)
+		}
+	}
+
+	keys := countKeys("metric.orphan")
+	summary := prune("metric.orphan")
+	if len(deletions) != 1 {
+		t.Fatalf("expected 1 deletion, got %v", deletions)
+	}
+	if a, e := deletions[0].Key, makeDataKeyNamePrefix("metric.orphan"); !a.Equal(e) {
+		t.Errorf("expected the deletion to start at %s, got %s", e, a)
+	}
+	if a := countKeys("metric.orphan"); a != 0 {
+		t.Errorf("expected no keys to remain, got %d", a)
+	}
+	if summary.OrphansDeleted != 1 || summary.SeriesPruned != 1 || summary.KeysDeleted != int64(keys) {
+		t.Errorf("expected 1 orphan of %d keys to be deleted, got %+v", keys, summary)
+	}
+
+	// Without the known names, nothing is deleted as an orphan.
+	deletions = nil
+	opts.KnownNames = nil
+	if summary := prune("metric.recent"); summary.OrphansDeleted != 0 || len(deletions) != 0 {
+		t.Errorf("expected no deletions, got %v", deletions)
+	}
+}
+
+// TestPruneTimeSeriesRangeTombstones verifies that pruning with range deletion
+// tombstones leaves the same data as pruning key by key, while writing far
+// fewer entries to the engine, and that range tombstones refuse to delete
+// versioned values.
+func TestPruneTimeSeriesRangeTombstones(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+	// Two identical series, each of ten days of hourly data from ten sources,
+	// one slab per key.
+	metrics := []string{"metric.points", "metric.tombstones"}
+	for _, metric := range metrics {
+		for i := 0; i < 10; i++ {
+			data := tspb.TimeSeriesData{Name: metric, Source: fmt.Sprintf("source%d", i)}
+			for ts := now - int64(10*24*time.Hour); ts < now; ts += int64(time.Hour) {
+				data.Datapoints = append(data.Datapoints, datapoint(ts, float64(ts%1000)))
+			}
+			tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{data})
+		}
+	}
+
+	// remaining returns the data of the series, keyed by all but its name.
+	remaining := func(name string) map[string]roachpb.InternalTimeSeriesData {
+		prefix := makeDataKeyNamePrefix(name)
+		kvs, _, _, err := engine.MVCCScan(context.Background(), tm.Eng, prefix, prefix.PrefixEnd(),
+			math.MaxInt64, tm.Clock.Now(), true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[string]roachpb.InternalTimeSeriesData, len(kvs))
+		for _, kv := range kvs {
+			_, source, res, tsNanos, err := DecodeDataKey(kv.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := kv.Value.GetTimeseries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result[fmt.Sprintf("%s/%s/%d", source, res, tsNanos)] = data
+		}
+		return result
+	}
+	keysWritten := func() int64 {
+		stats, err := tm.Eng.GetStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.KeysWritten
+	}
+	prune := func(name string, useRangeTombstones bool) (written int64) {
+		before := keysWritten()
+		if _, _, err := pruneTimeSeries(
+			context.Background(),
+			tm.Eng,
+			roachpb.RKeyMin,
+			roachpb.RKeyMax,
+			tm.LocalTestCluster.DB,
+			[]timeSeriesResolutionInfo{{Name: name, Resolution: Resolution10s}},
+			hlc.Timestamp{WallTime: now},
+			storage.TimeSeriesPruneOptions{
+				Retention:          storage.TimeSeriesRetention{Resolution10s.String(): 24 * time.Hour},
+				UseRangeTombstones: useRangeTombstones,
+			},
+		); err != nil {
+			t.Fatal(err)
+		}
+		return keysWritten() - before
+	}
+
+	before := len(remaining(metrics[0]))
+	pointsWritten := prune(metrics[0], false)
+	tombstonesWritten := prune(metrics[1], true)
+
+	points, tombstones := remaining(metrics[0]), remaining(metrics[1])
+	if deleted := before - len(points); deleted < 2000 {
+		t.Fatalf("expected at least 2000 of %d keys to be pruned, got %d", before, deleted)
+	}
+	if !reflect.DeepEqual(points, tombstones) {
+		t.Errorf("expected %d keys to remain after pruning with range tombstones, got %d",
+			len(points), len(tombstones))
+	}
+	if pointsWritten < 2000 {
+		t.Errorf("expected pruning key by key to write at least 2000 keys, got %d", pointsWritten)
+	}
+	if tombstonesWritten*10 > pointsWritten {
+		t.Errorf("expected pruning with range tombstones to write far fewer than %d keys, got %d",
+			pointsWritten, tombstonesWritten)
+	}
+
+	// The range tombstones cover only part of the range, so the stats of the
+	// range must agree with a recomputation.
+	repl := tm.Store.LookupReplica(roachpb.RKey(keys.TimeseriesPrefix), nil)
+	if repl == nil {
+		t.Fatal("expected a replica for the time series data")
+	}
+	ms := repl.GetMVCCStats()
+	if ms.ContainsEstimates {
+		t.Fatal("expected the stats of the range not to contain estimates")
+	}
+	recomputed, err := storage.ComputeStatsForRange(repl.Desc(), tm.Eng, ms.LastUpdateNanos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms != recomputed {
+		t.Fatalf("expected the range's stats to agree with recomputation: got\n%+v\nrecomputed\n%+v",
+			ms, recomputed)
+	}
+
+	// A range tombstone must not wipe out the history of versioned values.
+	ctx := context.Background()
+	versioned := MakeDataKey("test.versioned", "", Resolution10s, now)
+	if err := tm.LocalTestCluster.DB.Put(ctx, versioned, "value"); err != nil {
+		t.Fatal(err)
+	}
+	b := &client.Batch{}
+	b.AddRawRequest(&roachpb.DeleteRangeRequest{
+		Span:              roachpb.Span{Key: versioned, EndKey: versioned.PrefixEnd()},
+		Inline:            true,
+		UseRangeTombstone: true,
+	})
+	if err := tm.LocalTestCluster.DB.Run(ctx, b); !testutils.IsError(err, "versioned values") {
+		t.Fatalf("expected the deletion of versioned values to fail, got %v", err)
+	}
+	if kv, err := tm.LocalTestCluster.DB.Get(ctx, versioned); err != nil {
+		t.Fatal(err)
+	} else if !kv.Exists() {
+		t.Fatal("expected the versioned value to remain")
+	}
+}
+
+// TestPruneTimeSeriesSources verifies that pruning dead sources deletes all of
+// their data, regardless of its age, and leaves the data of the other sources
+// untouched.
+func TestPruneTimeSeriesSources(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+	metrics := []string{"metric.a", "metric.z"}
+	sources := []string{"1", "2", "3"}
+	for _, metric := range metrics {
+		for _, source := range sources {
+			for _, resolution := range []Resolution{Resolution10s, resolution1ns} {
+				tm.storeTimeSeriesData(resolution, []tspb.TimeSeriesData{
+					{
+						Name:   metric,
+						Source: source,
+						Datapoints: []tspb.TimeSeriesDatapoint{
+							{
+								TimestampNanos: now,
+								Value:          1,
+							},
+							{
+								TimestampNanos: now - int64(365*24*time.Hour),
+								Value:          2,
+							},
+						},
+					},
+				})
+			}
+		}
+	}
+	tm.assertKeyCount(24)
+
+	ctx := context.Background()
+	snap := tm.LocalTestCluster.Eng.NewSnapshot()
+	defer snap.Close()
+	// Source "4" has no data.
+	dead := []string{"2", "4"}
+	summary, err := tm.DB.PruneTimeSeriesSources(
+		ctx, snap, roachpb.RKeyMin, roachpb.RKeyMax, dead, tm.LocalTestCluster.DB, nil, /* limiter */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.KeysDeleted != 8 || summary.BytesDeleted == 0 {
+		t.Errorf("expected 8 keys and some bytes to be deleted, got %+v", summary)
+	}
+	if expected := map[string]int64{"2": 8}; !reflect.DeepEqual(summary.KeysDeletedBySource, expected) {
+		t.Errorf("expected keys deleted by source %v, got %v", expected, summary.KeysDeletedBySource)
+	}
+
+	// Remove the data of the dead sources from the model.
+	for k := range tm.modelData {
+		_, source, _, _, err := DecodeDataKey(roachpb.Key(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range dead {
+			if source == s {
+				delete(tm.modelData, k)
+			}
+		}
+	}
+	tm.assertModelCorrect()
+	tm.assertKeyCount(16)
+}
@@ -29,6 +29,8 @@ func (r Resolution) String() string {
 	switch r {
 	case Resolution10s:
 		return "10s"
+	case Resolution30m:
+		return "30m"
 	case resolution1ns:
 		return "1ns"
 	}
@@ -40,6 +42,9 @@ func (r Resolution) String() string {
 const (
 	// Resolution10s stores data with a sample resolution of 10 seconds.
 	Resolution10s Resolution = 1
+	// Resolution30m stores data with a sample resolution of 30 minutes. Data at
+	// this resolution is produced by rolling up older Resolution10s data.
+	Resolution30m Resolution = 2
 	// resolution1ns stores data with a sample resolution of 1 nanosecond. Used
 	// only for testing.
 	resolution1ns Resolution = 999
@@ -50,6 +55,7 @@ const (
 // nanoseconds.
 var sampleDurationByResolution = map[Resolution]int64{
 	Resolution10s: int64(time.Second * 10),
+	Resolution30m: int64(time.Minute * 30),
 	resolution1ns: 1, // 1ns resolution only for tests.
 }
 
@@ -59,6 +65,7 @@ var sampleDurationByResolution = map[Resolution]int64{
 // expressed in nanoseconds.
 var slabDurationByResolution = map[Resolution]int64{
 	Resolution10s: int64(time.Hour),
+	Resolution30m: int64(time.Hour * 24),
 	resolution1ns: 10, // 1ns resolution only for tests.
 }
 
@@ -67,9 +74,17 @@ var slabDurationByResolution = map[Resolution]int64{
 // eligible for deletion. Thresholds are specified in nanoseconds.
 var pruneThresholdByResolution = map[Resolution]int64{
 	Resolution10s: (30 * 24 * time.Hour).Nanoseconds(),
+	Resolution30m: (365 * 24 * time.Hour).Nanoseconds(),
 	resolution1ns: time.Second.Nanoseconds(),
 }
 
+// rollupResolutionByResolution maps a resolution to the lower resolution into
+// which its data is rolled up before being pruned. Resolutions which are not
+// present are pruned without being rolled up.
+var rollupResolutionByResolution = map[Resolution]Resolution{
+	Resolution10s: Resolution30m,
+}
+
 // SampleDuration returns the sample duration corresponding to this resolution
 // value, expressed in nanoseconds.
 func (r Resolution) SampleDuration() int64 {
@@ -101,3 +116,11 @@ func (r Resolution) PruneThreshold() int64 {
 	}
 	return threshold
 }
+
+// RollupResolution returns the resolution into which data at this resolution
+// is rolled up before it is pruned, and false if data at this resolution is
+// not rolled up.
+func (r Resolution) RollupResolution() (Resolution, bool) {
+	target, ok := rollupResolutionByResolution[r]
+	return target, ok
+}
@@ -0,0 +1,383 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+)
+
+// rollupScanBatchSize is the maximum number of source keys read by a single
+// scan while computing rollups.
+const rollupScanBatchSize = 1000
+
+// rollupIngestMinRows is the minimum number of rollup keys computed from a
+// single scan for them to be ingested as an SST, if a RollupIngester is set.
+// Fewer keys are written as KV merges, as building and ingesting an SST isn't
+// worthwhile for them.
+const rollupIngestMinRows = 100
+
+// RollupIngester ingests an SST of rolled up time series data as a single
+// bulk write, rather than writing each key through the normal KV write path.
+// The keys of the SST are inline MVCC values within the supplied span, which
+// are merged into the existing data by the time series merge operator, as KV
+// merges are, in a single atomic write. Ingesting the same SST again must have
+// no further effect.
+type RollupIngester func(ctx context.Context, span roachpb.Span, sst []byte) error
+
+// SetRollupIngester sets the ingester used by RollupTimeSeries to write large
+// batches of rollups, which are otherwise written as KV merges. It must be
+// called before the DB is used.
+func (tsdb *DB) SetRollupIngester(ingester RollupIngester) {
+	tsdb.rollupIngester = ingester
+}
+
+// WriteBatchRollupIngester returns a RollupIngester which writes the data of
+// each SST through the KV client as a single WriteBatch request with the Merge
+// flag set, which merges the data into the span as one raft command. It must
+// only be used where WriteBatch is implemented, as it is by CCL builds (see
+// storage.WriteBatchImplemented). Where the span straddles ranges, or the
+// range is evaluated by a node unaware of the Merge flag, the ingestion fails
+// and the rollups are written as KV merges instead.
+func WriteBatchRollupIngester(db *client.DB) RollupIngester {
+	return func(ctx context.Context, span roachpb.Span, sst []byte) error {
+		reader := engine.MakeRocksDBSstFileReader()
+		defer reader.Close()
+		if err := reader.IngestExternalFile(sst); err != nil {
+			return err
+		}
+		var batch engine.RocksDBBatchBuilder
+		if err := reader.Iterate(
+			engine.MakeMVCCMetadataKey(span.Key),
+			engine.MakeMVCCMetadataKey(span.EndKey),
+			func(kv engine.MVCCKeyValue) (bool, error) {
+				batch.Merge(kv.Key, kv.Value)
+				return false, nil
+			},
+		); err != nil {
+			return err
+		}
+		b := &client.Batch{}
+		b.AddRawRequest(&roachpb.WriteBatchRequest{
+			Span:     span,
+			DataSpan: span,
+			Data:     batch.Finish(),
+			Merge:    true,
+		})
+		return db.Run(ctx, b)
+	}
+}
+
+// RollupTimeSeries downsamples data for any time series found in the supplied
+// key range which is old enough to be pruned, writing it at the lower
+// resolution returned by Resolution.RollupResolution. It is intended to be
+// called before PruneTimeSeries, so that rolled up data is materialized before
+// the source data is deleted.
+//
+// As with PruneTimeSeries, the snapshot is used only to discover the names of
+// time series stored in the range; the KV client is used to read the source
+// data and write the rollups. The SSTs of ingested rollups are built in the
+// supplied temporary directory, such as the store's temp prefix.
+func (tsdb *DB) RollupTimeSeries(
+	ctx context.Context,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	db *client.DB,
+	timestamp hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+	tempDir string,
+) error {
+	series, err := findTimeSeries(snapshot, start, end, timestamp, retention)
+	if err != nil {
+		return err
+	}
+	var ingester rollupSSTIngester
+	if tsdb.rollupIngester != nil {
+		ingester = rollupSSTIngester{ingest: tsdb.rollupIngester, tempDir: tempDir}
+	}
+	return rollupTimeSeries(ctx, db, series, timestamp, retention, ingester)
+}
+
+// rollupSSTIngester is a RollupIngester along with the directory in which the
+// SSTs it is passed are built.
+type rollupSSTIngester struct {
+	ingest  RollupIngester
+	tempDir string
+}
+
+// rollupTimeSeries computes rollups for the supplied set of time series. For
+// each time series which has a rollup resolution, all data older than the
+// pruning threshold of its resolution under the supplied retention is
+// downsampled and merged into the rollup resolution. A resolution which is
+// never pruned is never rolled up.
+//
+// Rollups are idempotent: the rollup of a source slab depends only on that
+// slab, and each source slab maps to a distinct set of samples in a single
+// rollup slab. Because the time series merge operator keeps only the last
+// written value for each sample, rolling up the same data again (including
+// concurrently on another node) rewrites the same values. Data which has
+// already been pruned produces no rollup samples, leaving earlier rollups
+// intact.
+//
+// If an ingester is supplied, the rollups computed from a scan are ingested as
+// an SST instead, if there are at least rollupIngestMinRows of them (see
+// ingestRollups). Should the ingestion fail, they are written as KV merges.
+func rollupTimeSeries(
+	ctx context.Context,
+	db *client.DB,
+	timeSeriesList []timeSeriesResolutionInfo,
+	now hlc.Timestamp,
+	retention storage.TimeSeriesRetention,
+	ingester rollupSSTIngester,
+) error {
+	thresholds := computeThresholds(now.WallTime, retention)
+
+	for _, timeSeries := range timeSeriesList {
+		target, ok := timeSeries.Resolution.RollupResolution()
+		if !ok {
+			continue
+		}
+		threshold, ok := thresholds[timeSeries.Resolution]
+		if !ok {
+			continue
+		}
+
+		begin := makeDataKeySeriesPrefix(timeSeries.Name, timeSeries.Resolution)
+		end := MakeDataKey(timeSeries.Name, "", timeSeries.Resolution, threshold)
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			kvs, err := db.Scan(ctx, begin, end, rollupScanBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(kvs) == 0 {
+				break
+			}
+
+			// Several source slabs of a source roll up into the same slab of
+			// the target resolution, so their rollups are combined by key.
+			rollups := make(map[string]roachpb.InternalTimeSeriesData)
+			for i := range kvs {
+				_, source, _, _, err := DecodeDataKey(kvs[i].Key)
+				if err != nil {
+					return err
+				}
+				var data roachpb.InternalTimeSeriesData
+				if err := kvs[i].ValueProto(&data); err != nil {
+					return err
+				}
+				rollup := rollupInternalData(data, target)
+				if len(rollup.Samples) == 0 {
+					continue
+				}
+				key := string(MakeDataKey(timeSeries.Name, source, target, rollup.StartTimestampNanos))
+				if existing, ok := rollups[key]; ok {
+					rollup.Samples = mergeRollupSamples(existing.Samples, rollup.Samples)
+				}
+				rollups[key] = rollup
+			}
+			if ingester.ingest != nil && len(rollups) >= rollupIngestMinRows {
+				if err := ingestRollups(ctx, ingester, rollups); err == nil {
+					rollups = nil
+				} else if ctx.Err() != nil {
+					return err
+				} else {
+					log.VEventf(ctx, 2, "writing rollups as KV merges after failing to ingest them: %s", err)
+				}
+			}
+			if len(rollups) > 0 {
+				if err := mergeRollups(ctx, db, rollups); err != nil {
+					return err
+				}
+			}
+
+			if len(kvs) < rollupScanBatchSize {
+				break
+			}
+			begin = kvs[len(kvs)-1].Key.Next()
+		}
+	}
+
+	return nil
+}
+
+// mergeRollups writes the supplied rollups, keyed by their keys, as KV merges.
+func mergeRollups(
+	ctx context.Context, db *client.DB, rollups map[string]roachpb.InternalTimeSeriesData,
+) error {
+	b := &client.Batch{}
+	for _, key := range sortedRollupKeys(rollups) {
+		rollup := rollups[key]
+		var value roachpb.Value
+		if err := value.SetProto(&rollup); err != nil {
+			return err
+		}
+		b.AddRawRequest(&roachpb.MergeRequest{
+			Span:  roachpb.Span{Key: roachpb.Key(key)},
+			Value: value,
+		})
+	}
+	return db.Run(ctx, b)
+}
+
+// ingestRollups writes the supplied rollups, keyed by their keys, as an SST
+// which is passed to the ingester. The ingester merges the SST into the
+// existing data, as KV merges would, so no sample previously written to the
+// span, including those rolled up from source data since pruned, nor any
+// written concurrently, is lost. The SST depends only on the rollups, so when
+// a rollup is retried, the same source data regenerates a byte-identical SST.
+func ingestRollups(
+	ctx context.Context, ingester rollupSSTIngester, rollups map[string]roachpb.InternalTimeSeriesData,
+) error {
+	keys := sortedRollupKeys(rollups)
+	span := roachpb.Span{
+		Key:    roachpb.Key(keys[0]),
+		EndKey: roachpb.Key(keys[len(keys)-1]).Next(),
+	}
+	sst, err := buildRollupSST(ingester.tempDir, keys, rollups)
+	if err != nil {
+		return err
+	}
+	return ingester.ingest(ctx, span, sst)
+}
+
+// buildRollupSST returns an SST of the supplied rollups as inline values,
+// written in the order of the supplied keys. The SST is built in a directory
+// created under tempPrefix, which is removed once it is read.
+func buildRollupSST(
+	tempPrefix string, keys []string, rollups map[string]roachpb.InternalTimeSeriesData,
+) ([]byte, error) {
+	dir, err := ioutil.TempDir(tempPrefix, "ts-rollup")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, "rollup.sst")
+
+	sst := engine.MakeRocksDBSstFileWriter()
+	if err := sst.Open(path); err != nil {
+		return nil, err
+	}
+	// Close is idempotent, so it's safe to call it again on success.
+	defer func() {
+		_ = sst.Close()
+	}()
+	for _, key := range keys {
+		rollup := rollups[key]
+		var value roachpb.Value
+		if err := value.SetProto(&rollup); err != nil {
+			return nil, err
+		}
+		meta, err := protoutil.Marshal(&enginepb.MVCCMetadata{RawBytes: value.RawBytes})
+		if err != nil {
+			return nil, err
+		}
+		if err := sst.Add(engine.MVCCKeyValue{
+			Key:   engine.MakeMVCCMetadataKey(roachpb.Key(key)),
+			Value: meta,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := sst.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// sortedRollupKeys returns the keys of the supplied rollups in order.
+func sortedRollupKeys(rollups map[string]roachpb.InternalTimeSeriesData) []string {
+	keys := make([]string, 0, len(rollups))
+	for key := range rollups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeRollupSamples merges two lists of samples sorted by offset, as the
+// time series merge operator does: where both have a sample at an offset, the
+// sample in b is kept.
+func mergeRollupSamples(a, b []roachpb.InternalTimeSeriesSample) []roachpb.InternalTimeSeriesSample {
+	merged := make([]roachpb.InternalTimeSeriesSample, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].Offset < b[j].Offset):
+			merged = append(merged, a[i])
+			i++
+		case i == len(a) || b[j].Offset < a[i].Offset:
+			merged = append(merged, b[j])
+			j++
+		default:
+			merged = append(merged, b[j])
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+// rollupInternalData downsamples a single slab of time series data into the
+// supplied (lower) resolution. The returned data belongs to the target
+// resolution's slab containing the start of the source slab; each target
+// sample records the average of the source samples which fall within it.
+func rollupInternalData(
+	src roachpb.InternalTimeSeriesData, target Resolution,
+) roachpb.InternalTimeSeriesData {
+	sampleDuration := target.SampleDuration()
+	result := roachpb.InternalTimeSeriesData{
+		StartTimestampNanos: src.StartTimestampNanos - src.StartTimestampNanos%target.SlabDuration(),
+		SampleDurationNanos: sampleDuration,
+	}
+
+	var counts []int
+	for _, sample := range src.Samples {
+		ts := src.StartTimestampNanos + int64(sample.Offset)*src.SampleDurationNanos
+		offset := int32((ts - result.StartTimestampNanos) / sampleDuration)
+		n := len(result.Samples)
+		if n == 0 || result.Samples[n-1].Offset != offset {
+			result.Samples = append(result.Samples, roachpb.InternalTimeSeriesSample{
+				Offset: offset,
+				Count:  1,
+			})
+			counts = append(counts, 0)
+			n++
+		}
+		result.Samples[n-1].Sum += sample.Average()
+		counts[n-1]++
+	}
+	for i := range result.Samples {
+		result.Samples[i].Sum /= float64(counts[i])
+	}
+	return result
+}
@@ -0,0 +1,287 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ts
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/kr/pretty"
+)
+
+func TestRollupInternalData(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	day := Resolution30m.SlabDuration()
+	// A 10s slab beginning three hours into an arbitrary day.
+	dayStart := 17000 * day
+	src := roachpb.InternalTimeSeriesData{
+		StartTimestampNanos: dayStart + int64(3*time.Hour),
+		SampleDurationNanos: Resolution10s.SampleDuration(),
+		Samples: []roachpb.InternalTimeSeriesSample{
+			{Offset: 0, Count: 1, Sum: 1},
+			{Offset: 1, Count: 1, Sum: 3},
+			// Deprecated samples may contain multiple measurements.
+			{Offset: 2, Count: 2, Sum: 10},
+			// 30 minutes into the slab.
+			{Offset: 180, Count: 1, Sum: 7},
+		},
+	}
+
+	expected := roachpb.InternalTimeSeriesData{
+		StartTimestampNanos: dayStart,
+		SampleDurationNanos: Resolution30m.SampleDuration(),
+		Samples: []roachpb.InternalTimeSeriesSample{
+			{Offset: 6, Count: 1, Sum: 3},
+			{Offset: 7, Count: 1, Sum: 7},
+		},
+	}
+	if a, e := rollupInternalData(src, Resolution30m), expected; !reflect.DeepEqual(a, e) {
+		t.Fatalf("rollup %v did not match expected value %v: %s", a, e, pretty.Diff(a, e))
+	}
+}
+
+func TestRollupTimeSeries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// Arbitrary timestamp, aligned to the start of a day.
+	var now int64 = 1475712000 * 1e9
+	old := now - int64(365*24*time.Hour)
+
+	tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+		{
+			Name:   "metric.a",
+			Source: "source1",
+			Datapoints: []tspb.TimeSeriesDatapoint{
+				{TimestampNanos: old, Value: 1},
+				{TimestampNanos: old + int64(10*time.Second), Value: 3},
+				{TimestampNanos: now, Value: 100},
+			},
+		},
+	})
+	tm.assertModelCorrect()
+
+	series := []timeSeriesResolutionInfo{{Name: "metric.a", Resolution: Resolution10s}}
+	rollup := func() {
+		if err := rollupTimeSeries(
+			context.TODO(), tm.LocalTestCluster.DB, series, hlc.Timestamp{WallTime: now}, nil,
+			rollupSSTIngester{},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rolling up the same data more than once is idempotent.
+	rollup()
+	rollup()
+
+	rollupKey := MakeDataKey("metric.a", "source1", Resolution30m, old)
+	actual := tm.getActualData()
+	if a, e := len(actual), len(tm.modelData)+1; a != e {
+		t.Fatalf("expected %d keys after rollup, found %d", e, a)
+	}
+	value, ok := actual[string(rollupKey)]
+	if !ok {
+		t.Fatalf("expected rollup key %s to be present", rollupKey)
+	}
+	data, err := value.GetTimeseries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := roachpb.InternalTimeSeriesData{
+		StartTimestampNanos: old - old%Resolution30m.SlabDuration(),
+		SampleDurationNanos: Resolution30m.SampleDuration(),
+		Samples: []roachpb.InternalTimeSeriesSample{
+			{Offset: int32((old % Resolution30m.SlabDuration()) / Resolution30m.SampleDuration()), Count: 1, Sum: 2},
+		},
+	}
+	if a, e := data, expected; !reflect.DeepEqual(a, e) {
+		t.Fatalf("rollup %v did not match expected value %v: %s", a, e, pretty.Diff(a, e))
+	}
+}
+
+// TestRollupTimeSeriesIngest verifies that rollups ingested as SSTs are read
+// back identically to rollups written as KV merges, that retrying an ingested
+// rollup regenerates a byte-identical SST, that small batches of rollups are
+// written as KV merges regardless, and that ingested rollups are merged into
+// the existing data of their slabs rather than replacing it.
+func TestRollupTimeSeriesIngest(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModel(t)
+	tm.Start()
+	defer tm.Stop()
+	ctx := context.TODO()
+
+	// Arbitrary timestamp, aligned to the start of a day.
+	var now int64 = 1475712000 * 1e9
+	old := now - int64(365*24*time.Hour)
+
+	// Identical data for two series, with enough sources for their rollups to
+	// be ingested. Each source has data in two source slabs which roll up into
+	// the same target slab.
+	var data []tspb.TimeSeriesData
+	for _, name := range []string{"metric.kv", "metric.sst"} {
+		for i := 0; i < rollupIngestMinRows; i++ {
+			data = append(data, tspb.TimeSeriesData{
+				Name:   name,
+				Source: fmt.Sprintf("source%03d", i),
+				Datapoints: []tspb.TimeSeriesDatapoint{
+					{TimestampNanos: old, Value: float64(i)},
+					{TimestampNanos: old + int64(time.Hour), Value: float64(2 * i)},
+				},
+			})
+		}
+	}
+	tm.storeTimeSeriesData(Resolution10s, data)
+
+	// The ingester records the SSTs it is passed, and merges their data into
+	// the engine, as WriteBatchRollupIngester does.
+	var ssts [][]byte
+	ingester := func(ctx context.Context, span roachpb.Span, sst []byte) error {
+		ssts = append(ssts, sst)
+		reader := engine.MakeRocksDBSstFileReader()
+		defer reader.Close()
+		if err := reader.IngestExternalFile(sst); err != nil {
+			return err
+		}
+		return reader.Iterate(
+			engine.MakeMVCCMetadataKey(span.Key),
+			engine.MakeMVCCMetadataKey(span.EndKey),
+			func(kv engine.MVCCKeyValue) (bool, error) {
+				return false, tm.Eng.Merge(kv.Key, kv.Value)
+			},
+		)
+	}
+	rollup := func(name string, ingester RollupIngester) {
+		series := []timeSeriesResolutionInfo{{Name: name, Resolution: Resolution10s}}
+		if err := rollupTimeSeries(
+			ctx, tm.LocalTestCluster.DB, series, hlc.Timestamp{WallTime: now}, nil,
+			rollupSSTIngester{ingest: ingester, tempDir: tm.Eng.GetTempDir()},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rollup("metric.kv", nil)
+	rollup("metric.sst", ingester)
+	if len(ssts) != 1 {
+		t.Fatalf("expected 1 ingested SST, got %d", len(ssts))
+	}
+	// Retrying the rollup regenerates the same SST.
+	rollup("metric.sst", ingester)
+	if len(ssts) != 2 {
+		t.Fatalf("expected 2 ingested SSTs, got %d", len(ssts))
+	}
+	if !bytes.Equal(ssts[0], ssts[1]) {
+		t.Fatal("expected a retried rollup to ingest an identical SST")
+	}
+
+	actual := tm.getActualData()
+	for i := 0; i < rollupIngestMinRows; i++ {
+		source := fmt.Sprintf("source%03d", i)
+		kvKey := MakeDataKey("metric.kv", source, Resolution30m, old)
+		sstKey := MakeDataKey("metric.sst", source, Resolution30m, old)
+		kvValue, ok := actual[string(kvKey)]
+		if !ok {
+			t.Fatalf("expected rollup key %s to be present", kvKey)
+		}
+		sstValue, ok := actual[string(sstKey)]
+		if !ok {
+			t.Fatalf("expected rollup key %s to be present", sstKey)
+		}
+		kvData, err := kvValue.GetTimeseries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sstData, err := sstValue.GetTimeseries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvData.Samples) != 2 {
+			t.Fatalf("expected 2 rollup samples for %s, got %v", source, kvData)
+		}
+		if a, e := sstData, kvData; !reflect.DeepEqual(a, e) {
+			t.Fatalf("ingested rollup %v did not match merged rollup %v: %s", a, e, pretty.Diff(a, e))
+		}
+	}
+
+	// A series with too few sources is rolled up with KV merges, even with an
+	// ingester.
+	tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{{
+		Name:       "metric.small",
+		Source:     "source1",
+		Datapoints: []tspb.TimeSeriesDatapoint{{TimestampNanos: old, Value: 1}},
+	}})
+	rollup("metric.small", ingester)
+	if len(ssts) != 2 {
+		t.Fatalf("expected no further SSTs to be ingested, got %d", len(ssts)-2)
+	}
+	if _, ok := tm.getActualData()[string(MakeDataKey("metric.small", "source1", Resolution30m, old))]; !ok {
+		t.Fatal("expected the small rollup to be written")
+	}
+
+	// A sample already in a target slab, such as one rolled up from source
+	// data since pruned, is kept when rollups are ingested into the slab.
+	prunedOffset := int32((old%Resolution30m.SlabDuration())/Resolution30m.SampleDuration()) + 1
+	existingKey := MakeDataKey("metric.existing", "source000", Resolution30m, old)
+	existing := roachpb.InternalTimeSeriesData{
+		StartTimestampNanos: old - old%Resolution30m.SlabDuration(),
+		SampleDurationNanos: Resolution30m.SampleDuration(),
+		Samples: []roachpb.InternalTimeSeriesSample{
+			{Offset: prunedOffset, Count: 1, Sum: 42},
+		},
+	}
+	if err := mergeRollups(ctx, tm.LocalTestCluster.DB, map[string]roachpb.InternalTimeSeriesData{
+		string(existingKey): existing,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data = nil
+	for i := 0; i < rollupIngestMinRows; i++ {
+		data = append(data, tspb.TimeSeriesData{
+			Name:       "metric.existing",
+			Source:     fmt.Sprintf("source%03d", i),
+			Datapoints: []tspb.TimeSeriesDatapoint{{TimestampNanos: old, Value: float64(i)}},
+		})
+	}
+	tm.storeTimeSeriesData(Resolution10s, data)
+	rollup("metric.existing", ingester)
+	if len(ssts) != 3 {
+		t.Fatalf("expected 1 further ingested SST, got %d", len(ssts)-2)
+	}
+	value, ok := tm.getActualData()[string(existingKey)]
+	if !ok {
+		t.Fatalf("expected rollup key %s to be present", existingKey)
+	}
+	merged, err := value.GetTimeseries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Samples) != 2 || merged.Samples[1] != existing.Samples[0] {
+		t.Fatalf("expected the existing sample to be kept alongside the ingested one, got %v", merged)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package hlc
+
+import "github.com/pkg/errors"
+
+// TimestampWindow is the time range [Start, End) of an incremental iteration,
+// such as that of an incremental backup: the versions written at or after
+// Start and before End, and the intents which may commit in that time. It is
+// the one definition of the window semantics shared by the iteration and the
+// filtering of the sstables it reads.
+//
+// A window with Start equal to End is empty, and one which ends at a version
+// or intent excludes it: a transaction whose intent is at End can only commit
+// at End or later.
+type TimestampWindow struct {
+	Start, End Timestamp
+}
+
+// Validate returns an error if the window ends before it starts.
+func (w TimestampWindow) Validate() error {
+	if w.End.Less(w.Start) {
+		return errors.Errorf("end time %s precedes start time %s", w.End, w.Start)
+	}
+	return nil
+}
+
+// Contains returns whether a version or intent at ts is in the window.
+func (w TimestampWindow) Contains(ts Timestamp) bool {
+	return !ts.Less(w.Start) && ts.Less(w.End)
+}
+
+// Overlaps returns whether any timestamp in [min, max] is in the window, so
+// that data with timestamps in that range, such as an sstable, must be read
+// by an iteration over it. Overlaps(ts, ts) equals Contains(ts).
+func (w TimestampWindow) Overlaps(min, max Timestamp) bool {
+	return w.Start.Less(w.End) && !max.Less(w.Start) && min.Less(w.End)
+}
+
+func (w TimestampWindow) String() string {
+	return "[" + w.Start.String() + ", " + w.End.String() + ")"
+}
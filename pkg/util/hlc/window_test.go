@@ -0,0 +1,98 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package hlc
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTimestampWindowValidate(t *testing.T) {
+	testCases := []struct {
+		start, end Timestamp
+		valid      bool
+	}{
+		{makeTS(0, 0), makeTS(0, 0), true},
+		{makeTS(1, 0), makeTS(1, 0), true},
+		{makeTS(1, 0), makeTS(1, 1), true},
+		{makeTS(1, 1), makeTS(2, 0), true},
+		{makeTS(1, 1), makeTS(1, 0), false},
+		{makeTS(2, 0), makeTS(1, 5), false},
+	}
+	for _, tc := range testCases {
+		w := TimestampWindow{Start: tc.start, End: tc.end}
+		if err := w.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%t, got %v", w, tc.valid, err)
+		}
+	}
+}
+
+// TestTimestampWindowBoundaries checks Contains and Overlaps at every
+// timestamp within a logical tick of either end of windows whose ends differ
+// in their wall times, their logical ticks, or not at all.
+func TestTimestampWindowBoundaries(t *testing.T) {
+	windows := []TimestampWindow{
+		{Start: makeTS(1, 0), End: makeTS(2, 0)},
+		{Start: makeTS(1, 1), End: makeTS(1, 3)},
+		{Start: makeTS(1, 1), End: makeTS(1, 2)},
+		{Start: makeTS(1, 1), End: makeTS(1, 1)},
+		{Start: makeTS(2, 0), End: makeTS(2, 0)},
+	}
+	for _, w := range windows {
+		t.Run(w.String(), func(t *testing.T) {
+			var timestamps []Timestamp
+			for _, end := range []Timestamp{w.Start, w.End} {
+				timestamps = append(timestamps, end.Prev(), end, end.Next())
+			}
+			for _, ts := range timestamps {
+				// The definition, in terms of comparisons with both ends.
+				e := (w.Start == ts || w.Start.Less(ts)) && ts.Less(w.End)
+				if a := w.Contains(ts); a != e {
+					t.Errorf("Contains(%s): expected %t, got %t", ts, e, a)
+				}
+				if a := w.Overlaps(ts, ts); a != e {
+					t.Errorf("Overlaps(%s, %[1]s): expected %t, got %t", ts, e, a)
+				}
+			}
+			// A range of timestamps overlaps the window iff one of them does.
+			for i, min := range timestamps {
+				for _, max := range timestamps[i:] {
+					if max.Less(min) {
+						continue
+					}
+					var e bool
+					for ts := min; !max.Less(ts); ts = ts.Next() {
+						e = e || w.Overlaps(ts, ts)
+						if ts.Logical > 10 {
+							// Skip to the next wall time, as the windows have no
+							// ends at higher logical ticks.
+							ts = makeTS(ts.WallTime+1, 0).Prev()
+						}
+					}
+					if a := w.Overlaps(min, max); a != e {
+						t.Errorf("Overlaps(%s, %s): expected %t, got %t", min, max, e, a)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTimestampWindowString(t *testing.T) {
+	w := TimestampWindow{Start: makeTS(1, 2), End: makeTS(3, 4)}
+	if a, e := w.String(), fmt.Sprintf("[%s, %s)", w.Start, w.End); a != e {
+		t.Errorf("expected %s, got %s", e, a)
+	}
+}
@@ -558,3 +558,16 @@ func IngestRemoteSpans(ctx context.Context, remoteSpans [][]byte) error {
 	}
 	return ImportRemoteSpans(span, rawSpans)
 }
+
+// TraceIDFromContext returns the ID of the trace of the span in the context,
+// or zero if there is no span or it isn't one of this package's spans.
+func TraceIDFromContext(ctx context.Context) uint64 {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return 0
+	}
+	if sc, ok := span.Context().(*spanContext); ok {
+		return sc.TraceID
+	}
+	return 0
+}